@@ -19,9 +19,20 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/sema"
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/fs/compositefs"
+	"github.com/restic/restic/internal/fs/ocifs"
+	"github.com/restic/restic/internal/fs/s3fs"
+	"github.com/restic/restic/internal/fs/sftpfs"
+	"github.com/restic/restic/internal/fs/snapshotfs"
+	"github.com/restic/restic/internal/fs/tarfs"
+	"github.com/restic/restic/internal/fs/transformfs"
+	"github.com/restic/restic/internal/fs/webdavfs"
+	"github.com/restic/restic/internal/fs/zipfs"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 	"github.com/restic/restic/internal/textfile"
@@ -45,7 +56,8 @@ Exit status is 1 if there was a fatal error (no snapshot created).
 Exit status is 3 if some source data could not be read (incomplete snapshot created).
 `,
 	PreRun: func(cmd *cobra.Command, args []string) {
-		if backupOptions.Host == "" {
+		// with --from-snapshot, the host name of the snapshot is used by default
+		if backupOptions.Host == "" && backupOptions.FromSnapshot == "" {
 			hostname, err := os.Hostname()
 			if err != nil {
 				debug.Log("os.Hostname() returned err: %v", err)
@@ -88,29 +100,52 @@ Exit status is 3 if some source data could not be read (incomplete snapshot crea
 type BackupOptions struct {
 	excludePatternOptions
 
-	Parent            string
-	GroupBy           restic.SnapshotGroupByOptions
-	Force             bool
-	ExcludeOtherFS    bool
-	ExcludeIfPresent  []string
-	ExcludeCaches     bool
-	ExcludeLargerThan string
-	Stdin             bool
-	StdinFilename     string
-	StdinCommand      bool
-	Tags              restic.TagLists
-	Host              string
-	FilesFrom         []string
-	FilesFromVerbatim []string
-	FilesFromRaw      []string
-	TimeStamp         string
-	WithAtime         bool
-	IgnoreInode       bool
-	IgnoreCtime       bool
-	UseFsSnapshot     bool
-	DryRun            bool
-	ReadConcurrency   uint
-	NoScan            bool
+	Parent               string
+	GroupBy              restic.SnapshotGroupByOptions
+	Force                bool
+	ExcludeOtherFS       bool
+	ExcludeIfPresent     []string
+	ExcludeCaches        bool
+	ExcludeLargerThan    string
+	ExcludeCaseSensitive bool
+	NewerThan            string
+	Stdin                bool
+	StdinFilename        string
+	StdinCommand         bool
+	Tar                  string
+	Zip                  string
+	OCIImage             string
+	OCIPlatform          string
+	FromSnapshot         string
+	Mounts               []string
+	Renames              []string
+	Transforms           []string
+	StdinSize            string
+	StdinMtime           string
+	Tags                 restic.TagLists
+	Host                 string
+	FilesFrom            []string
+	FilesFromVerbatim    []string
+	FilesFromRaw         []string
+	TimeStamp            string
+	WithAtime            bool
+	IgnoreInode          bool
+	IgnoreCtime          bool
+	ChangeDetection      string
+	ExcludeXattrs        []string
+	SkipACLs             bool
+	UseFsSnapshot        bool
+	DryRun               bool
+	ReadConcurrency      uint
+	MaxInFlight          string
+	LazyIndex            bool
+	WriteOnlyKey         string
+	NoScan               bool
+	SkipIfUnchanged      bool
+	TolerateDirErrors    bool
+	ReadDevices          bool
+	FollowSymlinks       bool
+	Metadata             map[string]string
 }
 
 var backupOptions BackupOptions
@@ -118,6 +153,10 @@ var backupOptions BackupOptions
 // ErrInvalidSourceData is used to report an incomplete backup
 var ErrInvalidSourceData = errors.New("at least one source file could not be read")
 
+// ErrSnapshotSkipped is used to report that no snapshot was created because
+// nothing changed compared to the parent snapshot
+var ErrSnapshotSkipped = errors.New("no changes, snapshot skipped")
+
 func init() {
 	cmdRoot.AddCommand(cmdBackup)
 
@@ -132,11 +171,25 @@ func init() {
 	f.BoolVarP(&backupOptions.ExcludeOtherFS, "one-file-system", "x", false, "exclude other file systems, don't cross filesystem boundaries and subvolumes")
 	f.StringArrayVar(&backupOptions.ExcludeIfPresent, "exclude-if-present", nil, "takes `filename[:header]`, exclude contents of directories containing filename (except filename itself) if header of that file is as provided (can be specified multiple times)")
 	f.BoolVar(&backupOptions.ExcludeCaches, "exclude-caches", false, `excludes cache directories that are marked with a CACHEDIR.TAG file. See https://bford.info/cachedir/ for the Cache Directory Tagging Standard`)
-	f.StringVar(&backupOptions.ExcludeLargerThan, "exclude-larger-than", "", "max `size` of the files to be backed up (allowed suffixes: k/K, m/M, g/G, t/T)")
+	f.BoolVar(&backupOptions.ExcludeCaseSensitive, "exclude-case-sensitive", false, "match --exclude patterns case-sensitively even if the file system ignores the case of file names")
+	f.StringVar(&backupOptions.NewerThan, "newer-than", "", "only save files modified at or after `time` (RFC 3339, ex. '2012-11-01T22:08:41+01:00')")
+	f.StringVar(&backupOptions.ExcludeLargerThan, "exclude-larger-than", "", "max `size` of the files to be backed up (allowed suffixes: k/K, m/M, g/G, t/T, optionally followed by iB)")
 	f.BoolVar(&backupOptions.Stdin, "stdin", false, "read backup from stdin")
 	f.StringVar(&backupOptions.StdinFilename, "stdin-filename", "stdin", "`filename` to use when reading from stdin")
 	f.BoolVar(&backupOptions.StdinCommand, "stdin-from-command", false, "execute command and store its stdout")
+	f.StringVar(&backupOptions.Tar, "tar", "", "read the files to back up from the (possibly compressed) tar archive `file`, use \"-\" for stdin")
+	f.StringVar(&backupOptions.Zip, "zip", "", "read the files to back up from the zip archive `file`")
+	f.StringVar(&backupOptions.OCIImage, "oci-image", "", "read the files to back up from the container image in the OCI image layout or docker save archive `path`")
+	f.StringVar(&backupOptions.OCIPlatform, "oci-platform", "", "select the image for `platform` (os/arch[/variant]) from an image for several platforms")
+	f.StringVar(&backupOptions.FromSnapshot, "from-snapshot", "", "read the files to back up from the `snapshot` in the repository")
+	f.StringArrayVar(&backupOptions.Mounts, "mount", nil, "save the `path=target` at path in the snapshot, target is a local path, an sftp://, s3: or webdav: target (can be specified multiple times)")
+	f.StringArrayVar(&backupOptions.Renames, "rename", nil, "save the file or directory `source=path` at path in the snapshot (can be specified multiple times)")
+	f.StringArrayVar(&backupOptions.Transforms, "transform", nil, "save the output of the command for files matching the `pattern=command`, the file is passed to the command on stdin (can be specified multiple times)")
+	f.StringVar(&backupOptions.StdinSize, "stdin-size", "", "expected `size` of the data read from stdin, only used for progress reporting (allowed suffixes: k/K, m/M, g/G, t/T)")
+	f.StringVar(&backupOptions.StdinMtime, "stdin-mtime", "", "modification `time` of the file read from stdin (ex. '2012-11-01 22:08:41') (default: time of the backup)")
+	f.StringToStringVar(&backupOptions.Metadata, "metadata", nil, "add metadata `key=value` to the new snapshot (can be specified multiple times)")
 	f.Var(&backupOptions.Tags, "tag", "add `tags` for the new snapshot in the format `tag[,tag,...]` (can be specified multiple times)")
+	f.StringVar(&backupOptions.MaxInFlight, "max-in-flight", "", "limit the data read but not yet stored in the repository to `size` (default: pack size times backend connections, allowed suffixes: k/K, m/M, g/G, t/T)")
 	f.UintVar(&backupOptions.ReadConcurrency, "read-concurrency", 0, "read `n` files concurrently (default: $RESTIC_READ_CONCURRENCY or 2)")
 	f.StringVarP(&backupOptions.Host, "host", "H", "", "set the `hostname` for the snapshot manually. To prevent an expensive rescan use the \"parent\" flag")
 	f.StringVar(&backupOptions.Host, "hostname", "", "set the `hostname` for the snapshot manually")
@@ -152,8 +205,17 @@ func init() {
 	f.BoolVar(&backupOptions.WithAtime, "with-atime", false, "store the atime for all files and directories")
 	f.BoolVar(&backupOptions.IgnoreInode, "ignore-inode", false, "ignore inode number changes when checking for modified files")
 	f.BoolVar(&backupOptions.IgnoreCtime, "ignore-ctime", false, "ignore ctime changes when checking for modified files")
+	f.StringArrayVar(&backupOptions.ExcludeXattrs, "exclude-xattr", nil, "do not save extended attributes matching `pattern`, e.g. 'user.dropbox.*' (can be specified multiple times)")
+	f.BoolVar(&backupOptions.SkipACLs, "skip-acls", false, "do not save access control lists")
+	f.StringVar(&backupOptions.ChangeDetection, "change-detection", archiver.ChangeDetectionDefault.String(), "`mode` for checking for modified files: default, mtime-size or force-rescan")
 	f.BoolVarP(&backupOptions.DryRun, "dry-run", "n", false, "do not upload or write any data, just show what would be done")
+	f.BoolVar(&backupOptions.LazyIndex, "lazy-index", false, "only load index files which probably contain a blob of the backup, using filters stored in the local cache (reduces memory usage)")
+	f.StringVar(&backupOptions.WriteOnlyKey, "write-only-key", "", "open the repository using the write-only key stored in `file`, see 'restic key add --write-only'")
 	f.BoolVar(&backupOptions.NoScan, "no-scan", false, "do not run scanner to estimate size of backup")
+	f.BoolVar(&backupOptions.SkipIfUnchanged, "skip-if-unchanged", false, "skip snapshot creation if identical to parent snapshot")
+	f.BoolVar(&backupOptions.FollowSymlinks, "follow-symlinks", false, "save the targets of symbolic links instead of the links")
+	f.BoolVar(&backupOptions.ReadDevices, "read-devices", false, "save the contents of block and character devices as regular files")
+	f.BoolVar(&backupOptions.TolerateDirErrors, "tolerate-dir-errors", false, "save directories which cannot be listed without their contents instead of leaving them out")
 	if runtime.GOOS == "windows" {
 		f.BoolVar(&backupOptions.UseFsSnapshot, "use-fs-snapshot", false, "use filesystem snapshot where possible (currently only Windows VSS)")
 	}
@@ -276,8 +338,8 @@ func readFilenamesRaw(r io.Reader) (names []string, err error) {
 
 // Check returns an error when an invalid combination of options was set.
 func (opts BackupOptions) Check(gopts GlobalOptions, args []string) error {
-	if gopts.password == "" {
-		if opts.Stdin {
+	if gopts.password == "" && opts.WriteOnlyKey == "" {
+		if opts.Stdin || opts.Tar == "-" {
 			return errors.Fatal("cannot read both password and data from stdin")
 		}
 
@@ -303,14 +365,114 @@ func (opts BackupOptions) Check(gopts GlobalOptions, args []string) error {
 		if len(args) > 0 && !opts.StdinCommand {
 			return errors.Fatal("--stdin was specified and files/dirs were listed as arguments")
 		}
+	} else {
+		if opts.StdinSize != "" {
+			return errors.Fatal("--stdin-size requires --stdin or --stdin-from-command")
+		}
+		if opts.StdinMtime != "" {
+			return errors.Fatal("--stdin-mtime requires --stdin or --stdin-from-command")
+		}
+	}
+
+	if opts.OCIPlatform != "" && opts.OCIImage == "" {
+		return errors.Fatal("--oci-platform can only be used together with --oci-image")
+	}
+
+	if sources := opts.sourceNames(args); len(sources) > 0 {
+		source := sources[0]
+		switch {
+		case len(sources) > 1:
+			return errors.Fatalf("%v cannot be used together", strings.Join(sources, " and "))
+		case opts.Stdin || opts.StdinCommand:
+			return errors.Fatalf("--stdin and %v cannot be used together", source)
+		case len(opts.FilesFrom) > 0 || len(opts.FilesFromVerbatim) > 0 || len(opts.FilesFromRaw) > 0:
+			return errors.Fatalf("--files-from and %v cannot be used together", source)
+		case opts.ExcludeOtherFS:
+			return errors.Fatalf("--one-file-system is not supported for %v", source)
+		case len(opts.ExcludeIfPresent) > 0 || opts.ExcludeCaches:
+			return errors.Fatalf("--exclude-if-present and --exclude-caches are not supported for %v", source)
+		case opts.UseFsSnapshot:
+			return errors.Fatalf("--use-fs-snapshot is not supported for %v", source)
+		case source == "--mount" && len(args) > 0:
+			return errors.Fatal("--mount was specified and files/dirs were listed as arguments")
+		}
+	}
+
+	if len(opts.Renames) > 0 || len(opts.Transforms) > 0 {
+		switch {
+		case opts.Stdin || opts.StdinCommand:
+			return errors.Fatal("--rename and --transform cannot be used together with --stdin")
+		case len(opts.Renames) > 0 && opts.ExcludeOtherFS:
+			return errors.Fatal("--one-file-system is not supported for --rename")
+		case len(opts.Renames) > 0 && (len(opts.ExcludeIfPresent) > 0 || opts.ExcludeCaches):
+			return errors.Fatal("--exclude-if-present and --exclude-caches are not supported for --rename")
+		}
+		if _, err := parseTransformOptions(opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.MaxInFlight != "" {
+		if size, err := ui.ParseBytes(opts.MaxInFlight); err != nil || size <= 0 {
+			return errors.Fatalf("invalid --max-in-flight %q", opts.MaxInFlight)
+		}
+	}
+
+	if opts.LazyIndex && gopts.NoCache {
+		return errors.Fatal("--lazy-index requires the local cache and cannot be used with --no-cache")
+	}
+
+	// a write-only key cannot read snapshots or the index
+	if opts.WriteOnlyKey != "" {
+		switch {
+		case opts.Parent != "":
+			return errors.Fatal("--parent cannot be used with --write-only-key")
+		case opts.FromSnapshot != "":
+			return errors.Fatal("--from-snapshot cannot be used with --write-only-key")
+		case opts.LazyIndex:
+			return errors.Fatal("--lazy-index cannot be used with --write-only-key")
+		case opts.SkipIfUnchanged:
+			return errors.Fatal("--skip-if-unchanged cannot be used with --write-only-key")
+		case opts.DryRun:
+			return errors.Fatal("--dry-run cannot be used with --write-only-key")
+		}
+	}
+
+	if opts.StdinSize != "" {
+		if size, err := ui.ParseBytes(opts.StdinSize); err != nil || size < 0 {
+			return errors.Fatalf("invalid --stdin-size %q", opts.StdinSize)
+		}
+	}
+
+	if opts.StdinMtime != "" {
+		if _, err := time.ParseInLocation(TimeFormat, opts.StdinMtime, time.Local); err != nil {
+			return errors.Fatalf("error in stdin-mtime option: %v", err)
+		}
+	}
+
+	if opts.ChangeDetection != "" {
+		if _, err := archiver.ParseChangeDetection(opts.ChangeDetection); err != nil {
+			return errors.Fatalf("invalid --change-detection: %v", err)
+		}
+	}
+
+	if err := restic.ValidateMetadata(opts.Metadata); err != nil {
+		return errors.Fatalf("invalid --metadata: %v", err)
+	}
+
+	for _, pattern := range opts.ExcludeXattrs {
+		if err := archiver.ValidateXattrPattern(pattern); err != nil {
+			return errors.Fatalf("invalid --exclude-xattr: %v", err)
+		}
 	}
 
 	return nil
 }
 
 // collectRejectByNameFuncs returns a list of all functions which may reject data
-// from being saved in a snapshot based on path only
-func collectRejectByNameFuncs(opts BackupOptions, repo *repository.Repository) (fs []RejectByNameFunc, err error) {
+// from being saved in a snapshot based on path only. If caseInsensitive is set,
+// the --exclude patterns ignore the case of file names.
+func collectRejectByNameFuncs(opts BackupOptions, repo *repository.Repository, caseInsensitive bool) (fs []RejectByNameFunc, err error) {
 	// exclude restic cache
 	if repo.Cache != nil {
 		f, err := rejectResticCache(repo)
@@ -321,7 +483,7 @@ func collectRejectByNameFuncs(opts BackupOptions, repo *repository.Repository) (
 		fs = append(fs, f)
 	}
 
-	fsPatterns, err := opts.excludePatternOptions.CollectPatterns()
+	fsPatterns, err := opts.excludePatternOptions.CollectPatterns(caseInsensitive)
 	if err != nil {
 		return nil, err
 	}
@@ -345,14 +507,18 @@ func collectRejectByNameFuncs(opts BackupOptions, repo *repository.Repository) (
 
 // collectRejectFuncs returns a list of all functions which may reject data
 // from being saved in a snapshot based on path and file info
-func collectRejectFuncs(opts BackupOptions, targets []string) (fs []RejectFunc, err error) {
+func collectRejectFuncs(opts BackupOptions, targets []string) (funcs []RejectFunc, err error) {
 	// allowed devices
 	if opts.ExcludeOtherFS && !opts.Stdin {
 		f, err := rejectByDevice(targets)
-		if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrDeviceIDNotSupported):
+			Warnf("--one-file-system is not supported for these targets, ignoring: %v\n", err)
+		case err != nil:
 			return nil, err
+		default:
+			funcs = append(funcs, f)
 		}
-		fs = append(fs, f)
 	}
 
 	if len(opts.ExcludeLargerThan) != 0 && !opts.Stdin {
@@ -360,10 +526,18 @@ func collectRejectFuncs(opts BackupOptions, targets []string) (fs []RejectFunc,
 		if err != nil {
 			return nil, err
 		}
-		fs = append(fs, f)
+		funcs = append(funcs, f)
 	}
 
-	return fs, nil
+	if len(opts.NewerThan) != 0 && !opts.Stdin {
+		f, err := rejectByModTime(opts.NewerThan)
+		if err != nil {
+			return nil, err
+		}
+		funcs = append(funcs, f)
+	}
+
+	return funcs, nil
 }
 
 // collectTargets returns a list of target files/dirs from several sources.
@@ -433,6 +607,471 @@ func collectTargets(opts BackupOptions, args []string) (targets []string, err er
 	return targets, nil
 }
 
+// sourceNames returns descriptions of the file systems the targets are read
+// from if it is not the local file system.
+func (opts BackupOptions) sourceNames(args []string) []string {
+	var names []string
+	if opts.Tar != "" {
+		names = append(names, "--tar")
+	}
+	if opts.Zip != "" {
+		names = append(names, "--zip")
+	}
+	if opts.OCIImage != "" {
+		names = append(names, "--oci-image")
+	}
+	if opts.FromSnapshot != "" {
+		names = append(names, "--from-snapshot")
+	}
+	if len(opts.Mounts) > 0 {
+		names = append(names, "--mount")
+	}
+	if hasSFTPTargets(args) {
+		names = append(names, "sftp:// targets")
+	}
+	if hasS3Targets(args) {
+		names = append(names, "s3: targets")
+	}
+	if hasWebDAVTargets(args) {
+		names = append(names, "webdav: targets")
+	}
+	return names
+}
+
+// openTarSource reads the tar archive given by --tar. The targets are the
+// paths within the archive, by default the whole archive is saved.
+func openTarSource(opts BackupOptions, args []string) (*tarfs.FS, []string, error) {
+	archive, err := tarfs.Open(opts.Tar, "")
+	if err != nil {
+		return nil, nil, errors.Fatalf("unable to read tar archive: %v", err)
+	}
+
+	targets, err := archiveTargets(archive, args)
+	if err != nil {
+		_ = archive.Close()
+		return nil, nil, err
+	}
+	return archive, targets, nil
+}
+
+// openZipSource opens the zip archive given by --zip. The targets are the
+// paths within the archive, by default the whole archive is saved.
+func openZipSource(opts BackupOptions, args []string) (*zipfs.FS, []string, error) {
+	archive, err := zipfs.Open(opts.Zip)
+	if err != nil {
+		return nil, nil, errors.Fatalf("unable to read zip archive: %v", err)
+	}
+
+	targets, err := archiveTargets(archive, args)
+	if err != nil {
+		_ = archive.Close()
+		return nil, nil, err
+	}
+	return archive, targets, nil
+}
+
+// openOCISource opens the container image given by --oci-image. The targets
+// are the paths within the image.
+func openOCISource(opts BackupOptions, args []string) (*ocifs.FS, []string, error) {
+	image, err := ocifs.Open(opts.OCIImage, ocifs.Options{Platform: opts.OCIPlatform})
+	if err != nil {
+		return nil, nil, errors.Fatalf("unable to read container image: %v", err)
+	}
+
+	targets, err := archiveTargets(image, args)
+	if err != nil {
+		_ = image.Close()
+		return nil, nil, err
+	}
+	return image, targets, nil
+}
+
+// archiveTargets returns the paths of the targets within archive, targets
+// which do not exist are skipped.
+func archiveTargets(archive fs.FS, args []string) ([]string, error) {
+	if len(args) == 0 {
+		return []string{"/"}, nil
+	}
+
+	var targets []string
+	for _, arg := range args {
+		target, _ := archive.Abs(arg)
+		if _, err := archive.Lstat(target); errors.Is(err, os.ErrNotExist) {
+			Warnf("%v does not exist in the archive, skipping\n", target)
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.Fatal("all target directories/files do not exist")
+	}
+	return targets, nil
+}
+
+// hasSFTPTargets returns true if any of the targets is on a remote host.
+func hasSFTPTargets(args []string) bool {
+	for _, arg := range args {
+		if sftpfs.IsTarget(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// openSFTPTargets connects to the remote host all targets are located on. It
+// returns the file system and the absolute paths of the targets on the host.
+func openSFTPTargets(gopts GlobalOptions, args []string) (*sftpfs.FS, []string, error) {
+	var cfg sftpfs.Config
+	var dirs []string
+	for i, arg := range args {
+		if !sftpfs.IsTarget(arg) {
+			return nil, nil, errors.Fatal("local targets and sftp:// targets cannot be used together")
+		}
+		c, dir, err := sftpfs.ParseTarget(arg)
+		if err != nil {
+			return nil, nil, errors.Fatalf("%v", err)
+		}
+		if i > 0 && !c.SameHost(cfg) {
+			return nil, nil, errors.Fatal("all sftp:// targets must be located on the same host")
+		}
+		cfg = c
+		dirs = append(dirs, dir)
+	}
+
+	if err := gopts.extended.Extract("sftp-source").Apply("sftp-source", &cfg); err != nil {
+		return nil, nil, err
+	}
+
+	remote, err := sftpfs.Open(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var targets []string
+	for _, dir := range dirs {
+		target, err := remote.Abs(dir)
+		if err != nil {
+			_ = remote.Close()
+			return nil, nil, err
+		}
+
+		_, err = remote.Lstat(target)
+		if errors.Is(err, os.ErrNotExist) {
+			Warnf("%v does not exist on %v, skipping\n", target, cfg.Host)
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		_ = remote.Close()
+		return nil, nil, errors.Fatal("all target directories/files do not exist")
+	}
+
+	return remote, targets, nil
+}
+
+// openSnapshotSource finds the snapshot given by --from-snapshot. The
+// targets are the paths within the snapshot, by default the paths saved in
+// the snapshot (or the subfolder given with snapshotID:subfolder).
+func openSnapshotSource(ctx context.Context, repo restic.Repository, opts BackupOptions, args []string) (*snapshotfs.FS, *restic.Snapshot, []string, error) {
+	sn, subfolder, err := (&restic.SnapshotFilter{}).FindLatest(ctx, repo, repo, opts.FromSnapshot)
+	if err != nil {
+		return nil, nil, nil, errors.Fatalf("failed to find snapshot: %v", err)
+	}
+
+	sfs, err := snapshotfs.New(ctx, repo, sn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var targets []string
+	switch {
+	case len(args) > 0:
+		for _, arg := range args {
+			target, _ := sfs.Abs(arg)
+			targets = append(targets, target)
+		}
+	case subfolder != "":
+		target, _ := sfs.Abs(subfolder)
+		targets = []string{target}
+	default:
+		targets = sfs.Targets()
+	}
+
+	return sfs, sn, targets, nil
+}
+
+// existingSnapshotTargets returns the targets which exist in the snapshot.
+func existingSnapshotTargets(sourceFS fs.FS, sn *restic.Snapshot, targets []string) ([]string, error) {
+	var existing []string
+	for _, target := range targets {
+		_, err := sourceFS.Lstat(target)
+		if errors.Is(err, os.ErrNotExist) {
+			Warnf("%v does not exist in snapshot %v, skipping\n", target, sn.ID().Str())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		existing = append(existing, target)
+	}
+
+	if len(existing) == 0 {
+		return nil, errors.Fatal("all target directories/files do not exist")
+	}
+	return existing, nil
+}
+
+// hasS3Targets returns true if any of the targets is located in an S3 bucket.
+func hasS3Targets(args []string) bool {
+	for _, arg := range args {
+		if s3fs.IsTarget(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// openS3Targets opens the bucket all targets are located in. It returns the
+// file system and the paths of the targets within the bucket.
+func openS3Targets(ctx context.Context, gopts GlobalOptions, args []string) (*s3fs.FS, []string, error) {
+	var cfg s3fs.Config
+	var dirs []string
+	for i, arg := range args {
+		if !s3fs.IsTarget(arg) {
+			return nil, nil, errors.Fatal("s3: targets cannot be used together with other targets")
+		}
+		c, dir, err := s3fs.ParseTarget(arg)
+		if err != nil {
+			return nil, nil, errors.Fatalf("%v", err)
+		}
+		if i > 0 && !c.SameBucket(cfg) {
+			return nil, nil, errors.Fatal("all s3: targets must be located in the same bucket")
+		}
+		cfg = c
+		dirs = append(dirs, dir)
+	}
+
+	cfg.ApplyEnvironment("")
+	if err := gopts.extended.Extract("s3-source").Apply("s3-source", &cfg); err != nil {
+		return nil, nil, err
+	}
+
+	rt, err := backend.Transport(gopts.TransportOptions)
+	if err != nil {
+		return nil, nil, errors.Fatal(err.Error())
+	}
+
+	bucket, err := s3fs.Open(ctx, cfg, rt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var targets []string
+	for _, dir := range dirs {
+		_, err = bucket.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			Warnf("%v does not exist in bucket %v, skipping\n", dir, cfg.Bucket)
+			continue
+		}
+		if err != nil {
+			_ = bucket.Close()
+			return nil, nil, err
+		}
+		targets = append(targets, dir)
+	}
+
+	if len(targets) == 0 {
+		_ = bucket.Close()
+		return nil, nil, errors.Fatal("all target directories/files do not exist")
+	}
+
+	return bucket, targets, nil
+}
+
+// hasWebDAVTargets returns true if any of the targets is located on a WebDAV
+// server.
+func hasWebDAVTargets(args []string) bool {
+	for _, arg := range args {
+		if webdavfs.IsTarget(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// openWebDAVTargets connects to the WebDAV server all targets are located on.
+// It returns the file system and the paths of the targets on the server.
+func openWebDAVTargets(ctx context.Context, gopts GlobalOptions, args []string) (*webdavfs.FS, []string, error) {
+	var cfg webdavfs.Config
+	var dirs []string
+	for i, arg := range args {
+		if !webdavfs.IsTarget(arg) {
+			return nil, nil, errors.Fatal("webdav: targets cannot be used together with other targets")
+		}
+		c, dir, err := webdavfs.ParseTarget(arg)
+		if err != nil {
+			return nil, nil, errors.Fatalf("%v", err)
+		}
+		if i > 0 && !c.SameServer(cfg) {
+			return nil, nil, errors.Fatal("all webdav: targets must be located on the same server")
+		}
+		cfg = c
+		dirs = append(dirs, dir)
+	}
+
+	cfg.ApplyEnvironment("")
+	if err := gopts.extended.Extract("webdav-source").Apply("webdav-source", &cfg); err != nil {
+		return nil, nil, err
+	}
+
+	topts := gopts.TransportOptions
+	if cfg.CACert != "" {
+		topts.RootCertFilenames = []string{cfg.CACert}
+	}
+	rt, err := backend.Transport(topts)
+	if err != nil {
+		return nil, nil, errors.Fatal(err.Error())
+	}
+
+	server, err := webdavfs.Open(ctx, cfg, rt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var targets []string
+	for _, dir := range dirs {
+		_, err = server.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			Warnf("%v does not exist on %v, skipping\n", dir, cfg.URL.Host)
+			continue
+		}
+		if err != nil {
+			_ = server.Close()
+			return nil, nil, err
+		}
+		targets = append(targets, dir)
+	}
+
+	if len(targets) == 0 {
+		_ = server.Close()
+		return nil, nil, errors.Fatal("all target directories/files do not exist")
+	}
+
+	return server, targets, nil
+}
+
+// openMountSources opens the targets given by --mount and combines them into
+// a single file system. The targets are the paths of the mounts.
+func openMountSources(ctx context.Context, gopts GlobalOptions, specs []string) (*compositefs.FS, []string, error) {
+	var mounts []compositefs.Mount
+	var targets []string
+	closeAll := func() {
+		for _, m := range mounts {
+			if c, ok := m.FS.(io.Closer); ok {
+				_ = c.Close()
+			}
+		}
+	}
+
+	for _, spec := range specs {
+		mountPath, target, ok := strings.Cut(spec, "=")
+		if !ok || mountPath == "" || target == "" {
+			closeAll()
+			return nil, nil, errors.Fatalf("invalid --mount %q, must be path=target", spec)
+		}
+
+		var m compositefs.Mount
+		switch {
+		case sftpfs.IsTarget(target):
+			remote, dirs, err := openSFTPTargets(gopts, []string{target})
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			m = compositefs.Mount{FS: remote, Root: dirs[0]}
+		case s3fs.IsTarget(target):
+			bucket, dirs, err := openS3Targets(ctx, gopts, []string{target})
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			m = compositefs.Mount{FS: bucket, Root: dirs[0]}
+		case webdavfs.IsTarget(target):
+			server, dirs, err := openWebDAVTargets(ctx, gopts, []string{target})
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			m = compositefs.Mount{FS: server, Root: dirs[0]}
+		default:
+			if _, err := fs.Lstat(target); err != nil {
+				closeAll()
+				return nil, nil, errors.Fatalf("unable to mount %v: %v", target, err)
+			}
+			m = compositefs.Mount{FS: fs.Local{}, Root: target}
+		}
+
+		m.Path = path.Clean("/" + mountPath)
+		m.Name = target
+		mounts = append(mounts, m)
+		targets = append(targets, m.Path)
+	}
+
+	cfs, err := compositefs.New(mounts...)
+	if err != nil {
+		closeAll()
+		return nil, nil, errors.Fatalf("%v", err)
+	}
+	return cfs, targets, nil
+}
+
+// parseTransformOptions parses --rename and --transform.
+func parseTransformOptions(opts BackupOptions) (transformfs.Options, error) {
+	var tOpts transformfs.Options
+	for _, spec := range opts.Renames {
+		source, target, ok := strings.Cut(spec, "=")
+		if !ok || source == "" || target == "" {
+			return tOpts, errors.Fatalf("invalid --rename %q, must be source=path", spec)
+		}
+		tOpts.Renames = append(tOpts.Renames, transformfs.Rename{Source: source, Target: target})
+	}
+
+	for _, spec := range opts.Transforms {
+		pattern, command, ok := strings.Cut(spec, "=")
+		if !ok || pattern == "" {
+			return tOpts, errors.Fatalf("invalid --transform %q, must be pattern=command", spec)
+		}
+		args, err := backend.SplitShellStrings(command)
+		if err != nil {
+			return tOpts, errors.Fatalf("invalid --transform %q: %v", spec, err)
+		}
+		if len(args) == 0 {
+			return tOpts, errors.Fatalf("invalid --transform %q, no command given", spec)
+		}
+		tOpts.Transforms = append(tOpts.Transforms, transformfs.Transform{Pattern: pattern, Command: args})
+	}
+
+	tOpts.Stderr = globalOptions.stderr
+	return tOpts, nil
+}
+
+// newTransformFS wraps inner to apply --rename and --transform, which have
+// already been validated in opts.Check().
+func newTransformFS(ctx context.Context, opts BackupOptions, inner fs.FS) (*transformfs.FS, error) {
+	tOpts, err := parseTransformOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	wfs, err := transformfs.New(ctx, inner, tOpts)
+	if err != nil {
+		return nil, errors.Fatalf("%v", err)
+	}
+	return wfs, nil
+}
+
 // parent returns the ID of the parent snapshot. If there is none, nil is
 // returned.
 func findParentSnapshot(ctx context.Context, repo restic.Repository, opts BackupOptions, targets []string, timeStampLimit time.Time) (*restic.Snapshot, error) {
@@ -469,10 +1108,40 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 		return err
 	}
 
-	targets, err := collectTargets(opts, args)
+	// sourceFS is set if the targets are not read from the local file system
+	var sourceFS interface {
+		fs.FS
+		io.Closer
+	}
+	var targets []string
+	switch {
+	case opts.Tar != "":
+		sourceFS, targets, err = openTarSource(opts, args)
+	case opts.Zip != "":
+		sourceFS, targets, err = openZipSource(opts, args)
+	case opts.OCIImage != "":
+		sourceFS, targets, err = openOCISource(opts, args)
+	case len(opts.Mounts) > 0:
+		sourceFS, targets, err = openMountSources(ctx, gopts, opts.Mounts)
+	case hasSFTPTargets(args):
+		sourceFS, targets, err = openSFTPTargets(gopts, args)
+	case hasS3Targets(args):
+		sourceFS, targets, err = openS3Targets(ctx, gopts, args)
+	case hasWebDAVTargets(args):
+		sourceFS, targets, err = openWebDAVTargets(ctx, gopts, args)
+	case opts.FromSnapshot != "":
+		// the snapshot is opened together with the repository
+	default:
+		targets, err = collectTargets(opts, args)
+	}
 	if err != nil {
 		return err
 	}
+	if sourceFS != nil {
+		defer func() {
+			_ = sourceFS.Close()
+		}()
+	}
 
 	timeStamp := time.Now()
 	if opts.TimeStamp != "" {
@@ -486,7 +1155,12 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 		Verbosef("open repository\n")
 	}
 
-	repo, err := OpenRepository(ctx, gopts)
+	var repo *repository.Repository
+	if opts.WriteOnlyKey != "" {
+		repo, err = OpenWriteOnlyRepository(ctx, gopts, opts.WriteOnlyKey)
+	} else {
+		repo, err = OpenRepository(ctx, gopts)
+	}
 	if err != nil {
 		return err
 	}
@@ -517,8 +1191,55 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 		}
 	}
 
+	var sourceSnapshot *restic.Snapshot
+	if opts.FromSnapshot != "" {
+		var snapshotFS *snapshotfs.FS
+		snapshotFS, sourceSnapshot, targets, err = openSnapshotSource(ctx, repo, opts, args)
+		if err != nil {
+			return err
+		}
+		sourceFS = snapshotFS
+		defer func() {
+			_ = sourceFS.Close()
+		}()
+
+		if opts.Host == "" {
+			opts.Host = sourceSnapshot.Hostname
+		}
+		// files which have not been modified are not read again
+		if opts.Parent == "" {
+			opts.Parent = sourceSnapshot.ID().String()
+		}
+	}
+
+	// the targets are saved at the paths given by --rename
+	localTargets := append([]string(nil), targets...)
+	var statFS fs.FS = sourceFS
+	if len(opts.Renames) > 0 || len(opts.Transforms) > 0 {
+		var inner fs.FS = fs.Local{}
+		if sourceFS != nil {
+			inner = sourceFS
+		}
+		wfs, err := newTransformFS(ctx, opts, inner)
+		if err != nil {
+			return err
+		}
+		for i, target := range targets {
+			targets[i] = wfs.Target(target)
+		}
+		statFS = wfs
+	}
+
+	// exclude patterns follow the case sensitivity of the file system the
+	// files are read from, unless --exclude-case-sensitive is given
+	var nameFS fs.FS = fs.Local{}
+	if statFS != nil {
+		nameFS = statFS
+	}
+	caseInsensitive := fs.CapabilitiesOf(nameFS).Has(fs.CapCaseInsensitiveNames) && !opts.ExcludeCaseSensitive
+
 	// rejectByNameFuncs collect functions that can reject items from the backup based on path only
-	rejectByNameFuncs, err := collectRejectByNameFuncs(opts, repo)
+	rejectByNameFuncs, err := collectRejectByNameFuncs(opts, repo, caseInsensitive)
 	if err != nil {
 		return err
 	}
@@ -530,7 +1251,7 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 	}
 
 	var parentSnapshot *restic.Snapshot
-	if !opts.Stdin {
+	if !opts.Stdin && !repo.WriteOnly() {
 		parentSnapshot, err = findParentSnapshot(ctx, repo, opts, targets, timeStamp)
 		if err != nil {
 			return err
@@ -544,18 +1265,56 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 			}
 		}
 	}
+	if repo.WriteOnly() && !gopts.JSON {
+		progressPrinter.P("write-only key cannot read the repository, will read and upload all files\n")
+	}
 
-	if !gopts.JSON {
+	if !gopts.JSON && !repo.WriteOnly() {
 		progressPrinter.V("load index files")
 	}
 
 	bar := newIndexTerminalProgress(gopts.Quiet, gopts.JSON, term)
 
-	err = repo.LoadIndex(ctx, bar)
+	switch {
+	case repo.WriteOnly():
+		// the index cannot be decrypted, thus no data is deduplicated
+	case opts.LazyIndex && repo.Cache == nil:
+		return errors.Fatal("--lazy-index requires the local cache, which is not available")
+	case opts.LazyIndex && repo.Config().MaxRepoSize == 0:
+		err = repo.LoadIndexLazy(ctx, bar)
+	default:
+		if opts.LazyIndex {
+			// the size of the repository is computed from the full index
+			Verbosef("the repository has a size limit, loading the full index\n")
+		}
+		err = repo.LoadIndex(ctx, bar)
+	}
 	if err != nil {
 		return err
 	}
 
+	var quota repository.QuotaStatus
+	if repo.Config().MaxRepoSize > 0 && !repo.WriteOnly() {
+		quota = repo.QuotaStatus(ctx)
+		switch {
+		case quota.Exceeded() && opts.DryRun:
+			Warnf("repository size %v exceeds its limit of %v\n", ui.FormatBytes(quota.Size), ui.FormatBytes(quota.Limit))
+		case quota.Exceeded():
+			return errors.Fatalf("repository size %v exceeds its limit of %v, remove snapshots using forget and prune first",
+				ui.FormatBytes(quota.Size), ui.FormatBytes(quota.Limit))
+		case !opts.DryRun:
+			repo.EnforceQuota(quota)
+		}
+	}
+
+	if sourceSnapshot != nil {
+		// the trees of the snapshot can only be read once the index is loaded
+		targets, err = existingSnapshotTargets(statFS, sourceSnapshot, targets)
+		if err != nil {
+			return err
+		}
+	}
+
 	selectByNameFilter := func(item string) bool {
 		for _, reject := range rejectByNameFuncs {
 			if reject(item) {
@@ -574,8 +1333,10 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 		return true
 	}
 
-	var targetFS fs.FS = fs.Local{}
-	if runtime.GOOS == "windows" && opts.UseFsSnapshot {
+	var targetFS fs.FS = fs.Local{UpdateAtime: gopts.UpdateAtime}
+	if sourceFS != nil {
+		targetFS = sourceFS
+	} else if runtime.GOOS == "windows" && opts.UseFsSnapshot {
 		if err = fs.HasSufficientPrivilegesForVSS(); err != nil {
 			return err
 		}
@@ -590,8 +1351,20 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 			}
 		}
 
-		localVss := fs.NewLocalVss(errorHandler, messageHandler)
+		warningHandler := func(msg string, args ...interface{}) {
+			Warnf("warning: "+msg, args...)
+		}
+
+		localVss := fs.NewLocalVss(errorHandler, warningHandler, messageHandler)
 		defer localVss.DeleteSnapshots()
+		// also delete the snapshots if the backup is interrupted
+		AddCleanupHandler(func(code int) (int, error) {
+			localVss.DeleteSnapshots()
+			return code, nil
+		})
+		// snapshot all volumes before the scanner starts, so that the
+		// scanner and the archiver see the same state
+		localVss.CreateSnapshots(localTargets)
 		targetFS = localVss
 	}
 
@@ -607,24 +1380,60 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 				return err
 			}
 		}
+
+		// both options have already been validated in opts.Check()
+		size := fs.SizeUnknown
+		if opts.StdinSize != "" {
+			size, _ = ui.ParseBytes(opts.StdinSize)
+		}
+		mtime := timeStamp
+		if opts.StdinMtime != "" {
+			mtime, _ = time.ParseInLocation(TimeFormat, opts.StdinMtime, time.Local)
+		}
+		if size > 0 {
+			progressReporter.SetExpectedBytes(uint64(size))
+		}
+
 		targetFS = &fs.Reader{
-			ModTime:    timeStamp,
+			ModTime:    mtime,
 			Name:       filename,
 			Mode:       0644,
+			Size:       size,
 			ReadCloser: source,
 		}
 		targets = []string{filename}
 	}
 
+	if len(opts.Renames) > 0 || len(opts.Transforms) > 0 {
+		targetFS, err = newTransformFS(ctx, opts, targetFS)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the scanner does not report dangling symlinks, the archiver does
+	scanFS, archiveFS := targetFS, targetFS
+	if opts.FollowSymlinks && !opts.Stdin && !opts.StdinCommand {
+		scanFS = fs.FollowSymlinks{FS: targetFS}
+		archiveFS = fs.FollowSymlinks{FS: targetFS, DanglingLink: func(name string, err error) {
+			Warnf("unable to resolve symlink %v, saving it as a link: %v\n", name, err)
+		}}
+	}
+
 	wg, wgCtx := errgroup.WithContext(ctx)
 	cancelCtx, cancel := context.WithCancel(wgCtx)
 	defer cancel()
 
 	if !opts.NoScan {
-		sc := archiver.NewScanner(targetFS)
+		sc := archiver.NewScanner(scanFS)
 		sc.SelectByName = selectByNameFilter
 		sc.Select = selectFilter
+		sc.OneFileSystem = opts.ExcludeOtherFS && !opts.Stdin
 		sc.Error = progressPrinter.ScannerError
+		sc.TolerateDirErrors = opts.TolerateDirErrors
+		sc.ReadDevices = opts.ReadDevices
+		// the archiver reads files with several hard links only once
+		sc.CountHardLinksOnce = true
 		sc.Result = progressReporter.ReportTotal
 
 		if !gopts.JSON {
@@ -633,9 +1442,24 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 		wg.Go(func() error { return sc.Scan(cancelCtx, targets) })
 	}
 
-	arch := archiver.New(repo, targetFS, archiver.Options{ReadConcurrency: backupOptions.ReadConcurrency})
+	archOpts := archiver.Options{ReadConcurrency: backupOptions.ReadConcurrency}
+	if opts.MaxInFlight != "" {
+		size, _ := ui.ParseBytes(opts.MaxInFlight)
+		archOpts.MaxInFlightBytes = uint64(size)
+	}
+	arch := archiver.New(repo, archiveFS, archOpts)
 	arch.SelectByName = selectByNameFilter
-	arch.Select = selectFilter
+	arch.Select = func(item string, fi os.FileInfo) bool {
+		if selectFilter(item, fi) {
+			return true
+		}
+		// the scanner uses selectFilter directly, so excluded items are
+		// only listed once
+		if !gopts.JSON {
+			progressPrinter.VV("excluded  %v", termstatus.Quote(item))
+		}
+		return false
+	}
 	arch.WithAtime = opts.WithAtime
 	success := true
 	arch.Error = func(item string, err error) error {
@@ -648,9 +1472,19 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 		}
 		return reterr
 	}
+	arch.Warn = func(msg string) {
+		Warnf("%v\n", msg)
+	}
 	arch.CompleteItem = progressReporter.CompleteItem
 	arch.StartFile = progressReporter.StartFile
 	arch.CompleteBlob = progressReporter.CompleteBlob
+	arch.CompleteUnknownSizeBlob = progressReporter.CompleteUnknownSizeBlob
+	arch.FileProgress = progressReporter.FileProgress
+	arch.Stalled = progressReporter.Stalled
+	if opts.DryRun {
+		// list the files which would be read and why
+		arch.ChangedFile = progressReporter.ChangedFile
+	}
 
 	if opts.IgnoreInode {
 		// --ignore-inode implies --ignore-ctime: on FUSE, the ctime is not
@@ -661,6 +1495,25 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 		arch.ChangeIgnoreFlags |= archiver.ChangeIgnoreCtime
 	}
 
+	arch.TolerateDirErrors = opts.TolerateDirErrors
+	arch.ReadDevices = opts.ReadDevices
+	arch.ExcludeXattrPatterns = opts.ExcludeXattrs
+	arch.SkipACLs = opts.SkipACLs
+
+	// the mode has already been validated in opts.Check(), empty selects the
+	// default mode
+	arch.ChangeDetection, _ = archiver.ParseChangeDetection(opts.ChangeDetection)
+	if opts.Stdin || opts.StdinCommand {
+		// the size and modification time of data read from stdin may match
+		// the parent snapshot even though the contents differ
+		arch.ChangeDetection = archiver.ChangeDetectionForceRescan
+	}
+	if parentSnapshot != nil && parentSnapshot.ChangeDetection != "" &&
+		parentSnapshot.ChangeDetection != arch.ChangeDetection.String() {
+		Warnf("change detection mode %v differs from %v used for parent snapshot %v\n",
+			arch.ChangeDetection, parentSnapshot.ChangeDetection, parentSnapshot.ID().Str())
+	}
+
 	snapshotOpts := archiver.SnapshotOptions{
 		Excludes:       opts.Excludes,
 		Tags:           opts.Tags.Flatten(),
@@ -669,11 +1522,16 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 		ParentSnapshot: parentSnapshot,
 		ProgramVersion: "restic " + version,
 	}
+	if opts.StdinCommand {
+		snapshotOpts.Command = args
+	}
+	snapshotOpts.SkipIfUnchanged = opts.SkipIfUnchanged
+	snapshotOpts.Metadata = opts.Metadata
 
 	if !gopts.JSON {
 		progressPrinter.V("start backup on %v", targets)
 	}
-	_, id, err := arch.Snapshot(ctx, targets, snapshotOpts)
+	sn, id, err := arch.Snapshot(ctx, targets, snapshotOpts)
 
 	// cleanly shutdown all running goroutines
 	cancel()
@@ -682,18 +1540,35 @@ func runBackup(ctx context.Context, opts BackupOptions, gopts GlobalOptions, ter
 	werr := wg.Wait()
 
 	// return original error
+	if errors.Is(err, restic.ErrQuotaExceeded) {
+		return errors.Fatalf("unable to save snapshot: the repository reached its size limit of %v, the data uploaded so far was kept",
+			ui.FormatBytes(quota.Limit))
+	}
 	if err != nil {
 		return errors.Fatalf("unable to save snapshot: %v", err)
 	}
 
 	// Report finished execution
+	if stats, ok := sema.AdaptiveConnections(repo.Backend()); ok {
+		progressReporter.Connections(stats.Connections, stats.Choices())
+	}
+	uploads := repo.UploadStats()
+	progressReporter.Uploads(uploads.Uploads, uploads.Parallelism, uploads.Waited)
 	progressReporter.Finish(id, opts.DryRun)
-	if !gopts.JSON && !opts.DryRun {
-		progressPrinter.P("snapshot %s saved\n", id.Str())
+	if !gopts.JSON {
+		switch {
+		case sn == nil:
+			progressPrinter.P("no changes, snapshot skipped\n")
+		case !opts.DryRun:
+			progressPrinter.P("snapshot %s saved\n", id.Str())
+		}
 	}
 	if !success {
 		return ErrInvalidSourceData
 	}
+	if werr == nil && sn == nil {
+		return ErrSnapshotSkipped
+	}
 
 	// Return error if any
 	return werr
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/restic/restic/internal/archiver"
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/fs"
 	"github.com/restic/restic/internal/restic"
@@ -185,6 +194,93 @@ func TestDryRunBackup(t *testing.T) {
 	rtest.Equals(t, indexIDs, indexIDsAfter)
 }
 
+type writeCountingBackend struct {
+	backend.Backend
+	writes *int32
+}
+
+func (be *writeCountingBackend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	atomic.AddInt32(be.writes, 1)
+	return be.Backend.Save(ctx, h, rd)
+}
+
+func (be *writeCountingBackend) Remove(ctx context.Context, h backend.Handle) error {
+	atomic.AddInt32(be.writes, 1)
+	return be.Backend.Remove(ctx, h)
+}
+
+func TestDryRunBackupListing(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+	rtest.OK(t, os.MkdirAll(env.testdata, 0755))
+	for _, name := range []string{"unchanged", "modified"} {
+		rtest.OK(t, os.WriteFile(filepath.Join(env.testdata, name), []byte("content of "+name), 0644))
+	}
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+
+	rtest.OK(t, appendRandomData(filepath.Join(env.testdata, "modified"), 100))
+	rtest.OK(t, appendRandomData(filepath.Join(env.testdata, "new"), 200))
+
+	var writes int32
+	gopts := env.gopts
+	gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return &writeCountingBackend{Backend: r, writes: &writes}, nil
+	}
+	gopts.JSON = true
+	gopts.verbosity = 2
+	buf := bytes.NewBuffer(nil)
+	gopts.stdout = buf
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{DryRun: true}, gopts)
+	rtest.Equals(t, int32(0), atomic.LoadInt32(&writes))
+
+	type dryRunFile struct {
+		Action string `json:"action"`
+		Item   string `json:"item"`
+		Reason string `json:"reason"`
+		Size   uint64 `json:"size"`
+	}
+	files := make(map[string]dryRunFile)
+	var summary struct {
+		FilesProcessed uint   `json:"total_files_processed"`
+		BytesProcessed uint64 `json:"total_bytes_processed"`
+		BytesToRead    uint64 `json:"bytes_to_read"`
+		ScannedFiles   uint   `json:"scanned_files"`
+		ScannedBytes   uint64 `json:"scanned_bytes"`
+	}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var msg struct {
+			MessageType string `json:"message_type"`
+		}
+		rtest.OK(t, json.Unmarshal([]byte(line), &msg))
+		switch msg.MessageType {
+		case "dry_run_file":
+			var file dryRunFile
+			rtest.OK(t, json.Unmarshal([]byte(line), &file))
+			files[filepath.Base(file.Item)] = file
+		case "summary":
+			rtest.OK(t, json.Unmarshal([]byte(line), &summary))
+		}
+	}
+
+	modifiedSize := uint64(len("content of modified") + 100)
+	rtest.Equals(t, map[string]dryRunFile{
+		"modified": {Action: "modified", Item: files["modified"].Item, Reason: "size changed", Size: modifiedSize},
+		"new":      {Action: "new", Item: files["new"].Item, Reason: "new", Size: 200},
+	}, files)
+	rtest.Equals(t, modifiedSize+200, summary.BytesToRead)
+	rtest.Equals(t, uint(3), summary.ScannedFiles)
+	rtest.Equals(t, summary.FilesProcessed, summary.ScannedFiles)
+	rtest.Equals(t, summary.BytesProcessed, summary.ScannedBytes)
+
+	// the listing honors the verbosity
+	gopts.verbosity = 1
+	buf.Reset()
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{DryRun: true}, gopts)
+	rtest.Assert(t, !strings.Contains(buf.String(), "dry_run_file"), "unexpected listing %v", buf.String())
+}
+
 func TestBackupNonExistingFile(t *testing.T) {
 	env, cleanup := withTestEnvironment(t)
 	defer cleanup()
@@ -441,6 +537,362 @@ func TestBackupTags(t *testing.T) {
 		"expected parent to be %v, got %v", parent.ID, newest.Parent)
 }
 
+func TestBackupMetadata(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+
+	opts := BackupOptions{Metadata: map[string]string{"ticket": "42"}}
+	testRunBackup(t, "", []string{env.testdata}, opts, env.gopts)
+	testRunCheck(t, env.gopts)
+
+	newest, _ := testRunSnapshots(t, env.gopts)
+	if newest == nil {
+		t.Fatal("expected a backup, got nil")
+	}
+	rtest.Equals(t, map[string]string{"ticket": "42"}, newest.Metadata)
+
+	buf, err := withCaptureStdout(func() error {
+		gopts := env.gopts
+		gopts.JSON = true
+		snapOpts := SnapshotOptions{}
+		snapOpts.Metadata = map[string]string{"ticket": "42"}
+		return runSnapshots(context.TODO(), snapOpts, gopts, []string{})
+	})
+	rtest.OK(t, err)
+	snapshots := []Snapshot{}
+	rtest.OK(t, json.Unmarshal(buf.Bytes(), &snapshots))
+	rtest.Assert(t, len(snapshots) == 1 && snapshots[0].ID.Equal(*newest.ID),
+		"expected only snapshot %v to match the metadata filter, got %v", newest.ID, snapshots)
+
+	opts.Metadata = map[string]string{"": "empty"}
+	err = testRunBackupAssumeFailure(t, "", []string{env.testdata}, opts, env.gopts)
+	rtest.Assert(t, err != nil, "expected error for empty metadata key")
+}
+
+func TestBackupAdaptiveConnections(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	env.gopts.AdaptiveConnections = true
+
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, BackupOptions{}, env.gopts)
+	testListSnapshots(t, env.gopts, 1)
+	testRunCheck(t, env.gopts)
+}
+
+func TestBackupUploadConcurrency(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	env.gopts.UploadConcurrency = 8
+	env.gopts.UploadMemory = "32M"
+
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, BackupOptions{}, env.gopts)
+	testListSnapshots(t, env.gopts, 1)
+	testRunCheck(t, env.gopts)
+}
+
+func TestBackupTar(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	filename := filepath.Join(env.base, "archive.tar")
+	f, err := os.Create(filename)
+	rtest.OK(t, err)
+	tw := tar.NewWriter(f)
+	for _, name := range []string{"etc/hosts", "etc/passwd", "home/user/file"} {
+		data := "content of " + name
+		rtest.OK(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}))
+		_, err := io.WriteString(tw, data)
+		rtest.OK(t, err)
+	}
+	rtest.OK(t, tw.Close())
+	rtest.OK(t, f.Close())
+
+	testRunBackup(t, "", nil, BackupOptions{Tar: filename}, env.gopts)
+	testRunBackup(t, "", []string{"/etc", "/missing"}, BackupOptions{Tar: filename}, env.gopts)
+	testRunCheck(t, env.gopts)
+
+	newest, snapmap := testRunSnapshots(t, env.gopts)
+	rtest.Equals(t, 2, len(snapmap))
+	rtest.Equals(t, []string{"/etc"}, newest.Paths)
+	for id, sn := range snapmap {
+		if !id.Equal(*newest.ID) {
+			rtest.Equals(t, []string{"/"}, sn.Paths)
+		}
+	}
+
+	lsAll := testRunLs(t, env.gopts, "latest")
+	rtest.Assert(t, strings.Contains(strings.Join(lsAll, "\n"), "/etc/passwd"), "missing /etc/passwd in %v", lsAll)
+	rtest.Assert(t, !strings.Contains(strings.Join(lsAll, "\n"), "/home"), "unexpected /home in %v", lsAll)
+
+	err = testRunBackupAssumeFailure(t, "", nil, BackupOptions{Tar: filename, ExcludeOtherFS: true}, env.gopts)
+	rtest.Assert(t, err != nil, "expected error for --one-file-system with --tar")
+}
+
+func TestBackupZip(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	filename := filepath.Join(env.base, "archive.zip")
+	f, err := os.Create(filename)
+	rtest.OK(t, err)
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"data/report.csv", "data/summary.txt", "readme.txt"} {
+		w, err := zw.Create(name)
+		rtest.OK(t, err)
+		_, err = io.WriteString(w, "content of "+name)
+		rtest.OK(t, err)
+	}
+	rtest.OK(t, zw.Close())
+	rtest.OK(t, f.Close())
+
+	testRunBackup(t, "", []string{"/data"}, BackupOptions{Zip: filename}, env.gopts)
+	testRunCheck(t, env.gopts)
+
+	newest, _ := testRunSnapshots(t, env.gopts)
+	rtest.Equals(t, []string{"/data"}, newest.Paths)
+
+	lsAll := strings.Join(testRunLs(t, env.gopts, "latest"), "\n")
+	rtest.Assert(t, strings.Contains(lsAll, "/data/report.csv"), "missing /data/report.csv in %v", lsAll)
+	rtest.Assert(t, !strings.Contains(lsAll, "/readme.txt"), "unexpected /readme.txt in %v", lsAll)
+
+	err = testRunBackupAssumeFailure(t, "", nil, BackupOptions{Zip: filename, Tar: filename}, env.gopts)
+	rtest.Assert(t, err != nil, "expected error for --zip with --tar")
+}
+
+func TestBackupOCIImage(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	// an archive in the format written by docker save
+	writeTar := func(w io.Writer, files ...string) {
+		tw := tar.NewWriter(w)
+		for i := 0; i < len(files); i += 2 {
+			name, content := files[i], files[i+1]
+			rtest.OK(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+			_, err := io.WriteString(tw, content)
+			rtest.OK(t, err)
+		}
+		rtest.OK(t, tw.Close())
+	}
+
+	var layer strings.Builder
+	writeTar(&layer, "etc/hostname", "container", "app/main", "binary")
+	filename := filepath.Join(env.base, "image.tar")
+	f, err := os.Create(filename)
+	rtest.OK(t, err)
+	writeTar(f,
+		"layer.tar", layer.String(),
+		"manifest.json", `[{"Config": "", "RepoTags": ["app:latest"], "Layers": ["layer.tar"]}]`)
+	rtest.OK(t, f.Close())
+
+	testRunBackup(t, "", []string{"/app"}, BackupOptions{OCIImage: filename}, env.gopts)
+	testRunCheck(t, env.gopts)
+
+	lsAll := strings.Join(testRunLs(t, env.gopts, "latest"), "\n")
+	rtest.Assert(t, strings.Contains(lsAll, "/app/main"), "missing /app/main in %v", lsAll)
+	rtest.Assert(t, !strings.Contains(lsAll, "/etc/hostname"), "unexpected /etc/hostname in %v", lsAll)
+
+	err = testRunBackupAssumeFailure(t, "", nil, BackupOptions{OCIPlatform: "linux/amd64"}, env.gopts)
+	rtest.Assert(t, err != nil, "expected error for --oci-platform without --oci-image")
+}
+
+func TestBackupFromSnapshot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("paths within snapshots of Windows directories differ from the original paths")
+	}
+
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	source := filepath.Join(env.base, "source")
+	rtest.OK(t, os.Mkdir(source, 0755))
+	archiver.TestCreateFiles(t, source, archiver.TestDir{
+		"keep":       archiver.TestFile{Content: "keep"},
+		"remove.tmp": archiver.TestFile{Content: "remove"},
+		"sub": archiver.TestDir{
+			"file": archiver.TestFile{Content: "nested"},
+		},
+	})
+	testRunBackup(t, "", []string{source}, BackupOptions{Host: "original"}, env.gopts)
+	original, _ := testRunSnapshots(t, env.gopts)
+
+	// the source directory is not needed anymore
+	rtest.RemoveAll(t, source)
+
+	opts := BackupOptions{FromSnapshot: original.ID.String(), excludePatternOptions: excludePatternOptions{Excludes: []string{"*.tmp"}}}
+	testRunBackup(t, "", nil, opts, env.gopts)
+	testRunCheck(t, env.gopts)
+
+	filtered, snapmap := testRunSnapshots(t, env.gopts)
+	rtest.Equals(t, 2, len(snapmap))
+	rtest.Equals(t, original.Paths, filtered.Paths)
+	rtest.Equals(t, "original", filtered.Hostname)
+	rtest.Equals(t, original.ID, filtered.Parent)
+
+	lsFiltered := strings.Join(testRunLs(t, env.gopts, filtered.ID.String()), "\n")
+	rtest.Assert(t, strings.Contains(lsFiltered, "sub/file"), "missing sub/file in %v", lsFiltered)
+	rtest.Assert(t, !strings.Contains(lsFiltered, "remove.tmp"), "unexpected remove.tmp in %v", lsFiltered)
+
+	// a subfolder of the snapshot can be saved
+	testRunBackup(t, "", []string{filepath.Join(source, "sub")}, BackupOptions{FromSnapshot: "latest"}, env.gopts)
+	newest, _ := testRunSnapshots(t, env.gopts)
+	rtest.Equals(t, []string{filepath.Join(source, "sub")}, newest.Paths)
+
+	err := testRunBackupAssumeFailure(t, "", nil, BackupOptions{FromSnapshot: "latest", Tar: "archive.tar"}, env.gopts)
+	rtest.Assert(t, err != nil, "expected error for --from-snapshot with --tar")
+}
+
+func TestBackupMount(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	for _, name := range []string{"first", "second"} {
+		dir := filepath.Join(env.base, name)
+		rtest.OK(t, os.Mkdir(dir, 0755))
+		archiver.TestCreateFiles(t, dir, archiver.TestDir{
+			name: archiver.TestFile{Content: name},
+		})
+	}
+
+	opts := BackupOptions{Mounts: []string{
+		"/data/first=" + filepath.Join(env.base, "first"),
+		"/second=" + filepath.Join(env.base, "second"),
+	}}
+	testRunBackup(t, "", nil, opts, env.gopts)
+	testRunCheck(t, env.gopts)
+
+	sn, _ := testRunSnapshots(t, env.gopts)
+	rtest.Equals(t, []string{"/data/first", "/second"}, sn.Paths)
+
+	ls := strings.Join(testRunLs(t, env.gopts, sn.ID.String()), "\n")
+	for _, item := range []string{"/data/first/first", "/second/second"} {
+		rtest.Assert(t, strings.Contains(ls, item), "missing %v in %v", item, ls)
+	}
+
+	opts.Mounts = append(opts.Mounts, "/data/first/sub="+filepath.Join(env.base, "second"))
+	err := testRunBackupAssumeFailure(t, "", nil, opts, env.gopts)
+	rtest.Assert(t, err != nil, "expected error for nested mounts")
+
+	err = testRunBackupAssumeFailure(t, "", []string{env.base}, BackupOptions{Mounts: []string{"/a=" + env.base}}, env.gopts)
+	rtest.Assert(t, err != nil, "expected error for --mount with arguments")
+}
+
+func TestBackupRenameTransform(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses Unix paths and commands")
+	}
+	if _, err := exec.LookPath("tr"); err != nil {
+		t.Skip("tr not available")
+	}
+
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	source := filepath.Join(env.base, "source")
+	rtest.OK(t, os.Mkdir(source, 0755))
+	archiver.TestCreateFiles(t, source, archiver.TestDir{
+		"data":    archiver.TestFile{Content: "data"},
+		"app.log": archiver.TestFile{Content: "secret"},
+	})
+
+	opts := BackupOptions{
+		Renames:    []string{source + "=/app"},
+		Transforms: []string{"*.log=tr a-z A-Z"},
+	}
+	testRunBackup(t, "", []string{source}, opts, env.gopts)
+	testRunCheck(t, env.gopts)
+
+	sn, _ := testRunSnapshots(t, env.gopts)
+	rtest.Equals(t, []string{"/app"}, sn.Paths)
+
+	restoredir := filepath.Join(env.base, "restore")
+	testRunRestore(t, env.gopts, restoredir, *sn.ID)
+	for name, content := range map[string]string{"data": "data", "app.log": "SECRET"} {
+		buf, err := os.ReadFile(filepath.Join(restoredir, "app", name))
+		rtest.OK(t, err)
+		rtest.Equals(t, content, string(buf))
+	}
+
+	err := testRunBackupAssumeFailure(t, "", []string{source}, BackupOptions{Renames: []string{"invalid"}}, env.gopts)
+	rtest.Assert(t, err != nil, "expected error for invalid --rename")
+}
+
+func TestBackupSkipIfUnchanged(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	opts := BackupOptions{SkipIfUnchanged: true}
+
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, env.gopts)
+	testListSnapshots(t, env.gopts, 1)
+
+	// nothing changed
+	err := testRunBackupAssumeFailure(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, env.gopts)
+	rtest.Assert(t, err == ErrSnapshotSkipped, "expected ErrSnapshotSkipped, got %v", err)
+	testListSnapshots(t, env.gopts, 1)
+
+	// changed tags require a new snapshot
+	opts.Tags = restic.TagLists{[]string{"NL"}}
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, env.gopts)
+	testListSnapshots(t, env.gopts, 2)
+
+	// changed contents require a new snapshot
+	rtest.OK(t, appendRandomData(filepath.Join(env.testdata, "new-file"), 42))
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, env.gopts)
+	testListSnapshots(t, env.gopts, 3)
+
+	testRunCheck(t, env.gopts)
+}
+
+func TestBackupLazyIndex(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	opts := BackupOptions{LazyIndex: true}
+
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, env.gopts)
+	packs := listPacks(env.gopts, t)
+
+	// all blobs are found using the lazy index
+	opts.Force = true
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, env.gopts)
+	rtest.Equals(t, packs, listPacks(env.gopts, t))
+	files, err := filepath.Glob(filepath.Join(env.cache, "*", "lazy-index"))
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, len(files))
+
+	rtest.OK(t, appendRandomData(filepath.Join(env.testdata, "new-file"), 42))
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, env.gopts)
+	testListSnapshots(t, env.gopts, 3)
+	testRunCheck(t, env.gopts)
+
+	gopts := env.gopts
+	gopts.NoCache = true
+	err = testRunBackupAssumeFailure(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, gopts)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "--no-cache"), "expected error for --no-cache, got %v", err)
+}
+
 func TestBackupProgramVersion(t *testing.T) {
 	env, cleanup := withTestEnvironment(t)
 	defer cleanup()
@@ -579,12 +1031,71 @@ func TestStdinFromCommand(t *testing.T) {
 		StdinFilename: "stdin",
 	}
 
-	testRunBackup(t, filepath.Dir(env.testdata), []string{"python", "-c", "import sys; print('something'); sys.exit(0)"}, opts, env.gopts)
-	testListSnapshots(t, env.gopts, 1)
+	command := []string{"python", "-c", "import sys; print('something'); sys.exit(0)"}
+	testRunBackup(t, filepath.Dir(env.testdata), command, opts, env.gopts)
+	snapshotIDs := testListSnapshots(t, env.gopts, 1)
 
+	r, err := OpenRepository(context.TODO(), env.gopts)
+	rtest.OK(t, err)
+	sn := testLoadLatestSnapshot(t, r, snapshotIDs)
+	rtest.Equals(t, command, sn.Command)
+
+	testRunCheck(t, env.gopts)
+}
+
+func TestStdinSizeAndMtime(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	opts := BackupOptions{
+		StdinCommand:  true,
+		StdinFilename: "stdin",
+		StdinSize:     "1k",
+		StdinMtime:    "2020-01-02 03:04:05",
+	}
+	mtime, err := time.ParseInLocation(TimeFormat, opts.StdinMtime, time.Local)
+	rtest.OK(t, err)
+
+	// the size hint is wrong and the size and mtime of both files are the
+	// same, the second backup must nevertheless store the new content
+	var contents []restic.ID
+	for i, text := range []string{"something", "different"} {
+		testRunBackup(t, filepath.Dir(env.testdata), []string{"python", "-c", "print('" + text + "')"}, opts, env.gopts)
+		snapshotIDs := testListSnapshots(t, env.gopts, i+1)
+
+		r, err := OpenRepository(context.TODO(), env.gopts)
+		rtest.OK(t, err)
+		rtest.OK(t, r.LoadIndex(context.TODO(), nil))
+
+		sn := testLoadLatestSnapshot(t, r, snapshotIDs)
+		tree, err := restic.LoadTree(context.TODO(), r, *sn.Tree)
+		rtest.OK(t, err)
+		rtest.Assert(t, len(tree.Nodes) == 1, "expected one node, got %v", len(tree.Nodes))
+
+		node := tree.Nodes[0]
+		rtest.Equals(t, uint64(len(text)+1), node.Size)
+		rtest.Assert(t, node.ModTime.Equal(mtime), "wrong mtime, want %v, got %v", mtime, node.ModTime)
+		rtest.Assert(t, len(node.Content) == 1, "expected one blob, got %v", len(node.Content))
+		contents = append(contents, node.Content[0])
+	}
+
+	rtest.Assert(t, contents[0] != contents[1], "content of the second backup was not read")
 	testRunCheck(t, env.gopts)
 }
 
+func testLoadLatestSnapshot(t testing.TB, repo restic.Repository, ids restic.IDs) *restic.Snapshot {
+	var latest *restic.Snapshot
+	for _, id := range ids {
+		sn, err := restic.LoadSnapshot(context.TODO(), repo, id)
+		rtest.OK(t, err)
+		if latest == nil || sn.Time.After(latest.Time) {
+			latest = sn
+		}
+	}
+	return latest
+}
+
 func TestStdinFromCommandNoOutput(t *testing.T) {
 	env, cleanup := withTestEnvironment(t)
 	defer cleanup()
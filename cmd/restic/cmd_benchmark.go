@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/ui"
+	"github.com/restic/restic/internal/ui/table"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdBenchmark = &cobra.Command{
+	Use:   "benchmark [flags]",
+	Short: "Measure the performance and check the behavior of the backend",
+	Long: `
+The "benchmark" command writes, reads back, lists and deletes temporary files
+of different sizes in the repository location. It reports the latency and
+throughput of each operation and checks that the backend behaves as restic
+expects: missing files must be reported as such, new files must be visible in
+listings right away and must be read back unmodified, and removed files must
+disappear.
+
+The temporary files are stored as pack files with random names, existing files
+are never modified. They are removed at the end, even if the command is
+interrupted. The repository does not have to be initialized, which allows
+testing a new location before running "init".
+
+EXIT STATUS
+===========
+
+Exit status is 0 if the command was successful and all checks passed, and
+non-zero if there was any error.
+`,
+	DisableAutoGenTag: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runBenchmark(cmd.Context(), benchmarkOptions, globalOptions, args)
+	},
+}
+
+// BenchmarkOptions bundles all options for the benchmark command.
+type BenchmarkOptions struct {
+	FileSizes []string
+	Files     int
+}
+
+var benchmarkOptions BenchmarkOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdBenchmark)
+
+	f := cmdBenchmark.Flags()
+	f.StringSliceVar(&benchmarkOptions.FileSizes, "file-size", []string{"4k", "1M", "16M"}, "`size` of the temporary files (allowed suffixes: k/K, m/M, g/G, t/T, can be specified multiple times)")
+	f.IntVar(&benchmarkOptions.Files, "files", 3, "number of temporary files for each size")
+}
+
+// benchmarkCleanupTimeout limits the time for removing the temporary files
+// after the command was interrupted.
+const benchmarkCleanupTimeout = time.Minute
+
+type benchmarkOperation struct {
+	Operation  string  `json:"operation"`
+	Size       int64   `json:"size,omitempty"`
+	Count      int     `json:"count"`
+	Bytes      uint64  `json:"bytes,omitempty"`
+	LatencyP50 float64 `json:"latency_p50"`
+	LatencyP90 float64 `json:"latency_p90"`
+	LatencyP99 float64 `json:"latency_p99"`
+	LatencyMax float64 `json:"latency_max"`
+	// Throughput is the number of bytes per second
+	Throughput float64 `json:"throughput,omitempty"`
+
+	durations []time.Duration
+}
+
+type benchmarkCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type benchmarkResult struct {
+	Operations []*benchmarkOperation `json:"operations"`
+	Checks     []benchmarkCheck      `json:"checks"`
+	OK         bool                  `json:"ok"`
+}
+
+type benchmarkFile struct {
+	h    backend.Handle
+	size int64
+	hash [sha256.Size]byte
+}
+
+type benchmark struct {
+	be  backend.Backend
+	rnd *rand.Rand
+
+	result benchmarkResult
+	// files contains the temporary files which may exist in the backend
+	files []benchmarkFile
+}
+
+func runBenchmark(ctx context.Context, opts BenchmarkOptions, gopts GlobalOptions, args []string) error {
+	if len(args) > 0 {
+		return errors.Fatal("the benchmark command expects no arguments, only options - please see `restic help benchmark` for usage and flags")
+	}
+	if opts.Files < 1 {
+		return errors.Fatal("--files must be at least 1")
+	}
+
+	var sizes []int64
+	for _, s := range opts.FileSizes {
+		size, err := ui.ParseBytes(s)
+		if err != nil || size <= 0 {
+			return errors.Fatalf("invalid file size %q", s)
+		}
+		sizes = append(sizes, size)
+	}
+
+	repo, err := ReadRepo(gopts)
+	if err != nil {
+		return err
+	}
+	be, err := openBackend(ctx, repo, gopts, gopts.extended)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = be.Close()
+	}()
+
+	b := &benchmark{be: be, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	defer b.cleanup(ctx)
+
+	if err := b.run(ctx, sizes, opts.Files); err != nil {
+		return err
+	}
+
+	if gopts.JSON {
+		if err := json.NewEncoder(globalOptions.stdout).Encode(b.result); err != nil {
+			return err
+		}
+	} else if err := b.print(); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, c := range b.result.Checks {
+		if !c.OK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Fatalf("the backend failed %d of %d checks", failed, len(b.result.Checks))
+	}
+	return nil
+}
+
+func (b *benchmark) run(ctx context.Context, sizes []int64, files int) error {
+	if err := b.checkMissing(ctx); err != nil {
+		return err
+	}
+
+	for _, size := range sizes {
+		for i := 0; i < files; i++ {
+			if _, err := b.save(ctx, b.newHandle(), size); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := b.checkList(ctx); err != nil {
+		return err
+	}
+	if err := b.checkStat(ctx); err != nil {
+		return err
+	}
+	if err := b.checkContent(ctx); err != nil {
+		return err
+	}
+	if err := b.checkReplace(ctx); err != nil {
+		return err
+	}
+	if err := b.checkRemove(ctx); err != nil {
+		return err
+	}
+
+	for _, op := range b.result.Operations {
+		op.summarize()
+	}
+	b.result.OK = true
+	for _, c := range b.result.Checks {
+		b.result.OK = b.result.OK && c.OK
+	}
+	return nil
+}
+
+// newHandle returns a handle for a temporary file. As pack files are named
+// after the hash of their content, a random name never matches an existing
+// file.
+func (b *benchmark) newHandle() backend.Handle {
+	return backend.Handle{Type: restic.PackFile, Name: restic.NewRandomID().String()}
+}
+
+// measure runs fn and records its duration for the operation.
+func (b *benchmark) measure(name string, size int64, fn func() error) error {
+	var op *benchmarkOperation
+	for _, o := range b.result.Operations {
+		if o.Operation == name && o.Size == size {
+			op = o
+		}
+	}
+	if op == nil {
+		op = &benchmarkOperation{Operation: name, Size: size}
+		b.result.Operations = append(b.result.Operations, op)
+	}
+
+	start := time.Now()
+	err := fn()
+	op.durations = append(op.durations, time.Since(start))
+	op.Count++
+	if size > 0 {
+		op.Bytes += uint64(size)
+	}
+	return err
+}
+
+func (b *benchmark) addCheck(name string, failures []string) {
+	c := benchmarkCheck{Name: name, OK: len(failures) == 0}
+	if len(failures) > 0 {
+		c.Message = failures[0]
+		if len(failures) > 1 {
+			c.Message += fmt.Sprintf(" (and %d more)", len(failures)-1)
+		}
+	}
+	debug.Log("check %v: %v %v", name, c.OK, failures)
+	b.result.Checks = append(b.result.Checks, c)
+}
+
+// save stores a file with random content of the given size.
+func (b *benchmark) save(ctx context.Context, h backend.Handle, size int64) (benchmarkFile, error) {
+	data := make([]byte, size)
+	_, _ = b.rnd.Read(data)
+	f := benchmarkFile{h: h, size: size, hash: sha256.Sum256(data)}
+
+	if !b.known(h) {
+		// remember the file before saving it, a failed upload may leave a
+		// partial file behind
+		b.files = append(b.files, f)
+	}
+	err := b.measure("save", size, func() error {
+		return b.be.Save(ctx, h, backend.NewByteReader(data, b.be.Hasher()))
+	})
+	if err != nil {
+		return f, errors.Wrapf(err, "Save(%v)", h)
+	}
+	return f, nil
+}
+
+func (b *benchmark) known(h backend.Handle) bool {
+	for _, f := range b.files {
+		if f.h == h {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *benchmark) checkMissing(ctx context.Context) error {
+	h := b.newHandle()
+	var failures []string
+
+	err := b.measure("stat", 0, func() error {
+		_, err := b.be.Stat(ctx, h)
+		return err
+	})
+	if err == nil {
+		failures = append(failures, "Stat of a missing file succeeded")
+	} else if !b.be.IsNotExist(err) {
+		failures = append(failures, fmt.Sprintf("Stat of a missing file returned an unrecognized error: %v", err))
+	}
+
+	err = b.be.Load(ctx, h, 0, 0, func(rd io.Reader) error {
+		_, err := io.Copy(io.Discard, rd)
+		return err
+	})
+	if err == nil {
+		failures = append(failures, "Load of a missing file succeeded")
+	} else if !b.be.IsNotExist(err) {
+		failures = append(failures, fmt.Sprintf("Load of a missing file returned an unrecognized error: %v", err))
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	b.addCheck("missing-file", failures)
+	return nil
+}
+
+// list returns the sizes of the temporary files found in the listing.
+func (b *benchmark) list(ctx context.Context) (map[string]int64, error) {
+	found := make(map[string]int64)
+	err := b.measure("list", 0, func() error {
+		return b.be.List(ctx, restic.PackFile, func(fi backend.FileInfo) error {
+			if b.known(backend.Handle{Type: restic.PackFile, Name: fi.Name}) {
+				found[fi.Name] = fi.Size
+			}
+			return nil
+		})
+	})
+	return found, errors.Wrap(err, "List")
+}
+
+func (b *benchmark) checkList(ctx context.Context) error {
+	found, err := b.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, f := range b.files {
+		size, ok := found[f.h.Name]
+		switch {
+		case !ok:
+			failures = append(failures, fmt.Sprintf("new file %v is missing from the listing", f.h.Name))
+		case size != f.size:
+			failures = append(failures, fmt.Sprintf("listing reports size %d for new file %v, expected %d", size, f.h.Name, f.size))
+		}
+	}
+	b.addCheck("list-after-write", failures)
+	return nil
+}
+
+func (b *benchmark) checkStat(ctx context.Context) error {
+	var failures []string
+	for _, f := range b.files {
+		var fi backend.FileInfo
+		err := b.measure("stat", 0, func() error {
+			var err error
+			fi, err = b.be.Stat(ctx, f.h)
+			return err
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("Stat(%v) failed: %v", f.h.Name, err))
+		case fi.Size != f.size:
+			failures = append(failures, fmt.Sprintf("Stat(%v) reports size %d, expected %d", f.h.Name, fi.Size, f.size))
+		}
+	}
+	b.addCheck("stat-after-write", failures)
+	return nil
+}
+
+// load returns the hash of the content of the file.
+func (b *benchmark) load(ctx context.Context, f benchmarkFile) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	err := b.measure("load", f.size, func() error {
+		return b.be.Load(ctx, f.h, 0, 0, func(rd io.Reader) error {
+			hw := sha256.New()
+			if _, err := io.Copy(hw, rd); err != nil {
+				return err
+			}
+			copy(hash[:], hw.Sum(nil))
+			return nil
+		})
+	})
+	return hash, err
+}
+
+func (b *benchmark) checkContent(ctx context.Context) error {
+	var failures []string
+	for _, f := range b.files {
+		hash, err := b.load(ctx, f)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("Load(%v) failed: %v", f.h.Name, err))
+		case !bytes.Equal(hash[:], f.hash[:]):
+			failures = append(failures, fmt.Sprintf("Load(%v) returned modified content", f.h.Name))
+		}
+	}
+	b.addCheck("content", failures)
+	return nil
+}
+
+// checkReplace overwrites the smallest file if the backend claims to replace
+// files atomically. The new content must be visible right away.
+func (b *benchmark) checkReplace(ctx context.Context) error {
+	if !b.be.HasAtomicReplace() {
+		b.result.Checks = append(b.result.Checks, benchmarkCheck{Name: "atomic-replace", OK: true, Message: "not supported by the backend"})
+		return nil
+	}
+
+	smallest := b.files[0]
+	for _, f := range b.files {
+		if f.size < smallest.size {
+			smallest = f
+		}
+	}
+
+	f, err := b.save(ctx, smallest.h, smallest.size)
+	if err != nil {
+		return err
+	}
+	for i := range b.files {
+		if b.files[i].h == f.h {
+			b.files[i] = f
+		}
+	}
+
+	var failures []string
+	hash, err := b.load(ctx, f)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	switch {
+	case err != nil:
+		failures = append(failures, fmt.Sprintf("Load(%v) failed after replacing the file: %v", f.h.Name, err))
+	case !bytes.Equal(hash[:], f.hash[:]):
+		failures = append(failures, fmt.Sprintf("Load(%v) returned the old content after replacing the file", f.h.Name))
+	}
+	b.addCheck("atomic-replace", failures)
+	return nil
+}
+
+func (b *benchmark) checkRemove(ctx context.Context) error {
+	var failures []string
+	removed := make(map[string]struct{})
+	for _, f := range b.files {
+		err := b.measure("remove", 0, func() error {
+			return b.be.Remove(ctx, f.h)
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("Remove(%v) failed: %v", f.h.Name, err))
+			continue
+		}
+		removed[f.h.Name] = struct{}{}
+
+		_, err = b.be.Stat(ctx, f.h)
+		if err == nil || !b.be.IsNotExist(err) {
+			failures = append(failures, fmt.Sprintf("Stat(%v) does not report a removed file as missing: %v", f.h.Name, err))
+		}
+	}
+
+	found, err := b.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, f := range b.files {
+		_, listed := found[f.h.Name]
+		if _, ok := removed[f.h.Name]; ok && listed {
+			failures = append(failures, fmt.Sprintf("removed file %v is still listed", f.h.Name))
+		}
+	}
+	b.addCheck("remove", failures)
+
+	// keep the files which are still listed or could not be removed for
+	// the cleanup
+	var remaining []benchmarkFile
+	for _, f := range b.files {
+		_, listed := found[f.h.Name]
+		if _, ok := removed[f.h.Name]; listed || !ok {
+			remaining = append(remaining, f)
+		}
+	}
+	b.files = remaining
+	return nil
+}
+
+// cleanup removes all temporary files which may still exist. It also runs
+// after ctx was canceled.
+func (b *benchmark) cleanup(ctx context.Context) {
+	if len(b.files) == 0 {
+		return
+	}
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), benchmarkCleanupTimeout)
+		defer cancel()
+	}
+
+	for _, f := range b.files {
+		err := b.be.Remove(ctx, f.h)
+		if err != nil && !b.be.IsNotExist(err) {
+			Warnf("unable to remove temporary file %v: %v\n", f.h, err)
+		}
+	}
+	b.files = nil
+}
+
+// summarize calculates the latency percentiles and the throughput.
+func (op *benchmarkOperation) summarize() {
+	sorted := append([]time.Duration(nil), op.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(p int) float64 {
+		// nearest-rank method
+		idx := (len(sorted)*p + 99) / 100
+		if idx < 1 {
+			idx = 1
+		}
+		return sorted[idx-1].Seconds()
+	}
+	op.LatencyP50 = percentile(50)
+	op.LatencyP90 = percentile(90)
+	op.LatencyP99 = percentile(99)
+	op.LatencyMax = sorted[len(sorted)-1].Seconds()
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	if op.Bytes > 0 && total > 0 {
+		op.Throughput = float64(op.Bytes) / total.Seconds()
+	}
+}
+
+func formatLatency(sec float64) string {
+	return fmt.Sprintf("%.1fms", sec*1000)
+}
+
+func (b *benchmark) print() error {
+	tab := table.New()
+	tab.AddColumn("Operation", "{{ .Operation }}")
+	tab.AddColumn("Size", "{{ .Size }}")
+	tab.AddColumn("Count", "{{ .Count }}")
+	tab.AddColumn("p50", "{{ .P50 }}")
+	tab.AddColumn("p90", "{{ .P90 }}")
+	tab.AddColumn("p99", "{{ .P99 }}")
+	tab.AddColumn("Max", "{{ .Max }}")
+	tab.AddColumn("Throughput", "{{ .Throughput }}")
+
+	for _, op := range b.result.Operations {
+		row := struct {
+			Operation, Size    string
+			Count              int
+			P50, P90, P99, Max string
+			Throughput         string
+		}{
+			Operation: op.Operation,
+			Count:     op.Count,
+			P50:       formatLatency(op.LatencyP50),
+			P90:       formatLatency(op.LatencyP90),
+			P99:       formatLatency(op.LatencyP99),
+			Max:       formatLatency(op.LatencyMax),
+		}
+		if op.Size > 0 {
+			row.Size = ui.FormatBytes(uint64(op.Size))
+		}
+		if op.Throughput > 0 {
+			row.Throughput = ui.FormatBytes(uint64(op.Throughput)) + "/s"
+		}
+		tab.AddRow(row)
+	}
+	if err := tab.Write(globalOptions.stdout); err != nil {
+		return err
+	}
+
+	Printf("\n")
+	for _, c := range b.result.Checks {
+		status := "ok"
+		if !c.OK {
+			status = "FAILED"
+		}
+		if c.Message != "" {
+			Printf("%-18s %s: %s\n", c.Name, status, c.Message)
+		} else {
+			Printf("%-18s %s\n", c.Name, status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func testRunBenchmark(t testing.TB, gopts GlobalOptions) (benchmarkResult, error) {
+	var result benchmarkResult
+	buf, err := withCaptureStdout(func() error {
+		gopts.JSON = true
+		opts := BenchmarkOptions{FileSizes: []string{"1k", "100k"}, Files: 2}
+		return runBenchmark(context.TODO(), opts, gopts, nil)
+	})
+	if buf.Len() > 0 {
+		rtest.OK(t, json.Unmarshal(buf.Bytes(), &result))
+	}
+	return result, err
+}
+
+func checkBenchmarkResult(t testing.TB, result benchmarkResult, failed ...string) {
+	t.Helper()
+	for _, c := range result.Checks {
+		shouldFail := false
+		for _, name := range failed {
+			shouldFail = shouldFail || c.Name == name
+		}
+		rtest.Assert(t, c.OK != shouldFail, "unexpected result of check %v: %v", c.Name, c.Message)
+	}
+	rtest.Equals(t, len(failed) == 0, result.OK)
+}
+
+func TestBenchmark(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	testRunBackup(t, env.testdata, []string{"."}, BackupOptions{}, env.gopts)
+	packsBefore := listPacks(env.gopts, t)
+
+	result, err := testRunBenchmark(t, env.gopts)
+	rtest.OK(t, err)
+	checkBenchmarkResult(t, result)
+
+	counts := make(map[string]int)
+	for _, op := range result.Operations {
+		counts[op.Operation] += op.Count
+		rtest.Assert(t, op.LatencyP50 <= op.LatencyP90 && op.LatencyP90 <= op.LatencyP99 && op.LatencyP99 <= op.LatencyMax,
+			"latency percentiles of %v are not sorted: %v", op.Operation, op)
+		if op.Operation == "save" || op.Operation == "load" {
+			rtest.Assert(t, op.Size > 0 && op.Throughput > 0, "missing throughput for %v", op.Operation)
+		}
+	}
+	// the local backend replaces files atomically, the first file is saved
+	// and loaded twice
+	rtest.Equals(t, map[string]int{"stat": 5, "save": 5, "list": 2, "load": 5, "remove": 4}, counts)
+
+	// the repository is unchanged
+	rtest.Equals(t, packsBefore, listPacks(env.gopts, t))
+	testRunCheck(t, env.gopts)
+}
+
+// staleListBackend does not list files created after it was opened.
+type staleListBackend struct {
+	backend.Backend
+	known map[string]struct{}
+}
+
+func (be *staleListBackend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	be.known[h.Name] = struct{}{}
+	return be.Backend.Save(ctx, h, rd)
+}
+
+func (be *staleListBackend) List(ctx context.Context, t restic.FileType, fn func(backend.FileInfo) error) error {
+	return be.Backend.List(ctx, t, func(fi backend.FileInfo) error {
+		if _, ok := be.known[fi.Name]; ok {
+			return nil
+		}
+		return fn(fi)
+	})
+}
+
+func TestBenchmarkFailedCheck(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	gopts := env.gopts
+	gopts.backendInnerTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return &staleListBackend{Backend: r, known: make(map[string]struct{})}, nil
+	}
+	result, err := testRunBenchmark(t, gopts)
+	rtest.Assert(t, err != nil, "benchmark with failed check succeeded")
+	checkBenchmarkResult(t, result, "list-after-write")
+	rtest.Equals(t, 0, len(listPacks(env.gopts, t)))
+}
+
+// cancelingBackend cancels the context after the first file was saved.
+type cancelingBackend struct {
+	backend.Backend
+	cancel context.CancelFunc
+}
+
+func (be *cancelingBackend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err := be.Backend.Save(ctx, h, rd)
+	be.cancel()
+	return err
+}
+
+func TestBenchmarkCanceled(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	gopts := env.gopts
+	gopts.backendInnerTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return &cancelingBackend{Backend: r, cancel: cancel}, nil
+	}
+	err := runBenchmark(ctx, BenchmarkOptions{FileSizes: []string{"1k"}, Files: 3}, gopts, nil)
+	rtest.Assert(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+
+	// the temporary file was removed
+	rtest.Equals(t, 0, len(listPacks(env.gopts, t)))
+}
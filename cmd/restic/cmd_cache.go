@@ -11,6 +11,7 @@ import (
 	"github.com/restic/restic/internal/cache"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/ui"
 	"github.com/restic/restic/internal/ui/table"
 	"github.com/spf13/cobra"
@@ -176,3 +177,14 @@ func dirSize(path string) (int64, error) {
 	})
 	return size, err
 }
+
+// printPackCacheStats prints how often data pack files were loaded from the
+// pack cache, if it is used.
+func printPackCacheStats(repo *repository.Repository) {
+	if repo.PackCache == nil {
+		return
+	}
+
+	stats := repo.PackCache.Stats()
+	Verbosef("pack cache: %d hits, %d misses\n", stats.Hits, stats.Misses)
+}
@@ -49,6 +49,8 @@ type CheckOptions struct {
 	ReadDataSubset string
 	CheckUnused    bool
 	WithCache      bool
+	thawOptions
+	prefetchOptions
 }
 
 var checkOptions CheckOptions
@@ -67,12 +69,17 @@ func init() {
 		panic(err)
 	}
 	f.BoolVar(&checkOptions.WithCache, "with-cache", false, "use existing cache, only read uncached data from repository")
+	initThawOptions(f, &checkOptions.thawOptions)
+	initPrefetchOptions(f, &checkOptions.prefetchOptions)
 }
 
 func checkFlags(opts CheckOptions) error {
 	if opts.ReadData && opts.ReadDataSubset != "" {
 		return errors.Fatal("check flags --read-data and --read-data-subset cannot be used together")
 	}
+	if _, err := opts.prefetchOptions.options(); err != nil {
+		return err
+	}
 	if opts.ReadDataSubset != "" {
 		dataSubset, err := stringToIntSlice(opts.ReadDataSubset)
 		argumentError := errors.Fatal("check flag --read-data-subset has invalid value, please see documentation")
@@ -180,6 +187,12 @@ func prepareCheckCache(opts CheckOptions, gopts *GlobalOptions) (cleanup func())
 		return cleanup
 	}
 
+	// the pack cache is kept in the regular cache directory
+	gopts.packCacheDir = gopts.CacheDir
+	if gopts.packCacheDir == "" {
+		gopts.packCacheDir, _ = cache.DefaultDir()
+	}
+
 	gopts.CacheDir = tempdir
 	Verbosef("using temporary cache in %v\n", tempdir)
 
@@ -220,10 +233,21 @@ func runCheck(ctx context.Context, opts CheckOptions, gopts GlobalOptions, args
 	}
 
 	chkr := checker.New(repo, opts.CheckUnused)
+	chkr.Prefetch, err = opts.prefetchOptions.options()
+	if err != nil {
+		return err
+	}
 	err = chkr.LoadSnapshots(ctx)
 	if err != nil {
 		return err
 	}
+	tombstones, err := chkr.Tombstones(ctx)
+	if err != nil {
+		return err
+	}
+	if len(tombstones.Marked) > 0 {
+		Verbosef("%d snapshots are marked as removed by %d tombstones and will not be checked\n", len(tombstones.Marked), len(tombstones.IDs))
+	}
 
 	Verbosef("load indexes\n")
 	bar := newIndexProgress(gopts.Quiet, gopts.JSON)
@@ -323,6 +347,16 @@ func runCheck(ctx context.Context, opts CheckOptions, gopts GlobalOptions, args
 	}
 
 	doReadData := func(packs map[restic.ID]int64) {
+		ids := make(restic.IDs, 0, len(packs))
+		for id := range packs {
+			ids = append(ids, id)
+		}
+		if err := thawPacks(ctx, repo, ids, opts.thawOptions, gopts); err != nil {
+			errorsFound = true
+			Warnf("%v\n", err)
+			return
+		}
+
 		packCount := uint64(len(packs))
 
 		p := newProgressMax(!gopts.Quiet, packCount, "packs")
@@ -394,6 +428,7 @@ func runCheck(ctx context.Context, opts CheckOptions, gopts GlobalOptions, args
 		}
 		doReadData(packs)
 	}
+	printPackCacheStats(repo)
 
 	if errorsFound {
 		return errors.Fatal("repository contains errors")
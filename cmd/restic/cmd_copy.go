@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/walker"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/restic/chunker"
 	"github.com/spf13/cobra"
 )
 
@@ -30,6 +33,14 @@ This means that copied files, which existed in both the source and destination
 repository, /may occupy up to twice their space/ in the destination repository.
 This can be mitigated by the "--copy-chunker-params" option when initializing a
 new destination repository using the "init" command.
+
+If the repositories use different chunk sizes, the files are split into chunks
+again according to the chunker parameters of the destination repository. This
+is considerably slower than copying the blobs.
+
+If the repositories use different blob hash algorithms, the IDs of all blobs
+of the copied snapshots are computed again. This requires loading every file
+and directory instead of copying whole pack files.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return runCopy(cmd.Context(), copyOptions, globalOptions, args)
@@ -108,6 +119,17 @@ func runCopy(ctx context.Context, opts CopyOptions, gopts GlobalOptions, args []
 		return err
 	}
 
+	var rc *rechunker
+	srcCfg, dstCfg := srcRepo.Config(), dstRepo.Config()
+	switch {
+	case srcCfg.ChunkerSizes.Normalize() != dstCfg.ChunkerSizes.Normalize():
+		Verbosef("the repositories use different chunk sizes, files are split into new chunks\n")
+		rc = newRechunker(srcRepo, dstRepo, true)
+	case srcCfg.BlobHasher() != dstCfg.BlobHasher():
+		Verbosef("the repositories use different blob hash algorithms (%v and %v), blob IDs are computed again\n", srcCfg.BlobHasher(), dstCfg.BlobHasher())
+		rc = newRechunker(srcRepo, dstRepo, false)
+	}
+
 	dstSnapshotByOriginal := make(map[restic.ID][]*restic.Snapshot)
 	for sn := range FindFilteredSnapshots(ctx, dstSnapshotLister, dstRepo, &opts.SnapshotFilter, nil) {
 		if sn.Original != nil && !sn.Original.IsNull() {
@@ -130,7 +152,8 @@ func runCopy(ctx context.Context, opts CopyOptions, gopts GlobalOptions, args []
 		if originalSns, ok := dstSnapshotByOriginal[srcOriginal]; ok {
 			isCopy := false
 			for _, originalSn := range originalSns {
-				if similarSnapshots(originalSn, sn) {
+				// re-chunked or re-hashed files result in a different tree
+				if similarSnapshots(originalSn, sn, rc != nil) {
 					Verboseff("\n%v\n", sn)
 					Verboseff("skipping source snapshot %s, was already copied to snapshot %s\n", sn.ID().Str(), originalSn.ID().Str())
 					isCopy = true
@@ -143,7 +166,13 @@ func runCopy(ctx context.Context, opts CopyOptions, gopts GlobalOptions, args []
 		}
 		Verbosef("\n%v\n", sn)
 		Verbosef("  copy started, this may take a while...\n")
-		if err := copyTree(ctx, srcRepo, dstRepo, visitedTrees, *sn.Tree, gopts.Quiet); err != nil {
+		if rc != nil {
+			newTree, err := rc.copyTree(ctx, *sn.Tree)
+			if err != nil {
+				return err
+			}
+			sn.Tree = &newTree
+		} else if err := copyTree(ctx, srcRepo, dstRepo, visitedTrees, *sn.Tree, gopts.Quiet); err != nil {
 			return err
 		}
 		debug.Log("tree copied")
@@ -163,15 +192,16 @@ func runCopy(ctx context.Context, opts CopyOptions, gopts GlobalOptions, args []
 	return nil
 }
 
-func similarSnapshots(sna *restic.Snapshot, snb *restic.Snapshot) bool {
+func similarSnapshots(sna *restic.Snapshot, snb *restic.Snapshot, ignoreTree bool) bool {
 	// everything except Parent and Original must match
-	if !sna.Time.Equal(snb.Time) || !sna.Tree.Equal(*snb.Tree) || sna.Hostname != snb.Hostname ||
+	if !sna.Time.Equal(snb.Time) || (!ignoreTree && !sna.Tree.Equal(*snb.Tree)) || sna.Hostname != snb.Hostname ||
 		sna.Username != snb.Username || sna.UID != snb.UID || sna.GID != snb.GID ||
 		len(sna.Paths) != len(snb.Paths) || len(sna.Excludes) != len(snb.Excludes) ||
 		len(sna.Tags) != len(snb.Tags) {
 		return false
 	}
-	if !sna.HasPaths(snb.Paths) || !sna.HasTags(snb.Tags) {
+	if !sna.HasPaths(snb.Paths) || !sna.HasTags(snb.Tags) ||
+		len(sna.Metadata) != len(snb.Metadata) || !sna.HasMetadata(snb.Metadata) {
 		return false
 	}
 	for i, a := range sna.Excludes {
@@ -243,3 +273,161 @@ func copyTree(ctx context.Context, srcRepo restic.Repository, dstRepo restic.Rep
 	}
 	return nil
 }
+
+// rechunker copies trees to a repository with different chunk sizes or a
+// different blob hash algorithm. The files are split into chunks again using
+// the chunker parameters of the destination repository, unless only the IDs
+// of the blobs have to be computed again.
+type rechunker struct {
+	src, dst restic.Repository
+	rewriter *walker.TreeRewriter
+	rechunk  bool
+
+	chunker *chunker.Chunker
+	buf     []byte
+
+	// ctx and err are only valid while copyTree is running
+	ctx context.Context
+	err error
+}
+
+func newRechunker(src, dst restic.Repository, rechunk bool) *rechunker {
+	rc := &rechunker{
+		src:     src,
+		dst:     dst,
+		rechunk: rechunk,
+		chunker: dst.Config().NewChunker(nil),
+		buf:     make([]byte, dst.Config().Max()),
+	}
+	// the rewriter remembers the trees which were already copied
+	rc.rewriter = walker.NewTreeRewriter(walker.RewriteOpts{
+		RewriteNode: rc.rewriteNode,
+		BlobHasher:  src.Config().BlobHasher(),
+	})
+	return rc
+}
+
+// LoadBlob loads a blob from the source repository.
+func (rc *rechunker) LoadBlob(ctx context.Context, t restic.BlobType, id restic.ID, buf []byte) ([]byte, error) {
+	return rc.src.LoadBlob(ctx, t, id, buf)
+}
+
+// SaveBlob saves a blob in the destination repository.
+func (rc *rechunker) SaveBlob(ctx context.Context, t restic.BlobType, buf []byte, id restic.ID, storeDuplicate bool) (restic.ID, bool, int, error) {
+	return rc.dst.SaveBlob(ctx, t, buf, id, storeDuplicate)
+}
+
+// copyTree copies the tree with the given ID and returns the ID of the copy.
+func (rc *rechunker) copyTree(ctx context.Context, treeID restic.ID) (restic.ID, error) {
+	wg, wgCtx := errgroup.WithContext(ctx)
+	rc.dst.StartPackUploader(wgCtx, wg)
+
+	var newTreeID restic.ID
+	wg.Go(func() error {
+		rc.ctx, rc.err = wgCtx, nil
+		var err error
+		newTreeID, err = rc.rewriter.RewriteTree(wgCtx, rc, "/", treeID)
+		if err == nil {
+			err = rc.err
+		}
+		if err != nil {
+			return err
+		}
+		return rc.dst.Flush(wgCtx)
+	})
+	return newTreeID, wg.Wait()
+}
+
+func (rc *rechunker) rewriteNode(node *restic.Node, path string) *restic.Node {
+	if node.Type != "file" || rc.err != nil {
+		return node
+	}
+
+	var content restic.IDs
+	var err error
+	if rc.rechunk {
+		content, err = rc.rechunkFile(rc.ctx, node.Content)
+	} else {
+		content, err = rc.rehashFile(rc.ctx, node.Content)
+	}
+	if err != nil {
+		rc.err = fmt.Errorf("copying %v failed: %w", path, err)
+		return node
+	}
+	node.Content = content
+	return node
+}
+
+// rechunkFile splits the data of the blobs into new chunks and saves them in
+// the destination repository.
+func (rc *rechunker) rechunkFile(ctx context.Context, blobs restic.IDs) (restic.IDs, error) {
+	rd := &blobReader{ctx: ctx, repo: rc.src, blobs: blobs}
+	rc.dst.Config().ResetChunker(rc.chunker, rd)
+
+	content := restic.IDs{}
+	for {
+		chunk, err := rc.chunker.Next(rc.buf)
+		if err == io.EOF {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id, _, _, err := rc.dst.SaveBlob(ctx, restic.DataBlob, chunk.Data, restic.ID{}, false)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, id)
+	}
+}
+
+// rehashFile saves the blobs in the destination repository, which computes
+// their IDs using its blob hash algorithm.
+func (rc *rechunker) rehashFile(ctx context.Context, blobs restic.IDs) (restic.IDs, error) {
+	content := make(restic.IDs, 0, len(blobs))
+	for _, blobID := range blobs {
+		var err error
+		rc.buf, err = rc.src.LoadBlob(ctx, restic.DataBlob, blobID, rc.buf)
+		if err != nil {
+			return nil, err
+		}
+
+		id, _, _, err := rc.dst.SaveBlob(ctx, restic.DataBlob, rc.buf, restic.ID{}, false)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, id)
+	}
+	return content, nil
+}
+
+// blobReader reads the concatenated data of blobs.
+type blobReader struct {
+	ctx   context.Context
+	repo  restic.BlobLoader
+	blobs restic.IDs
+
+	buf  []byte
+	rest []byte
+}
+
+func (rd *blobReader) Read(p []byte) (int, error) {
+	for len(rd.rest) == 0 {
+		if len(rd.blobs) == 0 {
+			return 0, io.EOF
+		}
+
+		var err error
+		rd.buf, err = rd.repo.LoadBlob(rd.ctx, restic.DataBlob, rd.blobs[0], rd.buf)
+		if err != nil {
+			return 0, err
+		}
+		rd.rest = rd.buf
+		rd.blobs = rd.blobs[1:]
+	}
+
+	n := copy(p, rd.rest)
+	rd.rest = rd.rest[n:]
+	return n, nil
+}
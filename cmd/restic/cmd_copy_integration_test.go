@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/restic/restic/internal/restic"
 	rtest "github.com/restic/restic/internal/test"
 )
 
@@ -134,3 +136,74 @@ func TestCopyUnstableJSON(t *testing.T) {
 	testRunCheck(t, env2.gopts)
 	testListSnapshots(t, env2.gopts, 1)
 }
+
+func TestCopyRechunk(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+	env2, cleanup2 := withTestEnvironment(t)
+	defer cleanup2()
+
+	testSetupBackupData(t, env)
+	// a file which consists of several chunks in both repositories
+	rtest.OK(t, os.WriteFile(filepath.Join(env.testdata, "0", "0", "9", "large"), rtest.Random(42, 3*1024*1024), 0o644))
+	testRunBackup(t, "", []string{filepath.Join(env.testdata, "0", "0", "9")}, BackupOptions{}, env.gopts)
+
+	initOpts := InitOptions{ChunkMinSize: "64KiB", ChunkAverageSize: "128KiB", ChunkMaxSize: "256KiB"}
+	rtest.OK(t, runInit(context.TODO(), initOpts, env2.gopts, nil))
+	testRunCopy(t, env.gopts, env2.gopts)
+	// check verifies that all blobs respect the chunk sizes of the destination
+	testRunCheck(t, env2.gopts)
+
+	// the copy is detected although it has a different tree
+	testRunCopy(t, env.gopts, env2.gopts)
+	snapshotIDs := testListSnapshots(t, env.gopts, 1)
+	copiedSnapshotIDs := testListSnapshots(t, env2.gopts, 1)
+
+	restoredir := filepath.Join(env.base, "restore")
+	testRunRestore(t, env.gopts, restoredir, snapshotIDs[0])
+	copydir := filepath.Join(env2.base, "restore")
+	testRunRestore(t, env2.gopts, copydir, copiedSnapshotIDs[0])
+	rtest.Equals(t, "", directoriesContentsDiff(restoredir, copydir))
+
+	repo, err := OpenRepository(context.TODO(), env.gopts)
+	rtest.OK(t, err)
+	sn := testLoadLatestSnapshot(t, repo, snapshotIDs)
+	repo2, err := OpenRepository(context.TODO(), env2.gopts)
+	rtest.OK(t, err)
+	copied := testLoadLatestSnapshot(t, repo2, copiedSnapshotIDs)
+	rtest.Assert(t, !sn.Tree.Equal(*copied.Tree), "files were not split into new chunks")
+}
+
+func TestCopyBlobHash(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+	env2, cleanup2 := withTestEnvironment(t)
+	defer cleanup2()
+
+	testSetupBackupData(t, env)
+	testRunBackup(t, "", []string{filepath.Join(env.testdata, "0", "0", "9")}, BackupOptions{}, env.gopts)
+
+	initOpts := InitOptions{BlobHash: restic.BlobHashBLAKE3}
+	rtest.OK(t, runInit(context.TODO(), initOpts, env2.gopts, nil))
+	testRunCopy(t, env.gopts, env2.gopts)
+	// check verifies that all blobs use the hash of the destination
+	testRunCheck(t, env2.gopts)
+
+	snapshotIDs := testListSnapshots(t, env.gopts, 1)
+	copiedSnapshotIDs := testListSnapshots(t, env2.gopts, 1)
+
+	restoredir := filepath.Join(env.base, "restore")
+	testRunRestore(t, env.gopts, restoredir, snapshotIDs[0])
+	copydir := filepath.Join(env2.base, "restore")
+	testRunRestore(t, env2.gopts, copydir, copiedSnapshotIDs[0])
+	rtest.Equals(t, "", directoriesContentsDiff(restoredir, copydir))
+
+	repo, err := OpenRepository(context.TODO(), env.gopts)
+	rtest.OK(t, err)
+	sn := testLoadLatestSnapshot(t, repo, snapshotIDs)
+	repo2, err := OpenRepository(context.TODO(), env2.gopts)
+	rtest.OK(t, err)
+	rtest.Equals(t, restic.BlobHashBLAKE3, repo2.Config().BlobHasher().String())
+	copied := testLoadLatestSnapshot(t, repo2, copiedSnapshotIDs)
+	rtest.Assert(t, !sn.Tree.Equal(*copied.Tree), "blobs were not hashed again")
+}
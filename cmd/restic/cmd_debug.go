@@ -382,7 +382,7 @@ func loadBlobs(ctx context.Context, repo restic.Repository, packID restic.ID, li
 				}
 			}
 
-			id := restic.Hash(plaintext)
+			id := repo.Config().BlobHasher().Hash(plaintext)
 			var prefix string
 			if !id.Equal(blob.ID) {
 				Printf("         successfully %vdecrypted blob (length %v), hash is %v, ID does not match, wanted %v\n", outputPrefix, len(plaintext), id, blob.ID)
@@ -5,7 +5,8 @@ import (
 	"encoding/json"
 	"path"
 	"reflect"
-	"sort"
+	"strings"
+	"time"
 
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
@@ -29,8 +30,13 @@ directory:
 * T  The type was changed, e.g. a file was made a symlink
 * ?  Bitrot detected: The file's content has changed but all metadata is the same
 
-Metadata comparison will likely not work if a backup was created using the
-'--ignore-inode' or '--ignore-ctime' option.
+Items whose content is unchanged but whose metadata differs are only shown with
+"--metadata". Metadata comparison will likely not work if a backup was created
+using the '--ignore-inode' or '--ignore-ctime' option.
+
+With "--json", each differing item is printed as a JSON object which contains
+the kind of change, the old and new size of files, and the attributes which
+differ: content, mode, owner, mtime, xattrs or other metadata.
 
 To only compare files in specific subfolders, you can use the
 "<snapshotID>:<subfolder>" syntax, where "subfolder" is a path within the
@@ -58,7 +64,7 @@ func init() {
 	cmdRoot.AddCommand(cmdDiff)
 
 	f := cmdDiff.Flags()
-	f.BoolVar(&diffOptions.ShowMetadata, "metadata", false, "print changes in metadata")
+	f.BoolVar(&diffOptions.ShowMetadata, "metadata", false, "also print items whose content is identical but whose metadata changed")
 }
 
 func loadSnapshot(ctx context.Context, be restic.Lister, repo restic.Repository, desc string) (*restic.Snapshot, string, error) {
@@ -76,16 +82,104 @@ type Comparer struct {
 	printChange func(change *Change)
 }
 
+// The kinds of changes reported by diff.
+const (
+	changeAdded        = "added"
+	changeRemoved      = "removed"
+	changeModified     = "modified"
+	changeTypeChanged  = "type-changed"
+	changeMetadataOnly = "metadata-only"
+)
+
 type Change struct {
 	MessageType string `json:"message_type"` // "change"
 	Path        string `json:"path"`
 	Modifier    string `json:"modifier"`
+	// ChangeType is one of added, removed, modified, type-changed and
+	// metadata-only
+	ChangeType string `json:"change_type"`
+	// OldSize and NewSize are only set for files
+	OldSize *uint64 `json:"old_size,omitempty"`
+	NewSize *uint64 `json:"new_size,omitempty"`
+	// Attributes lists the differing attributes of items contained in both
+	// snapshots, see nodeDifferences
+	Attributes []string `json:"attributes,omitempty"`
 }
 
 func NewChange(path string, mode string) *Change {
 	return &Change{MessageType: "change", Path: path, Modifier: mode}
 }
 
+// newNodeChange returns the change from node1 to node2, either of which may be
+// nil if the item was added or removed.
+func newNodeChange(path string, mode string, node1, node2 *restic.Node) *Change {
+	change := NewChange(path, mode)
+	switch {
+	case node1 == nil:
+		change.ChangeType = changeAdded
+	case node2 == nil:
+		change.ChangeType = changeRemoved
+	default:
+		change.Attributes = nodeDifferences(node1, node2)
+		switch {
+		case node1.Type != node2.Type:
+			change.ChangeType = changeTypeChanged
+		case strings.Contains(mode, "M"):
+			change.ChangeType = changeModified
+		default:
+			change.ChangeType = changeMetadataOnly
+		}
+	}
+
+	if node1 != nil && node1.Type == "file" {
+		size := node1.Size
+		change.OldSize = &size
+	}
+	if node2 != nil && node2.Type == "file" {
+		size := node2.Size
+		change.NewSize = &size
+	}
+	return change
+}
+
+// nodeDifferences returns the attributes which differ between node1 and node2.
+// Subtrees are not compared, as the contents of directories are compared
+// separately.
+func nodeDifferences(node1, node2 *restic.Node) []string {
+	var diff []string
+	if node1.Type != node2.Type {
+		diff = append(diff, "type")
+	}
+	if !reflect.DeepEqual(node1.Content, node2.Content) || node1.Size != node2.Size ||
+		node1.LinkTarget != node2.LinkTarget || node1.Device != node2.Device {
+		diff = append(diff, "content")
+	}
+	if node1.Mode != node2.Mode {
+		diff = append(diff, "mode")
+	}
+	if node1.UID != node2.UID || node1.GID != node2.GID || node1.User != node2.User || node1.Group != node2.Group {
+		diff = append(diff, "owner")
+	}
+	if !node1.ModTime.Equal(node2.ModTime) {
+		diff = append(diff, "mtime")
+	}
+	if !(restic.Node{ExtendedAttributes: node1.ExtendedAttributes}).Equals(restic.Node{ExtendedAttributes: node2.ExtendedAttributes}) {
+		diff = append(diff, "xattrs")
+	}
+
+	// all remaining metadata, like timestamps other than the mtime
+	other1, other2 := *node1, *node2
+	for _, n := range []*restic.Node{&other1, &other2} {
+		n.Type, n.Content, n.Size, n.LinkTarget, n.Device, n.Subtree = "", nil, 0, "", 0, nil
+		n.Mode, n.UID, n.GID, n.User, n.Group = 0, 0, 0, "", ""
+		n.ModTime, n.ExtendedAttributes = time.Time{}, nil
+	}
+	if !other1.Equals(other2) {
+		diff = append(diff, "other")
+	}
+	return diff
+}
+
 // DiffStat collects stats for all types of items.
 type DiffStat struct {
 	Files     int    `json:"files"`
@@ -137,10 +231,16 @@ func addBlobs(bs restic.BlobSet, node *restic.Node) {
 }
 
 type DiffStatsContainer struct {
-	MessageType                          string         `json:"message_type"` // "statistics"
-	SourceSnapshot                       string         `json:"source_snapshot"`
-	TargetSnapshot                       string         `json:"target_snapshot"`
-	ChangedFiles                         int            `json:"changed_files"`
+	MessageType    string `json:"message_type"` // "statistics"
+	SourceSnapshot string `json:"source_snapshot"`
+	TargetSnapshot string `json:"target_snapshot"`
+	ChangedFiles   int    `json:"changed_files"`
+	ChangedOthers  int    `json:"changed_others"`
+	// TypeChanged counts the items whose type changed, MetadataChanged those
+	// whose content is identical but whose metadata changed. The latter are
+	// counted also without --metadata.
+	TypeChanged                          int            `json:"type_changed"`
+	MetadataChanged                      int            `json:"metadata_changed"`
 	Added                                DiffStat       `json:"added"`
 	Removed                              DiffStat       `json:"removed"`
 	BlobsBefore, BlobsAfter, BlobsCommon restic.BlobSet `json:"-"`
@@ -178,7 +278,11 @@ func (c *Comparer) printDir(ctx context.Context, mode string, stats *DiffStat, b
 		if node.Type == "dir" {
 			name += "/"
 		}
-		c.printChange(NewChange(name, mode))
+		if mode == "+" {
+			c.printChange(newNodeChange(name, mode, nil, node))
+		} else {
+			c.printChange(newNodeChange(name, mode, node, nil))
+		}
 		stats.Add(node)
 		addBlobs(blobs, node)
 
@@ -214,27 +318,29 @@ func (c *Comparer) collectDir(ctx context.Context, blobs restic.BlobSet, id rest
 	return nil
 }
 
-func uniqueNodeNames(tree1, tree2 *restic.Tree) (tree1Nodes, tree2Nodes map[string]*restic.Node, uniqueNames []string) {
-	names := make(map[string]struct{})
-	tree1Nodes = make(map[string]*restic.Node)
-	for _, node := range tree1.Nodes {
-		tree1Nodes[node.Name] = node
-		names[node.Name] = struct{}{}
-	}
-
-	tree2Nodes = make(map[string]*restic.Node)
-	for _, node := range tree2.Nodes {
-		tree2Nodes[node.Name] = node
-		names[node.Name] = struct{}{}
-	}
+// mergeTrees calls fn for the nodes of both trees in the order of their
+// names. If a name is only contained in one of the trees, the other node is
+// nil. As the nodes of a tree are sorted by name, the trees are merged without
+// building an index of their nodes.
+func mergeTrees(tree1, tree2 *restic.Tree, fn func(node1, node2 *restic.Node) error) error {
+	nodes1, nodes2 := tree1.Nodes, tree2.Nodes
+	for len(nodes1) > 0 || len(nodes2) > 0 {
+		var node1, node2 *restic.Node
+		switch {
+		case len(nodes2) == 0 || (len(nodes1) > 0 && nodes1[0].Name < nodes2[0].Name):
+			node1, nodes1 = nodes1[0], nodes1[1:]
+		case len(nodes1) == 0 || nodes2[0].Name < nodes1[0].Name:
+			node2, nodes2 = nodes2[0], nodes2[1:]
+		default:
+			node1, nodes1 = nodes1[0], nodes1[1:]
+			node2, nodes2 = nodes2[0], nodes2[1:]
+		}
 
-	uniqueNames = make([]string, 0, len(names))
-	for name := range names {
-		uniqueNames = append(uniqueNames, name)
+		if err := fn(node1, node2); err != nil {
+			return err
+		}
 	}
-
-	sort.Strings(uniqueNames)
-	return tree1Nodes, tree2Nodes, uniqueNames
+	return nil
 }
 
 func (c *Comparer) diffTree(ctx context.Context, stats *DiffStatsContainer, prefix string, id1, id2 restic.ID) error {
@@ -249,11 +355,14 @@ func (c *Comparer) diffTree(ctx context.Context, stats *DiffStatsContainer, pref
 		return err
 	}
 
-	tree1Nodes, tree2Nodes, names := uniqueNodeNames(tree1, tree2)
-
-	for _, name := range names {
-		node1, t1 := tree1Nodes[name]
-		node2, t2 := tree2Nodes[name]
+	return mergeTrees(tree1, tree2, func(node1, node2 *restic.Node) error {
+		t1, t2 := node1 != nil, node2 != nil
+		var name string
+		if t1 {
+			name = node1.Name
+		} else {
+			name = node2.Name
+		}
 
 		addBlobs(stats.BlobsBefore, node1)
 		addBlobs(stats.BlobsAfter, node2)
@@ -265,6 +374,7 @@ func (c *Comparer) diffTree(ctx context.Context, stats *DiffStatsContainer, pref
 
 			if node1.Type != node2.Type {
 				mod += "T"
+				stats.TypeChanged++
 			}
 
 			if node2.Type == "dir" {
@@ -286,12 +396,23 @@ func (c *Comparer) diffTree(ctx context.Context, stats *DiffStatsContainer, pref
 					// probable bitrot detected
 					mod += "?"
 				}
-			} else if c.opts.ShowMetadata && !node1.Equals(*node2) {
-				mod += "U"
+			} else if node1.Type == node2.Type {
+				diff := nodeDifferences(node1, node2)
+				switch {
+				case len(diff) > 0 && diff[0] == "content":
+					// the target of a symlink or the number of a device
+					mod += "M"
+					stats.ChangedOthers++
+				case len(diff) > 0:
+					stats.MetadataChanged++
+					if c.opts.ShowMetadata {
+						mod += "U"
+					}
+				}
 			}
 
 			if mod != "" {
-				c.printChange(NewChange(name, mod))
+				c.printChange(newNodeChange(name, mod, node1, node2))
 			}
 
 			if node1.Type == "dir" && node2.Type == "dir" {
@@ -310,7 +431,7 @@ func (c *Comparer) diffTree(ctx context.Context, stats *DiffStatsContainer, pref
 			if node1.Type == "dir" {
 				prefix += "/"
 			}
-			c.printChange(NewChange(prefix, "-"))
+			c.printChange(newNodeChange(prefix, "-", node1, nil))
 			stats.Removed.Add(node1)
 
 			if node1.Type == "dir" {
@@ -324,7 +445,7 @@ func (c *Comparer) diffTree(ctx context.Context, stats *DiffStatsContainer, pref
 			if node2.Type == "dir" {
 				prefix += "/"
 			}
-			c.printChange(NewChange(prefix, "+"))
+			c.printChange(newNodeChange(prefix, "+", nil, node2))
 			stats.Added.Add(node2)
 
 			if node2.Type == "dir" {
@@ -334,9 +455,8 @@ func (c *Comparer) diffTree(ctx context.Context, stats *DiffStatsContainer, pref
 				}
 			}
 		}
-	}
-
-	return nil
+		return nil
+	})
 }
 
 func runDiff(ctx context.Context, opts DiffOptions, gopts GlobalOptions, args []string) error {
@@ -401,7 +521,7 @@ func runDiff(ctx context.Context, opts DiffOptions, gopts GlobalOptions, args []
 
 	c := &Comparer{
 		repo: repo,
-		opts: diffOptions,
+		opts: opts,
 		printChange: func(change *Change) {
 			Printf("%-5s%v\n", change.Modifier, change.Path)
 		},
@@ -450,7 +570,8 @@ func runDiff(ctx context.Context, opts DiffOptions, gopts GlobalOptions, args []
 		Printf("\n")
 		Printf("Files:       %5d new, %5d removed, %5d changed\n", stats.Added.Files, stats.Removed.Files, stats.ChangedFiles)
 		Printf("Dirs:        %5d new, %5d removed\n", stats.Added.Dirs, stats.Removed.Dirs)
-		Printf("Others:      %5d new, %5d removed\n", stats.Added.Others, stats.Removed.Others)
+		Printf("Others:      %5d new, %5d removed, %5d changed\n", stats.Added.Others, stats.Removed.Others, stats.ChangedOthers)
+		Printf("Changed:     %5d type, %5d metadata only\n", stats.TypeChanged, stats.MetadataChanged)
 		Printf("Data Blobs:  %5d new, %5d removed\n", stats.Added.DataBlobs, stats.Removed.DataBlobs)
 		Printf("Tree Blobs:  %5d new, %5d removed\n", stats.Added.TreeBlobs, stats.Removed.TreeBlobs)
 		Printf("  Added:   %-5s\n", ui.FormatBytes(uint64(stats.Added.Bytes)))
@@ -15,10 +15,11 @@ import (
 )
 
 func testRunDiffOutput(gopts GlobalOptions, firstSnapshotID string, secondSnapshotID string) (string, error) {
+	return testRunDiffOutputWithOptions(DiffOptions{ShowMetadata: false}, gopts, firstSnapshotID, secondSnapshotID)
+}
+
+func testRunDiffOutputWithOptions(opts DiffOptions, gopts GlobalOptions, firstSnapshotID string, secondSnapshotID string) (string, error) {
 	buf, err := withCaptureStdout(func() error {
-		opts := DiffOptions{
-			ShowMetadata: false,
-		}
 		return runDiff(context.TODO(), opts, gopts, []string{firstSnapshotID, secondSnapshotID})
 	})
 	return buf.String(), err
@@ -157,27 +158,47 @@ func TestDiffJSON(t *testing.T) {
 	out, err := testRunDiffOutput(env.gopts, firstSnapshotID, secondSnapshotID)
 	rtest.OK(t, err)
 
-	var stat DiffStatsContainer
-	var changes int
-
-	scanner := bufio.NewScanner(strings.NewReader(out))
-	for scanner.Scan() {
-		line := scanner.Text()
-		var sniffer typeSniffer
-		rtest.OK(t, json.Unmarshal([]byte(line), &sniffer))
-		switch sniffer.MessageType {
-		case "change":
-			changes++
-		case "statistics":
-			rtest.OK(t, json.Unmarshal([]byte(line), &stat))
-		default:
-			t.Fatalf("unexpected message type %v", sniffer.MessageType)
-		}
-	}
-	rtest.Equals(t, 9, changes)
+	changes, stat := parseDiffJSON(t, out)
+	rtest.Equals(t, 9, len(changes))
 	rtest.Assert(t, stat.Added.Files == 2 && stat.Added.Dirs == 3 && stat.Added.DataBlobs == 2 &&
 		stat.Removed.Files == 1 && stat.Removed.Dirs == 2 && stat.Removed.DataBlobs == 1 &&
 		stat.ChangedFiles == 1, "unexpected statistics")
+	rtest.Assert(t, stat.MetadataChanged > 0, "metadata changes were not counted")
+
+	for _, change := range changes {
+		switch filepath.Base(change.Path) {
+		case "modfile1":
+			rtest.Equals(t, "modified", change.ChangeType)
+			rtest.Assert(t, *change.OldSize == 256*1024 && *change.NewSize == 512*1024,
+				"unexpected sizes %v, %v", *change.OldSize, *change.NewSize)
+			rtest.Equals(t, "content", change.Attributes[0])
+		case "modfile3":
+			rtest.Equals(t, "added", change.ChangeType)
+			rtest.Assert(t, change.OldSize == nil && *change.NewSize == 256*1024, "unexpected sizes")
+		case "modfile":
+			rtest.Equals(t, "removed", change.ChangeType)
+			rtest.Assert(t, *change.OldSize == 256*1024 && change.NewSize == nil, "unexpected sizes")
+		}
+	}
+
+	// --metadata also prints the items whose metadata changed
+	metaOut, err := testRunDiffOutputWithOptions(DiffOptions{ShowMetadata: true}, env.gopts, firstSnapshotID, secondSnapshotID)
+	rtest.OK(t, err)
+	metaChanges, _ := parseDiffJSON(t, metaOut)
+	metadataOnly := 0
+	for _, change := range metaChanges {
+		if change.ChangeType != "metadata-only" {
+			continue
+		}
+		metadataOnly++
+		rtest.Equals(t, "U", change.Modifier)
+		rtest.Assert(t, len(change.Attributes) > 0, "no attributes for %v", change.Path)
+		for _, attr := range change.Attributes {
+			rtest.Assert(t, attr != "content", "content of %v changed", change.Path)
+		}
+	}
+	rtest.Equals(t, stat.MetadataChanged, metadataOnly)
+	rtest.Equals(t, len(changes)+metadataOnly, len(metaChanges))
 
 	// check quiet output
 	env.gopts.Quiet = true
@@ -191,3 +212,26 @@ func TestDiffJSON(t *testing.T) {
 		stat.ChangedFiles == 1, "unexpected statistics")
 	rtest.Assert(t, stat.SourceSnapshot == firstSnapshotID && stat.TargetSnapshot == secondSnapshotID, "unexpected snapshot ids")
 }
+
+func parseDiffJSON(t *testing.T, out string) ([]Change, DiffStatsContainer) {
+	var stat DiffStatsContainer
+	var changes []Change
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		var sniffer typeSniffer
+		rtest.OK(t, json.Unmarshal([]byte(line), &sniffer))
+		switch sniffer.MessageType {
+		case "change":
+			var change Change
+			rtest.OK(t, json.Unmarshal([]byte(line), &change))
+			changes = append(changes, change)
+		case "statistics":
+			rtest.OK(t, json.Unmarshal([]byte(line), &stat))
+		default:
+			t.Fatalf("unexpected message type %v", sniffer.MessageType)
+		}
+	}
+	return changes, stat
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"regexp"
+	"regexp/syntax"
 	"sort"
 	"strings"
 	"time"
@@ -13,6 +15,7 @@ import (
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/filter"
 	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/ui"
 	"github.com/restic/restic/internal/walker"
 )
 
@@ -22,9 +25,16 @@ var cmdFind = &cobra.Command{
 	Long: `
 The "find" command searches for files or directories in snapshots stored in the
 repo.
-It can also be used to search for restic blobs or trees for troubleshooting.`,
+It can also be used to search for restic blobs or trees for troubleshooting.
+
+Matches can be restricted further by their size with --size, by their
+modification time with --newer and --older and by a regular expression for the
+full path with --regex. If one of these options is given, PATTERN may be
+omitted. The options --newer and --older accept a date/time in the local
+timezone or a duration like "7d" or "1y2m" relative to the current time.`,
 	Example: `restic find config.json
 restic find --json "*.yml" "*.json"
+restic find --size +1G --newer 7d --regex '^/var/'
 restic find --json --blob 420f620f b46ebe8a ddd38656
 restic find --show-pack-id --blob 420f620f
 restic find --tree 577c2bc9 f81f2e22 a62827a9
@@ -51,6 +61,9 @@ type FindOptions struct {
 	CaseInsensitive    bool
 	ListLong           bool
 	HumanReadable      bool
+	Size               string
+	Newer, Older       string
+	Regex              string
 	restic.SnapshotFilter
 }
 
@@ -70,6 +83,10 @@ func init() {
 	f.BoolVarP(&findOptions.CaseInsensitive, "ignore-case", "i", false, "ignore case for pattern")
 	f.BoolVarP(&findOptions.ListLong, "long", "l", false, "use a long listing format showing size and mode")
 	f.BoolVar(&findOptions.HumanReadable, "human-readable", false, "print sizes in human readable format")
+	f.StringVar(&findOptions.Size, "size", "", "only match files larger (+`size`), smaller (-size) or exactly as large as size, e.g. +1G")
+	f.StringVar(&findOptions.Newer, "newer", "", "only match entries modified after `time` or within the duration, e.g. 7d")
+	f.StringVar(&findOptions.Older, "older", "", "only match entries modified before `time` or longer ago than the duration, e.g. 1y")
+	f.StringVar(&findOptions.Regex, "regex", "", "only match entries whose full path matches the regular `expression`")
 
 	initMultiSnapshotFilter(f, &findOptions.SnapshotFilter, true)
 }
@@ -78,6 +95,127 @@ type findPattern struct {
 	oldest, newest time.Time
 	pattern        []string
 	ignoreCase     bool
+
+	// newer and older are exclusive bounds for the modification time
+	newer, older time.Time
+	size         *sizeFilter
+	regex        *regexp.Regexp
+	// regexPrefix is the literal prefix of an anchored regex, all matching
+	// paths start with it
+	regexPrefix   string
+	regexFoldCase bool
+}
+
+// hasFilters returns true if matches are restricted by other means than the
+// name patterns.
+func (pat *findPattern) hasFilters() bool {
+	return !pat.oldest.IsZero() || !pat.newest.IsZero() || !pat.newer.IsZero() || !pat.older.IsZero() ||
+		pat.size != nil || pat.regex != nil
+}
+
+// matchesFilters returns true if node at nodepath passes all filters besides
+// the name patterns.
+func (pat *findPattern) matchesFilters(nodepath string, node *restic.Node) bool {
+	if !pat.oldest.IsZero() && node.ModTime.Before(pat.oldest) {
+		debug.Log("    ModTime is older than %s\n", pat.oldest)
+		return false
+	}
+
+	if !pat.newest.IsZero() && node.ModTime.After(pat.newest) {
+		debug.Log("    ModTime is newer than %s\n", pat.newest)
+		return false
+	}
+
+	if !pat.newer.IsZero() && !node.ModTime.After(pat.newer) {
+		return false
+	}
+
+	if !pat.older.IsZero() && !node.ModTime.Before(pat.older) {
+		return false
+	}
+
+	if pat.size != nil && !pat.size.match(node) {
+		return false
+	}
+
+	return pat.regex == nil || pat.regex.MatchString(nodepath)
+}
+
+// childMayMatchRegex returns false if no entry below the directory at
+// nodepath can match an anchored regex.
+func (pat *findPattern) childMayMatchRegex(nodepath string) bool {
+	if pat.regexPrefix == "" {
+		return true
+	}
+
+	// all children start with the path of the directory and a separator
+	dir := nodepath + "/"
+	n := len(dir)
+	if len(pat.regexPrefix) < n {
+		n = len(pat.regexPrefix)
+	}
+	if pat.regexFoldCase {
+		return strings.EqualFold(dir[:n], pat.regexPrefix[:n])
+	}
+	return dir[:n] == pat.regexPrefix[:n]
+}
+
+// sizeFilter matches regular files by their size.
+type sizeFilter struct {
+	// cmp is '+' for files larger than size, '-' for files smaller than size
+	// and 0 for files of exactly size bytes
+	cmp  byte
+	size uint64
+}
+
+// parseSizeFilter parses a size like "+1G", "-10M" or "512".
+func parseSizeFilter(str string) (*sizeFilter, error) {
+	f := &sizeFilter{}
+	if str != "" && (str[0] == '+' || str[0] == '-') {
+		f.cmp = str[0]
+		str = str[1:]
+	}
+
+	size, err := ui.ParseBytes(str)
+	if err != nil || strings.HasPrefix(str, "+") || strings.HasPrefix(str, "-") {
+		return nil, errors.Fatalf("invalid size %q: expected a size like +1G or -10M", str)
+	}
+	f.size = uint64(size)
+	return f, nil
+}
+
+func (f *sizeFilter) match(node *restic.Node) bool {
+	if node.Type != "file" {
+		return false
+	}
+	switch f.cmp {
+	case '+':
+		return node.Size > f.size
+	case '-':
+		return node.Size < f.size
+	default:
+		return node.Size == f.size
+	}
+}
+
+// anchoredPrefix returns the literal prefix of a regular expression which
+// only matches at the beginning of the text, e.g. "/var/log/" for
+// "^/var/log/.*\.gz$". The prefix is empty if the expression is not anchored.
+func anchoredPrefix(expr string) (prefix string, foldCase bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	if len(subs) < 2 || subs[0].Op != syntax.OpBeginText || subs[1].Op != syntax.OpLiteral {
+		return "", false
+	}
+	return string(subs[1].Rune), subs[1].Flags&syntax.FoldCase != 0
 }
 
 var timeFormats = []string{
@@ -94,9 +232,11 @@ var timeFormats = []string{
 	"Mon Jan 2 15:04:05 -0700 MST 2006",
 }
 
-func parseTime(str string) (time.Time, error) {
+// parseTime parses str in one of the timeFormats. Times without a timezone
+// are interpreted in loc.
+func parseTime(str string, loc *time.Location) (time.Time, error) {
 	for _, fmt := range timeFormats {
-		if t, err := time.ParseInLocation(fmt, str, time.Local); err == nil {
+		if t, err := time.ParseInLocation(fmt, str, loc); err == nil {
 			return t, nil
 		}
 	}
@@ -104,6 +244,21 @@ func parseTime(str string) (time.Time, error) {
 	return time.Time{}, errors.Fatalf("unable to parse time: %q", str)
 }
 
+// parseTimeOrDuration parses str as a time like parseTime, interpreted in the
+// timezone of now, or as a duration like "7d" or "1y2m" which is subtracted
+// from now.
+func parseTimeOrDuration(str string, now time.Time) (time.Time, error) {
+	if t, err := parseTime(str, now.Location()); err == nil {
+		return t, nil
+	}
+
+	d, err := restic.ParseDuration(str)
+	if err != nil {
+		return time.Time{}, errors.Fatalf("unable to parse time or duration: %q", str)
+	}
+	return now.AddDate(-d.Years, -d.Months, -d.Days).Add(time.Hour * time.Duration(-d.Hours)), nil
+}
+
 type statefulOutput struct {
 	ListLong      bool
 	HumanReadable bool
@@ -116,10 +271,16 @@ type statefulOutput struct {
 
 func (s *statefulOutput) PrintPatternJSON(path string, node *restic.Node) {
 	type findNode restic.Node
+	var size *uint64
+	if node.Type == "file" {
+		size = &node.Size
+	}
 	b, err := json.Marshal(struct {
 		// Add these attributes
 		Path        string `json:"path,omitempty"`
 		Permissions string `json:"permissions,omitempty"`
+		// Size is also reported for empty files
+		Size *uint64 `json:"size,omitempty"`
 
 		*findNode
 
@@ -132,6 +293,7 @@ func (s *statefulOutput) PrintPatternJSON(path string, node *restic.Node) {
 	}{
 		Path:        path,
 		Permissions: node.Mode.String(),
+		Size:        size,
 		findNode:    (*findNode)(node),
 	})
 	if err != nil {
@@ -279,7 +441,8 @@ func (f *Finder) findInSnapshot(ctx context.Context, sn *restic.Snapshot) error
 			normalizedNodepath = strings.ToLower(nodepath)
 		}
 
-		var foundMatch bool
+		// without patterns, only the other filters apply
+		foundMatch := len(f.pat.pattern) == 0
 
 		for _, pat := range f.pat.pattern {
 			found, err := filter.Match(pat, normalizedNodepath)
@@ -297,7 +460,7 @@ func (f *Finder) findInSnapshot(ctx context.Context, sn *restic.Snapshot) error
 			errIfNoMatch    error
 		)
 		if node.Type == "dir" {
-			var childMayMatch bool
+			childMayMatch := len(f.pat.pattern) == 0
 			for _, pat := range f.pat.pattern {
 				mayMatch, err := filter.ChildMatch(pat, normalizedNodepath)
 				if err != nil {
@@ -309,6 +472,11 @@ func (f *Finder) findInSnapshot(ctx context.Context, sn *restic.Snapshot) error
 				}
 			}
 
+			if childMayMatch && !f.pat.childMayMatchRegex(nodepath) {
+				debug.Log("    no child of %v can match the regex\n", nodepath)
+				childMayMatch = false
+			}
+
 			if !childMayMatch {
 				ignoreIfNoMatch = true
 				errIfNoMatch = walker.ErrSkipNode
@@ -321,13 +489,7 @@ func (f *Finder) findInSnapshot(ctx context.Context, sn *restic.Snapshot) error
 			return ignoreIfNoMatch, errIfNoMatch
 		}
 
-		if !f.pat.oldest.IsZero() && node.ModTime.Before(f.pat.oldest) {
-			debug.Log("    ModTime is older than %s\n", f.pat.oldest)
-			return ignoreIfNoMatch, errIfNoMatch
-		}
-
-		if !f.pat.newest.IsZero() && node.ModTime.After(f.pat.newest) {
-			debug.Log("    ModTime is newer than %s\n", f.pat.newest)
+		if !f.pat.matchesFilters(nodepath, node) {
 			return ignoreIfNoMatch, errIfNoMatch
 		}
 
@@ -536,10 +698,6 @@ func (f *Finder) findObjectsPacks() {
 }
 
 func runFind(ctx context.Context, opts FindOptions, gopts GlobalOptions, args []string) error {
-	if len(args) == 0 {
-		return errors.Fatal("wrong number of arguments")
-	}
-
 	var err error
 	pat := findPattern{pattern: args}
 	if opts.CaseInsensitive {
@@ -550,17 +708,47 @@ func runFind(ctx context.Context, opts FindOptions, gopts GlobalOptions, args []
 	}
 
 	if opts.Oldest != "" {
-		if pat.oldest, err = parseTime(opts.Oldest); err != nil {
+		if pat.oldest, err = parseTime(opts.Oldest, time.Local); err != nil {
 			return err
 		}
 	}
 
 	if opts.Newest != "" {
-		if pat.newest, err = parseTime(opts.Newest); err != nil {
+		if pat.newest, err = parseTime(opts.Newest, time.Local); err != nil {
 			return err
 		}
 	}
 
+	now := time.Now()
+	if opts.Newer != "" {
+		if pat.newer, err = parseTimeOrDuration(opts.Newer, now); err != nil {
+			return err
+		}
+	}
+
+	if opts.Older != "" {
+		if pat.older, err = parseTimeOrDuration(opts.Older, now); err != nil {
+			return err
+		}
+	}
+
+	if opts.Size != "" {
+		if pat.size, err = parseSizeFilter(opts.Size); err != nil {
+			return err
+		}
+	}
+
+	if opts.Regex != "" {
+		expr := opts.Regex
+		if opts.CaseInsensitive {
+			expr = "(?i)" + expr
+		}
+		if pat.regex, err = regexp.Compile(expr); err != nil {
+			return errors.Fatalf("invalid regular expression %q: %v", opts.Regex, err)
+		}
+		pat.regexPrefix, pat.regexFoldCase = anchoredPrefix(expr)
+	}
+
 	// Check at most only one kind of IDs is provided: currently we
 	// can't mix types
 	if (opts.BlobID && opts.TreeID) ||
@@ -569,6 +757,14 @@ func runFind(ctx context.Context, opts FindOptions, gopts GlobalOptions, args []
 		return errors.Fatal("cannot have several ID types")
 	}
 
+	searchIDs := opts.BlobID || opts.TreeID || opts.PackID
+	if searchIDs && (opts.Newer != "" || opts.Older != "" || opts.Size != "" || opts.Regex != "") {
+		return errors.Fatal("--newer, --older, --size and --regex cannot be used with --blob, --tree or --pack")
+	}
+	if len(args) == 0 && (searchIDs || !pat.hasFilters()) {
+		return errors.Fatal("wrong number of arguments")
+	}
+
 	repo, err := OpenRepository(ctx, gopts)
 	if err != nil {
 		return err
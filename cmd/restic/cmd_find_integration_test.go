@@ -3,6 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -11,11 +14,13 @@ import (
 )
 
 func testRunFind(t testing.TB, wantJSON bool, gopts GlobalOptions, pattern string) []byte {
+	return testRunFindWithOptions(t, wantJSON, gopts, FindOptions{}, pattern)
+}
+
+func testRunFindWithOptions(t testing.TB, wantJSON bool, gopts GlobalOptions, opts FindOptions, patterns ...string) []byte {
 	buf, err := withCaptureStdout(func() error {
 		gopts.JSON = wantJSON
-
-		opts := FindOptions{}
-		return runFind(context.TODO(), opts, gopts, []string{pattern})
+		return runFind(context.TODO(), opts, gopts, patterns)
 	})
 	rtest.OK(t, err)
 	return buf.Bytes()
@@ -48,6 +53,7 @@ type testMatch struct {
 	Permissions string    `json:"permissions,omitempty"`
 	Size        uint64    `json:"size,omitempty"`
 	Date        time.Time `json:"date,omitempty"`
+	MTime       time.Time `json:"mtime,omitempty"`
 	UID         uint32    `json:"uid,omitempty"`
 	GID         uint32    `json:"gid,omitempty"`
 }
@@ -85,3 +91,69 @@ func TestFindJSON(t *testing.T) {
 	rtest.Assert(t, len(matches[0].Matches) == 3, "expected 3 files to match (%v)", datafile)
 	rtest.Assert(t, matches[0].Hits == 3, "expected hits to show 3 matches (%v)", datafile)
 }
+
+func TestFindFilters(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour).Truncate(time.Second)
+	lastYear := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	for _, file := range []struct {
+		name  string
+		size  int
+		mtime time.Time
+	}{
+		{"var/log/big.log", 4096, lastWeek},
+		{"var/log/old.log", 4096, lastYear},
+		{"var/log/small.log", 10, lastWeek},
+		{"var/lib/big.db", 8192, lastWeek},
+		{"home/empty", 0, lastWeek},
+	} {
+		p := filepath.Join(env.testdata, filepath.FromSlash(file.name))
+		rtest.OK(t, os.MkdirAll(filepath.Dir(p), 0755))
+		rtest.OK(t, os.WriteFile(p, make([]byte, file.size), 0644))
+		rtest.OK(t, os.Chtimes(p, file.mtime, file.mtime))
+	}
+
+	testRunInit(t, env.gopts)
+	testRunBackup(t, env.testdata, []string{"."}, BackupOptions{}, env.gopts)
+	testRunCheck(t, env.gopts)
+
+	find := func(opts FindOptions, patterns ...string) []testMatch {
+		var matches []testMatches
+		rtest.OK(t, json.Unmarshal(testRunFindWithOptions(t, true, env.gopts, opts, patterns...), &matches))
+		if len(matches) == 0 {
+			return nil
+		}
+		rtest.Equals(t, 1, len(matches))
+		rtest.Equals(t, len(matches[0].Matches), matches[0].Hits)
+		return matches[0].Matches
+	}
+	paths := func(matches []testMatch) []string {
+		var paths []string
+		for _, m := range matches {
+			paths = append(paths, m.Path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	matches := find(FindOptions{Size: "+1K"})
+	rtest.Equals(t, []string{"/var/lib/big.db", "/var/log/big.log", "/var/log/old.log"}, paths(matches))
+	for _, m := range matches {
+		rtest.Assert(t, m.Size >= 4096, "unexpected size %v of %v", m.Size, m.Path)
+		rtest.Assert(t, !m.MTime.IsZero(), "missing mtime of %v", m.Path)
+	}
+
+	rtest.Equals(t, []string{"/var/log/small.log"}, paths(find(FindOptions{Size: "-1K"}, "*.log")))
+	rtest.Equals(t, []string{"/var/log/big.log", "/var/log/small.log"},
+		paths(find(FindOptions{Newer: "30d", Regex: `^/var/log/`})))
+	rtest.Equals(t, []string{"/var/log/old.log"},
+		paths(find(FindOptions{Older: "2024-01-01", Size: "+1K"})))
+	rtest.Equals(t, []string{"/var/lib/big.db", "/var/log/big.log"},
+		paths(find(FindOptions{Size: "+1K", Newer: "30d", Oldest: lastYear.AddDate(0, 1, 0).Format("2006-01-02")})))
+	rtest.Equals(t, []string{"/var/log/big.log"},
+		paths(find(FindOptions{Regex: `(?i)^/VAR/.*/BIG\.`, CaseInsensitive: true}, "*.log")))
+	rtest.Equals(t, []string{"/home/empty"}, paths(find(FindOptions{Regex: `^/home/.*`})))
+	rtest.Equals(t, 0, len(find(FindOptions{Regex: `^/nonexistent/`})))
+}
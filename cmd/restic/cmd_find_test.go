@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestParseTimeOrDuration(t *testing.T) {
+	berlin := time.FixedZone("CET", 3600)
+	newYork := time.FixedZone("EST", -5*3600)
+	now := time.Date(2024, time.March, 15, 12, 0, 0, 0, berlin)
+
+	for _, test := range []struct {
+		input string
+		now   time.Time
+		want  time.Time
+	}{
+		// times without a timezone are interpreted in the timezone of now
+		{"2024-01-02", now, time.Date(2024, time.January, 1, 23, 0, 0, 0, time.UTC)},
+		{"2024-01-02 15:04", now, time.Date(2024, time.January, 2, 14, 4, 0, 0, time.UTC)},
+		{"2024-01-02 15:04", now.In(newYork), time.Date(2024, time.January, 2, 20, 4, 0, 0, time.UTC)},
+		{"02.01.2024 15:04:05", now.In(time.UTC), time.Date(2024, time.January, 2, 15, 4, 5, 0, time.UTC)},
+		// an explicit offset takes precedence
+		{"2024-01-02 15:04:05 -0700", now, time.Date(2024, time.January, 2, 22, 4, 5, 0, time.UTC)},
+		{"2024-01-02 15:04:05 -0700", now.In(newYork), time.Date(2024, time.January, 2, 22, 4, 5, 0, time.UTC)},
+		// durations are relative to now, independent of the timezone
+		{"2h", now, time.Date(2024, time.March, 15, 9, 0, 0, 0, time.UTC)},
+		{"2h", now.In(newYork), time.Date(2024, time.March, 15, 9, 0, 0, 0, time.UTC)},
+		{"7d", now, time.Date(2024, time.March, 8, 11, 0, 0, 0, time.UTC)},
+		{"1y1m", now, time.Date(2023, time.February, 15, 11, 0, 0, 0, time.UTC)},
+	} {
+		t.Run("", func(t *testing.T) {
+			got, err := parseTimeOrDuration(test.input, test.now)
+			rtest.OK(t, err)
+			rtest.Assert(t, got.Equal(test.want), "parsing %q at %v: want %v, got %v", test.input, test.now, test.want, got)
+		})
+	}
+
+	_, err := parseTimeOrDuration("yesterday", now)
+	rtest.Assert(t, err != nil, "expected an error for an invalid time")
+}
+
+func TestFindTimeFilterTimezone(t *testing.T) {
+	berlin := time.FixedZone("CET", 3600)
+	now := time.Date(2024, time.March, 15, 12, 0, 0, 0, berlin)
+
+	var pat findPattern
+	var err error
+	pat.newer, err = parseTimeOrDuration("2024-03-01 10:00", now)
+	rtest.OK(t, err)
+	pat.older, err = parseTimeOrDuration("2024-03-01 12:00", now)
+	rtest.OK(t, err)
+
+	for _, test := range []struct {
+		mtime time.Time
+		match bool
+	}{
+		// the same instants in different timezones
+		{time.Date(2024, time.March, 1, 10, 30, 0, 0, berlin), true},
+		{time.Date(2024, time.March, 1, 9, 30, 0, 0, time.UTC), true},
+		{time.Date(2024, time.March, 1, 4, 30, 0, 0, time.FixedZone("EST", -5*3600)), true},
+		// 10:30 UTC is 11:30 CET
+		{time.Date(2024, time.March, 1, 10, 30, 0, 0, time.UTC), true},
+		// 11:30 UTC is 12:30 CET
+		{time.Date(2024, time.March, 1, 11, 30, 0, 0, time.UTC), false},
+		// the bounds are exclusive
+		{time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, time.March, 1, 11, 0, 0, 0, time.UTC), false},
+	} {
+		node := &restic.Node{Type: "file", ModTime: test.mtime}
+		rtest.Equals(t, test.match, pat.matchesFilters("/file", node))
+	}
+}
+
+func TestParseSizeFilter(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		want  sizeFilter
+	}{
+		{"+1G", sizeFilter{'+', 1 << 30}},
+		{"-10M", sizeFilter{'-', 10 << 20}},
+		{"512", sizeFilter{0, 512}},
+		{"+2KiB", sizeFilter{'+', 2048}},
+	} {
+		f, err := parseSizeFilter(test.input)
+		rtest.OK(t, err)
+		rtest.Equals(t, test.want, *f)
+	}
+
+	for _, input := range []string{"", "+", "-1x", "++1G"} {
+		_, err := parseSizeFilter(input)
+		rtest.Assert(t, err != nil, "expected an error for %q", input)
+	}
+
+	f := sizeFilter{'+', 100}
+	rtest.Assert(t, f.match(&restic.Node{Type: "file", Size: 101}), "larger file does not match")
+	rtest.Assert(t, !f.match(&restic.Node{Type: "file", Size: 100}), "file of the same size matches")
+	rtest.Assert(t, !f.match(&restic.Node{Type: "dir", Size: 101}), "directory matches")
+}
+
+func TestFindRegexPrefix(t *testing.T) {
+	for _, test := range []struct {
+		expr     string
+		prefix   string
+		foldCase bool
+	}{
+		{`^/var/log/.*\.gz$`, "/var/log/", false},
+		{`^/home`, "/home", false},
+		{`(?i)^/Var/`, "/VAR/", true},
+		{`^/var/l(og|ib)/`, "/var/l", false},
+		{`/var/log`, "", false},
+		{`^/var|^/home`, "", false},
+		{`^.*\.gz$`, "", false},
+	} {
+		prefix, foldCase := anchoredPrefix(test.expr)
+		rtest.Assert(t, prefix == test.prefix, "%q: want prefix %q, got %q", test.expr, test.prefix, prefix)
+		rtest.Equals(t, test.foldCase, foldCase)
+	}
+
+	pat := findPattern{regexPrefix: "/var/log/"}
+	for path, mayMatch := range map[string]bool{
+		"/var":         true,
+		"/var/log":     true,
+		"/var/log/apt": true,
+		"/var/lib":     false,
+		"/home":        false,
+		"/va":          false,
+	} {
+		rtest.Assert(t, pat.childMayMatchRegex(path) == mayMatch, "%v: want %v", path, mayMatch)
+	}
+
+	pat = findPattern{regexPrefix: "/var/", regexFoldCase: true}
+	rtest.Assert(t, pat.childMayMatchRegex("/VAR"), "case was not ignored")
+	rtest.Assert(t, !pat.childMayMatchRegex("/home"), "unrelated directory may match")
+}
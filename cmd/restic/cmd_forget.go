@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"os"
 	"strconv"
+	"time"
 
+	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/restic"
 	"github.com/spf13/cobra"
@@ -274,10 +277,16 @@ func runForget(ctx context.Context, opts ForgetOptions, gopts GlobalOptions, arg
 
 	if len(removeSnIDs) > 0 {
 		if !opts.DryRun {
-			err := DeleteFilesChecked(ctx, gopts, repo, removeSnIDs, restic.SnapshotFile)
+			forbidden, err := DeleteFilesChecked(ctx, gopts, repo, removeSnIDs, restic.SnapshotFile)
 			if err != nil {
 				return err
 			}
+			if len(forbidden) > 0 {
+				err = markSnapshotsRemoved(ctx, gopts, repo, forbidden)
+				if err != nil {
+					return err
+				}
+			}
 		} else {
 			if !gopts.JSON {
 				Printf("Would have removed the following snapshots:\n%v\n\n", removeSnIDs)
@@ -307,6 +316,37 @@ func runForget(ctx context.Context, opts ForgetOptions, gopts GlobalOptions, arg
 	return nil
 }
 
+// markSnapshotsRemoved saves a tombstone which marks the snapshots as removed.
+// This is used for repositories which do not allow deleting files, the
+// snapshots and the tombstone must later be deleted by running prune with the
+// permission to delete files.
+func markSnapshotsRemoved(ctx context.Context, gopts GlobalOptions, repo restic.Repository, ids restic.IDSet) error {
+	if repo.Config().Version < restic.MinTombstoneRepoVersion {
+		return errors.Fatalf("the repository does not allow deleting files, marking %d snapshots as removed requires repository version %d", len(ids), restic.MinTombstoneRepoVersion)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		debug.Log("os.Hostname() returned err: %v", err)
+		hostname = ""
+	}
+
+	tombstone, err := restic.NewTombstone(ids.List(), hostname, time.Now())
+	if err != nil {
+		return err
+	}
+	id, err := restic.SaveSnapshot(ctx, repo, tombstone)
+	if err != nil {
+		return errors.Fatalf("unable to save tombstone: %v", err)
+	}
+
+	if !gopts.JSON {
+		Warnf("the repository does not allow deleting files, marked %d snapshots as removed by tombstone %v\n", len(ids), id.Str())
+		Warnf("run 'restic prune --remove-marked-snapshots' with the permission to delete files to remove them\n")
+	}
+	return nil
+}
+
 // ForgetGroup helps to print what is forgotten in JSON.
 type ForgetGroup struct {
 	Tags    []string            `json:"tags"`
@@ -10,6 +10,7 @@ import (
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/ui"
 
 	"github.com/spf13/cobra"
 )
@@ -36,6 +37,11 @@ type InitOptions struct {
 	secondaryRepoOptions
 	CopyChunkerParameters bool
 	RepositoryVersion     string
+	ChunkMinSize          string
+	ChunkMaxSize          string
+	ChunkAverageSize      string
+	MaxRepoSize           string
+	BlobHash              string
 }
 
 var initOptions InitOptions
@@ -47,6 +53,11 @@ func init() {
 	initSecondaryRepoOptions(f, &initOptions.secondaryRepoOptions, "secondary", "to copy chunker parameters from")
 	f.BoolVar(&initOptions.CopyChunkerParameters, "copy-chunker-params", false, "copy chunker parameters from the secondary repository (useful with the copy command)")
 	f.StringVar(&initOptions.RepositoryVersion, "repository-version", "stable", "repository format version to use, allowed values are a format version, 'latest' and 'stable'")
+	f.StringVar(&initOptions.ChunkMinSize, "chunk-min-size", "", "minimum `size` of the chunks files are split into (default: 512KiB, allowed suffixes: k/K, m/M)")
+	f.StringVar(&initOptions.ChunkMaxSize, "chunk-max-size", "", "maximum `size` of the chunks files are split into (default: 8MiB, allowed suffixes: k/K, m/M)")
+	f.StringVar(&initOptions.ChunkAverageSize, "chunk-avg-size", "", "average `size` of the chunks files are split into, must be a power of two (default: 1MiB, allowed suffixes: k/K, m/M)")
+	f.StringVar(&initOptions.BlobHash, "blob-hash", restic.BlobHashSHA256, "hash `algorithm` for the IDs of file contents and directories: sha256 or blake3 (blake3 requires repository version 3)")
+	f.StringVar(&initOptions.MaxRepoSize, "max-repo-size", "", "advisory size limit of the repository, backups stop uploading data once `size` is reached (allowed suffixes: k/K, m/M, g/G, t/T)")
 }
 
 func runInit(ctx context.Context, opts InitOptions, gopts GlobalOptions, args []string) error {
@@ -54,11 +65,37 @@ func runInit(ctx context.Context, opts InitOptions, gopts GlobalOptions, args []
 		return errors.Fatal("the init command expects no arguments, only options - please see `restic help init` for usage and flags")
 	}
 
+	hasher, err := restic.NewBlobHasher(opts.BlobHash)
+	if err != nil {
+		return errors.Fatalf("invalid --blob-hash: %v", err)
+	}
+
+	var maxRepoSize uint64
+	if opts.MaxRepoSize != "" {
+		size, err := ui.ParseBytes(opts.MaxRepoSize)
+		if err != nil || size <= 0 {
+			return errors.Fatalf("invalid --max-repo-size %q", opts.MaxRepoSize)
+		}
+		maxRepoSize = uint64(size)
+	}
+
+	chunkerPolynomial, chunkerSizes, err := maybeReadChunkerParameters(ctx, opts, gopts)
+	if err != nil {
+		return err
+	}
+
 	var version uint
 	if opts.RepositoryVersion == "latest" || opts.RepositoryVersion == "" {
 		version = restic.MaxRepoVersion
 	} else if opts.RepositoryVersion == "stable" {
 		version = restic.StableRepoVersion
+		// the blob hash and the chunker sizes can only be selected by newer repository versions
+		if hasher != (restic.BlobHasher{}) {
+			version = restic.MinBlobHashRepoVersion
+		}
+		if chunkerSizes != (restic.ChunkerSizes{}) && version < restic.MinChunkerSizesRepoVersion {
+			version = restic.MinChunkerSizesRepoVersion
+		}
 	} else {
 		v, err := strconv.ParseUint(opts.RepositoryVersion, 10, 32)
 		if err != nil {
@@ -69,10 +106,11 @@ func runInit(ctx context.Context, opts InitOptions, gopts GlobalOptions, args []
 	if version < restic.MinRepoVersion || version > restic.MaxRepoVersion {
 		return errors.Fatalf("only repository versions between %v and %v are allowed", restic.MinRepoVersion, restic.MaxRepoVersion)
 	}
-
-	chunkerPolynomial, err := maybeReadChunkerPolynomial(ctx, opts, gopts)
-	if err != nil {
-		return err
+	if hasher != (restic.BlobHasher{}) && version < restic.MinBlobHashRepoVersion {
+		return errors.Fatalf("--blob-hash %v requires repository version %v or later", hasher, restic.MinBlobHashRepoVersion)
+	}
+	if chunkerSizes != (restic.ChunkerSizes{}) && version < restic.MinChunkerSizesRepoVersion {
+		return errors.Fatalf("custom chunk sizes require repository version %v or later", restic.MinChunkerSizesRepoVersion)
 	}
 
 	gopts.Repo, err = ReadRepo(gopts)
@@ -93,17 +131,24 @@ func runInit(ctx context.Context, opts InitOptions, gopts GlobalOptions, args []
 	}
 
 	s, err := repository.New(be, repository.Options{
-		Compression: gopts.Compression,
-		PackSize:    gopts.PackSize * 1024 * 1024,
+		Compression:           gopts.Compression,
+		DataCompressionLevel:  gopts.DataCompressionLevel,
+		MinCompressionSavings: gopts.MinCompressionSavings,
+		PackSize:              gopts.PackSize * 1024 * 1024,
 	})
 	if err != nil {
 		return errors.Fatal(err.Error())
 	}
 
-	err = s.Init(ctx, version, gopts.password, chunkerPolynomial)
+	err = s.Init(ctx, version, gopts.password, chunkerPolynomial, chunkerSizes, hasher)
 	if err != nil {
 		return errors.Fatalf("create key in repository at %s failed: %v\n", location.StripPassword(gopts.backends, gopts.Repo), err)
 	}
+	if maxRepoSize > 0 {
+		if err := s.SetMaxRepoSize(ctx, maxRepoSize); err != nil {
+			return errors.Fatalf("setting the size limit failed: %v", err)
+		}
+	}
 
 	if !gopts.JSON {
 		Verbosef("created restic repository %v at %s", s.Config().ID[:10], location.StripPassword(gopts.backends, gopts.Repo))
@@ -129,26 +174,62 @@ func runInit(ctx context.Context, opts InitOptions, gopts GlobalOptions, args []
 	return nil
 }
 
-func maybeReadChunkerPolynomial(ctx context.Context, opts InitOptions, gopts GlobalOptions) (*chunker.Pol, error) {
+func maybeReadChunkerParameters(ctx context.Context, opts InitOptions, gopts GlobalOptions) (*chunker.Pol, restic.ChunkerSizes, error) {
+	sizes, err := parseChunkerSizes(opts)
+	if err != nil {
+		return nil, restic.ChunkerSizes{}, err
+	}
+
 	if opts.CopyChunkerParameters {
+		if sizes != (restic.ChunkerSizes{}) {
+			return nil, restic.ChunkerSizes{}, errors.Fatal("chunk sizes cannot be specified when copying the chunker parameters")
+		}
+
 		otherGopts, _, err := fillSecondaryGlobalOpts(opts.secondaryRepoOptions, gopts, "secondary")
 		if err != nil {
-			return nil, err
+			return nil, restic.ChunkerSizes{}, err
 		}
 
 		otherRepo, err := OpenRepository(ctx, otherGopts)
 		if err != nil {
-			return nil, err
+			return nil, restic.ChunkerSizes{}, err
 		}
 
 		pol := otherRepo.Config().ChunkerPolynomial
-		return &pol, nil
+		return &pol, otherRepo.Config().ChunkerSizes, nil
 	}
 
 	if opts.Repo != "" || opts.RepositoryFile != "" || opts.LegacyRepo != "" || opts.LegacyRepositoryFile != "" {
-		return nil, errors.Fatal("Secondary repository must only be specified when copying the chunker parameters")
+		return nil, restic.ChunkerSizes{}, errors.Fatal("Secondary repository must only be specified when copying the chunker parameters")
+	}
+	return nil, sizes, nil
+}
+
+func parseChunkerSizes(opts InitOptions) (restic.ChunkerSizes, error) {
+	var sizes restic.ChunkerSizes
+	for _, opt := range []struct {
+		name  string
+		value string
+		size  *uint
+	}{
+		{"--chunk-min-size", opts.ChunkMinSize, &sizes.MinSize},
+		{"--chunk-max-size", opts.ChunkMaxSize, &sizes.MaxSize},
+		{"--chunk-avg-size", opts.ChunkAverageSize, &sizes.AverageSize},
+	} {
+		if opt.value == "" {
+			continue
+		}
+		size, err := ui.ParseBytes(opt.value)
+		if err != nil || size <= 0 {
+			return restic.ChunkerSizes{}, errors.Fatalf("invalid %v %q", opt.name, opt.value)
+		}
+		*opt.size = uint(size)
+	}
+
+	if err := sizes.Validate(); err != nil {
+		return restic.ChunkerSizes{}, errors.Fatalf("invalid chunk sizes: %v", err)
 	}
-	return nil, nil
+	return sizes, nil
 }
 
 type initSuccess struct {
@@ -47,3 +47,37 @@ func TestInitCopyChunkerParams(t *testing.T) {
 		"expected equal chunker polynomials, got %v expected %v", repo.Config().ChunkerPolynomial,
 		otherRepo.Config().ChunkerPolynomial)
 }
+
+func TestInitBlobHash(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	initOpts := InitOptions{BlobHash: restic.BlobHashBLAKE3, RepositoryVersion: "2"}
+	rtest.Assert(t, runInit(context.TODO(), initOpts, env.gopts, nil) != nil, "expected blake3 to require repository version 3")
+	initOpts.BlobHash = "md5"
+	rtest.Assert(t, runInit(context.TODO(), initOpts, env.gopts, nil) != nil, "expected unknown algorithm to fail")
+
+	initOpts = InitOptions{BlobHash: restic.BlobHashBLAKE3, RepositoryVersion: "stable"}
+	rtest.OK(t, runInit(context.TODO(), initOpts, env.gopts, nil))
+
+	repo, err := OpenRepository(context.TODO(), env.gopts)
+	rtest.OK(t, err)
+	rtest.Equals(t, uint(restic.MinBlobHashRepoVersion), repo.Config().Version)
+	rtest.Equals(t, restic.BlobHashBLAKE3, repo.Config().BlobHash)
+}
+
+func TestInitChunkerSizes(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	initOpts := InitOptions{ChunkAverageSize: "2MiB", RepositoryVersion: "2"}
+	rtest.Assert(t, runInit(context.TODO(), initOpts, env.gopts, nil) != nil, "expected chunk sizes to require repository version 3")
+
+	initOpts.RepositoryVersion = "stable"
+	rtest.OK(t, runInit(context.TODO(), initOpts, env.gopts, nil))
+
+	repo, err := OpenRepository(context.TODO(), env.gopts)
+	rtest.OK(t, err)
+	rtest.Equals(t, uint(restic.MinChunkerSizesRepoVersion), repo.Config().Version)
+	rtest.Equals(t, uint(2*1024*1024), repo.Config().AverageSize)
+}
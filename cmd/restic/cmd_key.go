@@ -6,8 +6,10 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/crypto"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
@@ -17,11 +19,25 @@ import (
 )
 
 var cmdKey = &cobra.Command{
-	Use:   "key [flags] [list|add|remove|passwd] [ID]",
+	Use:   "key [flags] [list|add|remove|passwd|kdf] [ID]",
 	Short: "Manage keys (passwords)",
 	Long: `
 The "key" command manages keys (passwords) for accessing the repository.
 
+The "kdf" subcommand rewrites the key which is used to open the repository
+with new parameters for the key derivation function (scrypt). The password and
+the master keys stay the same, other keys are not modified. Unless N, r and p
+are specified, parameters are chosen such that deriving the key takes about
+--kdf-time on this machine. With --benchmark, the time required for the
+current and the new parameters is printed without modifying the key.
+
+With --write-only, the "add" subcommand creates a write-only key instead of a
+password and stores it in the given file. The file allows "restic backup
+--write-only-key" to add snapshots to the repository without being able to
+read, modify or remove any data. Reading the data saved using a write-only key
+requires a password. Access is revoked by removing the write-only key, the
+snapshots which were created using it stay readable.
+
 EXIT STATUS
 ===========
 
@@ -37,6 +53,12 @@ var (
 	newPasswordFile string
 	keyUsername     string
 	keyHostname     string
+	writeOnlyFile   string
+
+	kdfParams    crypto.Params
+	kdfTime      time.Duration
+	kdfMemory    int
+	kdfBenchmark bool
 )
 
 func init() {
@@ -46,6 +68,13 @@ func init() {
 	flags.StringVarP(&newPasswordFile, "new-password-file", "", "", "`file` from which to read the new password")
 	flags.StringVarP(&keyUsername, "user", "", "", "the username for new keys")
 	flags.StringVarP(&keyHostname, "host", "", "", "the hostname for new keys")
+	flags.StringVar(&writeOnlyFile, "write-only", "", "add a write-only key and store it in `file`")
+	flags.IntVar(&kdfParams.N, "kdf-n", 0, "scrypt parameter `N` for the kdf subcommand, must be a power of two (default: the current value if r or p are set)")
+	flags.IntVar(&kdfParams.R, "kdf-r", 0, "scrypt parameter `r` for the kdf subcommand (default: the current value if N or p are set)")
+	flags.IntVar(&kdfParams.P, "kdf-p", 0, "scrypt parameter `p` for the kdf subcommand (default: the current value if N or r are set)")
+	flags.DurationVar(&kdfTime, "kdf-time", repository.KDFTimeout, "choose the scrypt parameters such that deriving a key takes about `duration`")
+	flags.IntVar(&kdfMemory, "kdf-memory", repository.KDFMemory, "maximum `MiB` of memory used by the chosen scrypt parameters")
+	flags.BoolVar(&kdfBenchmark, "benchmark", false, "only print the time required by the current and the new scrypt parameters")
 }
 
 func listKeys(ctx context.Context, s *repository.Repository, gopts GlobalOptions) error {
@@ -55,6 +84,7 @@ func listKeys(ctx context.Context, s *repository.Repository, gopts GlobalOptions
 		UserName string `json:"userName"`
 		HostName string `json:"hostName"`
 		Created  string `json:"created"`
+		Access   string `json:"access"`
 	}
 
 	var m sync.Mutex
@@ -67,12 +97,22 @@ func listKeys(ctx context.Context, s *repository.Repository, gopts GlobalOptions
 			return nil
 		}
 
+		access := "read/write"
+		switch k.Type {
+		case repository.KeyTypeSession, repository.KeyTypeSessionList:
+			// session keys are created by each backup using a write-only key
+			return nil
+		case repository.KeyTypeWriteOnly:
+			access = "write-only"
+		}
+
 		key := keyInfo{
 			Current:  id == s.KeyID(),
 			ID:       id.Str(),
 			UserName: k.Username,
 			HostName: k.Hostname,
 			Created:  k.Created.Local().Format(TimeFormat),
+			Access:   access,
 		}
 
 		m.Lock()
@@ -94,6 +134,7 @@ func listKeys(ctx context.Context, s *repository.Repository, gopts GlobalOptions
 	tab.AddColumn("User", "{{ .UserName }}")
 	tab.AddColumn("Host", "{{ .HostName }}")
 	tab.AddColumn("Created", "{{ .Created }}")
+	tab.AddColumn("Access", "{{ .Access }}")
 
 	for _, key := range keys {
 		tab.AddRow(key)
@@ -145,13 +186,56 @@ func addKey(ctx context.Context, repo *repository.Repository, gopts GlobalOption
 	return nil
 }
 
+func addWriteOnlyKey(ctx context.Context, repo *repository.Repository) error {
+	f, err := os.OpenFile(writeOnlyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Fatalf("%s", err)
+	}
+
+	key, writeOnly, err := repository.AddWriteOnlyKey(ctx, repo, keyUsername, keyHostname)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(writeOnlyFile)
+		return errors.Fatalf("creating new key failed: %v\n", err)
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(writeOnly)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Fatalf("writing %v failed: %v, remove the key %v", writeOnlyFile, err, key.ID())
+	}
+
+	Verbosef("saved new write-only key as %s in %v\n", key.ID(), writeOnlyFile)
+	return nil
+}
+
 func deleteKey(ctx context.Context, repo *repository.Repository, id restic.ID) error {
 	if id == repo.KeyID() {
 		return errors.Fatal("refusing to remove key currently used to access repository")
 	}
 
+	k, err := repository.LoadKey(ctx, repo, id)
+	if err != nil {
+		return err
+	}
+	switch k.Type {
+	case repository.KeyTypeSession, repository.KeyTypeSessionList:
+		return errors.Fatal("refusing to remove session key, which is required to read the data of a backup")
+	case repository.KeyTypeWriteOnly:
+		moved, err := repository.RemoveWriteOnlyKey(ctx, repo, id)
+		if err != nil {
+			return err
+		}
+		Verbosef("removed write-only key %v, moved %d session keys into a session list\n", id, moved)
+		return nil
+	}
+
 	h := backend.Handle{Type: restic.KeyFile, Name: id.String()}
-	err := repo.Backend().Remove(ctx, h)
+	err = repo.Backend().Remove(ctx, h)
 	if err != nil {
 		return err
 	}
@@ -188,6 +272,80 @@ func changePassword(ctx context.Context, repo *repository.Repository, gopts Glob
 	return nil
 }
 
+// measureKDF returns the time needed to derive a key using params.
+func measureKDF(params crypto.Params, password string) (time.Duration, error) {
+	salt, err := crypto.NewSalt()
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	_, err = crypto.KDF(params, salt, password)
+	if err != nil {
+		return 0, errors.Fatalf("invalid KDF parameters N=%d, r=%d, p=%d: %v", params.N, params.R, params.P, err)
+	}
+	return time.Since(start), nil
+}
+
+func changeKDF(ctx context.Context, repo *repository.Repository, gopts GlobalOptions) error {
+	keyID := repo.KeyID()
+	key, err := repository.OpenKey(ctx, repo, keyID, gopts.password)
+	if err != nil {
+		return errors.Fatalf("opening key %v failed: %v", keyID.Str(), err)
+	}
+	current := key.KDFParams()
+
+	params := kdfParams
+	if params == (crypto.Params{}) {
+		params, err = crypto.Calibrate(kdfTime, kdfMemory)
+		if err != nil {
+			return errors.Fatalf("calibrating KDF parameters failed: %v", err)
+		}
+	} else {
+		if params.N == 0 {
+			params.N = current.N
+		}
+		if params.R == 0 {
+			params.R = current.R
+		}
+		if params.P == 0 {
+			params.P = current.P
+		}
+	}
+
+	currentTime, err := measureKDF(current, gopts.password)
+	if err != nil {
+		return err
+	}
+	newTime, err := measureKDF(params, gopts.password)
+	if err != nil {
+		return err
+	}
+
+	printf := Verbosef
+	if kdfBenchmark {
+		printf = Printf
+	}
+	printf("current KDF parameters: N=%d, r=%d, p=%d, deriving a key takes %v\n", current.N, current.R, current.P, currentTime.Round(time.Millisecond))
+	printf("new KDF parameters:     N=%d, r=%d, p=%d, deriving a key takes %v\n", params.N, params.R, params.P, newTime.Round(time.Millisecond))
+	if kdfBenchmark {
+		return nil
+	}
+
+	newKey, err := repository.RewriteKey(ctx, repo, key, gopts.password, params)
+	if err != nil {
+		return errors.Fatalf("rewriting key %v failed: %v", keyID.Str(), err)
+	}
+
+	err = repo.SearchKey(ctx, gopts.password, 0, newKey.ID().String())
+	if err != nil {
+		return errors.Fatalf("failed to access repository with new key: %v", err)
+	}
+
+	Verbosef("saved key %v as %v\n", keyID.Str(), newKey.ID())
+	return nil
+}
+
 func switchToNewKeyAndRemoveIfBroken(ctx context.Context, repo *repository.Repository, key *repository.Key, pw string) error {
 	// Verify new key to make sure it really works. A broken key can render the
 	// whole repository inaccessible
@@ -206,6 +364,15 @@ func runKey(ctx context.Context, gopts GlobalOptions, args []string) error {
 		return errors.Fatal("wrong number of arguments")
 	}
 
+	if args[0] == "kdf" {
+		// the password is needed to derive the new key
+		var err error
+		gopts.password, err = ReadPassword(gopts, "enter password for repository: ")
+		if err != nil {
+			return err
+		}
+	}
+
 	repo, err := OpenRepository(ctx, gopts)
 	if err != nil {
 		return err
@@ -230,6 +397,9 @@ func runKey(ctx context.Context, gopts GlobalOptions, args []string) error {
 			return err
 		}
 
+		if writeOnlyFile != "" {
+			return addWriteOnlyKey(ctx, repo)
+		}
 		return addKey(ctx, repo, gopts)
 	case "remove":
 		lock, ctx, err := lockRepoExclusive(ctx, repo, gopts.RetryLock, gopts.JSON)
@@ -252,6 +422,14 @@ func runKey(ctx context.Context, gopts GlobalOptions, args []string) error {
 		}
 
 		return changePassword(ctx, repo, gopts)
+	case "kdf":
+		lock, ctx, err := lockRepoExclusive(ctx, repo, gopts.RetryLock, gopts.JSON)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+
+		return changeKDF(ctx, repo, gopts)
 	}
 
 	return nil
@@ -3,10 +3,15 @@ package main
 import (
 	"bufio"
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/crypto"
 	"github.com/restic/restic/internal/repository"
 	rtest "github.com/restic/restic/internal/test"
 )
@@ -109,6 +114,110 @@ func TestKeyAddRemove(t *testing.T) {
 	testRunKeyAddNewKeyUserHost(t, env.gopts)
 }
 
+func testRunKeyKDF(gopts GlobalOptions, params crypto.Params, benchmark bool) error {
+	kdfParams, kdfBenchmark = params, benchmark
+	defer func() {
+		kdfParams, kdfBenchmark = crypto.Params{}, false
+	}()
+
+	return runKey(context.TODO(), gopts, []string{"kdf"})
+}
+
+func TestKeyKDF(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	// must list keys more than once
+	env.gopts.backendTestHook = nil
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+	testRunKeyAddNewKey(t, "geheim2", env.gopts)
+	before := testRunKeyListOtherIDs(t, env.gopts)
+	rtest.Equals(t, 1, len(before))
+
+	// the benchmark does not modify the key
+	rtest.OK(t, testRunKeyKDF(env.gopts, crypto.Params{N: 256}, true))
+	rtest.Equals(t, before, testRunKeyListOtherIDs(t, env.gopts))
+
+	err := testRunKeyKDF(env.gopts, crypto.Params{N: 100}, false)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "invalid KDF parameters"), "unexpected error %v", err)
+
+	rtest.OK(t, testRunKeyKDF(env.gopts, crypto.Params{N: 256, R: 2}, false))
+	// only the current key is rewritten
+	rtest.Equals(t, before, testRunKeyListOtherIDs(t, env.gopts))
+
+	repo, err := OpenRepository(context.TODO(), env.gopts)
+	rtest.OK(t, err)
+	key, err := repository.SearchKey(context.TODO(), repo, env.gopts.password, 0, "")
+	rtest.OK(t, err)
+	rtest.Equals(t, crypto.Params{N: 256, R: 2, P: 1}, key.KDFParams())
+
+	// the other key still opens the repository
+	env.gopts.password = "geheim2"
+	testRunCheck(t, env.gopts)
+}
+
+func TestKeyWriteOnly(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	// must list keys more than once
+	env.gopts.backendTestHook = nil
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+
+	keyFile := filepath.Join(env.base, "write-only.json")
+	writeOnlyFile = keyFile
+	rtest.OK(t, runKey(context.TODO(), env.gopts, []string{"add"}))
+	writeOnlyFile = ""
+
+	buf, err := withCaptureStdout(func() error {
+		return runKey(context.TODO(), env.gopts, []string{"list"})
+	})
+	rtest.OK(t, err)
+	rtest.Assert(t, strings.Contains(buf.String(), "write-only"), "write-only key missing in list:\n%v", buf)
+	writeOnlyIDs := testRunKeyListOtherIDs(t, env.gopts)
+	rtest.Equals(t, 1, len(writeOnlyIDs))
+
+	// the password is not required for a backup using the write-only key
+	woOpts := env.gopts
+	woOpts.password = ""
+	opts := BackupOptions{WriteOnlyKey: keyFile}
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, woOpts)
+	testRunBackup(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, woOpts)
+
+	// each backup stores a session key, which is not listed
+	rtest.Equals(t, writeOnlyIDs, testRunKeyListOtherIDs(t, env.gopts))
+
+	restoreAll := func(name string) {
+		t.Helper()
+		for i, snapshotID := range testListSnapshots(t, env.gopts, 2) {
+			restoredir := filepath.Join(env.base, fmt.Sprintf("%v%d", name, i))
+			testRunRestore(t, env.gopts, restoredir, snapshotID)
+			diff := directoriesContentsDiff(env.testdata, filepath.Join(restoredir, "testdata"))
+			rtest.Assert(t, diff == "", "directories are not equal: %v", diff)
+		}
+		testRunCheck(t, env.gopts)
+	}
+	restoreAll("restore")
+
+	// prune moves the session keys into a single key file
+	keyFiles := func() int {
+		t.Helper()
+		entries, err := os.ReadDir(filepath.Join(env.repo, "keys"))
+		rtest.OK(t, err)
+		return len(entries)
+	}
+	rtest.Equals(t, 4, keyFiles())
+	testRunPrune(t, env.gopts, PruneOptions{MaxUnused: "5%"})
+	rtest.Equals(t, 3, keyFiles())
+	restoreAll("restore-pruned")
+
+	testRunKeyRemove(t, env.gopts, writeOnlyIDs)
+	restoreAll("restore-removed")
+
+	err = testRunBackupAssumeFailure(t, filepath.Dir(env.testdata), []string{"testdata"}, opts, woOpts)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "was removed"), "unexpected error %v", err)
+}
+
 type emptySaveBackend struct {
 	backend.Backend
 }
@@ -139,6 +248,10 @@ func TestKeyProblems(t *testing.T) {
 	t.Log(err)
 	rtest.Assert(t, err != nil, "expected key adding to fail")
 
+	err = testRunKeyKDF(env.gopts, crypto.Params{N: 256}, false)
+	t.Log(err)
+	rtest.Assert(t, err != nil, "expected rewriting the key to fail")
+
 	t.Logf("testing access with initial password %q\n", env.gopts.password)
 	rtest.OK(t, runKey(context.TODO(), env.gopts, []string{"list"}))
 	testRunCheck(t, env.gopts)
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"io"
 	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -34,6 +37,15 @@ will allow traversing into matching directories' subfolders.
 Any directory paths specified must be absolute (starting with
 a path separator); paths use the forward slash '/' as separator.
 
+The --recursive-depth flag lists the entries up to the given number
+of levels below the listed directories, or the root of the snapshot.
+The size of a directory is the total size of the files it contains.
+
+With --format ncdu, the snapshot is written in the JSON export format
+of ncdu. Open it with "ncdu -f FILE" to browse the snapshot and the
+space used by its directories. Use "snapshotID:subfolder" to only
+export a subfolder of the snapshot.
+
 EXIT STATUS
 ===========
 
@@ -49,8 +61,10 @@ Exit status is 0 if the command was successful, and non-zero if there was any er
 type LsOptions struct {
 	ListLong bool
 	restic.SnapshotFilter
-	Recursive     bool
-	HumanReadable bool
+	Recursive      bool
+	HumanReadable  bool
+	RecursiveDepth int
+	Format         string
 }
 
 var lsOptions LsOptions
@@ -63,6 +77,8 @@ func init() {
 	flags.BoolVarP(&lsOptions.ListLong, "long", "l", false, "use a long listing format showing size and mode")
 	flags.BoolVar(&lsOptions.Recursive, "recursive", false, "include files in subfolders of the listed directories")
 	flags.BoolVar(&lsOptions.HumanReadable, "human-readable", false, "print sizes in human readable format")
+	flags.IntVar(&lsOptions.RecursiveDepth, "recursive-depth", 0, "list entries up to `n` levels below the listed directories, with the total size of directories")
+	flags.StringVar(&lsOptions.Format, "format", "", "write the listing in another `format`, \"ncdu\" writes the JSON export format of ncdu")
 }
 
 type lsSnapshot struct {
@@ -74,6 +90,14 @@ type lsSnapshot struct {
 
 // Print node in our custom JSON format, followed by a newline.
 func lsNodeJSON(enc *json.Encoder, path string, node *restic.Node) error {
+	// Always print size for regular files, even when empty,
+	// but never for other types.
+	return lsNodeJSONSize(enc, path, node, node.Type == "file")
+}
+
+// lsNodeJSONSize is like lsNodeJSON, but prints the size of node only if
+// withSize is set.
+func lsNodeJSONSize(enc *json.Encoder, path string, node *restic.Node, withSize bool) error {
 	n := &struct {
 		Name        string      `json:"name"`
 		Type        string      `json:"type"`
@@ -105,15 +129,263 @@ func lsNodeJSON(enc *json.Encoder, path string, node *restic.Node) error {
 		Inode:       node.Inode,
 		StructType:  "node",
 	}
-	// Always print size for regular files, even when empty,
-	// but never for other types.
-	if node.Type == "file" {
+	if withSize {
 		n.Size = &n.size
 	}
 
 	return enc.Encode(n)
 }
 
+// lsDir is a directory entered while walking a snapshot.
+type lsDir struct {
+	path string
+	// size is the total size of the files below the directory visited so far
+	size uint64
+	// entry is the pending output of the directory, if it is listed
+	entry *lsEntry
+}
+
+// contains returns true if nodepath is located below the directory.
+func (d *lsDir) contains(nodepath string) bool {
+	return d.path == "/" || strings.HasPrefix(nodepath, d.path+"/")
+}
+
+type lsInode struct {
+	inode, device uint64
+}
+
+// lsDirStack aggregates the sizes of the directories entered by walker.Walk.
+// As the walker visits the entries of a directory right after the directory
+// itself, a directory is complete once an entry outside of it is visited.
+// Only the directories on the path to the current entry are kept in memory.
+type lsDirStack struct {
+	dirs []*lsDir
+	// leave is called with each directory once all its entries were visited
+	leave func(dir *lsDir) error
+	// hardlinks are the files with several links which were already counted
+	hardlinks map[lsInode]struct{}
+}
+
+// visit completes all directories which do not contain nodepath.
+func (s *lsDirStack) visit(nodepath string) error {
+	for len(s.dirs) > 0 {
+		dir := s.dirs[len(s.dirs)-1]
+		if dir.contains(nodepath) {
+			return nil
+		}
+		if err := s.pop(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *lsDirStack) push(dir *lsDir) {
+	s.dirs = append(s.dirs, dir)
+}
+
+func (s *lsDirStack) pop() error {
+	dir := s.dirs[len(s.dirs)-1]
+	s.dirs = s.dirs[:len(s.dirs)-1]
+	if len(s.dirs) > 0 {
+		s.dirs[len(s.dirs)-1].size += dir.size
+	}
+	return s.leave(dir)
+}
+
+// addFile adds the size of the file node to the current directory. Files
+// with several hardlinks are only counted once.
+func (s *lsDirStack) addFile(node *restic.Node) {
+	if len(s.dirs) == 0 || node.Type != "file" {
+		return
+	}
+	if node.Links > 1 {
+		key := lsInode{node.Inode, node.DeviceID}
+		if _, ok := s.hardlinks[key]; ok {
+			return
+		}
+		if s.hardlinks == nil {
+			s.hardlinks = make(map[lsInode]struct{})
+		}
+		s.hardlinks[key] = struct{}{}
+	}
+	s.dirs[len(s.dirs)-1].size += node.Size
+}
+
+// finish completes all remaining directories.
+func (s *lsDirStack) finish() error {
+	for len(s.dirs) > 0 {
+		if err := s.pop(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lsEntry is an entry of a listing with --recursive-depth.
+type lsEntry struct {
+	path string
+	node restic.Node
+	// done is set once the total size of a directory is known
+	done bool
+}
+
+// pathDepth returns the number of elements of the slash-separated path p.
+func pathDepth(p string) int {
+	p = strings.Trim(path.Clean(p), "/")
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+// ncduItem is the information about an entry in the JSON export format of
+// ncdu, see https://dev.yorhel.nl/ncdu/jsonfmt.
+type ncduItem struct {
+	Name  string `json:"name"`
+	Asize uint64 `json:"asize,omitempty"`
+	Dsize uint64 `json:"dsize,omitempty"`
+	Dev   uint64 `json:"dev,omitempty"`
+	Ino   uint64 `json:"ino,omitempty"`
+	// Hlnkc is set for files with several hardlinks, ncdu only counts
+	// their size once per inode
+	Hlnkc  bool   `json:"hlnkc,omitempty"`
+	Nlink  uint64 `json:"nlink,omitempty"`
+	NotReg bool   `json:"notreg,omitempty"`
+	UID    uint32 `json:"uid,omitempty"`
+	GID    uint32 `json:"gid,omitempty"`
+	Mode   uint32 `json:"mode,omitempty"`
+	Mtime  int64  `json:"mtime,omitempty"`
+}
+
+func newNcduItem(node *restic.Node) ncduItem {
+	item := ncduItem{
+		Name:   node.Name,
+		Dev:    node.DeviceID,
+		Ino:    node.Inode,
+		NotReg: node.Type != "file" && node.Type != "dir",
+		UID:    node.UID,
+		GID:    node.GID,
+		Mode:   ncduMode(node),
+		Mtime:  node.ModTime.Unix(),
+	}
+	if node.Type == "file" {
+		// the used disk space is unknown, use the size instead
+		item.Asize = node.Size
+		item.Dsize = node.Size
+		if node.Links > 1 {
+			item.Hlnkc = true
+			item.Nlink = node.Links
+		}
+	}
+	return item
+}
+
+// ncduMode returns the mode of node like st_mode of stat(2).
+func ncduMode(node *restic.Node) uint32 {
+	mode := uint32(node.Mode.Perm())
+	if node.Mode&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if node.Mode&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if node.Mode&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+
+	switch node.Type {
+	case "file":
+		mode |= 0100000
+	case "dir":
+		mode |= 040000
+	case "symlink":
+		mode |= 0120000
+	case "dev":
+		mode |= 060000
+	case "chardev":
+		mode |= 020000
+	case "fifo":
+		mode |= 010000
+	case "socket":
+		mode |= 0140000
+	}
+	return mode
+}
+
+// lsNcdu writes the tree of sn to out in the JSON export format of ncdu.
+// Directories are arrays of the information about the directory followed
+// by its entries, ncdu sums up the sizes of their contents itself. The output
+// is written while walking the tree, only the open directories are kept in
+// memory.
+func lsNcdu(ctx context.Context, repo restic.Repository, sn *restic.Snapshot, rootName string, out io.Writer) error {
+	wr := bufio.NewWriter(out)
+	var werr error
+	write := func(data ...interface{}) {
+		for _, d := range data {
+			if werr != nil {
+				return
+			}
+			switch d := d.(type) {
+			case string:
+				_, werr = wr.WriteString(d)
+			default:
+				var buf []byte
+				buf, werr = json.Marshal(d)
+				if werr == nil {
+					_, werr = wr.Write(buf)
+				}
+			}
+		}
+	}
+
+	write("[1,2,", map[string]interface{}{
+		"progname":  "restic",
+		"progver":   version,
+		"timestamp": sn.Time.Unix(),
+	}, ",\n[", ncduItem{Name: rootName, Mtime: sn.Time.Unix()})
+
+	stack := lsDirStack{
+		leave: func(_ *lsDir) error {
+			write("]")
+			return werr
+		},
+	}
+	stack.push(&lsDir{path: "/"})
+
+	err := walker.Walk(ctx, repo, *sn.Tree, nil, func(_ restic.ID, nodepath string, node *restic.Node, err error) (bool, error) {
+		if err != nil {
+			return false, err
+		}
+		if node == nil {
+			return false, nil
+		}
+
+		if err := stack.visit(nodepath); err != nil {
+			return false, err
+		}
+		if node.Type == "dir" {
+			write(",\n[", newNcduItem(node))
+			stack.push(&lsDir{path: nodepath})
+		} else {
+			write(",\n", newNcduItem(node))
+		}
+		return false, werr
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := stack.finish(); err != nil {
+		return err
+	}
+	write("]\n")
+	if werr != nil {
+		return werr
+	}
+	return wr.Flush()
+}
+
 func runLs(ctx context.Context, opts LsOptions, gopts GlobalOptions, args []string) error {
 	if len(args) == 0 {
 		return errors.Fatal("no snapshot ID specified, specify snapshot ID or use special ID 'latest'")
@@ -130,6 +402,22 @@ func runLs(ctx context.Context, opts LsOptions, gopts GlobalOptions, args []stri
 		}
 	}
 
+	switch opts.Format {
+	case "":
+	case "ncdu":
+		if len(dirs) > 0 {
+			return errors.Fatal("directory filters are not supported with --format ncdu, use snapshotID:subfolder instead")
+		}
+		if gopts.JSON || opts.ListLong || opts.RecursiveDepth != 0 {
+			return errors.Fatal("--format ncdu cannot be combined with --json, --long or --recursive-depth")
+		}
+	default:
+		return errors.Fatalf("unknown format %q, only \"ncdu\" is supported", opts.Format)
+	}
+	if opts.RecursiveDepth < 0 {
+		return errors.Fatal("--recursive-depth must not be negative")
+	}
+
 	withinDir := func(nodepath string) bool {
 		if len(dirs) == 0 {
 			return true
@@ -179,6 +467,10 @@ func runLs(ctx context.Context, opts LsOptions, gopts GlobalOptions, args []stri
 		return err
 	}
 
+	// with --recursive-depth, directories are printed with the total size of
+	// their contents
+	aggregate := opts.RecursiveDepth > 0
+
 	var (
 		printSnapshot func(sn *restic.Snapshot)
 		printNode     func(path string, node *restic.Node)
@@ -200,7 +492,7 @@ func runLs(ctx context.Context, opts LsOptions, gopts GlobalOptions, args []stri
 		}
 
 		printNode = func(path string, node *restic.Node) {
-			err := lsNodeJSON(enc, path, node)
+			err := lsNodeJSONSize(enc, path, node, node.Type == "file" || (aggregate && node.Type == "dir"))
 			if err != nil {
 				Warnf("JSON encode failed: %v\n", err)
 			}
@@ -210,7 +502,7 @@ func runLs(ctx context.Context, opts LsOptions, gopts GlobalOptions, args []stri
 			Verbosef("%v filtered by %v:\n", sn, dirs)
 		}
 		printNode = func(path string, node *restic.Node) {
-			Printf("%s\n", formatNode(path, node, lsOptions.ListLong, lsOptions.HumanReadable))
+			Printf("%s\n", formatNode(path, node, opts.ListLong, opts.HumanReadable))
 		}
 	}
 
@@ -228,8 +520,52 @@ func runLs(ctx context.Context, opts LsOptions, gopts GlobalOptions, args []stri
 		return err
 	}
 
+	if opts.Format == "ncdu" {
+		rootName := "/"
+		if subfolder != "" {
+			rootName = subfolder
+		}
+		return lsNcdu(ctx, repo, sn, rootName, globalOptions.stdout)
+	}
+
 	printSnapshot(sn)
 
+	// depth returns the depth of nodepath below the listed directory
+	depth := func(nodepath string) int {
+		for _, dir := range dirs {
+			if fs.HasPathPrefix(dir, nodepath) {
+				return pathDepth(nodepath) - pathDepth(dir)
+			}
+		}
+		return pathDepth(nodepath)
+	}
+
+	// The entries up to opts.RecursiveDepth are kept in pending until the
+	// sizes of all directories listed before them are known, so that they
+	// are printed in the same order as without aggregation.
+	var pending []*lsEntry
+	flush := func() {
+		n := 0
+		for n < len(pending) && pending[n].done {
+			printNode(pending[n].path, &pending[n].node)
+			n++
+		}
+		pending = pending[n:]
+		if len(pending) == 0 {
+			pending = nil
+		}
+	}
+	stack := lsDirStack{
+		leave: func(dir *lsDir) error {
+			if dir.entry != nil {
+				dir.entry.node.Size = dir.size
+				dir.entry.done = true
+				flush()
+			}
+			return nil
+		},
+	}
+
 	err = walker.Walk(ctx, repo, *sn.Tree, nil, func(_ restic.ID, nodepath string, node *restic.Node, err error) (bool, error) {
 		if err != nil {
 			return false, err
@@ -238,7 +574,27 @@ func runLs(ctx context.Context, opts LsOptions, gopts GlobalOptions, args []stri
 			return false, nil
 		}
 
-		if withinDir(nodepath) {
+		if aggregate {
+			if err := stack.visit(nodepath); err != nil {
+				return false, err
+			}
+			if withinDir(nodepath) {
+				var entry *lsEntry
+				if depth(nodepath) <= opts.RecursiveDepth {
+					entry = &lsEntry{path: nodepath, node: *node, done: node.Type != "dir"}
+					pending = append(pending, entry)
+				}
+				if node.Type == "dir" {
+					stack.push(&lsDir{path: nodepath, entry: entry})
+				} else {
+					stack.addFile(node)
+				}
+				flush()
+
+				// visit all entries to determine the size of directories
+				return false, nil
+			}
+		} else if withinDir(nodepath) {
 			// if we're within a dir, print the node
 			printNode(nodepath, node)
 
@@ -267,5 +623,5 @@ func runLs(ctx context.Context, opts LsOptions, gopts GlobalOptions, args []stri
 		return err
 	}
 
-	return nil
+	return stack.finish()
 }
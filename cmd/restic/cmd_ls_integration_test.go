@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -17,3 +21,156 @@ func testRunLs(t testing.TB, gopts GlobalOptions, snapshotID string) []string {
 	rtest.OK(t, err)
 	return strings.Split(buf.String(), "\n")
 }
+
+func testRunLsWithOptions(t testing.TB, gopts GlobalOptions, opts LsOptions, args ...string) []byte {
+	buf, err := withCaptureStdout(func() error {
+		gopts.Quiet = true
+		return runLs(context.TODO(), opts, gopts, args)
+	})
+	rtest.OK(t, err)
+	return buf.Bytes()
+}
+
+func setupLsSizeTest(t testing.TB, env *testEnvironment) {
+	for name, size := range map[string]int{
+		"a/file1":       100,
+		"a/b/file2":     200,
+		"a/b/c/file3":   300,
+		"a/b/c/d/file4": 400,
+		"e/file5":       50,
+		"file6":         10,
+	} {
+		p := filepath.Join(env.testdata, filepath.FromSlash(name))
+		rtest.OK(t, os.MkdirAll(filepath.Dir(p), 0755))
+		rtest.OK(t, os.WriteFile(p, make([]byte, size), 0644))
+	}
+
+	testRunInit(t, env.gopts)
+	testRunBackup(t, env.testdata, []string{"."}, BackupOptions{}, env.gopts)
+}
+
+func TestLsRecursiveDepth(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+	setupLsSizeTest(t, env)
+
+	parse := func(out []byte) (paths []string, sizes map[string]uint64) {
+		sizes = make(map[string]uint64)
+		scanner := bufio.NewScanner(strings.NewReader(string(out)))
+		for scanner.Scan() {
+			var node struct {
+				Path       string  `json:"path"`
+				Size       *uint64 `json:"size"`
+				StructType string  `json:"struct_type"`
+			}
+			rtest.OK(t, json.Unmarshal(scanner.Bytes(), &node))
+			if node.StructType != "node" {
+				continue
+			}
+			rtest.Assert(t, node.Size != nil, "missing size of %v", node.Path)
+			paths = append(paths, node.Path)
+			sizes[node.Path] = *node.Size
+		}
+		return paths, sizes
+	}
+
+	gopts := env.gopts
+	gopts.JSON = true
+	paths, sizes := parse(testRunLsWithOptions(t, gopts, LsOptions{RecursiveDepth: 2}, "latest"))
+	rtest.Equals(t, []string{"/a", "/a/b", "/a/file1", "/e", "/e/file5", "/file6"}, paths)
+	rtest.Equals(t, map[string]uint64{
+		"/a":       1000,
+		"/a/b":     900,
+		"/a/file1": 100,
+		"/e":       50,
+		"/e/file5": 50,
+		"/file6":   10,
+	}, sizes)
+
+	// the depth is relative to the listed directory
+	paths, sizes = parse(testRunLsWithOptions(t, gopts, LsOptions{RecursiveDepth: 1}, "latest", "/a/b"))
+	rtest.Equals(t, []string{"/a/b", "/a/b/c", "/a/b/file2"}, paths)
+	rtest.Equals(t, uint64(900), sizes["/a/b"])
+	rtest.Equals(t, uint64(700), sizes["/a/b/c"])
+
+	out := testRunLsWithOptions(t, env.gopts, LsOptions{RecursiveDepth: 1, ListLong: true}, "latest")
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	rtest.Equals(t, 3, len(lines))
+	rtest.Assert(t, strings.Contains(lines[0], "  1000 ") && strings.HasSuffix(lines[0], " /a"),
+		"unexpected line for /a: %q", lines[0])
+}
+
+// ncduDir is a directory of the ncdu export format.
+type ncduDir struct {
+	info    ncduItem
+	files   []ncduItem
+	subdirs []ncduDir
+}
+
+func parseNcduDir(t testing.TB, raw json.RawMessage) ncduDir {
+	var entries []json.RawMessage
+	rtest.OK(t, json.Unmarshal(raw, &entries))
+	rtest.Assert(t, len(entries) > 0, "directory without information")
+
+	var dir ncduDir
+	rtest.OK(t, json.Unmarshal(entries[0], &dir.info))
+	for _, entry := range entries[1:] {
+		if entry[0] == '[' {
+			dir.subdirs = append(dir.subdirs, parseNcduDir(t, entry))
+			continue
+		}
+		var item ncduItem
+		rtest.OK(t, json.Unmarshal(entry, &item))
+		dir.files = append(dir.files, item)
+	}
+	return dir
+}
+
+func (d ncduDir) size() uint64 {
+	var size uint64
+	for _, f := range d.files {
+		size += f.Asize
+	}
+	for _, sub := range d.subdirs {
+		size += sub.size()
+	}
+	return size
+}
+
+func TestLsNcdu(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+	setupLsSizeTest(t, env)
+
+	out := testRunLsWithOptions(t, env.gopts, LsOptions{Format: "ncdu"}, "latest")
+	var export []json.RawMessage
+	rtest.OK(t, json.Unmarshal(out, &export))
+	rtest.Equals(t, 4, len(export))
+	rtest.Equals(t, "1", string(export[0]))
+
+	var meta struct {
+		Progname string `json:"progname"`
+	}
+	rtest.OK(t, json.Unmarshal(export[2], &meta))
+	rtest.Equals(t, "restic", meta.Progname)
+
+	root := parseNcduDir(t, export[3])
+	rtest.Equals(t, "/", root.info.Name)
+	rtest.Equals(t, uint64(1060), root.size())
+
+	rtest.Equals(t, "file6", root.files[0].Name)
+	dir := root.subdirs[0]
+	rtest.Equals(t, "a", dir.info.Name)
+	rtest.Equals(t, uint64(1000), dir.size())
+	rtest.Equals(t, "file1", dir.files[0].Name)
+	rtest.Equals(t, uint32(0100644), dir.files[0].Mode)
+	rtest.Equals(t, "b", dir.subdirs[0].info.Name)
+	rtest.Equals(t, uint32(040000), dir.subdirs[0].info.Mode&0170000)
+
+	// only the subfolder is exported
+	out = testRunLsWithOptions(t, env.gopts, LsOptions{Format: "ncdu"}, "latest:a/b")
+	rtest.OK(t, json.Unmarshal(out, &export))
+	root = parseNcduDir(t, export[3])
+	rtest.Equals(t, "a/b", root.info.Name)
+	rtest.Equals(t, uint64(900), root.size())
+}
@@ -90,3 +90,55 @@ func TestLsNodeJSON(t *testing.T) {
 		rtest.OK(t, err)
 	}
 }
+
+func TestLsDirStack(t *testing.T) {
+	var left []string
+	sizes := make(map[string]uint64)
+	stack := lsDirStack{
+		leave: func(dir *lsDir) error {
+			left = append(left, dir.path)
+			sizes[dir.path] = dir.size
+			return nil
+		},
+	}
+
+	for _, item := range []struct {
+		path string
+		node restic.Node
+	}{
+		{"/a", restic.Node{Type: "dir"}},
+		{"/a/b", restic.Node{Type: "dir"}},
+		{"/a/b/file", restic.Node{Type: "file", Size: 10}},
+		{"/a/link1", restic.Node{Type: "file", Size: 5, Links: 2, Inode: 42}},
+		{"/a/link2", restic.Node{Type: "file", Size: 5, Links: 2, Inode: 42}},
+		{"/ab", restic.Node{Type: "dir"}},
+		{"/ab/symlink", restic.Node{Type: "symlink", Size: 100}},
+	} {
+		rtest.OK(t, stack.visit(item.path))
+		if item.node.Type == "dir" {
+			stack.push(&lsDir{path: item.path})
+		} else {
+			stack.addFile(&item.node)
+		}
+	}
+	rtest.Equals(t, []string{"/a/b", "/a"}, left)
+	rtest.OK(t, stack.finish())
+
+	rtest.Equals(t, []string{"/a/b", "/a", "/ab"}, left)
+	rtest.Equals(t, map[string]uint64{"/a/b": 10, "/a": 15, "/ab": 0}, sizes)
+}
+
+func TestNcduMode(t *testing.T) {
+	for _, c := range []struct {
+		node restic.Node
+		mode uint32
+	}{
+		{restic.Node{Type: "file", Mode: 0644}, 0100644},
+		{restic.Node{Type: "dir", Mode: os.ModeDir | os.ModeSticky | 0777}, 041777},
+		{restic.Node{Type: "file", Mode: os.ModeSetuid | 0755}, 0104755},
+		{restic.Node{Type: "symlink", Mode: os.ModeSymlink | 0777}, 0120777},
+		{restic.Node{Type: "fifo", Mode: os.ModeNamedPipe | 0600}, 010600},
+	} {
+		rtest.Equals(t, c.mode, ncduMode(&c.node))
+	}
+}
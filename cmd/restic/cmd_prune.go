@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"math"
+	"os"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/crypto"
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/index"
@@ -57,6 +64,16 @@ type PruneOptions struct {
 	RepackCachableOnly bool
 	RepackSmall        bool
 	RepackUncompressed bool
+	RepackCold         bool
+	ThawInterval       time.Duration
+
+	PrioritizeDuplicates   bool
+	PrioritizeUncompressed bool
+
+	AppendOnly       bool
+	PendingDeletions string
+
+	RemoveMarkedSnapshots bool
 }
 
 var pruneOptions PruneOptions
@@ -76,6 +93,13 @@ func addPruneOptions(c *cobra.Command) {
 	f.BoolVar(&pruneOptions.RepackCachableOnly, "repack-cacheable-only", false, "only repack packs which are cacheable")
 	f.BoolVar(&pruneOptions.RepackSmall, "repack-small", false, "repack pack files below 80% of target pack size")
 	f.BoolVar(&pruneOptions.RepackUncompressed, "repack-uncompressed", false, "repack all uncompressed data")
+	f.BoolVar(&pruneOptions.PrioritizeDuplicates, "prioritize-duplicates", false, "repack pack files containing duplicate blobs first, only limited by --max-repack-size")
+	f.BoolVar(&pruneOptions.PrioritizeUncompressed, "prioritize-uncompressed", false, "repack pack files containing uncompressed blobs first, only limited by --max-repack-size")
+	f.BoolVar(&pruneOptions.RepackCold, "repack-cold", false, "also repack pack files in cold storage, their restore is requested first")
+	f.DurationVar(&pruneOptions.ThawInterval, "thaw-interval", defaultThawInterval, "with --repack-cold, check for restored pack files every `interval`")
+	f.BoolVar(&pruneOptions.AppendOnly, "append-only", false, "only add data to the repository and list the files which must be deleted later, this is used automatically if the repository does not allow deleting files")
+	f.StringVar(&pruneOptions.PendingDeletions, "pending-deletions", "", "write the list of files which could not be deleted as JSON to `file`")
+	f.BoolVar(&pruneOptions.RemoveMarkedSnapshots, "remove-marked-snapshots", false, "delete the snapshots which forget marked as removed because the repository did not allow deleting files")
 }
 
 func verifyPruneOptions(opts *PruneOptions) error {
@@ -90,6 +114,12 @@ func verifyPruneOptions(opts *PruneOptions) error {
 	if opts.UnsafeNoSpaceRecovery != "" {
 		// prevent repacking data to make sure users cannot get stuck.
 		opts.MaxRepackBytes = 0
+		if opts.AppendOnly {
+			return errors.Fatal("--unsafe-recover-no-free-space and --append-only are mutually exclusive")
+		}
+	}
+	if opts.AppendOnly && opts.RemoveMarkedSnapshots {
+		return errors.Fatal("--append-only and --remove-marked-snapshots are mutually exclusive")
 	}
 
 	maxUnused := strings.TrimSpace(opts.MaxUnused)
@@ -146,6 +176,9 @@ func runPrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions) error
 	if opts.RepackUncompressed && gopts.Compression == repository.CompressionOff {
 		return errors.Fatal("disabled compression and `--repack-uncompressed` are mutually exclusive")
 	}
+	if opts.PrioritizeUncompressed && gopts.Compression == repository.CompressionOff {
+		return errors.Fatal("disabled compression and `--prioritize-uncompressed` are mutually exclusive")
+	}
 
 	repo, err := OpenRepository(ctx, gopts)
 	if err != nil {
@@ -156,7 +189,7 @@ func runPrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions) error
 		return errors.Fatal("prune requires a backend connection limit of at least two")
 	}
 
-	if repo.Config().Version < 2 && opts.RepackUncompressed {
+	if repo.Config().Version < 2 && (opts.RepackUncompressed || opts.PrioritizeUncompressed) {
 		return errors.Fatal("compression requires at least repository format version 2")
 	}
 
@@ -178,8 +211,13 @@ func runPrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions) error
 }
 
 func runPruneWithRepo(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo *repository.Repository, ignoreSnapshots restic.IDSet) error {
-	// we do not need index updates while pruning!
-	repo.DisableAutoIndexUpdate()
+	// Repacked packs are indexed as soon as possible, such that an interrupted
+	// prune can be resumed: the next run finds the new packs instead of
+	// removing them as unreferenced. When recovering from a full repository, no
+	// index must be written before the old ones are deleted.
+	if opts.unsafeRecovery {
+		repo.DisableAutoIndexUpdate()
+	}
 
 	if repo.Cache == nil {
 		Print("warning: running prune without a cache, this may be very slow!\n")
@@ -192,6 +230,10 @@ func runPruneWithRepo(ctx context.Context, opts PruneOptions, gopts GlobalOption
 	if err != nil {
 		return err
 	}
+	if len(repo.SkippedIndexes()) > 0 {
+		// the packs of skipped index files would be removed as unreferenced
+		return errors.Fatal("prune cannot run with damaged index files, run 'restic repair index' first")
+	}
 
 	plan, stats, err := planPrune(ctx, opts, repo, ignoreSnapshots, gopts.Quiet)
 	if err != nil {
@@ -202,10 +244,17 @@ func runPruneWithRepo(ctx context.Context, opts PruneOptions, gopts GlobalOption
 		Verbosef("\nWould have made the following changes:")
 	}
 
-	err = printPruneStats(stats)
+	if gopts.JSON {
+		err = printJSONPruneStats(globalOptions.stdout, stats)
+	} else {
+		err = printPruneStats(opts, stats)
+	}
 	if err != nil {
 		return err
 	}
+	if repo.Config().MaxRepoSize > 0 {
+		printPruneQuota(repo.QuotaStatus(ctx), stats)
+	}
 
 	// Trigger GC to reset garbage collection threshold
 	runtime.GC()
@@ -231,6 +280,15 @@ type pruneStats struct {
 		repackrm     uint64
 		unref        uint64
 		uncompressed uint64
+
+		// stored size of the compressed data blobs and their size before compression
+		compressed    uint64
+		compressedRaw uint64
+	}
+	categories struct {
+		duplicate    pruneCategory
+		unused       pruneCategory // unused blobs which are not duplicates
+		uncompressed pruneCategory // used blobs which are stored uncompressed
 	}
 	packs struct {
 		used       uint
@@ -240,7 +298,33 @@ type pruneStats struct {
 		keep       uint
 		repack     uint
 		remove     uint
+		small      uint
+		smallMerge uint
+	}
+}
+
+// pruneCategory counts the blobs of a category of data which repacking can
+// improve and the blobs of the category which this prune handles.
+type pruneCategory struct {
+	blobs        uint
+	size         uint64
+	packs        uint
+	plannedBlobs uint
+	plannedSize  uint64
+}
+
+func (c *pruneCategory) add(blobs uint, size uint64) {
+	if blobs == 0 {
+		return
 	}
+	c.blobs += blobs
+	c.size += size
+	c.packs++
+}
+
+func (c *pruneCategory) plan(blobs uint, size uint64) {
+	c.plannedBlobs += blobs
+	c.plannedSize += size
 }
 
 type prunePlan struct {
@@ -249,6 +333,8 @@ type prunePlan struct {
 	keepBlobs        restic.CountedBlobSet // blobs to keep during repacking
 	removePacks      restic.IDSet          // packs to remove
 	ignorePacks      restic.IDSet          // packs to ignore when rebuilding the index
+	removeSnapshots  restic.IDSet          // snapshots marked as removed by tombstones
+	removeTombstones restic.IDSet          // tombstones to remove after the marked snapshots
 }
 
 type packInfo struct {
@@ -258,12 +344,20 @@ type packInfo struct {
 	unusedSize   uint64
 	tpe          restic.BlobType
 	uncompressed bool
+
+	// duplicate blobs are also counted as unused blobs
+	duplicateBlobs uint
+	duplicateSize  uint64
+	// uncompressed blobs are also counted as used blobs
+	uncompressedBlobs uint
+	uncompressedSize  uint64
 }
 
 type packInfoWithID struct {
 	ID restic.ID
 	packInfo
 	mustCompress bool
+	prioritized  bool
 }
 
 // planPrune selects which files to rewrite and which to delete and which blobs to keep.
@@ -271,7 +365,27 @@ type packInfoWithID struct {
 func planPrune(ctx context.Context, opts PruneOptions, repo restic.Repository, ignoreSnapshots restic.IDSet, quiet bool) (prunePlan, pruneStats, error) {
 	var stats pruneStats
 
-	usedBlobs, err := getUsedBlobs(ctx, repo, ignoreSnapshots, quiet)
+	snapshotLister, err := restic.MemorizeList(ctx, repo, restic.SnapshotFile)
+	if err != nil {
+		return prunePlan{}, stats, err
+	}
+	tombstones, err := restic.FindTombstones(ctx, snapshotLister, repo)
+	if err != nil {
+		return prunePlan{}, stats, err
+	}
+	var keepSnapshots restic.IDSet
+	if len(tombstones.Marked) > 0 {
+		if opts.RemoveMarkedSnapshots {
+			Verbosef("removing %d snapshots marked as removed by %d tombstones:\n", len(tombstones.Marked), len(tombstones.IDs))
+			printMarkedSnapshots(ctx, repo, tombstones.Marked)
+		} else {
+			// the marked snapshots remain in the repository, so must their data
+			Verbosef("keeping %d snapshots marked as removed by %d tombstones, use --remove-marked-snapshots to remove them\n", len(tombstones.Marked), len(tombstones.IDs))
+			keepSnapshots = tombstones.Marked
+		}
+	}
+
+	usedBlobs, err := getUsedBlobs(ctx, repo, snapshotLister, ignoreSnapshots, keepSnapshots, quiet)
 	if err != nil {
 		return prunePlan{}, stats, err
 	}
@@ -308,6 +422,10 @@ func planPrune(ctx context.Context, opts PruneOptions, repo restic.Repository, i
 		keepBlobs = nil
 	}
 	plan.keepBlobs = keepBlobs
+	if opts.RemoveMarkedSnapshots {
+		plan.removeSnapshots = tombstones.Marked
+		plan.removeTombstones = tombstones.IDs
+	}
 
 	return plan, stats, nil
 }
@@ -381,6 +499,8 @@ func packInfoFromIndex(ctx context.Context, idx restic.MasterIndex, usedBlobs re
 			// mark as unused for now, we will later on select one copy
 			ip.unusedSize += size
 			ip.unusedBlobs++
+			ip.duplicateSize += size
+			ip.duplicateBlobs++
 
 			// count as duplicate, will later on change one copy to be counted as used
 			stats.size.duplicate += size
@@ -388,6 +508,10 @@ func packInfoFromIndex(ctx context.Context, idx restic.MasterIndex, usedBlobs re
 		case dupCount == 1: // used blob, not duplicate
 			ip.usedSize += size
 			ip.usedBlobs++
+			if !blob.IsCompressed() {
+				ip.uncompressedSize += size
+				ip.uncompressedBlobs++
+			}
 
 			stats.size.used += size
 			stats.blobs.used++
@@ -400,6 +524,9 @@ func packInfoFromIndex(ctx context.Context, idx restic.MasterIndex, usedBlobs re
 		}
 		if !blob.IsCompressed() {
 			ip.uncompressed = true
+		} else if blob.Type == restic.DataBlob {
+			stats.size.compressed += size
+			stats.size.compressedRaw += uint64(crypto.CiphertextLength(int(blob.DataLength())))
 		}
 		// update indexPack
 		indexPack[blob.PackID] = ip
@@ -429,6 +556,12 @@ func packInfoFromIndex(ctx context.Context, idx restic.MasterIndex, usedBlobs re
 				ip.usedBlobs++
 				ip.unusedSize -= size
 				ip.unusedBlobs--
+				ip.duplicateSize -= size
+				ip.duplicateBlobs--
+				if !blob.IsCompressed() {
+					ip.uncompressedSize += size
+					ip.uncompressedBlobs++
+				}
 				// same for the global statistics
 				stats.size.used += size
 				stats.blobs.used++
@@ -470,6 +603,7 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 	var repackCandidates []packInfoWithID
 	var repackSmallCandidates []packInfoWithID
 	repoVersion := repo.Config().Version
+	cold := backend.AsBackend[backend.ColdStorageBackend](repo.Backend())
 	// only repack very small files by default
 	targetPackSize := repo.PackSize() / 25
 	if opts.RepackSmall {
@@ -499,6 +633,9 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 		}
 
 		// statistics
+		if p.usedBlobs != 0 && packSize < int64(targetPackSize) {
+			stats.packs.small++
+		}
 		switch {
 		case p.usedBlobs == 0:
 			stats.packs.unused++
@@ -511,12 +648,18 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 		if p.uncompressed {
 			stats.size.uncompressed += p.unusedSize + p.usedSize
 		}
+		stats.categories.duplicate.add(p.duplicateBlobs, p.duplicateSize)
+		stats.categories.unused.add(p.unusedBlobs-p.duplicateBlobs, p.unusedSize-p.duplicateSize)
+		stats.categories.uncompressed.add(p.uncompressedBlobs, p.uncompressedSize)
+
 		mustCompress := false
 		if repoVersion >= 2 {
 			// repo v2: always repack tree blobs if uncompressed
 			// compress data blobs if requested
 			mustCompress = (p.tpe == restic.TreeBlob || opts.RepackUncompressed) && p.uncompressed
 		}
+		prioritized := (opts.PrioritizeDuplicates && p.duplicateBlobs > 0) ||
+			(opts.PrioritizeUncompressed && repoVersion >= 2 && p.uncompressedBlobs > 0)
 
 		// decide what to do
 		switch {
@@ -525,22 +668,28 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 			removePacks.Insert(id)
 			stats.blobs.remove += p.unusedBlobs
 			stats.size.remove += p.unusedSize
+			stats.categories.duplicate.plan(p.duplicateBlobs, p.duplicateSize)
+			stats.categories.unused.plan(p.unusedBlobs-p.duplicateBlobs, p.unusedSize-p.duplicateSize)
+
+		case cold != nil && !opts.RepackCold && cold.ColdFile(backend.Handle{Type: restic.PackFile, Name: id.String(), IsMetadata: p.tpe != restic.DataBlob}):
+			// pack is in cold storage and --repack-cold is not set => keep pack!
+			stats.packs.keep++
 
 		case opts.RepackCachableOnly && p.tpe == restic.DataBlob:
 			// if this is a data pack and --repack-cacheable-only is set => keep pack!
 			stats.packs.keep++
 
-		case p.unusedBlobs == 0 && p.tpe != restic.InvalidBlob && !mustCompress:
+		case p.unusedBlobs == 0 && p.tpe != restic.InvalidBlob && !mustCompress && !prioritized:
 			if packSize >= int64(targetPackSize) {
 				// All blobs in pack are used and not mixed => keep pack!
 				stats.packs.keep++
 			} else {
-				repackSmallCandidates = append(repackSmallCandidates, packInfoWithID{ID: id, packInfo: p, mustCompress: mustCompress})
+				repackSmallCandidates = append(repackSmallCandidates, packInfoWithID{ID: id, packInfo: p, mustCompress: mustCompress, prioritized: prioritized})
 			}
 
 		default:
 			// all other packs are candidates for repacking
-			repackCandidates = append(repackCandidates, packInfoWithID{ID: id, packInfo: p, mustCompress: mustCompress})
+			repackCandidates = append(repackCandidates, packInfoWithID{ID: id, packInfo: p, mustCompress: mustCompress, prioritized: prioritized})
 		}
 
 		delete(indexPack, id)
@@ -591,7 +740,7 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 	// This is equivalent to sorting by unused / total space.
 	// Instead of unused[i] / used[i] > unused[j] / used[j] we use
 	// unused[i] * used[j] > unused[j] * used[i] as uint32*uint32 < uint64
-	// Moreover packs containing trees and too small packs are sorted to the beginning
+	// Moreover packs containing trees, prioritized and too small packs are sorted to the beginning
 	sort.Slice(repackCandidates, func(i, j int) bool {
 		pi := repackCandidates[i].packInfo
 		pj := repackCandidates[j].packInfo
@@ -600,6 +749,10 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 			return true
 		case pj.tpe != restic.DataBlob && pi.tpe == restic.DataBlob:
 			return false
+		case repackCandidates[i].prioritized && !repackCandidates[j].prioritized:
+			return true
+		case repackCandidates[j].prioritized && !repackCandidates[i].prioritized:
+			return false
 		case pi.unusedSize+pi.usedSize < uint64(targetPackSize) && pj.unusedSize+pj.usedSize >= uint64(targetPackSize):
 			return true
 		case pj.unusedSize+pj.usedSize < uint64(targetPackSize) && pi.unusedSize+pi.usedSize >= uint64(targetPackSize):
@@ -617,6 +770,12 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 		if p.uncompressed {
 			stats.size.uncompressed -= p.unusedSize + p.usedSize
 		}
+		if p.unusedSize+p.usedSize < uint64(targetPackSize) {
+			stats.packs.smallMerge++
+		}
+		stats.categories.duplicate.plan(p.duplicateBlobs, p.duplicateSize)
+		stats.categories.unused.plan(p.unusedBlobs-p.duplicateBlobs, p.unusedSize-p.duplicateSize)
+		stats.categories.uncompressed.plan(p.uncompressedBlobs, p.uncompressedSize)
 	}
 
 	// calculate limit for number of unused bytes in the repo after repacking
@@ -631,8 +790,8 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 		case reachedRepackSize:
 			stats.packs.keep++
 
-		case p.tpe != restic.DataBlob, p.mustCompress:
-			// repacking non-data packs / uncompressed-trees is only limited by repackSize
+		case p.tpe != restic.DataBlob, p.mustCompress, p.prioritized:
+			// repacking non-data packs / uncompressed-trees / prioritized packs is only limited by repackSize
 			repack(p.ID, p.packInfo)
 
 		case reachedUnusedSizeAfter && packIsLargeEnough:
@@ -651,6 +810,7 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 	if repo.Config().Version < 2 {
 		// compression not supported for repository format version 1
 		stats.size.uncompressed = 0
+		stats.categories.uncompressed = pruneCategory{}
 	}
 
 	return prunePlan{removePacksFirst: removePacksFirst,
@@ -660,8 +820,22 @@ func decidePackAction(ctx context.Context, opts PruneOptions, repo restic.Reposi
 	}, nil
 }
 
+// printPruneQuota prints how far the repository is over or under its size
+// limit before and after pruning.
+func printPruneQuota(status repository.QuotaStatus, stats pruneStats) {
+	after := status
+	// unreferenced packs are not contained in the size from the index
+	if pruned := stats.size.remove + stats.size.repackrm; pruned < after.Size {
+		after.Size -= pruned
+	} else {
+		after.Size = 0
+	}
+	Verbosef("size limit:   %s, currently %s, after prune %s\n\n",
+		ui.FormatBytes(status.Limit), formatQuotaDistance(status), formatQuotaDistance(after))
+}
+
 // printPruneStats prints out the statistics
-func printPruneStats(stats pruneStats) error {
+func printPruneStats(opts PruneOptions, stats pruneStats) error {
 	Verboseff("\nused:         %10d blobs / %s\n", stats.blobs.used, ui.FormatBytes(stats.size.used))
 	if stats.blobs.duplicate > 0 {
 		Verboseff("duplicates:   %10d blobs / %s\n", stats.blobs.duplicate, ui.FormatBytes(stats.size.duplicate))
@@ -684,11 +858,13 @@ func printPruneStats(stats pruneStats) error {
 	if stats.size.uncompressed > 0 {
 		Verbosef("not yet compressed:              %s\n", ui.FormatBytes(stats.size.uncompressed))
 	}
+	printCompressionProgress(opts, stats)
 	Verbosef("remaining:    %10d blobs / %s\n", totalBlobs-(stats.blobs.remove+stats.blobs.repackrm), ui.FormatBytes(totalSize-totalPruneSize))
 	unusedAfter := unusedSize - stats.size.remove - stats.size.repackrm
 	Verbosef("unused size after prune: %s (%s of remaining size)\n",
 		ui.FormatBytes(unusedAfter), ui.FormatPercent(unusedAfter, totalSize-totalPruneSize))
 	Verbosef("\n")
+	printPruneCategories(stats)
 	Verboseff("totally used packs: %10d\n", stats.packs.used)
 	Verboseff("partly used packs:  %10d\n", stats.packs.partlyUsed)
 	Verboseff("unused packs:       %10d\n\n", stats.packs.unused)
@@ -696,12 +872,149 @@ func printPruneStats(stats pruneStats) error {
 	Verboseff("to keep:      %10d packs\n", stats.packs.keep)
 	Verboseff("to repack:    %10d packs\n", stats.packs.repack)
 	Verboseff("to delete:    %10d packs\n", stats.packs.remove)
+	if stats.packs.small > 0 {
+		Verbosef("small packs:  %10d packs, %d of them will be merged\n", stats.packs.small, stats.packs.smallMerge)
+	}
 	if stats.packs.unref > 0 {
 		Verboseff("to delete:    %10d unreferenced packs\n\n", stats.packs.unref)
 	}
 	return nil
 }
 
+// compressionSavings estimates how much space compressing size bytes of
+// uncompressed data saves, assuming that it compresses like the already
+// compressed data. It returns false if no data is compressed yet.
+func compressionSavings(stats pruneStats, size uint64) (uint64, bool) {
+	raw, compressed := stats.size.compressedRaw, stats.size.compressed
+	if raw <= compressed {
+		return 0, false
+	}
+	ratio := float64(raw-compressed) / float64(raw)
+	return uint64(ratio * float64(size)), true
+}
+
+// printPruneCategories prints a table of the data which repacking can
+// improve. The space recovered by compressing data can only be estimated.
+func printPruneCategories(stats pruneStats) {
+	c := stats.categories
+	if c.duplicate.blobs+c.unused.blobs+c.uncompressed.blobs == 0 {
+		return
+	}
+
+	Verbosef("%-13s %10s %12s %7s %13s %13s\n", "category", "blobs", "size", "packs", "recoverable", "this prune")
+	row := func(name string, cat pruneCategory, recoverable, planned string) {
+		if cat.blobs == 0 {
+			return
+		}
+		Verbosef("%-13s %10d %12s %7d %13s %13s\n", name, cat.blobs, ui.FormatBytes(cat.size), cat.packs, recoverable, planned)
+	}
+	row("duplicate", c.duplicate, ui.FormatBytes(c.duplicate.size), ui.FormatBytes(c.duplicate.plannedSize))
+	row("unused", c.unused, ui.FormatBytes(c.unused.size), ui.FormatBytes(c.unused.plannedSize))
+
+	recoverable, planned := "unknown", "unknown"
+	if saved, ok := compressionSavings(stats, c.uncompressed.size); ok {
+		recoverable = "~" + ui.FormatBytes(saved)
+		saved, _ = compressionSavings(stats, c.uncompressed.plannedSize)
+		planned = "~" + ui.FormatBytes(saved)
+	}
+	row("uncompressed", c.uncompressed, recoverable, planned)
+	Verbosef("\n")
+}
+
+// PruneCategoryStats describes a category of data which repacking can improve.
+type PruneCategoryStats struct {
+	Blobs uint   `json:"blobs"`
+	Size  uint64 `json:"size"`
+	Packs uint   `json:"packs"`
+	// RecoverableSize is the space freed by repacking all packs of the category.
+	RecoverableSize uint64 `json:"recoverable_size"`
+	PlannedBlobs    uint   `json:"planned_blobs"`
+	// PlannedSize is the space freed by this prune.
+	PlannedSize uint64 `json:"planned_size"`
+	// Estimated is set if the sizes are estimated, which is the case for the
+	// space saved by compressing data.
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// PruneStats are the statistics of the prune plan printed with --json.
+type PruneStats struct {
+	UsedBlobs        uint   `json:"used_blobs"`
+	UsedSize         uint64 `json:"used_size"`
+	DuplicateBlobs   uint   `json:"duplicate_blobs"`
+	DuplicateSize    uint64 `json:"duplicate_size"`
+	UnusedBlobs      uint   `json:"unused_blobs"`
+	UnusedSize       uint64 `json:"unused_size"`
+	UnreferencedSize uint64 `json:"unreferenced_size"`
+	RepackBlobs      uint   `json:"repack_blobs"`
+	RepackSize       uint64 `json:"repack_size"`
+	RemoveBlobs      uint   `json:"remove_blobs"`
+	RemoveSize       uint64 `json:"remove_size"`
+	UncompressedSize uint64 `json:"uncompressed_size"`
+
+	Duplicate    PruneCategoryStats `json:"duplicate"`
+	Unused       PruneCategoryStats `json:"unused"`
+	Uncompressed PruneCategoryStats `json:"uncompressed"`
+}
+
+func printJSONPruneStats(stdout io.Writer, stats pruneStats) error {
+	category := func(c pruneCategory) PruneCategoryStats {
+		return PruneCategoryStats{
+			Blobs:           c.blobs,
+			Size:            c.size,
+			Packs:           c.packs,
+			RecoverableSize: c.size,
+			PlannedBlobs:    c.plannedBlobs,
+			PlannedSize:     c.plannedSize,
+		}
+	}
+	uncompressed := category(stats.categories.uncompressed)
+	uncompressed.RecoverableSize, _ = compressionSavings(stats, uncompressed.Size)
+	uncompressed.PlannedSize, _ = compressionSavings(stats, uncompressed.PlannedSize)
+	uncompressed.Estimated = true
+
+	return json.NewEncoder(stdout).Encode(PruneStats{
+		UsedBlobs:        stats.blobs.used,
+		UsedSize:         stats.size.used,
+		DuplicateBlobs:   stats.blobs.duplicate,
+		DuplicateSize:    stats.size.duplicate,
+		UnusedBlobs:      stats.blobs.unused,
+		UnusedSize:       stats.size.unused,
+		UnreferencedSize: stats.size.unref,
+		RepackBlobs:      stats.blobs.repack,
+		RepackSize:       stats.size.repack,
+		RemoveBlobs:      stats.blobs.remove + stats.blobs.repackrm,
+		RemoveSize:       stats.size.remove + stats.size.repackrm + stats.size.unref,
+		UncompressedSize: stats.size.uncompressed,
+
+		Duplicate:    category(stats.categories.duplicate),
+		Unused:       category(stats.categories.unused),
+		Uncompressed: uncompressed,
+	})
+}
+
+// printCompressionProgress prints the space saved by compressing data blobs so
+// far and estimates how much compressing the remaining data saves. Each run of prune
+// with --repack-uncompressed continues where the previous one stopped, as the
+// progress is derived from the index.
+func printCompressionProgress(opts PruneOptions, stats pruneStats) {
+	raw, compressed := stats.size.compressedRaw, stats.size.compressed
+	if raw > compressed {
+		Verbosef("saved by compression:            %s (%s of compressed data)\n",
+			ui.FormatBytes(raw-compressed), ui.FormatPercent(raw-compressed, raw))
+	}
+	if stats.size.uncompressed == 0 {
+		return
+	}
+
+	if saved, ok := compressionSavings(stats, stats.size.uncompressed); ok {
+		Verbosef("estimated savings for the rest:  %s\n", ui.FormatBytes(saved))
+	}
+	if opts.RepackUncompressed && opts.MaxRepackBytes > 0 && opts.MaxRepackBytes != math.MaxUint64 {
+		runs := (stats.size.uncompressed + opts.MaxRepackBytes - 1) / opts.MaxRepackBytes
+		Verbosef("compressing the rest requires about %d more runs with --max-repack-size %v\n", runs, opts.MaxRepackSize)
+	}
+}
+
 // doPrune does the actual pruning:
 // - remove unreferenced packs first
 // - repack given pack files while keeping the given blobs
@@ -717,15 +1030,41 @@ func doPrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo r
 			}
 			Printf("Would have repacked and removed the following packs:\n%v\n\n", plan.repackPacks)
 			Printf("Would have removed the following no longer used packs:\n%v\n\n", plan.removePacks)
+			if len(plan.removeTombstones) > 0 {
+				Printf("Would have removed the following snapshots marked as removed:\n%v\n\n", plan.removeSnapshots)
+				Printf("Would have removed the following tombstones:\n%v\n\n", plan.removeTombstones)
+			}
 		}
 		// Always quit here if DryRun was set!
 		return nil
 	}
 
+	d := pruneDeleter{appendOnly: opts.AppendOnly}
+
+	// the marked snapshots are removed before their data, such that a
+	// remaining snapshot never references removed data
+	if len(plan.removeSnapshots) != 0 {
+		Verbosef("removing %d snapshots marked as removed\n", len(plan.removeSnapshots))
+		forbidden, err := DeleteFilesChecked(ctx, gopts, repo, plan.removeSnapshots, restic.SnapshotFile)
+		if err != nil {
+			return errors.Fatalf("%s", err)
+		}
+		if len(forbidden) != 0 {
+			return errors.Fatal("the repository does not allow deleting the snapshots marked as removed, run prune without --remove-marked-snapshots")
+		}
+	}
+
 	// unreferenced packs can be safely deleted first
 	if len(plan.removePacksFirst) != 0 {
 		Verbosef("deleting unreferenced packs\n")
-		DeleteFiles(ctx, gopts, repo, plan.removePacksFirst, restic.PackFile)
+		_ = d.deleteFiles(ctx, gopts, repo, plan.removePacksFirst, restic.PackFile, true)
+	}
+
+	if len(plan.repackPacks) != 0 && opts.RepackCold {
+		err := thawPacks(ctx, repo, plan.repackPacks.List(), thawOptions{Thaw: true, ThawInterval: opts.ThawInterval}, gopts)
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(plan.repackPacks) != 0 {
@@ -761,12 +1100,21 @@ func doPrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo r
 	if opts.unsafeRecovery {
 		Verbosef("deleting index files\n")
 		indexFiles := repo.Index().(*index.MasterIndex).IDs()
-		err = DeleteFilesChecked(ctx, gopts, repo, indexFiles, restic.IndexFile)
+		forbidden, err := DeleteFilesChecked(ctx, gopts, repo, indexFiles, restic.IndexFile)
 		if err != nil {
 			return errors.Fatalf("%s", err)
 		}
+		if len(forbidden) != 0 {
+			return errors.Fatal("the repository does not allow deleting the index files")
+		}
 	} else if len(plan.ignorePacks) != 0 {
-		err = rebuildIndexFiles(ctx, gopts, repo, plan.ignorePacks, nil)
+		obsoleteIndexes, err := writeIndexFiles(ctx, gopts, repo, plan.ignorePacks, nil)
+		if err != nil {
+			return errors.Fatalf("%s", err)
+		}
+
+		Verbosef("deleting obsolete index files\n")
+		err = d.deleteFiles(ctx, gopts, repo, obsoleteIndexes, restic.IndexFile, false)
 		if err != nil {
 			return errors.Fatalf("%s", err)
 		}
@@ -774,7 +1122,16 @@ func doPrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo r
 
 	if len(plan.removePacks) != 0 {
 		Verbosef("removing %d old packs\n", len(plan.removePacks))
-		DeleteFiles(ctx, gopts, repo, plan.removePacks, restic.PackFile)
+		_ = d.deleteFiles(ctx, gopts, repo, plan.removePacks, restic.PackFile, true)
+	}
+
+	if len(plan.removeTombstones) != 0 {
+		// tombstones are only removed after all marked snapshots, otherwise
+		// the snapshots would reappear
+		err = d.deleteFiles(ctx, gopts, repo, plan.removeTombstones, restic.SnapshotFile, false)
+		if err != nil {
+			return errors.Fatalf("%s", err)
+		}
 	}
 
 	if opts.unsafeRecovery {
@@ -784,10 +1141,99 @@ func doPrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo r
 		}
 	}
 
+	if !d.appendOnly {
+		// each backup using a write-only key stores a session key
+		moved, err := repository.FoldSessionKeys(ctx, repo.(*repository.Repository))
+		if err != nil {
+			Warnf("unable to move session keys into a session list: %v\n", err)
+		} else if moved > 0 {
+			Verbosef("moved %d session keys into a session list\n", moved)
+		}
+	}
+
+	if d.appendOnly {
+		err = printPendingDeletions(opts, d.pending)
+		if err != nil {
+			return err
+		}
+	}
+
 	Verbosef("done\n")
 	return nil
 }
 
+// pendingDeletions lists the files which must be deleted by a client with the
+// permission to do so. The fields are named after the directories of the
+// repository which contain the files.
+type pendingDeletions struct {
+	Snapshots restic.IDs `json:"snapshots"`
+	Index     restic.IDs `json:"index"`
+	Data      restic.IDs `json:"data"`
+}
+
+func (p *pendingDeletions) add(ids restic.IDSet, t restic.FileType) {
+	switch t {
+	case restic.SnapshotFile:
+		p.Snapshots = append(p.Snapshots, ids.List()...)
+	case restic.IndexFile:
+		p.Index = append(p.Index, ids.List()...)
+	case restic.PackFile:
+		p.Data = append(p.Data, ids.List()...)
+	default:
+		panic(fmt.Sprintf("unexpected file type %v", t))
+	}
+}
+
+func (p *pendingDeletions) len() int {
+	return len(p.Snapshots) + len(p.Index) + len(p.Data)
+}
+
+// pruneDeleter deletes files until the repository refuses to delete one, from
+// then on prune only adds data and collects the files to delete as pending.
+type pruneDeleter struct {
+	appendOnly bool
+	pending    pendingDeletions
+}
+
+// deleteFiles deletes the files or records them as pending. If ignoreError is
+// set, errors other than a forbidden deletion only result in a warning.
+func (d *pruneDeleter) deleteFiles(ctx context.Context, gopts GlobalOptions, repo restic.Repository, ids restic.IDSet, t restic.FileType, ignoreError bool) error {
+	if d.appendOnly {
+		d.pending.add(ids, t)
+		return nil
+	}
+
+	forbidden, err := deleteFiles(ctx, gopts, ignoreError, repo, ids, t)
+	if len(forbidden) != 0 {
+		Warnf("the repository does not allow deleting files, continuing without deleting files\n")
+		d.appendOnly = true
+		d.pending.add(forbidden, t)
+	}
+	return err
+}
+
+func printPendingDeletions(opts PruneOptions, pending pendingDeletions) error {
+	if pending.len() == 0 {
+		return nil
+	}
+	Printf("%d files could not be deleted, they must be removed by running prune with the permission to delete files:\n", pending.len())
+	Printf("  %d snapshot files, %d index files, %d pack files\n", len(pending.Snapshots), len(pending.Index), len(pending.Data))
+
+	if opts.PendingDeletions == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(opts.PendingDeletions, append(buf, '\n'), 0600)
+	if err != nil {
+		return errors.Fatalf("unable to write list of pending deletions: %v", err)
+	}
+	Verbosef("wrote list of pending deletions to %v\n", opts.PendingDeletions)
+	return nil
+}
+
 func writeIndexFiles(ctx context.Context, gopts GlobalOptions, repo restic.Repository, removePacks restic.IDSet, extraObsolete restic.IDs) (restic.IDSet, error) {
 	Verbosef("rebuilding index\n")
 
@@ -804,13 +1250,36 @@ func rebuildIndexFiles(ctx context.Context, gopts GlobalOptions, repo restic.Rep
 	}
 
 	Verbosef("deleting obsolete index files\n")
-	return DeleteFilesChecked(ctx, gopts, repo, obsoleteIndexes, restic.IndexFile)
+	forbidden, err := DeleteFilesChecked(ctx, gopts, repo, obsoleteIndexes, restic.IndexFile)
+	if err != nil {
+		return err
+	}
+	if len(forbidden) != 0 {
+		return errors.Fatalf("the repository does not allow deleting %d obsolete index files", len(forbidden))
+	}
+	return nil
 }
 
-func getUsedBlobs(ctx context.Context, repo restic.Repository, ignoreSnapshots restic.IDSet, quiet bool) (usedBlobs restic.CountedBlobSet, err error) {
+// printMarkedSnapshots prints the snapshots which are marked as removed by
+// tombstones.
+func printMarkedSnapshots(ctx context.Context, repo restic.Repository, ids restic.IDSet) {
+	for _, id := range ids.List() {
+		sn, err := restic.LoadSnapshot(ctx, repo, id)
+		if err != nil {
+			Verbosef("  %v (unable to load: %v)\n", id.Str(), err)
+			continue
+		}
+		Verbosef("  %v\n", sn)
+	}
+}
+
+// getUsedBlobs returns the blobs used by all snapshots except ignoreSnapshots.
+// The snapshots in keepSnapshots are included even if they are marked as
+// removed by a tombstone.
+func getUsedBlobs(ctx context.Context, repo restic.Repository, snapshotLister restic.Lister, ignoreSnapshots restic.IDSet, keepSnapshots restic.IDSet, quiet bool) (usedBlobs restic.CountedBlobSet, err error) {
 	var snapshotTrees restic.IDs
 	Verbosef("loading all snapshots...\n")
-	err = restic.ForAllSnapshots(ctx, repo, repo, ignoreSnapshots,
+	err = restic.ForAllSnapshots(ctx, snapshotLister, repo, ignoreSnapshots,
 		func(id restic.ID, sn *restic.Snapshot, err error) error {
 			if err != nil {
 				debug.Log("failed to load snapshot %v (error %v)", id, err)
@@ -823,6 +1292,17 @@ func getUsedBlobs(ctx context.Context, repo restic.Repository, ignoreSnapshots r
 	if err != nil {
 		return nil, errors.Fatalf("failed loading snapshot: %v", err)
 	}
+	for id := range keepSnapshots {
+		if ignoreSnapshots.Has(id) {
+			continue
+		}
+		sn, err := restic.LoadSnapshot(ctx, repo, id)
+		if err != nil {
+			return nil, errors.Fatalf("failed loading snapshot: %v", err)
+		}
+		debug.Log("add snapshot %v marked as removed (tree %v)", id, *sn.Tree)
+		snapshotTrees = append(snapshotTrees, *sn.Tree)
+	}
 
 	Verbosef("finding data that is still in use for %d snapshots\n", len(snapshotTrees))
 
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
 	rtest "github.com/restic/restic/internal/test"
 )
 
@@ -219,3 +228,402 @@ func testEdgeCaseRepo(t *testing.T, tarfile string, optionsCheck CheckOptions, o
 			"prune should have reported an error")
 	}
 }
+
+func testRunPruneJSON(t testing.TB, gopts GlobalOptions, opts PruneOptions) PruneStats {
+	buf, err := withCaptureStdout(func() error {
+		gopts.JSON = true
+		gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) { return newListOnceBackend(r), nil }
+		globalOptions.verbosity = 0
+		return runPrune(context.TODO(), opts, gopts)
+	})
+	rtest.OK(t, err)
+
+	var stats PruneStats
+	rtest.OK(t, json.Unmarshal(buf.Bytes(), &stats))
+	return stats
+}
+
+func TestPruneDuplicateStats(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	datafile := filepath.Join("testdata", "repo-duplicates.tar.gz")
+	rtest.SetupTarTestFixture(t, env.base, datafile)
+
+	opts := PruneOptions{MaxUnused: "unlimited", DryRun: true}
+	stats := testRunPruneJSON(t, env.gopts, opts)
+	rtest.Assert(t, stats.DuplicateBlobs > 0, "no duplicates found")
+	rtest.Equals(t, stats.DuplicateBlobs, stats.Duplicate.Blobs)
+	rtest.Equals(t, stats.DuplicateSize, stats.Duplicate.Size)
+	rtest.Equals(t, stats.DuplicateSize, stats.Duplicate.RecoverableSize)
+	rtest.Assert(t, stats.Duplicate.Packs > 0, "no packs with duplicates found")
+
+	// duplicates are repacked regardless of --max-unused
+	opts.PrioritizeDuplicates = true
+	stats = testRunPruneJSON(t, env.gopts, opts)
+	rtest.Equals(t, stats.Duplicate.Blobs, stats.Duplicate.PlannedBlobs)
+	rtest.Equals(t, stats.Duplicate.Size, stats.Duplicate.PlannedSize)
+
+	opts.DryRun = false
+	testRunPrune(t, env.gopts, opts)
+	stats = testRunPruneJSON(t, env.gopts, PruneOptions{MaxUnused: "unlimited", DryRun: true})
+	rtest.Equals(t, uint(0), stats.DuplicateBlobs)
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true, CheckUnused: true}, env.gopts, nil))
+}
+
+// retainingBackend protects all data and snapshot files against deletion.
+type retainingBackend struct {
+	backend.Backend
+}
+
+func (be *retainingBackend) Remove(ctx context.Context, h backend.Handle) error {
+	if h.Type == restic.PackFile || h.Type == restic.SnapshotFile {
+		return errors.Wrapf(backend.ErrRetained, "Remove(%v)", h)
+	}
+	return be.Backend.Remove(ctx, h)
+}
+
+func (be *retainingBackend) Retention(_ context.Context, h backend.Handle) (backend.Retention, error) {
+	if h.Type == restic.PackFile || h.Type == restic.SnapshotFile {
+		return backend.Retention{Mode: "compliance", Until: time.Now().Add(time.Hour)}, nil
+	}
+	return backend.Retention{}, nil
+}
+
+// indexFailBackend fails to save index files once the given number of index
+// files were saved.
+type indexFailBackend struct {
+	backend.Backend
+	m     sync.Mutex
+	saves int
+}
+
+func (be *indexFailBackend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	if h.Type == restic.IndexFile {
+		be.m.Lock()
+		be.saves--
+		fail := be.saves < 0
+		be.m.Unlock()
+		if fail {
+			return errors.New("index upload failed")
+		}
+	}
+	return be.Backend.Save(ctx, h, rd)
+}
+
+func TestPruneResumeRepackSmall(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+	// every backup adds a small data pack
+	for i := 0; i < 12; i++ {
+		dir := filepath.Join(env.testdata, fmt.Sprint(i))
+		rtest.OK(t, os.MkdirAll(dir, 0755))
+		rtest.OK(t, os.WriteFile(filepath.Join(dir, "file"), rtest.Random(i, 100*1024), 0644))
+		testRunBackup(t, "", []string{dir}, BackupOptions{}, env.gopts)
+	}
+	packsBefore := listPacks(env.gopts, t)
+
+	// prune is interrupted as it cannot rebuild the index after repacking
+	gopts := env.gopts
+	gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return newListOnceBackend(&indexFailBackend{Backend: r, saves: 1}), nil
+	}
+	opts := PruneOptions{MaxUnused: "unlimited", RepackSmall: true}
+	rtest.Assert(t, runPrune(context.TODO(), opts, gopts) != nil, "missing error")
+
+	// the new packs are already indexed
+	repo, err := OpenRepository(context.TODO(), env.gopts)
+	rtest.OK(t, err)
+	rtest.OK(t, repo.LoadIndex(context.TODO(), nil))
+	indexed := restic.NewIDSet()
+	repo.Index().Each(context.TODO(), func(pb restic.PackedBlob) {
+		indexed.Insert(pb.PackID)
+	})
+	packsInterrupted := listPacks(env.gopts, t)
+	rtest.Assert(t, len(packsInterrupted) > len(packsBefore), "no packs were repacked")
+	for id := range packsInterrupted {
+		rtest.Assert(t, indexed.Has(id), "pack %v is not indexed", id.Str())
+	}
+
+	testRunPrune(t, env.gopts, opts)
+	rtest.Assert(t, len(listPacks(env.gopts, t)) < len(packsBefore), "small packs were not merged")
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true, CheckUnused: true}, env.gopts, nil))
+}
+
+func TestPruneRetainedPacks(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	createPrunableRepo(t, env)
+	packsBefore := listPacks(env.gopts, t)
+
+	// deleting the packs is deferred, prune still succeeds
+	gopts := env.gopts
+	gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return newListOnceBackend(&retainingBackend{Backend: r}), nil
+	}
+	rtest.OK(t, runPrune(context.TODO(), PruneOptions{MaxUnused: "0%"}, gopts))
+	packsAfter := listPacks(env.gopts, t)
+	for id := range packsBefore {
+		rtest.Assert(t, packsAfter.Has(id), "retained pack %v was removed", id.Str())
+	}
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true}, env.gopts, nil))
+
+	// the packs are removed once they are no longer retained
+	testRunPrune(t, env.gopts, PruneOptions{MaxUnused: "0%"})
+	rtest.Assert(t, len(listPacks(env.gopts, t)) < len(packsBefore), "unused packs were not removed")
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true, CheckUnused: true}, env.gopts, nil))
+}
+
+// forbidDeleteBackend refuses to delete any files except locks, like a
+// rest-server in append-only mode.
+type forbidDeleteBackend struct {
+	backend.Backend
+}
+
+var errDeletionForbidden = errors.New("deletion forbidden")
+
+func (be *forbidDeleteBackend) Remove(ctx context.Context, h backend.Handle) error {
+	if h.Type != restic.LockFile {
+		return errors.Wrapf(errDeletionForbidden, "Remove(%v)", h)
+	}
+	return be.Backend.Remove(ctx, h)
+}
+
+func (be *forbidDeleteBackend) IsDeletionForbidden(err error) bool {
+	return errors.Is(err, errDeletionForbidden)
+}
+
+func testLoadSnapshots(t testing.TB, gopts GlobalOptions) restic.Snapshots {
+	repo, err := OpenRepository(context.TODO(), gopts)
+	rtest.OK(t, err)
+	snapshots, err := restic.TestLoadAllSnapshots(context.TODO(), repo, nil)
+	rtest.OK(t, err)
+	return snapshots
+}
+
+func TestPruneAppendOnly(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	createPrunableRepo(t, env)
+	packsBefore := listPacks(env.gopts, t)
+	snapshotsBefore := testLoadSnapshots(t, env.gopts)
+	rtest.Equals(t, 2, len(snapshotsBefore))
+
+	gopts := env.gopts
+	gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return newListOnceBackend(&forbidDeleteBackend{Backend: r}), nil
+	}
+
+	// forget marks the snapshot as removed instead of failing
+	testRunForget(t, gopts, snapshotsBefore[0].ID().String())
+	rtest.Equals(t, 1, len(testLoadSnapshots(t, env.gopts)))
+	testListSnapshots(t, env.gopts, 3)
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true}, env.gopts, nil))
+
+	// removing the marked snapshots fails before modifying the repository
+	err := runPrune(context.TODO(), PruneOptions{MaxUnused: "0%", RemoveMarkedSnapshots: true}, gopts)
+	rtest.Assert(t, err != nil, "expected prune to fail without the permission to delete the marked snapshots")
+	rtest.Equals(t, packsBefore, listPacks(env.gopts, t))
+
+	// prune only adds data and lists the files to delete
+	pendingFile := filepath.Join(env.base, "pending.json")
+	rtest.OK(t, runPrune(context.TODO(), PruneOptions{MaxUnused: "0%", PendingDeletions: pendingFile}, gopts))
+	packsAfter := listPacks(env.gopts, t)
+	for id := range packsBefore {
+		rtest.Assert(t, packsAfter.Has(id), "pack %v was removed", id.Str())
+	}
+	buf, err := os.ReadFile(pendingFile)
+	rtest.OK(t, err)
+	var pending pendingDeletions
+	rtest.OK(t, json.Unmarshal(buf, &pending))
+	rtest.Equals(t, 0, len(pending.Snapshots))
+	rtest.Assert(t, len(pending.Index) > 0, "no index files to delete")
+	rtest.Assert(t, len(pending.Data) > 0, "no packs to delete")
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true}, env.gopts, nil))
+
+	// the marked snapshot and its data are kept unless their removal is requested
+	testRunPrune(t, env.gopts, PruneOptions{MaxUnused: "0%"})
+	testListSnapshots(t, env.gopts, 3)
+	rtest.Equals(t, 1, len(testLoadSnapshots(t, env.gopts)))
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true}, env.gopts, nil))
+
+	// a prune which may delete files removes the snapshot and its tombstone
+	packsBefore = listPacks(env.gopts, t)
+	testRunPrune(t, env.gopts, PruneOptions{MaxUnused: "0%", RemoveMarkedSnapshots: true})
+	testListSnapshots(t, env.gopts, 1)
+	rtest.Assert(t, len(listPacks(env.gopts, t)) < len(packsBefore), "unused packs were not removed")
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true, CheckUnused: true}, env.gopts, nil))
+}
+
+func TestForgetAppendOnlyRepoVersion(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	repository.TestUseLowSecurityKDFParameters(t)
+	restic.TestDisableCheckPolynomial(t)
+	restic.TestSetLockTimeout(t, 0)
+	rtest.OK(t, runInit(context.TODO(), InitOptions{RepositoryVersion: "2"}, env.gopts, nil))
+	rtest.SetupTarTestFixture(t, env.testdata, filepath.Join("testdata", "backup-data.tar.gz"))
+
+	testRunBackup(t, "", []string{filepath.Join(env.testdata, "0", "0", "9")}, BackupOptions{}, env.gopts)
+	snapshotID := testListSnapshots(t, env.gopts, 1)[0]
+
+	gopts := env.gopts
+	gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return &forbidDeleteBackend{Backend: r}, nil
+	}
+
+	// older repository versions cannot contain tombstones
+	err := runForget(context.TODO(), ForgetOptions{}, gopts, []string{snapshotID.String()})
+	rtest.Assert(t, err != nil, "expected forget to fail")
+	testListSnapshots(t, env.gopts, 1)
+}
+
+// coldBackend stores all data packs in a simulated archive storage tier. The
+// state is shared by all commands using the backend. A requested restore
+// completes before the next check.
+type coldBackend struct {
+	m         sync.Mutex
+	archived  restic.IDSet
+	requested restic.IDSet
+	thawed    restic.IDSet
+}
+
+func newColdBackend() *coldBackend {
+	return &coldBackend{archived: restic.NewIDSet(), requested: restic.NewIDSet(), thawed: restic.NewIDSet()}
+}
+
+func (c *coldBackend) hook(r backend.Backend) (backend.Backend, error) {
+	return &coldStorageBackend{Backend: r, c: c}, nil
+}
+
+func (c *coldBackend) requests() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return len(c.requested)
+}
+
+type coldStorageBackend struct {
+	backend.Backend
+	c *coldBackend
+}
+
+func (be *coldStorageBackend) ColdFile(h backend.Handle) bool {
+	return h.Type == restic.PackFile && !h.IsMetadata
+}
+
+func (be *coldStorageBackend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	err := be.Backend.Save(ctx, h, rd)
+	if err == nil && be.ColdFile(h) {
+		be.c.m.Lock()
+		be.c.archived.Insert(restic.TestParseID(h.Name))
+		be.c.m.Unlock()
+	}
+	return err
+}
+
+func (be *coldStorageBackend) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	if h.Type == restic.PackFile {
+		id := restic.TestParseID(h.Name)
+		be.c.m.Lock()
+		cold := be.c.archived.Has(id) && !be.c.thawed.Has(id)
+		be.c.m.Unlock()
+		if cold {
+			return errors.Wrapf(backend.ErrCold, "Load(%v)", h)
+		}
+	}
+	return be.Backend.Load(ctx, h, length, offset, fn)
+}
+
+func (be *coldStorageBackend) Thaw(_ context.Context, h backend.Handle, request bool) (bool, error) {
+	id := restic.TestParseID(h.Name)
+	be.c.m.Lock()
+	defer be.c.m.Unlock()
+
+	switch {
+	case !be.c.archived.Has(id) || be.c.thawed.Has(id):
+		return true, nil
+	case be.c.requested.Has(id):
+		be.c.thawed.Insert(id)
+	case request:
+		be.c.requested.Insert(id)
+	}
+	return false, nil
+}
+
+func TestPruneColdPacks(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	cold := newColdBackend()
+	env.gopts.backendTestHook = cold.hook
+	createPrunableRepo(t, env)
+
+	// cold data packs are kept, prune does not request their restore
+	gopts := env.gopts
+	gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return cold.hook(newListOnceBackend(r))
+	}
+	rtest.OK(t, runPrune(context.TODO(), PruneOptions{MaxUnused: "0%"}, gopts))
+	rtest.Equals(t, 0, cold.requests())
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{}, env.gopts, nil))
+
+	// repacking cold packs requires their restore
+	packsBefore := listPacks(env.gopts, t)
+	rtest.OK(t, runPrune(context.TODO(), PruneOptions{MaxUnused: "0%", RepackCold: true, ThawInterval: time.Millisecond}, gopts))
+	rtest.Assert(t, cold.requests() > 0, "no restore was requested")
+	rtest.Assert(t, !listPacks(env.gopts, t).Equals(packsBefore), "no pack was repacked")
+
+	// the new data packs are cold again
+	rtest.Assert(t, runCheck(context.TODO(), CheckOptions{ReadData: true}, env.gopts, nil) != nil, "check of cold packs succeeded")
+	rtest.OK(t, runCheck(context.TODO(), CheckOptions{ReadData: true, CheckUnused: true, thawOptions: thawOptions{Thaw: true, ThawInterval: time.Millisecond}}, env.gopts, nil))
+}
+
+func TestPruneRepackUncompressedIncremental(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+	gopts := env.gopts
+	gopts.Compression = repository.CompressionOff
+	// every backup adds an uncompressed data pack of about 1 MiB
+	for i := 0; i < 4; i++ {
+		dir := filepath.Join(env.testdata, fmt.Sprint(i))
+		rtest.OK(t, os.MkdirAll(dir, 0755))
+		data := bytes.Repeat(rtest.Random(i, 1024), 1024)
+		rtest.OK(t, os.WriteFile(filepath.Join(dir, "file"), data, 0644))
+		testRunBackup(t, "", []string{dir}, BackupOptions{}, gopts)
+	}
+
+	uncompressed := func() int {
+		repo, err := OpenRepository(context.TODO(), env.gopts)
+		rtest.OK(t, err)
+		rtest.OK(t, repo.LoadIndex(context.TODO(), nil))
+		count := 0
+		repo.Index().Each(context.TODO(), func(pb restic.PackedBlob) {
+			if pb.Type == restic.DataBlob && !pb.IsCompressed() {
+				count++
+			}
+		})
+		return count
+	}
+	before := uncompressed()
+	rtest.Assert(t, before >= 4, "expected uncompressed data blobs, got %v", before)
+
+	// each run only compresses a part of the data
+	opts := PruneOptions{MaxUnused: "5%", MaxRepackSize: "2M", RepackUncompressed: true}
+	testRunPrune(t, env.gopts, opts)
+	after := uncompressed()
+	rtest.Assert(t, after > 0 && after < before, "expected some blobs to be compressed, %v of %v are uncompressed", after, before)
+
+	for i := 0; i < 4 && after > 0; i++ {
+		testRunPrune(t, env.gopts, opts)
+		after = uncompressed()
+	}
+	rtest.Equals(t, 0, after)
+	testRunCheck(t, env.gopts)
+}
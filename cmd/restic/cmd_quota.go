@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/ui"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdQuota = &cobra.Command{
+	Use:   "quota [flags]",
+	Short: "Show or change the size limit of the repository",
+	Long: `
+The "quota" command shows the size of the repository and its size limit. The
+limit is stored in the repository config and can be changed using --set or
+removed using --remove.
+
+Once the repository reaches its size limit, backups refuse to start. A backup
+which reaches the limit while it is running stops uploading data, writes the
+index for the data uploaded so far and then fails. The limit is only advisory:
+it is enforced by each client on its own and may be exceeded by backups which
+run concurrently. Older restic versions ignore the limit entirely, and
+neither the backend nor the repository format prevent writing more data.
+
+EXIT STATUS
+===========
+
+Exit status is 0 if the command was successful, and non-zero if there was any error.
+`,
+	DisableAutoGenTag: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQuota(cmd.Context(), quotaOptions, globalOptions, args)
+	},
+}
+
+// QuotaOptions collects all options for the quota command.
+type QuotaOptions struct {
+	Set    string
+	Remove bool
+}
+
+var quotaOptions QuotaOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdQuota)
+
+	f := cmdQuota.Flags()
+	f.StringVar(&quotaOptions.Set, "set", "", "set the advisory size limit of the repository to `size` (allowed suffixes: k/K, m/M, g/G, t/T)")
+	f.BoolVar(&quotaOptions.Remove, "remove", false, "remove the size limit of the repository")
+}
+
+type quotaJSON struct {
+	Size  uint64 `json:"size"`
+	Limit uint64 `json:"limit,omitempty"`
+	Slack uint64 `json:"slack,omitempty"`
+}
+
+func runQuota(ctx context.Context, opts QuotaOptions, gopts GlobalOptions, args []string) error {
+	if len(args) > 0 {
+		return errors.Fatal("the quota command expects no arguments")
+	}
+	if opts.Set != "" && opts.Remove {
+		return errors.Fatal("--set and --remove cannot be used together")
+	}
+
+	var limit uint64
+	change := opts.Set != "" || opts.Remove
+	if opts.Set != "" {
+		size, err := ui.ParseBytes(opts.Set)
+		if err != nil || size <= 0 {
+			return errors.Fatalf("invalid --set %q", opts.Set)
+		}
+		limit = uint64(size)
+	}
+
+	repo, err := OpenRepository(ctx, gopts)
+	if err != nil {
+		return err
+	}
+
+	if !gopts.NoLock || change {
+		var lock *restic.Lock
+		lock, ctx, err = lockRepository(ctx, repo, change, gopts.RetryLock, gopts.JSON)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	if change {
+		if err := repo.SetMaxRepoSize(ctx, limit); err != nil {
+			return err
+		}
+	}
+
+	bar := newIndexProgress(gopts.Quiet, gopts.JSON)
+	if err := repo.LoadIndex(ctx, bar); err != nil {
+		return err
+	}
+	status := repo.QuotaStatus(ctx)
+
+	if gopts.JSON {
+		out := quotaJSON{Size: status.Size}
+		if status.Limit > 0 {
+			out.Limit, out.Slack = status.Limit, status.Slack
+		}
+		err = json.NewEncoder(globalOptions.stdout).Encode(out)
+		if err != nil {
+			return fmt.Errorf("encoding output: %v", err)
+		}
+		return nil
+	}
+
+	Printf("repository size:  %s\n", ui.FormatBytes(status.Size))
+	if status.Limit == 0 {
+		Printf("size limit:       none\n")
+		return nil
+	}
+	Printf("size limit:       %s (%s used, %s)\n", ui.FormatBytes(status.Limit), ui.FormatPercent(status.Size, status.Limit), formatQuotaDistance(status))
+	return nil
+}
+
+// formatQuotaDistance describes how far the repository is over or under its
+// size limit.
+func formatQuotaDistance(status repository.QuotaStatus) string {
+	if status.Exceeded() {
+		return ui.FormatBytes(status.Size-status.Limit) + " over the limit"
+	}
+	return ui.FormatBytes(status.Limit-status.Size) + " under the limit"
+}
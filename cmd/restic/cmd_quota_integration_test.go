@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func testRunQuota(t testing.TB, opts QuotaOptions, gopts GlobalOptions) quotaJSON {
+	gopts.JSON = true
+	buf, err := withCaptureStdout(func() error {
+		return runQuota(context.TODO(), opts, gopts, nil)
+	})
+	rtest.OK(t, err)
+
+	var status quotaJSON
+	rtest.OK(t, json.Unmarshal(buf.Bytes(), &status))
+	return status
+}
+
+func TestBackupQuota(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+	status := testRunQuota(t, QuotaOptions{}, env.gopts)
+	rtest.Assert(t, status.Size > 0, "missing repository size")
+	rtest.Equals(t, uint64(0), status.Limit)
+
+	status = testRunQuota(t, QuotaOptions{Set: "1K"}, env.gopts)
+	rtest.Equals(t, uint64(1024), status.Limit)
+	err := testRunBackupAssumeFailure(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "exceeds its limit"), "unexpected error %v", err)
+
+	// the backup stops once the limit is reached
+	limit := status.Size + 4*1024*1024
+	status = testRunQuota(t, QuotaOptions{Set: fmt.Sprint(limit)}, env.gopts)
+	rtest.Equals(t, limit, status.Limit)
+	packs := listPacks(env.gopts, t)
+	for _, name := range []string{"new1", "new2", "new3"} {
+		rtest.OK(t, appendRandomData(filepath.Join(env.testdata, name), 4*1024*1024))
+	}
+	err = testRunBackupAssumeFailure(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "reached its size limit"), "unexpected error %v", err)
+	testListSnapshots(t, env.gopts, 1)
+	// the uploaded data was added to the index
+	rtest.Assert(t, len(listPacks(env.gopts, t)) > len(packs), "no data was uploaded")
+	repo, err := OpenRepository(context.TODO(), env.gopts)
+	rtest.OK(t, err)
+	rtest.OK(t, repo.LoadIndex(context.TODO(), nil))
+	indexed := restic.NewIDSet()
+	repo.Index().Each(context.TODO(), func(pb restic.PackedBlob) {
+		indexed.Insert(pb.PackID)
+	})
+	rtest.Equals(t, listPacks(env.gopts, t), indexed)
+	// the blobs are unused, as no snapshot was created
+	_, err = testRunCheckOutput(env.gopts, false)
+	rtest.OK(t, err)
+
+	testRunQuota(t, QuotaOptions{Remove: true}, env.gopts)
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+	testListSnapshots(t, env.gopts, 2)
+	testRunCheck(t, env.gopts)
+}
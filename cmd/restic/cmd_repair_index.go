@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"sort"
+	"sync"
 
+	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/index"
 	"github.com/restic/restic/internal/pack"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/ui/progress"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"golang.org/x/sync/errgroup"
 )
 
 var cmdRepairIndex = &cobra.Command{
@@ -18,6 +23,15 @@ var cmdRepairIndex = &cobra.Command{
 The "repair index" command creates a new index based on the pack files in the
 repository.
 
+By default, the existing index is cross-checked against the list of pack files.
+Entries which refer to missing pack files are removed, while the headers of
+pack files which are missing from the index or have an unexpected size are read
+and added to the index. Duplicate entries for the same blob are merged. With
+--verify-packs, the headers of all indexed pack files are read in addition and
+the pack files which do not match the index are indexed again. The option
+--read-all-packs ignores the existing index and creates a new one from the
+headers of all pack files.
+
 EXIT STATUS
 ===========
 
@@ -41,6 +55,7 @@ var cmdRebuildIndex = &cobra.Command{
 // RepairIndexOptions collects all options for the repair index command.
 type RepairIndexOptions struct {
 	ReadAllPacks bool
+	VerifyPacks  bool
 }
 
 var repairIndexOptions RepairIndexOptions
@@ -52,10 +67,15 @@ func init() {
 
 	for _, f := range []*pflag.FlagSet{cmdRepairIndex.Flags(), cmdRebuildIndex.Flags()} {
 		f.BoolVar(&repairIndexOptions.ReadAllPacks, "read-all-packs", false, "read all pack files to generate new index from scratch")
+		f.BoolVar(&repairIndexOptions.VerifyPacks, "verify-packs", false, "read the headers of all indexed pack files and index the pack files again which do not match the index")
 	}
 }
 
 func runRebuildIndex(ctx context.Context, opts RepairIndexOptions, gopts GlobalOptions) error {
+	if opts.ReadAllPacks && opts.VerifyPacks {
+		return errors.Fatal("--read-all-packs and --verify-packs cannot be used together")
+	}
+
 	repo, err := OpenRepository(ctx, gopts)
 	if err != nil {
 		return err
@@ -74,6 +94,7 @@ func rebuildIndex(ctx context.Context, opts RepairIndexOptions, gopts GlobalOpti
 	var obsoleteIndexes restic.IDs
 	packSizeFromList := make(map[restic.ID]int64)
 	packSizeFromIndex := make(map[restic.ID]int64)
+	indexedPacks := make(map[restic.ID]int64)
 	removePacks := restic.NewIDSet()
 
 	if opts.ReadAllPacks {
@@ -115,7 +136,9 @@ func rebuildIndex(ctx context.Context, opts RepairIndexOptions, gopts GlobalOpti
 	}
 
 	Verbosef("getting pack files to read...\n")
+	packFiles := 0
 	err := repo.List(ctx, restic.PackFile, func(id restic.ID, packSize int64) error {
+		packFiles++
 		size, ok := packSizeFromIndex[id]
 		if !ok || size != packSize {
 			// Pack was not referenced in index or size does not match
@@ -126,6 +149,8 @@ func rebuildIndex(ctx context.Context, opts RepairIndexOptions, gopts GlobalOpti
 			Warnf("adding pack file to index %v\n", id)
 		} else if size != packSize {
 			Warnf("reindexing pack file %v with unexpected size %v instead of %v\n", id, packSize, size)
+		} else {
+			indexedPacks[id] = packSize
 		}
 		delete(packSizeFromIndex, id)
 		return nil
@@ -140,6 +165,29 @@ func rebuildIndex(ctx context.Context, opts RepairIndexOptions, gopts GlobalOpti
 		Warnf("removing not found pack file %v\n", id)
 	}
 
+	if opts.VerifyPacks && len(indexedPacks) > 0 {
+		Verbosef("verifying pack files\n")
+		bar := newProgressMax(!gopts.Quiet, uint64(len(indexedPacks)), "packs")
+		mismatched, err := verifyIndexedPacks(ctx, repo, indexedPacks, bar)
+		bar.Done()
+		if err != nil {
+			return err
+		}
+		for id := range mismatched {
+			Warnf("reindexing pack file %v whose header does not match the index\n", id)
+			packSizeFromList[id] = indexedPacks[id]
+			removePacks.Insert(id)
+		}
+	}
+
+	removedEntries := countIndexEntries(ctx, repo, removePacks)
+	reindexed := restic.NewIDSet()
+	for id := range packSizeFromList {
+		reindexed.Insert(id)
+	}
+	// reindexed packs are still contained in the old index
+	addedEntries := -countIndexEntries(ctx, repo, reindexed)
+
 	if len(packSizeFromList) > 0 {
 		Verbosef("reading pack files\n")
 		bar := newProgressMax(!gopts.Quiet, uint64(len(packSizeFromList)), "packs")
@@ -153,6 +201,19 @@ func rebuildIndex(ctx context.Context, opts RepairIndexOptions, gopts GlobalOpti
 			Verboseff("skipped incomplete pack file: %v\n", id)
 		}
 	}
+	addedEntries += countIndexEntries(ctx, repo, reindexed)
+
+	headers := len(packSizeFromList)
+	if opts.VerifyPacks {
+		headers += len(indexedPacks)
+	}
+	if opts.ReadAllPacks {
+		Verbosef("scanned %d pack files, read %d pack headers, the new index contains %d entries\n",
+			packFiles, headers, addedEntries)
+	} else {
+		Verbosef("scanned %d pack files, read %d pack headers, added %d and removed %d index entries\n",
+			packFiles, headers, addedEntries, removedEntries)
+	}
 
 	err = rebuildIndexFiles(ctx, gopts, repo, removePacks, obsoleteIndexes)
 	if err != nil {
@@ -162,3 +223,84 @@ func rebuildIndex(ctx context.Context, opts RepairIndexOptions, gopts GlobalOpti
 
 	return nil
 }
+
+// verifyIndexedPacks reads the headers of the pack files in parallel and
+// returns those whose header does not match the index entries.
+func verifyIndexedPacks(ctx context.Context, repo *repository.Repository, packs map[restic.ID]int64, p *progress.Counter) (restic.IDSet, error) {
+	var m sync.Mutex
+	mismatched := restic.NewIDSet()
+
+	wg, ctx := errgroup.WithContext(ctx)
+	ch := make(chan restic.PackBlobs)
+	wg.Go(func() error {
+		defer close(ch)
+		ids := restic.NewIDSet()
+		for id := range packs {
+			ids.Insert(id)
+		}
+		for pb := range repo.Index().ListPacks(ctx, ids) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ch <- pb:
+			}
+		}
+		return ctx.Err()
+	})
+
+	worker := func() error {
+		for pb := range ch {
+			blobs, _, err := repo.ListPack(ctx, pb.PackID, packs[pb.PackID])
+			if err != nil {
+				// keep the index entries, check reports the damaged pack file
+				Warnf("unable to read header of pack file %v: %v\n", pb.PackID, err)
+			} else if !sameBlobs(blobs, pb.Blobs) {
+				m.Lock()
+				mismatched.Insert(pb.PackID)
+				m.Unlock()
+			}
+			p.Add(1)
+		}
+		return nil
+	}
+
+	// headers are small, thus reading them is primarily IO-bound
+	for i := 0; i < int(repo.Connections()); i++ {
+		wg.Go(worker)
+	}
+	return mismatched, wg.Wait()
+}
+
+// sameBlobs returns true if the pack header lists exactly the blobs of the
+// index entries.
+func sameBlobs(header, index []restic.Blob) bool {
+	if len(header) != len(index) {
+		return false
+	}
+	for _, blobs := range [][]restic.Blob{header, index} {
+		blobs := blobs
+		sort.Slice(blobs, func(i, j int) bool {
+			return blobs[i].Offset < blobs[j].Offset
+		})
+	}
+	for i := range header {
+		if header[i] != index[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// countIndexEntries returns the number of index entries for the pack files.
+func countIndexEntries(ctx context.Context, repo restic.Repository, packs restic.IDSet) int {
+	if len(packs) == 0 {
+		return 0
+	}
+	count := 0
+	repo.Index().Each(ctx, func(pb restic.PackedBlob) {
+		if packs.Has(pb.PackID) {
+			count++
+		}
+	})
+	return count
+}
@@ -139,3 +139,47 @@ func TestRebuildIndexFailsOnAppendOnly(t *testing.T) {
 	}
 	t.Log(err)
 }
+
+func TestRebuildIndexVerifyPacks(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+
+	// replace the index by one which lists a wrong ID for a blob, this does not
+	// change the size of the pack file
+	ctx := context.TODO()
+	repo, err := OpenRepository(ctx, env.gopts)
+	rtest.OK(t, err)
+	rtest.OK(t, repo.LoadIndex(ctx, nil))
+	oldIndexes := repo.Index().(*index.MasterIndex).IDs()
+
+	idx := index.NewIndex()
+	damaged := false
+	for pb := range repo.Index().ListPacks(ctx, repo.Index().(*index.MasterIndex).Packs(restic.NewIDSet())) {
+		if !damaged && pb.Blobs[0].Type == restic.DataBlob {
+			pb.Blobs[0].ID[0] ^= 1
+			damaged = true
+		}
+		idx.StorePack(pb.PackID, pb.Blobs)
+	}
+	rtest.Assert(t, damaged, "no data pack found")
+	idx.Finalize()
+	_, err = index.SaveIndex(ctx, repo, idx)
+	rtest.OK(t, err)
+	for id := range oldIndexes {
+		rtest.OK(t, repo.Backend().Remove(ctx, backend.Handle{Type: restic.IndexFile, Name: id.String()}))
+	}
+
+	// the pack file size matches the index, thus only reading the header finds the problem
+	testRunRebuildIndex(t, env.gopts)
+	_, err = testRunCheckOutput(env.gopts, false)
+	rtest.Assert(t, err != nil, "expected check to fail")
+
+	rtest.OK(t, withRestoreGlobalOptions(func() error {
+		globalOptions.stdout = io.Discard
+		return runRebuildIndex(ctx, RepairIndexOptions{VerifyPacks: true}, env.gopts)
+	}))
+	testRunCheck(t, env.gopts)
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/dump"
 	"github.com/restic/restic/internal/errors"
-	"github.com/restic/restic/internal/filter"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/fs/sftpfs"
 	"github.com/restic/restic/internal/restic"
 	"github.com/restic/restic/internal/restorer"
 	"github.com/restic/restic/internal/ui"
@@ -31,6 +37,14 @@ repository.
 To only restore a specific subfolder, you can use the "<snapshotID>:<subfolder>"
 syntax, where "subfolder" is a path within the snapshot.
 
+With "--target -", the selected files are written to stdout as a tar (default)
+or zip archive instead, see "--archive". With "--target sftp://user@host/path",
+the files are restored to a directory on another host via SFTP.
+
+The progress of the restore is recorded in a state file, which is removed once
+the restore is complete. After an interruption, "--resume" continues the
+restore of the same snapshot without writing the completed files again.
+
 EXIT STATUS
 ===========
 
@@ -68,14 +82,33 @@ Exit status is 0 if the command was successful, and non-zero if there was any er
 
 // RestoreOptions collects all options for the restore command.
 type RestoreOptions struct {
-	Exclude            []string
-	InsensitiveExclude []string
-	Include            []string
-	InsensitiveInclude []string
-	Target             string
+	excludePatternOptions
+	includePatternOptions
+	Target  string
+	Archive string
 	restic.SnapshotFilter
-	Sparse bool
-	Verify bool
+	Sparse           bool
+	DryRun           bool
+	Verify           bool
+	VerifySkipped    bool
+	WriteToDevices   bool
+	NoXattrs         bool
+	NoACLs           bool
+	WriteConcurrency uint
+	Overwrite        restorer.OverwriteBehavior
+	Delta            bool
+	DeltaContent     bool
+	Delete           bool
+	Resume           bool
+	StateFile        string
+	Ownership        restorer.OwnershipPolicy
+	UIDMap           []string
+	GIDMap           []string
+	UIDMapFiles      []string
+	GIDMapFiles      []string
+	DefaultOwner     string
+	thawOptions
+	prefetchOptions
 }
 
 var restoreOptions RestoreOptions
@@ -84,51 +117,53 @@ func init() {
 	cmdRoot.AddCommand(cmdRestore)
 
 	flags := cmdRestore.Flags()
-	flags.StringArrayVarP(&restoreOptions.Exclude, "exclude", "e", nil, "exclude a `pattern` (can be specified multiple times)")
-	flags.StringArrayVar(&restoreOptions.InsensitiveExclude, "iexclude", nil, "same as --exclude but ignores the casing of `pattern`")
-	flags.StringArrayVarP(&restoreOptions.Include, "include", "i", nil, "include a `pattern`, exclude everything else (can be specified multiple times)")
-	flags.StringArrayVar(&restoreOptions.InsensitiveInclude, "iinclude", nil, "same as --include but ignores the casing of `pattern`")
-	flags.StringVarP(&restoreOptions.Target, "target", "t", "", "directory to extract data to")
+	initExcludePatternOptions(flags, &restoreOptions.excludePatternOptions)
+	initIncludePatternOptions(flags, &restoreOptions.includePatternOptions)
+	flags.StringVarP(&restoreOptions.Target, "target", "t", "", "directory to extract data to, an sftp:// target, or \"-\" to write an archive to stdout")
+	flags.StringVar(&restoreOptions.Archive, "archive", "tar", "set archive `format` as \"tar\" or \"zip\" when writing to stdout")
 
 	initSingleSnapshotFilter(flags, &restoreOptions.SnapshotFilter)
 	flags.BoolVar(&restoreOptions.Sparse, "sparse", false, "restore files as sparse")
+	flags.BoolVarP(&restoreOptions.DryRun, "dry-run", "n", false, "do not modify the target directory, just print what would be done")
 	flags.BoolVar(&restoreOptions.Verify, "verify", false, "verify restored files content")
+	flags.BoolVar(&restoreOptions.VerifySkipped, "verify-skipped", false, "with --verify, also verify existing files which were kept due to --overwrite")
+	flags.BoolVar(&restoreOptions.NoXattrs, "no-xattrs", false, "do not restore extended attributes, except for access control lists")
+	flags.BoolVar(&restoreOptions.NoACLs, "no-acls", false, "do not restore access control lists")
+	flags.BoolVar(&restoreOptions.WriteToDevices, "write-to-devices", false, "write files saved with backup --read-devices into existing devices at the target path")
+	flags.Var(&restoreOptions.Overwrite, "overwrite", "overwrite existing files, symlinks and special files `behavior`: always, if-changed, if-newer or never")
+	flags.BoolVar(&restoreOptions.Delta, "delta", false, "skip existing files whose size and modification time match the snapshot (same as --overwrite if-changed)")
+	flags.BoolVar(&restoreOptions.DeltaContent, "delta-content", false, "only write the changed parts of existing files which are overwritten (implies --delta unless --overwrite is given)")
+	flags.BoolVar(&restoreOptions.Delete, "delete", false, "delete files from the target directory which are not contained in the snapshot")
+	flags.BoolVar(&restoreOptions.Resume, "resume", false, "record the progress of the restore and resume an interrupted restore, files it completed are not written again")
+	flags.StringVar(&restoreOptions.StateFile, "state-file", "", "record the progress of the restore in `file` (default: "+restorer.StateFileName+" in the target directory)")
+	flags.Var(&restoreOptions.Ownership, "ownership", "set the owner of restored files by `policy`: numeric IDs, user and group name, or skip")
+	flags.StringArrayVar(&restoreOptions.UIDMap, "uid-map", nil, "map user IDs from the snapshot to local IDs, e.g. `1000:2000,33:48` (can be specified multiple times)")
+	flags.StringArrayVar(&restoreOptions.GIDMap, "gid-map", nil, "map group IDs from the snapshot to local IDs, e.g. `1000:2000,33:48` (can be specified multiple times)")
+	flags.StringArrayVar(&restoreOptions.UIDMapFiles, "uid-map-file", nil, "read user ID mappings from `file` (can be specified multiple times)")
+	flags.StringArrayVar(&restoreOptions.GIDMapFiles, "gid-map-file", nil, "read group ID mappings from `file` (can be specified multiple times)")
+	flags.StringVar(&restoreOptions.DefaultOwner, "default-owner", "", "assign files whose user or group name does not exist locally to `user:group` (default: current user)")
+	flags.UintVar(&restoreOptions.WriteConcurrency, "write-concurrency", 0, "create and write up to `n` files and directories in parallel (default: number of CPUs)")
+	initThawOptions(flags, &restoreOptions.thawOptions)
+	initPrefetchOptions(flags, &restoreOptions.prefetchOptions)
 }
 
 func runRestore(ctx context.Context, opts RestoreOptions, gopts GlobalOptions,
 	term *termstatus.Terminal, args []string) error {
 
-	hasExcludes := len(opts.Exclude) > 0 || len(opts.InsensitiveExclude) > 0
-	hasIncludes := len(opts.Include) > 0 || len(opts.InsensitiveInclude) > 0
-
-	// Validate provided patterns
-	if len(opts.Exclude) > 0 {
-		if err := filter.ValidatePatterns(opts.Exclude); err != nil {
-			return errors.Fatalf("--exclude: %s", err)
-		}
-	}
-	if len(opts.InsensitiveExclude) > 0 {
-		if err := filter.ValidatePatterns(opts.InsensitiveExclude); err != nil {
-			return errors.Fatalf("--iexclude: %s", err)
-		}
-	}
-	if len(opts.Include) > 0 {
-		if err := filter.ValidatePatterns(opts.Include); err != nil {
-			return errors.Fatalf("--include: %s", err)
-		}
-	}
-	if len(opts.InsensitiveInclude) > 0 {
-		if err := filter.ValidatePatterns(opts.InsensitiveInclude); err != nil {
-			return errors.Fatalf("--iinclude: %s", err)
-		}
+	excludePatternFns, err := opts.excludePatternOptions.CollectPatterns(false)
+	if err != nil {
+		return err
 	}
-
-	for i, str := range opts.InsensitiveExclude {
-		opts.InsensitiveExclude[i] = strings.ToLower(str)
+	includePatternFns, err := opts.includePatternOptions.CollectPatterns()
+	if err != nil {
+		return err
 	}
+	hasExcludes := len(excludePatternFns) > 0
+	hasIncludes := len(includePatternFns) > 0
 
-	for i, str := range opts.InsensitiveInclude {
-		opts.InsensitiveInclude[i] = strings.ToLower(str)
+	prefetchOpts, err := opts.prefetchOptions.options()
+	if err != nil {
+		return err
 	}
 
 	switch {
@@ -146,6 +181,43 @@ func runRestore(ctx context.Context, opts RestoreOptions, gopts GlobalOptions,
 		return errors.Fatal("exclude and include patterns are mutually exclusive")
 	}
 
+	if opts.DryRun && opts.Verify {
+		return errors.Fatal("--dry-run and --verify are mutually exclusive")
+	}
+
+	if opts.DryRun && opts.Resume {
+		return errors.Fatal("--dry-run and --resume are mutually exclusive")
+	}
+
+	toStdout := opts.Target == "-"
+	if toStdout {
+		switch opts.Archive {
+		case "tar", "zip":
+		default:
+			return errors.Fatalf("unknown archive format %q", opts.Archive)
+		}
+		if opts.Verify || opts.Overwrite != restorer.OverwriteAlways || opts.Delta || opts.DeltaContent || opts.Delete {
+			return errors.Fatal("--verify, --overwrite, --delta, --delta-content and --delete cannot be used when writing to stdout")
+		}
+		if opts.hasOwnershipOptions() {
+			return errors.Fatal("--ownership, --uid-map, --gid-map and --default-owner cannot be used when writing to stdout")
+		}
+		if opts.DryRun {
+			return errors.Fatal("--dry-run cannot be used when writing to stdout")
+		}
+		if opts.Resume || opts.StateFile != "" {
+			return errors.Fatal("--resume and --state-file cannot be used when writing to stdout")
+		}
+		if err := checkStdoutArchive(); err != nil {
+			return errors.Fatalf("%v", err)
+		}
+	}
+
+	ownership, err := opts.ownership()
+	if err != nil {
+		return err
+	}
+
 	snapshotIDString := args[0]
 
 	debug.Log("restore %v to %v", snapshotIDString, opts.Target)
@@ -185,81 +257,197 @@ func runRestore(ctx context.Context, opts RestoreOptions, gopts GlobalOptions,
 	}
 
 	msg := ui.NewMessage(term, gopts.verbosity)
+
+	// the progress is not used when writing the restored data to stdout, a
+	// dry run only uses the printer to report errors
 	var printer restoreui.ProgressPrinter
-	if gopts.JSON {
-		printer = restoreui.NewJSONProgress(term)
-	} else {
-		printer = restoreui.NewTextProgress(term)
+	var progress *restoreui.Progress
+	if !toStdout {
+		if gopts.JSON {
+			printer = restoreui.NewJSONProgress(term, gopts.verbosity)
+		} else {
+			printer = restoreui.NewTextProgress(term, gopts.verbosity)
+		}
+		if !opts.DryRun {
+			progress = restoreui.NewProgress(printer, calculateProgressInterval(!gopts.Quiet, gopts.JSON))
+		}
 	}
 
-	progress := restoreui.NewProgress(printer, calculateProgressInterval(!gopts.Quiet, gopts.JSON))
-	res := restorer.NewRestorer(repo, sn, opts.Sparse, progress)
-
+	// errors may be reported concurrently
+	var errorsMutex sync.Mutex
 	totalErrors := 0
-	res.Error = func(location string, err error) error {
-		msg.E("ignoring error for %s: %s\n", location, err)
+	reportError := func(location string, err error) error {
+		errorsMutex.Lock()
+		defer errorsMutex.Unlock()
 		totalErrors++
+		if progress != nil {
+			return progress.Error(location, err)
+		}
+		if printer != nil {
+			return printer.Error(location, err)
+		}
+		msg.E("ignoring error for %s: %s\n", location, err)
 		return nil
 	}
 
-	excludePatterns := filter.ParsePatterns(opts.Exclude)
-	insensitiveExcludePatterns := filter.ParsePatterns(opts.InsensitiveExclude)
 	selectExcludeFilter := func(item string, dstpath string, node *restic.Node) (selectedForRestore bool, childMayBeSelected bool) {
-		matched, err := filter.List(excludePatterns, item)
-		if err != nil {
-			msg.E("error for exclude pattern: %v", err)
-		}
-
-		matchedInsensitive, err := filter.List(insensitiveExcludePatterns, strings.ToLower(item))
-		if err != nil {
-			msg.E("error for iexclude pattern: %v", err)
+		matched := false
+		for _, rejectFn := range excludePatternFns {
+			matched = matched || rejectFn(item)
 		}
 
 		// An exclude filter is basically a 'wildcard but foo',
 		// so even if a childMayMatch, other children of a dir may not,
 		// therefore childMayMatch does not matter, but we should not go down
 		// unless the dir is selected for restore
-		selectedForRestore = !matched && !matchedInsensitive
+		selectedForRestore = !matched
 		childMayBeSelected = selectedForRestore && node.Type == "dir"
 
 		return selectedForRestore, childMayBeSelected
 	}
 
-	includePatterns := filter.ParsePatterns(opts.Include)
-	insensitiveIncludePatterns := filter.ParsePatterns(opts.InsensitiveInclude)
 	selectIncludeFilter := func(item string, dstpath string, node *restic.Node) (selectedForRestore bool, childMayBeSelected bool) {
-		matched, childMayMatch, err := filter.ListWithChild(includePatterns, item)
-		if err != nil {
-			msg.E("error for include pattern: %v", err)
+		for _, includeFn := range includePatternFns {
+			matched, childMayMatch := includeFn(item)
+			selectedForRestore = selectedForRestore || matched
+			childMayBeSelected = childMayBeSelected || childMayMatch
 		}
+		childMayBeSelected = childMayBeSelected && node.Type == "dir"
 
-		matchedInsensitive, childMayMatchInsensitive, err := filter.ListWithChild(insensitiveIncludePatterns, strings.ToLower(item))
+		return selectedForRestore, childMayBeSelected
+	}
+
+	var selectFilter func(item string, dstpath string, node *restic.Node) (selectedForRestore bool, childMayBeSelected bool)
+	if hasExcludes {
+		selectFilter = selectExcludeFilter
+	} else if hasIncludes {
+		selectFilter = selectIncludeFilter
+	}
+
+	if toStdout {
+		err = restoreToStdout(ctx, repo, sn, opts.Archive, selectFilter, reportError)
 		if err != nil {
-			msg.E("error for iexclude pattern: %v", err)
+			return err
+		}
+		if totalErrors > 0 {
+			return errors.Fatalf("There were %d errors\n", totalErrors)
 		}
+		return nil
+	}
 
-		selectedForRestore = matched || matchedInsensitive
-		childMayBeSelected = (childMayMatch || childMayMatchInsensitive) && node.Type == "dir"
+	res := restorer.NewRestorer(repo, sn, opts.Sparse, progress)
+	res.WriteToDevices = opts.WriteToDevices
+	res.NoXattrs = opts.NoXattrs
+	res.NoACLs = opts.NoACLs
+	if opts.WriteConcurrency > 0 {
+		res.Workers = int(opts.WriteConcurrency)
+	}
+	res.Overwrite = opts.Overwrite
+	if (opts.Delta || opts.DeltaContent) && opts.Overwrite == restorer.OverwriteAlways {
+		res.Overwrite = restorer.OverwriteIfChanged
+	}
+	res.DeltaContent = opts.DeltaContent
+	res.Delete = opts.Delete
+	res.VerifySkipped = opts.VerifySkipped
+	res.Ownership.Policy = ownership.Policy
+	res.Ownership.UIDMap = ownership.UIDMap
+	res.Ownership.GIDMap = ownership.GIDMap
+	if opts.DefaultOwner != "" {
+		res.Ownership.DefaultUID, res.Ownership.DefaultGID = ownership.DefaultUID, ownership.DefaultGID
+	}
+	res.Prefetch = prefetchOpts
+	res.PreparePacks = func(ctx context.Context, packs restic.IDs) error {
+		return thawPacks(ctx, repo, packs, opts.thawOptions, gopts)
+	}
+	res.Error = reportError
+	res.Warn = func(message string) {
+		msg.E("%v\n", message)
+	}
+	if selectFilter != nil {
+		res.SelectFilter = selectFilter
+	}
 
-		return selectedForRestore, childMayBeSelected
+	// target is the path on the remote host for sftp:// targets
+	target := opts.Target
+	if sftpfs.IsTarget(opts.Target) {
+		remote, dir, err := openSFTPDestination(gopts, opts.Target)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = remote.Close()
+		}()
+		res.Destination = restorer.NewRemoteDestination(remote)
+		target = dir
 	}
 
-	if hasExcludes {
-		res.SelectFilter = selectExcludeFilter
-	} else if hasIncludes {
-		res.SelectFilter = selectIncludeFilter
+	if opts.DryRun {
+		if !gopts.JSON {
+			msg.P("would restore %s to %s\n", res.Snapshot(), opts.Target)
+		}
+		plan, err := res.DryRun(ctx, target, func(step restorer.PlannedStep) {
+			printPlannedStep(step, gopts, msg, term)
+		})
+		if err != nil {
+			return err
+		}
+		printPlan(plan, totalErrors, gopts, msg, term)
+		if totalErrors > 0 {
+			return errors.Fatalf("There were %d errors\n", totalErrors)
+		}
+		return nil
+	}
+
+	stateFile, err := opts.stateFile()
+	if err != nil {
+		return err
+	}
+	if stateFile != "" {
+		res.State, err = restorer.OpenState(stateFile, *sn.ID(), *sn.Tree, opts.Resume)
+		if err != nil {
+			return err
+		}
 	}
 
 	if !gopts.JSON {
 		msg.P("restoring %s to %s\n", res.Snapshot(), opts.Target)
 	}
 
-	err = res.RestoreTo(ctx, opts.Target)
+	err = res.RestoreTo(ctx, target)
+	// always print the summary, also if the restore was aborted
+	progress.Finish()
+	if res.State != nil {
+		if err == nil && totalErrors == 0 {
+			if rerr := res.State.Remove(); rerr != nil {
+				msg.E("unable to remove state file: %v\n", rerr)
+			}
+		} else if cerr := res.State.Close(); cerr != nil {
+			msg.E("unable to save the progress of the restore: %v\n", cerr)
+		} else {
+			msg.E("the progress of the restore was saved to %s, use --resume to continue it\n", res.State.Path())
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	progress.Finish()
+	skippedAttrs := res.SkippedAttributes()
+	kinds := make([]string, 0, len(skippedAttrs))
+	for kind := range skippedAttrs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		msg.E("Warning: %d %s were not restored, as the target file system does not support them or restic lacks the required privileges\n",
+			skippedAttrs[kind], kind)
+	}
+	stats := res.Stats()
+	if res.Overwrite != restorer.OverwriteAlways || opts.DeltaContent || opts.Delete || opts.Resume || stats.OwnersUnmapped > 0 {
+		printRestoreStats(stats, gopts, term)
+	}
+	if !gopts.JSON {
+		printPackCacheStats(repo)
+	}
 
 	if totalErrors > 0 {
 		return errors.Fatalf("There were %d errors\n", totalErrors)
@@ -271,7 +459,7 @@ func runRestore(ctx context.Context, opts RestoreOptions, gopts GlobalOptions,
 		}
 		var count int
 		t0 := time.Now()
-		count, err = res.VerifyFiles(ctx, opts.Target)
+		count, err = res.VerifyFiles(ctx, target)
 		if err != nil {
 			return err
 		}
@@ -287,3 +475,290 @@ func runRestore(ctx context.Context, opts RestoreOptions, gopts GlobalOptions,
 
 	return nil
 }
+
+// stateFile returns the path of the state file which records the progress of
+// the restore. It is only kept in the target directory for local targets, an
+// empty path disables the state file for sftp:// targets.
+func (opts *RestoreOptions) stateFile() (string, error) {
+	if opts.StateFile != "" {
+		return opts.StateFile, nil
+	}
+	if !opts.Resume {
+		// only record the progress if asked to, the state file would
+		// otherwise be left among the restored files after an error
+		return "", nil
+	}
+	if sftpfs.IsTarget(opts.Target) {
+		if opts.Resume {
+			return "", errors.Fatal("--resume requires --state-file for sftp:// targets")
+		}
+		return "", nil
+	}
+
+	if err := fs.MkdirAll(opts.Target, 0700); err != nil {
+		return "", errors.Wrap(err, "MkdirAll")
+	}
+	return filepath.Join(opts.Target, restorer.StateFileName), nil
+}
+
+// openSFTPDestination connects to the host of the sftp:// target. It returns
+// the file system and the path of the target on the host.
+func openSFTPDestination(gopts GlobalOptions, target string) (*sftpfs.FS, string, error) {
+	cfg, dir, err := sftpfs.ParseTarget(target)
+	if err != nil {
+		return nil, "", errors.Fatalf("%v", err)
+	}
+
+	if err := gopts.extended.Extract("sftp-source").Apply("sftp-source", &cfg); err != nil {
+		return nil, "", err
+	}
+
+	remote, err := sftpfs.Open(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dir, err = remote.Abs(dir)
+	if err != nil {
+		_ = remote.Close()
+		return nil, "", err
+	}
+	return remote, dir, nil
+}
+
+type restoreStats struct {
+	MessageType   string `json:"message_type"` // "restore_stats"
+	Version       int    `json:"version"`
+	FilesSkipped  uint64 `json:"files_skipped"`
+	FilesPatched  uint64 `json:"files_patched"`
+	FilesReplaced uint64 `json:"files_replaced"`
+	FilesDeleted  uint64 `json:"files_deleted"`
+	FilesResumed  uint64 `json:"files_resumed"`
+	BytesWritten  uint64 `json:"bytes_written"`
+	// OwnersUnmapped is only set for --ownership name
+	OwnersUnmapped uint64 `json:"owners_unmapped,omitempty"`
+}
+
+// printRestoreStats prints how existing files in the target directory were
+// handled.
+func printRestoreStats(stats restorer.Stats, gopts GlobalOptions, term *termstatus.Terminal) {
+	if gopts.JSON {
+		term.Print(ui.ToJSONString(restoreStats{
+			MessageType:   "restore_stats",
+			Version:       restoreui.JSONVersion,
+			FilesSkipped:  stats.FilesSkipped,
+			FilesPatched:  stats.FilesPatched,
+			FilesReplaced: stats.FilesReplaced,
+			FilesDeleted:  stats.FilesDeleted,
+			FilesResumed:  stats.FilesResumed,
+			BytesWritten:  stats.BytesWritten,
+
+			OwnersUnmapped: stats.OwnersUnmapped,
+		}))
+		return
+	}
+	if stats.OwnersUnmapped > 0 {
+		term.Error(fmt.Sprintf("%d items were assigned to the default owner, as their user or group does not exist locally",
+			stats.OwnersUnmapped))
+	}
+	if gopts.Quiet {
+		return
+	}
+	term.Print(fmt.Sprintf("Existing files: %d skipped, %d patched, %d replaced, %d deleted, %d resumed, %s written",
+		stats.FilesSkipped, stats.FilesPatched, stats.FilesReplaced, stats.FilesDeleted, stats.FilesResumed,
+		ui.FormatBytes(stats.BytesWritten)))
+}
+
+type dryRunAction struct {
+	MessageType string  `json:"message_type"` // "dry_run_action"
+	Version     int     `json:"version"`
+	Action      string  `json:"action"`
+	Item        string  `json:"item"`
+	Size        uint64  `json:"size,omitempty"`
+	Replace     bool    `json:"replace,omitempty"`
+	Patch       bool    `json:"patch,omitempty"`
+	LinkTarget  string  `json:"link_target,omitempty"`
+	Mode        string  `json:"mode,omitempty"`
+	UID         *uint32 `json:"uid,omitempty"`
+	GID         *uint32 `json:"gid,omitempty"`
+}
+
+// printPlannedStep prints a step determined by restore --dry-run. Metadata
+// changes are only printed with --verbose.
+func printPlannedStep(step restorer.PlannedStep, gopts GlobalOptions, msg *ui.Message, term *termstatus.Terminal) {
+	if step.Action == restorer.PlanMetadata && gopts.verbosity < 2 {
+		return
+	}
+
+	if gopts.JSON {
+		action := dryRunAction{
+			MessageType: "dry_run_action",
+			Version:     restoreui.JSONVersion,
+			Action:      string(step.Action),
+			Item:        step.Location,
+			Size:        step.Size,
+			Replace:     step.Replace,
+			Patch:       step.Patch,
+			LinkTarget:  step.LinkTarget,
+		}
+		if step.Action == restorer.PlanMetadata {
+			action.Mode = step.Mode.String()
+			if step.SetOwner {
+				action.UID, action.GID = &step.UID, &step.GID
+			}
+		}
+		term.Print(ui.ToJSONString(action))
+		return
+	}
+
+	switch step.Action {
+	case restorer.PlanCreateDir:
+		msg.P("would create dir   %v\n", step.Location)
+	case restorer.PlanWriteFile:
+		verb := "write  "
+		if step.Patch {
+			verb = "patch  "
+		} else if step.Replace {
+			verb = "replace"
+		}
+		msg.P("would %v      %v with size %v\n", verb, step.Location, ui.FormatBytes(step.Size))
+	case restorer.PlanCreate:
+		if step.Replace {
+			msg.P("would replace      %v\n", step.Location)
+		} else {
+			msg.P("would create       %v\n", step.Location)
+		}
+	case restorer.PlanLink:
+		msg.P("would link         %v to %v\n", step.Location, step.LinkTarget)
+	case restorer.PlanSkip:
+		msg.P("would skip         %v\n", step.Location)
+	case restorer.PlanDelete:
+		msg.P("would delete       %v\n", step.Location)
+	case restorer.PlanMetadata:
+		if step.SetOwner {
+			msg.V("would set mode %v and owner %d:%d of %v\n", step.Mode, step.UID, step.GID, step.Location)
+		} else {
+			msg.V("would set mode %v of %v\n", step.Mode, step.Location)
+		}
+	}
+}
+
+type dryRunSummary struct {
+	MessageType     string `json:"message_type"` // "dry_run_summary"
+	Version         int    `json:"version"`
+	DirsCreated     uint64 `json:"dirs_created"`
+	FilesRestored   uint64 `json:"files_restored"`
+	FilesSkipped    uint64 `json:"files_skipped"`
+	FilesDeleted    uint64 `json:"files_deleted"`
+	BytesToDownload uint64 `json:"bytes_to_download"`
+	BytesToWrite    uint64 `json:"bytes_to_write"`
+	Errors          int    `json:"errors"`
+}
+
+// printPlan prints the totals of restore --dry-run.
+func printPlan(plan restorer.Plan, totalErrors int, gopts GlobalOptions, msg *ui.Message, term *termstatus.Terminal) {
+	if gopts.JSON {
+		term.Print(ui.ToJSONString(dryRunSummary{
+			MessageType:     "dry_run_summary",
+			Version:         restoreui.JSONVersion,
+			DirsCreated:     plan.Dirs,
+			FilesRestored:   plan.Files,
+			FilesSkipped:    plan.Skipped,
+			FilesDeleted:    plan.Deleted,
+			BytesToDownload: plan.BytesToDownload,
+			BytesToWrite:    plan.BytesToWrite,
+			Errors:          totalErrors,
+		}))
+		return
+	}
+
+	msg.P("\nWould create %d dirs, restore %d files, skip %d existing files and delete %d items\n",
+		plan.Dirs, plan.Files, plan.Skipped, plan.Deleted)
+	msg.P("Would download %s and write %s\n",
+		ui.FormatBytes(plan.BytesToDownload), ui.FormatBytes(plan.BytesToWrite))
+}
+
+func (opts RestoreOptions) hasOwnershipOptions() bool {
+	return opts.Ownership != restorer.OwnershipNumeric || len(opts.UIDMap) > 0 || len(opts.GIDMap) > 0 ||
+		len(opts.UIDMapFiles) > 0 || len(opts.GIDMapFiles) > 0 || opts.DefaultOwner != ""
+}
+
+// ownership parses the options which control the owner of restored files. The
+// default owner is only set if --default-owner is given.
+func (opts RestoreOptions) ownership() (restorer.Ownership, error) {
+	o := restorer.Ownership{Policy: opts.Ownership}
+
+	var err error
+	o.UIDMap, err = readIDMaps(opts.UIDMap, opts.UIDMapFiles)
+	if err != nil {
+		return o, errors.Fatalf("--uid-map: %v", err)
+	}
+	o.GIDMap, err = readIDMaps(opts.GIDMap, opts.GIDMapFiles)
+	if err != nil {
+		return o, errors.Fatalf("--gid-map: %v", err)
+	}
+
+	if opts.DefaultOwner != "" {
+		o.DefaultUID, o.DefaultGID, err = restorer.ParseOwner(opts.DefaultOwner)
+		if err != nil {
+			return o, errors.Fatalf("--default-owner: %v", err)
+		}
+	}
+	return o, nil
+}
+
+// readIDMaps combines the ID mappings given on the command line with those
+// read from files. Empty lines and lines starting with # are ignored in files.
+func readIDMaps(mappings []string, files []string) (restorer.IDMap, error) {
+	for _, filename := range files {
+		lines, err := readLines(filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			mappings = append(mappings, line)
+		}
+	}
+
+	idMap := make(restorer.IDMap)
+	for _, s := range mappings {
+		m, err := restorer.ParseIDMap(s)
+		if err != nil {
+			return nil, err
+		}
+		for from, to := range m {
+			idMap[from] = to
+		}
+	}
+	return idMap, nil
+}
+
+// restoreToStdout writes the files selected by selectFilter as an archive to
+// stdout. Errors for individual files are passed to reportError.
+func restoreToStdout(ctx context.Context, repo restic.Repository, sn *restic.Snapshot, format string,
+	selectFilter func(item string, dstpath string, node *restic.Node) (bool, bool),
+	reportError func(location string, err error) error) error {
+
+	tree, err := restic.LoadTree(ctx, repo, *sn.Tree)
+	if err != nil {
+		return err
+	}
+
+	d := dump.New(format, repo, os.Stdout)
+	d.Error = reportError
+	if selectFilter != nil {
+		d.SelectFilter = func(item string, node *restic.Node) (bool, bool) {
+			return selectFilter(item, "", node)
+		}
+	}
+
+	err = d.DumpTree(ctx, tree, "/")
+	if err != nil {
+		return errors.Fatalf("cannot dump snapshot: %v", err)
+	}
+	return nil
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	mrand "math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/filter"
 	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/restorer"
 	rtest "github.com/restic/restic/internal/test"
 	"github.com/restic/restic/internal/ui/termstatus"
 )
@@ -23,8 +29,8 @@ func testRunRestore(t testing.TB, opts GlobalOptions, dir string, snapshotID res
 
 func testRunRestoreExcludes(t testing.TB, gopts GlobalOptions, dir string, snapshotID restic.ID, excludes []string) {
 	opts := RestoreOptions{
-		Target:  dir,
-		Exclude: excludes,
+		Target:                dir,
+		excludePatternOptions: excludePatternOptions{Excludes: excludes},
 	}
 
 	rtest.OK(t, testRunRestoreAssumeFailure(snapshotID.String(), opts, gopts))
@@ -50,8 +56,8 @@ func testRunRestoreLatest(t testing.TB, gopts GlobalOptions, dir string, paths [
 
 func testRunRestoreIncludes(t testing.TB, gopts GlobalOptions, dir string, snapshotID restic.ID, includes []string) {
 	opts := RestoreOptions{
-		Target:  dir,
-		Include: includes,
+		Target:                dir,
+		includePatternOptions: includePatternOptions{Includes: includes},
 	}
 
 	rtest.OK(t, testRunRestoreAssumeFailure(snapshotID.String(), opts, gopts))
@@ -132,6 +138,178 @@ func TestRestore(t *testing.T) {
 	rtest.Assert(t, diff == "", "directories are not equal %v", diff)
 }
 
+func TestRestoreColdPacks(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	cold := newColdBackend()
+	env.gopts.backendTestHook = cold.hook
+	testSetupBackupData(t, env)
+	testRunBackup(t, filepath.Dir(env.testdata), []string{filepath.Base(env.testdata)}, BackupOptions{}, env.gopts)
+	snapshotID := testListSnapshots(t, env.gopts, 1)[0]
+
+	// the restore fails before any file is written
+	restoredir := filepath.Join(env.base, "restore")
+	err := testRunRestoreAssumeFailure(snapshotID.String(), RestoreOptions{Target: restoredir}, env.gopts)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "cold storage"), "unexpected error %v", err)
+	rtest.Equals(t, 0, cold.requests())
+
+	opts := RestoreOptions{Target: restoredir, thawOptions: thawOptions{Thaw: true, ThawInterval: time.Millisecond}}
+	rtest.OK(t, testRunRestoreAssumeFailure(snapshotID.String(), opts, env.gopts))
+	rtest.Assert(t, cold.requests() > 0, "no restore was requested")
+
+	diff := directoriesContentsDiff(env.testdata, filepath.Join(restoredir, filepath.Base(env.testdata)))
+	rtest.Assert(t, diff == "", "directories are not equal %v", diff)
+}
+
+// dataLoadCountingBackend counts how often data pack files are loaded.
+type dataLoadCountingBackend struct {
+	backend.Backend
+	loads *int32
+}
+
+func (b *dataLoadCountingBackend) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	if h.Type == backend.PackFile && !h.IsMetadata {
+		atomic.AddInt32(b.loads, 1)
+	}
+	return b.Backend.Load(ctx, h, length, offset, fn)
+}
+
+func TestRestorePackCache(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	for i := 0; i < 5; i++ {
+		p := filepath.Join(env.testdata, fmt.Sprintf("foo/testfile%v", i))
+		rtest.OK(t, os.MkdirAll(filepath.Dir(p), 0755))
+		rtest.OK(t, appendRandomData(p, uint(mrand.Intn(2<<20))))
+	}
+	testRunBackup(t, filepath.Dir(env.testdata), []string{filepath.Base(env.testdata)}, BackupOptions{}, env.gopts)
+
+	var loads int32
+	env.gopts.PackCacheSize = "1G"
+	env.gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return &dataLoadCountingBackend{Backend: r, loads: &loads}, nil
+	}
+
+	for i, expectLoads := range []bool{true, false} {
+		atomic.StoreInt32(&loads, 0)
+		restoredir := filepath.Join(env.base, fmt.Sprintf("restore%d", i))
+		testRunRestoreLatest(t, env.gopts, restoredir, nil, nil)
+
+		diff := directoriesContentsDiff(env.testdata, filepath.Join(restoredir, filepath.Base(env.testdata)))
+		rtest.Assert(t, diff == "", "directories are not equal %v", diff)
+		rtest.Assert(t, (atomic.LoadInt32(&loads) > 0) == expectLoads, "restore %d loaded %d data pack files", i, atomic.LoadInt32(&loads))
+	}
+}
+
+func TestRestoreDryRun(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	for i := 0; i < 3; i++ {
+		p := filepath.Join(env.testdata, fmt.Sprintf("foo/testfile%v", i))
+		rtest.OK(t, os.MkdirAll(filepath.Dir(p), 0755))
+		rtest.OK(t, appendRandomData(p, uint(mrand.Intn(2<<20)+1)))
+	}
+	testRunBackup(t, filepath.Dir(env.testdata), []string{filepath.Base(env.testdata)}, BackupOptions{}, env.gopts)
+
+	var loads int32
+	gopts := env.gopts
+	gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return &dataLoadCountingBackend{Backend: r, loads: &loads}, nil
+	}
+	gopts.JSON = true
+	buf := bytes.NewBuffer(nil)
+	gopts.stdout = buf
+
+	restoredir := filepath.Join(env.base, "restore")
+	opts := RestoreOptions{Target: restoredir, DryRun: true}
+	rtest.OK(t, testRunRestoreAssumeFailure("latest", opts, gopts))
+	rtest.Equals(t, int32(0), atomic.LoadInt32(&loads))
+	_, err := os.Lstat(restoredir)
+	rtest.Assert(t, os.IsNotExist(err), "dry run created the target directory: %v", err)
+
+	var summary dryRunSummary
+	actions := 0
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var action dryRunAction
+		rtest.OK(t, json.Unmarshal([]byte(line), &action))
+		switch action.MessageType {
+		case "dry_run_action":
+			actions++
+		case "dry_run_summary":
+			rtest.OK(t, json.Unmarshal([]byte(line), &summary))
+		}
+	}
+	rtest.Equals(t, uint64(3), summary.FilesRestored)
+	rtest.Equals(t, 0, summary.Errors)
+	rtest.Assert(t, summary.BytesToWrite > 0 && summary.BytesToDownload > 0, "unexpected summary %v", summary)
+	rtest.Assert(t, uint64(actions) == summary.DirsCreated+summary.FilesRestored, "unexpected number of actions %v", actions)
+
+	// existing files which block the restore are reported as errors
+	rtest.OK(t, os.MkdirAll(restoredir, 0755))
+	rtest.OK(t, os.WriteFile(filepath.Join(restoredir, filepath.Base(env.testdata)), []byte("conflict"), 0644))
+	err = testRunRestoreAssumeFailure("latest", opts, gopts)
+	rtest.Assert(t, err != nil, "expected an error for a conflicting file")
+}
+
+func TestRestoreResume(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	for i := 0; i < 3; i++ {
+		p := filepath.Join(env.testdata, fmt.Sprintf("foo/testfile%v", i))
+		rtest.OK(t, os.MkdirAll(filepath.Dir(p), 0755))
+		rtest.OK(t, appendRandomData(p, uint(mrand.Intn(2<<20)+1)))
+	}
+	testRunBackup(t, filepath.Dir(env.testdata), []string{filepath.Base(env.testdata)}, BackupOptions{}, env.gopts)
+
+	// a directory in place of a file interrupts the restore
+	restoredir := filepath.Join(env.base, "restore")
+	conflict := filepath.Join(restoredir, filepath.Base(env.testdata), "foo", "testfile0")
+	rtest.OK(t, os.MkdirAll(conflict, 0755))
+	opts := RestoreOptions{Target: restoredir}
+	err := testRunRestoreAssumeFailure("latest", opts, env.gopts)
+	rtest.Assert(t, err != nil, "expected an error for the conflicting directory")
+	// without --resume, the progress is not recorded
+	stateFile := filepath.Join(restoredir, restorer.StateFileName)
+	_, err = os.Lstat(stateFile)
+	rtest.Assert(t, os.IsNotExist(err), "unexpected state file: %v", err)
+
+	opts.Resume = true
+	err = testRunRestoreAssumeFailure("latest", opts, env.gopts)
+	rtest.Assert(t, err != nil, "expected an error for the conflicting directory")
+	_, err = os.Lstat(stateFile)
+	rtest.OK(t, err)
+
+	gopts := env.gopts
+	gopts.JSON = true
+	buf := bytes.NewBuffer(nil)
+	gopts.stdout = buf
+
+	rtest.OK(t, os.Remove(conflict))
+	rtest.OK(t, testRunRestoreAssumeFailure("latest", opts, gopts))
+
+	var stats restoreStats
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, `"restore_stats"`) {
+			rtest.OK(t, json.Unmarshal([]byte(line), &stats))
+		}
+	}
+	rtest.Equals(t, uint64(2), stats.FilesResumed)
+	diff := directoriesContentsDiff(env.testdata, filepath.Join(restoredir, filepath.Base(env.testdata)))
+	rtest.Assert(t, diff == "", "directories are not equal %v", diff)
+	_, err = os.Lstat(stateFile)
+	rtest.Assert(t, os.IsNotExist(err), "state file was not removed: %v", err)
+}
+
 func TestRestoreLatest(t *testing.T) {
 	env, cleanup := withTestEnvironment(t)
 	defer cleanup()
@@ -226,6 +404,89 @@ func TestRestoreWithPermissionFailure(t *testing.T) {
 	}
 }
 
+func TestRestorePatternFiles(t *testing.T) {
+	testfiles := []string{
+		"dir1/sub/a.c",
+		"dir1/sub/b.txt",
+		"dir2/sub/c.c",
+		"dir2/other/d.c",
+		"top.c",
+	}
+
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+
+	for _, name := range testfiles {
+		p := filepath.Join(env.testdata, name)
+		rtest.OK(t, os.MkdirAll(filepath.Dir(p), 0755))
+		rtest.OK(t, appendRandomData(p, 100))
+	}
+	rtest.OK(t, setZeroModTime(filepath.Join(env.testdata, "dir1", "sub")))
+	rtest.OK(t, setZeroModTime(filepath.Join(env.testdata, "dir1")))
+
+	testRunBackup(t, filepath.Dir(env.testdata), []string{filepath.Base(env.testdata)}, BackupOptions{}, env.gopts)
+	snapshotID := testListSnapshots(t, env.gopts, 1)[0]
+
+	writePatterns := func(name, patterns string) string {
+		p := filepath.Join(env.base, name)
+		rtest.OK(t, os.WriteFile(p, []byte(patterns), 0644))
+		return p
+	}
+
+	for i, test := range []struct {
+		opts     RestoreOptions
+		restored []string
+	}{
+		{
+			// wildcards in intermediate components
+			opts: RestoreOptions{includePatternOptions: includePatternOptions{
+				IncludeFiles: []string{writePatterns("include", "# only C files\n\n/testdata/*/sub/*.c\n")},
+			}},
+			restored: []string{"dir1/sub/a.c", "dir2/sub/c.c"},
+		},
+		{
+			// an included directory includes its children
+			opts: RestoreOptions{includePatternOptions: includePatternOptions{
+				InsensitiveIncludeFiles: []string{writePatterns("iinclude", "/TESTDATA/DIR2\n")},
+			}},
+			restored: []string{"dir2/sub/c.c", "dir2/other/d.c"},
+		},
+		{
+			opts: RestoreOptions{excludePatternOptions: excludePatternOptions{
+				ExcludeFiles: []string{writePatterns("exclude", "/testdata/*/sub\n")},
+			}},
+			restored: []string{"dir2/other/d.c", "top.c"},
+		},
+	} {
+		base := filepath.Join(env.base, fmt.Sprintf("restore%d", i))
+		test.opts.Target = base
+		rtest.OK(t, testRunRestoreAssumeFailure(snapshotID.String(), test.opts, env.gopts))
+
+		restored := make(map[string]struct{})
+		for _, name := range test.restored {
+			restored[name] = struct{}{}
+		}
+		for _, name := range testfiles {
+			err := testFileSize(filepath.Join(base, "testdata", name), 100)
+			if _, ok := restored[name]; ok {
+				rtest.OK(t, err)
+			} else {
+				rtest.Assert(t, os.IsNotExist(err), "expected %v to not exist in restore step %v, err %v", name, i, err)
+			}
+		}
+	}
+
+	// the metadata of intermediate directories is restored, even though
+	// they were not matched by the patterns
+	for _, dir := range []string{"dir1", "dir1/sub"} {
+		fi, err := os.Stat(filepath.Join(env.base, "restore0", "testdata", dir))
+		rtest.OK(t, err)
+		rtest.Assert(t, fi.ModTime().Equal(time.Unix(0, 0)), "metadata of intermediate directory %v was not restored", dir)
+	}
+}
+
 func setZeroModTime(filename string) error {
 	var utimes = []syscall.Timespec{
 		syscall.NsecToTimespec(0),
@@ -305,3 +566,23 @@ func TestRestoreLocalLayout(t *testing.T) {
 		rtest.RemoveAll(t, target)
 	}
 }
+
+func TestRestorePrefetch(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	testRunBackup(t, filepath.Dir(env.testdata), []string{filepath.Base(env.testdata)}, BackupOptions{}, env.gopts)
+	snapshotID := testListSnapshots(t, env.gopts, 1)[0]
+
+	restoredir := filepath.Join(env.base, "restore")
+	opts := RestoreOptions{Target: restoredir, prefetchOptions: prefetchOptions{Prefetch: 4, PrefetchMemory: "64M"}}
+	rtest.OK(t, testRunRestoreAssumeFailure(snapshotID.String(), opts, env.gopts))
+
+	diff := directoriesContentsDiff(env.testdata, filepath.Join(restoredir, filepath.Base(env.testdata)))
+	rtest.Assert(t, diff == "", "directories are not equal %v", diff)
+
+	opts.PrefetchMemory = "invalid"
+	err := testRunRestoreAssumeFailure(snapshotID.String(), opts, env.gopts)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "--prefetch-memory"), "unexpected error %v", err)
+}
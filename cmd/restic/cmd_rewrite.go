@@ -109,7 +109,7 @@ func rewriteSnapshot(ctx context.Context, repo *repository.Repository, sn *resti
 		return false, errors.Errorf("snapshot %v has nil tree", sn.ID().Str())
 	}
 
-	rejectByNameFuncs, err := opts.excludePatternOptions.CollectPatterns()
+	rejectByNameFuncs, err := opts.excludePatternOptions.CollectPatterns(false)
 	if err != nil {
 		return false, err
 	}
@@ -141,6 +141,7 @@ func rewriteSnapshot(ctx context.Context, repo *repository.Repository, sn *resti
 				return nil
 			},
 			DisableNodeCache: true,
+			BlobHasher:       repo.Config().BlobHasher(),
 		})
 
 		filter = func(ctx context.Context, sn *restic.Snapshot) (restic.ID, error) {
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/restic/chunker"
+	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/crypto"
+	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 	"github.com/restic/restic/internal/restorer"
@@ -18,6 +21,7 @@ import (
 
 	"github.com/minio/sha256-simd"
 	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
 )
 
 var cmdStats = &cobra.Command{
@@ -43,6 +47,14 @@ The modes are:
 * raw-data: Counts the size of blobs in the repository, regardless of
   how many files reference them.
 * blobs-per-file: A combination of files-by-contents and raw-data.
+* snapshot-usage: Shows the restore size, the deduplicated size and the
+  unique size of each snapshot, or of each group of snapshots with
+  --group-by. The unique size is the size of the data which is referenced
+  by no other snapshot. With --per-directory, the sizes are also shown for
+  the directories in the backup paths of the snapshots.
+* retention: Shows how many snapshot and data files are protected by
+  a retention policy of the backend, e.g. S3 Object Lock, and when the
+  protection expires. Snapshot filters are ignored in this mode.
 
 Refer to the online manual for more details about each mode.
 
@@ -62,6 +74,10 @@ type StatsOptions struct {
 	// the mode of counting to perform (see consts for available modes)
 	countMode string
 
+	// GroupBy and perDirectory are only used for the snapshot-usage mode
+	GroupBy      restic.SnapshotGroupByOptions
+	perDirectory bool
+
 	restic.SnapshotFilter
 }
 
@@ -70,7 +86,9 @@ var statsOptions StatsOptions
 func init() {
 	cmdRoot.AddCommand(cmdStats)
 	f := cmdStats.Flags()
-	f.StringVar(&statsOptions.countMode, "mode", countModeRestoreSize, "counting mode: restore-size (default), files-by-contents, blobs-per-file or raw-data")
+	f.StringVar(&statsOptions.countMode, "mode", countModeRestoreSize, "counting mode: restore-size (default), files-by-contents, blobs-per-file, raw-data, snapshot-usage or retention")
+	f.VarP(&statsOptions.GroupBy, "group-by", "g", "`group` snapshots by host, paths and/or tags, separated by comma (snapshot-usage mode only)")
+	f.BoolVar(&statsOptions.perDirectory, "per-directory", false, "show the sizes of the directories in the backup paths (snapshot-usage mode only)")
 	initMultiSnapshotFilter(f, &statsOptions.SnapshotFilter, true)
 }
 
@@ -94,6 +112,10 @@ func runStats(ctx context.Context, opts StatsOptions, gopts GlobalOptions, args
 		}
 	}
 
+	if opts.countMode == countModeRetention {
+		return statsRetention(ctx, repo, gopts)
+	}
+
 	snapshotLister, err := restic.MemorizeList(ctx, repo, restic.SnapshotFile)
 	if err != nil {
 		return err
@@ -111,6 +133,10 @@ func runStats(ctx context.Context, opts StatsOptions, gopts GlobalOptions, args
 		Printf("scanning...\n")
 	}
 
+	if opts.countMode == countModeSnapshotUsage {
+		return statsSnapshotUsage(ctx, repo, snapshotLister, opts, gopts, args)
+	}
+
 	// create a container for the stats (and other needed state)
 	stats := &statsContainer{
 		uniqueFiles:    make(map[fileID]struct{}),
@@ -299,11 +325,17 @@ func verifyStatsInput(opts StatsOptions) error {
 	case countModeUniqueFilesByContents:
 	case countModeBlobsPerFile:
 	case countModeRawData:
+	case countModeSnapshotUsage:
+	case countModeRetention:
 	case countModeDebug:
 	default:
 		return fmt.Errorf("unknown counting mode: %s (use the -h flag to get a list of supported modes)", opts.countMode)
 	}
 
+	if opts.countMode != countModeSnapshotUsage && (opts.GroupBy != (restic.SnapshotGroupByOptions{}) || opts.perDirectory) {
+		return errors.Fatal("--group-by and --per-directory can only be used with --mode snapshot-usage")
+	}
+
 	return nil
 }
 
@@ -344,9 +376,121 @@ const (
 	countModeUniqueFilesByContents = "files-by-contents"
 	countModeBlobsPerFile          = "blobs-per-file"
 	countModeRawData               = "raw-data"
+	countModeSnapshotUsage         = "snapshot-usage"
+	countModeRetention             = "retention"
 	countModeDebug                 = "debug"
 )
 
+// retentionStats summarizes the retention of all files of one type.
+type retentionStats struct {
+	FileType       string     `json:"file_type"`
+	Files          uint64     `json:"files"`
+	Retained       uint64     `json:"retained"`
+	EarliestExpiry *time.Time `json:"earliest_expiry,omitempty"`
+	LatestExpiry   *time.Time `json:"latest_expiry,omitempty"`
+}
+
+func (s *retentionStats) add(r backend.Retention, now time.Time) {
+	s.Files++
+	if !r.Retained(now) {
+		return
+	}
+
+	s.Retained++
+	until := r.Until
+	if s.EarliestExpiry == nil || until.Before(*s.EarliestExpiry) {
+		s.EarliestExpiry = &until
+	}
+	if s.LatestExpiry == nil || until.After(*s.LatestExpiry) {
+		s.LatestExpiry = &until
+	}
+}
+
+func statsRetention(ctx context.Context, repo restic.Repository, gopts GlobalOptions) error {
+	be := backend.AsBackend[backend.RetentionBackend](repo.Backend())
+	if be == nil {
+		return errors.Fatal("the repository backend does not support retention policies")
+	}
+
+	var stats []retentionStats
+	for _, t := range []restic.FileType{restic.SnapshotFile, restic.PackFile} {
+		s, err := statsRetentionFileType(ctx, repo, be, t, gopts)
+		if err != nil {
+			return err
+		}
+		stats = append(stats, s)
+	}
+
+	if gopts.JSON {
+		err := json.NewEncoder(globalOptions.stdout).Encode(stats)
+		if err != nil {
+			return fmt.Errorf("encoding output: %v", err)
+		}
+		return nil
+	}
+
+	Printf("Retention status:\n")
+	for _, s := range stats {
+		Printf("%16s:  %d of %d files retained", s.FileType+" files", s.Retained, s.Files)
+		if s.Retained > 0 {
+			Printf(", expiring between %v and %v", s.EarliestExpiry.Local().Format(TimeFormat), s.LatestExpiry.Local().Format(TimeFormat))
+		}
+		Printf("\n")
+	}
+	return nil
+}
+
+func statsRetentionFileType(ctx context.Context, repo restic.Repository, be backend.RetentionBackend, tpe restic.FileType, gopts GlobalOptions) (retentionStats, error) {
+	var ids restic.IDs
+	err := repo.List(ctx, tpe, func(id restic.ID, _ int64) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return retentionStats{}, err
+	}
+
+	bar := newProgressMax(!gopts.JSON && !gopts.Quiet, uint64(len(ids)), tpe.String()+" files checked")
+	defer bar.Done()
+
+	now := time.Now()
+	stats := retentionStats{FileType: tpe.String()}
+	var m sync.Mutex
+
+	idCh := make(chan restic.ID)
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		defer close(idCh)
+		for _, id := range ids {
+			select {
+			case idCh <- id:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	for i := 0; i < int(repo.Connections()); i++ {
+		wg.Go(func() error {
+			for id := range idCh {
+				r, err := be.Retention(ctx, backend.Handle{Type: tpe, Name: id.String()})
+				if err != nil {
+					return err
+				}
+
+				m.Lock()
+				stats.add(r, now)
+				m.Unlock()
+				bar.Add(1)
+			}
+			return nil
+		})
+	}
+
+	return stats, wg.Wait()
+}
+
 func statsDebug(ctx context.Context, repo restic.Repository) error {
 	Warnf("Collecting size statistics\n\n")
 	for _, t := range []restic.FileType{restic.KeyFile, restic.LockFile, restic.IndexFile, restic.PackFile} {
@@ -378,7 +522,7 @@ func statsDebugFileType(ctx context.Context, repo restic.Repository, tpe restic.
 func statsDebugBlobs(ctx context.Context, repo restic.Repository) [restic.NumBlobTypes]*sizeHistogram {
 	var hist [restic.NumBlobTypes]*sizeHistogram
 	for i := 0; i < len(hist); i++ {
-		hist[i] = newSizeHistogram(2 * chunker.MaxSize)
+		hist[i] = newSizeHistogram(2 * uint64(repo.Config().Max()))
 	}
 
 	repo.Index().Each(ctx, func(pb restic.PackedBlob) {
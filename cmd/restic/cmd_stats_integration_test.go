@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestStatsRetention(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testSetupBackupData(t, env)
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+	packs := listPacks(env.gopts, t)
+
+	opts := StatsOptions{countMode: countModeRetention}
+	rtest.Assert(t, runStats(context.TODO(), opts, env.gopts, nil) != nil,
+		"missing error for backend without retention support")
+
+	gopts := env.gopts
+	gopts.JSON = true
+	gopts.backendTestHook = func(r backend.Backend) (backend.Backend, error) {
+		return &retainingBackend{Backend: r}, nil
+	}
+	buf, err := withCaptureStdout(func() error {
+		return runStats(context.TODO(), opts, gopts, nil)
+	})
+	rtest.OK(t, err)
+
+	var stats []retentionStats
+	rtest.OK(t, json.Unmarshal(buf.Bytes(), &stats))
+	rtest.Equals(t, 2, len(stats))
+	rtest.Equals(t, retentionStats{FileType: "snapshot", Files: 1, Retained: 1}, withoutExpiry(t, stats[0]))
+	rtest.Equals(t, retentionStats{FileType: "data", Files: uint64(len(packs)), Retained: uint64(len(packs))}, withoutExpiry(t, stats[1]))
+}
+
+func withoutExpiry(t testing.TB, s retentionStats) retentionStats {
+	rtest.Assert(t, s.EarliestExpiry != nil && s.LatestExpiry != nil, "expiry missing for %v files", s.FileType)
+	s.EarliestExpiry, s.LatestExpiry = nil, nil
+	return s
+}
+
+func testRunStatsJSON(t testing.TB, opts StatsOptions, gopts GlobalOptions, args []string, v interface{}) {
+	gopts.JSON = true
+	buf, err := withCaptureStdout(func() error {
+		return runStats(context.TODO(), opts, gopts, args)
+	})
+	rtest.OK(t, err)
+	rtest.OK(t, json.Unmarshal(buf.Bytes(), v))
+}
+
+func TestStatsSnapshotUsage(t *testing.T) {
+	env, cleanup := withTestEnvironment(t)
+	defer cleanup()
+
+	testRunInit(t, env.gopts)
+	rtest.OK(t, os.MkdirAll(filepath.Join(env.testdata, "shared"), 0755))
+	rtest.OK(t, appendRandomData(filepath.Join(env.testdata, "shared", "file"), 3*1024*1024))
+	rtest.OK(t, appendRandomData(filepath.Join(env.testdata, "top"), 1000))
+
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+	rtest.OK(t, os.MkdirAll(filepath.Join(env.testdata, "new"), 0755))
+	rtest.OK(t, appendRandomData(filepath.Join(env.testdata, "new", "file"), 1024*1024))
+	testRunBackup(t, "", []string{env.testdata}, BackupOptions{}, env.gopts)
+	snapshotIDs := testListSnapshots(t, env.gopts, 2)
+
+	var raw [3]statsContainer
+	rawOpts := StatsOptions{countMode: countModeRawData}
+	testRunStatsJSON(t, rawOpts, env.gopts, nil, &raw[0])
+	var usage []snapshotUsage
+	testRunStatsJSON(t, StatsOptions{countMode: countModeSnapshotUsage, perDirectory: true}, env.gopts, nil, &usage)
+	rtest.Equals(t, 2, len(usage))
+
+	for i, u := range usage {
+		rtest.Equals(t, 1, len(u.Snapshots))
+		testRunStatsJSON(t, rawOpts, env.gopts, u.Snapshots, &raw[i+1])
+	}
+	for i, u := range usage {
+		rtest.Equals(t, raw[i+1].TotalSize, u.DeduplicatedSize)
+		// the unique size is freed by removing the snapshot
+		rtest.Equals(t, raw[0].TotalSize-raw[2-i].TotalSize, u.UniqueSize)
+
+		var restore statsContainer
+		testRunStatsJSON(t, StatsOptions{countMode: countModeRestoreSize}, env.gopts, u.Snapshots, &restore)
+		rtest.Equals(t, restore.TotalSize, u.RestoreSize)
+	}
+	rtest.Assert(t, usage[1].UniqueSize > 1024*1024, "unique size %d of the second snapshot is too small", usage[1].UniqueSize)
+	rtest.Assert(t, usage[0].UniqueSize < 10*1024, "unique size %d of the first snapshot is too large", usage[0].UniqueSize)
+
+	// the directories within the backup target
+	rtest.Equals(t, 1, len(usage[0].Directories))
+	rtest.Equals(t, 2, len(usage[1].Directories))
+	shared, added := usage[1].Directories[1], usage[1].Directories[0]
+	rtest.Assert(t, strings.HasSuffix(shared.Path, "/testdata/shared"), "unexpected path %v", shared.Path)
+	rtest.Equals(t, uint64(3*1024*1024), shared.RestoreSize)
+	rtest.Equals(t, uint64(0), shared.UniqueSize)
+	rtest.Equals(t, uint64(1024*1024), added.RestoreSize)
+	rtest.Assert(t, added.UniqueSize > 1024*1024 && added.UniqueSize <= usage[1].UniqueSize,
+		"unexpected unique size %d of the new directory", added.UniqueSize)
+
+	// all snapshots in one group
+	testRunStatsJSON(t, StatsOptions{countMode: countModeSnapshotUsage, GroupBy: restic.SnapshotGroupByOptions{Host: true}}, env.gopts, nil, &usage)
+	rtest.Equals(t, 1, len(usage))
+	rtest.Equals(t, 2, len(usage[0].Snapshots))
+	rtest.Equals(t, raw[0].TotalSize, usage[0].DeduplicatedSize)
+	rtest.Equals(t, raw[0].TotalSize, usage[0].UniqueSize)
+
+	// the unselected snapshot is still considered for the unique size
+	testRunStatsJSON(t, StatsOptions{countMode: countModeSnapshotUsage}, env.gopts, []string{snapshotIDs[0].String()}, &usage)
+	rtest.Equals(t, 1, len(usage))
+	rtest.Assert(t, usage[0].UniqueSize < usage[0].DeduplicatedSize, "unique size %d not smaller than deduplicated size %d", usage[0].UniqueSize, usage[0].DeduplicatedSize)
+
+	rtest.Assert(t, runStats(context.TODO(), StatsOptions{countMode: countModeRawData, perDirectory: true}, env.gopts, nil) != nil,
+		"missing error for --per-directory in raw-data mode")
+}
@@ -2,28 +2,39 @@ package main
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 
 	"golang.org/x/sync/errgroup"
 
 	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 )
 
 // DeleteFiles deletes the given fileList of fileType in parallel
-// it will print a warning if there is an error, but continue deleting the remaining files
-func DeleteFiles(ctx context.Context, gopts GlobalOptions, repo restic.Repository, fileList restic.IDSet, fileType restic.FileType) {
-	_ = deleteFiles(ctx, gopts, true, repo, fileList, fileType)
+// it will print a warning if there is an error, but continue deleting the remaining files.
+// The files which the backend does not allow to delete are returned.
+func DeleteFiles(ctx context.Context, gopts GlobalOptions, repo restic.Repository, fileList restic.IDSet, fileType restic.FileType) (forbidden restic.IDSet) {
+	forbidden, _ = deleteFiles(ctx, gopts, true, repo, fileList, fileType)
+	return forbidden
 }
 
 // DeleteFilesChecked deletes the given fileList of fileType in parallel
-// if an error occurs, it will cancel and return this error
-func DeleteFilesChecked(ctx context.Context, gopts GlobalOptions, repo restic.Repository, fileList restic.IDSet, fileType restic.FileType) error {
+// if an error occurs, it will cancel and return this error.
+// The files which the backend does not allow to delete are returned.
+func DeleteFilesChecked(ctx context.Context, gopts GlobalOptions, repo restic.Repository, fileList restic.IDSet, fileType restic.FileType) (forbidden restic.IDSet, err error) {
 	return deleteFiles(ctx, gopts, false, repo, fileList, fileType)
 }
 
 // deleteFiles deletes the given fileList of fileType in parallel
 // if ignoreError=true, it will print a warning if there was an error, else it will abort.
-func deleteFiles(ctx context.Context, gopts GlobalOptions, ignoreError bool, repo restic.Repository, fileList restic.IDSet, fileType restic.FileType) error {
+// Files which are protected by a retention policy are skipped, their deletion
+// is deferred to a later run. Files which the backend does not allow to
+// delete at all are skipped and returned, it is up to the caller to handle them.
+func deleteFiles(ctx context.Context, gopts GlobalOptions, ignoreError bool, repo restic.Repository, fileList restic.IDSet, fileType restic.FileType) (restic.IDSet, error) {
 	totalCount := len(fileList)
 	fileChan := make(chan restic.ID)
 	wg, ctx := errgroup.WithContext(ctx)
@@ -41,6 +52,9 @@ func deleteFiles(ctx context.Context, gopts GlobalOptions, ignoreError bool, rep
 
 	bar := newProgressMax(!gopts.JSON && !gopts.Quiet, uint64(totalCount), "files deleted")
 	defer bar.Done()
+	var deferred uint64
+	var m sync.Mutex
+	forbidden := restic.NewIDSet()
 	// deleting files is IO-bound
 	workerCount := repo.Connections()
 	for i := 0; i < int(workerCount); i++ {
@@ -48,6 +62,20 @@ func deleteFiles(ctx context.Context, gopts GlobalOptions, ignoreError bool, rep
 			for id := range fileChan {
 				h := backend.Handle{Type: fileType, Name: id.String()}
 				err := repo.Backend().Remove(ctx, h)
+				if errors.Is(err, backend.ErrRetained) {
+					debug.Log("deferring deletion of %v: %v", h, err)
+					atomic.AddUint64(&deferred, 1)
+					bar.Add(1)
+					continue
+				}
+				if repository.IsDeletionForbidden(repo, err) {
+					debug.Log("deletion of %v is forbidden: %v", h, err)
+					m.Lock()
+					forbidden.Insert(id)
+					m.Unlock()
+					bar.Add(1)
+					continue
+				}
 				if err != nil {
 					if !gopts.JSON {
 						Warnf("unable to remove %v from the repository\n", h)
@@ -65,5 +93,9 @@ func deleteFiles(ctx context.Context, gopts GlobalOptions, ignoreError bool, rep
 		})
 	}
 	err := wg.Wait()
-	return err
+	bar.Done()
+	if deferred > 0 && !gopts.JSON {
+		Warnf("deferred deletion of %d %v files which are protected by a retention policy, they will be removed by a later run after the retention expired\n", deferred, fileType)
+	}
+	return forbidden, err
 }
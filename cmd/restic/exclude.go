@@ -9,7 +9,9 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/restic/restic/internal/archiver"
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/filter"
@@ -93,15 +95,18 @@ func rejectByPattern(patterns []string) RejectByNameFunc {
 	}
 }
 
-// Same as `rejectByPattern` but case insensitive.
+// rejectByInsensitivePattern is like rejectByPattern, but ignores the case of
+// patterns and paths. Unicode case folding and normalization are applied, see
+// filter.FoldName.
 func rejectByInsensitivePattern(patterns []string) RejectByNameFunc {
-	for index, path := range patterns {
-		patterns[index] = strings.ToLower(path)
+	folded := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		folded = append(folded, filter.FoldName(pattern))
 	}
 
-	rejFunc := rejectByPattern(patterns)
+	rejFunc := rejectByPattern(folded)
 	return func(item string) bool {
-		return rejFunc(strings.ToLower(item))
+		return rejFunc(filter.FoldName(item))
 	}
 }
 
@@ -369,28 +374,32 @@ func rejectBySize(maxSizeStr string) (RejectFunc, error) {
 		return nil, err
 	}
 
+	selectFn := archiver.SelectBySize(maxSize)
 	return func(item string, fi os.FileInfo) bool {
-		// directory will be ignored
-		if fi.IsDir() {
-			return false
-		}
+		return !selectFn(item, fi)
+	}, nil
+}
 
-		filesize := fi.Size()
-		if filesize > maxSize {
-			debug.Log("file %s is oversize: %d", item, filesize)
-			return true
-		}
+// rejectByModTime returns a RejectFunc which rejects files modified before the
+// RFC 3339 timestamp cutoffStr.
+func rejectByModTime(cutoffStr string) (RejectFunc, error) {
+	cutoff, err := time.Parse(time.RFC3339, cutoffStr)
+	if err != nil {
+		return nil, errors.Fatalf("invalid --newer-than: %v", err)
+	}
 
-		return false
+	selectFn := archiver.SelectByModTime(cutoff)
+	return func(item string, fi os.FileInfo) bool {
+		return !selectFn(item, fi)
 	}, nil
 }
 
-// readExcludePatternsFromFiles reads all exclude files and returns the list of
-// exclude patterns. For each line, leading and trailing white space is removed
+// readPatternsFromFiles reads all include or exclude files and returns the
+// list of patterns. For each line, leading and trailing white space is removed
 // and comment lines are ignored. For each remaining pattern, environment
 // variables are resolved. For adding a literal dollar sign ($), write $$ to
 // the file.
-func readExcludePatternsFromFiles(excludeFiles []string) ([]string, error) {
+func readPatternsFromFiles(files []string) ([]string, error) {
 	getenvOrDollar := func(s string) string {
 		if s == "$" {
 			return "$"
@@ -398,8 +407,8 @@ func readExcludePatternsFromFiles(excludeFiles []string) ([]string, error) {
 		return os.Getenv(s)
 	}
 
-	var excludes []string
-	for _, filename := range excludeFiles {
+	var patterns []string
+	for _, filename := range files {
 		err := func() (err error) {
 			data, err := textfile.Read(filename)
 			if err != nil {
@@ -421,7 +430,7 @@ func readExcludePatternsFromFiles(excludeFiles []string) ([]string, error) {
 				}
 
 				line = os.Expand(line, getenvOrDollar)
-				excludes = append(excludes, line)
+				patterns = append(patterns, line)
 			}
 			return scanner.Err()
 		}()
@@ -429,7 +438,7 @@ func readExcludePatternsFromFiles(excludeFiles []string) ([]string, error) {
 			return nil, err
 		}
 	}
-	return excludes, nil
+	return patterns, nil
 }
 
 type excludePatternOptions struct {
@@ -450,11 +459,13 @@ func (opts *excludePatternOptions) Empty() bool {
 	return len(opts.Excludes) == 0 && len(opts.InsensitiveExcludes) == 0 && len(opts.ExcludeFiles) == 0 && len(opts.InsensitiveExcludeFiles) == 0
 }
 
-func (opts excludePatternOptions) CollectPatterns() ([]RejectByNameFunc, error) {
-	var fs []RejectByNameFunc
+// CollectPatterns returns the functions to reject files by name. If
+// caseInsensitive is set, the --exclude patterns are matched like --iexclude.
+func (opts excludePatternOptions) CollectPatterns(caseInsensitive bool) ([]RejectByNameFunc, error) {
+	var funcs []RejectByNameFunc
 	// add patterns from file
 	if len(opts.ExcludeFiles) > 0 {
-		excludePatterns, err := readExcludePatternsFromFiles(opts.ExcludeFiles)
+		excludePatterns, err := readPatternsFromFiles(opts.ExcludeFiles)
 		if err != nil {
 			return nil, err
 		}
@@ -467,7 +478,7 @@ func (opts excludePatternOptions) CollectPatterns() ([]RejectByNameFunc, error)
 	}
 
 	if len(opts.InsensitiveExcludeFiles) > 0 {
-		excludes, err := readExcludePatternsFromFiles(opts.InsensitiveExcludeFiles)
+		excludes, err := readPatternsFromFiles(opts.InsensitiveExcludeFiles)
 		if err != nil {
 			return nil, err
 		}
@@ -484,7 +495,7 @@ func (opts excludePatternOptions) CollectPatterns() ([]RejectByNameFunc, error)
 			return nil, errors.Fatalf("--iexclude: %s", err)
 		}
 
-		fs = append(fs, rejectByInsensitivePattern(opts.InsensitiveExcludes))
+		funcs = append(funcs, rejectByInsensitivePattern(opts.InsensitiveExcludes))
 	}
 
 	if len(opts.Excludes) > 0 {
@@ -492,7 +503,11 @@ func (opts excludePatternOptions) CollectPatterns() ([]RejectByNameFunc, error)
 			return nil, errors.Fatalf("--exclude: %s", err)
 		}
 
-		fs = append(fs, rejectByPattern(opts.Excludes))
+		if caseInsensitive {
+			funcs = append(funcs, rejectByInsensitivePattern(opts.Excludes))
+		} else {
+			funcs = append(funcs, rejectByPattern(opts.Excludes))
+		}
 	}
-	return fs, nil
+	return funcs, nil
 }
@@ -62,6 +62,38 @@ func TestRejectByInsensitivePattern(t *testing.T) {
 	}
 }
 
+func TestCollectPatternsCaseInsensitive(t *testing.T) {
+	opts := excludePatternOptions{Excludes: []string{"Thumbs.db", "[a-z]*.tmp"}}
+
+	var tests = []struct {
+		filename        string
+		caseInsensitive bool
+		reject          bool
+	}{
+		{filename: "/home/user/Thumbs.db", caseInsensitive: false, reject: true},
+		{filename: "/home/user/thumbs.db", caseInsensitive: false, reject: false},
+		{filename: "/home/user/thumbs.db", caseInsensitive: true, reject: true},
+		{filename: "/home/user/Cache.TMP", caseInsensitive: false, reject: false},
+		{filename: "/home/user/Cache.TMP", caseInsensitive: true, reject: true},
+		{filename: "/home/user/1cache.tmp", caseInsensitive: true, reject: false},
+	}
+
+	for _, tc := range tests {
+		t.Run("", func(t *testing.T) {
+			funcs, err := opts.CollectPatterns(tc.caseInsensitive)
+			test.OK(t, err)
+			test.Equals(t, 1, len(funcs))
+			res := funcs[0](tc.filename)
+			if res != tc.reject {
+				t.Fatalf("wrong result for filename %v (case insensitive %v): want %v, got %v",
+					tc.filename, tc.caseInsensitive, tc.reject, res)
+			}
+		})
+	}
+
+	test.Equals(t, []string{"Thumbs.db", "[a-z]*.tmp"}, opts.Excludes)
+}
+
 func TestIsExcludedByFile(t *testing.T) {
 	const (
 		tagFilename = "CACHEDIR.TAG"
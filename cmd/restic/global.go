@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -20,6 +21,7 @@ import (
 	"github.com/restic/restic/internal/backend/local"
 	"github.com/restic/restic/internal/backend/location"
 	"github.com/restic/restic/internal/backend/logger"
+	"github.com/restic/restic/internal/backend/mirror"
 	"github.com/restic/restic/internal/backend/rclone"
 	"github.com/restic/restic/internal/backend/rest"
 	"github.com/restic/restic/internal/backend/retry"
@@ -27,6 +29,7 @@ import (
 	"github.com/restic/restic/internal/backend/sema"
 	"github.com/restic/restic/internal/backend/sftp"
 	"github.com/restic/restic/internal/backend/swift"
+	"github.com/restic/restic/internal/backend/webdav"
 	"github.com/restic/restic/internal/cache"
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/fs"
@@ -34,6 +37,7 @@ import (
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 	"github.com/restic/restic/internal/textfile"
+	"github.com/restic/restic/internal/ui"
 	"github.com/restic/restic/internal/ui/termstatus"
 
 	"github.com/restic/restic/internal/errors"
@@ -65,16 +69,32 @@ type GlobalOptions struct {
 	CacheDir        string
 	NoCache         bool
 	CleanupCache    bool
+	PackCacheSize   string
 	Compression     repository.CompressionMode
 	PackSize        uint
+	UpdateAtime     bool
+
+	DataCompressionLevel  int
+	MinCompressionSavings uint
+	SkipDamagedIndex      bool
 
 	backend.TransportOptions
 	limiter.Limits
+	LimitFile string
+	OpLimits  limiter.OpLimits
+
+	AdaptiveConnections bool
+	UploadConcurrency   uint
+	UploadMemory        string
 
 	password string
 	stdout   io.Writer
 	stderr   io.Writer
 
+	// packCacheDir overrides CacheDir for the pack cache, it is set by check
+	// which uses a temporary directory for the metadata cache.
+	packCacheDir string
+
 	backends                              *location.Registry
 	backendTestHook, backendInnerTestHook backendWrapper
 
@@ -109,6 +129,8 @@ func init() {
 	backends.Register(s3.NewFactory())
 	backends.Register(sftp.NewFactory())
 	backends.Register(swift.NewFactory())
+	backends.Register(webdav.NewFactory())
+	backends.Register(mirror.NewFactory(backends, Warnf))
 	globalOptions.backends = backends
 
 	var cancel context.CancelFunc
@@ -138,10 +160,22 @@ func init() {
 	f.StringVar(&globalOptions.TLSClientCertKeyFilename, "tls-client-cert", "", "path to a `file` containing PEM encoded TLS client certificate and private key (default: $RESTIC_TLS_CLIENT_CERT)")
 	f.BoolVar(&globalOptions.InsecureTLS, "insecure-tls", false, "skip TLS certificate verification when connecting to the repository (insecure)")
 	f.BoolVar(&globalOptions.CleanupCache, "cleanup-cache", false, "auto remove old cache directories")
+	f.StringVar(&globalOptions.PackCacheSize, "pack-cache-size", "", "also cache data pack files locally, using up to `size` (allowed suffixes: k/K, m/M, g/G, t/T) (default: $RESTIC_PACK_CACHE_SIZE)")
 	f.Var(&globalOptions.Compression, "compression", "compression mode (only available for repository format version 2), one of (auto|off|max) (default: $RESTIC_COMPRESSION)")
+	f.IntVar(&globalOptions.DataCompressionLevel, "data-compression-level", 0, "use zstd compression `level` 1-22 for data blobs, tree blobs always use the best compression (default: depends on --compression)")
+	f.UintVar(&globalOptions.MinCompressionSavings, "compression-min-savings", 0, "store data blobs uncompressed unless compression saves at least `percent` of their size (default: always compress)")
 	f.IntVar(&globalOptions.Limits.UploadKb, "limit-upload", 0, "limits uploads to a maximum `rate` in KiB/s. (default: unlimited)")
 	f.IntVar(&globalOptions.Limits.DownloadKb, "limit-download", 0, "limits downloads to a maximum `rate` in KiB/s. (default: unlimited)")
+	f.StringVar(&globalOptions.LimitFile, "limit-file", "", "read upload and download limits from `file`, which is reloaded when it is modified or on SIGUSR2 (default: $RESTIC_LIMIT_FILE)")
+	f.Float64Var(&globalOptions.OpLimits.Rate, "limit-ops", 0, "limits backend operations to a maximum `rate` per second (default: unlimited)")
+	f.IntVar(&globalOptions.OpLimits.Burst, "limit-ops-burst", 0, "allow bursts of up to `n` backend operations (default: the value of --limit-ops)")
+	f.BoolVar(&globalOptions.OpLimits.Adaptive, "limit-ops-adaptive", false, "temporarily lower the operation rate when the backend throttles requests")
+	f.BoolVar(&globalOptions.AdaptiveConnections, "adaptive-connections", false, "adjust the number of backend connections to the latency and errors of the backend, at most the configured connections are used")
+	f.UintVar(&globalOptions.UploadConcurrency, "upload-concurrency", 0, "upload up to `n` pack files concurrently, independent of the backend connections used for other operations (default: $RESTIC_UPLOAD_CONCURRENCY or the number of connections)")
+	f.StringVar(&globalOptions.UploadMemory, "upload-memory", "", "limit the pack files queued for or being uploaded to `size` (allowed suffixes: k/K, m/M, g/G, t/T) (default: unlimited)")
+	f.BoolVar(&globalOptions.SkipDamagedIndex, "skip-damaged-index", false, "skip index files which cannot be loaded instead of failing, run 'restic repair index' to repair the index")
 	f.UintVar(&globalOptions.PackSize, "pack-size", 0, "set target pack `size` in MiB, created pack files may be larger (default: $RESTIC_PACK_SIZE)")
+	f.BoolVar(&globalOptions.UpdateAtime, "update-atime", false, "do not prevent reading files from updating their access time")
 	f.StringSliceVarP(&globalOptions.Options, "option", "o", []string{}, "set extended option (`key=value`, can be specified multiple times)")
 	// Use our "generate" command instead of the cobra provided "completion" command
 	cmdRoot.CompletionOptions.DisableDefaultCmd = true
@@ -163,6 +197,11 @@ func init() {
 	// parse target pack size from env, on error the default value will be used
 	targetPackSize, _ := strconv.ParseUint(os.Getenv("RESTIC_PACK_SIZE"), 10, 32)
 	globalOptions.PackSize = uint(targetPackSize)
+	// parse upload concurrency from env, on error the default value will be used
+	uploadConcurrency, _ := strconv.ParseUint(os.Getenv("RESTIC_UPLOAD_CONCURRENCY"), 10, 32)
+	globalOptions.UploadConcurrency = uint(uploadConcurrency)
+	globalOptions.PackCacheSize = os.Getenv("RESTIC_PACK_CACHE_SIZE")
+	globalOptions.LimitFile = os.Getenv("RESTIC_LIMIT_FILE")
 
 	restoreTerminal()
 }
@@ -424,8 +463,20 @@ func ReadRepo(opts GlobalOptions) (string, error) {
 
 const maxKeys = 20
 
-// OpenRepository reads the password and opens the repository.
-func OpenRepository(ctx context.Context, opts GlobalOptions) (*repository.Repository, error) {
+// retryMessage is printed to stderr in JSON mode when a backend operation
+// is retried.
+type retryMessage struct {
+	MessageType string  `json:"message_type"` // "retry"
+	Operation   string  `json:"operation"`
+	Attempt     int     `json:"attempt"`
+	MaxAttempts uint    `json:"max_attempts"`
+	Delay       float64 `json:"delay_seconds"`
+	Error       string  `json:"error"`
+}
+
+// newRepository opens the backend and returns a repository for it, which has
+// not been unlocked by a key yet.
+func newRepository(ctx context.Context, opts GlobalOptions) (*repository.Repository, error) {
 	repo, err := ReadRepo(opts)
 	if err != nil {
 		return nil, err
@@ -436,13 +487,35 @@ func OpenRepository(ctx context.Context, opts GlobalOptions) (*repository.Reposi
 		return nil, err
 	}
 
-	report := func(msg string, err error, d time.Duration) {
-		Warnf("%v returned error, retrying after %v: %v\n", msg, d, err)
+	policy := retry.DefaultPolicy()
+	if err := opts.extended.Extract("retry").Apply("retry", &policy); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	maxAttempts := policy.MaxRetries + 1
+	report := func(msg string, err error, attempt int, d time.Duration) {
+		if opts.JSON {
+			status := retryMessage{
+				MessageType: "retry",
+				Operation:   msg,
+				Attempt:     attempt,
+				MaxAttempts: maxAttempts,
+				Delay:       d.Seconds(),
+				Error:       err.Error(),
+			}
+			if jerr := json.NewEncoder(globalOptions.stderr).Encode(status); jerr == nil {
+				return
+			}
+		}
+		Warnf("%v returned error (attempt %d/%d), retrying after %v: %v\n", msg, attempt, maxAttempts, d, err)
 	}
 	success := func(msg string, retries int) {
 		Warnf("%v operation successful after %d retries\n", msg, retries)
 	}
-	be = retry.New(be, 10, report, success)
+	be = retry.New(be, policy, report, success)
 
 	// wrap backend if a test specified a hook
 	if opts.backendTestHook != nil {
@@ -452,13 +525,69 @@ func OpenRepository(ctx context.Context, opts GlobalOptions) (*repository.Reposi
 		}
 	}
 
-	s, err := repository.New(be, repository.Options{
-		Compression: opts.Compression,
-		PackSize:    opts.PackSize * 1024 * 1024,
-	})
+	repoOpts := repository.Options{
+		Compression:           opts.Compression,
+		DataCompressionLevel:  opts.DataCompressionLevel,
+		MinCompressionSavings: opts.MinCompressionSavings,
+		PackSize:              opts.PackSize * 1024 * 1024,
+		UploadConcurrency:     opts.UploadConcurrency,
+	}
+	if opts.UploadMemory != "" {
+		size, err := ui.ParseBytes(opts.UploadMemory)
+		if err != nil || size <= 0 {
+			return nil, errors.Fatalf("invalid upload memory %q: %v", opts.UploadMemory, err)
+		}
+		repoOpts.UploadMemory = uint64(size)
+	}
+	if opts.SkipDamagedIndex {
+		repoOpts.DamagedIndex = func(id restic.ID, err error) {
+			Warnf("skipping damaged index %v: %v\n", id, err)
+		}
+	}
+	s, err := repository.New(be, repoOpts)
 	if err != nil {
 		return nil, errors.Fatal(err.Error())
 	}
+	return s, nil
+}
+
+// OpenWriteOnlyRepository opens the repository using the write-only key stored
+// in filename, see "restic key add --write-only".
+func OpenWriteOnlyRepository(ctx context.Context, opts GlobalOptions, filename string) (*repository.Repository, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Fatalf("%s", err)
+	}
+	key, err := repository.ParseWriteOnlyKey(buf)
+	if err != nil {
+		return nil, errors.Fatalf("%s: %v", filename, err)
+	}
+
+	s, err := newRepository(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = s.OpenWriteOnly(ctx, key)
+	if err != nil {
+		return nil, errors.Fatalf("%s", err)
+	}
+
+	if stdoutIsTerminal() && !opts.JSON {
+		id := s.Config().ID
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		Verbosef("repository %v opened using write-only key %v\n", id, key.Key.Str())
+	}
+	return s, nil
+}
+
+// OpenRepository reads the password and opens the repository.
+func OpenRepository(ctx context.Context, opts GlobalOptions) (*repository.Repository, error) {
+	s, err := newRepository(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	passwordTriesLeft := 1
 	if stdinIsTerminal() && opts.password == "" {
@@ -506,6 +635,24 @@ func OpenRepository(ctx context.Context, opts GlobalOptions) (*repository.Reposi
 		return s, nil
 	}
 
+	if opts.PackCacheSize != "" {
+		maxSize, err := ui.ParseBytes(opts.PackCacheSize)
+		if err != nil {
+			return nil, errors.Fatalf("invalid pack cache size %q: %v", opts.PackCacheSize, err)
+		}
+
+		dir := opts.CacheDir
+		if opts.packCacheDir != "" {
+			dir = opts.packCacheDir
+		}
+		pc, err := cache.NewPackCache(s.Config().ID, dir, maxSize)
+		if err != nil {
+			Warnf("unable to open pack cache: %v\n", err)
+		} else {
+			s.UsePackCache(pc)
+		}
+	}
+
 	c, err := cache.New(s.Config().ID, opts.CacheDir)
 	if err != nil {
 		Warnf("unable to open cache: %v\n", err)
@@ -558,17 +705,184 @@ func parseConfig(loc location.Location, opts options.Options) (interface{}, erro
 	}
 
 	// only apply options for a particular backend here
-	opts = opts.Extract(loc.Scheme)
-	if err := opts.Apply(loc.Scheme, cfg); err != nil {
+	if err := opts.Extract(loc.Scheme).Apply(loc.Scheme, cfg); err != nil {
 		return nil, err
 	}
 
+	// backends which combine other backends pass on the options
+	if nested, ok := cfg.(location.NestedConfig); ok {
+		for _, inner := range nested.Locations() {
+			if _, err := parseConfig(inner, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	debug.Log("opening %v repository at %#v", loc.Scheme, cfg)
 	return cfg, nil
 }
 
+// newLimiter returns the limiter for the upload and download rate. If a limits
+// file is specified, the limits are read from the file and updated when it
+// changes.
+func newLimiter(ctx context.Context, gopts GlobalOptions) (limiter.Limiter, error) {
+	if gopts.LimitFile == "" {
+		return limiter.NewStaticLimiter(gopts.Limits), nil
+	}
+
+	limits, err := limiter.ReadLimitsFile(gopts.LimitFile, gopts.Limits)
+	if err != nil {
+		return nil, errors.Fatalf("unable to read limits file: %v", err)
+	}
+	debug.Log("using limits %+v from %v", limits, gopts.LimitFile)
+
+	lim := limiter.NewAdjustableLimiter(limits)
+	limiter.WatchLimitsFile(ctx, gopts.LimitFile, gopts.Limits, lim, func(limits limiter.Limits, err error) {
+		if err != nil {
+			Warnf("unable to reload limits file, keeping the current limits: %v\n", err)
+			return
+		}
+		if !gopts.JSON {
+			Verbosef("changed limits to %s upload, %s download\n", formatLimit(limits.UploadKb), formatLimit(limits.DownloadKb))
+		}
+	})
+	return lim, nil
+}
+
+// rateLimitMessage is printed to stderr in JSON mode when restic exits, if
+// the rate of backend operations was limited.
+type rateLimitMessage struct {
+	MessageType string  `json:"message_type"` // "rate_limit"
+	Waited      float64 `json:"waited_seconds"`
+	Reductions  int     `json:"reductions"`
+	Rate        float64 `json:"rate"`
+}
+
+// newOpLimiter returns the limiter for the rate of backend operations, or nil
+// if it is unlimited. The time spent waiting for the limit is reported when
+// restic exits.
+func newOpLimiter(gopts GlobalOptions) (*limiter.OpLimiter, error) {
+	l := gopts.OpLimits
+	if l.Rate < 0 || l.Burst < 0 {
+		return nil, errors.Fatal("--limit-ops and --limit-ops-burst must not be negative")
+	}
+	if l.Rate == 0 {
+		if l.Burst > 0 || l.Adaptive {
+			return nil, errors.Fatal("--limit-ops-burst and --limit-ops-adaptive require --limit-ops")
+		}
+		return nil, nil
+	}
+
+	lim := limiter.NewOpLimiter(l)
+	AddCleanupHandler(func(code int) (int, error) {
+		if gopts.JSON {
+			msg := rateLimitMessage{
+				MessageType: "rate_limit",
+				Waited:      lim.Waited().Seconds(),
+				Reductions:  lim.Reductions(),
+				Rate:        lim.Rate(),
+			}
+			_ = json.NewEncoder(gopts.stderr).Encode(msg)
+			return code, nil
+		}
+
+		Verbosef("waited %v for the limit of %g backend operations per second\n", lim.Waited().Round(time.Millisecond), l.Rate)
+		if n := lim.Reductions(); n > 0 {
+			Verbosef("the backend throttled requests, the rate was lowered %d times and is now %.2f operations per second\n", n, lim.Rate())
+		}
+		return code, nil
+	})
+	return lim, nil
+}
+
+// connectionsMessage is printed to stderr in JSON mode when restic exits, if
+// the number of backend connections was chosen adaptively.
+type connectionsMessage struct {
+	MessageType string              `json:"message_type"` // "connections"
+	Connections uint                `json:"connections"`
+	Max         uint                `json:"max_connections"`
+	History     []connectionsChange `json:"history"`
+}
+
+type connectionsChange struct {
+	Seconds     float64 `json:"seconds"`
+	Connections uint    `json:"connections"`
+	Reason      string  `json:"reason"`
+}
+
+// limitConnections wraps be with the limit for the number of concurrent
+// backend connections. Uploads of pack files use a separate limit if
+// --upload-concurrency is set. The connections chosen by the adaptive limit
+// are reported when restic exits.
+func limitConnections(gopts GlobalOptions, be backend.Backend) backend.Backend {
+	if !gopts.AdaptiveConnections {
+		be = sema.NewBackend(be)
+		if gopts.UploadConcurrency > 0 {
+			sema.LimitUploads(be, gopts.UploadConcurrency)
+		}
+		return be
+	}
+
+	be = sema.NewAdaptiveBackend(be)
+	if gopts.UploadConcurrency > 0 {
+		sema.LimitUploads(be, gopts.UploadConcurrency)
+	}
+	start := time.Now()
+	AddCleanupHandler(func(code int) (int, error) {
+		stats, _ := sema.AdaptiveConnections(be)
+		if gopts.JSON {
+			msg := connectionsMessage{
+				MessageType: "connections",
+				Connections: stats.Connections,
+				Max:         stats.Max,
+			}
+			for _, c := range stats.History {
+				msg.History = append(msg.History, connectionsChange{
+					Seconds:     c.Time.Sub(start).Seconds(),
+					Connections: c.Connections,
+					Reason:      c.Reason,
+				})
+			}
+			_ = json.NewEncoder(gopts.stderr).Encode(msg)
+			return code, nil
+		}
+
+		Verbosef("adaptive connections: %d of at most %d, history: %v\n", stats.Connections, stats.Max, stats.Choices())
+		return code, nil
+	})
+	return be
+}
+
+func formatLimit(kb int) string {
+	if kb <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d KiB/s", kb)
+}
+
 // Open the backend specified by a location config.
 func open(ctx context.Context, s string, gopts GlobalOptions, opts options.Options) (backend.Backend, error) {
+	be, err := openBackend(ctx, s, gopts, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// check if config is there
+	fi, err := be.Stat(ctx, backend.Handle{Type: restic.ConfigFile})
+	if err != nil {
+		return nil, errors.Fatalf("unable to open config file: %v\nIs there a repository at the following location?\n%v", err, location.StripPassword(gopts.backends, s))
+	}
+
+	if fi.Size == 0 {
+		return nil, errors.New("config file has zero size, invalid repository?")
+	}
+
+	return be, nil
+}
+
+// openBackend opens the backend specified by URI without checking whether it
+// contains a repository.
+func openBackend(ctx context.Context, s string, gopts GlobalOptions, opts options.Options) (backend.Backend, error) {
 	debug.Log("parsing location %v", location.StripPassword(gopts.backends, s))
 	loc, err := location.Parse(gopts.backends, s)
 	if err != nil {
@@ -588,9 +902,20 @@ func open(ctx context.Context, s string, gopts GlobalOptions, opts options.Optio
 	}
 
 	// wrap the transport so that the throughput via HTTP is limited
-	lim := limiter.NewStaticLimiter(gopts.Limits)
+	lim, err := newLimiter(ctx, gopts)
+	if err != nil {
+		return nil, err
+	}
 	rt = lim.Transport(rt)
 
+	opLim, err := newOpLimiter(gopts)
+	if err != nil {
+		return nil, err
+	}
+	if opLim != nil {
+		rt = opLim.Transport(rt)
+	}
+
 	factory := gopts.backends.Lookup(loc.Scheme)
 	if factory == nil {
 		return nil, errors.Fatalf("invalid backend: %q", loc.Scheme)
@@ -602,7 +927,12 @@ func open(ctx context.Context, s string, gopts GlobalOptions, opts options.Optio
 	}
 
 	// wrap with debug logging and connection limiting
-	be = logger.New(sema.NewBackend(be))
+	be = logger.New(limitConnections(gopts, be))
+
+	// wait for the operation rate limit before taking a connection
+	if opLim != nil {
+		be = limiter.LimitOperations(be, opLim)
+	}
 
 	// wrap backend if a test specified an inner hook
 	if gopts.backendInnerTestHook != nil {
@@ -612,16 +942,6 @@ func open(ctx context.Context, s string, gopts GlobalOptions, opts options.Optio
 		}
 	}
 
-	// check if config is there
-	fi, err := be.Stat(ctx, backend.Handle{Type: restic.ConfigFile})
-	if err != nil {
-		return nil, errors.Fatalf("unable to open config file: %v\nIs there a repository at the following location?\n%v", err, location.StripPassword(gopts.backends, s))
-	}
-
-	if fi.Size == 0 {
-		return nil, errors.New("config file has zero size, invalid repository?")
-	}
-
 	return be, nil
 }
 
@@ -653,5 +973,5 @@ func create(ctx context.Context, s string, gopts GlobalOptions, opts options.Opt
 		return nil, err
 	}
 
-	return logger.New(sema.NewBackend(be)), nil
+	return logger.New(limitConnections(gopts, be)), nil
 }
@@ -74,6 +74,10 @@ func (be *listOnceBackend) List(ctx context.Context, t restic.FileType, fn func(
 	return be.Backend.List(ctx, t, fn)
 }
 
+func (be *listOnceBackend) Unwrap() backend.Backend {
+	return be.Backend
+}
+
 func TestListOnce(t *testing.T) {
 	env, cleanup := withTestEnvironment(t)
 	defer cleanup()
@@ -9,6 +9,7 @@ import (
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 )
 
@@ -56,6 +57,8 @@ func lockRepository(ctx context.Context, repo restic.Repository, exclusive bool,
 	lockFn := restic.NewLock
 	if exclusive {
 		lockFn = restic.NewExclusiveLock
+	} else if r, ok := repo.(*repository.Repository); ok && r.WriteOnly() {
+		lockFn = restic.NewWriteOnlyLock
 	}
 
 	var lock *restic.Lock
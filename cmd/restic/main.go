@@ -113,6 +113,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "%v\nthe `unlock` command can be used to remove stale locks\n", err)
 	case err == ErrInvalidSourceData:
 		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	case err == ErrSnapshotSkipped:
+		// already reported by the backup command
 	case errors.IsFatal(err):
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 	case err != nil:
@@ -133,6 +135,8 @@ func main() {
 		exitCode = 0
 	case ErrInvalidSourceData:
 		exitCode = 3
+	case ErrSnapshotSkipped:
+		exitCode = 4
 	default:
 		exitCode = 1
 	}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/restic/restic/internal/backend/prefetch"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/ui"
+
+	"github.com/spf13/pflag"
+)
+
+// defaultPrefetchMemory limits the data which is loaded ahead of its use.
+const defaultPrefetchMemory = "256M"
+
+type prefetchOptions struct {
+	Prefetch       uint
+	PrefetchMemory string
+}
+
+func initPrefetchOptions(f *pflag.FlagSet, opts *prefetchOptions) {
+	f.UintVar(&opts.Prefetch, "prefetch", 0, "load up to `n` pack files ahead of their use to hide the latency of the backend (default: disabled)")
+	f.StringVar(&opts.PrefetchMemory, "prefetch-memory", defaultPrefetchMemory, "limit the data loaded ahead by --prefetch to `size` (allowed suffixes: k/K, m/M, g/G, t/T)")
+}
+
+// options returns the options of the prefetcher.
+func (opts prefetchOptions) options() (prefetch.Options, error) {
+	s := opts.PrefetchMemory
+	if s == "" {
+		s = defaultPrefetchMemory
+	}
+	size, err := ui.ParseBytes(s)
+	if err != nil || size <= 0 {
+		return prefetch.Options{}, errors.Fatalf("invalid --prefetch-memory %q", opts.PrefetchMemory)
+	}
+	return prefetch.Options{Depth: int(opts.Prefetch), MaxBytes: size}, nil
+}
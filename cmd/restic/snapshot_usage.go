@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/ui"
+	"github.com/restic/restic/internal/ui/table"
+)
+
+// usageSizes are the sizes reported for a snapshot group or a directory
+// within it.
+type usageSizes struct {
+	// RestoreSize is the size of the files, hard links are counted for
+	// each link.
+	RestoreSize uint64 `json:"restore_size"`
+	// DeduplicatedSize is the size of all blobs referenced.
+	DeduplicatedSize uint64 `json:"deduplicated_size"`
+	// UniqueSize is the size of the blobs which are referenced by nothing
+	// else in the repository.
+	UniqueSize uint64 `json:"unique_size"`
+}
+
+type directoryUsage struct {
+	Path string `json:"path"`
+	usageSizes
+}
+
+type snapshotUsage struct {
+	GroupKey  *restic.SnapshotGroupKey `json:"group_key,omitempty"`
+	Snapshots []string                 `json:"snapshots"`
+	usageSizes
+	Directories []*directoryUsage `json:"directories,omitempty"`
+
+	list restic.Snapshots
+}
+
+// usageUnit is a part of the repository which the blob references are
+// attributed to. Its trees are walked recursively, its blobs are referenced
+// directly.
+type usageUnit struct {
+	trees restic.IDs
+	blobs restic.BlobHandles
+	// fileSize is the size of the files not contained in trees
+	fileSize uint64
+	// sizes is nil for units which are not reported
+	sizes *usageSizes
+}
+
+type usageTree struct {
+	refs int
+	size uint64
+}
+
+type usageBlob struct {
+	refs uint32
+	// units is the number of units which referenced the blob before it was
+	// last entered
+	units uint32
+	// enter is the unit in which the blob was last entered
+	enter uint32
+	size  uint32
+}
+
+// usageCounter computes the sizes for a sequence of units. Only the trees
+// and blobs referenced by the current unit are kept, a unit is processed
+// by adding its references first and removing those of the previous unit
+// afterwards. Similar units (e.g. consecutive snapshots) thus only require
+// loading the trees in which they differ.
+type usageCounter struct {
+	repo restic.Repository
+
+	trees map[restic.ID]*usageTree
+	blobs map[restic.BlobHandle]usageBlob
+	unit  uint32
+	// size is the size of the blobs referenced by the current unit
+	size uint64
+}
+
+func newUsageCounter(repo restic.Repository) *usageCounter {
+	return &usageCounter{
+		repo:  repo,
+		trees: make(map[restic.ID]*usageTree),
+		blobs: make(map[restic.BlobHandle]usageBlob),
+	}
+}
+
+func (c *usageCounter) addBlob(h restic.BlobHandle) error {
+	b, ok := c.blobs[h]
+	if !ok {
+		pbs := c.repo.Index().Lookup(h)
+		if len(pbs) == 0 {
+			return errors.Errorf("blob %v not found", h)
+		}
+		b.size = uint32(pbs[0].Length)
+	}
+	if b.refs == 0 {
+		b.enter = c.unit
+		c.size += uint64(b.size)
+	}
+	b.refs++
+	c.blobs[h] = b
+	return nil
+}
+
+func (c *usageCounter) removeBlob(h restic.BlobHandle) {
+	b := c.blobs[h]
+	b.refs--
+	if b.refs == 0 {
+		b.units += c.unit - b.enter
+		c.size -= uint64(b.size)
+	}
+	c.blobs[h] = b
+}
+
+func (c *usageCounter) addTree(ctx context.Context, id restic.ID) (*usageTree, error) {
+	if t, ok := c.trees[id]; ok {
+		t.refs++
+		return t, nil
+	}
+
+	tree, err := restic.LoadTree(ctx, c.repo, id)
+	if err != nil {
+		return nil, err
+	}
+	t := &usageTree{refs: 1}
+	c.trees[id] = t
+	if err := c.addBlob(restic.BlobHandle{ID: id, Type: restic.TreeBlob}); err != nil {
+		return nil, err
+	}
+
+	for _, node := range tree.Nodes {
+		switch {
+		case node.Type == "file":
+			t.size += node.Size
+			for _, blob := range node.Content {
+				if err := c.addBlob(restic.BlobHandle{ID: blob, Type: restic.DataBlob}); err != nil {
+					return nil, err
+				}
+			}
+		case node.Type == "dir" && node.Subtree != nil:
+			sub, err := c.addTree(ctx, *node.Subtree)
+			if err != nil {
+				return nil, err
+			}
+			t.size += sub.size
+		}
+	}
+	return t, nil
+}
+
+func (c *usageCounter) removeTree(ctx context.Context, id restic.ID) error {
+	t := c.trees[id]
+	t.refs--
+	if t.refs > 0 {
+		return nil
+	}
+	delete(c.trees, id)
+
+	tree, err := restic.LoadTree(ctx, c.repo, id)
+	if err != nil {
+		return err
+	}
+	c.removeBlob(restic.BlobHandle{ID: id, Type: restic.TreeBlob})
+	for _, node := range tree.Nodes {
+		switch {
+		case node.Type == "file":
+			for _, blob := range node.Content {
+				c.removeBlob(restic.BlobHandle{ID: blob, Type: restic.DataBlob})
+			}
+		case node.Type == "dir" && node.Subtree != nil:
+			if err := c.removeTree(ctx, *node.Subtree); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *usageCounter) add(ctx context.Context, u *usageUnit) (restoreSize uint64, err error) {
+	restoreSize = u.fileSize
+	for _, id := range u.trees {
+		t, err := c.addTree(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		restoreSize += t.size
+	}
+	for _, h := range u.blobs {
+		if err := c.addBlob(h); err != nil {
+			return 0, err
+		}
+	}
+	return restoreSize, nil
+}
+
+func (c *usageCounter) remove(ctx context.Context, u *usageUnit) error {
+	for _, id := range u.trees {
+		if err := c.removeTree(ctx, id); err != nil {
+			return err
+		}
+	}
+	for _, h := range u.blobs {
+		c.removeBlob(h)
+	}
+	return nil
+}
+
+// run computes the sizes of all units. A blob is unique to a unit if no
+// other unit references it.
+func (c *usageCounter) run(ctx context.Context, units []*usageUnit, bar func()) error {
+	for i, u := range units {
+		c.unit = uint32(i)
+		restoreSize, err := c.add(ctx, u)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if err := c.remove(ctx, units[i-1]); err != nil {
+				return err
+			}
+		}
+		if u.sizes != nil {
+			u.sizes.RestoreSize = restoreSize
+			u.sizes.DeduplicatedSize = c.size
+		}
+		bar()
+	}
+
+	end := uint32(len(units))
+	for _, b := range c.blobs {
+		total := b.units
+		if b.refs > 0 {
+			total += end - b.enter
+		}
+		if total == 1 && units[b.enter].sizes != nil {
+			units[b.enter].sizes.UniqueSize += uint64(b.size)
+		}
+	}
+	return nil
+}
+
+// splitSnapshotPath returns the path of a backup target within the tree of
+// a snapshot.
+func splitSnapshotPath(p string) string {
+	vol := filepath.VolumeName(p)
+	p = filepath.ToSlash(p)
+	if len(vol) == 2 && vol[1] == ':' {
+		// the colon of the volume name is removed by the archiver
+		p = vol[:1] + p[2:]
+	}
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// usageDirectories splits sn into the directories directly within its backup
+// targets. Everything else in sn is added to rest.
+func usageDirectories(ctx context.Context, repo restic.Repository, sn *restic.Snapshot, rest *usageUnit, dir func(string) *usageUnit) error {
+	targets := make(map[string]struct{})
+	parents := make(map[string]struct{})
+	for _, p := range sn.Paths {
+		p = splitSnapshotPath(p)
+		targets[p] = struct{}{}
+		for p != "." && p != "" {
+			p = path.Dir(p)
+			parents[p] = struct{}{}
+		}
+	}
+	parents["."] = struct{}{}
+
+	var visit func(id restic.ID, dirPath string) error
+	visit = func(id restic.ID, dirPath string) error {
+		tree, err := restic.LoadTree(ctx, repo, id)
+		if err != nil {
+			return err
+		}
+		rest.blobs = append(rest.blobs, restic.BlobHandle{ID: id, Type: restic.TreeBlob})
+		_, isTarget := targets[dirPath]
+
+		for _, node := range tree.Nodes {
+			nodePath := path.Join(dirPath, node.Name)
+			switch {
+			case node.Type == "file":
+				rest.fileSize += node.Size
+				for _, blob := range node.Content {
+					rest.blobs = append(rest.blobs, restic.BlobHandle{ID: blob, Type: restic.DataBlob})
+				}
+			case node.Type != "dir" || node.Subtree == nil:
+			case isTarget:
+				u := dir("/" + nodePath)
+				u.trees = append(u.trees, *node.Subtree)
+			default:
+				_, isParent := parents[nodePath]
+				if _, ok := targets[nodePath]; ok || isParent {
+					if err := visit(*node.Subtree, nodePath); err != nil {
+						return err
+					}
+				} else {
+					rest.trees = append(rest.trees, *node.Subtree)
+				}
+			}
+		}
+		return nil
+	}
+	return visit(*sn.Tree, ".")
+}
+
+// usageSnapshotOrder sorts snapshots such that similar snapshots are
+// adjacent.
+func usageSnapshotOrder(list restic.Snapshots) {
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		if pa, pb := strings.Join(a.Paths, "\x00"), strings.Join(b.Paths, "\x00"); pa != pb {
+			return pa < pb
+		}
+		return a.Time.Before(b.Time)
+	})
+}
+
+func statsSnapshotUsage(ctx context.Context, repo restic.Repository, snapshotLister restic.Lister, opts StatsOptions, gopts GlobalOptions, args []string) error {
+	selected := restic.NewIDSet()
+	var snapshots restic.Snapshots
+	for sn := range FindFilteredSnapshots(ctx, snapshotLister, repo, &opts.SnapshotFilter, args) {
+		if sn.Tree == nil {
+			return errors.Fatalf("snapshot %s has nil tree", sn.ID().Str())
+		}
+		if !selected.Has(*sn.ID()) {
+			selected.Insert(*sn.ID())
+			snapshots = append(snapshots, sn)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the unique size also considers the snapshots which were not selected
+	var others restic.IDs
+	err := restic.ForAllSnapshots(ctx, snapshotLister, repo, selected, func(_ restic.ID, sn *restic.Snapshot, err error) error {
+		if err != nil {
+			return err
+		}
+		if sn.Tree != nil {
+			others = append(others, *sn.Tree)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var usage []*snapshotUsage
+	if opts.GroupBy != (restic.SnapshotGroupByOptions{}) {
+		groups, _, err := restic.GroupSnapshots(snapshots, opts.GroupBy)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for k := range groups {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var key restic.SnapshotGroupKey
+			if err := json.Unmarshal([]byte(k), &key); err != nil {
+				return err
+			}
+			list := groups[k]
+			sort.Sort(list)
+			usage = append(usage, &snapshotUsage{GroupKey: &key, list: list})
+		}
+	} else {
+		usageSnapshotOrder(snapshots)
+		for _, sn := range snapshots {
+			usage = append(usage, &snapshotUsage{list: restic.Snapshots{sn}})
+		}
+	}
+
+	var units []*usageUnit
+	for _, u := range usage {
+		unit := &usageUnit{sizes: &u.usageSizes}
+		for _, sn := range u.list {
+			u.Snapshots = append(u.Snapshots, sn.ID().String())
+			unit.trees = append(unit.trees, *sn.Tree)
+		}
+		units = append(units, unit)
+	}
+	if len(others) > 0 {
+		units = append(units, &usageUnit{trees: others})
+	}
+
+	bar := newProgressMax(!gopts.Quiet && !gopts.JSON, uint64(len(units)), "snapshot groups processed")
+	err = newUsageCounter(repo).run(ctx, units, func() { bar.Add(1) })
+	bar.Done()
+	if err != nil {
+		return err
+	}
+
+	if opts.perDirectory {
+		err = statsDirectoryUsage(ctx, repo, usage, others, gopts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.GroupBy == (restic.SnapshotGroupByOptions{}) {
+		// report single snapshots in chronological order
+		sort.SliceStable(usage, func(i, j int) bool {
+			return usage[i].list[0].Time.Before(usage[j].list[0].Time)
+		})
+	}
+
+	if gopts.JSON {
+		err = json.NewEncoder(globalOptions.stdout).Encode(usage)
+		if err != nil {
+			return fmt.Errorf("encoding output: %v", err)
+		}
+		return nil
+	}
+
+	printSnapshotUsage(usage, opts.GroupBy != (restic.SnapshotGroupByOptions{}), opts.perDirectory)
+	return nil
+}
+
+// statsDirectoryUsage computes the sizes of the directories in the backup
+// targets of the snapshots. The unique size of a directory only counts blobs
+// which are not referenced by other directories of the same group either.
+func statsDirectoryUsage(ctx context.Context, repo restic.Repository, usage []*snapshotUsage, others restic.IDs, gopts GlobalOptions) error {
+	type dirKey struct {
+		path  string
+		group int
+	}
+	dirUnits := make(map[dirKey]*usageUnit)
+	var rest []*usageUnit
+
+	for i, u := range usage {
+		unit := &usageUnit{}
+		rest = append(rest, unit)
+		for _, sn := range u.list {
+			err := usageDirectories(ctx, repo, sn, unit, func(p string) *usageUnit {
+				k := dirKey{p, i}
+				if dirUnits[k] == nil {
+					d := &directoryUsage{Path: p}
+					u.Directories = append(u.Directories, d)
+					dirUnits[k] = &usageUnit{sizes: &d.usageSizes}
+				}
+				return dirUnits[k]
+			})
+			if err != nil {
+				return err
+			}
+		}
+		sort.Slice(u.Directories, func(i, j int) bool {
+			return u.Directories[i].Path < u.Directories[j].Path
+		})
+	}
+
+	// the same directory of different groups is most likely similar
+	var keys []dirKey
+	for k := range dirUnits {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].group < keys[j].group
+	})
+
+	units := rest
+	for _, k := range keys {
+		units = append(units, dirUnits[k])
+	}
+	if len(others) > 0 {
+		units = append(units, &usageUnit{trees: others})
+	}
+
+	bar := newProgressMax(!gopts.Quiet && !gopts.JSON, uint64(len(units)), "directories processed")
+	defer bar.Done()
+	return newUsageCounter(repo).run(ctx, units, func() { bar.Add(1) })
+}
+
+func printSnapshotUsage(usage []*snapshotUsage, grouped, perDirectory bool) {
+	tab := table.New()
+	if grouped {
+		tab.AddColumn("Group", "{{ .Group }}")
+		tab.AddColumn("Snapshots", "{{ .Snapshots }}")
+	} else {
+		tab.AddColumn("ID", "{{ .Snapshots }}")
+		tab.AddColumn("Time", "{{ .Time }}")
+	}
+	if !grouped || perDirectory {
+		tab.AddColumn("Path", "{{ .Path }}")
+	}
+	tab.AddColumn("Restore Size", "{{ .RestoreSize }}")
+	tab.AddColumn("Deduplicated Size", "{{ .DeduplicatedSize }}")
+	tab.AddColumn("Unique Size", "{{ .UniqueSize }}")
+
+	type row struct {
+		Group, Snapshots, Time, Path              string
+		RestoreSize, DeduplicatedSize, UniqueSize string
+	}
+	newRow := func(s usageSizes) row {
+		return row{
+			RestoreSize:      ui.FormatBytes(s.RestoreSize),
+			DeduplicatedSize: ui.FormatBytes(s.DeduplicatedSize),
+			UniqueSize:       ui.FormatBytes(s.UniqueSize),
+		}
+	}
+
+	for _, u := range usage {
+		r := newRow(u.usageSizes)
+		if grouped {
+			r.Group = formatGroupKey(*u.GroupKey)
+			r.Snapshots = fmt.Sprintf("%d", len(u.list))
+		} else {
+			r.Snapshots = u.list[0].ID().Str()
+			r.Time = u.list[0].Time.Local().Format(TimeFormat)
+			r.Path = strings.Join(u.list[0].Paths, ", ")
+		}
+		tab.AddRow(r)
+
+		for _, d := range u.Directories {
+			r := newRow(d.usageSizes)
+			r.Path = d.Path
+			tab.AddRow(r)
+		}
+	}
+
+	err := tab.Write(globalOptions.stdout)
+	if err != nil {
+		Warnf("error printing: %v\n", err)
+	}
+}
+
+func formatGroupKey(key restic.SnapshotGroupKey) string {
+	var s []string
+	if key.Hostname != "" {
+		s = append(s, "host ["+key.Hostname+"]")
+	}
+	if key.Tags != nil {
+		s = append(s, "tags ["+strings.Join(key.Tags, ", ")+"]")
+	}
+	if key.Paths != nil {
+		s = append(s, "paths ["+strings.Join(key.Paths, ", ")+"]")
+	}
+	return strings.Join(s, ", ")
+}
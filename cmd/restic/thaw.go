@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+
+	"github.com/spf13/pflag"
+)
+
+// defaultThawInterval is the time between checks whether pack files have
+// been restored from cold storage. Restores usually take several hours.
+const defaultThawInterval = 10 * time.Minute
+
+type thawOptions struct {
+	Thaw         bool
+	ThawInterval time.Duration
+}
+
+func initThawOptions(f *pflag.FlagSet, opts *thawOptions) {
+	f.BoolVar(&opts.Thaw, "thaw", false, "request the restore of pack files in cold storage and wait until they can be read")
+	f.DurationVar(&opts.ThawInterval, "thaw-interval", defaultThawInterval, "check for restored pack files in cold storage every `interval`")
+}
+
+// thawPacks makes sure that the pack files can be read. If some of them are
+// in cold storage and opts.Thaw is not set, they are listed and an error is
+// returned.
+func thawPacks(ctx context.Context, repo restic.Repository, packs restic.IDs, opts thawOptions, gopts GlobalOptions) error {
+	lastPending := -1
+	err := repository.ThawPacks(ctx, repo, packs, repository.ThawOptions{
+		Request:      opts.Thaw,
+		PollInterval: opts.ThawInterval,
+		Progress: func(pending, total int) {
+			if !opts.Thaw || pending == 0 || pending == lastPending || gopts.JSON {
+				return
+			}
+			lastPending = pending
+			Verbosef("waiting for %d of %d pack files to be restored from cold storage\n", pending, total)
+		},
+	})
+
+	var cerr *repository.ColdPacksError
+	if errors.As(err, &cerr) {
+		Warnf("The following pack files are in cold storage and must be restored before they can be read:\n")
+		for _, id := range cerr.Packs {
+			Warnf("  %v\n", id)
+		}
+		return errors.Fatalf("%v, restore them or use --thaw to request their restore", err)
+	}
+	return err
+}
@@ -24,6 +24,7 @@ require (
 	github.com/restic/chunker v0.4.0
 	github.com/spf13/cobra v1.7.0
 	github.com/spf13/pflag v1.0.5
+	github.com/zeebo/blake3 v0.2.4
 	go.uber.org/automaxprocs v1.5.3
 	golang.org/x/crypto v0.17.0
 	golang.org/x/net v0.19.0
@@ -83,6 +83,44 @@ type Archiver struct {
 	// CompleteBlob is called for all saved blobs for files.
 	CompleteBlob func(bytes uint64)
 
+	// CompleteUnknownSizeBlob, if set, is called instead of CompleteBlob for
+	// the blobs of files with an unknown size. The Scanner does not include
+	// them in the total, so progress reports can count them separately.
+	CompleteUnknownSizeBlob func(bytes uint64)
+
+	// Warn, if set, is called once per run for each requested feature which
+	// is not supported by the file system, see fs.Capabilities.
+	Warn func(msg string)
+
+	// Stalled is called with the time reading was blocked because the limit
+	// Options.MaxInFlightBytes was reached, which hints at a slow backend.
+	//
+	// Stalled may be called asynchronously from several different
+	// goroutines!
+	Stalled func(d time.Duration)
+
+	// FileProgress, if set, is called periodically while a file is read,
+	// see Options.FileProgressBytes and Options.FileProgressInterval. The
+	// parameter total is the size of the file when reading started, or the
+	// number of bytes read if the file has grown since.
+	//
+	// FileProgress may be called asynchronously from several different
+	// goroutines!
+	FileProgress func(item string, read, total uint64)
+
+	// ChangedFile, if set, is called for each regular file which is read
+	// because it is not contained in the parent snapshot or has changed
+	// since. size is the size of the file when it is opened.
+	//
+	// ChangedFile may be called asynchronously from several different
+	// goroutines!
+	ChangedFile func(item string, reason ChangeReason, size uint64)
+
+	// ReadDevices saves the contents of block and character devices like
+	// regular files instead of only the device node. The resulting nodes have
+	// DeviceType set.
+	ReadDevices bool
+
 	// WithAtime configures if the access time for files and directories should
 	// be saved. Enabling it may result in much metadata, so it's off by
 	// default.
@@ -90,14 +128,83 @@ type Archiver struct {
 
 	// Flags controlling change detection. See doc/040_backup.rst for details.
 	ChangeIgnoreFlags uint
+
+	// ChangeDetection selects how files are compared to the parent snapshot.
+	// The mode is recorded in the snapshot.
+	ChangeDetection ChangeDetection
+
+	// ExcludeXattrPatterns lists patterns for names of extended attributes
+	// which are not saved, for example "user.dropbox.*". The syntax is the one
+	// of path.Match. If SkipACLs is set, the extended attributes holding
+	// access control lists are not saved either. The excluded names are
+	// recorded in the snapshot.
+	ExcludeXattrPatterns []string
+	SkipACLs             bool
+
+	// Order is the order in which the entries of a directory are processed.
+	// Regardless of it, the nodes are always stored byte-wise sorted in the
+	// tree.
+	Order Order
+
+	// TolerateDirErrors keeps directories which cannot be listed in the
+	// snapshot if Error suppresses the error. They are saved without
+	// contents and the error message is recorded in the node. Otherwise such
+	// directories are left out entirely.
+	TolerateDirErrors bool
+
+	// parents are the directories from the target down to the directory
+	// currently being saved, used to detect cycles when following symlinks.
+	parents *dirChain
+
+	// hardLinks is the index of files with several hard links saved in
+	// the current backup run.
+	hardLinks *hardLinkIndex
 }
 
 // Flags for the ChangeIgnoreFlags bitfield.
 const (
 	ChangeIgnoreCtime = 1 << iota
 	ChangeIgnoreInode
+
+	// changeSecondsOnlyMtime compares modification times with a resolution
+	// of one second, it is set for file systems which do not report more.
+	changeSecondsOnlyMtime
 )
 
+// ChangeDetection selects which attributes of a file are compared to the
+// node in the parent snapshot to decide whether the file needs to be read.
+type ChangeDetection uint
+
+const (
+	// ChangeDetectionDefault compares ctime, mtime, size and inode, subject
+	// to ChangeIgnoreFlags.
+	ChangeDetectionDefault ChangeDetection = iota
+	// ChangeDetectionMtimeSize only compares mtime and size.
+	ChangeDetectionMtimeSize
+	// ChangeDetectionForceRescan always reads all files.
+	ChangeDetectionForceRescan
+)
+
+var changeDetectionNames = []string{"default", "mtime-size", "force-rescan"}
+
+func (c ChangeDetection) String() string {
+	if int(c) < len(changeDetectionNames) {
+		return changeDetectionNames[c]
+	}
+	return fmt.Sprintf("ChangeDetection(%d)", uint(c))
+}
+
+// ParseChangeDetection returns the ChangeDetection for the name returned by
+// its String method.
+func ParseChangeDetection(s string) (ChangeDetection, error) {
+	for i, name := range changeDetectionNames {
+		if s == name {
+			return ChangeDetection(i), nil
+		}
+	}
+	return 0, errors.Errorf("invalid change detection mode %q, must be one of %v", s, strings.Join(changeDetectionNames, ", "))
+}
+
 // Options is used to configure the archiver.
 type Options struct {
 	// ReadConcurrency sets how many files are read in concurrently. If
@@ -113,6 +220,35 @@ type Options struct {
 	// SaveTreeConcurrency sets how many trees are marshalled and saved to the
 	// repo concurrently.
 	SaveTreeConcurrency uint
+
+	// LargeFileReadConcurrency sets how many goroutines read different parts
+	// of a single file which is at least LargeFileThreshold bytes large. The
+	// data is still chunked in order, so the resulting blobs are the same as
+	// for a sequential read. If it's set to zero or one, files are always
+	// read sequentially.
+	LargeFileReadConcurrency uint
+
+	// LargeFileThreshold is the minimum size of a file for it to be read
+	// concurrently. If it's set to zero, the default is 128 MiB.
+	LargeFileThreshold uint64
+
+	// ModifiedFileRetries sets how often a file which changed while it was
+	// read is read again. If it still changes, the node is saved with
+	// ModifiedDuringBackup set.
+	ModifiedFileRetries uint
+
+	// MaxInFlightBytes limits the size of the blobs which have been read but
+	// not yet stored by the repository. Reading files blocks while the limit
+	// is reached. If it's set to zero, the default is the pack size times the
+	// number of backend connections.
+	MaxInFlightBytes uint64
+
+	// FileProgressBytes and FileProgressInterval control how often
+	// Archiver.FileProgress is called while a file is read: once at least
+	// FileProgressBytes have been read or FileProgressInterval has passed
+	// since the previous call. The defaults are 64 MiB and one second.
+	FileProgressBytes    uint64
+	FileProgressInterval time.Duration
 }
 
 // ApplyDefaults returns a copy of o with the default options set for all unset
@@ -131,6 +267,18 @@ func (o Options) ApplyDefaults() Options {
 		o.SaveBlobConcurrency = uint(runtime.GOMAXPROCS(0))
 	}
 
+	if o.LargeFileThreshold == 0 {
+		o.LargeFileThreshold = 128 * 1024 * 1024
+	}
+
+	if o.FileProgressBytes == 0 {
+		o.FileProgressBytes = 64 * 1024 * 1024
+	}
+
+	if o.FileProgressInterval == 0 {
+		o.FileProgressInterval = time.Second
+	}
+
 	if o.SaveTreeConcurrency == 0 {
 		// can either wait for a file, wait for a tree, serialize a tree or wait for saveblob
 		// the last two are cpu-bound and thus mutually exclusive.
@@ -155,6 +303,7 @@ func New(repo restic.Repository, fs fs.FS, opts Options) *Archiver {
 		CompleteItem: func(string, *restic.Node, *restic.Node, ItemStats, time.Duration) {},
 		StartFile:    func(string) {},
 		CompleteBlob: func(uint64) {},
+		Stalled:      func(time.Duration) {},
 	}
 
 	return arch
@@ -188,6 +337,10 @@ func (arch *Archiver) nodeFromFileInfo(snPath, filename string, fi os.FileInfo)
 	if !arch.WithAtime {
 		node.AccessTime = node.ModTime
 	}
+	arch.filterExtendedAttributes(node)
+	if dev, ok := fi.(*deviceFileInfo); ok {
+		node.DeviceType = dev.deviceType
+	}
 	// overwrite name to match that within the snapshot
 	node.Name = path.Base(snPath)
 	if err != nil {
@@ -196,6 +349,69 @@ func (arch *Archiver) nodeFromFileInfo(snPath, filename string, fi os.FileInfo)
 	return node, err
 }
 
+// aclXattrs are the names of the extended attributes used to store access
+// control lists.
+var aclXattrs = fs.ACLAttributes
+
+// excludedXattrs returns the patterns for all extended attributes which are
+// not saved.
+func (arch *Archiver) excludedXattrs() []string {
+	patterns := append([]string(nil), arch.ExcludeXattrPatterns...)
+	if arch.SkipACLs {
+		patterns = append(patterns, aclXattrs...)
+	}
+	return patterns
+}
+
+// filterExtendedAttributes removes the excluded extended attributes from node.
+func (arch *Archiver) filterExtendedAttributes(node *restic.Node) {
+	if len(node.ExtendedAttributes) == 0 || (len(arch.ExcludeXattrPatterns) == 0 && !arch.SkipACLs) {
+		return
+	}
+
+	patterns := arch.excludedXattrs()
+	attrs := node.ExtendedAttributes[:0]
+	for _, attr := range node.ExtendedAttributes {
+		if matchXattr(patterns, attr.Name) {
+			debug.Log("%v: not saving extended attribute %v", node.Name, attr.Name)
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+
+	if len(attrs) == 0 {
+		attrs = nil
+	}
+	node.ExtendedAttributes = attrs
+}
+
+// matchXattr returns true if name matches one of the patterns.
+func matchXattr(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// invalid patterns never match, they are rejected by ValidateXattrPattern
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateXattrPattern returns an error if pattern is not a valid pattern for
+// ExcludeXattrPatterns.
+func ValidateXattrPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.Errorf("invalid extended attribute pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// tolerateDirError returns true if the directory for which listing the
+// contents failed with err should be kept. It is used by both the Archiver and
+// the Scanner, so that the estimated and actual numbers of directories match.
+func tolerateDirError(tolerate bool, err error) bool {
+	return tolerate && !errors.Is(err, context.Canceled)
+}
+
 // loadSubtree tries to load the subtree referenced by node. In case of an error, nil is returned.
 // If there is no node to load, then nil is returned without an error.
 func (arch *Archiver) loadSubtree(ctx context.Context, node *restic.Node) (*restic.Tree, error) {
@@ -232,11 +448,37 @@ func (arch *Archiver) SaveDir(ctx context.Context, snPath string, dir string, fi
 		return FutureNode{}, err
 	}
 
+	// SaveDir descends into subdirectories synchronously, so the chain of
+	// parents can be kept in arch
+	if key, ok := fileKey(fi); ok {
+		if arch.parents.contains(key) {
+			debug.Log("directory %v is one of its own parents", dir)
+			return FutureNode{}, fmt.Errorf("%v: %w", dir, ErrCycleDetected)
+		}
+		parents := arch.parents
+		arch.parents = &dirChain{key: key, parent: parents}
+		defer func() {
+			arch.parents = parents
+		}()
+	}
+
 	names, err := readdirnames(arch.FS, dir, fs.O_NOFOLLOW)
 	if err != nil {
-		return FutureNode{}, err
+		if !tolerateDirError(arch.TolerateDirErrors, err) {
+			return FutureNode{}, err
+		}
+
+		msg := err.Error()
+		err = arch.error(dir, err)
+		if err != nil {
+			return FutureNode{}, err
+		}
+
+		debug.Log("unable to list %v, saving it without contents: %v", dir, msg)
+		treeNode.Error = msg
+		names = nil
 	}
-	sort.Strings(names)
+	SortNames(names, arch.Order)
 
 	nodes := make([]FutureNode, 0, len(names))
 
@@ -375,80 +617,31 @@ func (arch *Archiver) Save(ctx context.Context, snPath, target string, previous
 	case fs.IsRegularFile(fi):
 		debug.Log("  %v regular file", target)
 
-		// check if the file has not changed before performing a fopen operation (more expensive, specially
-		// in network filesystems)
-		if previous != nil && !fileChanged(fi, previous, arch.ChangeIgnoreFlags) {
-			if arch.allBlobsPresent(previous) {
-				debug.Log("%v hasn't changed, using old list of blobs", target)
-				arch.CompleteItem(snPath, previous, previous, ItemStats{}, time.Since(start))
-				arch.CompleteBlob(previous.Size)
-				node, err := arch.nodeFromFileInfo(snPath, target, fi)
-				if err != nil {
-					return FutureNode{}, false, err
-				}
-
-				// copy list of blobs
-				node.Content = previous.Content
-
-				fn = newFutureNodeWithResult(futureNodeResult{
-					snPath: snPath,
-					target: target,
-					node:   node,
-				})
-				return fn, false, nil
-			}
-
-			debug.Log("%v hasn't changed, but contents are missing!", target)
-			// There are contents missing - inform user!
-			err := errors.Errorf("parts of %v not found in the repository index; storing the file again", target)
-			err = arch.error(abstarget, err)
+		link, first := arch.hardLinks.add(fi)
+		if !first {
+			debug.Log("%v is another link to a file which is saved already", target)
+			fn, err = arch.saveHardLink(ctx, snPath, target, fi, link, previous, start)
 			if err != nil {
 				return FutureNode{}, false, err
 			}
+			break
 		}
 
-		// reopen file and do an fstat() on the open file to check it is still
-		// a file (and has not been exchanged for e.g. a symlink)
-		file, err := arch.FS.OpenFile(target, fs.O_RDONLY|fs.O_NOFOLLOW, 0)
-		if err != nil {
-			debug.Log("Openfile() for %v returned error: %v", target, err)
-			err = arch.error(abstarget, err)
-			if err != nil {
-				return FutureNode{}, false, errors.WithStack(err)
-			}
-			return FutureNode{}, true, nil
+		fn, excluded, err = arch.saveRegularFile(ctx, snPath, target, abstarget, fi, previous, start, link)
+		if err != nil || excluded {
+			link.complete(nil)
+			return FutureNode{}, excluded, err
 		}
 
-		fi, err = file.Stat()
-		if err != nil {
-			debug.Log("stat() on opened file %v returned error: %v", target, err)
-			_ = file.Close()
-			err = arch.error(abstarget, err)
-			if err != nil {
-				return FutureNode{}, false, errors.WithStack(err)
-			}
-			return FutureNode{}, true, nil
-		}
+	case arch.ReadDevices && fs.IsDevice(fi):
+		debug.Log("  %v device, saving its contents", target)
 
-		// make sure it's still a file
-		if !fs.IsRegularFile(fi) {
-			err = errors.Errorf("file %v changed type, refusing to archive", fi.Name())
-			_ = file.Close()
-			err = arch.error(abstarget, err)
-			if err != nil {
-				return FutureNode{}, false, err
-			}
-			return FutureNode{}, true, nil
+		file, fi, err := arch.openFile(target, abstarget, fs.IsDevice)
+		if file == nil {
+			return FutureNode{}, err == nil, err
 		}
 
-		// Save will close the file, we don't need to do that
-		fn = arch.fileSaver.Save(ctx, snPath, target, file, fi, func() {
-			arch.StartFile(snPath)
-		}, func() {
-			arch.CompleteItem(snPath, nil, nil, ItemStats{}, 0)
-		}, func(node *restic.Node, stats ItemStats) {
-			arch.CompleteItem(snPath, previous, node, stats, time.Since(start))
-		})
+		fn = arch.saveFile(ctx, snPath, target, file, newDeviceFileInfo(file, fi), previous, start, nil)
 
 	case fi.IsDir():
 		debug.Log("  %v dir", target)
@@ -494,20 +687,215 @@ func (arch *Archiver) Save(ctx context.Context, snPath, target string, previous
 	return fn, false, nil
 }
 
+// saveRegularFile saves the regular file target, or reuses the content of
+// previous if the file has not changed. For the first link to a file with
+// several hard links, link is completed with the resulting node.
+func (arch *Archiver) saveRegularFile(ctx context.Context, snPath, target, abstarget string, fi os.FileInfo, previous *restic.Node, start time.Time, link *hardLink) (FutureNode, bool, error) {
+	// check if the file has not changed before performing a fopen operation (more expensive, specially
+	// in network filesystems)
+	reason := arch.changeReason(fi, previous)
+	if reason == "" {
+		if arch.allBlobsPresent(previous) {
+			debug.Log("%v hasn't changed, using old list of blobs", target)
+			arch.CompleteItem(snPath, previous, previous, ItemStats{}, time.Since(start))
+			arch.CompleteBlob(previous.Size)
+			node, err := arch.nodeFromFileInfo(snPath, target, fi)
+			if err != nil {
+				return FutureNode{}, false, err
+			}
+
+			// copy list of blobs
+			node.Content = previous.Content
+			link.complete(node)
+
+			fn := newFutureNodeWithResult(futureNodeResult{
+				snPath: snPath,
+				target: target,
+				node:   node,
+			})
+			return fn, false, nil
+		}
+
+		debug.Log("%v hasn't changed, but contents are missing!", target)
+		// There are contents missing - inform user!
+		err := errors.Errorf("parts of %v not found in the repository index; storing the file again", target)
+		err = arch.error(abstarget, err)
+		if err != nil {
+			return FutureNode{}, false, err
+		}
+		reason = ChangeMissingBlobs
+	}
+
+	file, fi, err := arch.openFile(target, abstarget, fs.IsRegularFile)
+	if file == nil {
+		return FutureNode{}, err == nil, err
+	}
+	if arch.ChangedFile != nil {
+		var size uint64
+		if fi.Size() > 0 {
+			size = uint64(fi.Size())
+		}
+		arch.ChangedFile(snPath, reason, size)
+	}
+
+	return arch.saveFile(ctx, snPath, target, file, fi, previous, start, link), false, nil
+}
+
+// saveHardLink returns the node for another link to a file whose first link
+// is saved via link. The content is copied from that node once it is
+// available, the file is not read again.
+func (arch *Archiver) saveHardLink(ctx context.Context, snPath, target string, fi os.FileInfo, link *hardLink, previous *restic.Node, start time.Time) (FutureNode, error) {
+	node, err := arch.nodeFromFileInfo(snPath, target, fi)
+	if err != nil {
+		return FutureNode{}, err
+	}
+
+	fn, ch := newFutureNode()
+	go func() {
+		defer close(ch)
+
+		select {
+		case <-link.done:
+		case <-ctx.Done():
+			return
+		}
+
+		res := futureNodeResult{snPath: snPath, target: target}
+		if link.node == nil {
+			res.err = errors.Errorf("another hard link to %v could not be saved", target)
+		} else {
+			node.Content = link.node.Content
+			node.Size = link.node.Size
+			node.ModifiedDuringBackup = link.node.ModifiedDuringBackup
+			res.node = node
+			arch.CompleteItem(snPath, previous, node, ItemStats{}, time.Since(start))
+		}
+		ch <- res
+	}()
+
+	return fn, nil
+}
+
+// openFile opens target and runs fstat() on the open file to check that it
+// still has the expected type (and has not been exchanged for e.g. a symlink).
+// If the error is suppressed by arch.error, both the file and the error are
+// nil.
+func (arch *Archiver) openFile(target, abstarget string, expectedType func(os.FileInfo) bool) (fs.File, os.FileInfo, error) {
+	file, err := arch.FS.OpenFile(target, fs.O_RDONLY|fs.O_NOFOLLOW, 0)
+	if err != nil {
+		debug.Log("Openfile() for %v returned error: %v", target, err)
+		return nil, nil, errors.WithStack(arch.error(abstarget, err))
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		debug.Log("stat() on opened file %v returned error: %v", target, err)
+		_ = file.Close()
+		return nil, nil, errors.WithStack(arch.error(abstarget, err))
+	}
+
+	if !expectedType(fi) {
+		err = errors.Errorf("file %v changed type, refusing to archive", fi.Name())
+		_ = file.Close()
+		return nil, nil, arch.error(abstarget, err)
+	}
+
+	return file, fi, nil
+}
+
+// saveFile passes the open file to the file saver, which closes it. If link
+// is not nil, it is completed with the saved node.
+func (arch *Archiver) saveFile(ctx context.Context, snPath, target string, file fs.File, fi os.FileInfo, previous *restic.Node, start time.Time, link *hardLink) FutureNode {
+	return arch.fileSaver.Save(ctx, snPath, target, file, fi, func() {
+		arch.StartFile(snPath)
+	}, func() {
+		arch.CompleteItem(snPath, nil, nil, ItemStats{}, 0)
+	}, func(node *restic.Node, stats ItemStats) {
+		link.complete(node)
+		arch.CompleteItem(snPath, previous, node, stats, time.Since(start))
+	})
+}
+
+// ChangeReason explains why a regular file is read, see Archiver.ChangedFile.
+type ChangeReason string
+
+const (
+	// ChangeNew is used for files which are not contained in the parent
+	// snapshot.
+	ChangeNew ChangeReason = "new"
+	// ChangeType is used if the parent snapshot contains another type of
+	// item at the same path.
+	ChangeType ChangeReason = "type changed"
+	// ChangeSize, ChangeMtime, ChangeCtime and ChangeInode are used if the
+	// respective metadata differs from the parent snapshot.
+	ChangeSize  ChangeReason = "size changed"
+	ChangeMtime ChangeReason = "mtime changed"
+	ChangeCtime ChangeReason = "ctime changed"
+	ChangeInode ChangeReason = "inode changed"
+	// ChangeUnknownSize is used for files whose size is only known once
+	// they have been read.
+	ChangeUnknownSize ChangeReason = "unknown size"
+	// ChangeForced is used for all files contained in the parent snapshot
+	// with ChangeDetectionForceRescan.
+	ChangeForced ChangeReason = "forced rescan"
+	// ChangeMissingBlobs is used for unchanged files whose contents are
+	// missing in the repository.
+	ChangeMissingBlobs ChangeReason = "contents missing"
+)
+
+// changeReason applies the configured ChangeDetection to decide whether a
+// file needs to be read again. It returns an empty reason for unchanged files.
+func (arch *Archiver) changeReason(fi os.FileInfo, node *restic.Node) ChangeReason {
+	flags := arch.ChangeIgnoreFlags
+	caps := fs.CapabilitiesOf(arch.FS)
+	if !caps.Has(fs.CapInodes) {
+		flags |= ChangeIgnoreInode
+	}
+	if caps.Has(fs.CapSecondsOnlyMtime) {
+		flags |= changeSecondsOnlyMtime
+	}
+
+	switch {
+	case node == nil:
+		return ChangeNew
+	case arch.ChangeDetection == ChangeDetectionForceRescan:
+		return ChangeForced
+	case arch.ChangeDetection == ChangeDetectionMtimeSize:
+		return changeReason(fi, node, flags|ChangeIgnoreCtime|ChangeIgnoreInode)
+	default:
+		return changeReason(fi, node, flags)
+	}
+}
+
 // fileChanged tries to detect whether a file's content has changed compared
 // to the contents of node, which describes the same path in the parent backup.
 // It should only be run for regular files.
 func fileChanged(fi os.FileInfo, node *restic.Node, ignoreFlags uint) bool {
+	return changeReason(fi, node, ignoreFlags) != ""
+}
+
+// changeReason returns why fileChanged considers the file changed, or an
+// empty reason.
+func changeReason(fi os.FileInfo, node *restic.Node, ignoreFlags uint) ChangeReason {
 	switch {
 	case node == nil:
-		return true
+		return ChangeNew
 	case node.Type != "file":
 		// We're only called for regular files, so this is a type change.
-		return true
+		return ChangeType
+	case fi.Size() == fs.SizeUnknown:
+		// the file must be read to know whether its size has changed
+		return ChangeUnknownSize
 	case uint64(fi.Size()) != node.Size:
-		return true
+		return ChangeSize
+	case ignoreFlags&changeSecondsOnlyMtime != 0:
+		// the parent snapshot may have been created from a file system
+		// with a higher resolution
+		if !fi.ModTime().Truncate(time.Second).Equal(node.ModTime.Truncate(time.Second)) {
+			return ChangeMtime
+		}
 	case !fi.ModTime().Equal(node.ModTime):
-		return true
+		return ChangeMtime
 	}
 
 	checkCtime := ignoreFlags&ChangeIgnoreCtime == 0
@@ -516,12 +904,12 @@ func fileChanged(fi os.FileInfo, node *restic.Node, ignoreFlags uint) bool {
 	extFI := fs.ExtendedStat(fi)
 	switch {
 	case checkCtime && !extFI.ChangeTime.Equal(node.ChangeTime):
-		return true
+		return ChangeCtime
 	case checkInode && node.Inode != extFI.Inode:
-		return true
+		return ChangeInode
 	}
 
-	return false
+	return ""
 }
 
 // join returns all elements separated with a forward slash.
@@ -572,9 +960,10 @@ func (arch *Archiver) SaveTree(ctx context.Context, snPath string, atree *Tree,
 
 	debug.Log("%v (%v nodes), parent %v", snPath, len(atree.Nodes), previous)
 	nodeNames := atree.NodeNames()
+	SortNames(nodeNames, arch.Order)
 	nodes := make([]FutureNode, 0, len(nodeNames))
 
-	// iterate over the nodes of atree in lexicographic (=deterministic) order
+	// iterate over the nodes of atree in a deterministic order
 	for _, name := range nodeNames {
 		subatree := atree.Nodes[name]
 
@@ -656,7 +1045,7 @@ func readdirnames(filesystem fs.FS, dir string, flags int) ([]string, error) {
 // resolveRelativeTargets replaces targets that only contain relative
 // directories ("." or "../../") with the contents of the directory. Each
 // element of target is processed with fs.Clean().
-func resolveRelativeTargets(filesys fs.FS, targets []string) ([]string, error) {
+func resolveRelativeTargets(filesys fs.FS, targets []string, order Order) ([]string, error) {
 	debug.Log("targets before resolving: %v", targets)
 	result := make([]string, 0, len(targets))
 	for _, target := range targets {
@@ -672,7 +1061,7 @@ func resolveRelativeTargets(filesys fs.FS, targets []string) ([]string, error) {
 		if err != nil {
 			return nil, err
 		}
-		sort.Strings(entries)
+		SortNames(entries, order)
 
 		for _, name := range entries {
 			result = append(result, filesys.Join(target, name))
@@ -691,6 +1080,61 @@ type SnapshotOptions struct {
 	Time           time.Time
 	ParentSnapshot *restic.Snapshot
 	ProgramVersion string
+	// Command is the command line whose output was saved, if any.
+	Command []string
+	// SkipIfUnchanged skips saving the snapshot if it would only differ from
+	// ParentSnapshot in its timestamp.
+	SkipIfUnchanged bool
+	// Metadata is stored in the snapshot.
+	Metadata map[string]string
+}
+
+// sameSnapshot returns true if sn references the same tree as parent and both
+// have the same hostname, paths and tags.
+func sameSnapshot(parent, sn *restic.Snapshot) bool {
+	if parent == nil || parent.Tree == nil || !parent.Tree.Equal(*sn.Tree) {
+		return false
+	}
+
+	return parent.Hostname == sn.Hostname &&
+		sameStrings(parent.Paths, sn.Paths) &&
+		sameStrings(parent.Tags, sn.Tags) &&
+		len(parent.Metadata) == len(sn.Metadata) && parent.HasMetadata(sn.Metadata)
+}
+
+// sameStrings returns true if a and b contain the same strings, regardless of
+// their order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// warnUnsupported calls Warn for the options which have no effect because the
+// file system does not support the feature.
+func (arch *Archiver) warnUnsupported() {
+	if arch.Warn == nil {
+		return
+	}
+
+	caps := fs.CapabilitiesOf(arch.FS)
+	switch {
+	case (len(arch.ExcludeXattrPatterns) > 0 || arch.SkipACLs) && !caps.Has(fs.CapXattrs):
+		arch.Warn("the file system does not support extended attributes, excluding them has no effect")
+	case arch.SkipACLs && !caps.Has(fs.CapACLs):
+		arch.Warn("the file system does not support access control lists, skipping them has no effect")
+	}
 }
 
 // loadParentTree loads a tree referenced by snapshot id. If id is null, nil is returned.
@@ -716,14 +1160,32 @@ func (arch *Archiver) loadParentTree(ctx context.Context, sn *restic.Snapshot) *
 
 // runWorkers starts the worker pools, which are stopped when the context is cancelled.
 func (arch *Archiver) runWorkers(ctx context.Context, wg *errgroup.Group) {
-	arch.blobSaver = NewBlobSaver(ctx, wg, arch.Repo, arch.Options.SaveBlobConcurrency)
+	caps := fs.CapabilitiesOf(arch.FS)
+	arch.hardLinks = nil
+	if caps.Has(fs.CapInodes | fs.CapDeviceIDs) {
+		arch.hardLinks = newHardLinkIndex()
+	}
+	maxInFlight := arch.Options.MaxInFlightBytes
+	if maxInFlight == 0 {
+		maxInFlight = uint64(arch.Repo.PackSize()) * uint64(arch.Repo.Connections())
+	}
+	arch.blobSaver = NewBlobSaver(ctx, wg, arch.Repo, arch.Options.SaveBlobConcurrency, maxInFlight)
+	arch.blobSaver.Stalled = arch.Stalled
 
 	arch.fileSaver = NewFileSaver(ctx, wg,
 		arch.blobSaver.Save,
-		arch.Repo.Config().ChunkerPolynomial,
+		arch.Repo.Config(),
 		arch.Options.ReadConcurrency, arch.Options.SaveBlobConcurrency)
 	arch.fileSaver.CompleteBlob = arch.CompleteBlob
+	arch.fileSaver.CompleteUnknownSizeBlob = arch.CompleteUnknownSizeBlob
 	arch.fileSaver.NodeFromFileInfo = arch.nodeFromFileInfo
+	arch.fileSaver.IgnoreHoles = !caps.Has(fs.CapSparseDetection)
+	arch.fileSaver.LargeFileReadConcurrency = arch.Options.LargeFileReadConcurrency
+	arch.fileSaver.LargeFileThreshold = int64(arch.Options.LargeFileThreshold)
+	arch.fileSaver.ModifiedFileRetries = arch.Options.ModifiedFileRetries
+	arch.fileSaver.FileProgress = arch.FileProgress
+	arch.fileSaver.FileProgressBytes = arch.Options.FileProgressBytes
+	arch.fileSaver.FileProgressInterval = arch.Options.FileProgressInterval
 
 	arch.treeSaver = NewTreeSaver(ctx, wg, arch.Options.SaveTreeConcurrency, arch.blobSaver.Save, arch.Error)
 }
@@ -737,9 +1199,10 @@ func (arch *Archiver) stopWorkers() {
 	arch.treeSaver = nil
 }
 
-// Snapshot saves several targets and returns a snapshot.
+// Snapshot saves several targets and returns a snapshot. If opts.SkipIfUnchanged
+// is set and nothing changed, no snapshot is saved and nil is returned.
 func (arch *Archiver) Snapshot(ctx context.Context, targets []string, opts SnapshotOptions) (*restic.Snapshot, restic.ID, error) {
-	cleanTargets, err := resolveRelativeTargets(arch.FS, targets)
+	cleanTargets, err := resolveRelativeTargets(arch.FS, targets, arch.Order)
 	if err != nil {
 		return nil, restic.ID{}, err
 	}
@@ -749,6 +1212,8 @@ func (arch *Archiver) Snapshot(ctx context.Context, targets []string, opts Snaps
 		return nil, restic.ID{}, err
 	}
 
+	arch.warnUnsupported()
+
 	var rootTreeID restic.ID
 
 	wgUp, wgUpCtx := errgroup.WithContext(ctx)
@@ -790,6 +1255,13 @@ func (arch *Archiver) Snapshot(ctx context.Context, targets []string, opts Snaps
 		err = wg.Wait()
 		debug.Log("err is %v", err)
 
+		if errors.Is(err, restic.ErrQuotaExceeded) {
+			// keep the data uploaded so far, such that the next backup does
+			// not have to upload it again
+			if ferr := arch.Repo.Flush(ctx); ferr != nil {
+				debug.Log("flush after exceeding the size limit failed: %v", ferr)
+			}
+		}
 		if err != nil {
 			debug.Log("error while saving tree: %v", err)
 			return err
@@ -808,12 +1280,21 @@ func (arch *Archiver) Snapshot(ctx context.Context, targets []string, opts Snaps
 	}
 
 	sn.ProgramVersion = opts.ProgramVersion
+	sn.Command = opts.Command
+	sn.Metadata = opts.Metadata
 	sn.Excludes = opts.Excludes
+	sn.ChangeDetection = arch.ChangeDetection.String()
+	sn.ExcludedXattrs = arch.excludedXattrs()
 	if opts.ParentSnapshot != nil {
 		sn.Parent = opts.ParentSnapshot.ID()
 	}
 	sn.Tree = &rootTreeID
 
+	if opts.SkipIfUnchanged && sameSnapshot(opts.ParentSnapshot, sn) {
+		debug.Log("snapshot is unchanged compared to parent %v, skipping", sn.Parent.Str())
+		return nil, restic.ID{}, nil
+	}
+
 	id, err := restic.SaveSnapshot(ctx, arch.Repo, sn)
 	if err != nil {
 		return nil, restic.ID{}, err
@@ -3,6 +3,7 @@ package archiver
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -203,6 +204,77 @@ func TestArchiverSaveFileReaderFS(t *testing.T) {
 	}
 }
 
+// streamReader returns the data in small pieces, like a pipe or a network
+// connection.
+type streamReader struct {
+	data []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > 4096 {
+		p = p[:4096]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestArchiverUnknownSize(t *testing.T) {
+	var tests = []struct {
+		name string
+		data string
+		size int64
+	}{
+		{name: "empty", data: "", size: fs.SizeUnknown},
+		{name: "stream", data: string(restictest.Random(23, 3*1024*1024+1234)), size: fs.SizeUnknown},
+		{name: "short", data: "short stream", size: 1024 * 1024},
+		{name: "exceeds-hint", data: string(restictest.Random(42, 100*1024)), size: 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := repository.TestRepository(t)
+			readerFs := &fs.Reader{
+				ModTime:        time.Now(),
+				Mode:           0644,
+				Name:           "stream",
+				Size:           test.size,
+				AllowEmptyFile: true,
+				ReadCloser:     io.NopCloser(&streamReader{data: []byte(test.data)}),
+			}
+
+			var sized, unknown uint64
+			arch := New(repo, readerFs, Options{})
+			arch.CompleteBlob = func(bytes uint64) { atomic.AddUint64(&sized, bytes) }
+			arch.CompleteUnknownSizeBlob = func(bytes uint64) { atomic.AddUint64(&unknown, bytes) }
+
+			sn, _, err := arch.Snapshot(context.TODO(), []string{"stream"}, SnapshotOptions{Time: time.Now()})
+			restictest.OK(t, err)
+
+			tree, err := restic.LoadTree(context.TODO(), repo, *sn.Tree)
+			restictest.OK(t, err)
+			node := tree.Find("stream")
+			restictest.Assert(t, node != nil, "stream is missing in %v", tree.Nodes)
+
+			// the size is taken from the data which was actually read
+			restictest.Equals(t, uint64(len(test.data)), node.Size)
+			restictest.Assert(t, !node.ModifiedDuringBackup, "stream is marked as modified")
+			TestEnsureFileContent(context.TODO(), t, repo, "stream", node, TestFile{Content: test.data})
+
+			if test.size == fs.SizeUnknown {
+				restictest.Equals(t, uint64(0), sized)
+				restictest.Equals(t, uint64(len(test.data)), unknown)
+			} else {
+				restictest.Equals(t, uint64(len(test.data)), sized)
+				restictest.Equals(t, uint64(0), unknown)
+			}
+		})
+	}
+}
+
 func TestArchiverSave(t *testing.T) {
 	var tests = []TestFile{
 		{Content: ""},
@@ -412,6 +484,39 @@ func BenchmarkArchiverSaveFileLarge(b *testing.B) {
 	}
 }
 
+func TestArchiverSaveFileBlobHash(t *testing.T) {
+	repository.TestAllBlobHashers(t, func(t *testing.T, hasher restic.BlobHasher) {
+		content := restictest.Random(5, 12345)
+		tempdir := restictest.TempDir(t)
+		TestCreateFiles(t, tempdir, TestDir{"file": TestFile{Content: string(content)}})
+		repo := repository.TestRepositoryWithBlobHasher(t, hasher)
+
+		node, _ := saveFile(t, repo, filepath.Join(tempdir, "file"), fs.Track{FS: fs.Local{}})
+		restictest.Equals(t, restic.IDs{hasher.Hash(content)}, node.Content)
+	})
+}
+
+func BenchmarkArchiverSaveFileBlobHash(b *testing.B) {
+	const fileSize = 40*1024*1024 + 1287898
+	d := TestDir{"file": TestFile{
+		Content: string(restictest.Random(23, fileSize)),
+	}}
+
+	repository.BenchmarkAllBlobHashers(b, func(b *testing.B, hasher restic.BlobHasher) {
+		b.SetBytes(fileSize)
+
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tempdir := restictest.TempDir(b)
+			TestCreateFiles(b, tempdir, d)
+			repo := repository.TestRepositoryWithBlobHasher(b, hasher)
+			b.StartTimer()
+
+			saveFile(b, repo, filepath.Join(tempdir, "file"), fs.Track{FS: fs.Local{}})
+		}
+	})
+}
+
 type blobCountingRepo struct {
 	restic.Repository
 
@@ -732,6 +837,31 @@ func TestFilChangedSpecialCases(t *testing.T) {
 	})
 }
 
+func TestChangeReason(t *testing.T) {
+	tempdir := restictest.TempDir(t)
+
+	filename := filepath.Join(tempdir, "file")
+	save(t, filename, []byte("foobar"))
+	fi := lstat(t, filename)
+	node := nodeFromFI(t, filename, fi)
+
+	arch := New(nil, fs.Local{}, Options{})
+	restictest.Equals(t, ChangeReason(""), arch.changeReason(fi, node))
+	restictest.Equals(t, ChangeNew, arch.changeReason(fi, nil))
+
+	sized := *node
+	sized.Size++
+	restictest.Equals(t, ChangeSize, arch.changeReason(fi, &sized))
+
+	modified := *node
+	modified.ModTime = node.ModTime.Add(time.Hour)
+	restictest.Equals(t, ChangeMtime, arch.changeReason(fi, &modified))
+
+	arch.ChangeDetection = ChangeDetectionForceRescan
+	restictest.Equals(t, ChangeForced, arch.changeReason(fi, node))
+	restictest.Equals(t, ChangeNew, arch.changeReason(fi, nil))
+}
+
 func TestArchiverSaveDir(t *testing.T) {
 	const targetNodeName = "targetdir"
 
@@ -1573,6 +1703,210 @@ func TestArchiverSnapshotSelect(t *testing.T) {
 	}
 }
 
+// readdirErrorFS returns an error when listing directories called name.
+type readdirErrorFS struct {
+	fs.FS
+	name string
+}
+
+func (f readdirErrorFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil || filepath.Base(name) != f.name {
+		return file, err
+	}
+	return readdirErrorFile{File: file}, nil
+}
+
+type readdirErrorFile struct {
+	fs.File
+}
+
+func (f readdirErrorFile) Readdirnames(_ int) ([]string, error) {
+	return nil, errors.New("input/output error")
+}
+
+func TestArchiverTolerateDirErrors(t *testing.T) {
+	src := TestDir{
+		"good": TestDir{
+			"file": TestFile{Content: "foo"},
+		},
+		"bad": TestDir{
+			"file": TestFile{Content: "bar"},
+		},
+		"other": TestFile{Content: "another file"},
+	}
+
+	for _, tolerate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%v", tolerate), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tempdir, repo := prepareTempdirRepoSrc(t, src)
+			back := restictest.Chdir(t, tempdir)
+			defer back()
+
+			testFS := readdirErrorFS{FS: fs.Local{}, name: "bad"}
+			var failed []string
+			errorFn := func(item string, err error) error {
+				failed = append(failed, filepath.Base(item))
+				return nil
+			}
+
+			sc := NewScanner(testFS)
+			sc.Error = errorFn
+			sc.TolerateDirErrors = tolerate
+			var scanStats ScanStats
+			sc.Result = func(item string, s ScanStats) {
+				if item == "" {
+					scanStats = s
+				}
+			}
+			restictest.OK(t, sc.Scan(ctx, []string{"."}))
+
+			arch := New(repo, testFS, Options{})
+			arch.Error = errorFn
+			arch.TolerateDirErrors = tolerate
+			var dirs uint
+			arch.CompleteItem = func(item string, previous, current *restic.Node, s ItemStats, d time.Duration) {
+				if current != nil && current.Type == "dir" && item != "/" {
+					dirs++
+				}
+			}
+
+			sn, snapshotID, err := arch.Snapshot(ctx, []string{"."}, SnapshotOptions{Time: time.Now()})
+			restictest.OK(t, err)
+			restictest.Equals(t, []string{"bad", "bad"}, failed)
+			restictest.Equals(t, scanStats.Dirs, dirs)
+			restictest.Equals(t, uint(1), scanStats.Errors)
+
+			want := TestDir{
+				"good":  src["good"],
+				"other": src["other"],
+			}
+			if tolerate {
+				want["bad"] = TestDir{}
+			}
+			TestEnsureSnapshot(t, repo, snapshotID, want)
+
+			tree, err := restic.LoadTree(ctx, repo, *sn.Tree)
+			restictest.OK(t, err)
+			node := tree.Find("bad")
+			if !tolerate {
+				restictest.Assert(t, node == nil, "unreadable directory was saved")
+				return
+			}
+			restictest.Assert(t, node != nil, "unreadable directory is missing")
+			restictest.Assert(t, strings.Contains(node.Error, "input/output error"), "unexpected error marker %q", node.Error)
+		})
+	}
+}
+
+// deviceFS reports files called name as block devices.
+type deviceFS struct {
+	fs.FS
+	name string
+}
+
+func (f deviceFS) Lstat(name string) (os.FileInfo, error) {
+	fi, err := f.FS.Lstat(name)
+	if err != nil || filepath.Base(name) != f.name {
+		return fi, err
+	}
+	return deviceInfo{fi}, nil
+}
+
+func (f deviceFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil || filepath.Base(name) != f.name {
+		return file, err
+	}
+	return deviceFile{File: file}, nil
+}
+
+type deviceFile struct {
+	fs.File
+}
+
+func (f deviceFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return deviceInfo{fi}, nil
+}
+
+type deviceInfo struct {
+	os.FileInfo
+}
+
+func (fi deviceInfo) Mode() os.FileMode {
+	return fi.FileInfo.Mode() | os.ModeDevice
+}
+
+func TestArchiverReadDevices(t *testing.T) {
+	src := TestDir{
+		"device": TestFile{Content: "contents of the block device"},
+		"file":   TestFile{Content: "foo"},
+	}
+
+	for _, readDevices := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%v", readDevices), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tempdir, repo := prepareTempdirRepoSrc(t, src)
+			back := restictest.Chdir(t, tempdir)
+			defer back()
+
+			testFS := deviceFS{FS: fs.Local{}, name: "device"}
+
+			sc := NewScanner(testFS)
+			sc.ReadDevices = readDevices
+			var scanStats ScanStats
+			sc.Result = func(item string, s ScanStats) {
+				if item == "" {
+					scanStats = s
+				}
+			}
+			restictest.OK(t, sc.Scan(ctx, []string{"."}))
+
+			arch := New(repo, testFS, Options{})
+			arch.ReadDevices = readDevices
+			sn, _, err := arch.Snapshot(ctx, []string{"."}, SnapshotOptions{Time: time.Now()})
+			restictest.OK(t, err)
+
+			tree, err := restic.LoadTree(ctx, repo, *sn.Tree)
+			restictest.OK(t, err)
+			node := tree.Find("device")
+			restictest.Assert(t, node != nil, "device is missing")
+
+			if !readDevices {
+				restictest.Equals(t, uint(1), scanStats.Files)
+				restictest.Equals(t, uint(1), scanStats.Others)
+				restictest.Equals(t, "dev", node.Type)
+				restictest.Equals(t, 0, len(node.Content))
+				return
+			}
+
+			restictest.Equals(t, uint(2), scanStats.Files)
+			restictest.Equals(t, uint(0), scanStats.Others)
+			restictest.Equals(t, "file", node.Type)
+			restictest.Equals(t, "dev", node.DeviceType)
+			TestEnsureFileContent(ctx, t, repo, "device", node, src["device"].(TestFile))
+		})
+	}
+}
+
+// capsFS reports caps as the capabilities of the wrapped file system.
+type capsFS struct {
+	fs.FS
+	caps fs.Capabilities
+}
+
+func (c capsFS) Capabilities() fs.Capabilities {
+	return c.caps
+}
+
 // MockFS keeps track which files are read.
 type MockFS struct {
 	fs.FS
@@ -1709,6 +2043,177 @@ func TestArchiverParent(t *testing.T) {
 	}
 }
 
+func TestArchiverChangeDetection(t *testing.T) {
+	defaultContent := []byte("foobar")
+
+	var modifications = []struct {
+		name   string
+		modify func(t testing.TB, filename string)
+		// skipForWindows is set for modifications which cannot be detected
+		// on Windows
+		skipForWindows bool
+	}{
+		{
+			name:   "none",
+			modify: func(t testing.TB, filename string) {},
+		},
+		{
+			name: "mtime",
+			modify: func(t testing.TB, filename string) {
+				fi := lstat(t, filename)
+				mtime := fi.ModTime().Add(time.Hour)
+				setTimestamp(t, filename, mtime, mtime)
+			},
+		},
+		{
+			name: "size",
+			modify: func(t testing.TB, filename string) {
+				fi := lstat(t, filename)
+				save(t, filename, []byte("foobarbaz"))
+				setTimestamp(t, filename, fi.ModTime(), fi.ModTime())
+			},
+		},
+		{
+			name:           "ctime",
+			modify:         chmodTwice,
+			skipForWindows: true,
+		},
+		{
+			name: "inode",
+			modify: func(t testing.TB, filename string) {
+				fi := lstat(t, filename)
+				// keep the old file until the new one has been created, so
+				// that the inode number is not reused
+				tempname := filename + ".old"
+				rename(t, filename, tempname)
+				save(t, filename, defaultContent)
+				remove(t, tempname)
+				setTimestamp(t, filename, fi.ModTime(), fi.ModTime())
+			},
+			skipForWindows: true,
+		},
+	}
+
+	var tests = []struct {
+		mode ChangeDetection
+		// reread lists the modifications for which the file must be read again
+		reread map[string]bool
+	}{
+		{
+			mode:   ChangeDetectionDefault,
+			reread: map[string]bool{"mtime": true, "size": true, "ctime": true, "inode": true},
+		},
+		{
+			mode:   ChangeDetectionMtimeSize,
+			reread: map[string]bool{"mtime": true, "size": true},
+		},
+		{
+			mode:   ChangeDetectionForceRescan,
+			reread: map[string]bool{"none": true, "mtime": true, "size": true, "ctime": true, "inode": true},
+		},
+	}
+
+	for _, test := range tests {
+		for _, mod := range modifications {
+			t.Run(test.mode.String()+"/"+mod.name, func(t *testing.T) {
+				if runtime.GOOS == "windows" && mod.skipForWindows {
+					t.Skip("don't run test on Windows")
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				tempdir, repo := prepareTempdirRepoSrc(t, TestDir{"file": TestFile{Content: string(defaultContent)}})
+
+				back := restictest.Chdir(t, tempdir)
+				defer back()
+
+				testFS := &MockFS{
+					FS:        fs.Track{FS: fs.Local{}},
+					bytesRead: make(map[string]int),
+				}
+
+				arch := New(repo, testFS, Options{})
+				arch.ChangeDetection = test.mode
+
+				parent, _, err := arch.Snapshot(ctx, []string{"file"}, SnapshotOptions{Time: time.Now()})
+				restictest.OK(t, err)
+				restictest.Equals(t, test.mode.String(), parent.ChangeDetection)
+
+				mod.modify(t, "file")
+
+				testFS.bytesRead = make(map[string]int)
+				_, _, err = arch.Snapshot(ctx, []string{"file"}, SnapshotOptions{Time: time.Now(), ParentSnapshot: parent})
+				restictest.OK(t, err)
+
+				_, reread := testFS.bytesRead["file"]
+				if reread != test.reread[mod.name] {
+					t.Errorf("file reread: want %v, got %v", test.reread[mod.name], reread)
+				}
+			})
+		}
+	}
+}
+
+func TestParseChangeDetection(t *testing.T) {
+	for _, mode := range []ChangeDetection{ChangeDetectionDefault, ChangeDetectionMtimeSize, ChangeDetectionForceRescan} {
+		parsed, err := ParseChangeDetection(mode.String())
+		restictest.OK(t, err)
+		restictest.Equals(t, mode, parsed)
+	}
+
+	_, err := ParseChangeDetection("invalid")
+	if err == nil {
+		t.Fatal("invalid mode was accepted")
+	}
+}
+
+func TestArchiverExcludeXattrs(t *testing.T) {
+	newNode := func() *restic.Node {
+		return &restic.Node{
+			Name: "file",
+			ExtendedAttributes: []restic.ExtendedAttribute{
+				{Name: "user.comment", Value: []byte("foo")},
+				{Name: "user.dropbox.attrs", Value: []byte("bar")},
+				{Name: "system.posix_acl_access", Value: []byte("baz")},
+			},
+		}
+	}
+
+	var tests = []struct {
+		patterns []string
+		skipACLs bool
+		want     []string
+	}{
+		{nil, false, []string{"user.comment", "user.dropbox.attrs", "system.posix_acl_access"}},
+		{[]string{"user.dropbox.*"}, false, []string{"user.comment", "system.posix_acl_access"}},
+		{nil, true, []string{"user.comment", "user.dropbox.attrs"}},
+		{[]string{"user.*"}, true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			arch := &Archiver{ExcludeXattrPatterns: test.patterns, SkipACLs: test.skipACLs}
+			node := newNode()
+			arch.filterExtendedAttributes(node)
+
+			var names []string
+			for _, attr := range node.ExtendedAttributes {
+				names = append(names, attr.Name)
+			}
+			restictest.Equals(t, test.want, names)
+		})
+	}
+
+	arch := &Archiver{ExcludeXattrPatterns: []string{"user.dropbox.*"}, SkipACLs: true}
+	restictest.Equals(t, append([]string{"user.dropbox.*"}, aclXattrs...), arch.excludedXattrs())
+
+	restictest.OK(t, ValidateXattrPattern("user.dropbox.*"))
+	if ValidateXattrPattern("user.[") == nil {
+		t.Fatal("invalid pattern was accepted")
+	}
+}
+
 func TestArchiverErrorReporting(t *testing.T) {
 	ignoreErrorForBasename := func(basename string) ErrorFunc {
 		return func(item string, err error) error {
@@ -2245,3 +2750,124 @@ func TestRacyFileSwap(t *testing.T) {
 		t.Errorf("Save() excluded the node, that's unexpected")
 	}
 }
+
+func TestArchiverScannerOrder(t *testing.T) {
+	src := TestDir{
+		"B": TestFile{Content: "B"},
+		"a": TestDir{
+			"file10": TestFile{Content: "file 10"},
+			"File2":  TestFile{Content: "file 2"},
+			"sub": TestDir{
+				"x": TestFile{Content: "x"},
+			},
+		},
+		"c": TestFile{Content: "c"},
+	}
+
+	for _, order := range []Order{OrderBytewise, OrderNatural} {
+		t.Run("", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tempdir, repo := prepareTempdirRepoSrc(t, src)
+
+			back := restictest.Chdir(t, tempdir)
+			defer back()
+
+			targets := []string{"."}
+
+			var scanned []string
+			sc := NewScanner(fs.Track{FS: fs.Local{}})
+			sc.Order = order
+			sc.Select = func(item string, fi os.FileInfo) bool {
+				scanned = append(scanned, item)
+				return true
+			}
+			err := sc.Scan(ctx, targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var saved []string
+			arch := New(repo, fs.Track{FS: fs.Local{}}, Options{})
+			arch.Order = order
+			arch.Select = func(item string, fi os.FileInfo) bool {
+				saved = append(saved, item)
+				return true
+			}
+			_, snapshotID, err := arch.Snapshot(ctx, targets, SnapshotOptions{Time: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !cmp.Equal(scanned, saved) {
+				t.Errorf("order %v: scanner and archiver visited items in a different order:\n%s", order, cmp.Diff(scanned, saved))
+			}
+
+			TestEnsureSnapshot(t, repo, snapshotID, src)
+			checker.TestCheckRepo(t, repo)
+		})
+	}
+}
+
+// metadataFileInfo is a regular file described by fs.Metadata.
+type metadataFileInfo struct {
+	size  int64
+	mtime time.Time
+	meta  *fs.Metadata
+}
+
+func (fi metadataFileInfo) Name() string       { return "file" }
+func (fi metadataFileInfo) Size() int64        { return fi.size }
+func (fi metadataFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi metadataFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi metadataFileInfo) IsDir() bool        { return false }
+func (fi metadataFileInfo) Sys() interface{}   { return fi.meta }
+
+func TestFileChangedCapabilities(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	ctime := time.Unix(1600000100, 0)
+	node := &restic.Node{Type: "file", Size: 5, ModTime: mtime.Add(500 * time.Millisecond), ChangeTime: ctime, Inode: 23}
+	fi := metadataFileInfo{size: 5, mtime: mtime, meta: &fs.Metadata{ChangeTime: ctime, Inode: 42}}
+
+	var tests = []struct {
+		caps    fs.Capabilities
+		changed bool
+	}{
+		{caps: fs.CapInodes, changed: true},
+		{caps: fs.CapInodes | fs.CapSecondsOnlyMtime, changed: true},
+		// the inode number and the fraction of the mtime are ignored
+		{caps: fs.CapSecondsOnlyMtime, changed: false},
+	}
+
+	for _, test := range tests {
+		arch := New(nil, capsFS{FS: fs.Local{}, caps: test.caps}, Options{})
+		restictest.Equals(t, test.changed, arch.changeReason(fi, node) != "")
+	}
+}
+
+func TestArchiverWarnUnsupported(t *testing.T) {
+	var tests = []struct {
+		caps  fs.Capabilities
+		warns int
+	}{
+		{caps: fs.CapXattrs | fs.CapACLs, warns: 0},
+		{caps: fs.CapXattrs, warns: 1},
+		{caps: 0, warns: 1},
+	}
+
+	for _, test := range tests {
+		tempdir, repo := prepareTempdirRepoSrc(t, TestDir{"file": TestFile{Content: "foo"}})
+
+		arch := New(repo, capsFS{FS: fs.Local{}, caps: test.caps}, Options{})
+		arch.SkipACLs = true
+		var warnings []string
+		arch.Warn = func(msg string) {
+			warnings = append(warnings, msg)
+		}
+
+		_, _, err := arch.Snapshot(context.TODO(), []string{tempdir}, SnapshotOptions{Time: time.Now()})
+		restictest.OK(t, err)
+		restictest.Equals(t, test.warns, len(warnings))
+	}
+}
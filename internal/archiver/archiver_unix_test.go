@@ -4,8 +4,18 @@
 package archiver
 
 import (
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
 	"syscall"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/restic"
+	restictest "github.com/restic/restic/internal/test"
+	"github.com/restic/restic/internal/walker"
 )
 
 type wrappedFileInfo struct {
@@ -39,3 +49,125 @@ func wrapFileInfo(fi os.FileInfo) os.FileInfo {
 
 	return res
 }
+
+func TestArchiverFollowSymlinks(t *testing.T) {
+	src := TestDir{
+		"other":    TestFile{Content: "another file"},
+		"file":     TestSymlink{Target: "other"},
+		"dangling": TestSymlink{Target: "missing"},
+		"work": TestDir{
+			"foo": TestFile{Content: "foo"},
+			"subdir": TestDir{
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+				"loop":    TestSymlink{Target: ".."},
+			},
+			"sibling": TestSymlink{Target: "subdir"},
+		},
+	}
+
+	tempdir, repo := prepareTempdirRepoSrc(t, src)
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	var dangling, cycles []string
+	arch := New(repo, fs.FollowSymlinks{
+		FS: fs.Track{FS: fs.Local{}},
+		DanglingLink: func(name string, err error) {
+			dangling = append(dangling, name)
+		},
+	}, Options{})
+	arch.Error = func(item string, err error) error {
+		if errors.Is(err, ErrCycleDetected) {
+			cycles = append(cycles, filepath.Base(item))
+			return nil
+		}
+		return err
+	}
+
+	_, snapshotID, err := arch.Snapshot(context.TODO(), []string{"."}, SnapshotOptions{Time: time.Now()})
+	restictest.OK(t, err)
+
+	// "sibling" is not a cycle, so the directory is saved twice
+	want := TestDir{
+		"other":    TestFile{Content: "another file"},
+		"file":     TestFile{Content: "another file"},
+		"dangling": TestSymlink{Target: "missing"},
+		"work": TestDir{
+			"foo": TestFile{Content: "foo"},
+			"subdir": TestDir{
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+			},
+			"sibling": TestDir{
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+			},
+		},
+	}
+	TestEnsureSnapshot(t, repo, snapshotID, want)
+
+	restictest.Equals(t, []string{"loop", "loop"}, cycles)
+	restictest.Equals(t, []string{"dangling"}, dangling)
+}
+
+func TestArchiverHardLinksAcrossTargets(t *testing.T) {
+	const content = "content of a file with several hard links"
+
+	var tests = []struct {
+		targets []string
+		files   int
+	}{
+		{targets: []string{"a", "b"}, files: 3},
+		{targets: []string{"b", "a"}, files: 3},
+		{targets: []string{"b/zlink", "a"}, files: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(filepath.Join(test.targets...), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// b/0link sorts before and b/zlink after the name a/file
+			tempdir, repo := prepareTempdirRepoSrc(t, TestDir{
+				"a": TestDir{"file": TestFile{Content: content}},
+				"b": TestDir{},
+			})
+			back := restictest.Chdir(t, tempdir)
+			defer back()
+
+			for _, name := range []string{"0link", "zlink"} {
+				restictest.OK(t, os.Link(filepath.Join("a", "file"), filepath.Join("b", name)))
+			}
+
+			testFS := &MockFS{FS: fs.Local{}, bytesRead: make(map[string]int)}
+			arch := New(repo, testFS, Options{})
+			sn, _, err := arch.Snapshot(ctx, test.targets, SnapshotOptions{Time: time.Now()})
+			restictest.OK(t, err)
+
+			var read int
+			for _, n := range testFS.bytesRead {
+				read += n
+			}
+			restictest.Equals(t, len(content), read)
+
+			var nodes []*restic.Node
+			err = walker.Walk(ctx, repo, *sn.Tree, nil, func(_ restic.ID, path string, node *restic.Node, err error) (bool, error) {
+				if err != nil {
+					return false, err
+				}
+				if node != nil && node.Type == "file" {
+					nodes = append(nodes, node)
+				}
+				return false, nil
+			})
+			restictest.OK(t, err)
+
+			restictest.Equals(t, test.files, len(nodes))
+			for _, node := range nodes {
+				restictest.Equals(t, uint64(3), node.Links)
+				restictest.Equals(t, nodes[0].Inode, node.Inode)
+				restictest.Equals(t, uint64(len(content)), node.Size)
+				restictest.Equals(t, nodes[0].Content, node.Content)
+				TestEnsureFileContent(ctx, t, repo, node.Name, node, TestFile{Content: content})
+			}
+		})
+	}
+}
@@ -2,10 +2,12 @@ package archiver
 
 import (
 	"context"
+	"time"
 
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/restic"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 // Saver allows saving a blob.
@@ -17,15 +19,31 @@ type Saver interface {
 type BlobSaver struct {
 	repo Saver
 	ch   chan<- saveBlobJob
+
+	// inFlight limits the size of the blobs passed to Save which have not
+	// been saved by the repo yet, nil if there is no limit.
+	inFlight    *semaphore.Weighted
+	maxInFlight int64
+
+	// Stalled is called with the time Save was blocked because the limit of
+	// data in flight was reached.
+	Stalled func(d time.Duration)
 }
 
 // NewBlobSaver returns a new blob. A worker pool is started, it is stopped
-// when ctx is cancelled.
-func NewBlobSaver(ctx context.Context, wg *errgroup.Group, repo Saver, workers uint) *BlobSaver {
+// when ctx is cancelled. Save blocks while the blobs which have not yet been
+// saved exceed maxInFlight bytes, zero disables the limit.
+func NewBlobSaver(ctx context.Context, wg *errgroup.Group, repo Saver, workers uint, maxInFlight uint64) *BlobSaver {
 	ch := make(chan saveBlobJob)
 	s := &BlobSaver{
-		repo: repo,
-		ch:   ch,
+		repo:    repo,
+		ch:      ch,
+		Stalled: func(time.Duration) {},
+	}
+
+	if maxInFlight > 0 {
+		s.maxInFlight = int64(maxInFlight)
+		s.inFlight = semaphore.NewWeighted(s.maxInFlight)
 	}
 
 	for i := uint(0); i < workers; i++ {
@@ -44,17 +62,54 @@ func (s *BlobSaver) TriggerShutdown() {
 // Save stores a blob in the repo. It checks the index and the known blobs
 // before saving anything. It takes ownership of the buffer passed in.
 func (s *BlobSaver) Save(ctx context.Context, t restic.BlobType, buf *Buffer, cb func(res SaveBlobResponse)) {
+	size, err := s.acquire(ctx, len(buf.Data))
+	if err != nil {
+		debug.Log("not sending job, context is cancelled")
+		return
+	}
+
 	select {
-	case s.ch <- saveBlobJob{BlobType: t, buf: buf, cb: cb}:
+	case s.ch <- saveBlobJob{BlobType: t, buf: buf, cb: cb, size: size}:
 	case <-ctx.Done():
+		s.release(size)
 		debug.Log("not sending job, context is cancelled")
 	}
 }
 
+// acquire reserves the budget for a blob of length bytes and returns the
+// amount to pass to release.
+func (s *BlobSaver) acquire(ctx context.Context, length int) (int64, error) {
+	if s.inFlight == nil {
+		return 0, nil
+	}
+
+	// a single blob larger than the limit must not block forever
+	size := int64(length)
+	if size > s.maxInFlight {
+		size = s.maxInFlight
+	}
+
+	if s.inFlight.TryAcquire(size) {
+		return size, nil
+	}
+
+	start := time.Now()
+	err := s.inFlight.Acquire(ctx, size)
+	s.Stalled(time.Since(start))
+	return size, err
+}
+
+func (s *BlobSaver) release(size int64) {
+	if s.inFlight != nil {
+		s.inFlight.Release(size)
+	}
+}
+
 type saveBlobJob struct {
 	restic.BlobType
-	buf *Buffer
-	cb  func(res SaveBlobResponse)
+	buf  *Buffer
+	cb   func(res SaveBlobResponse)
+	size int64
 }
 
 type SaveBlobResponse struct {
@@ -93,6 +148,7 @@ func (s *BlobSaver) worker(ctx context.Context, jobs <-chan saveBlobJob) error {
 		}
 
 		res, err := s.saveBlob(ctx, job.BlobType, job.buf.Data)
+		s.release(job.size)
 		if err != nil {
 			debug.Log("saveBlob returned error, exiting: %v", err)
 			return err
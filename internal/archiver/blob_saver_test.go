@@ -7,6 +7,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/index"
@@ -44,7 +45,7 @@ func TestBlobSaver(t *testing.T) {
 		idx: index.NewMasterIndex(),
 	}
 
-	b := NewBlobSaver(ctx, wg, saver, uint(runtime.NumCPU()))
+	b := NewBlobSaver(ctx, wg, saver, uint(runtime.NumCPU()), 0)
 
 	var wait sync.WaitGroup
 	var results []SaveBlobResponse
@@ -102,7 +103,7 @@ func TestBlobSaverError(t *testing.T) {
 				failAt: int32(test.failAt),
 			}
 
-			b := NewBlobSaver(ctx, wg, saver, uint(runtime.NumCPU()))
+			b := NewBlobSaver(ctx, wg, saver, uint(runtime.NumCPU()), 0)
 
 			for i := 0; i < test.blobs; i++ {
 				buf := &Buffer{Data: []byte(fmt.Sprintf("foo%d", i))}
@@ -122,3 +123,87 @@ func TestBlobSaverError(t *testing.T) {
 		})
 	}
 }
+
+// blockingSaver blocks in SaveBlob until a value is sent to unblock.
+type blockingSaver struct {
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingSaver) SaveBlob(_ context.Context, _ restic.BlobType, _ []byte, id restic.ID, _ bool) (restic.ID, bool, int, error) {
+	b.started <- struct{}{}
+	<-b.unblock
+	return id, false, 0, nil
+}
+
+func TestBlobSaverMaxInFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg, ctx := errgroup.WithContext(ctx)
+	saver := &blockingSaver{
+		started: make(chan struct{}, 10),
+		unblock: make(chan struct{}),
+	}
+
+	// at most two blobs of four bytes fit into the limit
+	b := NewBlobSaver(ctx, wg, saver, 4, 8)
+	var stalled int64
+	b.Stalled = func(d time.Duration) {
+		atomic.AddInt64(&stalled, int64(d))
+	}
+
+	var queued int32
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			buf := &Buffer{Data: []byte(fmt.Sprintf("foo%d", i))}
+			b.Save(ctx, restic.DataBlob, buf, func(res SaveBlobResponse) {})
+			atomic.AddInt32(&queued, 1)
+		}
+		close(done)
+	}()
+
+	<-saver.started
+	<-saver.started
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&queued); n != 2 {
+		t.Errorf("expected two queued blobs, got %d", n)
+	}
+
+	// saving one blob allows the third one to be queued
+	saver.unblock <- struct{}{}
+	<-done
+	<-saver.started
+	saver.unblock <- struct{}{}
+	saver.unblock <- struct{}{}
+
+	b.TriggerShutdown()
+	if err := wg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt64(&stalled) <= 0 {
+		t.Errorf("stall time was not reported")
+	}
+}
+
+func TestBlobSaverMaxInFlightLargeBlob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg, ctx := errgroup.WithContext(ctx)
+	saver := &saveFail{idx: index.NewMasterIndex()}
+
+	// a blob larger than the limit must not block forever
+	b := NewBlobSaver(ctx, wg, saver, 1, 2)
+	for i := 0; i < 3; i++ {
+		buf := &Buffer{Data: []byte(fmt.Sprintf("foo%d", i))}
+		b.Save(ctx, restic.DataBlob, buf, func(res SaveBlobResponse) {})
+	}
+
+	b.TriggerShutdown()
+	if err := wg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
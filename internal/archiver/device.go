@@ -0,0 +1,42 @@
+package archiver
+
+import (
+	"os"
+
+	"github.com/restic/restic/internal/fs"
+)
+
+// deviceFileInfo presents a block or character device as a regular file, so
+// that the file saver reads its contents.
+type deviceFileInfo struct {
+	os.FileInfo
+	size       int64
+	deviceType string
+}
+
+// newDeviceFileInfo returns the information for the open device f. The size
+// is zero if it cannot be determined, e.g. for character devices.
+func newDeviceFileInfo(f fs.File, fi os.FileInfo) *deviceFileInfo {
+	size, _ := fs.DeviceSize(f)
+
+	deviceType := "dev"
+	if fi.Mode()&os.ModeCharDevice != 0 {
+		deviceType = "chardev"
+	}
+
+	return &deviceFileInfo{FileInfo: fi, size: int64(size), deviceType: deviceType}
+}
+
+func (fi *deviceFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *deviceFileInfo) Mode() os.FileMode {
+	return fi.FileInfo.Mode() &^ (os.ModeDevice | os.ModeCharDevice)
+}
+
+// update returns the information for the device with the current stat data
+// cur, keeping the size.
+func (fi *deviceFileInfo) update(cur os.FileInfo) *deviceFileInfo {
+	return &deviceFileInfo{FileInfo: cur, size: fi.size, deviceType: fi.deviceType}
+}
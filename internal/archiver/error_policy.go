@@ -0,0 +1,37 @@
+package archiver
+
+import (
+	"os"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+)
+
+// ErrorPolicyAbort is an ErrorFunc which aborts on all errors.
+func ErrorPolicyAbort(_ string, err error) error {
+	return err
+}
+
+// ErrorPolicyWarnAndContinue returns an ErrorFunc which passes all errors to
+// warnf and continues. Errors which indicate that the file system cannot be
+// accessed any more (see fs.IsFatalError) still abort.
+func ErrorPolicyWarnAndContinue(warnf func(msg string, args ...interface{})) ErrorFunc {
+	return func(item string, err error) error {
+		if fs.IsFatalError(err) {
+			return err
+		}
+
+		warnf("%v\n", err)
+		return nil
+	}
+}
+
+// ErrorPolicyIgnorePermissionDenied is an ErrorFunc which silently skips items
+// that cannot be accessed due to missing permissions and aborts on all other
+// errors.
+func ErrorPolicyIgnorePermissionDenied(_ string, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return nil
+	}
+	return err
+}
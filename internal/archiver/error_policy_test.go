@@ -0,0 +1,70 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+func TestErrorPolicies(t *testing.T) {
+	permErr := &os.PathError{Op: "open", Path: "/foo", Err: os.ErrPermission}
+	ioErr := &os.PathError{Op: "read", Path: "/foo", Err: syscall.EIO}
+
+	var tests = []struct {
+		name string
+		err  error
+
+		// whether the respective policy aborts for err
+		abort bool
+		warn  bool
+		perm  bool
+	}{
+		{"permission-denied", permErr, true, false, false},
+		{"permission-denied-wrapped", fmt.Errorf("/foo: %w", permErr), true, false, false},
+		{"io-error", ioErr, true, false, true},
+		{"cancelled", context.Canceled, true, true, true},
+		{"cancelled-wrapped", errors.Wrap(context.Canceled, "read"), true, true, true},
+		{"deadline", context.DeadlineExceeded, true, true, true},
+		{"fatal", errors.Fatal("command failed"), true, true, true},
+		{"not-connected", &os.PathError{Op: "lstat", Path: "/mnt", Err: syscall.ENOTCONN}, true, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var warnings int
+			warn := ErrorPolicyWarnAndContinue(func(msg string, args ...interface{}) {
+				warnings++
+			})
+
+			for _, p := range []struct {
+				name  string
+				fn    ErrorFunc
+				abort bool
+			}{
+				{"abort", ErrorPolicyAbort, test.abort},
+				{"warn", warn, test.warn},
+				{"ignore-permission-denied", ErrorPolicyIgnorePermissionDenied, test.perm},
+			} {
+				err := p.fn("/foo", test.err)
+				if p.abort && err != test.err {
+					t.Errorf("policy %v: expected original error %v to be returned, got %v", p.name, test.err, err)
+				}
+				if !p.abort && err != nil {
+					t.Errorf("policy %v: expected error to be suppressed, got %v", p.name, err)
+				}
+			}
+
+			wantWarnings := 1
+			if test.warn {
+				wantWarnings = 0
+			}
+			if warnings != wantWarnings {
+				t.Errorf("expected %d warnings, got %d", wantWarnings, warnings)
+			}
+		})
+	}
+}
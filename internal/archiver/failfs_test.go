@@ -0,0 +1,212 @@
+package archiver
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/fs/failfs"
+	"github.com/restic/restic/internal/restic"
+	restictest "github.com/restic/restic/internal/test"
+)
+
+// The tests in this file check the error handling of the archiver and the
+// scanner with the failures injected by failfs.
+
+var failFSTestDir = TestDir{
+	"a":    TestDir{"file": TestFile{Content: "file in a"}},
+	"b":    TestDir{"file": TestFile{Content: "file in b"}},
+	"file": TestFile{Content: "top-level file"},
+}
+
+// collectErrors returns an ErrorFunc which records all errors and suppresses
+// them.
+func collectErrors() (ErrorFunc, func() map[string]error) {
+	var m sync.Mutex
+	errs := make(map[string]error)
+	return func(item string, err error) error {
+			m.Lock()
+			defer m.Unlock()
+			errs[item] = err
+			return nil
+		}, func() map[string]error {
+			m.Lock()
+			defer m.Unlock()
+			return errs
+		}
+}
+
+func TestArchiverFailFSReaddir(t *testing.T) {
+	for _, tolerate := range []bool{false, true} {
+		tempdir, repo := prepareTempdirRepoSrc(t, failFSTestDir)
+
+		// the first call lists tempdir, the second one the directory "a"
+		ffs := failfs.New(fs.Local{}, failfs.Options{ReaddirFailures: []int{2}})
+		arch := New(repo, ffs, Options{})
+		arch.TolerateDirErrors = tolerate
+		errFn, errs := collectErrors()
+		arch.Error = errFn
+
+		sn, _, err := arch.Snapshot(context.TODO(), []string{tempdir}, SnapshotOptions{Time: time.Now()})
+		restictest.OK(t, err)
+
+		// the snapshot is saved without the contents of "a"
+		restictest.Equals(t, 1, len(errs()))
+		err = errs()[filepath.Join(tempdir, "a")]
+		restictest.Assert(t, errors.Is(err, syscall.EIO), "unexpected error %v", err)
+
+		tree := loadFailFSTree(t, repo, sn, tempdir)
+		restictest.Assert(t, tree.Find("b") != nil && tree.Find("file") != nil, "items missing in %v", tree.Nodes)
+		a := tree.Find("a")
+		if tolerate {
+			restictest.Assert(t, a != nil, "directory which cannot be listed is missing")
+			restictest.Assert(t, a.Error != "", "error of directory is not saved")
+			subtree, err := restic.LoadTree(context.TODO(), repo, *a.Subtree)
+			restictest.OK(t, err)
+			restictest.Equals(t, 0, len(subtree.Nodes))
+		} else {
+			restictest.Assert(t, a == nil, "directory which cannot be listed is saved")
+		}
+		restictest.Equals(t, 0, ffs.OpenFiles())
+	}
+}
+
+func TestArchiverFailFSShortReads(t *testing.T) {
+	src := TestDir{
+		"large": TestFile{Content: string(restictest.Random(23, 3*1024*1024+1234))},
+		"small": TestFile{Content: "small file"},
+	}
+	tempdir, repo := prepareTempdirRepoSrc(t, src)
+
+	var shortReads = make(map[string]int)
+	for name := range src {
+		shortReads[filepath.Join(tempdir, name)] = 1000
+	}
+	ffs := failfs.New(fs.Local{}, failfs.Options{ShortReads: shortReads})
+
+	arch := New(repo, ffs, Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{tempdir}, SnapshotOptions{Time: time.Now()})
+	restictest.OK(t, err)
+
+	tree := loadFailFSTree(t, repo, sn, tempdir)
+	TestEnsureTree(context.TODO(), t, "/", repo, *loadFailFSTreeID(t, repo, sn, tempdir), src)
+	restictest.Equals(t, 2, len(tree.Nodes))
+	restictest.Equals(t, 0, ffs.OpenFiles())
+}
+
+func TestArchiverFailFSSizeChange(t *testing.T) {
+	for _, retries := range []uint{0, 1} {
+		tempdir, repo := prepareTempdirRepoSrc(t, failFSTestDir)
+		filename := filepath.Join(tempdir, "file")
+
+		// the size reported before reading the file differs from the
+		// size afterwards
+		ffs := failfs.New(fs.Local{}, failfs.Options{SizeChanges: map[string]int64{filename: 100}})
+		arch := New(repo, ffs, Options{ModifiedFileRetries: retries})
+		sn, _, err := arch.Snapshot(context.TODO(), []string{tempdir}, SnapshotOptions{Time: time.Now()})
+		restictest.OK(t, err)
+
+		node := loadFailFSTree(t, repo, sn, tempdir).Find("file")
+		restictest.Assert(t, node != nil, "file is missing")
+		restictest.Equals(t, uint64(len("top-level file")), node.Size)
+		// reading the file again yields a consistent result
+		restictest.Equals(t, retries == 0, node.ModifiedDuringBackup)
+	}
+}
+
+func TestArchiverFailFSCancel(t *testing.T) {
+	src := TestDir{}
+	for i := 0; i < 100; i++ {
+		src[string(rune('a'+i%26))+string(rune('a'+i/26))] = TestFile{Content: string(restictest.Random(i, 1024))}
+	}
+	tempdir, repo := prepareTempdirRepoSrc(t, src)
+	ffs := failfs.New(fs.Local{}, failfs.Options{Latency: 2 * time.Millisecond})
+
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	arch := New(repo, ffs, Options{})
+	_, _, err := arch.Snapshot(ctx, []string{tempdir}, SnapshotOptions{Time: time.Now()})
+	restictest.Assert(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+
+	// the scanner only provides estimates and stops without an error
+	sc := NewScanner(ffs)
+	restictest.OK(t, sc.Scan(ctx, []string{tempdir}))
+
+	restictest.Equals(t, 0, ffs.OpenFiles())
+
+	// all goroutines started by the archiver and the scanner must exit
+	for i := 0; runtime.NumGoroutine() > goroutines; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines are still running after the snapshot was cancelled", runtime.NumGoroutine()-goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScannerFailFS(t *testing.T) {
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, failFSTestDir)
+	filename := filepath.Join(tempdir, "file")
+
+	for _, tolerate := range []bool{false, true} {
+		ffs := failfs.New(fs.Local{}, failfs.Options{
+			ReaddirFailures: []int{2},
+			SizeChanges:     map[string]int64{filename: 100},
+		})
+		sc := NewScanner(ffs)
+		sc.TolerateDirErrors = tolerate
+		errFn, errs := collectErrors()
+		sc.Error = errFn
+
+		var stats ScanStats
+		sc.Result = func(item string, s ScanStats) {
+			if item == "" {
+				stats = s
+			}
+		}
+		restictest.OK(t, sc.Scan(context.TODO(), []string{tempdir}))
+
+		restictest.Equals(t, 1, len(errs()))
+		err := errs()[filepath.Join(tempdir, "a")]
+		restictest.Assert(t, errors.Is(err, syscall.EIO), "unexpected error %v", err)
+
+		// the scanner counts the same items as the archiver
+		want := ScanStats{Files: 2, Dirs: 2, Bytes: uint64(len("top-level file") + 100 + len("file in b")), Errors: 1}
+		if tolerate {
+			want.Dirs++
+		}
+		restictest.Equals(t, want, stats)
+		restictest.Equals(t, 0, ffs.OpenFiles())
+	}
+}
+
+func loadFailFSTreeID(t testing.TB, repo restic.Repository, sn *restic.Snapshot, dir string) *restic.ID {
+	id := sn.Tree
+	components, _ := pathComponents(fs.Local{}, dir, false)
+	for _, name := range components {
+		tree, err := restic.LoadTree(context.TODO(), repo, *id)
+		restictest.OK(t, err)
+		node := tree.Find(name)
+		restictest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", name)
+		id = node.Subtree
+	}
+	return id
+}
+
+func loadFailFSTree(t testing.TB, repo restic.Repository, sn *restic.Snapshot, dir string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, *loadFailFSTreeID(t, repo, sn, dir))
+	restictest.OK(t, err)
+	return tree
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/restic/chunker"
 	"github.com/restic/restic/internal/debug"
@@ -23,18 +24,47 @@ type FileSaver struct {
 	saveFilePool *BufferPool
 	saveBlob     SaveBlobFn
 
-	pol chunker.Pol
+	chunkerCfg restic.Config
 
 	ch chan<- saveFileJob
 
 	CompleteBlob func(bytes uint64)
 
+	// CompleteUnknownSizeBlob is called instead of CompleteBlob for files
+	// with an unknown size, if it is set.
+	CompleteUnknownSizeBlob func(bytes uint64)
+
 	NodeFromFileInfo func(snPath, filename string, fi os.FileInfo) (*restic.Node, error)
+
+	// LargeFileReadConcurrency is the number of goroutines reading a single
+	// file of at least LargeFileThreshold bytes. Values below two disable
+	// concurrent reads, as do files which do not support io.ReaderAt. The
+	// holes of sparse files are also skipped by concurrent reads.
+	LargeFileReadConcurrency uint
+	LargeFileThreshold       int64
+
+	// IgnoreHoles reads sparse files entirely, it is set for file systems
+	// which cannot detect holes.
+	IgnoreHoles bool
+
+	// ModifiedFileRetries is the number of times a file is read again when
+	// its size or modification time changed while it was read. If it is
+	// still modified afterwards, the node is marked with
+	// ModifiedDuringBackup.
+	ModifiedFileRetries uint
+
+	// FileProgress, if set, is called while a file is read with the number of
+	// bytes read so far and the expected size. It is called once at least
+	// FileProgressBytes have been read or FileProgressInterval has passed
+	// since the previous call for the same file.
+	FileProgress         func(snPath string, read, total uint64)
+	FileProgressBytes    uint64
+	FileProgressInterval time.Duration
 }
 
 // NewFileSaver returns a new file saver. A worker pool with fileWorkers is
 // started, it is stopped when ctx is cancelled.
-func NewFileSaver(ctx context.Context, wg *errgroup.Group, save SaveBlobFn, pol chunker.Pol, fileWorkers, blobWorkers uint) *FileSaver {
+func NewFileSaver(ctx context.Context, wg *errgroup.Group, save SaveBlobFn, chunkerCfg restic.Config, fileWorkers, blobWorkers uint) *FileSaver {
 	ch := make(chan saveFileJob)
 
 	debug.Log("new file saver with %v file workers and %v blob workers", fileWorkers, blobWorkers)
@@ -43,8 +73,8 @@ func NewFileSaver(ctx context.Context, wg *errgroup.Group, save SaveBlobFn, pol
 
 	s := &FileSaver{
 		saveBlob:     save,
-		saveFilePool: NewBufferPool(int(poolSize), chunker.MaxSize),
-		pol:          pol,
+		saveFilePool: NewBufferPool(int(poolSize), int(chunkerCfg.Max())),
+		chunkerCfg:   chunkerCfg,
 		ch:           ch,
 
 		CompleteBlob: func(uint64) {},
@@ -156,78 +186,150 @@ func (s *FileSaver) saveFile(ctx context.Context, chnker *chunker.Chunker, snPat
 
 	debug.Log("%v", snPath)
 
-	node, err := s.NodeFromFileInfo(snPath, f.Name(), fi)
-	if err != nil {
-		_ = f.Close()
-		completeError(err)
-		return
+	newNode := func(fi os.FileInfo) (*restic.Node, error) {
+		node, err := s.NodeFromFileInfo(snPath, f.Name(), fi)
+		if err != nil {
+			return nil, err
+		}
+
+		if node.Type != "file" {
+			return nil, errors.Errorf("node type %q is wrong", node.Type)
+		}
+		return node, nil
 	}
 
-	if node.Type != "file" {
-		_ = f.Close()
-		completeError(errors.Errorf("node type %q is wrong", node.Type))
-		return
+	// reported is the number of bytes passed to CompleteBlob, so that
+	// reading a file again does not count the same bytes twice
+	var reported uint64
+
+	var progress *fileProgress
+	if s.FileProgress != nil {
+		progress = &fileProgress{
+			report: func(read, total uint64) {
+				s.FileProgress(snPath, read, total)
+			},
+			bytes:    s.FileProgressBytes,
+			interval: s.FileProgressInterval,
+			last:     time.Now(),
+		}
 	}
 
-	// reuse the chunker
-	chnker.Reset(f, s.pol)
+	// read chunks the file from rd and saves the blobs for node. It
+	// returns the number of blobs passed to saveBlob.
+	read := func(node *restic.Node, rd io.Reader) (int, error) {
+		// reuse the chunker
+		s.chunkerCfg.ResetChunker(chnker, rd)
+
+		node.Content = []restic.ID{}
+		node.Size = 0
+		var idx int
+		for {
+			buf := s.saveFilePool.Get()
+			chunk, err := chnker.Next(buf.Data)
+			if err == io.EOF {
+				buf.Release()
+				break
+			}
 
-	node.Content = []restic.ID{}
-	node.Size = 0
-	var idx int
-	for {
-		buf := s.saveFilePool.Get()
-		chunk, err := chnker.Next(buf.Data)
-		if err == io.EOF {
-			buf.Release()
-			break
+			buf.Data = chunk.Data
+			node.Size += uint64(chunk.Length)
+
+			if err != nil {
+				return idx, err
+			}
+			// test if the context has been cancelled, return the error
+			if ctx.Err() != nil {
+				return idx, ctx.Err()
+			}
+
+			// add a place to store the saveBlob result
+			pos := idx
+
+			lock.Lock()
+			node.Content = append(node.Content, restic.ID{})
+			lock.Unlock()
+
+			s.saveBlob(ctx, restic.DataBlob, buf, func(sbr SaveBlobResponse) {
+				lock.Lock()
+				if !sbr.known {
+					fnr.stats.DataBlobs++
+					fnr.stats.DataSize += uint64(sbr.length)
+					fnr.stats.DataSizeInRepo += uint64(sbr.sizeInRepo)
+				}
+
+				node.Content[pos] = sbr.id
+				lock.Unlock()
+
+				completeBlob()
+			})
+			idx++
+
+			// test if the context has been cancelled, return the error
+			if ctx.Err() != nil {
+				return idx, ctx.Err()
+			}
+
+			if node.Size > reported {
+				completeBlob := s.CompleteBlob
+				if fi.Size() == fs.SizeUnknown && s.CompleteUnknownSizeBlob != nil {
+					completeBlob = s.CompleteUnknownSizeBlob
+				}
+				completeBlob(node.Size - reported)
+				reported = node.Size
+			}
+
+			if progress != nil {
+				progress.update(node.Size, knownSize(fi))
+			}
 		}
 
-		buf.Data = chunk.Data
-		node.Size += uint64(chunk.Length)
+		return idx, nil
+	}
+
+	node, err := newNode(fi)
+	if err != nil {
+		_ = f.Close()
+		completeError(err)
+		return
+	}
+
+	// blobs is the number of blobs saved in all attempts, each of them calls
+	// completeBlob once
+	var blobs int
+	for retries := uint(0); ; retries++ {
+		rd, closeReader := s.reader(f, fi, target)
+		n, err := read(node, rd)
+		closeReader()
+		blobs += n
 
 		if err != nil {
 			_ = f.Close()
 			completeError(err)
 			return
 		}
-		// test if the context has been cancelled, return the error
-		if ctx.Err() != nil {
-			_ = f.Close()
-			completeError(ctx.Err())
-			return
-		}
-
-		// add a place to store the saveBlob result
-		pos := idx
-
-		lock.Lock()
-		node.Content = append(node.Content, restic.ID{})
-		lock.Unlock()
 
-		s.saveBlob(ctx, restic.DataBlob, buf, func(sbr SaveBlobResponse) {
-			lock.Lock()
-			if !sbr.known {
-				fnr.stats.DataBlobs++
-				fnr.stats.DataSize += uint64(sbr.length)
-				fnr.stats.DataSizeInRepo += uint64(sbr.sizeInRepo)
-			}
-
-			node.Content[pos] = sbr.id
-			lock.Unlock()
+		cur, modified := fileModified(f, fi)
+		if !modified {
+			break
+		}
 
-			completeBlob()
-		})
-		idx++
+		if retries >= s.ModifiedFileRetries {
+			debug.Log("%v was modified while being read", target)
+			node.ModifiedDuringBackup = true
+			break
+		}
 
-		// test if the context has been cancelled, return the error
-		if ctx.Err() != nil {
+		debug.Log("%v was modified while being read, reading it again", target)
+		_, err = f.Seek(0, io.SeekStart)
+		if err == nil {
+			fi = cur
+			node, err = newNode(fi)
+		}
+		if err != nil {
 			_ = f.Close()
-			completeError(ctx.Err())
+			completeError(err)
 			return
 		}
-
-		s.CompleteBlob(uint64(len(chunk.Data)))
 	}
 
 	err = f.Close()
@@ -240,15 +342,127 @@ func (s *FileSaver) saveFile(ctx context.Context, chnker *chunker.Chunker, snPat
 	lock.Lock()
 	// require one additional completeFuture() call to ensure that the future only completes
 	// after reaching the end of this method
-	remaining += idx + 1
+	remaining += blobs + 1
 	lock.Unlock()
 	finishReading()
 	completeBlob()
 }
 
+// fileProgress limits how often the progress of reading a single file is
+// reported.
+type fileProgress struct {
+	report   func(read, total uint64)
+	bytes    uint64
+	interval time.Duration
+
+	// read and last are the number of bytes and the time of the previous
+	// report, or of the start of reading
+	read uint64
+	last time.Time
+}
+
+// update reports that read bytes of the file have been read, if enough bytes
+// or time have passed since the previous report.
+func (p *fileProgress) update(read, total uint64) {
+	if read < p.read {
+		// the file is read again
+		p.read = 0
+	}
+
+	if read-p.read < p.bytes && time.Since(p.last) < p.interval {
+		return
+	}
+
+	// the file may have grown since it has been opened, a total of zero
+	// means that the size is unknown
+	if total > 0 && read > total {
+		total = read
+	}
+
+	p.read = read
+	p.last = time.Now()
+	p.report(read, total)
+}
+
+// reader returns a reader for the contents of f. Holes in sparse files are
+// skipped and large files are read concurrently if possible. The returned
+// function must be called once reading has finished.
+func (s *FileSaver) reader(f fs.File, fi os.FileInfo, target string) (io.Reader, func()) {
+	var sparse fs.SparseFile
+	if !s.IgnoreHoles && isSparse(fi) {
+		if sf, ok := fs.Sparse(f); ok {
+			sparse = sf
+		}
+	}
+
+	ra, ok := fs.ReaderAt(f)
+	if !ok {
+		return f, func() {}
+	}
+
+	if s.LargeFileReadConcurrency > 1 && fi.Size() >= s.LargeFileThreshold {
+		if sparse != nil {
+			// the workers only read the data regions
+			debug.Log("reading sparse file %v without holes", target)
+			ra = newSparseReaderAt(ra, sparse, fi.Size())
+		}
+		debug.Log("reading %v with %d goroutines", target, s.LargeFileReadConcurrency)
+		pr := newParallelReader(ra, fi.Size(), s.LargeFileReadConcurrency, parallelReadRegionSize)
+		return pr, func() {
+			_ = pr.Close()
+		}
+	}
+
+	if sparse != nil {
+		debug.Log("reading sparse file %v without holes", target)
+		return newSparseReader(ra, sparse, fi.Size()), func() {}
+	}
+
+	return f, func() {}
+}
+
+// isSparse returns true if less space is allocated for the file than its size.
+func isSparse(fi os.FileInfo) bool {
+	if _, ok := fi.(*deviceFileInfo); ok {
+		// devices do not have any blocks allocated on the file system
+		return false
+	}
+	if fi.Size() == fs.SizeUnknown {
+		return false
+	}
+	allocated, ok := allocatedSize(fi)
+	return ok && allocated < uint64(fi.Size())
+}
+
+// allocatedSize returns the space allocated for the file, if it is known.
+func allocatedSize(fi os.FileInfo) (uint64, bool) {
+	if fi.Sys() == nil {
+		// e.g. files read from stdin
+		return 0, false
+	}
+	return fs.ExtendedStat(fi).AllocatedSize()
+}
+
+// fileModified checks whether the size or modification time of the open file
+// f differ from fi. It returns the current file information.
+func fileModified(f fs.File, fi os.FileInfo) (os.FileInfo, bool) {
+	cur, err := f.Stat()
+	if err != nil {
+		debug.Log("unable to stat %v after reading: %v", f.Name(), err)
+		return fi, false
+	}
+
+	if dev, ok := fi.(*deviceFileInfo); ok {
+		// stat() does not report the size of devices
+		return dev.update(cur), !cur.ModTime().Equal(fi.ModTime())
+	}
+
+	return cur, cur.Size() != fi.Size() || !cur.ModTime().Equal(fi.ModTime())
+}
+
 func (s *FileSaver) worker(ctx context.Context, jobs <-chan saveFileJob) {
 	// a worker has one chunker which is reused for each file (because it contains a rather large buffer)
-	chnker := chunker.New(nil, s.pol)
+	chnker := s.chunkerCfg.NewChunker(nil)
 
 	for {
 		var job saveFileJob
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/restic/chunker"
 	"github.com/restic/restic/internal/fs"
@@ -48,7 +49,7 @@ func startFileSaver(ctx context.Context, t testing.TB) (*FileSaver, context.Cont
 		t.Fatal(err)
 	}
 
-	s := NewFileSaver(ctx, wg, saveBlob, pol, workers, workers)
+	s := NewFileSaver(ctx, wg, saveBlob, restic.Config{ChunkerPolynomial: pol}, workers, workers)
 	s.NodeFromFileInfo = func(snPath, filename string, fi os.FileInfo) (*restic.Node, error) {
 		return restic.NodeFromFileInfo(filename, fi)
 	}
@@ -100,3 +101,244 @@ func TestFileSaver(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// changingFile pretends that the file is modified while it is read: the
+// first changes calls to Stat return a different modification time each.
+type changingFile struct {
+	fs.File
+	changes   int
+	calls     int
+	bytesRead int
+}
+
+func (f *changingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.bytesRead += n
+	return n, err
+}
+
+func (f *changingFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	f.calls++
+	offset := f.calls
+	if offset > f.changes {
+		offset = f.changes
+	}
+	return changedModTime{FileInfo: fi, modTime: fi.ModTime().Add(time.Duration(offset) * time.Second)}, nil
+}
+
+type changedModTime struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (fi changedModTime) ModTime() time.Time {
+	return fi.modTime
+}
+
+func TestFileSaverModifiedFile(t *testing.T) {
+	var tests = []struct {
+		retries  uint
+		changes  int
+		reads    int
+		modified bool
+	}{
+		{retries: 0, changes: 0, reads: 1, modified: false},
+		{retries: 0, changes: 1, reads: 1, modified: true},
+		{retries: 2, changes: 1, reads: 2, modified: false},
+		{retries: 1, changes: 3, reads: 2, modified: true},
+	}
+
+	content := []byte("file content which changes while it is read")
+	filename := filepath.Join(test.TempDir(t), "file")
+	test.OK(t, os.WriteFile(filename, content, 0600))
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("retries-%d-changes-%d", tt.retries, tt.changes), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s, ctx, wg := startFileSaver(ctx, t)
+			s.ModifiedFileRetries = tt.retries
+
+			var completed uint64
+			s.CompleteBlob = func(bytes uint64) {
+				completed += bytes
+			}
+
+			f, err := fs.Local{}.Open(filename)
+			test.OK(t, err)
+			fi, err := f.Stat()
+			test.OK(t, err)
+
+			file := &changingFile{File: f, changes: tt.changes}
+			fn := s.Save(ctx, filename, filename, file, fi, func() {}, func() {}, func(*restic.Node, ItemStats) {})
+			fnr := fn.take(ctx)
+			test.OK(t, fnr.err)
+
+			s.TriggerShutdown()
+			test.OK(t, wg.Wait())
+
+			test.Equals(t, tt.reads*len(content), file.bytesRead)
+			test.Equals(t, tt.modified, fnr.node.ModifiedDuringBackup)
+			test.Equals(t, uint64(len(content)), fnr.node.Size)
+			test.Equals(t, uint64(len(content)), completed)
+			test.Equals(t, 1, len(fnr.node.Content))
+		})
+	}
+}
+
+// saveFileWithPolynomial saves filename with a new FileSaver using pol, so
+// that the resulting blobs can be compared. configure is called before the
+// file is saved.
+func saveFileWithPolynomial(t testing.TB, filename string, pol chunker.Pol, configure func(s *FileSaver)) *restic.Node {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg, ctx := errgroup.WithContext(ctx)
+
+	saveBlob := func(ctx context.Context, tpe restic.BlobType, buf *Buffer, cb func(SaveBlobResponse)) {
+		cb(SaveBlobResponse{id: restic.Hash(buf.Data), length: len(buf.Data)})
+	}
+	s := NewFileSaver(ctx, wg, saveBlob, restic.Config{ChunkerPolynomial: pol}, 2, 2)
+	s.NodeFromFileInfo = func(snPath, filename string, fi os.FileInfo) (*restic.Node, error) {
+		return restic.NodeFromFileInfo(filename, fi)
+	}
+	configure(s)
+
+	f, err := fs.Track{FS: fs.Local{}}.Open(filename)
+	test.OK(t, err)
+	fi, err := f.Stat()
+	test.OK(t, err)
+
+	fn := s.Save(ctx, filename, filename, f, fi, func() {}, func() {}, func(*restic.Node, ItemStats) {})
+	fnr := fn.take(ctx)
+	test.OK(t, fnr.err)
+
+	s.TriggerShutdown()
+	test.OK(t, wg.Wait())
+
+	return fnr.node
+}
+
+func TestFileSaverSparseFile(t *testing.T) {
+	const size = 6 * 1024 * 1024
+
+	tempdir := test.TempDir(t)
+	data := make([]byte, size)
+	copy(data[3*1024*1024:], randomData(t, 23, 100*1024))
+
+	// the same content, once as a sparse file and once fully allocated
+	sparse := filepath.Join(tempdir, "sparse")
+	f, err := os.Create(sparse)
+	test.OK(t, err)
+	test.OK(t, f.Truncate(size))
+	_, err = f.WriteAt(data[3*1024*1024:3*1024*1024+100*1024], 3*1024*1024)
+	test.OK(t, err)
+	test.OK(t, f.Close())
+
+	full := filepath.Join(tempdir, "full")
+	test.OK(t, os.WriteFile(full, data, 0600))
+
+	pol, err := chunker.RandomPolynomial()
+	test.OK(t, err)
+
+	sparseNode := saveFileWithPolynomial(t, sparse, pol, func(*FileSaver) {})
+	fullNode := saveFileWithPolynomial(t, full, pol, func(*FileSaver) {})
+
+	test.Equals(t, uint64(size), sparseNode.Size)
+	test.Equals(t, fullNode.Content, sparseNode.Content)
+
+	// large sparse files are read in parallel, still skipping the holes
+	parallelNode := saveFileWithPolynomial(t, sparse, pol, func(s *FileSaver) {
+		s.LargeFileReadConcurrency = 4
+		s.LargeFileThreshold = 1
+	})
+	test.Equals(t, fullNode.Content, parallelNode.Content)
+}
+
+func TestFileSaverFileProgress(t *testing.T) {
+	const size = 8 * 1024 * 1024
+
+	filename := filepath.Join(test.TempDir(t), "file")
+	test.OK(t, os.WriteFile(filename, randomData(t, 23, size), 0600))
+
+	pol, err := chunker.RandomPolynomial()
+	test.OK(t, err)
+
+	var reports []uint64
+	node := saveFileWithPolynomial(t, filename, pol, func(s *FileSaver) {
+		s.FileProgress = func(snPath string, read, total uint64) {
+			test.Equals(t, filename, snPath)
+			test.Equals(t, uint64(size), total)
+			reports = append(reports, read)
+		}
+		s.FileProgressBytes = 1
+		s.FileProgressInterval = time.Hour
+	})
+
+	// with FileProgressBytes set to one, every chunk is reported
+	test.Equals(t, len(node.Content), len(reports))
+	for i := 1; i < len(reports); i++ {
+		test.Assert(t, reports[i] > reports[i-1], "progress is not increasing: %v", reports)
+	}
+	test.Equals(t, uint64(size), reports[len(reports)-1])
+}
+
+func TestFileProgressUpdate(t *testing.T) {
+	type report struct{ read, total uint64 }
+	var reports []report
+
+	p := &fileProgress{
+		report: func(read, total uint64) {
+			reports = append(reports, report{read, total})
+		},
+		bytes:    10,
+		interval: time.Hour,
+		last:     time.Now(),
+	}
+
+	p.update(5, 100)
+	p.update(10, 100)
+	p.update(15, 100)
+	p.update(20, 100)
+	// the file has grown while it is read
+	p.update(120, 100)
+	// the file is read again from the start
+	p.update(12, 130)
+
+	test.Equals(t, []report{{10, 100}, {20, 100}, {120, 120}, {12, 130}}, reports)
+
+	// reports are also sent once the interval has passed
+	p.interval = 0
+	p.update(13, 130)
+	test.Equals(t, report{13, 130}, reports[len(reports)-1])
+}
+
+func BenchmarkFileSaverFileProgress(b *testing.B) {
+	const size = 40 * 1024 * 1024
+
+	filename := filepath.Join(test.TempDir(b), "file")
+	test.OK(b, os.WriteFile(filename, randomData(b, 23, size), 0600))
+
+	pol, err := chunker.RandomPolynomial()
+	test.OK(b, err)
+
+	for _, progress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("progress-%v", progress), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				saveFileWithPolynomial(b, filename, pol, func(s *FileSaver) {
+					if progress {
+						s.FileProgress = func(string, uint64, uint64) {}
+						s.FileProgressBytes = 64 * 1024 * 1024
+						s.FileProgressInterval = time.Second
+					}
+				})
+			}
+		})
+	}
+}
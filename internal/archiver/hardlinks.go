@@ -0,0 +1,77 @@
+package archiver
+
+import (
+	"os"
+	"sync"
+
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/restic"
+)
+
+// hardLinkIndex remembers the files with several hard links which have been
+// saved during a backup run. Further links to such a file, in the same or in
+// another target, are saved with the content of the first link instead of
+// reading the file again, so all links are recorded consistently.
+type hardLinkIndex struct {
+	m     sync.Mutex
+	links map[fileID]*hardLink
+}
+
+func newHardLinkIndex() *hardLinkIndex {
+	return &hardLinkIndex{links: make(map[fileID]*hardLink)}
+}
+
+// hardLink is the first link to a file which is saved. The channel done is
+// closed once node is set, node is nil if the file could not be saved.
+type hardLink struct {
+	once sync.Once
+	done chan struct{}
+	node *restic.Node
+}
+
+// add returns the entry for the file described by fi. If first is true, the
+// caller must save the file and call complete on the returned link, which is
+// nil for files with a single link or when the index is full.
+func (idx *hardLinkIndex) add(fi os.FileInfo) (link *hardLink, first bool) {
+	if idx == nil {
+		return nil, true
+	}
+
+	_, links, err := fs.Inode(fi)
+	if err != nil || links <= 1 {
+		return nil, true
+	}
+
+	key, ok := fileKey(fi)
+	if !ok {
+		return nil, true
+	}
+
+	idx.m.Lock()
+	defer idx.m.Unlock()
+
+	if link, ok := idx.links[key]; ok {
+		return link, false
+	}
+
+	if len(idx.links) >= scanMaxHardLinks {
+		return nil, true
+	}
+
+	link = &hardLink{done: make(chan struct{})}
+	idx.links[key] = link
+	return link, true
+}
+
+// complete records the node saved for the first link. It is a no-op for a nil
+// link and for all but the first call.
+func (l *hardLink) complete(node *restic.Node) {
+	if l == nil {
+		return
+	}
+
+	l.once.Do(func() {
+		l.node = node
+		close(l.done)
+	})
+}
@@ -0,0 +1,116 @@
+package archiver
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Order selects the order in which the entries of a directory are processed
+// by the Scanner and the Archiver.
+type Order int
+
+const (
+	// OrderBytewise sorts names byte-wise. This is the order in which nodes
+	// are stored in a tree in the repo.
+	OrderBytewise Order = iota
+
+	// OrderNatural sorts names case-insensitively and compares runs of digits
+	// by their numeric value, so that "file2" comes before "File10". Names
+	// which compare equal are ordered byte-wise.
+	OrderNatural
+)
+
+// SortNames sorts the directory entries in names in the given order. Both
+// the Scanner and the Archiver use it, so that they visit the entries in the
+// same sequence.
+func SortNames(names []string, order Order) {
+	switch order {
+	case OrderNatural:
+		sort.Slice(names, func(i, j int) bool {
+			return naturalLess(names[i], names[j])
+		})
+	default:
+		sort.Strings(names)
+	}
+}
+
+// naturalLess returns true if a sorts before b in natural order.
+func naturalLess(a, b string) bool {
+	if c := naturalCompare(a, b); c != 0 {
+		return c < 0
+	}
+	return a < b
+}
+
+// naturalCompare compares a and b case-insensitively, treating runs of
+// digits as numbers. It returns -1, 0 or 1.
+func naturalCompare(a, b string) int {
+	for len(a) > 0 && len(b) > 0 {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			var da, db string
+			da, a = digitRun(a)
+			db, b = digitRun(b)
+			if c := compareNumbers(da, db); c != 0 {
+				return c
+			}
+			continue
+		}
+
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		a, b = a[na:], b[nb:]
+
+		ra, rb = unicode.ToLower(ra), unicode.ToLower(rb)
+		if ra != rb {
+			if ra < rb {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case len(a) > 0:
+		return 1
+	case len(b) > 0:
+		return -1
+	}
+	return 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// digitRun splits s after the leading run of digits.
+func digitRun(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// compareNumbers compares two runs of digits by their numeric value without
+// converting them, so arbitrarily long runs work.
+func compareNumbers(a, b string) int {
+	for len(a) > 1 && a[0] == '0' {
+		a = a[1:]
+	}
+	for len(b) > 1 && b[0] == '0' {
+		b = b[1:]
+	}
+
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package archiver
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSortNames(t *testing.T) {
+	var tests = []struct {
+		order Order
+		names []string
+		want  []string
+	}{
+		{
+			order: OrderBytewise,
+			names: []string{"b", "File10", "a", "file2", "B", "file10"},
+			want:  []string{"B", "File10", "a", "b", "file10", "file2"},
+		},
+		{
+			order: OrderNatural,
+			names: []string{"b", "File10", "a", "file2", "B", "file10"},
+			want:  []string{"a", "B", "b", "file2", "File10", "file10"},
+		},
+		{
+			order: OrderNatural,
+			names: []string{"x010", "x9", "x10", "x", "x1y", "x1"},
+			want:  []string{"x", "x1", "x1y", "x9", "x010", "x10"},
+		},
+		{
+			order: OrderNatural,
+			names: []string{"Äb", "äa", "ac"},
+			want:  []string{"ac", "äa", "Äb"},
+		},
+	}
+
+	for _, test := range tests {
+		SortNames(test.names, test.order)
+		if !cmp.Equal(test.want, test.names) {
+			t.Errorf("order %v: wrong result, diff:\n%s", test.order, cmp.Diff(test.want, test.names))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package archiver
+
+import (
+	"io"
+	"sync"
+)
+
+// parallelReadRegionSize is the size of the regions a parallelReader reads
+// concurrently.
+const parallelReadRegionSize = 8 * 1024 * 1024
+
+// parallelReader reads a file of a known size via several goroutines, each
+// reading a different region. The data is returned by Read in the same order
+// as a sequential reader would return it. At most workers regions are held
+// in memory ahead of the consumer.
+//
+// If the file grows while it is being read, the data after the initial size
+// is read sequentially. If it shrinks, Read returns io.EOF at the new end.
+type parallelReader struct {
+	rd      io.ReaderAt
+	pending chan chan parallelRegion
+	free    chan []byte
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+
+	cur    []byte // remaining data of the current region
+	buf    []byte // buffer of the current region, reused when consumed
+	offset int64  // offset of the end of the data returned by Read so far
+	tail   bool   // all regions have been consumed, read sequentially
+	err    error
+}
+
+type parallelRegion struct {
+	buf []byte
+	err error
+}
+
+type parallelJob struct {
+	offset int64
+	length int
+	ch     chan<- parallelRegion
+}
+
+// newParallelReader starts reading size bytes from rd with workers goroutines
+// in regions of regionSize bytes. Close must be called to stop them.
+func newParallelReader(rd io.ReaderAt, size int64, workers uint, regionSize int) *parallelReader {
+	r := &parallelReader{
+		rd:      rd,
+		pending: make(chan chan parallelRegion, workers),
+		free:    make(chan []byte, workers+1),
+		done:    make(chan struct{}),
+	}
+
+	jobs := make(chan parallelJob)
+
+	for i := uint(0); i < workers; i++ {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			for job := range jobs {
+				r.read(job)
+			}
+		}()
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(jobs)
+		defer close(r.pending)
+
+		for offset := int64(0); offset < size; offset += int64(regionSize) {
+			length := regionSize
+			if size-offset < int64(length) {
+				length = int(size - offset)
+			}
+
+			// the channel is buffered so that workers never block
+			ch := make(chan parallelRegion, 1)
+
+			// the capacity of pending limits the number of regions read ahead
+			select {
+			case r.pending <- ch:
+			case <-r.done:
+				return
+			}
+
+			select {
+			case jobs <- parallelJob{offset: offset, length: length, ch: ch}:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// read reads the region described by job and sends the result to job.ch.
+func (r *parallelReader) read(job parallelJob) {
+	var buf []byte
+	select {
+	case buf = <-r.free:
+	default:
+	}
+	if cap(buf) < job.length {
+		buf = make([]byte, job.length)
+	}
+	buf = buf[:job.length]
+
+	n, err := r.rd.ReadAt(buf, job.offset)
+	if err == io.EOF && n == job.length {
+		err = nil
+	}
+
+	job.ch <- parallelRegion{buf: buf[:n], err: err}
+}
+
+// Read returns the data of the file in order.
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.tail {
+			return r.readTail(p)
+		}
+
+		ch, ok := <-r.pending
+		if !ok {
+			r.tail = true
+			continue
+		}
+
+		res := <-ch
+		r.release()
+		r.buf, r.cur = res.buf, res.buf
+		r.offset += int64(len(res.buf))
+
+		// when the file has become shorter, the remaining regions are ignored
+		r.err = res.err
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// readTail reads data written after the initial end of the file.
+func (r *parallelReader) readTail(p []byte) (int, error) {
+	n, err := r.rd.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if n > 0 {
+		// return the error with the next call
+		r.err = err
+		return n, nil
+	}
+	return 0, err
+}
+
+// release hands the buffer of the current region back to the workers.
+func (r *parallelReader) release() {
+	if r.buf == nil {
+		return
+	}
+
+	select {
+	case r.free <- r.buf:
+	default:
+	}
+	r.buf = nil
+}
+
+// Close stops all goroutines. It does not close the underlying file.
+func (r *parallelReader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	r.wg.Wait()
+	return nil
+}
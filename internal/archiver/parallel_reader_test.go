@@ -0,0 +1,141 @@
+package archiver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/restic/chunker"
+	"github.com/restic/restic/internal/restic"
+	restictest "github.com/restic/restic/internal/test"
+)
+
+func randomData(t testing.TB, seed int64, size int) []byte {
+	buf := make([]byte, size)
+	_, err := rand.New(rand.NewSource(seed)).Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestParallelReader(t *testing.T) {
+	const regionSize = 1000
+
+	for _, size := range []int{0, 1, regionSize - 1, regionSize, regionSize + 1, 10*regionSize + 3} {
+		for _, workers := range []uint{1, 3, 8} {
+			data := randomData(t, int64(size), size)
+
+			var tests = []struct {
+				name     string
+				data     []byte
+				initSize int64
+			}{
+				{"same-size", data, int64(len(data))},
+				{"grown", data, int64(len(data) / 2)},
+				{"shrunk", data[:len(data)/2], int64(len(data))},
+			}
+
+			for _, test := range tests {
+				t.Run(fmt.Sprintf("%v-%v-%v", test.name, size, workers), func(t *testing.T) {
+					rd := newParallelReader(bytes.NewReader(test.data), test.initSize, workers, regionSize)
+					buf, err := io.ReadAll(rd)
+					restictest.OK(t, err)
+					restictest.OK(t, rd.Close())
+
+					if !bytes.Equal(buf, test.data) {
+						t.Fatalf("wrong data returned, want %d bytes, got %d bytes", len(test.data), len(buf))
+					}
+				})
+			}
+		}
+	}
+}
+
+type errorReaderAt struct {
+	io.ReaderAt
+	offset int64
+	err    error
+}
+
+func (r errorReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.offset {
+		return 0, r.err
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func TestParallelReaderError(t *testing.T) {
+	data := randomData(t, 23, 10000)
+	testErr := errors.New("test error")
+
+	rd := newParallelReader(errorReaderAt{ReaderAt: bytes.NewReader(data), offset: 5000, err: testErr}, int64(len(data)), 4, 1000)
+	buf, err := io.ReadAll(rd)
+	if !errors.Is(err, testErr) {
+		t.Fatalf("wrong error returned, want %v, got %v", testErr, err)
+	}
+	restictest.OK(t, rd.Close())
+
+	if !bytes.Equal(buf, data[:5000]) {
+		t.Fatalf("wrong data returned, want 5000 bytes, got %d bytes", len(buf))
+	}
+
+	// closing the reader early must stop all goroutines
+	rd = newParallelReader(bytes.NewReader(data), int64(len(data)), 4, 1000)
+	_, err = rd.Read(make([]byte, 10))
+	restictest.OK(t, err)
+	restictest.OK(t, rd.Close())
+}
+
+func TestFileSaverLargeFileReadConcurrency(t *testing.T) {
+	filename := filepath.Join(restictest.TempDir(t), "file")
+	restictest.OK(t, os.WriteFile(filename, randomData(t, 42, 3*parallelReadRegionSize+12345), 0600))
+
+	// use the same chunker polynomial for both runs
+	pol, err := chunker.RandomPolynomial()
+	restictest.OK(t, err)
+
+	var results [][]restic.ID
+	for _, concurrency := range []uint{1, 4} {
+		node := saveFileWithPolynomial(t, filename, pol, func(s *FileSaver) {
+			s.LargeFileReadConcurrency = concurrency
+			s.LargeFileThreshold = 1
+		})
+		results = append(results, node.Content)
+	}
+
+	if len(results[0]) == 0 {
+		t.Fatal("no blobs saved")
+	}
+	restictest.Equals(t, results[0], results[1])
+}
+
+func BenchmarkParallelReader(b *testing.B) {
+	const size = 64 * 1024 * 1024
+
+	filename := filepath.Join(restictest.TempDir(b), "file")
+	restictest.OK(b, os.WriteFile(filename, randomData(b, 42, size), 0600))
+
+	for _, workers := range []uint{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("%d", workers), func(b *testing.B) {
+			b.SetBytes(size)
+			buf := make([]byte, 1024*1024)
+
+			for i := 0; i < b.N; i++ {
+				f, err := os.Open(filename)
+				restictest.OK(b, err)
+
+				rd := newParallelReader(f, size, workers, parallelReadRegionSize)
+				_, err = io.CopyBuffer(io.Discard, struct{ io.Reader }{rd}, buf)
+				restictest.OK(b, err)
+				restictest.OK(b, rd.Close())
+				restictest.OK(b, f.Close())
+			}
+		})
+	}
+}
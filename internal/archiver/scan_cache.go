@@ -0,0 +1,169 @@
+package archiver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// scanCacheVersion is incremented when the format of the cache file changes.
+const scanCacheVersion = 1
+
+// ScanCache remembers the contents of directories found by a Scanner, so that
+// subsequent scans can skip directories which have not been modified since.
+type ScanCache struct {
+	filename string
+	key      string
+
+	m   sync.Mutex
+	old map[string]scanCacheEntry
+	new map[string]scanCacheEntry
+}
+
+type scanCacheEntry struct {
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+
+	// Direct contains the stats for all entries of the directory which are
+	// not directories themselves, Subdirs the names of the directories.
+	Direct  ScanStats `json:"direct"`
+	Subdirs []string  `json:"subdirs,omitempty"`
+}
+
+type scanCacheFile struct {
+	Version int                       `json:"version"`
+	Key     string                    `json:"key"`
+	Entries map[string]scanCacheEntry `json:"entries"`
+}
+
+// ScanCacheKey returns a key for the scan cache from parts, which must
+// identify the file system and all settings which influence which files are
+// selected by the scanner (e.g. exclude patterns).
+func ScanCacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		// include the length to make the key unambiguous
+		buf, _ := json.Marshal(part)
+		_, _ = h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NewScanCache loads the scan cache from filename. If the file does not exist
+// or was created with a different key, an empty cache is returned.
+func NewScanCache(filename, key string) (*ScanCache, error) {
+	c := &ScanCache{
+		filename: filename,
+		key:      key,
+		old:      make(map[string]scanCacheEntry),
+		new:      make(map[string]scanCacheEntry),
+	}
+
+	buf, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var f scanCacheFile
+	err = json.Unmarshal(buf, &f)
+	if err != nil {
+		debug.Log("unable to decode scan cache %v, ignoring: %v", filename, err)
+		return c, nil
+	}
+
+	if f.Version != scanCacheVersion || f.Key != key {
+		debug.Log("scan cache %v is outdated, ignoring", filename)
+		return c, nil
+	}
+
+	if f.Entries != nil {
+		c.old = f.Entries
+	}
+	return c, nil
+}
+
+// lookup returns the entry stored for the directory dir if it has not been
+// modified since.
+func (c *ScanCache) lookup(dir string, fi os.FileInfo) (scanCacheEntry, bool) {
+	if c == nil {
+		return scanCacheEntry{}, false
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	e, ok := c.old[dir]
+	if !ok || !e.ModTime.Equal(fi.ModTime()) || e.Size != fi.Size() {
+		return scanCacheEntry{}, false
+	}
+
+	return e, true
+}
+
+// store records the contents of the directory dir.
+func (c *ScanCache) store(dir string, fi os.FileInfo, direct ScanStats, subdirs []string) {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.new[dir] = scanCacheEntry{
+		ModTime: fi.ModTime(),
+		Size:    fi.Size(),
+		Direct:  direct,
+		Subdirs: subdirs,
+	}
+}
+
+// Save writes all entries used or found during the last scan to the cache
+// file. Entries for directories which have not been seen are dropped.
+func (c *ScanCache) Save() error {
+	c.m.Lock()
+	buf, err := json.Marshal(scanCacheFile{
+		Version: scanCacheVersion,
+		Key:     c.key,
+		Entries: c.new,
+	})
+	c.m.Unlock()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.filename), 0700)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// write to a temporary file first so that the cache is never truncated
+	f, err := os.CreateTemp(filepath.Dir(c.filename), filepath.Base(c.filename)+"-tmp-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = f.Write(buf)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(f.Name(), c.filename))
+}
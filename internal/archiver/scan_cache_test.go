@@ -0,0 +1,116 @@
+package archiver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/fs"
+	restictest "github.com/restic/restic/internal/test"
+)
+
+// lstatCountFS counts the calls to Lstat.
+type lstatCountFS struct {
+	fs.FS
+	calls *int32
+}
+
+func (f lstatCountFS) Lstat(name string) (os.FileInfo, error) {
+	atomic.AddInt32(f.calls, 1)
+	return f.FS.Lstat(name)
+}
+
+func scanWithCache(t testing.TB, cache *ScanCache) (ScanStats, int32) {
+	var calls int32
+	sc := NewScanner(lstatCountFS{FS: fs.Track{FS: fs.Local{}}, calls: &calls})
+	sc.Cache = cache
+
+	var stats ScanStats
+	sc.Result = func(item string, s ScanStats) {
+		if item == "" {
+			stats = s
+		}
+	}
+
+	err := sc.Scan(context.TODO(), []string{"work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stats, calls
+}
+
+func loadScanCache(t testing.TB, filename, key string) *ScanCache {
+	cache, err := NewScanCache(filename, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestScanCache(t *testing.T) {
+	src := TestDir{
+		"work": TestDir{
+			"foo":     TestFile{Content: "foo"},
+			"foo.txt": TestFile{Content: "foo text file"},
+			"subdir": TestDir{
+				"other":   TestFile{Content: "other in subdir"},
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+			},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+	cacheFile := filepath.Join(restictest.TempDir(t), "cache", "scan.json")
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	want := ScanStats{Files: 4, Dirs: 2, Bytes: 48}
+	key := ScanCacheKey("local", "--exclude=*.bak")
+
+	// first run, nothing is cached
+	cache := loadScanCache(t, cacheFile, key)
+	stats, fullCalls := scanWithCache(t, cache)
+	if stats != want {
+		t.Errorf("wrong result, want\n  %#v\ngot:\n  %#v", want, stats)
+	}
+	restictest.OK(t, cache.Save())
+
+	// second run, only the directories are visited
+	cache = loadScanCache(t, cacheFile, key)
+	stats, calls := scanWithCache(t, cache)
+	if stats != want {
+		t.Errorf("wrong result for cached scan, want\n  %#v\ngot:\n  %#v", want, stats)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls to lstat for cached run, got %d (full scan: %d)", calls, fullCalls)
+	}
+	restictest.OK(t, cache.Save())
+
+	// adding a file changes the mtime of the directory
+	restictest.OK(t, os.WriteFile(filepath.Join("work", "subdir", "new"), []byte("new file"), 0644))
+	// make sure the modification is visible even if the file system has a
+	// coarse timestamp resolution
+	future := time.Now().Add(time.Hour)
+	restictest.OK(t, os.Chtimes(filepath.Join("work", "subdir"), future, future))
+
+	cache = loadScanCache(t, cacheFile, key)
+	stats, _ = scanWithCache(t, cache)
+	want = ScanStats{Files: 5, Dirs: 2, Bytes: 56}
+	if stats != want {
+		t.Errorf("wrong result after modification, want\n  %#v\ngot:\n  %#v", want, stats)
+	}
+	restictest.OK(t, cache.Save())
+
+	// the cache is not used if the key changes
+	cache = loadScanCache(t, cacheFile, ScanCacheKey("local", "--exclude=*.txt"))
+	_, calls = scanWithCache(t, cache)
+	if calls != fullCalls+1 {
+		t.Errorf("expected %d calls to lstat with a different key, got %d", fullCalls+1, calls)
+	}
+}
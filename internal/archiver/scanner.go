@@ -2,12 +2,16 @@ package archiver
 
 import (
 	"context"
+	"fmt"
 	"os"
-	"path/filepath"
-	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/fs"
+	"golang.org/x/sync/errgroup"
 )
 
 // Scanner  traverses the targets and calls the function Result with cumulated
@@ -19,6 +23,124 @@ type Scanner struct {
 	Select       SelectFunc
 	Error        ErrorFunc
 	Result       func(item string, s ScanStats)
+
+	// ResultPerTarget is called once at the end of a successful scan with the
+	// stats for each of the targets passed to Scan. When targets overlap,
+	// each item is only counted for the most specific target containing it.
+	ResultPerTarget func(stats map[string]ScanStats)
+
+	// Progress is called together with Result and additionally receives the
+	// current throughput of the scan.
+	Progress func(item string, s ScanStats, p ScanProgress)
+
+	// ReportInterval is the minimum duration between two calls to Result and
+	// Progress. If it is zero, they are called for every item found. The
+	// final call with the complete result at the end of Scan is never
+	// suppressed.
+	ReportInterval time.Duration
+
+	// Order is the order in which the entries of a directory are scanned. It
+	// should match the Order of the Archiver, so that the items reported by
+	// the Scanner arrive in the same sequence in which they are saved.
+	Order Order
+
+	// OneFileSystem configures the scanner to not descend into directories
+	// which are located on a different device than the target they belong
+	// to. The mountpoint itself is still counted. If the file system does not
+	// provide device IDs, this option has no effect.
+	OneFileSystem bool
+
+	// TolerateDirErrors counts directories which cannot be listed if Error
+	// suppresses the error. It should match the setting of the Archiver.
+	TolerateDirErrors bool
+
+	// ReadDevices counts block and character devices as files, including the
+	// size of block devices. It should match the setting of the Archiver.
+	ReadDevices bool
+
+	// Cache, if set, is used to avoid listing directories which have not
+	// been modified since the last scan and running lstat() on the files
+	// within, their stats are taken from the cache instead. Subdirectories
+	// are still visited. As modifying a file does not change the modification
+	// time of the directory containing it, changed file sizes are not
+	// noticed, so the cache must only be used for estimations.
+	Cache *ScanCache
+
+	// MaxDepth limits how deep the scanner descends into the directory tree
+	// below each target. Directories located MaxDepth levels below a target
+	// are counted, but their contents are not scanned. Zero means unlimited.
+	MaxDepth uint
+
+	// CountHardLinksOnce configures the scanner to add the size of a file
+	// with several hard links only once to the total. Further links are
+	// counted in ScanStats.HardLinks instead. Only files with a link count
+	// above one are remembered, at most scanMaxHardLinks of them. If the file
+	// system does not provide inode numbers, this option has no effect.
+	CountHardLinksOnce bool
+
+	// AllocatedSize configures the scanner to count the bytes allocated on
+	// disk for sparse files instead of their apparent size, as the holes
+	// are not read during the backup. If the file system cannot detect holes,
+	// this option has no effect.
+	AllocatedSize bool
+
+	// CountExcludedSubtrees configures the scanner to descend into
+	// directories rejected by SelectByName or Select and to add their
+	// contents to the excluded counters in ScanStats. Otherwise only the
+	// directory itself is counted.
+	CountExcludedSubtrees bool
+
+	// SkipIf is called for each directory with the names of its entries
+	// before they are scanned. If it returns true, the contents of the
+	// directory are not scanned and it is counted in ScanStats.SkippedDirs.
+	// SkipIf may be called concurrently. Directories restored from the Cache
+	// are not checked again, as their list of entries has not changed.
+	SkipIf SkipFunc
+
+	// Concurrency sets how many directories are scanned concurrently. If it
+	// is zero or one, the targets are traversed sequentially. With a higher
+	// value, Result is called from several goroutines (but never
+	// concurrently) and the order of the items passed to it is not
+	// deterministic. The final result is the same in both cases.
+	Concurrency uint
+
+	// sem limits the number of additional goroutines running scan().
+	sem chan struct{}
+
+	// targets holds the absolute paths of the original targets.
+	targets []scanTarget
+
+	// m protects the fields below and serializes calls to Result.
+	m          sync.Mutex
+	stats      ScanStats
+	start      time.Time
+	lastReport time.Time
+	samples    []scanSample
+	hardLinks  map[fileID]struct{}
+
+	// caps are the capabilities of FS during Scan.
+	caps fs.Capabilities
+}
+
+// fileID identifies a file by its device ID and inode number.
+type fileID struct {
+	device, inode uint64
+}
+
+// scanMaxHardLinks is the maximum number of files with several hard links the
+// scanner remembers. With tens of millions of hard linked files, the map would
+// otherwise use several GiB of memory. Once the limit is reached, additional
+// links are counted as regular files.
+const scanMaxHardLinks = 10 * 1000 * 1000
+
+// scanTarget collects the stats for one of the targets passed to Scan.
+type scanTarget struct {
+	name, abs string
+	stats     ScanStats
+
+	// device is the device ID of the target, only valid if hasDevice is set.
+	device    uint64
+	hasDevice bool
 }
 
 // NewScanner initializes a new Scanner.
@@ -29,6 +151,9 @@ func NewScanner(fs fs.FS) *Scanner {
 		Select:       func(item string, fi os.FileInfo) bool { return true },
 		Error:        func(item string, err error) error { return err },
 		Result:       func(item string, s ScanStats) {},
+
+		ResultPerTarget: func(stats map[string]ScanStats) {},
+		Progress:        func(item string, s ScanStats, p ScanProgress) {},
 	}
 }
 
@@ -36,38 +161,245 @@ func NewScanner(fs fs.FS) *Scanner {
 type ScanStats struct {
 	Files, Dirs, Others uint
 	Bytes               uint64
+
+	// SkippedMountpoints is the number of directories whose contents were
+	// not scanned because they are located on a different file system.
+	SkippedMountpoints uint
+
+	// HardLinks is the number of files which were not added to Bytes
+	// because another hard link to the same file was already counted.
+	HardLinks uint
+
+	// Errors is the number of items which could not be scanned, for which
+	// the error was suppressed by the error callback.
+	Errors uint
+
+	// ExcludedFiles, ExcludedDirs and ExcludedBytes count the items
+	// rejected by SelectByName or Select. They are not included in Files,
+	// Dirs and Bytes.
+	ExcludedFiles, ExcludedDirs uint
+	ExcludedBytes               uint64
+
+	// SkippedDirs is the number of directories whose contents were not
+	// scanned because SkipIf returned true for them.
+	SkippedDirs uint
+
+	// Truncated is set if directories were not scanned because they are
+	// located deeper than the configured maximum depth.
+	Truncated bool
+}
+
+// ErrCycleDetected is passed to the error callback of the Scanner and the
+// Archiver when a directory is found which is also one of its own parent
+// directories. This can only happen if the file system follows symlinks. The
+// directory is skipped.
+var ErrCycleDetected = errors.New("directory cycle detected")
+
+// dirChain is a linked list of the directories from a target down to the
+// directory currently being scanned.
+type dirChain struct {
+	key    fileID
+	parent *dirChain
+}
+
+// contains returns true if a directory identified by key is in the chain.
+func (c *dirChain) contains(key fileID) bool {
+	for ; c != nil; c = c.parent {
+		if c.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanProgress describes the throughput of a running scan.
+type ScanProgress struct {
+	Elapsed     time.Duration // time since the start of the scan
+	ItemsPerSec float64       // files, dirs and other items found per second
+	BytesPerSec float64       // bytes found per second
+}
+
+// scanRateWindow is the duration of the sliding window used to compute the
+// rates in ScanProgress.
+const scanRateWindow = 10 * time.Second
+
+// scanSample records the cumulated stats at a point in time.
+type scanSample struct {
+	t            time.Time
+	items, bytes uint64
+}
+
+func (s ScanStats) items() uint64 {
+	return uint64(s.Files) + uint64(s.Dirs) + uint64(s.Others)
 }
 
-func (s *Scanner) scanTree(ctx context.Context, stats ScanStats, tree Tree) (ScanStats, error) {
+// add adds the counters in other to s.
+func (s *ScanStats) add(other ScanStats) {
+	s.Files += other.Files
+	s.Dirs += other.Dirs
+	s.Others += other.Others
+	s.Bytes += other.Bytes
+	s.SkippedMountpoints += other.SkippedMountpoints
+	s.HardLinks += other.HardLinks
+	s.Errors += other.Errors
+	s.SkippedDirs += other.SkippedDirs
+	s.ExcludedFiles += other.ExcludedFiles
+	s.ExcludedDirs += other.ExcludedDirs
+	s.ExcludedBytes += other.ExcludedBytes
+	s.Truncated = s.Truncated || other.Truncated
+}
+
+// report adds delta to the cumulated stats as well as the stats of target and
+// calls Result for item. If final is false, the call is skipped when the last
+// one happened less than ReportInterval ago.
+func (s *Scanner) report(item string, target *scanTarget, delta ScanStats, final bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.addStats(target, delta)
+
+	now := time.Now()
+	s.sample(now)
+
+	if !final && s.ReportInterval > 0 && now.Sub(s.lastReport) < s.ReportInterval {
+		return
+	}
+	s.lastReport = now
+
+	s.Result(item, s.stats)
+	s.Progress(item, s.stats, s.progress(now))
+}
+
+// count adds delta to the cumulated stats as well as the stats of target
+// without calling Result.
+func (s *Scanner) count(target *scanTarget, delta ScanStats) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.addStats(target, delta)
+}
+
+// addStats adds delta to the cumulated stats and the stats of target. The
+// caller must hold s.m.
+func (s *Scanner) addStats(target *scanTarget, delta ScanStats) {
+	s.stats.add(delta)
+	if target != nil {
+		target.stats.add(delta)
+	}
+}
+
+// sample records the current stats for the rate computation and drops
+// samples which are older than the sliding window. At most ten samples per
+// window are kept.
+func (s *Scanner) sample(now time.Time) {
+	if len(s.samples) > 0 && now.Sub(s.samples[len(s.samples)-1].t) < scanRateWindow/10 {
+		return
+	}
+
+	cutoff := now.Add(-scanRateWindow)
+	i := 0
+	for i < len(s.samples)-1 && s.samples[i].t.Before(cutoff) {
+		i++
+	}
+	s.samples = append(s.samples[i:], scanSample{t: now, items: s.stats.items(), bytes: s.stats.Bytes})
+}
+
+// progress computes the throughput within the sliding window.
+func (s *Scanner) progress(now time.Time) ScanProgress {
+	p := ScanProgress{Elapsed: now.Sub(s.start)}
+
+	// use the start of the scan if there is no older sample yet
+	oldest := scanSample{t: s.start}
+	if len(s.samples) > 0 && s.samples[0].t.Before(now) {
+		oldest = s.samples[0]
+	}
+
+	secs := now.Sub(oldest.t).Seconds()
+	if secs <= 0 {
+		return p
+	}
+
+	p.ItemsPerSec = float64(s.stats.items()-oldest.items) / secs
+	p.BytesPerSec = float64(s.stats.Bytes-oldest.bytes) / secs
+	return p
+}
+
+// findTarget returns the most specific target which contains the path item,
+// or nil if there is none.
+func (s *Scanner) findTarget(item string) *scanTarget {
+	var res *scanTarget
+	for i := range s.targets {
+		t := &s.targets[i]
+
+		prefix := t.abs
+		if !strings.HasSuffix(prefix, s.FS.Separator()) {
+			prefix += s.FS.Separator()
+		}
+
+		if item != t.abs && !strings.HasPrefix(item, prefix) {
+			continue
+		}
+
+		if res == nil || len(t.abs) > len(res.abs) {
+			res = t
+		}
+	}
+	return res
+}
+
+// spawn runs fn in a new goroutine in wg if a worker slot is available,
+// otherwise fn is run synchronously. This way the number of goroutines is
+// bounded and a worker waiting for its children can never deadlock.
+func (s *Scanner) spawn(wg *errgroup.Group, fn func() error) error {
+	if s.sem == nil {
+		return fn()
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		wg.Go(func() error {
+			defer func() { <-s.sem }()
+			return fn()
+		})
+		return nil
+	default:
+		return fn()
+	}
+}
+
+func (s *Scanner) scanTree(ctx context.Context, tree Tree) error {
 	// traverse the path in the file system for all leaf nodes
 	if tree.Leaf() {
 		abstarget, err := s.FS.Abs(tree.Path)
 		if err != nil {
-			return ScanStats{}, err
-		}
-
-		stats, err = s.scan(ctx, stats, abstarget)
-		if err != nil {
-			return ScanStats{}, err
+			return err
 		}
 
-		return stats, nil
+		_, err = s.scan(ctx, abstarget, scanPosition{owner: s.findTarget(abstarget)})
+		return err
 	}
 
+	var wg errgroup.Group
+
 	// otherwise recurse into the nodes in a deterministic order
-	for _, name := range tree.NodeNames() {
-		var err error
-		stats, err = s.scanTree(ctx, stats, tree.Nodes[name])
+	nodeNames := tree.NodeNames()
+	SortNames(nodeNames, s.Order)
+	for _, name := range nodeNames {
+		subtree := tree.Nodes[name]
+		err := s.spawn(&wg, func() error {
+			return s.scanTree(ctx, subtree)
+		})
 		if err != nil {
-			return ScanStats{}, err
+			_ = wg.Wait()
+			return err
 		}
 
 		if ctx.Err() != nil {
-			return stats, nil
+			break
 		}
 	}
 
-	return stats, nil
+	return wg.Wait()
 }
 
 // Scan traverses the targets. The function Result is called for each new item
@@ -75,7 +407,7 @@ func (s *Scanner) scanTree(ctx context.Context, stats ScanStats, tree Tree) (Sca
 func (s *Scanner) Scan(ctx context.Context, targets []string) error {
 	debug.Log("start scan for %v", targets)
 
-	cleanTargets, err := resolveRelativeTargets(s.FS, targets)
+	cleanTargets, err := resolveRelativeTargets(s.FS, targets, s.Order)
 	if err != nil {
 		return err
 	}
@@ -88,59 +420,425 @@ func (s *Scanner) Scan(ctx context.Context, targets []string) error {
 		return err
 	}
 
-	stats, err := s.scanTree(ctx, ScanStats{}, *tree)
+	s.caps = fs.CapabilitiesOf(s.FS)
+	s.targets = make([]scanTarget, 0, len(targets))
+	for _, target := range targets {
+		abstarget, err := s.FS.Abs(target)
+		if err != nil {
+			return err
+		}
+		t := scanTarget{name: target, abs: abstarget}
+		if s.OneFileSystem && s.caps.Has(fs.CapDeviceIDs) {
+			t.device, t.hasDevice = s.deviceID(abstarget)
+		}
+		s.targets = append(s.targets, t)
+	}
+
+	s.stats = ScanStats{}
+	s.start = time.Now()
+	s.lastReport = s.start
+	s.samples = nil
+	s.hardLinks = nil
+	if s.CountHardLinksOnce && s.caps.Has(fs.CapInodes|fs.CapDeviceIDs) {
+		s.hardLinks = make(map[fileID]struct{})
+	}
+	s.sem = nil
+	if s.Concurrency > 1 {
+		// the goroutine calling Scan counts as the first worker
+		s.sem = make(chan struct{}, s.Concurrency-1)
+	}
+
+	err = s.scanTree(ctx, *tree)
 	if err != nil {
 		return err
 	}
 
-	s.Result("", stats)
-	debug.Log("result: %+v", stats)
+	perTarget := make(map[string]ScanStats, len(s.targets))
+	for _, t := range s.targets {
+		stats := perTarget[t.name]
+		stats.add(t.stats)
+		perTarget[t.name] = stats
+	}
+	s.ResultPerTarget(perTarget)
+
+	s.report("", nil, ScanStats{}, true)
+	debug.Log("result: %+v", s.stats)
 	return nil
 }
 
-func (s *Scanner) scan(ctx context.Context, stats ScanStats, target string) (ScanStats, error) {
+// deviceID returns the device ID for item. If it cannot be determined, false
+// is returned.
+func (s *Scanner) deviceID(item string) (uint64, bool) {
+	fi, err := s.FS.Lstat(item)
+	if err != nil {
+		debug.Log("unable to stat target %v: %v", item, err)
+		return 0, false
+	}
+
+	id, err := fs.DeviceID(fi)
+	if err != nil {
+		debug.Log("unable to determine device for %v: %v", item, err)
+		return 0, false
+	}
+
+	return id, true
+}
+
+// crossesMountpoint returns true if the directory described by fi is located
+// on a different device than owner.
+func (s *Scanner) crossesMountpoint(owner *scanTarget, fi os.FileInfo) bool {
+	if !s.OneFileSystem || owner == nil || !owner.hasDevice {
+		return false
+	}
+
+	id, err := fs.DeviceID(fi)
+	if err != nil {
+		return false
+	}
+
+	return id != owner.device
+}
+
+// seenHardLink returns true if the file described by fi has several hard
+// links and another link to it has already been counted.
+func (s *Scanner) seenHardLink(fi os.FileInfo) bool {
+	if s.hardLinks == nil {
+		return false
+	}
+
+	_, links, err := fs.Inode(fi)
+	if err != nil || links <= 1 {
+		return false
+	}
+
+	key, ok := fileKey(fi)
+	if !ok {
+		return false
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.hardLinks[key]; ok {
+		return true
+	}
+
+	if len(s.hardLinks) < scanMaxHardLinks {
+		s.hardLinks[key] = struct{}{}
+	}
+	return false
+}
+
+// fileKey returns the device ID and inode number of the file described by fi.
+func fileKey(fi os.FileInfo) (fileID, bool) {
+	inode, _, err := fs.Inode(fi)
+	if err != nil {
+		return fileID{}, false
+	}
+
+	device, err := fs.DeviceID(fi)
+	if err != nil {
+		return fileID{}, false
+	}
+
+	return fileID{device: device, inode: inode}, true
+}
+
+// error passes err to the error callback. If the error is suppressed, it is
+// counted in the stats.
+func (s *Scanner) error(item string, owner *scanTarget, err error) error {
+	err = s.Error(item, err)
+	if err == nil {
+		s.m.Lock()
+		s.stats.Errors++
+		if owner != nil {
+			owner.stats.Errors++
+		}
+		s.m.Unlock()
+	}
+	return err
+}
+
+// scanResult is the result of scanning a single item.
+type scanResult struct {
+	stats ScanStats // stats for the item and all its children
+	dir   bool      // true if the item is a directory
+}
+
+// scanPosition describes where an item is located below the target root.
+type scanPosition struct {
+	owner   *scanTarget // the target containing the item
+	parents *dirChain   // the directories from the target root down to the parent of the item
+	depth   uint        // the number of directories between the target root and the item
+}
+
+// scan traverses target.
+func (s *Scanner) scan(ctx context.Context, target string, pos scanPosition) (scanResult, error) {
+	owner := pos.owner
+
 	if ctx.Err() != nil {
-		return stats, nil
+		return scanResult{}, nil
 	}
 
 	// exclude files by path before running stat to reduce number of lstat calls
 	if !s.SelectByName(target) {
-		return stats, nil
+		return s.excluded(ctx, target, nil, owner), nil
 	}
 
 	// get file information
 	fi, err := s.FS.Lstat(target)
 	if err != nil {
-		return stats, s.Error(target, err)
+		return scanResult{}, s.error(target, owner, err)
 	}
 
 	// run remaining select functions that require file information
 	if !s.Select(target, fi) {
-		return stats, nil
+		return s.excluded(ctx, target, fi, owner), nil
 	}
 
+	var stats ScanStats
 	switch {
+	case fi.Mode().IsRegular() && s.seenHardLink(fi):
+		stats = ScanStats{Files: 1, HardLinks: 1}
 	case fi.Mode().IsRegular():
-		stats.Files++
-		stats.Bytes += uint64(fi.Size())
+		stats = ScanStats{Files: 1, Bytes: s.fileSize(fi)}
+	case s.ReadDevices && fs.IsDevice(fi):
+		stats = ScanStats{Files: 1, Bytes: s.deviceSize(target)}
+	case fi.Mode().IsDir() && s.crossesMountpoint(owner, fi):
+		debug.Log("not descending into mountpoint %v", target)
+		s.report(target, owner, ScanStats{Dirs: 1, SkippedMountpoints: 1}, false)
+		return scanResult{stats: ScanStats{Dirs: 1, SkippedMountpoints: 1}, dir: true}, nil
 	case fi.Mode().IsDir():
+		stats, err = s.scanDir(ctx, target, fi, pos)
+		return scanResult{stats: stats, dir: true}, err
+	default:
+		stats = ScanStats{Others: 1}
+	}
+
+	s.report(target, owner, stats, false)
+	return scanResult{stats: stats}, nil
+}
+
+// fileSize returns the number of bytes which need to be read for the file.
+// Files with an unknown size are not added to the total.
+func (s *Scanner) fileSize(fi os.FileInfo) uint64 {
+	size := knownSize(fi)
+	if !s.AllocatedSize || !s.caps.Has(fs.CapSparseDetection) {
+		return size
+	}
+
+	allocated, ok := allocatedSize(fi)
+	if ok && allocated < size {
+		return allocated
+	}
+	return size
+}
+
+// knownSize returns the size of the file, or zero if it is unknown.
+func knownSize(fi os.FileInfo) uint64 {
+	if fi.Size() == fs.SizeUnknown {
+		return 0
+	}
+	return uint64(fi.Size())
+}
+
+// deviceSize returns the size of the block device target, or zero if it is
+// unknown.
+func (s *Scanner) deviceSize(target string) uint64 {
+	f, err := s.FS.OpenFile(target, fs.O_RDONLY|fs.O_NOFOLLOW, 0)
+	if err != nil {
+		debug.Log("unable to open device %v: %v", target, err)
+		return 0
+	}
+
+	size, _ := fs.DeviceSize(f)
+	_ = f.Close()
+	return size
+}
+
+// excluded counts the item target which has been rejected by one of the select
+// functions. If fi is nil, target is stat'ed first.
+func (s *Scanner) excluded(ctx context.Context, target string, fi os.FileInfo, owner *scanTarget) scanResult {
+	if fi == nil {
+		var err error
+		fi, err = s.FS.Lstat(target)
+		if err != nil {
+			debug.Log("unable to stat excluded item %v: %v", target, err)
+			return scanResult{}
+		}
+	}
+
+	// excluded items are not passed to Result, they only show up in the
+	// stats of the next call
+	stats := s.countExcluded(ctx, target, fi, nil)
+	s.count(owner, stats)
+
+	// directories are marked as such so that they are checked again when
+	// the parent directory is restored from the cache
+	return scanResult{stats: stats, dir: fi.IsDir() && s.CountExcludedSubtrees}
+}
+
+// countExcluded returns the excluded stats for target. When
+// CountExcludedSubtrees is set, the contents of directories are added,
+// ignoring all errors. parents is used to stop at directory cycles.
+func (s *Scanner) countExcluded(ctx context.Context, target string, fi os.FileInfo, parents *dirChain) ScanStats {
+	switch {
+	case fi.Mode().IsRegular():
+		return ScanStats{ExcludedFiles: 1, ExcludedBytes: knownSize(fi)}
+	case !fi.IsDir():
+		return ScanStats{ExcludedFiles: 1}
+	}
+
+	stats := ScanStats{ExcludedDirs: 1}
+	if !s.CountExcludedSubtrees || ctx.Err() != nil {
+		return stats
+	}
+
+	if key, ok := fileKey(fi); ok {
+		if parents.contains(key) {
+			debug.Log("excluded directory %v is one of its own parents", target)
+			return stats
+		}
+		parents = &dirChain{key: key, parent: parents}
+	}
+
+	names, err := readdirnames(s.FS, target, fs.O_NOFOLLOW)
+	if err != nil {
+		debug.Log("unable to list excluded directory %v: %v", target, err)
+		return stats
+	}
+
+	for _, name := range names {
+		item := s.FS.Join(target, name)
+		fi, err := s.FS.Lstat(item)
+		if err != nil {
+			debug.Log("unable to stat excluded item %v: %v", item, err)
+			continue
+		}
+		stats.add(s.countExcluded(ctx, item, fi, parents))
+	}
+
+	return stats
+}
+
+// scanDir traverses the contents of the directory target and returns the
+// stats for the whole subtree.
+func (s *Scanner) scanDir(ctx context.Context, target string, fi os.FileInfo, pos scanPosition) (ScanStats, error) {
+	owner := pos.owner
+	childPos := scanPosition{owner: owner, parents: pos.parents, depth: pos.depth + 1}
+	if key, ok := fileKey(fi); ok {
+		if pos.parents.contains(key) {
+			debug.Log("directory %v is one of its own parents", target)
+			return ScanStats{}, s.error(target, owner, fmt.Errorf("%v: %w", target, ErrCycleDetected))
+		}
+		childPos.parents = &dirChain{key: key, parent: pos.parents}
+	}
+
+	if s.MaxDepth > 0 && pos.depth >= s.MaxDepth {
+		debug.Log("not descending into %v, maximum depth reached", target)
+		stats := ScanStats{Dirs: 1, Truncated: true}
+		s.report(target, owner, stats, false)
+		return stats, nil
+	}
+
+	// stats of the direct children which are not directories
+	var direct ScanStats
+	var subdirs []string
+
+	// the stats for the subtree, including the directory itself
+	subtree := ScanStats{Dirs: 1}
+	// the stats which still need to be reported for the directory itself
+	report := ScanStats{Dirs: 1}
+
+	if entry, ok := s.Cache.lookup(target, fi); ok {
+		// the list of entries has not changed, so only the subdirectories
+		// need to be scanned
+		debug.Log("using cached entries for %v", target)
+		direct = entry.Direct
+		subdirs = append([]string(nil), entry.Subdirs...)
+		SortNames(subdirs, s.Order)
+		report.add(direct)
+
+		results, err := s.scanChildren(ctx, target, subdirs, childPos)
+		if err != nil {
+			return ScanStats{}, err
+		}
+		for _, res := range results {
+			subtree.add(res.stats)
+		}
+	} else {
 		names, err := readdirnames(s.FS, target, fs.O_NOFOLLOW)
 		if err != nil {
-			return stats, s.Error(target, err)
+			tolerate := tolerateDirError(s.TolerateDirErrors, err)
+			err = s.error(target, owner, err)
+			if err != nil || !tolerate {
+				return ScanStats{}, err
+			}
+
+			// the directory is saved without contents
+			stats := ScanStats{Dirs: 1}
+			s.report(target, owner, stats, false)
+			return stats, nil
 		}
-		sort.Strings(names)
+		SortNames(names, s.Order)
 
-		for _, name := range names {
-			stats, err = s.scan(ctx, stats, filepath.Join(target, name))
-			if err != nil {
-				return stats, err
+		if s.SkipIf != nil {
+			if skip, reason := s.SkipIf(target, names); skip {
+				debug.Log("skipping contents of %v: %v", target, reason)
+				stats := ScanStats{Dirs: 1, SkippedDirs: 1}
+				s.report(target, owner, stats, false)
+				return stats, nil
 			}
 		}
-		stats.Dirs++
-	default:
-		stats.Others++
+
+		results, err := s.scanChildren(ctx, target, names, childPos)
+		if err != nil {
+			return ScanStats{}, err
+		}
+		for i, res := range results {
+			if res.dir {
+				subdirs = append(subdirs, names[i])
+				subtree.add(res.stats)
+			} else {
+				direct.add(res.stats)
+			}
+		}
+	}
+
+	// do not remember incomplete results
+	if ctx.Err() == nil {
+		s.Cache.store(target, fi, direct, subdirs)
+	}
+
+	s.report(target, owner, report, false)
+	subtree.add(direct)
+	return subtree, nil
+}
+
+// scanChildren scans the items names in the directory dir, possibly
+// concurrently. The results are returned in the same order as names.
+func (s *Scanner) scanChildren(ctx context.Context, dir string, names []string, pos scanPosition) ([]scanResult, error) {
+	// each child writes to its own slot, so no locking is needed
+	results := make([]scanResult, len(names))
+
+	var wg errgroup.Group
+	for i, name := range names {
+		item := s.FS.Join(dir, name)
+		res := &results[i]
+		err := s.spawn(&wg, func() error {
+			var err error
+			*res, err = s.scan(ctx, item, pos)
+			return err
+		})
+		if err != nil {
+			_ = wg.Wait()
+			return nil, err
+		}
 	}
 
-	s.Result(target, stats)
-	return stats, nil
+	err := wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
 }
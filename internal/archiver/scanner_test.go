@@ -2,10 +2,13 @@ package archiver
 
 import (
 	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/restic/restic/internal/fs"
@@ -67,11 +70,11 @@ func TestScanner(t *testing.T) {
 				return false
 			},
 			want: map[string]ScanStats{
-				filepath.FromSlash("work/foo.txt"):        {Files: 1, Bytes: 13},
-				filepath.FromSlash("work/subdir/bar.txt"): {Files: 2, Bytes: 30},
-				filepath.FromSlash("work/subdir"):         {Files: 2, Dirs: 1, Bytes: 30},
-				filepath.FromSlash("work"):                {Files: 2, Dirs: 2, Bytes: 30},
-				filepath.FromSlash(""):                    {Files: 2, Dirs: 2, Bytes: 30},
+				filepath.FromSlash("work/foo.txt"):        {Files: 1, Bytes: 13, ExcludedFiles: 2, ExcludedBytes: 15},
+				filepath.FromSlash("work/subdir/bar.txt"): {Files: 2, Bytes: 30, ExcludedFiles: 2, ExcludedBytes: 15},
+				filepath.FromSlash("work/subdir"):         {Files: 2, Dirs: 1, Bytes: 30, ExcludedFiles: 3, ExcludedBytes: 30},
+				filepath.FromSlash("work"):                {Files: 2, Dirs: 2, Bytes: 30, ExcludedFiles: 3, ExcludedBytes: 30},
+				filepath.FromSlash(""):                    {Files: 2, Dirs: 2, Bytes: 30, ExcludedFiles: 3, ExcludedBytes: 30},
 			},
 		},
 	}
@@ -164,7 +167,7 @@ func TestScannerError(t *testing.T) {
 					},
 				},
 			},
-			result: ScanStats{Files: 3, Dirs: 1, Bytes: 28},
+			result: ScanStats{Files: 3, Dirs: 1, Bytes: 28, Errors: 1},
 			prepare: func(t testing.TB) {
 				err := os.Chmod(filepath.Join("work", "subdir"), 0000)
 				if err != nil {
@@ -187,7 +190,7 @@ func TestScannerError(t *testing.T) {
 				"foo":   TestFile{Content: "foo"},
 				"other": TestFile{Content: "other"},
 			},
-			result: ScanStats{Files: 3, Dirs: 0, Bytes: 11},
+			result: ScanStats{Files: 3, Dirs: 0, Bytes: 11, Errors: 1},
 			resFn: func(t testing.TB, item string, s ScanStats) {
 				if item == "bar" {
 					err := os.Remove("foo")
@@ -319,3 +322,439 @@ func TestScannerCancel(t *testing.T) {
 		t.Errorf("wrong final result, want\n  %#v\ngot:\n  %#v", result, lastStats)
 	}
 }
+
+func TestScannerConcurrency(t *testing.T) {
+	src := TestDir{
+		"other": TestFile{Content: "another file"},
+		"work": TestDir{
+			"foo":     TestFile{Content: "foo"},
+			"foo.txt": TestFile{Content: "foo text file"},
+			"subdir": TestDir{
+				"other":   TestFile{Content: "other in subdir"},
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+				"nested": TestDir{
+					"a": TestFile{Content: "a"},
+					"b": TestFile{Content: "bb"},
+				},
+			},
+			"subdir2": TestDir{
+				"x": TestFile{Content: "xxx"},
+				"y": TestDir{
+					"z": TestFile{Content: "zzzz"},
+				},
+			},
+		},
+	}
+
+	want := ScanStats{Files: 9, Dirs: 5, Bytes: 70}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	for _, concurrency := range []uint{0, 1, 2, 3, 8} {
+		sc := NewScanner(fs.Track{FS: fs.Local{}})
+		sc.Concurrency = concurrency
+
+		var final ScanStats
+		items := make(map[string]struct{})
+		sc.Result = func(item string, s ScanStats) {
+			if item == "" {
+				final = s
+				return
+			}
+			if _, ok := items[item]; ok {
+				t.Errorf("item %v reported twice", item)
+			}
+			items[item] = struct{}{}
+		}
+
+		err := sc.Scan(context.TODO(), []string{"."})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if final != want {
+			t.Errorf("concurrency %d: wrong final result, want\n  %#v\ngot:\n  %#v", concurrency, want, final)
+		}
+
+		if len(items) != int(want.Files+want.Dirs) {
+			t.Errorf("concurrency %d: wrong number of items reported, want %d, got %d", concurrency, want.Files+want.Dirs, len(items))
+		}
+	}
+}
+
+func TestScannerResultPerTarget(t *testing.T) {
+	src := TestDir{
+		"other": TestFile{Content: "another file"},
+		"work": TestDir{
+			"foo":     TestFile{Content: "foo"},
+			"foo.txt": TestFile{Content: "foo text file"},
+			"subdir": TestDir{
+				"other":   TestFile{Content: "other in subdir"},
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+			},
+		},
+	}
+
+	var tests = []struct {
+		targets []string
+		want    map[string]ScanStats
+		total   ScanStats
+	}{
+		{
+			targets: []string{"other", "work"},
+			want: map[string]ScanStats{
+				"other": {Files: 1, Bytes: 12},
+				"work":  {Files: 4, Dirs: 2, Bytes: 48},
+			},
+			total: ScanStats{Files: 5, Dirs: 2, Bytes: 60},
+		},
+		{
+			targets: []string{"work", filepath.Join("work", "subdir")},
+			want: map[string]ScanStats{
+				"work":                          {Files: 2, Bytes: 16},
+				filepath.Join("work", "subdir"): {Files: 2, Dirs: 1, Bytes: 32},
+			},
+			total: ScanStats{Files: 4, Dirs: 1, Bytes: 48},
+		},
+		{
+			targets: []string{"."},
+			want: map[string]ScanStats{
+				".": {Files: 5, Dirs: 2, Bytes: 60},
+			},
+			total: ScanStats{Files: 5, Dirs: 2, Bytes: 60},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			sc := NewScanner(fs.Track{FS: fs.Local{}})
+
+			var total ScanStats
+			var perTarget map[string]ScanStats
+			sc.Result = func(item string, s ScanStats) {
+				if item == "" {
+					total = s
+				}
+			}
+			sc.ResultPerTarget = func(stats map[string]ScanStats) {
+				perTarget = stats
+			}
+
+			err := sc.Scan(context.TODO(), test.targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if total != test.total {
+				t.Errorf("wrong final result, want\n  %#v\ngot:\n  %#v", test.total, total)
+			}
+
+			if !cmp.Equal(test.want, perTarget) {
+				t.Error(cmp.Diff(test.want, perTarget))
+			}
+		})
+	}
+}
+
+func TestScannerReportInterval(t *testing.T) {
+	src := TestDir{
+		"other": TestFile{Content: "another file"},
+		"work": TestDir{
+			"foo":     TestFile{Content: "foo"},
+			"foo.txt": TestFile{Content: "foo text file"},
+			"subdir": TestDir{
+				"other":   TestFile{Content: "other in subdir"},
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+			},
+		},
+	}
+
+	want := ScanStats{Files: 5, Dirs: 2, Bytes: 60}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	for _, interval := range []time.Duration{0, time.Hour} {
+		sc := NewScanner(fs.Track{FS: fs.Local{}})
+		sc.ReportInterval = interval
+
+		var calls int
+		var final ScanStats
+		var finalProgress ScanProgress
+		sc.Result = func(item string, s ScanStats) {
+			calls++
+			if item == "" {
+				final = s
+			}
+		}
+		sc.Progress = func(item string, s ScanStats, p ScanProgress) {
+			if item == "" {
+				finalProgress = p
+			}
+		}
+
+		err := sc.Scan(context.TODO(), []string{"."})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if final != want {
+			t.Errorf("interval %v: wrong final result, want\n  %#v\ngot:\n  %#v", interval, want, final)
+		}
+
+		wantCalls := 1
+		if interval == 0 {
+			wantCalls += int(want.Files + want.Dirs)
+		}
+		if calls != wantCalls {
+			t.Errorf("interval %v: wrong number of calls to Result, want %d, got %d", interval, wantCalls, calls)
+		}
+
+		if finalProgress.Elapsed <= 0 {
+			t.Errorf("interval %v: elapsed time not set", interval)
+		}
+		if finalProgress.ItemsPerSec <= 0 || finalProgress.BytesPerSec <= 0 {
+			t.Errorf("interval %v: invalid rates %#v", interval, finalProgress)
+		}
+	}
+}
+
+func TestScannerMaxDepth(t *testing.T) {
+	src := TestDir{
+		"other": TestFile{Content: "another file"},
+		"work": TestDir{
+			"foo":     TestFile{Content: "foo"},
+			"foo.txt": TestFile{Content: "foo text file"},
+			"subdir": TestDir{
+				"other":   TestFile{Content: "other in subdir"},
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+				"nested": TestDir{
+					"a": TestFile{Content: "a"},
+				},
+			},
+		},
+	}
+
+	var tests = []struct {
+		targets  []string
+		maxDepth uint
+		want     ScanStats
+	}{
+		{
+			targets: []string{"."},
+			want:    ScanStats{Files: 6, Dirs: 3, Bytes: 61},
+		},
+		{
+			targets:  []string{"."},
+			maxDepth: 3,
+			want:     ScanStats{Files: 6, Dirs: 3, Bytes: 61},
+		},
+		{
+			targets:  []string{"."},
+			maxDepth: 2,
+			want:     ScanStats{Files: 5, Dirs: 3, Bytes: 60, Truncated: true},
+		},
+		{
+			targets:  []string{"."},
+			maxDepth: 1,
+			want:     ScanStats{Files: 3, Dirs: 2, Bytes: 28, Truncated: true},
+		},
+		{
+			// the depth is measured from each target
+			targets:  []string{"other", filepath.Join("work", "subdir")},
+			maxDepth: 1,
+			want:     ScanStats{Files: 3, Dirs: 2, Bytes: 44, Truncated: true},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	for _, test := range tests {
+		sc := NewScanner(fs.Track{FS: fs.Local{}})
+		sc.MaxDepth = test.maxDepth
+
+		var stats ScanStats
+		sc.Result = func(item string, s ScanStats) {
+			if item == "" {
+				stats = s
+			}
+		}
+
+		err := sc.Scan(context.TODO(), test.targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats != test.want {
+			t.Errorf("max depth %d: wrong final result, want\n  %#v\ngot:\n  %#v", test.maxDepth, test.want, stats)
+		}
+	}
+}
+
+func TestScannerSkipIf(t *testing.T) {
+	src := TestDir{
+		"work": TestDir{
+			"foo": TestFile{Content: "foo"},
+			"cache": TestDir{
+				CacheDirTagFilename: TestFile{Content: CacheDirTagSignature + "\n"},
+				"data":              TestFile{Content: "cached data"},
+				"sub": TestDir{
+					"more": TestFile{Content: "more cached data"},
+				},
+			},
+			"invalid": TestDir{
+				CacheDirTagFilename: TestFile{Content: "Signature: invalid"},
+				"data":              TestFile{Content: "data"},
+			},
+			"short": TestDir{
+				CacheDirTagFilename: TestFile{Content: "Sig"},
+			},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	var tests = []struct {
+		skip SkipFunc
+		want ScanStats
+	}{
+		{
+			want: ScanStats{Files: 7, Dirs: 5, Bytes: 99},
+		},
+		{
+			skip: SkipCacheDirs(fs.Local{}),
+			want: ScanStats{Files: 4, Dirs: 4, Bytes: 28, SkippedDirs: 1},
+		},
+		{
+			skip: SkipIfPresent(fs.Local{}, CacheDirTagFilename, ""),
+			want: ScanStats{Files: 1, Dirs: 4, Bytes: 3, SkippedDirs: 3},
+		},
+	}
+
+	for _, test := range tests {
+		sc := NewScanner(fs.Track{FS: fs.Local{}})
+		sc.SkipIf = test.skip
+
+		var stats ScanStats
+		sc.Result = func(item string, s ScanStats) {
+			if item == "" {
+				stats = s
+			}
+		}
+
+		err := sc.Scan(context.TODO(), []string{"work"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats != test.want {
+			t.Errorf("wrong final result, want\n  %#v\ngot:\n  %#v", test.want, stats)
+		}
+	}
+}
+
+func TestScannerExcluded(t *testing.T) {
+	src := TestDir{
+		"other": TestFile{Content: "another file"},
+		"work": TestDir{
+			"foo":     TestFile{Content: "foo"},
+			"foo.txt": TestFile{Content: "foo text file"},
+			"subdir": TestDir{
+				"other":   TestFile{Content: "other in subdir"},
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+				"nested": TestDir{
+					"a": TestFile{Content: "a"},
+				},
+			},
+		},
+	}
+
+	var tests = []struct {
+		countSubtrees bool
+		want          ScanStats
+	}{
+		{
+			want: ScanStats{Files: 2, Dirs: 1, Bytes: 15, ExcludedFiles: 1, ExcludedDirs: 1, ExcludedBytes: 13},
+		},
+		{
+			countSubtrees: true,
+			want:          ScanStats{Files: 2, Dirs: 1, Bytes: 15, ExcludedFiles: 4, ExcludedDirs: 2, ExcludedBytes: 46},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	for _, test := range tests {
+		sc := NewScanner(fs.Track{FS: fs.Local{}})
+		sc.CountExcludedSubtrees = test.countSubtrees
+		sc.SelectByName = func(item string) bool {
+			return filepath.Base(item) != "subdir"
+		}
+		sc.Select = func(item string, fi os.FileInfo) bool {
+			return filepath.Ext(item) != ".txt"
+		}
+
+		var stats ScanStats
+		sc.Result = func(item string, s ScanStats) {
+			if item == "" {
+				stats = s
+			}
+		}
+
+		err := sc.Scan(context.TODO(), []string{"."})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats != test.want {
+			t.Errorf("wrong final result, want\n  %#v\ngot:\n  %#v", test.want, stats)
+		}
+	}
+}
+
+func TestScannerUnknownSize(t *testing.T) {
+	readerFs := &fs.Reader{
+		ModTime:    time.Now(),
+		Mode:       0644,
+		Name:       "stream",
+		Size:       fs.SizeUnknown,
+		ReadCloser: io.NopCloser(strings.NewReader("data")),
+	}
+
+	sc := NewScanner(readerFs)
+	var stats ScanStats
+	sc.Result = func(item string, s ScanStats) {
+		if item == "" {
+			stats = s
+		}
+	}
+	restictest.OK(t, sc.Scan(context.TODO(), []string{"stream"}))
+
+	// the file is counted, but its size does not contribute to the total
+	restictest.Equals(t, ScanStats{Files: 1}, stats)
+}
@@ -0,0 +1,299 @@
+//go:build !windows
+// +build !windows
+
+package archiver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	restictest "github.com/restic/restic/internal/test"
+)
+
+// wrapDeviceID returns a new os.FileInfo for which fs.DeviceID returns id.
+func wrapDeviceID(fi os.FileInfo, id uint64) os.FileInfo {
+	stat := *fi.Sys().(*syscall.Stat_t)
+	// the type of Dev differs between platforms
+	dev := reflect.ValueOf(&stat.Dev).Elem()
+	switch dev.Kind() {
+	case reflect.Int32, reflect.Int64:
+		dev.SetInt(int64(id))
+	default:
+		dev.SetUint(id)
+	}
+	return wrappedFileInfo{
+		FileInfo: fi,
+		sys:      &stat,
+		mode:     fi.Mode(),
+	}
+}
+
+func TestScannerOneFileSystem(t *testing.T) {
+	src := TestDir{
+		"other": TestFile{Content: "another file"},
+		"work": TestDir{
+			"foo":     TestFile{Content: "foo"},
+			"foo.txt": TestFile{Content: "foo text file"},
+			"subdir": TestDir{
+				"other":   TestFile{Content: "other in subdir"},
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+			},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	cur, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subdir := filepath.Join(cur, "work", "subdir")
+	fi, err := os.Lstat(subdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := fs.DeviceID(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		override map[string]os.FileInfo
+		enabled  bool
+		want     ScanStats
+	}{
+		{
+			name:     "disabled",
+			override: map[string]os.FileInfo{subdir: wrapDeviceID(fi, id+1)},
+			want:     ScanStats{Files: 5, Dirs: 2, Bytes: 60},
+		},
+		{
+			name:     "same-device",
+			override: map[string]os.FileInfo{},
+			enabled:  true,
+			want:     ScanStats{Files: 5, Dirs: 2, Bytes: 60},
+		},
+		{
+			name:     "mountpoint",
+			override: map[string]os.FileInfo{subdir: wrapDeviceID(fi, id+1)},
+			enabled:  true,
+			want:     ScanStats{Files: 3, Dirs: 2, Bytes: 28, SkippedMountpoints: 1},
+		},
+		{
+			name: "no-device-ids",
+			override: map[string]os.FileInfo{
+				subdir: wrappedFileInfo{FileInfo: fi, mode: fi.Mode()},
+			},
+			enabled: true,
+			want:    ScanStats{Files: 5, Dirs: 2, Bytes: 60},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc := NewScanner(&StatFS{FS: fs.Track{FS: fs.Local{}}, OverrideLstat: test.override})
+			sc.OneFileSystem = test.enabled
+
+			var stats ScanStats
+			sc.Result = func(item string, s ScanStats) {
+				if item == "" {
+					stats = s
+				}
+			}
+
+			err := sc.Scan(context.TODO(), []string{"work", "other"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stats != test.want {
+				t.Errorf("wrong final result, want\n  %#v\ngot:\n  %#v", test.want, stats)
+			}
+		})
+	}
+}
+
+func TestScannerHardLinks(t *testing.T) {
+	src := TestDir{
+		"work": TestDir{
+			"foo":  TestFile{Content: "foo"},
+			"file": TestFile{Content: "file with several links"},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	cur, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"link1", "link2"} {
+		err := os.Link(filepath.Join("work", "file"), filepath.Join("work", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		enabled bool
+		fs      fs.FS
+		want    ScanStats
+	}{
+		{
+			enabled: false,
+			fs:      fs.Local{},
+			want:    ScanStats{Files: 4, Dirs: 1, Bytes: 72},
+		},
+		{
+			enabled: true,
+			fs:      fs.Local{},
+			want:    ScanStats{Files: 4, Dirs: 1, Bytes: 26, HardLinks: 2},
+		},
+		{
+			// without inode numbers, all links are counted
+			enabled: true,
+			fs: &StatFS{FS: fs.Local{}, OverrideLstat: map[string]os.FileInfo{
+				filepath.Join(cur, "work", "link1"): wrappedFileInfo{FileInfo: lstat(t, filepath.Join(cur, "work", "link1")), mode: 0644},
+			}},
+			want: ScanStats{Files: 4, Dirs: 1, Bytes: 49, HardLinks: 1},
+		},
+		{
+			// the file system does not report inode numbers at all
+			enabled: true,
+			fs:      capsFS{FS: fs.Local{}, caps: fs.CapDeviceIDs},
+			want:    ScanStats{Files: 4, Dirs: 1, Bytes: 72},
+		},
+	}
+
+	for _, test := range tests {
+		sc := NewScanner(fs.Track{FS: test.fs})
+		sc.CountHardLinksOnce = test.enabled
+
+		var stats ScanStats
+		sc.Result = func(item string, s ScanStats) {
+			if item == "" {
+				stats = s
+			}
+		}
+
+		err := sc.Scan(context.TODO(), []string{"work"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats != test.want {
+			t.Errorf("wrong final result, want\n  %#v\ngot:\n  %#v", test.want, stats)
+		}
+	}
+}
+
+func TestScannerCycle(t *testing.T) {
+	src := TestDir{
+		"other": TestFile{Content: "another file"},
+		"work": TestDir{
+			"foo": TestFile{Content: "foo"},
+			"subdir": TestDir{
+				"bar.txt": TestFile{Content: "bar.txt in subdir"},
+				"loop":    TestSymlink{Target: ".."},
+			},
+			"sibling": TestSymlink{Target: "subdir"},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	var stats ScanStats
+	var cycles []string
+
+	sc := NewScanner(fs.FollowSymlinks{FS: fs.Track{FS: fs.Local{}}})
+	sc.Result = func(item string, s ScanStats) {
+		if item == "" {
+			stats = s
+		}
+	}
+	sc.Error = func(item string, err error) error {
+		if errors.Is(err, ErrCycleDetected) {
+			cycles = append(cycles, filepath.Base(item))
+			return nil
+		}
+		return err
+	}
+
+	err := sc.Scan(context.TODO(), []string{"other", "work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "sibling" is not a cycle, so the directory is counted twice
+	want := ScanStats{Files: 4, Dirs: 3, Bytes: 49, Errors: 2}
+	if stats != want {
+		t.Errorf("wrong final result, want\n  %#v\ngot:\n  %#v", want, stats)
+	}
+
+	if len(cycles) != 2 {
+		t.Errorf("expected two cycles, got %v", cycles)
+	}
+	for _, item := range cycles {
+		if item != "loop" {
+			t.Errorf("unexpected cycle reported for %v", item)
+		}
+	}
+}
+
+func TestScannerAllocatedSize(t *testing.T) {
+	const size = 4 * 1024 * 1024
+
+	tempdir := restictest.TempDir(t)
+	filename := filepath.Join(tempdir, "sparse")
+	f, err := os.Create(filename)
+	restictest.OK(t, err)
+	restictest.OK(t, f.Truncate(size))
+	restictest.OK(t, f.Close())
+
+	allocated, ok := fs.ExtendedStat(lstat(t, filename)).AllocatedSize()
+	if !ok || allocated >= size {
+		t.Skip("file system does not support sparse files")
+	}
+
+	for _, test := range []struct {
+		allocatedSize bool
+		want          uint64
+	}{
+		{false, size},
+		{true, allocated},
+	} {
+		sc := NewScanner(fs.Track{FS: fs.Local{}})
+		sc.AllocatedSize = test.allocatedSize
+
+		var stats ScanStats
+		sc.Result = func(item string, s ScanStats) {
+			if item == "" {
+				stats = s
+			}
+		}
+
+		restictest.OK(t, sc.Scan(context.TODO(), []string{filename}))
+		restictest.Equals(t, test.want, stats.Bytes)
+	}
+}
@@ -0,0 +1,46 @@
+package archiver
+
+import (
+	"os"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/fs"
+)
+
+// SelectBySize returns a SelectFunc which excludes regular files larger than
+// maxSize bytes. Files of exactly maxSize bytes, directories and all other
+// items are included.
+func SelectBySize(maxSize int64) SelectFunc {
+	return func(item string, fi os.FileInfo) bool {
+		if !fs.IsRegularFile(fi) {
+			return true
+		}
+
+		if fi.Size() > maxSize {
+			debug.Log("file %s is oversize: %d", item, fi.Size())
+			return false
+		}
+
+		return true
+	}
+}
+
+// SelectByModTime returns a SelectFunc which excludes regular files modified
+// before cutoff. Files modified exactly at cutoff are included. Directories
+// and all other items are always included, so that newer files within old
+// directories are still found.
+func SelectByModTime(cutoff time.Time) SelectFunc {
+	return func(item string, fi os.FileInfo) bool {
+		if !fs.IsRegularFile(fi) {
+			return true
+		}
+
+		if fi.ModTime().Before(cutoff) {
+			debug.Log("file %s was last modified at %v, before %v", item, fi.ModTime(), cutoff)
+			return false
+		}
+
+		return true
+	}
+}
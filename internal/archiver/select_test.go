@@ -0,0 +1,144 @@
+package archiver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/fs"
+	restictest "github.com/restic/restic/internal/test"
+)
+
+func TestSelectBySize(t *testing.T) {
+	const maxSize = 100
+
+	src := TestDir{
+		"smaller": TestFile{Content: strings.Repeat("x", maxSize-1)},
+		"equal":   TestFile{Content: strings.Repeat("x", maxSize)},
+		"larger":  TestFile{Content: strings.Repeat("x", maxSize+1)},
+		"empty":   TestFile{},
+		"dir":     TestDir{},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	selectFn := SelectBySize(maxSize)
+
+	var tests = []struct {
+		name string
+		want bool
+	}{
+		{"smaller", true},
+		{"equal", true},
+		{"larger", false},
+		{"empty", true},
+		{"dir", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := filepath.Join(tempdir, test.name)
+			fi, err := fs.Lstat(item)
+			restictest.OK(t, err)
+			restictest.Equals(t, test.want, selectFn(item, fi))
+		})
+	}
+
+	// directories are never excluded, regardless of the size reported
+	restictest.Assert(t, SelectBySize(0)(tempdir, lstat(t, tempdir)), "directory was excluded")
+}
+
+func TestScannerSelectBySize(t *testing.T) {
+	src := TestDir{
+		"small": TestFile{Content: "foo"},
+		"large": TestFile{Content: strings.Repeat("x", 20)},
+		"sub": TestDir{
+			"large": TestFile{Content: strings.Repeat("x", 30)},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	var stats ScanStats
+	sc := NewScanner(fs.Track{FS: fs.Local{}})
+	sc.Select = SelectBySize(10)
+	sc.Result = func(item string, s ScanStats) {
+		if item == "" {
+			stats = s
+		}
+	}
+	restictest.OK(t, sc.Scan(context.TODO(), []string{"."}))
+
+	want := ScanStats{Files: 1, Dirs: 1, Bytes: 3, ExcludedFiles: 2, ExcludedBytes: 50}
+	restictest.Equals(t, want, stats)
+}
+
+func TestSelectByModTime(t *testing.T) {
+	cutoff := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	src := TestDir{
+		"old":   TestFile{Content: "old"},
+		"equal": TestFile{Content: "equal"},
+		"new":   TestFile{Content: "new"},
+		"olddir": TestDir{
+			"new": TestFile{Content: "new in old dir"},
+		},
+	}
+
+	tempdir := restictest.TempDir(t)
+	TestCreateFiles(t, tempdir, src)
+
+	for name, mtime := range map[string]time.Time{
+		"old":        cutoff.Add(-time.Second),
+		"equal":      cutoff,
+		"new":        cutoff.Add(time.Second),
+		"olddir/new": cutoff.Add(time.Hour),
+		"olddir":     cutoff.Add(-time.Hour),
+	} {
+		restictest.OK(t, os.Chtimes(filepath.Join(tempdir, filepath.FromSlash(name)), mtime, mtime))
+	}
+
+	selectFn := SelectByModTime(cutoff)
+
+	var tests = []struct {
+		name string
+		want bool
+	}{
+		{"old", false},
+		{"equal", true},
+		{"new", true},
+		{"olddir", true},
+		{"olddir/new", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := filepath.Join(tempdir, filepath.FromSlash(test.name))
+			restictest.Equals(t, test.want, selectFn(item, lstat(t, item)))
+		})
+	}
+
+	back := restictest.Chdir(t, tempdir)
+	defer back()
+
+	var stats ScanStats
+	sc := NewScanner(fs.Track{FS: fs.Local{}})
+	sc.Select = selectFn
+	sc.Result = func(item string, s ScanStats) {
+		if item == "" {
+			stats = s
+		}
+	}
+	restictest.OK(t, sc.Scan(context.TODO(), []string{"."}))
+
+	want := ScanStats{Files: 3, Dirs: 1, Bytes: 22, ExcludedFiles: 1, ExcludedBytes: 3}
+	restictest.Equals(t, want, stats)
+}
@@ -0,0 +1,85 @@
+package archiver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/fs"
+)
+
+// SkipFunc is called with a directory and the names of its entries. It returns
+// true and a human readable reason if the contents of the directory should be
+// skipped.
+type SkipFunc func(dir string, names []string) (skip bool, reason string)
+
+// CacheDirTagFilename and CacheDirTagSignature identify a cache directory as
+// described by the Cache Directory Tagging Standard, see
+// https://bford.info/cachedir/.
+const (
+	CacheDirTagFilename  = "CACHEDIR.TAG"
+	CacheDirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// SkipIfPresent returns a SkipFunc which skips directories containing a file
+// called filename. If header is not empty, the file must start with header,
+// otherwise the directory is not skipped. The file is read via filesys.
+func SkipIfPresent(filesys fs.FS, filename, header string) SkipFunc {
+	return func(dir string, names []string) (bool, string) {
+		found := false
+		for _, name := range names {
+			if name == filename {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, ""
+		}
+
+		if header == "" {
+			return true, fmt.Sprintf("contains %v", filename)
+		}
+
+		tf := filesys.Join(dir, filename)
+		ok, err := hasHeader(filesys, tf, header)
+		if err != nil {
+			debug.Log("unable to check exclusion tagfile %v: %v", tf, err)
+			return false, ""
+		}
+		if !ok {
+			debug.Log("invalid signature in exclusion tagfile %v", tf)
+			return false, ""
+		}
+
+		return true, fmt.Sprintf("contains %v with valid signature", filename)
+	}
+}
+
+// SkipCacheDirs returns a SkipFunc which skips directories tagged with a valid
+// CACHEDIR.TAG file.
+func SkipCacheDirs(filesys fs.FS) SkipFunc {
+	return SkipIfPresent(filesys, CacheDirTagFilename, CacheDirTagSignature)
+}
+
+// hasHeader returns true if the file filename starts with header.
+func hasHeader(filesys fs.FS, filename, header string) (bool, error) {
+	f, err := filesys.OpenFile(filename, fs.O_RDONLY|fs.O_NOFOLLOW, 0)
+	if err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, len(header))
+	_, err = io.ReadFull(f, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the file is too short
+		return false, f.Close()
+	}
+	if err != nil {
+		_ = f.Close()
+		return false, err
+	}
+
+	return bytes.Equal(buf, []byte(header)), f.Close()
+}
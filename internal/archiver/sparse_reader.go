@@ -0,0 +1,166 @@
+package archiver
+
+import (
+	"io"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/fs"
+)
+
+// sparseReader reads a sparse file without reading its holes. Holes are
+// returned as zeros, so the chunker produces the same blobs as for a
+// sequential read. All-zero chunks are stored as the well-known zero chunk by
+// the repository, which the restorer can turn back into holes.
+type sparseReader struct {
+	rd   io.ReaderAt
+	sf   fs.SparseFile
+	size int64 // size of the file when it was opened
+
+	offset  int64
+	data    int64 // start of the next data region
+	hole    int64 // start of the hole after the next data region
+	noData  bool  // there is no more data before size
+	fetched bool  // data and hole are valid for offset
+}
+
+func newSparseReader(rd io.ReaderAt, sf fs.SparseFile, size int64) *sparseReader {
+	return &sparseReader{rd: rd, sf: sf, size: size}
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if r.offset >= r.size {
+		// the file may have grown, read the remainder sequentially
+		return r.readAt(p)
+	}
+
+	if !r.fetched || (!r.noData && r.offset >= r.hole) {
+		err := r.next()
+		if err != nil {
+			// fall back to reading the file
+			debug.Log("unable to find data regions, reading holes: %v", err)
+			r.noData, r.data, r.hole = false, r.offset, r.size
+		}
+	}
+
+	if !r.noData && r.offset >= r.data {
+		// within a data region
+		end := r.hole
+		if end > r.size {
+			end = r.size
+		}
+		if int64(len(p)) > end-r.offset {
+			p = p[:end-r.offset]
+		}
+		return r.readAt(p)
+	}
+
+	// within a hole
+	end := r.data
+	if r.noData {
+		end = r.size
+	}
+	if int64(len(p)) > end-r.offset {
+		p = p[:end-r.offset]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	r.offset += int64(len(p))
+	return len(p), nil
+}
+
+// next finds the next data region at or after the current offset.
+func (r *sparseReader) next() error {
+	r.fetched = true
+
+	data, hole, err := r.sf.NextData(r.offset)
+	if err == io.EOF {
+		r.noData = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.data, r.hole = data, hole
+	if r.data >= r.size {
+		r.noData = true
+	}
+	return nil
+}
+
+func (r *sparseReader) readAt(p []byte) (int, error) {
+	n, err := r.rd.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		// return io.EOF with the next call
+		err = nil
+	}
+	return n, err
+}
+
+// sparseReaderAt reads a sparse file at arbitrary offsets without reading its
+// holes, which are returned as zeros like by sparseReader. It can be used by
+// several goroutines at once, e.g. by a parallelReader. Data after size is
+// read from the file.
+type sparseReaderAt struct {
+	rd   io.ReaderAt
+	sf   fs.SparseFile
+	size int64 // size of the file when it was opened
+}
+
+func newSparseReaderAt(rd io.ReaderAt, sf fs.SparseFile, size int64) *sparseReaderAt {
+	return &sparseReaderAt{rd: rd, sf: sf, size: size}
+}
+
+func (r *sparseReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	end := offset + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := offset + int64(n)
+		if pos >= end {
+			// the file may have grown, read the remainder
+			m, err := r.rd.ReadAt(p[n:], pos)
+			return n + m, err
+		}
+
+		data, hole, err := r.sf.NextData(pos)
+		if err == io.EOF {
+			data, hole = end, end
+		} else if err != nil {
+			// fall back to reading the holes
+			debug.Log("unable to find data regions, reading holes: %v", err)
+			data, hole = pos, end
+		}
+
+		if data > pos {
+			if data > end {
+				data = end
+			}
+			zero := p[n : n+int(data-pos)]
+			for i := range zero {
+				zero[i] = 0
+			}
+			n += len(zero)
+			continue
+		}
+
+		if hole > end {
+			hole = end
+		}
+		m, err := r.rd.ReadAt(p[n:n+int(hole-pos)], pos)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,149 @@
+package archiver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	restictest "github.com/restic/restic/internal/test"
+)
+
+// testSparseFile describes the data regions of buf. Reads from holes are
+// recorded as errors.
+type testSparseFile struct {
+	t       testing.TB
+	buf     []byte
+	regions [][2]int64 // start and end of the data regions
+	err     error      // returned by NextData if set
+}
+
+func (f *testSparseFile) NextData(offset int64) (int64, int64, error) {
+	if f.err != nil {
+		return 0, 0, f.err
+	}
+
+	for _, r := range f.regions {
+		if r[1] > offset {
+			if r[0] < offset {
+				return offset, r[1], nil
+			}
+			return r[0], r[1], nil
+		}
+	}
+	return 0, 0, io.EOF
+}
+
+func (f *testSparseFile) ReadAt(p []byte, offset int64) (int, error) {
+	if f.err == nil && len(p) > 0 {
+		end := offset + int64(len(p))
+		if end > int64(len(f.buf)) {
+			end = int64(len(f.buf))
+		}
+
+		inData := false
+		for _, r := range f.regions {
+			if offset >= r[0] && end <= r[1] {
+				inData = true
+			}
+		}
+		if !inData && offset < int64(len(f.buf)) {
+			f.t.Errorf("read of hole at offset %d, length %d", offset, len(p))
+		}
+	}
+	return bytes.NewReader(f.buf).ReadAt(p, offset)
+}
+
+func TestSparseReader(t *testing.T) {
+	var tests = []struct {
+		size    int
+		regions [][2]int64
+	}{
+		{size: 0},
+		{size: 1000},
+		{size: 1000, regions: [][2]int64{{0, 1000}}},
+		{size: 1000, regions: [][2]int64{{100, 200}}},
+		{size: 1000, regions: [][2]int64{{0, 100}, {500, 600}, {900, 1000}}},
+		// the last data region extends beyond the initial size
+		{size: 1000, regions: [][2]int64{{800, 1200}}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v", test.regions), func(t *testing.T) {
+			end := int64(test.size)
+			for _, r := range test.regions {
+				if r[1] > end {
+					end = r[1]
+				}
+			}
+
+			buf := make([]byte, end)
+			for _, r := range test.regions {
+				copy(buf[r[0]:r[1]], randomData(t, r[0], int(r[1]-r[0])))
+			}
+
+			sf := &testSparseFile{t: t, buf: buf, regions: test.regions}
+			rd := newSparseReader(sf, sf, int64(test.size))
+
+			data, err := io.ReadAll(struct{ io.Reader }{rd})
+			restictest.OK(t, err)
+
+			if !bytes.Equal(data, buf) {
+				t.Fatalf("wrong data returned, want %d bytes, got %d bytes", len(buf), len(data))
+			}
+		})
+	}
+}
+
+func TestSparseReaderFallback(t *testing.T) {
+	buf := randomData(t, 5, 1000)
+	sf := &testSparseFile{t: t, buf: buf, err: errors.New("not supported")}
+	rd := newSparseReader(sf, sf, int64(len(buf)))
+
+	data, err := io.ReadAll(rd)
+	restictest.OK(t, err)
+
+	if !bytes.Equal(data, buf) {
+		t.Fatalf("wrong data returned, want %d bytes, got %d bytes", len(buf), len(data))
+	}
+}
+
+func TestSparseReaderAt(t *testing.T) {
+	const size = 10000
+	regions := [][2]int64{{0, 100}, {1000, 3500}, {7000, 7001}, {9900, 10500}}
+	buf := make([]byte, 10500)
+	for _, r := range regions {
+		copy(buf[r[0]:r[1]], randomData(t, r[0], int(r[1]-r[0])))
+	}
+
+	for _, regionSize := range []int{1, 333, 1000, 4096, 20000} {
+		t.Run(fmt.Sprintf("%d", regionSize), func(t *testing.T) {
+			sf := &testSparseFile{t: t, buf: buf, regions: regions}
+			rd := newParallelReader(newSparseReaderAt(sf, sf, size), size, 4, regionSize)
+
+			data, err := io.ReadAll(struct{ io.Reader }{rd})
+			restictest.OK(t, err)
+			restictest.OK(t, rd.Close())
+
+			if !bytes.Equal(data, buf) {
+				t.Fatalf("wrong data returned, want %d bytes, got %d bytes", len(buf), len(data))
+			}
+		})
+	}
+}
+
+func TestSparseReaderAtFallback(t *testing.T) {
+	buf := randomData(t, 5, 1000)
+	sf := &testSparseFile{t: t, buf: buf, err: errors.New("not supported")}
+	rd := newSparseReaderAt(sf, sf, int64(len(buf)))
+
+	data := make([]byte, 500)
+	n, err := rd.ReadAt(data, 300)
+	restictest.OK(t, err)
+	restictest.Equals(t, 500, n)
+
+	if !bytes.Equal(data, buf[300:800]) {
+		t.Fatal("wrong data returned")
+	}
+}
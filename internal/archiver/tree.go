@@ -2,7 +2,6 @@ package archiver
 
 import (
 	"fmt"
-	"sort"
 
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
@@ -214,7 +213,7 @@ func (t Tree) NodeNames() []string {
 	for name := range t.Nodes {
 		names = append(names, name)
 	}
-	sort.Strings(names)
+	SortNames(names, OrderBytewise)
 	return names
 }
 
@@ -3,6 +3,7 @@ package archiver
 import (
 	"context"
 	"errors"
+	"sort"
 
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/restic"
@@ -79,8 +80,7 @@ func (s *TreeSaver) save(ctx context.Context, job *saveTreeJob) (*restic.Node, I
 	// allow GC of nodes array once the loop is finished
 	job.nodes = nil
 
-	builder := restic.NewTreeJSONBuilder()
-	var lastNode *restic.Node
+	results := make([]futureNodeResult, 0, len(nodes))
 
 	for i, fn := range nodes {
 		// fn is a copy, so clear the original value explicitly
@@ -105,6 +105,22 @@ func (s *TreeSaver) save(ctx context.Context, job *saveTreeJob) (*restic.Node, I
 			continue
 		}
 
+		results = append(results, fnr)
+	}
+
+	// the nodes may have been processed in a different order, but the tree
+	// must be sorted by name
+	byName := func(i, j int) bool {
+		return results[i].node.Name < results[j].node.Name
+	}
+	if !sort.SliceIsSorted(results, byName) {
+		sort.SliceStable(results, byName)
+	}
+
+	builder := restic.NewTreeJSONBuilder()
+	var lastNode *restic.Node
+
+	for _, fnr := range results {
 		err := builder.AddNode(fnr.node)
 		if err != nil && errors.Is(err, restic.ErrTreeNotOrdered) && lastNode != nil && fnr.node.Equals(*lastNode) {
 			debug.Log("insert %v failed: %v", fnr.node.Name, err)
@@ -0,0 +1,193 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+)
+
+// requiredSASPermissions lists the permissions a SAS token must grant, restic
+// creates and removes lock files even for read-only operations.
+var requiredSASPermissions = []struct {
+	flag byte
+	name string
+}{
+	{'r', "read"},
+	{'w', "write"},
+	{'d', "delete"},
+	{'l', "list"},
+}
+
+// parseSAS strips the leading question mark from a SAS token and decodes its
+// parameters.
+func parseSAS(token string) (string, sas.QueryParameters, error) {
+	token = strings.TrimPrefix(token, "?")
+	values, err := url.ParseQuery(token)
+	if err != nil {
+		return "", sas.QueryParameters{}, errors.Fatalf("azure: invalid SAS token: %v", err)
+	}
+	if values.Get("sig") == "" {
+		return "", sas.QueryParameters{}, errors.Fatal("azure: invalid SAS token: signature (sig) is missing")
+	}
+	return token, sas.NewQueryParameters(values, false), nil
+}
+
+// checkSAS verifies that the SAS token grants all permissions needed by
+// restic and has not expired yet. Tokens which refer to a stored access
+// policy do not contain permissions or an expiry time, those can only be
+// checked by the server.
+func checkSAS(q sas.QueryParameters, now time.Time) error {
+	if perms := q.Permissions(); perms != "" {
+		var missing []string
+		for _, p := range requiredSASPermissions {
+			if strings.IndexByte(perms, p.flag) < 0 {
+				missing = append(missing, p.name)
+			}
+		}
+		if len(missing) > 0 {
+			return errors.Fatalf("azure: the SAS token lacks the %v permission(s), restic needs read, write, delete and list access to the container",
+				strings.Join(missing, ", "))
+		}
+	}
+
+	if expiry := q.ExpiryTime(); !expiry.IsZero() && !now.Before(expiry) {
+		return errors.Fatalf("azure: the SAS token expired at %v, create a new token", expiry.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// sasExpiredError is returned by operations which fail after the SAS token
+// has expired.
+type sasExpiredError struct {
+	expiry time.Time
+	err    error
+}
+
+func (e *sasExpiredError) Error() string {
+	return fmt.Sprintf("the SAS token expired at %v, restart restic with a new token: %v", e.expiry.Local().Format(time.RFC3339), e.err)
+}
+
+func (e *sasExpiredError) Unwrap() error {
+	return e.err
+}
+
+// newCredential returns the token credential selected by cfg.Credential.
+func newCredential(cfg Config, opts azcore.ClientOptions) (azcore.TokenCredential, error) {
+	var managedID azidentity.ManagedIDKind
+	if cfg.ManagedIdentityID != "" {
+		managedID = azidentity.ClientID(cfg.ManagedIdentityID)
+	}
+
+	var cred azcore.TokenCredential
+	var err error
+	switch cfg.Credential {
+	case "", "default":
+		// tries environment variables, workload identity, managed identity
+		// and the Azure CLI in this order
+		cred, err = azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: opts,
+		})
+	case "managed-identity":
+		cred, err = azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ClientOptions: opts,
+			ID:            managedID,
+		})
+	case "workload-identity":
+		cred, err = azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientOptions: opts,
+		})
+	case "environment":
+		cred, err = azidentity.NewEnvironmentCredential(&azidentity.EnvironmentCredentialOptions{
+			ClientOptions: opts,
+		})
+	case "cli":
+		cred, err = azidentity.NewAzureCLICredential(nil)
+	default:
+		return nil, errors.Fatalf("azure: invalid credential %q, must be one of default, managed-identity, workload-identity, environment or cli", cfg.Credential)
+	}
+	if err != nil {
+		return nil, errors.Fatalf("azure: unable to set up %v credential: %v", credentialName(cfg.Credential), err)
+	}
+
+	return &timeoutCredential{
+		cred:    cred,
+		name:    credentialName(cfg.Credential),
+		timeout: cfg.TokenTimeout,
+	}, nil
+}
+
+func credentialName(name string) string {
+	if name == "" {
+		return "default"
+	}
+	return name
+}
+
+// timeoutCredential limits the time spent acquiring a token, so that an
+// unresponsive identity endpoint cannot stall the backup.
+type timeoutCredential struct {
+	cred    azcore.TokenCredential
+	name    string
+	timeout time.Duration
+}
+
+func (c *timeoutCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	tk, err := c.cred.GetToken(ctx, opts)
+	if err != nil {
+		return tk, &tokenError{name: c.name, err: err}
+	}
+	return tk, nil
+}
+
+// tokenError is returned if no access token can be acquired.
+type tokenError struct {
+	name string
+	err  error
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("acquiring an access token using the %v credential failed: %v", e.name, e.err)
+}
+
+func (e *tokenError) Unwrap() error {
+	return e.err
+}
+
+// permanent returns true if acquiring a token cannot succeed on a later
+// attempt, as the credential is not available or was rejected.
+func (e *tokenError) permanent() bool {
+	if errors.Is(e.err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var authErr *azidentity.AuthenticationFailedError
+	if errors.As(e.err, &authErr) {
+		if authErr.RawResponse == nil {
+			return true
+		}
+		switch authErr.RawResponse.StatusCode {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+			return true
+		}
+		return false
+	}
+
+	var unavailable interface{ NonRetriable() }
+	return errors.As(e.err, &unavailable)
+}
@@ -0,0 +1,130 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	rtest "github.com/restic/restic/internal/test"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+func TestCheckSAS(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		token string
+		err   string
+	}{
+		{"sv=2022-11-02&sp=racwdl&se=2023-06-02T00:00:00Z&sig=abc", ""},
+		{"?sv=2022-11-02&ss=b&srt=co&sp=rwdlac&se=2023-06-02T00:00:00Z&sig=abc", ""},
+		// stored access policy, only the server knows the permissions
+		{"sv=2022-11-02&si=backup&sr=c&sig=abc", ""},
+		{"sv=2022-11-02&sp=rl&se=2023-06-02T00:00:00Z&sig=abc", "lacks the write, delete permission(s)"},
+		{"sv=2022-11-02&sp=racwd&se=2023-06-02T00:00:00Z&sig=abc", "lacks the list permission(s)"},
+		{"sv=2022-11-02&sp=racwdl&se=2023-06-01T00:00:00Z&sig=abc", "expired at"},
+		{"sv=2022-11-02&sp=racwdl", "signature (sig) is missing"},
+		{"sv=2022-11-02&sp=%zz&sig=abc", "invalid SAS token"},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			token, params, err := parseSAS(test.token)
+			if err == nil {
+				rtest.Assert(t, !strings.HasPrefix(token, "?"), "token %q not stripped", token)
+				err = checkSAS(params, now)
+			}
+
+			if test.err == "" {
+				rtest.OK(t, err)
+				return
+			}
+			rtest.Assert(t, err != nil, "expected error containing %q", test.err)
+			rtest.Assert(t, errors.IsFatal(err), "error %v is not fatal", err)
+			rtest.Assert(t, strings.Contains(err.Error(), test.err), "error %q does not contain %q", err, test.err)
+		})
+	}
+}
+
+func TestApplyEnvironmentSASToken(t *testing.T) {
+	t.Setenv("AZURE_ACCOUNT_SAS", "")
+	t.Setenv("AZURE_SAS_TOKEN", "sp=rwdl&sig=abc")
+
+	cfg := NewConfig()
+	cfg.ApplyEnvironment("")
+	rtest.Equals(t, "sp=rwdl&sig=abc", cfg.AccountSAS.Unwrap())
+
+	// AZURE_ACCOUNT_SAS takes precedence
+	t.Setenv("AZURE_ACCOUNT_SAS", "sp=rl&sig=def")
+	cfg = NewConfig()
+	cfg.ApplyEnvironment("")
+	rtest.Equals(t, "sp=rl&sig=def", cfg.AccountSAS.Unwrap())
+}
+
+func TestNewCredentialInvalid(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Credential = "password"
+	_, err := newCredential(cfg, azcore.ClientOptions{})
+	rtest.Assert(t, err != nil && errors.IsFatal(err), "expected fatal error, got %v", err)
+}
+
+type blockingCredential struct{}
+
+func (blockingCredential) GetToken(ctx context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	<-ctx.Done()
+	return azcore.AccessToken{}, ctx.Err()
+}
+
+func TestTimeoutCredential(t *testing.T) {
+	cred := &timeoutCredential{cred: blockingCredential{}, name: "test", timeout: 10 * time.Millisecond}
+
+	_, err := cred.GetToken(context.TODO(), policy.TokenRequestOptions{})
+	rtest.Assert(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+
+	var te *tokenError
+	rtest.Assert(t, errors.As(err, &te), "error %v is not a tokenError", err)
+	rtest.Assert(t, !te.permanent(), "timeout must not be permanent")
+
+	be := &Backend{}
+	rtest.Assert(t, !be.IsPermanentError(err), "timeout classified as permanent")
+}
+
+func TestTokenErrorPermanent(t *testing.T) {
+	unavailable := &tokenError{name: "test", err: azidentity.NewCredentialUnavailableError("no managed identity endpoint")}
+	rtest.Assert(t, unavailable.permanent(), "unavailable credential must be permanent")
+
+	rejected := &tokenError{name: "test", err: &azidentity.AuthenticationFailedError{
+		RawResponse: &http.Response{StatusCode: http.StatusUnauthorized},
+	}}
+	rtest.Assert(t, rejected.permanent(), "rejected credential must be permanent")
+
+	unavailableServer := &tokenError{name: "test", err: &azidentity.AuthenticationFailedError{
+		RawResponse: &http.Response{StatusCode: http.StatusServiceUnavailable},
+	}}
+	rtest.Assert(t, !unavailableServer.permanent(), "server error must not be permanent")
+
+	be := &Backend{}
+	rtest.Assert(t, be.IsPermanentError(errors.Wrap(unavailable, "Save")), "wrapped token error not classified as permanent")
+}
+
+func TestWrapErrorExpiredSAS(t *testing.T) {
+	forbidden := &azcore.ResponseError{StatusCode: http.StatusForbidden}
+
+	be := &Backend{sasExpiry: time.Now().Add(time.Hour)}
+	rtest.Equals(t, error(forbidden), be.wrapError(forbidden))
+
+	be.sasExpiry = time.Now().Add(-time.Hour)
+	err := be.wrapError(forbidden)
+	var e *sasExpiredError
+	rtest.Assert(t, errors.As(err, &e), "error %v does not mention the expired token", err)
+	rtest.Assert(t, be.IsPermanentError(err), "error %v is not permanent", err)
+
+	notFound := errors.New("other error")
+	rtest.Equals(t, notFound, be.wrapError(notFound))
+}
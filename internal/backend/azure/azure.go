@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/backend/layout"
@@ -21,7 +22,6 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
@@ -36,6 +36,8 @@ type Backend struct {
 	connections  uint
 	prefix       string
 	listMaxItems int
+	// sasExpiry is the expiry time of the SAS token, if any
+	sasExpiry time.Time
 	layout.Layout
 }
 
@@ -52,7 +54,7 @@ func NewFactory() location.Factory {
 func open(cfg Config, rt http.RoundTripper) (*Backend, error) {
 	debug.Log("open, config %#v", cfg)
 	var client *azContainer.Client
-	var err error
+	var sasExpiry time.Time
 
 	var endpointSuffix string
 	if cfg.EndpointSuffix != "" {
@@ -88,12 +90,14 @@ func open(cfg Config, rt http.RoundTripper) (*Backend, error) {
 		// we (as per the SDK ) assume the default Azure portal.
 		// https://github.com/Azure/azure-storage-blob-go/issues/130
 		debug.Log(" - using sas token")
-		sas := cfg.AccountSAS.Unwrap()
-
-		// strip query sign prefix
-		if sas[0] == '?' {
-			sas = sas[1:]
+		sas, params, err := parseSAS(cfg.AccountSAS.Unwrap())
+		if err != nil {
+			return nil, err
 		}
+		if err := checkSAS(params, time.Now()); err != nil {
+			return nil, err
+		}
+		sasExpiry = params.ExpiryTime()
 
 		urlWithSAS := fmt.Sprintf("%s?%s", url, sas)
 
@@ -102,10 +106,10 @@ func open(cfg Config, rt http.RoundTripper) (*Backend, error) {
 			return nil, errors.Wrap(err, "NewAccountSASClientFromEndpointToken")
 		}
 	} else {
-		debug.Log(" - using DefaultAzureCredential")
-		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		debug.Log(" - using %v credential", credentialName(cfg.Credential))
+		cred, err := newCredential(cfg, opts.ClientOptions)
 		if err != nil {
-			return nil, errors.Wrap(err, "NewDefaultAzureCredential")
+			return nil, err
 		}
 
 		client, err = azContainer.NewClient(url, cred, opts)
@@ -123,14 +127,64 @@ func open(cfg Config, rt http.RoundTripper) (*Backend, error) {
 			Join: path.Join,
 		},
 		listMaxItems: defaultListMaxItems,
+		sasExpiry:    sasExpiry,
 	}
 
 	return be, nil
 }
 
-// Open opens the Azure backend at specified container.
-func Open(_ context.Context, cfg Config, rt http.RoundTripper) (*Backend, error) {
-	return open(cfg, rt)
+// Open opens the Azure backend at specified container. It checks that the
+// repository can be accessed, so that invalid credentials or missing
+// permissions are reported right away.
+func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (*Backend, error) {
+	be, err := open(cfg, rt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := be.checkAccess(ctx); err != nil {
+		return nil, err
+	}
+	return be, nil
+}
+
+// checkAccess lists the keys of the repository. A missing container is
+// reported later on when loading the repository config.
+func (be *Backend) checkAccess(ctx context.Context) error {
+	prefix, _ := be.Basedir(backend.KeyFile)
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	max := int32(1)
+	lister := be.container.NewListBlobsFlatPager(&azContainer.ListBlobsFlatOptions{
+		MaxResults: &max,
+		Prefix:     &prefix,
+	})
+	_, err := lister.NextPage(ctx)
+	if err == nil || bloberror.HasCode(err, bloberror.ContainerNotFound) {
+		return nil
+	}
+	if be.IsPermanentError(err) {
+		return errors.Fatalf("azure: unable to access container %v, check the credentials and their permissions: %v", be.cfg.Container, be.wrapError(err))
+	}
+	return errors.Wrap(err, "checking access")
+}
+
+// wrapError explains authentication failures which are caused by an expired
+// SAS token.
+func (be *Backend) wrapError(err error) error {
+	if err == nil || be.sasExpiry.IsZero() || time.Now().Before(be.sasExpiry) {
+		return err
+	}
+	if bloberror.HasCode(err, bloberror.AuthenticationFailed, bloberror.AuthorizationFailure) {
+		return &sasExpiredError{expiry: be.sasExpiry, err: err}
+	}
+	var e *azcore.ResponseError
+	if errors.As(err, &e) && e.StatusCode == http.StatusForbidden {
+		return &sasExpiredError{expiry: be.sasExpiry, err: err}
+	}
+	return err
 }
 
 // Create opens the Azure backend at specified container and creates the container if
@@ -167,6 +221,45 @@ func (be *Backend) IsNotExist(err error) bool {
 	return bloberror.HasCode(err, bloberror.BlobNotFound)
 }
 
+// IsDeletionForbidden returns true if the permissions or an immutability
+// policy of the container do not allow removing the file.
+func (be *Backend) IsDeletionForbidden(err error) bool {
+	if bloberror.HasCode(err, bloberror.BlobImmutableDueToPolicy, bloberror.AuthorizationPermissionMismatch) {
+		return true
+	}
+
+	var e *azcore.ResponseError
+	return errors.As(err, &e) && e.StatusCode == http.StatusForbidden
+}
+
+// IsPermanentError returns true if the error is caused by invalid credentials,
+// missing permissions or a missing container.
+func (be *Backend) IsPermanentError(err error) bool {
+	if bloberror.HasCode(err, bloberror.ContainerNotFound, bloberror.AuthenticationFailed,
+		bloberror.AuthorizationFailure, bloberror.InsufficientAccountPermissions) {
+		return true
+	}
+
+	var te *tokenError
+	if errors.As(err, &te) {
+		return te.permanent()
+	}
+
+	var e *azcore.ResponseError
+	return errors.As(err, &e) && (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden)
+}
+
+// IsThrottled returns true if the storage account is busy or the rate limit
+// for requests was exceeded.
+func (be *Backend) IsThrottled(err error) bool {
+	if bloberror.HasCode(err, bloberror.ServerBusy) {
+		return true
+	}
+
+	var e *azcore.ResponseError
+	return errors.As(err, &e) && e.StatusCode == http.StatusTooManyRequests
+}
+
 // Join combines path components with slashes.
 func (be *Backend) Join(p ...string) string {
 	return path.Join(p...)
@@ -211,7 +304,7 @@ func (be *Backend) Save(ctx context.Context, h backend.Handle, rd backend.Rewind
 		err = be.saveLarge(ctx, objName, rd)
 	}
 
-	return err
+	return be.wrapError(err)
 }
 
 func (be *Backend) saveSmall(ctx context.Context, objName string, rd backend.RewindReader) error {
@@ -310,7 +403,7 @@ func (be *Backend) openReader(ctx context.Context, h backend.Handle, length int,
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, be.wrapError(err)
 	}
 
 	return resp.Body, err
@@ -324,7 +417,7 @@ func (be *Backend) Stat(ctx context.Context, h backend.Handle) (backend.FileInfo
 	props, err := blobClient.GetProperties(ctx, nil)
 
 	if err != nil {
-		return backend.FileInfo{}, errors.Wrap(err, "blob.GetProperties")
+		return backend.FileInfo{}, errors.Wrap(be.wrapError(err), "blob.GetProperties")
 	}
 
 	fi := backend.FileInfo{
@@ -345,7 +438,7 @@ func (be *Backend) Remove(ctx context.Context, h backend.Handle) error {
 		return nil
 	}
 
-	return errors.Wrap(err, "client.RemoveObject")
+	return errors.Wrap(be.wrapError(err), "client.RemoveObject")
 }
 
 // List runs fn for each file in the backend which has the type t. When an
@@ -370,7 +463,7 @@ func (be *Backend) List(ctx context.Context, t backend.FileType, fn func(backend
 		resp, err := lister.NextPage(ctx)
 
 		if err != nil {
-			return err
+			return be.wrapError(err)
 		}
 
 		debug.Log("got %v objects", len(resp.Segment.BlobItems))
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/errors"
@@ -20,13 +21,17 @@ type Config struct {
 	Container      string
 	Prefix         string
 
-	Connections uint `option:"connections" help:"set a limit for the number of concurrent connections (default: 5)"`
+	Connections       uint          `option:"connections" help:"set a limit for the number of concurrent connections (default: 5)"`
+	Credential        string        `option:"credential" help:"credential used without account key or SAS token: default, managed-identity, workload-identity, environment or cli (default: default)"`
+	ManagedIdentityID string        `option:"managed-identity-id" help:"client ID of the user-assigned managed identity used by the managed-identity credential"`
+	TokenTimeout      time.Duration `option:"token-timeout" help:"give up acquiring an access token after this time (default: 1m)"`
 }
 
 // NewConfig returns a new Config with the default values filled in.
 func NewConfig() Config {
 	return Config{
-		Connections: 5,
+		Connections:  5,
+		TokenTimeout: time.Minute,
 	}
 }
 
@@ -73,6 +78,10 @@ func (cfg *Config) ApplyEnvironment(prefix string) {
 		cfg.AccountSAS = options.NewSecretString(os.Getenv(prefix + "AZURE_ACCOUNT_SAS"))
 	}
 
+	if cfg.AccountSAS.String() == "" {
+		cfg.AccountSAS = options.NewSecretString(os.Getenv(prefix + "AZURE_SAS_TOKEN"))
+	}
+
 	if cfg.EndpointSuffix == "" {
 		cfg.EndpointSuffix = os.Getenv(prefix + "AZURE_ENDPOINT_SUFFIX")
 	}
@@ -2,25 +2,29 @@ package azure
 
 import (
 	"testing"
+	"time"
 
 	"github.com/restic/restic/internal/backend/test"
 )
 
 var configTests = []test.ConfigTestData[Config]{
 	{S: "azure:container-name:/", Cfg: Config{
-		Container:   "container-name",
-		Prefix:      "",
-		Connections: 5,
+		Container:    "container-name",
+		Prefix:       "",
+		Connections:  5,
+		TokenTimeout: time.Minute,
 	}},
 	{S: "azure:container-name:/prefix/directory", Cfg: Config{
-		Container:   "container-name",
-		Prefix:      "prefix/directory",
-		Connections: 5,
+		Container:    "container-name",
+		Prefix:       "prefix/directory",
+		Connections:  5,
+		TokenTimeout: time.Minute,
 	}},
 	{S: "azure:container-name:/prefix/directory/", Cfg: Config{
-		Container:   "container-name",
-		Prefix:      "prefix/directory",
-		Connections: 5,
+		Container:    "container-name",
+		Prefix:       "prefix/directory",
+		Connections:  5,
+		TokenTimeout: time.Minute,
 	}},
 }
 
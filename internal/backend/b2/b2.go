@@ -29,6 +29,13 @@ type b2Backend struct {
 	layout.Layout
 
 	canDelete bool
+
+	// the low-level client is only used to cancel unfinished large files
+	rt         http.RoundTripper
+	baseMu     sync.Mutex
+	baseBucket *base.Bucket
+
+	stopCleanup func()
 }
 
 // Billing happens in 1000 item granularity, but we are more interested in reducing the number of network round trips
@@ -37,6 +44,8 @@ const defaultListMaxItems = 10 * 1000
 // ensure statically that *b2Backend implements backend.Backend.
 var _ backend.Backend = &b2Backend{}
 
+var apiBase = "" // Overridden by test.
+
 func NewFactory() location.Factory {
 	return location.NewHTTPBackendFactory("b2", ParseConfig, location.NoPassword, Create, Open)
 }
@@ -64,9 +73,15 @@ func newClient(ctx context.Context, cfg Config, rt http.RoundTripper) (*b2.Clien
 	if cfg.Key.String() == "" {
 		return nil, errors.Fatalf("unable to open B2 backend: Key ($B2_ACCOUNT_KEY) is empty")
 	}
+	if cfg.PartSize < minPartSize {
+		return nil, errors.Fatalf("unable to open B2 backend: part size must be at least %d MiB", minPartSize)
+	}
 
 	sniffer := &sniffingRoundTripper{RoundTripper: rt}
 	opts := []b2.ClientOption{b2.Transport(sniffer)}
+	if apiBase != "" {
+		opts = append(opts, b2.APIBase(apiBase))
+	}
 
 	// if the connection B2 fails, this can cause the client to hang
 	// cancel the connection after a minute to at least provide some feedback to the user
@@ -111,6 +126,19 @@ func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (backend.Backen
 		},
 		listMaxItems: defaultListMaxItems,
 		canDelete:    true,
+		rt:           rt,
+	}
+
+	// the cleanup must continue after Open has returned
+	cleanupCtx, stopCtx := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		be.runCleanup(cleanupCtx)
+	}()
+	be.stopCleanup = func() {
+		stopCtx()
+		<-done
 	}
 
 	return be, nil
@@ -146,6 +174,7 @@ func Create(ctx context.Context, cfg Config, rt http.RoundTripper) (backend.Back
 			Path: cfg.Prefix,
 		},
 		listMaxItems: defaultListMaxItems,
+		rt:           rt,
 	}
 	return be, nil
 }
@@ -220,20 +249,38 @@ func (be *b2Backend) Save(ctx context.Context, h backend.Handle, rd backend.Rewi
 	name := be.Filename(h)
 	obj := be.bucket.Object(name)
 
-	// b2 always requires sha1 checksums for uploaded file parts
-	w := obj.NewWriter(ctx)
-	n, err := io.Copy(w, rd)
-
-	if err != nil {
-		_ = w.Close()
-		return errors.Wrap(err, "Copy")
+	// large files must be canceled if the upload fails, even if ctx has been
+	// cancelled
+	cancelCtx, cancelCancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancelCancel()
+	w := obj.NewWriter(ctx, b2.WithCancelOnError(func() context.Context { return cancelCtx }, func(err error) {
+		debug.Log("canceled large file %v: %v", name, err)
+	}))
+	// Files of at least this size are uploaded using the large file API.
+	// The parts are streamed from rd with the sha1 checksum at the end of
+	// each part, such that the file is never buffered in memory. Failed parts
+	// are retried individually by the client library.
+	partSize := int64(be.cfg.PartSize) * 1024 * 1024
+	w.ChunkSize = int(partSize)
+	w.ConcurrentUploads = 1
+	large := rd.Length() >= partSize
+
+	n, err := io.Copy(w, newRewindReaderAt(rd))
+	if err == nil && n != rd.Length() {
+		// sanity check
+		err = errors.Errorf("wrote %d bytes instead of the expected %d bytes", n, rd.Length())
+	} else {
+		err = errors.Wrap(err, "Copy")
 	}
 
-	// sanity check
-	if n != rd.Length() {
-		return errors.Errorf("wrote %d bytes instead of the expected %d bytes", n, rd.Length())
+	closeErr := w.Close()
+	if err == nil {
+		err = errors.Wrap(closeErr, "Close")
+	}
+	if err != nil && large {
+		be.cancelUpload(name)
 	}
-	return errors.Wrap(w.Close(), "Close")
+	return err
 }
 
 // Stat returns information about a blob.
@@ -316,5 +363,10 @@ func (be *b2Backend) Delete(ctx context.Context) error {
 	return util.DefaultDelete(ctx, be)
 }
 
-// Close does nothing
-func (be *b2Backend) Close() error { return nil }
+// Close stops the cleanup of stale unfinished large files.
+func (be *b2Backend) Close() error {
+	if be.stopCleanup != nil {
+		be.stopCleanup()
+	}
+	return nil
+}
@@ -20,12 +20,14 @@ type Config struct {
 	Prefix    string
 
 	Connections uint `option:"connections" help:"set a limit for the number of concurrent connections (default: 5)"`
+	PartSize    uint `option:"part-size" help:"upload files in parts of this many MiB using the large file API if they are at least as large (default: 32, minimum: 5)"`
 }
 
 // NewConfig returns a new config with default options applied.
 func NewConfig() Config {
 	return Config{
 		Connections: 5,
+		PartSize:    32,
 	}
 }
 
@@ -11,31 +11,37 @@ var configTests = []test.ConfigTestData[Config]{
 		Bucket:      "bucketname",
 		Prefix:      "",
 		Connections: 5,
+		PartSize:    32,
 	}},
 	{S: "b2:bucketname:", Cfg: Config{
 		Bucket:      "bucketname",
 		Prefix:      "",
 		Connections: 5,
+		PartSize:    32,
 	}},
 	{S: "b2:bucketname:/prefix/directory", Cfg: Config{
 		Bucket:      "bucketname",
 		Prefix:      "prefix/directory",
 		Connections: 5,
+		PartSize:    32,
 	}},
 	{S: "b2:foobar", Cfg: Config{
 		Bucket:      "foobar",
 		Prefix:      "",
 		Connections: 5,
+		PartSize:    32,
 	}},
 	{S: "b2:foobar:", Cfg: Config{
 		Bucket:      "foobar",
 		Prefix:      "",
 		Connections: 5,
+		PartSize:    32,
 	}},
 	{S: "b2:foobar:/", Cfg: Config{
 		Bucket:      "foobar",
 		Prefix:      "",
 		Connections: 5,
+		PartSize:    32,
 	}},
 }
 
@@ -0,0 +1,208 @@
+package b2
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+
+	"github.com/Backblaze/blazer/base"
+)
+
+const (
+	// minPartSize is the minimum size of a part of a large file accepted by B2
+	minPartSize = 5
+	// staleLargeFileAge is the age after which unfinished large files are
+	// considered abandoned and are canceled
+	staleLargeFileAge = 24 * time.Hour
+	// cleanupInterval is the time between two searches for stale unfinished
+	// large files
+	cleanupInterval = 6 * time.Hour
+	// cancelTimeout limits the time spent canceling a failed upload
+	cancelTimeout = time.Minute
+)
+
+// rewindReaderAt provides random access to a RewindReader. The B2 client
+// streams uploads without buffering them if the data is an io.ReadSeeker and
+// an io.ReaderAt. The parts of a large file are read sequentially, so that
+// the reader only has to start from the beginning again if a part is
+// retried.
+type rewindReaderAt struct {
+	rd backend.RewindReader
+
+	m sync.Mutex
+	// pos is the position of rd
+	pos int64
+	// off is the position used by Read and Seek
+	off int64
+}
+
+func newRewindReaderAt(rd backend.RewindReader) *rewindReaderAt {
+	return &rewindReaderAt{rd: rd}
+}
+
+func (r *rewindReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if off < r.pos {
+		if err := r.rd.Rewind(); err != nil {
+			return 0, err
+		}
+		r.pos = 0
+	}
+	if off > r.pos {
+		n, err := io.CopyN(io.Discard, r.rd, off-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(r.rd, p)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *rewindReaderAt) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *rewindReaderAt) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.rd.Length()
+	default:
+		return 0, errors.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// largeFileBucket returns the bucket for the low-level API, which is needed
+// to cancel unfinished large files. The client authorizes on first use.
+func (be *b2Backend) largeFileBucket(ctx context.Context) (*base.Bucket, error) {
+	be.baseMu.Lock()
+	defer be.baseMu.Unlock()
+	if be.baseBucket != nil {
+		return be.baseBucket, nil
+	}
+
+	opts := []base.AuthOption{base.Transport(be.rt)}
+	if apiBase != "" {
+		opts = append(opts, base.SetAPIBase(apiBase))
+	}
+	client, err := base.AuthorizeAccount(ctx, be.cfg.AccountID, be.cfg.Key.Unwrap(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "AuthorizeAccount")
+	}
+	buckets, err := client.ListBuckets(ctx, be.cfg.Bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListBuckets")
+	}
+	if len(buckets) != 1 {
+		return nil, errors.Errorf("bucket %v not found", be.cfg.Bucket)
+	}
+	be.baseBucket = buckets[0]
+	return be.baseBucket, nil
+}
+
+// cancelLargeFiles cancels the unfinished large files in the repository for
+// which match returns true.
+func (be *b2Backend) cancelLargeFiles(ctx context.Context, match func(f *base.File) bool) (int, error) {
+	bucket, err := be.largeFileBucket(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	prefix := be.cfg.Prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	canceled := 0
+	cont := ""
+	for {
+		files, next, err := bucket.ListUnfinishedLargeFiles(ctx, 100, cont)
+		if err != nil {
+			return canceled, errors.Wrap(err, "ListUnfinishedLargeFiles")
+		}
+
+		for _, f := range files {
+			if !strings.HasPrefix(f.Name, prefix) || !match(f) {
+				continue
+			}
+			debug.Log("canceling unfinished large file %v started at %v", f.Name, f.Timestamp)
+			if err := f.CompileParts(0, nil).CancelLargeFile(ctx); err != nil {
+				return canceled, errors.Wrap(err, "CancelLargeFile")
+			}
+			canceled++
+		}
+
+		if next == "" || len(files) == 0 {
+			return canceled, nil
+		}
+		cont = next
+	}
+}
+
+// cancelUpload cancels the unfinished large files with the given name. It
+// makes sure that a failed upload does not leave parts behind, even if the
+// client library has not canceled the upload.
+func (be *b2Backend) cancelUpload(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+
+	n, err := be.cancelLargeFiles(ctx, func(f *base.File) bool {
+		return f.Name == name
+	})
+	debug.Log("canceled %d unfinished uploads of %v: %v", n, name, err)
+}
+
+// cleanupLargeFiles cancels the unfinished large files which were started
+// more than staleLargeFileAge ago, for example by a process that was killed
+// during an upload.
+func (be *b2Backend) cleanupLargeFiles(ctx context.Context) (int, error) {
+	deadline := time.Now().Add(-staleLargeFileAge)
+	return be.cancelLargeFiles(ctx, func(f *base.File) bool {
+		return f.Timestamp.Before(deadline)
+	})
+}
+
+// runCleanup searches for stale unfinished large files every cleanupInterval
+// until ctx is cancelled. Errors are not reported, the key may for example
+// not be allowed to list unfinished large files.
+func (be *b2Backend) runCleanup(ctx context.Context) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n, err := be.cleanupLargeFiles(ctx)
+		debug.Log("canceled %d stale unfinished large files: %v", n, err)
+		t.Reset(cleanupInterval)
+	}
+}
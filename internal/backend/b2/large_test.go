@@ -0,0 +1,463 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/options"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+type fakeLargeFile struct {
+	name    string
+	started time.Time
+	parts   map[int][]byte
+}
+
+// fakeB2 implements the parts of the B2 API used to upload files.
+type fakeB2 struct {
+	t   testing.TB
+	srv *httptest.Server
+
+	m      sync.Mutex
+	nextID int
+	files  map[string][]byte
+	large  map[string]*fakeLargeFile
+	// uploads counts the calls to b2_upload_part
+	uploads  int
+	canceled []string
+
+	// failParts is the number of uploads of parts which fail temporarily
+	failParts int
+	// rejectPart is the number of a part which is rejected permanently
+	rejectPart int
+	// blockPart is the number of a part which is never answered
+	blockPart int
+	// partStarted is closed when the upload of blockPart has started
+	partStarted chan struct{}
+}
+
+func newFakeB2(t testing.TB) *fakeB2 {
+	f := &fakeB2{
+		t:           t,
+		files:       make(map[string][]byte),
+		large:       make(map[string]*fakeLargeFile),
+		partStarted: make(chan struct{}),
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.srv.Close)
+
+	oldAPIBase := apiBase
+	apiBase = f.srv.URL
+	t.Cleanup(func() { apiBase = oldAPIBase })
+	return f
+}
+
+func (f *fakeB2) reply(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	rtest.OK(f.t, json.NewEncoder(w).Encode(data))
+}
+
+func (f *fakeB2) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	rtest.OK(f.t, json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"code":    code,
+		"message": code,
+	}))
+}
+
+func (f *fakeB2) fileInfo(id, name string, data []byte) map[string]interface{} {
+	return map[string]interface{}{
+		"fileId":          id,
+		"fileName":        name,
+		"accountId":       "account",
+		"bucketId":        "bucket-id",
+		"contentLength":   len(data),
+		"contentSha1":     fmt.Sprintf("%x", sha1.Sum(data)),
+		"contentType":     "application/octet-stream",
+		"action":          "upload",
+		"uploadTimestamp": time.Now().UnixNano() / 1e6,
+	}
+}
+
+// readBody returns the data of an upload and verifies its checksum.
+func (f *fakeB2) readBody(r *http.Request) ([]byte, bool) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, false
+	}
+	sum := r.Header.Get("X-Bz-Content-Sha1")
+	if sum == "hex_digits_at_end" {
+		if len(data) < 40 {
+			return nil, false
+		}
+		sum = string(data[len(data)-40:])
+		data = data[:len(data)-40]
+	}
+	return data, sum == fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+func (f *fakeB2) handle(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	if strings.HasPrefix(r.URL.Path, "/b2api/") && r.Method == http.MethodPost {
+		rtest.OK(f.t, json.NewDecoder(r.Body).Decode(&req))
+	}
+	str := func(key string) string {
+		s, _ := req[key].(string)
+		return s
+	}
+
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if strings.HasPrefix(r.URL.Path, "/upload_part/") {
+		method = "upload_part"
+	}
+
+	switch method {
+	case "b2_authorize_account":
+		f.reply(w, map[string]interface{}{
+			"accountId":               "account",
+			"authorizationToken":      "token",
+			"apiUrl":                  f.srv.URL,
+			"downloadUrl":             f.srv.URL,
+			"minimumPartSize":         minPartSize * 1024 * 1024,
+			"recommendedPartSize":     100 * 1024 * 1024,
+			"absoluteMinimumPartSize": minPartSize * 1024 * 1024,
+			"allowed": map[string]interface{}{
+				"capabilities": []string{"listBuckets", "listFiles", "readFiles", "writeFiles", "deleteFiles"},
+			},
+		})
+
+	case "b2_list_buckets":
+		f.reply(w, map[string]interface{}{
+			"buckets": []map[string]interface{}{{
+				"accountId":  "account",
+				"bucketId":   "bucket-id",
+				"bucketName": str("bucketName"),
+				"bucketType": "allPrivate",
+			}},
+		})
+
+	case "b2_get_upload_url":
+		f.reply(w, map[string]interface{}{
+			"bucketId":           "bucket-id",
+			"uploadUrl":          f.srv.URL + "/upload",
+			"authorizationToken": "token",
+		})
+
+	case "upload":
+		data, ok := f.readBody(r)
+		if !ok {
+			f.fail(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		name, err := url.QueryUnescape(r.Header.Get("X-Bz-File-Name"))
+		rtest.OK(f.t, err)
+
+		f.m.Lock()
+		f.nextID++
+		id := fmt.Sprintf("file%d", f.nextID)
+		f.files[name] = data
+		f.m.Unlock()
+		f.reply(w, f.fileInfo(id, name, data))
+
+	case "b2_start_large_file":
+		f.m.Lock()
+		f.nextID++
+		id := fmt.Sprintf("file%d", f.nextID)
+		f.large[id] = &fakeLargeFile{name: str("fileName"), started: time.Now(), parts: make(map[int][]byte)}
+		f.m.Unlock()
+		f.reply(w, f.fileInfo(id, str("fileName"), nil))
+
+	case "b2_get_upload_part_url":
+		f.reply(w, map[string]interface{}{
+			"fileId":             str("fileId"),
+			"uploadUrl":          f.srv.URL + "/upload_part/" + str("fileId"),
+			"authorizationToken": "token",
+		})
+
+	case "upload_part":
+		id := strings.TrimPrefix(r.URL.Path, "/upload_part/")
+		part, err := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		rtest.OK(f.t, err)
+
+		f.m.Lock()
+		f.uploads++
+		fail := f.failParts > 0
+		if fail {
+			f.failParts--
+		}
+		f.m.Unlock()
+
+		switch {
+		case fail:
+			_, _ = io.Copy(io.Discard, r.Body)
+			f.fail(w, http.StatusServiceUnavailable, "service_unavailable")
+			return
+		case part == f.rejectPart:
+			f.fail(w, http.StatusBadRequest, "bad_request")
+			return
+		case part == f.blockPart:
+			close(f.partStarted)
+			// the request is canceled once the connection is closed
+			_, _ = io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+
+		data, ok := f.readBody(r)
+		if !ok {
+			f.fail(w, http.StatusBadRequest, "checksum_mismatch")
+			return
+		}
+		f.m.Lock()
+		lf, ok := f.large[id]
+		if ok {
+			lf.parts[part] = data
+		}
+		f.m.Unlock()
+		if !ok {
+			f.fail(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		f.reply(w, map[string]interface{}{
+			"fileId":        id,
+			"partNumber":    part,
+			"contentLength": len(data),
+			"contentSha1":   fmt.Sprintf("%x", sha1.Sum(data)),
+		})
+
+	case "b2_finish_large_file":
+		id := str("fileId")
+		hashes, _ := req["partSha1Array"].([]interface{})
+
+		f.m.Lock()
+		lf, ok := f.large[id]
+		var data []byte
+		for i := 0; ok && i < len(hashes); i++ {
+			part, found := lf.parts[i+1]
+			ok = ok && found && hashes[i] == fmt.Sprintf("%x", sha1.Sum(part))
+			data = append(data, part...)
+		}
+		if ok {
+			delete(f.large, id)
+			f.files[lf.name] = data
+		}
+		f.m.Unlock()
+		if !ok {
+			f.fail(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		f.reply(w, f.fileInfo(id, lf.name, data))
+
+	case "b2_cancel_large_file":
+		id := str("fileId")
+		f.m.Lock()
+		lf, ok := f.large[id]
+		if ok {
+			delete(f.large, id)
+			f.canceled = append(f.canceled, lf.name)
+		}
+		f.m.Unlock()
+		if !ok {
+			f.fail(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		f.reply(w, map[string]interface{}{
+			"fileId":    id,
+			"fileName":  lf.name,
+			"accountId": "account",
+			"bucketId":  "bucket-id",
+		})
+
+	case "b2_list_unfinished_large_files":
+		count := 100
+		if c, ok := req["maxFileCount"].(float64); ok && c > 0 {
+			count = int(c)
+		}
+
+		f.m.Lock()
+		var ids []string
+		for id := range f.large {
+			if id >= str("startFileId") {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		next := ""
+		if len(ids) > count {
+			next = ids[count]
+			ids = ids[:count]
+		}
+		var files []map[string]interface{}
+		for _, id := range ids {
+			lf := f.large[id]
+			info := f.fileInfo(id, lf.name, nil)
+			info["uploadTimestamp"] = lf.started.UnixNano() / 1e6
+			files = append(files, info)
+		}
+		f.m.Unlock()
+		f.reply(w, map[string]interface{}{
+			"files":      files,
+			"nextFileId": next,
+		})
+
+	default:
+		f.t.Errorf("unexpected request %v %v", r.Method, r.URL)
+		f.fail(w, http.StatusBadRequest, "bad_request")
+	}
+}
+
+// unfinished returns the names of the unfinished large files.
+func (f *fakeB2) unfinished() []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	var names []string
+	for _, lf := range f.large {
+		names = append(names, lf.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func openFakeB2(t testing.TB) *b2Backend {
+	cfg := NewConfig()
+	cfg.AccountID = "account"
+	cfg.Key = options.NewSecretString("key")
+	cfg.Bucket = "bucket"
+	cfg.Prefix = "repo"
+	cfg.PartSize = minPartSize
+
+	be, err := Open(context.TODO(), cfg, http.DefaultTransport)
+	rtest.OK(t, err)
+	t.Cleanup(func() { rtest.OK(t, be.Close()) })
+	return be.(*b2Backend)
+}
+
+func saveFakeB2(ctx context.Context, be *b2Backend, data []byte) (string, error) {
+	h := backend.Handle{Type: backend.PackFile, Name: fmt.Sprintf("%x", sha1.Sum(data))}
+	err := be.Save(ctx, h, backend.NewByteReader(data, nil))
+	return be.Filename(h), err
+}
+
+func TestSaveLargeFile(t *testing.T) {
+	f := newFakeB2(t)
+	be := openFakeB2(t)
+
+	for _, size := range []int{1000, minPartSize*1024*1024 - 1, 12 * 1024 * 1024} {
+		data := rtest.Random(size, size)
+		name, err := saveFakeB2(context.TODO(), be, data)
+		rtest.OK(t, err)
+		rtest.Assert(t, bytes.Equal(data, f.files[name]), "wrong data stored for size %v", size)
+	}
+
+	// only the last file is uploaded in three parts
+	rtest.Equals(t, 3, f.uploads)
+	rtest.Equals(t, 0, len(f.unfinished()))
+}
+
+func TestSaveLargeFileRetryPart(t *testing.T) {
+	f := newFakeB2(t)
+	f.failParts = 1
+	be := openFakeB2(t)
+
+	data := rtest.Random(23, 12*1024*1024)
+	name, err := saveFakeB2(context.TODO(), be, data)
+	rtest.OK(t, err)
+	rtest.Assert(t, bytes.Equal(data, f.files[name]), "wrong data stored")
+
+	// the failed part is uploaded again
+	rtest.Equals(t, 4, f.uploads)
+}
+
+func TestSaveLargeFileCancel(t *testing.T) {
+	f := newFakeB2(t)
+	f.rejectPart = 2
+	be := openFakeB2(t)
+
+	name, err := saveFakeB2(context.TODO(), be, rtest.Random(42, 12*1024*1024))
+	rtest.Assert(t, err != nil, "missing error")
+	rtest.Equals(t, []string{name}, f.canceled)
+	rtest.Equals(t, 0, len(f.unfinished()))
+	_, ok := f.files[name]
+	rtest.Assert(t, !ok, "file was stored")
+}
+
+func TestSaveLargeFileContextCancel(t *testing.T) {
+	f := newFakeB2(t)
+	f.blockPart = 2
+	be := openFakeB2(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-f.partStarted
+		cancel()
+	}()
+	name, err := saveFakeB2(ctx, be, rtest.Random(42, 12*1024*1024))
+	rtest.Assert(t, err != nil, "missing error")
+	rtest.Equals(t, 0, len(f.unfinished()))
+	rtest.Equals(t, []string{name}, f.canceled)
+}
+
+func TestCleanupLargeFiles(t *testing.T) {
+	f := newFakeB2(t)
+	stale := time.Now().Add(-2 * staleLargeFileAge)
+	f.large["a"] = &fakeLargeFile{name: "repo/data/00/stale", started: stale}
+	f.large["b"] = &fakeLargeFile{name: "repo/data/00/recent", started: time.Now()}
+	f.large["c"] = &fakeLargeFile{name: "other/data/00/stale", started: stale}
+	f.large["d"] = &fakeLargeFile{name: "repository/data/00/stale", started: stale}
+
+	// the cleanup runs as soon as the backend has been opened
+	be := openFakeB2(t)
+	deadline := time.Now().Add(10 * time.Second)
+	for len(f.unfinished()) == 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rtest.OK(t, be.Close())
+
+	rtest.Equals(t, []string{"other/data/00/stale", "repo/data/00/recent", "repository/data/00/stale"}, f.unfinished())
+	rtest.Equals(t, []string{"repo/data/00/stale"}, f.canceled)
+}
+
+func TestRewindReaderAt(t *testing.T) {
+	data := rtest.Random(5, 1000)
+	rd := newRewindReaderAt(backend.NewByteReader(data, nil))
+
+	size, err := rd.Seek(0, io.SeekEnd)
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(len(data)), size)
+
+	buf := make([]byte, 100)
+	for _, off := range []int64{500, 600, 0, 950} {
+		n, err := rd.ReadAt(buf, off)
+		want := data[off:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+			rtest.OK(t, err)
+		} else {
+			rtest.Equals(t, io.EOF, err)
+		}
+		rtest.Equals(t, want, buf[:n])
+	}
+
+	_, err = rd.Seek(0, io.SeekStart)
+	rtest.OK(t, err)
+	all, err := io.ReadAll(rd)
+	rtest.OK(t, err)
+	rtest.Equals(t, data, all)
+}
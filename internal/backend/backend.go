@@ -100,6 +100,42 @@ type FreezeBackend interface {
 	Unfreeze()
 }
 
+// PermanentErrorClassifier is implemented by backends which can tell that an
+// error cannot be fixed by retrying the operation, for example because the
+// credentials are invalid or the bucket does not exist.
+type PermanentErrorClassifier interface {
+	Backend
+	// IsPermanentError returns true if retrying the failed operation is
+	// pointless.
+	IsPermanentError(err error) bool
+}
+
+// ThrottleClassifier is implemented by backends which can tell that an error
+// was caused by the provider throttling requests.
+type ThrottleClassifier interface {
+	Backend
+	// IsThrottled returns true if the operation failed because too many
+	// requests were sent.
+	IsThrottled(err error) bool
+}
+
+// DeletionClassifier is implemented by backends which can tell that a file
+// was not removed because the backend does not allow deleting files, for
+// example a rest-server in append-only mode.
+type DeletionClassifier interface {
+	Backend
+	// IsDeletionForbidden returns true if Remove failed with err because
+	// deleting the file is not allowed.
+	IsDeletionForbidden(err error) bool
+}
+
+// Throttler is implemented by backends which limit the rate of operations.
+type Throttler interface {
+	Backend
+	// Throttled is called when the provider has throttled a request.
+	Throttled()
+}
+
 // FileInfo is contains information about a file in the backend.
 type FileInfo struct {
 	Size int64
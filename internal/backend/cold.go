@@ -0,0 +1,24 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+// ErrCold is returned, possibly wrapped, by Load if a file is stored in an
+// archive storage tier and must be restored before it can be read.
+var ErrCold = errors.New("file is in cold storage and must be restored before it can be read")
+
+// ColdStorageBackend is implemented by backends which can store files in
+// archive storage tiers.
+type ColdStorageBackend interface {
+	Backend
+	// ColdFile returns true if the file h is stored in an archive storage
+	// tier when it is saved.
+	ColdFile(h Handle) bool
+	// Thaw returns true if the file h can be read. If the file is in an
+	// archive storage tier and request is set, a temporary readable copy is
+	// requested unless a request is already in progress.
+	Thaw(ctx context.Context, h Handle, request bool) (bool, error)
+}
@@ -0,0 +1,100 @@
+package gs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const (
+	defaultTokenURL = "https://sts.googleapis.com/v1/token"
+	scopeCloud      = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// externalAccount is the credential configuration for workload identity
+// federation, see https://google.aip.dev/auth/4117.
+type externalAccount struct {
+	Type             string `json:"type"`
+	Audience         string `json:"audience"`
+	SubjectTokenType string `json:"subject_token_type"`
+	TokenURL         string `json:"token_url"`
+	CredentialSource struct {
+		File string `json:"file"`
+	} `json:"credential_source"`
+}
+
+// newTokenSource returns the token source configured by cfg. The base
+// credentials are taken from GOOGLE_ACCESS_TOKEN, the workload identity
+// federation options or the application default credentials, in this order.
+// If a service account is to be impersonated, the base credentials are used
+// to request tokens for that account.
+func newTokenSource(ctx context.Context, cfg Config, rt http.RoundTripper) (oauth2.TokenSource, error) {
+	scope := storage.ScopeReadWrite
+	if cfg.ImpersonateServiceAccount != "" {
+		// generating tokens for another account requires the broader scope
+		scope = scopeCloud
+	}
+
+	var ts oauth2.TokenSource
+	switch {
+	case os.Getenv("GOOGLE_ACCESS_TOKEN") != "":
+		ts = oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: os.Getenv("GOOGLE_ACCESS_TOKEN"),
+			TokenType:   "Bearer",
+		})
+	case cfg.Audience != "":
+		if cfg.SubjectTokenFile == "" {
+			return nil, errors.New("gs.audience requires gs.subject-token-file to be set")
+		}
+
+		account := externalAccount{
+			Type:             "external_account",
+			Audience:         cfg.Audience,
+			SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+			TokenURL:         cfg.TokenURL,
+		}
+		if account.TokenURL == "" {
+			account.TokenURL = defaultTokenURL
+		}
+		account.CredentialSource.File = cfg.SubjectTokenFile
+
+		buf, err := json.Marshal(account)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := google.CredentialsFromJSON(ctx, buf, scope)
+		if err != nil {
+			return nil, errors.Wrap(err, "workload identity federation")
+		}
+		ts = creds.TokenSource
+	default:
+		var err error
+		ts, err = google.DefaultTokenSource(ctx, scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ImpersonateServiceAccount != "" {
+		client := &http.Client{Transport: &oauth2.Transport{Source: ts, Base: rt}}
+		var err error
+		ts, err = impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: cfg.ImpersonateServiceAccount,
+			Scopes:          []string{storage.ScopeReadWrite},
+		}, option.WithHTTPClient(client))
+		if err != nil {
+			return nil, errors.Wrapf(err, "impersonate %v", cfg.ImpersonateServiceAccount)
+		}
+	}
+
+	return ts, nil
+}
@@ -0,0 +1,153 @@
+package gs_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/gs"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+// fakeSTS exchanges subject tokens for access tokens which expire
+// immediately, so that each request needs a new token.
+type fakeSTS struct {
+	subjectToken string
+	audience     string
+
+	m      sync.Mutex
+	issued int
+}
+
+func (s *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Form.Get("subject_token") != s.subjectToken || r.Form.Get("audience") != s.audience {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":"access_denied","error_description":"Permission 'iam.workloadIdentityPools.createToken' denied"}`))
+		return
+	}
+
+	s.m.Lock()
+	s.issued++
+	token := fmt.Sprintf("token-%d", s.issued)
+	s.m.Unlock()
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":      token,
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"token_type":        "Bearer",
+		// shorter than the refresh margin of the oauth2 library
+		"expires_in": 1,
+	})
+}
+
+// fakeStorage serves an object listing in two pages and records the access
+// tokens and user projects of the requests.
+type fakeStorage struct {
+	m            sync.Mutex
+	tokens       []string
+	userProjects []string
+}
+
+func (s *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	s.tokens = append(s.tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	s.userProjects = append(s.userProjects, r.URL.Query().Get("userProject"))
+	s.m.Unlock()
+
+	if r.URL.Path != "/storage/v1/b/bucket/o" {
+		http.NotFound(w, r)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("pageToken") == "" {
+		_, _ = fmt.Fprintf(w, `{"items":[{"name":%q,"size":"1"}],"nextPageToken":"next"}`, prefix+"a")
+		return
+	}
+	_, _ = fmt.Fprintf(w, `{"items":[{"name":%q,"size":"2"}]}`, prefix+"b")
+}
+
+func TestWorkloadIdentityFederation(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	rtest.OK(t, os.WriteFile(tokenFile, []byte("subject-token"), 0600))
+
+	sts := &fakeSTS{subjectToken: "subject-token", audience: "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/github"}
+	stsSrv := httptest.NewServer(sts)
+	defer stsSrv.Close()
+
+	storage := &fakeStorage{}
+	storageSrv := httptest.NewServer(storage)
+	defer storageSrv.Close()
+
+	t.Setenv("GOOGLE_ACCESS_TOKEN", "")
+	t.Setenv("STORAGE_EMULATOR_HOST", storageSrv.URL)
+
+	cfg, err := gs.ParseConfig("gs:bucket:/repo")
+	rtest.OK(t, err)
+	cfg.Audience = sts.audience
+	cfg.SubjectTokenFile = tokenFile
+	cfg.TokenURL = stsSrv.URL
+	cfg.QuotaProject = "billing"
+
+	be, err := gs.Open(context.TODO(), *cfg, http.DefaultTransport)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, sts.issued)
+
+	var names []string
+	rtest.OK(t, be.List(context.TODO(), backend.SnapshotFile, func(fi backend.FileInfo) error {
+		names = append(names, fi.Name)
+		return nil
+	}))
+	rtest.Equals(t, []string{"a", "b"}, names)
+
+	// the token expired between both pages of the listing
+	rtest.Equals(t, []string{"token-2", "token-3"}, storage.tokens)
+	rtest.Equals(t, []string{"billing", "billing"}, storage.userProjects)
+}
+
+func TestWorkloadIdentityFederationDenied(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	rtest.OK(t, os.WriteFile(tokenFile, []byte("wrong-token"), 0600))
+
+	stsSrv := httptest.NewServer(&fakeSTS{subjectToken: "subject-token", audience: "audience"})
+	defer stsSrv.Close()
+
+	t.Setenv("GOOGLE_ACCESS_TOKEN", "")
+
+	cfg, err := gs.ParseConfig("gs:bucket:/repo")
+	rtest.OK(t, err)
+	cfg.Audience = "audience"
+	cfg.SubjectTokenFile = tokenFile
+	cfg.TokenURL = stsSrv.URL
+
+	_, err = gs.Open(context.TODO(), *cfg, http.DefaultTransport)
+	rtest.Assert(t, err != nil, "expected error")
+	rtest.Assert(t, strings.Contains(err.Error(), "unable to obtain an access token"), "unexpected error %v", err)
+	rtest.Assert(t, strings.Contains(err.Error(), "iam.workloadIdentityPools.createToken"), "IAM error is missing from %v", err)
+}
+
+func TestAudienceRequiresSubjectToken(t *testing.T) {
+	t.Setenv("GOOGLE_ACCESS_TOKEN", "")
+
+	cfg, err := gs.ParseConfig("gs:bucket:/repo")
+	rtest.OK(t, err)
+	cfg.Audience = "audience"
+
+	_, err = gs.Open(context.TODO(), *cfg, http.DefaultTransport)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "gs.subject-token-file"), "unexpected error %v", err)
+}
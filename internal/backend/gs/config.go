@@ -20,6 +20,12 @@ type Config struct {
 
 	Connections uint   `option:"connections" help:"set a limit for the number of concurrent connections (default: 5)"`
 	Region      string `option:"region" help:"region to create the bucket in (default: us)"`
+
+	ImpersonateServiceAccount string `option:"impersonate-service-account" help:"email address of a service account to impersonate"`
+	Audience                  string `option:"audience" help:"audience of the workload identity provider to exchange the subject token with"`
+	SubjectTokenFile          string `option:"subject-token-file" help:"file containing the OIDC token to exchange using workload identity federation"`
+	TokenURL                  string `option:"token-url" help:"security token service endpoint for workload identity federation (default: https://sts.googleapis.com/v1/token)"`
+	QuotaProject              string `option:"quota-project" help:"project billed for the requests, required for requester pays buckets"`
 }
 
 // NewConfig returns a new Config with the default values filled in.
@@ -66,4 +72,8 @@ func (cfg *Config) ApplyEnvironment(prefix string) {
 	if cfg.ProjectID == "" {
 		cfg.ProjectID = os.Getenv(prefix + "GOOGLE_PROJECT_ID")
 	}
+
+	if cfg.QuotaProject == "" {
+		cfg.QuotaProject = os.Getenv(prefix + "GOOGLE_CLOUD_QUOTA_PROJECT")
+	}
 }
@@ -7,7 +7,6 @@ import (
 	"hash"
 	"io"
 	"net/http"
-	"os"
 	"path"
 	"strings"
 
@@ -20,7 +19,6 @@ import (
 	"github.com/restic/restic/internal/debug"
 
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
@@ -52,7 +50,7 @@ func NewFactory() location.Factory {
 	return location.NewHTTPBackendFactory("gs", ParseConfig, location.NoPassword, Create, Open)
 }
 
-func getStorageClient(rt http.RoundTripper) (*storage.Client, error) {
+func getStorageClient(cfg Config, rt http.RoundTripper) (*storage.Client, error) {
 	// create a new HTTP client
 	httpClient := &http.Client{
 		Transport: rt,
@@ -61,18 +59,15 @@ func getStorageClient(rt http.RoundTripper) (*storage.Client, error) {
 	// create a new context with the HTTP client stored at the oauth2.HTTPClient key
 	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
 
-	var ts oauth2.TokenSource
-	if token := os.Getenv("GOOGLE_ACCESS_TOKEN"); token != "" {
-		ts = oauth2.StaticTokenSource(&oauth2.Token{
-			AccessToken: token,
-			TokenType:   "Bearer",
-		})
-	} else {
-		var err error
-		ts, err = google.DefaultTokenSource(ctx, storage.ScopeReadWrite)
-		if err != nil {
-			return nil, err
-		}
+	ts, err := newTokenSource(ctx, cfg, rt)
+	if err != nil {
+		return nil, err
+	}
+
+	// fail early if no token can be minted, for example because the
+	// federation or impersonation is not permitted
+	if _, err := ts.Token(); err != nil {
+		return nil, errors.Wrap(err, "unable to obtain an access token")
 	}
 
 	oauthClient := oauth2.NewClient(ctx, ts)
@@ -98,18 +93,25 @@ const defaultListMaxItems = 1000
 func open(cfg Config, rt http.RoundTripper) (*Backend, error) {
 	debug.Log("open, config %#v", cfg)
 
-	gcsClient, err := getStorageClient(rt)
+	gcsClient, err := getStorageClient(cfg, rt)
 	if err != nil {
 		return nil, errors.Wrap(err, "getStorageClient")
 	}
 
+	bucket := gcsClient.Bucket(cfg.Bucket)
+	if cfg.QuotaProject != "" {
+		// bills the requests to the given project, this is required to
+		// access requester pays buckets
+		bucket = bucket.UserProject(cfg.QuotaProject)
+	}
+
 	be := &Backend{
 		gcsClient:   gcsClient,
 		projectID:   cfg.ProjectID,
 		connections: cfg.Connections,
 		bucketName:  cfg.Bucket,
 		region:      cfg.Region,
-		bucket:      gcsClient.Bucket(cfg.Bucket),
+		bucket:      bucket,
 		prefix:      cfg.Prefix,
 		Layout: &layout.DefaultLayout{
 			Path: cfg.Prefix,
@@ -173,6 +175,30 @@ func (be *Backend) IsNotExist(err error) bool {
 	return errors.Is(err, storage.ErrObjectNotExist)
 }
 
+// IsPermanentError returns true if the error is caused by invalid credentials,
+// missing permissions or a missing bucket.
+func (be *Backend) IsPermanentError(err error) bool {
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return true
+	}
+
+	var e *googleapi.Error
+	return errors.As(err, &e) && (e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden)
+}
+
+// IsDeletionForbidden returns true if the permissions or the retention policy
+// of the bucket do not allow removing the file.
+func (be *Backend) IsDeletionForbidden(err error) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && e.Code == http.StatusForbidden
+}
+
+// IsThrottled returns true if the rate limit for requests was exceeded.
+func (be *Backend) IsThrottled(err error) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && e.Code == http.StatusTooManyRequests
+}
+
 // Join combines path components with slashes.
 func (be *Backend) Join(p ...string) string {
 	return path.Join(p...)
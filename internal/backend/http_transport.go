@@ -79,7 +79,10 @@ func Transport(opts TransportOptions) (http.RoundTripper, error) {
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig:       &tls.Config{},
+		TLSClientConfig: &tls.Config{
+			// resume TLS sessions when a new connection is required
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
 	}
 
 	if opts.InsecureTLS {
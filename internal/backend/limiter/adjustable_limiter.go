@@ -0,0 +1,62 @@
+package limiter
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// AdjustableLimiter is a Limiter whose upload and download limits can be
+// changed while it is in use. The limits apply to the aggregate throughput of
+// all readers, writers and transports created by the limiter.
+type AdjustableLimiter struct {
+	staticLimiter
+
+	m      sync.Mutex
+	limits Limits
+}
+
+// ensure AdjustableLimiter implements Limiter
+var _ Limiter = &AdjustableLimiter{}
+
+// NewAdjustableLimiter constructs a Limiter with the initial upload and
+// download limits l.
+func NewAdjustableLimiter(l Limits) *AdjustableLimiter {
+	lim := &AdjustableLimiter{
+		staticLimiter: staticLimiter{
+			// the burst is never zero, even while a bucket is unlimited
+			upstream:   rate.NewLimiter(rate.Inf, 1),
+			downstream: rate.NewLimiter(rate.Inf, 1),
+		},
+	}
+	lim.SetLimits(l)
+	return lim
+}
+
+// SetLimits changes the upload and download limits. Zero means unlimited.
+func (l *AdjustableLimiter) SetLimits(limits Limits) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	setLimit(l.upstream, limits.UploadKb)
+	setLimit(l.downstream, limits.DownloadKb)
+	l.limits = limits
+}
+
+// Limits returns the current upload and download limits.
+func (l *AdjustableLimiter) Limits() Limits {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.limits
+}
+
+func setLimit(bucket *rate.Limiter, kb int) {
+	if kb <= 0 {
+		bucket.SetLimit(rate.Inf)
+		return
+	}
+
+	// the bucket allows one second worth of data at once, like the static limiter
+	bucket.SetBurst(int(toByteRate(kb)))
+	bucket.SetLimit(rate.Limit(toByteRate(kb)))
+}
@@ -0,0 +1,88 @@
+package limiter
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/test"
+)
+
+// measureRate transfers size bytes per worker with the given number of
+// concurrent workers and returns the aggregate rate in bytes per second. The
+// initial burst of the bucket is not included.
+func measureRate(t *testing.T, workers int, size int, burst int, transfer func(data []byte) error) float64 {
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := transfer(make([]byte, size)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return float64(workers*size-burst) / time.Since(start).Seconds()
+}
+
+func assertRate(t *testing.T, want float64, got float64) {
+	t.Helper()
+	if got > want*1.05 || got < want*0.95 {
+		t.Fatalf("aggregate rate %.0f B/s is not within 5%% of the limit %.0f B/s", got, want)
+	}
+}
+
+func TestAdjustableLimiterThroughput(t *testing.T) {
+	const limitKb = 512
+	lim := NewAdjustableLimiter(Limits{UploadKb: limitKb, DownloadKb: limitKb})
+	byteRate := toByteRate(limitKb)
+
+	// four downloads share the limit
+	got := measureRate(t, 4, 256*1024, int(byteRate), func(data []byte) error {
+		_, err := io.Copy(io.Discard, lim.Downstream(bytes.NewReader(data)))
+		return err
+	})
+	assertRate(t, byteRate, got)
+
+	// the upload limit is independent of the download limit
+	got = measureRate(t, 4, 256*1024, int(byteRate), func(data []byte) error {
+		_, err := lim.UpstreamWriter(io.Discard).Write(data)
+		return err
+	})
+	assertRate(t, byteRate, got)
+}
+
+func TestAdjustableLimiterSetLimits(t *testing.T) {
+	lim := NewAdjustableLimiter(Limits{})
+	test.Equals(t, Limits{}, lim.Limits())
+
+	// unlimited transfers are not delayed
+	start := time.Now()
+	_, err := io.Copy(io.Discard, lim.Upstream(bytes.NewReader(make([]byte, 16*1024*1024))))
+	test.OK(t, err)
+	test.Assert(t, time.Since(start) < time.Second, "unlimited upload was delayed")
+
+	// readers created before the change respect the new limit
+	rd := lim.Upstream(bytes.NewReader(make([]byte, 1024*1024)))
+	lim.SetLimits(Limits{UploadKb: 256})
+	test.Equals(t, Limits{UploadKb: 256}, lim.Limits())
+
+	byteRate := toByteRate(256)
+	got := measureRate(t, 1, 768*1024, int(byteRate), func(data []byte) error {
+		_, err := io.ReadFull(rd, data)
+		return err
+	})
+	assertRate(t, byteRate, got)
+
+	// lifting the limit again
+	lim.SetLimits(Limits{})
+	start = time.Now()
+	_, err = io.Copy(io.Discard, rd)
+	test.OK(t, err)
+	test.Assert(t, time.Since(start) < time.Second, "unlimited upload was delayed")
+}
@@ -0,0 +1,107 @@
+package limiter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// ReadLimitsFile reads upload and download limits from a file. Each line of
+// the file has the form "upload=<rate>" or "download=<rate>" with the rate in
+// KiB/s, zero means unlimited. Empty lines and lines starting with # are
+// ignored. Limits which are not set in the file are taken from defaults.
+func ReadLimitsFile(filename string, defaults Limits) (Limits, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return Limits{}, errors.WithStack(err)
+	}
+
+	limits := defaults
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return Limits{}, errors.Errorf("%v:%d: invalid line %q", filename, line, text)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		kb, err := strconv.Atoi(value)
+		if err != nil || kb < 0 {
+			return Limits{}, errors.Errorf("%v:%d: invalid rate %q", filename, line, value)
+		}
+
+		switch strings.ToLower(key) {
+		case "upload":
+			limits.UploadKb = kb
+		case "download":
+			limits.DownloadKb = kb
+		default:
+			return Limits{}, errors.Errorf("%v:%d: unknown limit %q", filename, line, key)
+		}
+	}
+
+	return limits, errors.WithStack(sc.Err())
+}
+
+// limitsFilePollInterval is the interval in which WatchLimitsFile checks
+// whether the limits file has been modified.
+var limitsFilePollInterval = 5 * time.Second
+
+// WatchLimitsFile starts a goroutine which applies the limits from filename to
+// lim whenever the file is modified and, on Unix, when the process receives
+// SIGUSR2. report is called with the new limits or the error encountered when
+// reading the file. The goroutine exits when ctx is cancelled.
+func WatchLimitsFile(ctx context.Context, filename string, defaults Limits, lim *AdjustableLimiter, report func(Limits, error)) {
+	reload := make(chan os.Signal, 1)
+	notifyReload(reload)
+
+	var lastModTime time.Time
+	if fi, err := os.Stat(filename); err == nil {
+		lastModTime = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(limitsFilePollInterval)
+
+	go func() {
+		defer stopNotifyReload(reload)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reload:
+				debug.Log("reloading limits from %v", filename)
+			case <-ticker.C:
+				fi, err := os.Stat(filename)
+				if err != nil || fi.ModTime().Equal(lastModTime) {
+					continue
+				}
+				lastModTime = fi.ModTime()
+			}
+
+			limits, err := ReadLimitsFile(filename, defaults)
+			if err == nil {
+				if limits == lim.Limits() {
+					continue
+				}
+				lim.SetLimits(limits)
+			}
+			if report != nil {
+				report(limits, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,95 @@
+package limiter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/test"
+)
+
+func TestReadLimitsFile(t *testing.T) {
+	defaults := Limits{UploadKb: 100, DownloadKb: 200}
+
+	var tests = []struct {
+		data   string
+		limits Limits
+	}{
+		{"", defaults},
+		{"upload=10\n", Limits{UploadKb: 10, DownloadKb: 200}},
+		{"# work hours\nupload = 10\n\nDownload=0\n", Limits{UploadKb: 10, DownloadKb: 0}},
+		{"download=5000\r\nupload=0\r\n", Limits{UploadKb: 0, DownloadKb: 5000}},
+	}
+
+	for _, tt := range tests {
+		filename := filepath.Join(test.TempDir(t), "limits")
+		test.OK(t, os.WriteFile(filename, []byte(tt.data), 0600))
+
+		limits, err := ReadLimitsFile(filename, defaults)
+		test.OK(t, err)
+		test.Equals(t, tt.limits, limits)
+	}
+}
+
+func TestReadLimitsFileInvalid(t *testing.T) {
+	for _, data := range []string{
+		"upload\n",
+		"upload=fast\n",
+		"download=-1\n",
+		"bandwidth=10\n",
+	} {
+		filename := filepath.Join(test.TempDir(t), "limits")
+		test.OK(t, os.WriteFile(filename, []byte(data), 0600))
+
+		_, err := ReadLimitsFile(filename, Limits{})
+		test.Assert(t, err != nil, "missing error for %q", data)
+	}
+
+	_, err := ReadLimitsFile(filepath.Join(test.TempDir(t), "missing"), Limits{})
+	test.Assert(t, err != nil, "missing error for missing file")
+}
+
+func TestWatchLimitsFile(t *testing.T) {
+	defer func(d time.Duration) { limitsFilePollInterval = d }(limitsFilePollInterval)
+	limitsFilePollInterval = 10 * time.Millisecond
+
+	filename := filepath.Join(test.TempDir(t), "limits")
+	test.OK(t, os.WriteFile(filename, []byte("upload=10\n"), 0600))
+
+	lim := NewAdjustableLimiter(Limits{UploadKb: 10, DownloadKb: 20})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		limits Limits
+		err    error
+	}
+	reports := make(chan result, 10)
+	WatchLimitsFile(ctx, filename, Limits{DownloadKb: 20}, lim, func(l Limits, err error) {
+		reports <- result{l, err}
+	})
+
+	modify := func(data string, modTime time.Time) result {
+		test.OK(t, os.WriteFile(filename, []byte(data), 0600))
+		test.OK(t, os.Chtimes(filename, modTime, modTime))
+		select {
+		case r := <-reports:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("limits file was not reloaded")
+		}
+		return result{}
+	}
+
+	r := modify("upload=0\ndownload=500\n", time.Now().Add(time.Minute))
+	test.OK(t, r.err)
+	test.Equals(t, Limits{UploadKb: 0, DownloadKb: 500}, r.limits)
+	test.Equals(t, Limits{UploadKb: 0, DownloadKb: 500}, lim.Limits())
+
+	// invalid files are reported and the limits are kept
+	r = modify("upload=fast\n", time.Now().Add(2*time.Minute))
+	test.Assert(t, r.err != nil, "missing error for invalid limits file")
+	test.Equals(t, Limits{UploadKb: 0, DownloadKb: 500}, lim.Limits())
+}
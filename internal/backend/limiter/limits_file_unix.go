@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package limiter
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyReload(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+func stopNotifyReload(c chan<- os.Signal) {
+	signal.Stop(c)
+}
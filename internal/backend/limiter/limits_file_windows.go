@@ -0,0 +1,10 @@
+package limiter
+
+import "os"
+
+// there is no equivalent of SIGUSR2 on Windows, the limits file is only
+// checked for modifications
+
+func notifyReload(_ chan<- os.Signal) {}
+
+func stopNotifyReload(_ chan<- os.Signal) {}
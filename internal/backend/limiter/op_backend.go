@@ -0,0 +1,82 @@
+package limiter
+
+import (
+	"context"
+	"io"
+
+	"github.com/restic/restic/internal/backend"
+)
+
+// listPageSize is the number of files returned by a single list request of
+// most providers.
+const listPageSize = 1000
+
+// LimitOperations wraps a Backend and limits the rate at which operations are
+// started. List counts as one operation per listPageSize files.
+func LimitOperations(be backend.Backend, l *OpLimiter) backend.Backend {
+	return &opLimitedBackend{
+		Backend: be,
+		limiter: l,
+	}
+}
+
+type opLimitedBackend struct {
+	backend.Backend
+	limiter *OpLimiter
+}
+
+// make sure that opLimitedBackend can adjust the rate
+var _ backend.Throttler = &opLimitedBackend{}
+
+func (be *opLimitedBackend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	if err := be.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return be.Backend.Save(ctx, h, rd)
+}
+
+func (be *opLimitedBackend) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	if err := be.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return be.Backend.Load(ctx, h, length, offset, fn)
+}
+
+func (be *opLimitedBackend) Stat(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+	if err := be.limiter.Wait(ctx); err != nil {
+		return backend.FileInfo{}, err
+	}
+	return be.Backend.Stat(ctx, h)
+}
+
+func (be *opLimitedBackend) Remove(ctx context.Context, h backend.Handle) error {
+	if err := be.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return be.Backend.Remove(ctx, h)
+}
+
+func (be *opLimitedBackend) List(ctx context.Context, t backend.FileType, fn func(backend.FileInfo) error) error {
+	if err := be.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	n := 0
+	return be.Backend.List(ctx, t, func(fi backend.FileInfo) error {
+		n++
+		if n%listPageSize == 0 {
+			// the next page is requested
+			if err := be.limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		return fn(fi)
+	})
+}
+
+// Throttled lowers the rate in adaptive mode.
+func (be *opLimitedBackend) Throttled() {
+	be.limiter.Throttled()
+}
+
+func (be *opLimitedBackend) Unwrap() backend.Backend { return be.Backend }
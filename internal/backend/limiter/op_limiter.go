@@ -0,0 +1,182 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+
+	"golang.org/x/time/rate"
+)
+
+// OpLimits represents the limit for the number of backend operations per
+// second. A rate of zero means unlimited.
+type OpLimits struct {
+	Rate float64
+	// Burst is the number of operations which may be started at once, it
+	// defaults to the rate
+	Burst int
+	// Adaptive lowers the rate temporarily when the backend throttles
+	// requests
+	Adaptive bool
+}
+
+const (
+	// opThrottleCooldown is the minimum time between two reductions of the
+	// rate, concurrent requests are usually throttled at the same time
+	opThrottleCooldown = time.Second
+	// opRecoveryInterval is the time without throttled requests after which
+	// the rate is raised again
+	opRecoveryInterval = 30 * time.Second
+	// opMinRateFactor limits how far the rate is lowered
+	opMinRateFactor = 1.0 / 16
+)
+
+// OpLimiter limits the number of backend operations per second. In adaptive
+// mode, the rate is halved each time the backend throttles requests and is
+// raised step by step to the configured rate afterwards.
+type OpLimiter struct {
+	limits OpLimits
+	bucket *rate.Limiter
+	now    func() time.Time
+
+	m sync.Mutex
+	// current is the effective rate
+	current    float64
+	lastChange time.Time
+	reductions int
+
+	waited atomic.Int64
+}
+
+// NewOpLimiter returns a limiter for the operation rate l.
+func NewOpLimiter(l OpLimits) *OpLimiter {
+	lim := &OpLimiter{limits: l, now: time.Now, current: l.Rate}
+	if l.Rate > 0 {
+		burst := l.Burst
+		if burst <= 0 {
+			burst = int(l.Rate)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		lim.bucket = rate.NewLimiter(rate.Limit(l.Rate), burst)
+	}
+	return lim
+}
+
+// Wait blocks until another operation may be started.
+func (l *OpLimiter) Wait(ctx context.Context) error {
+	if l.bucket == nil {
+		return nil
+	}
+	l.raise()
+
+	r := l.bucket.Reserve()
+	d := r.Delay()
+	if d == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		l.waited.Add(int64(d))
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// Throttled records that the backend has throttled a request. In adaptive
+// mode, the rate is lowered.
+func (l *OpLimiter) Throttled() {
+	if !l.limits.Adaptive || l.bucket == nil {
+		return
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	minRate := l.limits.Rate * opMinRateFactor
+	if now.Sub(l.lastChange) < opThrottleCooldown || l.current <= minRate {
+		return
+	}
+
+	l.current /= 2
+	if l.current < minRate {
+		l.current = minRate
+	}
+	l.lastChange = now
+	l.reductions++
+	l.bucket.SetLimit(rate.Limit(l.current))
+	debug.Log("backend throttled requests, lowering the rate to %.2f operations per second", l.current)
+}
+
+// raise raises the rate again after no request was throttled for a while.
+func (l *OpLimiter) raise() {
+	if !l.limits.Adaptive {
+		return
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.current >= l.limits.Rate {
+		return
+	}
+	now := l.now()
+	if now.Sub(l.lastChange) < opRecoveryInterval {
+		return
+	}
+
+	l.current += l.limits.Rate / 8
+	if l.current > l.limits.Rate {
+		l.current = l.limits.Rate
+	}
+	l.lastChange = now
+	l.bucket.SetLimit(rate.Limit(l.current))
+	debug.Log("raising the rate to %.2f operations per second", l.current)
+}
+
+// Rate returns the effective number of operations per second, zero means
+// unlimited.
+func (l *OpLimiter) Rate() float64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.current
+}
+
+// Waited returns the time spent waiting for the rate limit.
+func (l *OpLimiter) Waited() time.Duration {
+	return time.Duration(l.waited.Load())
+}
+
+// Reductions returns how often the rate was lowered because the backend has
+// throttled requests.
+func (l *OpLimiter) Reductions() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.reductions
+}
+
+// Transport returns an http.RoundTripper which lowers the rate in adaptive
+// mode when the server responds that it throttles requests. Some client
+// libraries retry these requests internally, so that the error never reaches
+// the retry backend.
+func (l *OpLimiter) Transport(rt http.RoundTripper) http.RoundTripper {
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		res, err := rt.RoundTrip(req)
+		if res != nil && (res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable) {
+			debug.Log("%v %v was throttled: %v", req.Method, req.URL, res.Status)
+			l.Throttled()
+		}
+		return res, err
+	})
+}
@@ -0,0 +1,138 @@
+package limiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/mock"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestOpLimiterWait(t *testing.T) {
+	lim := NewOpLimiter(OpLimits{Rate: 100, Burst: 5})
+
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		rtest.OK(t, lim.Wait(context.TODO()))
+	}
+	// the first five operations are started at once
+	elapsed := time.Since(start)
+	rtest.Assert(t, elapsed >= 90*time.Millisecond, "15 operations took only %v", elapsed)
+	rtest.Assert(t, lim.Waited() >= 90*time.Millisecond, "waited only %v", lim.Waited())
+}
+
+func TestOpLimiterUnlimited(t *testing.T) {
+	lim := NewOpLimiter(OpLimits{Adaptive: true})
+	for i := 0; i < 1000; i++ {
+		rtest.OK(t, lim.Wait(context.TODO()))
+	}
+	lim.Throttled()
+	rtest.Equals(t, time.Duration(0), lim.Waited())
+	rtest.Equals(t, 0.0, lim.Rate())
+}
+
+func TestOpLimiterCanceled(t *testing.T) {
+	lim := NewOpLimiter(OpLimits{Rate: 0.01})
+	rtest.OK(t, lim.Wait(context.TODO()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	rtest.Equals(t, context.DeadlineExceeded, lim.Wait(ctx))
+}
+
+func TestOpLimiterAdaptive(t *testing.T) {
+	now := time.Unix(1000, 0)
+	lim := NewOpLimiter(OpLimits{Rate: 16, Adaptive: true})
+	lim.now = func() time.Time { return now }
+
+	lim.Throttled()
+	rtest.Equals(t, 8.0, lim.Rate())
+
+	// requests which were throttled at the same time are ignored
+	lim.Throttled()
+	rtest.Equals(t, 8.0, lim.Rate())
+
+	for i := 0; i < 10; i++ {
+		now = now.Add(2 * time.Second)
+		lim.Throttled()
+	}
+	// the rate is not lowered below a sixteenth of the limit
+	rtest.Equals(t, 1.0, lim.Rate())
+	rtest.Equals(t, 4, lim.Reductions())
+
+	// the rate is raised again in steps
+	now = now.Add(opRecoveryInterval)
+	lim.raise()
+	rtest.Equals(t, 3.0, lim.Rate())
+	lim.raise()
+	rtest.Equals(t, 3.0, lim.Rate())
+	for i := 0; i < 10; i++ {
+		now = now.Add(opRecoveryInterval)
+		lim.raise()
+	}
+	rtest.Equals(t, 16.0, lim.Rate())
+}
+
+func TestOpLimiterStatic(t *testing.T) {
+	lim := NewOpLimiter(OpLimits{Rate: 16})
+	lim.Throttled()
+	rtest.Equals(t, 16.0, lim.Rate())
+	rtest.Equals(t, 0, lim.Reductions())
+}
+
+func TestOpLimiterTransport(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	lim := NewOpLimiter(OpLimits{Rate: 16, Adaptive: true})
+	client := http.Client{Transport: lim.Transport(http.DefaultTransport)}
+	get := func() {
+		resp, err := client.Get(srv.URL)
+		rtest.OK(t, err)
+		rtest.OK(t, resp.Body.Close())
+	}
+
+	get()
+	rtest.Equals(t, 16.0, lim.Rate())
+
+	status = http.StatusTooManyRequests
+	get()
+	rtest.Equals(t, 8.0, lim.Rate())
+}
+
+func TestLimitOperationsList(t *testing.T) {
+	be := mock.NewBackend()
+	be.ListFn = func(ctx context.Context, t backend.FileType, fn func(backend.FileInfo) error) error {
+		for i := 0; i < 2500; i++ {
+			if err := fn(backend.FileInfo{Name: "file"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	be.StatFn = func(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+		return backend.FileInfo{Name: h.Name}, nil
+	}
+
+	lim := NewOpLimiter(OpLimits{Rate: 0.001, Burst: 10})
+	limbe := LimitOperations(be, lim)
+	rtest.OK(t, limbe.List(context.TODO(), backend.PackFile, func(backend.FileInfo) error {
+		return nil
+	}))
+	_, err := limbe.Stat(context.TODO(), backend.Handle{Type: backend.PackFile, Name: "file"})
+	rtest.OK(t, err)
+
+	// one operation for the stat and each of the three pages
+	rtest.Assert(t, lim.bucket.Tokens() < 6.1, "%v tokens left", lim.bucket.Tokens())
+	rtest.Assert(t, lim.bucket.Tokens() > 5.9, "%v tokens left", lim.bucket.Tokens())
+
+	// the rate limiter can be found by the retry backend
+	rtest.Assert(t, backend.AsBackend[backend.Throttler](limbe) != nil, "missing Throttler")
+}
@@ -70,6 +70,12 @@ func (l staticLimiter) roundTripper(rt http.RoundTripper, req *http.Request) (*h
 		io.Closer
 	}
 
+	if l.upstream != nil {
+		if err := consumeTokens(requestHeaderSize(req), l.upstream); err != nil {
+			return nil, err
+		}
+	}
+
 	if req.Body != nil {
 		req.Body = &readCloser{
 			Reader: l.Upstream(req.Body),
@@ -79,6 +85,15 @@ func (l staticLimiter) roundTripper(rt http.RoundTripper, req *http.Request) (*h
 
 	res, err := rt.RoundTrip(req)
 
+	if res != nil && l.downstream != nil {
+		if err := consumeTokens(responseHeaderSize(res), l.downstream); err != nil {
+			if res.Body != nil {
+				_ = res.Body.Close()
+			}
+			return nil, err
+		}
+	}
+
 	if res != nil && res.Body != nil {
 		res.Body = &readCloser{
 			Reader: l.Downstream(res.Body),
@@ -135,16 +150,58 @@ func (w *rateLimitedWriter) Write(buf []byte) (int, error) {
 	return w.writer.Write(buf)
 }
 
+// headerSize returns the approximate size of the header lines on the wire.
+func headerSize(h http.Header) int {
+	n := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			// "key: value\r\n"
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// requestHeaderSize approximates the number of bytes sent for the request
+// line and headers. Headers added by the transport are not accounted for.
+func requestHeaderSize(req *http.Request) int {
+	// "METHOD uri HTTP/1.1\r\n", headers and the final "\r\n"
+	n := len(req.Method) + len(" HTTP/1.1\r\n") + 1 + headerSize(req.Header) + 2
+	if req.URL != nil {
+		n += len(req.URL.RequestURI()) + len("Host: \r\n") + len(req.URL.Host)
+	}
+	return n
+}
+
+// responseHeaderSize approximates the number of bytes received for the status
+// line and headers.
+func responseHeaderSize(res *http.Response) int {
+	// "HTTP/1.1 200 OK\r\n", headers and the final "\r\n"
+	return len(res.Proto) + 1 + len(res.Status) + 2 + headerSize(res.Header) + 2
+}
+
 func consumeTokens(tokens int, bucket *rate.Limiter) error {
-	// bucket allows waiting for at most Burst() tokens at once
-	maxWait := bucket.Burst()
-	for tokens > maxWait {
-		if err := bucket.WaitN(context.Background(), maxWait); err != nil {
+	for tokens > 0 {
+		if bucket.Limit() == rate.Inf {
+			return nil
+		}
+
+		// bucket allows waiting for at most Burst() tokens at once
+		n := tokens
+		if burst := bucket.Burst(); n > burst {
+			n = burst
+		}
+
+		if err := bucket.WaitN(context.Background(), n); err != nil {
+			if n > bucket.Burst() {
+				// the limits were changed concurrently, try again
+				continue
+			}
 			return err
 		}
-		tokens -= maxWait
+		tokens -= n
 	}
-	return bucket.WaitN(context.Background(), tokens)
+	return nil
 }
 
 func toByteRate(val int) float64 {
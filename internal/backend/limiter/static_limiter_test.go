@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"testing"
 
 	"github.com/restic/restic/internal/test"
@@ -136,3 +137,29 @@ func TestRoundTripperCornerCases(t *testing.T) {
 	_, err = rt.RoundTrip(&http.Request{})
 	test.Assert(t, err != nil, "round tripper lost an error")
 }
+
+func TestRoundTripperHeaders(t *testing.T) {
+	lim := NewStaticLimiter(Limits{UploadKb: 1, DownloadKb: 1}).(staticLimiter)
+	rt := lim.Transport(roundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Proto:  "HTTP/1.1",
+			Status: "200 OK",
+			Header: http.Header{"Content-Type": []string{"application/octet-stream"}},
+			Body:   io.NopCloser(bytes.NewReader(nil)),
+		}, nil
+	}))
+
+	u, err := url.Parse("https://example.com/data/0123456789")
+	test.OK(t, err)
+	req := &http.Request{Method: "HEAD", URL: u, Header: http.Header{"Accept": []string{"*/*"}}}
+	_, err = rt.RoundTrip(req)
+	test.OK(t, err)
+
+	// the headers are accounted for approximately
+	assertTokensUsed := func(bucket *rate.Limiter, min, max float64) {
+		used := float64(bucket.Burst()) - bucket.Tokens()
+		test.Assert(t, used >= min && used <= max, "%.0f tokens used, want between %v and %v", used, min, max)
+	}
+	assertTokensUsed(lim.upstream, 60, 100)
+	assertTokensUsed(lim.downstream, 40, 80)
+}
@@ -12,7 +12,8 @@ type Config struct {
 	Path   string
 	Layout string `option:"layout" help:"use this backend directory layout (default: auto-detect)"`
 
-	Connections uint `option:"connections" help:"set a limit for the number of concurrent operations (default: 2)"`
+	Connections uint   `option:"connections" help:"set a limit for the number of concurrent operations (default: 2)"`
+	Durability  string `option:"durability" help:"control which changes are synced to disk: none, file or file+dir (default: file)"`
 }
 
 // NewConfig returns a new config with default options applied.
@@ -0,0 +1,63 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// durability controls which changes are synced to disk by Save.
+type durability int
+
+const (
+	// durabilityNone does not sync anything.
+	durabilityNone durability = iota
+	// durabilityFile syncs each file and the directory it is renamed into.
+	durabilityFile
+	// durabilityFileDir additionally syncs the parents of newly created
+	// directories and the repository root after index and snapshot files
+	// have been written.
+	durabilityFileDir
+)
+
+func parseDurability(s string) (durability, error) {
+	switch s {
+	case "none":
+		return durabilityNone, nil
+	case "", "file":
+		return durabilityFile, nil
+	case "file+dir":
+		return durabilityFileDir, nil
+	}
+	return 0, errors.Fatalf("invalid durability %q, must be one of none, file or file+dir", s)
+}
+
+var dirSync = fsyncDir // Overridden by test.
+
+// isSyncNotSupported returns true if err indicates that the filesystem does
+// not support fsync for the file or directory.
+func isSyncNotSupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EINVAL) || isMacENOTTY(err)
+}
+
+// syncDir flushes changes to the directory dir. If the filesystem does not
+// support syncing directories, a warning is printed once and directories are
+// no longer synced.
+func (b *Local) syncDir(dir string) error {
+	if b.noDirSync.Load() {
+		return nil
+	}
+
+	err := dirSync(dir)
+	if err != nil && isSyncNotSupported(err) {
+		if b.noDirSync.CompareAndSwap(false, true) {
+			debug.Log("syncing directory %v failed, disabling directory syncs: %v", dir, err)
+			fmt.Fprintf(os.Stderr, "local: the filesystem does not support syncing directories, continuing without: %v\n", err)
+		}
+		return nil
+	}
+	return err
+}
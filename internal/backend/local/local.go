@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/restic/restic/internal/backend"
@@ -25,6 +26,11 @@ type Local struct {
 	Config
 	layout.Layout
 	util.Modes
+
+	durability durability
+	// noDirSync is set once syncing a directory has failed because the
+	// filesystem does not support it
+	noDirSync atomic.Bool
 }
 
 // ensure statically that *Local implements backend.Backend.
@@ -37,6 +43,11 @@ func NewFactory() location.Factory {
 const defaultLayout = "default"
 
 func open(ctx context.Context, cfg Config) (*Local, error) {
+	d, err := parseDurability(cfg.Durability)
+	if err != nil {
+		return nil, err
+	}
+
 	l, err := layout.ParseLayout(ctx, &layout.LocalFilesystem{}, cfg.Layout, defaultLayout, cfg.Path)
 	if err != nil {
 		return nil, err
@@ -47,9 +58,10 @@ func open(ctx context.Context, cfg Config) (*Local, error) {
 	debug.Log("using (%03O file, %03O dir) permissions", m.File, m.Dir)
 
 	return &Local{
-		Config: cfg,
-		Layout: l,
-		Modes:  m,
+		Config:     cfg,
+		Layout:     l,
+		Modes:      m,
+		durability: d,
 	}, nil
 }
 
@@ -83,6 +95,16 @@ func Create(ctx context.Context, cfg Config) (*Local, error) {
 		}
 	}
 
+	if be.durability >= durabilityFileDir {
+		// commit the new directories, the subdirectories of data/ first
+		dirs := []string{filepath.Dir(be.Filename(backend.Handle{Type: backend.PackFile, Name: "00"})), be.Path, filepath.Dir(be.Path)}
+		for _, d := range dirs {
+			if err := be.syncDir(d); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+
 	return be, nil
 }
 
@@ -110,6 +132,12 @@ func (b *Local) IsNotExist(err error) bool {
 	return errors.Is(err, os.ErrNotExist)
 }
 
+// IsDeletionForbidden returns true if the file cannot be removed as the
+// permissions of the repository directory do not allow it.
+func (b *Local) IsDeletionForbidden(err error) bool {
+	return errors.Is(err, os.ErrPermission)
+}
+
 // Save stores data in the backend at the handle.
 func (b *Local) Save(_ context.Context, h backend.Handle, rd backend.RewindReader) (err error) {
 	finalname := b.Filename(h)
@@ -131,6 +159,10 @@ func (b *Local) Save(_ context.Context, h backend.Handle, rd backend.RewindReade
 
 		// error is caused by a missing directory, try to create it
 		mkdirErr := fs.MkdirAll(dir, b.Modes.Dir)
+		if mkdirErr == nil && b.durability >= durabilityFileDir {
+			// commit the new directory
+			mkdirErr = b.syncDir(filepath.Dir(dir))
+		}
 		if mkdirErr != nil {
 			debug.Log("error creating dir %v: %v", dir, mkdirErr)
 		} else {
@@ -172,10 +204,13 @@ func (b *Local) Save(_ context.Context, h backend.Handle, rd backend.RewindReade
 	}
 
 	// Ignore error if filesystem does not support fsync.
-	err = f.Sync()
-	syncNotSup := err != nil && (errors.Is(err, syscall.ENOTSUP) || isMacENOTTY(err))
-	if err != nil && !syncNotSup {
-		return errors.WithStack(err)
+	syncNotSup := b.durability == durabilityNone
+	if b.durability >= durabilityFile {
+		err = f.Sync()
+		syncNotSup = err != nil && (errors.Is(err, syscall.ENOTSUP) || isMacENOTTY(err))
+		if err != nil && !syncNotSup {
+			return errors.WithStack(err)
+		}
 	}
 
 	// Close, then rename. Windows doesn't like the reverse order.
@@ -188,7 +223,16 @@ func (b *Local) Save(_ context.Context, h backend.Handle, rd backend.RewindReade
 
 	// Now sync the directory to commit the Rename.
 	if !syncNotSup {
-		err = fsyncDir(dir)
+		err = b.syncDir(dir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	// index and snapshot files make the new data visible, also sync the
+	// repository root in the strictest mode
+	if b.durability >= durabilityFileDir && !syncNotSup && (h.Type == backend.IndexFile || h.Type == backend.SnapshotFile) {
+		err = b.syncDir(b.Path)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -40,3 +41,81 @@ func TestNoSpacePermanent(t *testing.T) {
 	rtest.Assert(t, errors.Is(err, syscall.ENOSPC),
 		"could not recover original ENOSPC error")
 }
+
+// recordDirSyncs replaces dirSync by a function which records the synced
+// directories and returns err.
+func recordDirSyncs(t *testing.T, err error) *[]string {
+	oldDirSync := dirSync
+	t.Cleanup(func() {
+		dirSync = oldDirSync
+	})
+
+	var dirs []string
+	dirSync = func(dir string) error {
+		dirs = append(dirs, dir)
+		return err
+	}
+	return &dirs
+}
+
+func saveFiles(t *testing.T, durability string, handles ...backend.Handle) *Local {
+	dir := rtest.TempDir(t)
+	be, err := Create(context.Background(), Config{Path: dir, Connections: 2, Durability: durability})
+	rtest.OK(t, err)
+	defer func() {
+		rtest.OK(t, be.Close())
+	}()
+
+	for _, h := range handles {
+		rtest.OK(t, be.Save(context.Background(), h, backend.NewByteReader([]byte(h.Name), nil)))
+	}
+	return be
+}
+
+func TestDurability(t *testing.T) {
+	pack := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	index := backend.Handle{Type: backend.IndexFile, Name: "0123456789abcdef"}
+
+	for _, test := range []struct {
+		durability string
+		syncs      int
+		rootSyncs  int
+	}{
+		{"none", 0, 0},
+		{"", 2, 0},
+		{"file", 2, 0},
+		// Create syncs three directories and the index file also syncs the
+		// repository root
+		{"file+dir", 3 + 2 + 1, 2},
+	} {
+		t.Run(test.durability, func(t *testing.T) {
+			dirs := recordDirSyncs(t, nil)
+			be := saveFiles(t, test.durability, pack, index)
+
+			rtest.Equals(t, test.syncs, len(*dirs))
+			rootSyncs := 0
+			for _, d := range *dirs {
+				if d == be.Path {
+					rootSyncs++
+				}
+			}
+			rtest.Equals(t, test.rootSyncs, rootSyncs)
+		})
+	}
+}
+
+func TestDurabilityInvalid(t *testing.T) {
+	_, err := Open(context.Background(), Config{Path: rtest.TempDir(t), Durability: "always"})
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "invalid durability"), "unexpected error %v", err)
+}
+
+func TestDirSyncNotSupported(t *testing.T) {
+	dirs := recordDirSyncs(t, fmt.Errorf("sync: %w", syscall.EINVAL))
+	pack := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	snapshot := backend.Handle{Type: backend.SnapshotFile, Name: "0123456789abcdef"}
+
+	be := saveFiles(t, "file+dir", pack, snapshot)
+	rtest.Assert(t, be.noDirSync.Load(), "directory syncs were not disabled")
+	// only the first failed sync was attempted
+	rtest.Equals(t, 1, len(*dirs))
+}
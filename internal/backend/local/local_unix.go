@@ -12,7 +12,8 @@ import (
 	"github.com/restic/restic/internal/fs"
 )
 
-// fsyncDir flushes changes to the directory dir.
+// fsyncDir flushes changes to the directory dir. Errors returned by
+// filesystems which do not support syncing directories are passed on.
 func fsyncDir(dir string) error {
 	d, err := os.Open(dir)
 	if err != nil {
@@ -20,9 +21,7 @@ func fsyncDir(dir string) error {
 	}
 
 	err = d.Sync()
-	if err != nil &&
-		(errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOENT) ||
-			errors.Is(err, syscall.EINVAL) || isMacENOTTY(err)) {
+	if err != nil && errors.Is(err, syscall.ENOENT) {
 		err = nil
 	}
 
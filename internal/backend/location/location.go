@@ -14,6 +14,13 @@ type Location struct {
 	Config interface{}
 }
 
+// NestedConfig is implemented by the configurations of backends which combine
+// other backends. The environment and the options are also applied to the
+// configurations of the returned locations.
+type NestedConfig interface {
+	Locations() []Location
+}
+
 // NoPassword returns the repository location unchanged (there's no sensitive information there)
 func NoPassword(s string) string {
 	return s
@@ -0,0 +1,94 @@
+package mirror
+
+import (
+	"strings"
+
+	"github.com/restic/restic/internal/backend/location"
+	"github.com/restic/restic/internal/errors"
+)
+
+// Config contains the locations of the two backends which are written to.
+type Config struct {
+	Primary   location.Location
+	Secondary location.Location
+}
+
+const prefix = "mirror:"
+
+// splitLocations splits s (without the prefix) into the locations of the two
+// backends. They are separated by a comma, which must be followed by the
+// scheme of a registered backend, so that local paths may contain commas.
+func splitLocations(registry *location.Registry, s string) (string, string, error) {
+	var candidates []int
+	for i := 0; i < len(s); i++ {
+		if s[i] != ',' {
+			continue
+		}
+		scheme, _, ok := strings.Cut(s[i+1:], ":")
+		if ok && registry.Lookup(scheme) != nil {
+			candidates = append(candidates, i)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", "", errors.New("invalid format, expected mirror:primary,secondary")
+	case 1:
+		i := candidates[0]
+		return s[:i], s[i+1:], nil
+	}
+	return "", "", errors.New("invalid format, more than two backends specified")
+}
+
+// ParseConfig parses a location of the form mirror:primary,secondary. Both
+// locations must name the backend explicitly, e.g.
+// mirror:local:/srv/repo,s3:s3.amazonaws.com/bucket.
+func ParseConfig(registry *location.Registry, s string) (*Config, error) {
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errors.Errorf("invalid format, prefix %q not found", strings.TrimSuffix(prefix, ":"))
+	}
+
+	primary, secondary, err := splitLocations(registry, s[len(prefix):])
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	for _, l := range []struct {
+		s   string
+		loc *location.Location
+	}{
+		{primary, &cfg.Primary},
+		{secondary, &cfg.Secondary},
+	} {
+		scheme, _, _ := strings.Cut(l.s, ":")
+		if scheme == "mirror" {
+			return nil, errors.New("mirror backends cannot be nested")
+		}
+		if registry.Lookup(scheme) == nil {
+			return nil, errors.Errorf("invalid backend %q, the backend must be specified explicitly, e.g. local:/srv/repo", l.s)
+		}
+
+		*l.loc, err = location.Parse(registry, l.s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "location %v", location.StripPassword(registry, l.s))
+		}
+	}
+
+	return cfg, nil
+}
+
+// Locations returns the locations of both backends, so that the environment
+// and the extended options are applied to their configurations.
+func (cfg *Config) Locations() []location.Location {
+	return []location.Location{cfg.Primary, cfg.Secondary}
+}
+
+// StripPassword removes the passwords from both locations in s.
+func StripPassword(registry *location.Registry, s string) string {
+	primary, secondary, err := splitLocations(registry, strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return s
+	}
+	return prefix + location.StripPassword(registry, primary) + "," + location.StripPassword(registry, secondary)
+}
@@ -0,0 +1,389 @@
+package mirror
+
+import (
+	"context"
+	"hash"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/limiter"
+	"github.com/restic/restic/internal/backend/location"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// Backend writes all files to two backends. Save only succeeds if the file
+// has been stored in both backends. Files are loaded from the primary
+// backend, the secondary backend is used if that fails. Differences between
+// the backends found by List and Stat are reported with warnf.
+type Backend struct {
+	primary, secondary backend.Backend
+	warnf              func(msg string, args ...interface{})
+}
+
+// statically ensure that Backend implements backend.Backend.
+var _ backend.Backend = &Backend{}
+
+// New returns a backend which mirrors all files written to primary to
+// secondary. Warnings about differences between the backends are passed to
+// warnf.
+func New(primary, secondary backend.Backend, warnf func(msg string, args ...interface{})) *Backend {
+	return &Backend{
+		primary:   primary,
+		secondary: secondary,
+		warnf:     warnf,
+	}
+}
+
+type factory struct {
+	registry *location.Registry
+	warnf    func(msg string, args ...interface{})
+}
+
+// NewFactory returns a factory for mirror backends. The two backends are
+// looked up in registry, warnings are passed to warnf.
+func NewFactory(registry *location.Registry, warnf func(msg string, args ...interface{})) location.Factory {
+	return &factory{registry: registry, warnf: warnf}
+}
+
+func (f *factory) Scheme() string {
+	return "mirror"
+}
+
+func (f *factory) ParseConfig(s string) (interface{}, error) {
+	return ParseConfig(f.registry, s)
+}
+
+func (f *factory) StripPassword(s string) string {
+	return StripPassword(f.registry, s)
+}
+
+func (f *factory) Create(ctx context.Context, cfg interface{}, rt http.RoundTripper, lim limiter.Limiter) (backend.Backend, error) {
+	return f.open(cfg.(*Config), func(factory location.Factory, loc location.Location) (backend.Backend, error) {
+		return factory.Create(ctx, loc.Config, rt, lim)
+	})
+}
+
+func (f *factory) Open(ctx context.Context, cfg interface{}, rt http.RoundTripper, lim limiter.Limiter) (backend.Backend, error) {
+	return f.open(cfg.(*Config), func(factory location.Factory, loc location.Location) (backend.Backend, error) {
+		return factory.Open(ctx, loc.Config, rt, lim)
+	})
+}
+
+func (f *factory) open(cfg *Config, openFn func(location.Factory, location.Location) (backend.Backend, error)) (backend.Backend, error) {
+	var backends []backend.Backend
+	for _, loc := range cfg.Locations() {
+		factory := f.registry.Lookup(loc.Scheme)
+		if factory == nil {
+			return nil, errors.Fatalf("invalid backend: %q", loc.Scheme)
+		}
+
+		be, err := openFn(factory, loc)
+		if err != nil {
+			for _, be := range backends {
+				_ = be.Close()
+			}
+			return nil, err
+		}
+		backends = append(backends, be)
+	}
+
+	return New(backends[0], backends[1], f.warnf), nil
+}
+
+func (be *Backend) backends() []backend.Backend {
+	return []backend.Backend{be.primary, be.secondary}
+}
+
+// Location returns the locations of both backends.
+func (be *Backend) Location() string {
+	return prefix + be.primary.Location() + "," + be.secondary.Location()
+}
+
+// Connections returns the smaller number of connections of both backends, as
+// each operation uses both of them.
+func (be *Backend) Connections() uint {
+	if be.secondary.Connections() < be.primary.Connections() {
+		return be.secondary.Connections()
+	}
+	return be.primary.Connections()
+}
+
+// Hasher returns the hash function of the primary backend. The content hash
+// for the secondary backend is computed separately if it uses a different
+// hash function.
+func (be *Backend) Hasher() hash.Hash {
+	return be.primary.Hasher()
+}
+
+// HasAtomicReplace returns whether both backends can atomically replace
+// files.
+func (be *Backend) HasAtomicReplace() bool {
+	return be.primary.HasAtomicReplace() && be.secondary.HasAtomicReplace()
+}
+
+// IsNotExist returns true if the error was caused by a file which does not
+// exist in one of the backends.
+func (be *Backend) IsNotExist(err error) bool {
+	return be.primary.IsNotExist(err) || be.secondary.IsNotExist(err)
+}
+
+// IsPermanentError returns true if one of the backends classifies the error
+// as permanent.
+func (be *Backend) IsPermanentError(err error) bool {
+	for _, b := range []backend.Backend{be.primary, be.secondary} {
+		if c := backend.AsBackend[backend.PermanentErrorClassifier](b); c != nil && c.IsPermanentError(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDeletionForbidden returns true if one of the backends does not allow
+// removing the file.
+func (be *Backend) IsDeletionForbidden(err error) bool {
+	for _, b := range []backend.Backend{be.primary, be.secondary} {
+		if c := backend.AsBackend[backend.DeletionClassifier](b); c != nil && c.IsDeletionForbidden(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsThrottled returns true if one of the backends classifies the error as
+// caused by throttled requests.
+func (be *Backend) IsThrottled(err error) bool {
+	for _, b := range []backend.Backend{be.primary, be.secondary} {
+		if c := backend.AsBackend[backend.ThrottleClassifier](b); c != nil && c.IsThrottled(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashedReader replaces the content hash of a RewindReader.
+type hashedReader struct {
+	backend.RewindReader
+	hash []byte
+}
+
+func (rd *hashedReader) Hash() []byte {
+	return rd.hash
+}
+
+// readerFor returns a reader with the content hash expected by target.
+func (be *Backend) readerFor(target backend.Backend, rd backend.RewindReader) (backend.RewindReader, error) {
+	h := target.Hasher()
+	if h == nil {
+		return rd, nil
+	}
+	if primary := be.primary.Hasher(); primary != nil && reflect.TypeOf(primary) == reflect.TypeOf(h) {
+		return rd, nil
+	}
+
+	if _, err := io.Copy(h, rd); err != nil {
+		return nil, err
+	}
+	if err := rd.Rewind(); err != nil {
+		return nil, err
+	}
+	return &hashedReader{RewindReader: rd, hash: h.Sum(nil)}, nil
+}
+
+// Save stores the file in the primary and then in the secondary backend. If
+// the file cannot be stored in the secondary backend, it is removed from the
+// primary backend again, so that Save can be retried.
+func (be *Backend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	if err := be.primary.Save(ctx, h, rd); err != nil {
+		return err
+	}
+
+	err := rd.Rewind()
+	var srd backend.RewindReader
+	if err == nil {
+		srd, err = be.readerFor(be.secondary, rd)
+	}
+	if err == nil {
+		err = be.secondary.Save(ctx, h, srd)
+	}
+	if err == nil {
+		return nil
+	}
+
+	debug.Log("saving %v in %v failed, removing it from %v: %v", h, be.secondary.Location(), be.primary.Location(), err)
+	removeCtx := ctx
+	if ctx.Err() != nil {
+		// the file must be removed even if the operation was canceled
+		removeCtx = context.Background()
+	}
+	if rerr := be.primary.Remove(removeCtx, h); rerr != nil {
+		be.warnf("unable to remove %v from %v after saving it in %v failed: %v\n", h, be.primary.Location(), be.secondary.Location(), rerr)
+	}
+	return err
+}
+
+// Remove removes the file from both backends. Files which only exist in one
+// of the backends are removed without error.
+func (be *Backend) Remove(ctx context.Context, h backend.Handle) error {
+	var errs []error
+	notExist := 0
+	for _, b := range be.backends() {
+		err := b.Remove(ctx, h)
+		switch {
+		case err == nil:
+		case b.IsNotExist(err):
+			notExist++
+			errs = append(errs, err)
+		default:
+			return err
+		}
+	}
+
+	if notExist == 2 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Load runs fn with the content of the file from the primary backend. If
+// that fails, the file is loaded from the secondary backend. Errors returned
+// by fn are passed on without trying the secondary backend.
+func (be *Backend) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	var fnErr error
+	err := be.primary.Load(ctx, h, length, offset, func(rd io.Reader) error {
+		fnErr = fn(rd)
+		return fnErr
+	})
+	if err == nil || ctx.Err() != nil || (fnErr != nil && errors.Is(err, fnErr)) {
+		return err
+	}
+
+	serr := be.secondary.Load(ctx, h, length, offset, fn)
+	switch {
+	case serr == nil:
+		be.warnf("loading %v from %v failed, loaded it from %v: %v\n", h, be.primary.Location(), be.secondary.Location(), err)
+		return nil
+	case be.primary.IsNotExist(err):
+		return serr
+	case be.secondary.IsNotExist(serr):
+		return err
+	}
+	return errors.Errorf("%v, loading from %v failed as well: %v", err, be.secondary.Location(), serr)
+}
+
+// Stat returns information about the file from the primary backend. If the
+// file is missing or has a different size in one of the backends, a warning
+// is printed.
+func (be *Backend) Stat(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+	fi, err := be.primary.Stat(ctx, h)
+	sfi, serr := be.secondary.Stat(ctx, h)
+
+	switch {
+	case err == nil && serr == nil:
+		if fi.Size != sfi.Size {
+			be.warnf("%v has size %d in %v, but size %d in %v\n", h, fi.Size, be.primary.Location(), sfi.Size, be.secondary.Location())
+		}
+		return fi, nil
+	case err == nil:
+		be.warnf("stat %v in %v failed: %v\n", h, be.secondary.Location(), serr)
+		return fi, nil
+	case serr == nil:
+		be.warnf("stat %v in %v failed: %v\n", h, be.primary.Location(), err)
+		return sfi, nil
+	case be.primary.IsNotExist(err):
+		return backend.FileInfo{}, serr
+	}
+	return backend.FileInfo{}, err
+}
+
+// List runs fn for each file which exists in at least one of the backends.
+// Files which are missing in one of the backends or whose sizes differ are
+// reported, except for lock files which are created and removed in both
+// backends all the time. The size reported by the primary backend is used.
+// If listing one of the backends fails, the files of the other backend are
+// returned with a warning.
+func (be *Backend) List(ctx context.Context, t backend.FileType, fn func(backend.FileInfo) error) error {
+	warn := t != backend.LockFile
+
+	secondary := make(map[string]int64)
+	serr := be.secondary.List(ctx, t, func(fi backend.FileInfo) error {
+		secondary[fi.Name] = fi.Size
+		return nil
+	})
+	if serr != nil {
+		if ctx.Err() != nil {
+			return serr
+		}
+		be.warnf("listing %v files in %v failed: %v\n", t, be.secondary.Location(), serr)
+		secondary = nil
+	}
+
+	seen := make(map[string]struct{})
+	var fnErr error
+	err := be.primary.List(ctx, t, func(fi backend.FileInfo) error {
+		seen[fi.Name] = struct{}{}
+		if secondary != nil {
+			size, ok := secondary[fi.Name]
+			switch {
+			case !ok && warn:
+				be.warnf("%v file %v is missing in %v\n", t, fi.Name, be.secondary.Location())
+			case ok && size != fi.Size:
+				be.warnf("%v file %v has size %d in %v, but size %d in %v\n", t, fi.Name, fi.Size, be.primary.Location(), size, be.secondary.Location())
+			}
+		}
+
+		fnErr = fn(fi)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		if secondary == nil || ctx.Err() != nil {
+			return err
+		}
+		be.warnf("listing %v files in %v failed: %v\n", t, be.primary.Location(), err)
+	}
+
+	// files which only exist in the secondary backend
+	names := make([]string, 0, len(secondary))
+	for name := range secondary {
+		if _, ok := seen[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err == nil && warn {
+			be.warnf("%v file %v is missing in %v\n", t, name, be.primary.Location())
+		}
+		if err := fn(backend.FileInfo{Name: name, Size: secondary[name]}); err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
+
+// Delete removes all data in both backends.
+func (be *Backend) Delete(ctx context.Context) error {
+	for _, b := range be.backends() {
+		if err := b.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes both backends.
+func (be *Backend) Close() error {
+	err := be.primary.Close()
+	if serr := be.secondary.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,400 @@
+package mirror_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/local"
+	"github.com/restic/restic/internal/backend/location"
+	"github.com/restic/restic/internal/backend/mem"
+	"github.com/restic/restic/internal/backend/mirror"
+	"github.com/restic/restic/internal/backend/mock"
+	"github.com/restic/restic/internal/backend/test"
+	"github.com/restic/restic/internal/checker"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func newTestSuite(t testing.TB) *test.Suite[mirror.Config] {
+	registry := location.NewRegistry()
+	registry.Register(local.NewFactory())
+
+	return &test.Suite[mirror.Config]{
+		// NewConfig returns a config for a new temporary backend that will be used in tests.
+		NewConfig: func() (*mirror.Config, error) {
+			primary, secondary := rtest.TempDir(t), rtest.TempDir(t)
+			t.Logf("create new backend at %v and %v", primary, secondary)
+
+			return mirror.ParseConfig(registry, "mirror:local:"+primary+",local:"+secondary)
+		},
+
+		Factory: mirror.NewFactory(registry, t.Logf),
+	}
+}
+
+func TestBackend(t *testing.T) {
+	newTestSuite(t).RunTests(t)
+}
+
+// warnings collects the warnings of a mirror backend.
+type warnings struct {
+	m    sync.Mutex
+	msgs []string
+}
+
+func (w *warnings) warnf(msg string, args ...interface{}) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.msgs = append(w.msgs, fmt.Sprintf(msg, args...))
+}
+
+func (w *warnings) count(substr string) int {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	n := 0
+	for _, msg := range w.msgs {
+		if strings.Contains(msg, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func newMemBackend(name string) backend.Backend {
+	be := mem.New()
+	m := mock.NewBackend()
+	m.SaveFn = be.Save
+	m.OpenReaderFn = func(ctx context.Context, h backend.Handle, length int, offset int64) (io.ReadCloser, error) {
+		var rd io.ReadCloser
+		err := be.Load(ctx, h, length, offset, func(r io.Reader) error {
+			buf, err := io.ReadAll(r)
+			rd = io.NopCloser(bytes.NewReader(buf))
+			return err
+		})
+		return rd, err
+	}
+	m.StatFn = be.Stat
+	m.ListFn = be.List
+	m.RemoveFn = be.Remove
+	m.DeleteFn = be.Delete
+	m.IsNotExistFn = be.IsNotExist
+	m.HasherFn = be.Hasher
+	m.LocationFn = func() string { return name }
+	return m
+}
+
+func save(t testing.TB, be backend.Backend, h backend.Handle, data []byte) error {
+	t.Helper()
+	return be.Save(context.TODO(), h, backend.NewByteReader(data, be.Hasher()))
+}
+
+func exists(t testing.TB, be backend.Backend, h backend.Handle) bool {
+	t.Helper()
+	_, err := be.Stat(context.TODO(), h)
+	if err != nil && !be.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestSaveSecondaryFails(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+	saveErr := errors.New("secondary failed")
+	secondary.(*mock.Backend).SaveFn = func(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+		return saveErr
+	}
+
+	var w warnings
+	be := mirror.New(primary, secondary, w.warnf)
+
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	err := save(t, be, h, []byte("foobar"))
+	if !errors.Is(err, saveErr) {
+		t.Fatalf("unexpected error, want %v, got %v", saveErr, err)
+	}
+
+	if exists(t, primary, h) {
+		t.Fatalf("file was not removed from the primary backend")
+	}
+	rtest.Equals(t, 0, len(w.msgs))
+}
+
+func TestSaveSecondaryCanceled(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	secondary.(*mock.Backend).SaveFn = func(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+		cancel()
+		return ctx.Err()
+	}
+
+	var w warnings
+	be := mirror.New(primary, secondary, w.warnf)
+
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	err := be.Save(ctx, h, backend.NewByteReader([]byte("foobar"), be.Hasher()))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if exists(t, primary, h) {
+		t.Fatalf("file was not removed from the primary backend")
+	}
+}
+
+func TestSavePrimaryFails(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+	saveErr := errors.New("primary failed")
+	primary.(*mock.Backend).SaveFn = func(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+		return saveErr
+	}
+
+	be := mirror.New(primary, secondary, t.Logf)
+
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	err := save(t, be, h, []byte("foobar"))
+	if !errors.Is(err, saveErr) {
+		t.Fatalf("unexpected error, want %v, got %v", saveErr, err)
+	}
+
+	if exists(t, secondary, h) {
+		t.Fatalf("file was saved in the secondary backend")
+	}
+}
+
+func TestSaveRemoveFails(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+	secondary.(*mock.Backend).SaveFn = func(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+		return errors.New("secondary failed")
+	}
+	primary.(*mock.Backend).RemoveFn = func(ctx context.Context, h backend.Handle) error {
+		return errors.New("remove failed")
+	}
+
+	var w warnings
+	be := mirror.New(primary, secondary, w.warnf)
+
+	err := save(t, be, backend.Handle{Type: backend.PackFile, Name: "foo"}, []byte("foobar"))
+	if err == nil {
+		t.Fatal("Save did not return an error")
+	}
+	rtest.Equals(t, 1, w.count("remove failed"))
+}
+
+func TestSaveDifferentHasher(t *testing.T) {
+	// the local backend has no hash function, the memory backend verifies the content hash
+	lbe, err := local.Create(context.TODO(), local.Config{Path: rtest.TempDir(t), Connections: 2})
+	rtest.OK(t, err)
+	secondary := mem.New()
+
+	be := mirror.New(lbe, secondary, t.Logf)
+	defer func() {
+		rtest.OK(t, be.Close())
+	}()
+
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	rtest.OK(t, save(t, be, h, []byte("foobar")))
+
+	buf, err := backend.LoadAll(context.TODO(), nil, secondary, h)
+	rtest.OK(t, err)
+	rtest.Equals(t, []byte("foobar"), buf)
+}
+
+func TestLoadFallback(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+
+	var w warnings
+	be := mirror.New(primary, secondary, w.warnf)
+
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	rtest.OK(t, save(t, be, h, []byte("foobar")))
+
+	// the file is loaded from the primary backend
+	buf, err := backend.LoadAll(context.TODO(), nil, be, h)
+	rtest.OK(t, err)
+	rtest.Equals(t, []byte("foobar"), buf)
+	rtest.Equals(t, 0, len(w.msgs))
+
+	// and from the secondary if it is missing
+	rtest.OK(t, primary.Remove(context.TODO(), h))
+	buf, err = backend.LoadAll(context.TODO(), nil, be, h)
+	rtest.OK(t, err)
+	rtest.Equals(t, []byte("foobar"), buf)
+	rtest.Equals(t, 1, w.count("loaded it from secondary"))
+
+	// files missing in both backends are reported as not existing
+	rtest.OK(t, secondary.Remove(context.TODO(), h))
+	_, err = backend.LoadAll(context.TODO(), nil, be, h)
+	if !be.IsNotExist(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+
+	var w warnings
+	be := mirror.New(primary, secondary, w.warnf)
+
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	rtest.OK(t, save(t, secondary, h, []byte("foobar")))
+
+	fi, err := be.Stat(context.TODO(), h)
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(6), fi.Size)
+	rtest.Equals(t, 1, w.count("stat <data/foo> in primary failed"))
+
+	rtest.OK(t, save(t, primary, h, []byte("foo")))
+	fi, err = be.Stat(context.TODO(), h)
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(3), fi.Size)
+	rtest.Equals(t, 1, w.count("has size 3 in primary, but size 6 in secondary"))
+}
+
+func TestList(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+
+	var w warnings
+	be := mirror.New(primary, secondary, w.warnf)
+
+	for _, name := range []string{"both", "size"} {
+		rtest.OK(t, save(t, be, backend.Handle{Type: backend.PackFile, Name: name}, []byte("foobar")))
+	}
+	rtest.OK(t, save(t, primary, backend.Handle{Type: backend.PackFile, Name: "primary"}, []byte("foo")))
+	rtest.OK(t, save(t, secondary, backend.Handle{Type: backend.PackFile, Name: "secondary"}, []byte("foo")))
+	h := backend.Handle{Type: backend.PackFile, Name: "size"}
+	rtest.OK(t, secondary.Remove(context.TODO(), h))
+	rtest.OK(t, save(t, secondary, h, []byte("foo")))
+
+	files := make(map[string]int64)
+	rtest.OK(t, be.List(context.TODO(), backend.PackFile, func(fi backend.FileInfo) error {
+		if _, ok := files[fi.Name]; ok {
+			t.Errorf("file %v listed twice", fi.Name)
+		}
+		files[fi.Name] = fi.Size
+		return nil
+	}))
+
+	rtest.Equals(t, map[string]int64{"both": 6, "size": 6, "primary": 3, "secondary": 3}, files)
+	rtest.Equals(t, 1, w.count("data file primary is missing in secondary"))
+	rtest.Equals(t, 1, w.count("data file secondary is missing in primary"))
+	rtest.Equals(t, 1, w.count("data file size has size 6 in primary, but size 3 in secondary"))
+	rtest.Equals(t, 3, len(w.msgs))
+}
+
+func TestListFails(t *testing.T) {
+	for _, failPrimary := range []bool{true, false} {
+		t.Run(fmt.Sprintf("primary-%v", failPrimary), func(t *testing.T) {
+			primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+
+			var w warnings
+			be := mirror.New(primary, secondary, w.warnf)
+			for _, name := range []string{"foo", "bar"} {
+				rtest.OK(t, save(t, be, backend.Handle{Type: backend.PackFile, Name: name}, []byte("foobar")))
+			}
+
+			failing := secondary.(*mock.Backend)
+			if failPrimary {
+				failing = primary.(*mock.Backend)
+			}
+			failing.ListFn = func(ctx context.Context, t backend.FileType, fn func(backend.FileInfo) error) error {
+				return errors.New("list failed")
+			}
+
+			var names []string
+			rtest.OK(t, be.List(context.TODO(), backend.PackFile, func(fi backend.FileInfo) error {
+				names = append(names, fi.Name)
+				return nil
+			}))
+			rtest.Equals(t, 2, len(names))
+			rtest.Equals(t, 1, w.count("list failed"))
+			rtest.Equals(t, 1, len(w.msgs))
+
+			// listing fails if neither backend is available
+			primary.(*mock.Backend).ListFn = failing.ListFn
+			secondary.(*mock.Backend).ListFn = failing.ListFn
+			err := be.List(context.TODO(), backend.PackFile, func(fi backend.FileInfo) error {
+				return nil
+			})
+			if err == nil {
+				t.Fatal("List did not return an error")
+			}
+		})
+	}
+}
+
+func TestListLockFiles(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+
+	var w warnings
+	be := mirror.New(primary, secondary, w.warnf)
+	rtest.OK(t, save(t, primary, backend.Handle{Type: backend.LockFile, Name: "foo"}, []byte("foo")))
+
+	rtest.OK(t, be.List(context.TODO(), backend.LockFile, func(fi backend.FileInfo) error {
+		return nil
+	}))
+	rtest.Equals(t, 0, len(w.msgs))
+}
+
+func TestRemove(t *testing.T) {
+	primary, secondary := newMemBackend("primary"), newMemBackend("secondary")
+	be := mirror.New(primary, secondary, t.Logf)
+
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	rtest.OK(t, save(t, primary, h, []byte("foobar")))
+	rtest.OK(t, be.Remove(context.TODO(), h))
+	rtest.Assert(t, !exists(t, primary, h), "file was not removed")
+
+	err := be.Remove(context.TODO(), h)
+	if !be.IsNotExist(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestCheckRepository(t *testing.T) {
+	primary, secondary := filepath.Join(rtest.TempDir(t), "primary"), filepath.Join(rtest.TempDir(t), "secondary")
+	registry := location.NewRegistry()
+	registry.Register(local.NewFactory())
+
+	cfg, err := mirror.ParseConfig(registry, "mirror:local:"+primary+",local:"+secondary)
+	rtest.OK(t, err)
+
+	var w warnings
+	be, err := mirror.NewFactory(registry, w.warnf).Create(context.TODO(), cfg, nil, nil)
+	rtest.OK(t, err)
+	defer func() {
+		rtest.OK(t, be.Close())
+	}()
+
+	repo := repository.TestRepositoryWithBackend(t, be, 0)
+	restic.TestCreateSnapshot(t, repo, time.Unix(1460289341, 207401672), 2)
+	checker.TestCheckRepo(t, repo)
+
+	// remove a different pack file from each backend
+	var packs []string
+	rtest.OK(t, be.List(context.TODO(), backend.PackFile, func(fi backend.FileInfo) error {
+		packs = append(packs, fi.Name)
+		return nil
+	}))
+	rtest.Assert(t, len(packs) >= 2, "expected at least two pack files, got %v", len(packs))
+	for i, dir := range []string{primary, secondary} {
+		rtest.OK(t, os.Remove(filepath.Join(dir, "data", packs[i][:2], packs[i])))
+	}
+
+	checker.TestCheckRepo(t, repo)
+	rtest.Assert(t, w.count("is missing in") >= 2, "missing files were not reported: %v", w.msgs)
+	rtest.Assert(t, w.count("loaded it from") >= 1, "fallback was not used: %v", w.msgs)
+}
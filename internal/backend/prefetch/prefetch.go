@@ -0,0 +1,276 @@
+// Package prefetch loads file ranges ahead of their use according to an
+// access plan. This hides the latency of the backend when the ranges are
+// processed one after another.
+package prefetch
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// LoadFn loads a range of a file, it has the same signature as
+// backend.Backend.Load.
+type LoadFn func(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error
+
+// Request is a range of a file which is going to be loaded. A length of zero
+// means the whole file starting at offset.
+type Request struct {
+	Handle backend.Handle
+	Length int
+	Offset int64
+}
+
+// Options control how far the prefetcher loads ahead.
+type Options struct {
+	// Depth is the maximum number of requests which are loaded ahead of
+	// their use, zero disables prefetching.
+	Depth int
+	// MaxBytes limits the amount of buffered data, zero means unlimited.
+	// Requests which are larger than the limit are not prefetched.
+	MaxBytes int64
+}
+
+type entry struct {
+	done chan struct{}
+	buf  []byte
+	err  error
+}
+
+// Prefetcher loads the requests of the plan in order, while at most
+// Options.Depth requests are loaded and not yet used. Loads which do not
+// match a prefetched request are passed to the underlying load function.
+type Prefetcher struct {
+	load LoadFn
+	opts Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	m    sync.Mutex
+	cond *sync.Cond
+	// queue contains the requests of the plan which have not been started
+	queue   []Request
+	queued  map[Request]int
+	skip    map[Request]int
+	entries map[Request]*entry
+	// count and bytes track the requests which are loaded, but not yet used
+	count  int
+	bytes  int64
+	closed bool
+
+	hits, misses int
+}
+
+// New returns a Prefetcher for load. The prefetches are aborted when ctx is
+// cancelled or Close is called.
+func New(ctx context.Context, load LoadFn, opts Options) *Prefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Prefetcher{
+		load:    load,
+		opts:    opts,
+		ctx:     ctx,
+		cancel:  cancel,
+		queued:  make(map[Request]int),
+		skip:    make(map[Request]int),
+		entries: make(map[Request]*entry),
+	}
+	p.cond = sync.NewCond(&p.m)
+
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		<-ctx.Done()
+		p.m.Lock()
+		p.closed = true
+		p.cond.Broadcast()
+		p.m.Unlock()
+	}()
+	go func() {
+		defer p.wg.Done()
+		p.schedule()
+	}()
+	return p
+}
+
+// Plan appends requests to the access plan.
+func (p *Prefetcher) Plan(reqs ...Request) {
+	if p.opts.Depth <= 0 {
+		return
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		return
+	}
+	for _, req := range reqs {
+		p.queue = append(p.queue, req)
+		p.queued[req]++
+	}
+	p.cond.Broadcast()
+}
+
+// ready returns true if the next request can be started. The caller must hold
+// the lock.
+func (p *Prefetcher) ready() bool {
+	if len(p.queue) == 0 || p.count >= p.opts.Depth {
+		return false
+	}
+	length := int64(p.queue[0].Length)
+	if p.opts.MaxBytes == 0 || length > p.opts.MaxBytes {
+		// oversized requests are dropped by schedule
+		return true
+	}
+	return p.bytes+length <= p.opts.MaxBytes
+}
+
+// schedule starts the requests of the plan as long as the limits permit.
+func (p *Prefetcher) schedule() {
+	for {
+		p.m.Lock()
+		for !p.closed && !p.ready() {
+			p.cond.Wait()
+		}
+		if p.closed || p.ctx.Err() != nil {
+			p.m.Unlock()
+			return
+		}
+
+		req := p.queue[0]
+		p.queue = p.queue[1:]
+		p.queued[req]--
+		if p.queued[req] == 0 {
+			delete(p.queued, req)
+		}
+
+		_, exists := p.entries[req]
+		switch {
+		case p.skip[req] > 0:
+			// already loaded directly
+			p.skip[req]--
+			if p.skip[req] == 0 {
+				delete(p.skip, req)
+			}
+		case exists:
+			debug.Log("duplicate request %v, not prefetched", req)
+		case p.opts.MaxBytes > 0 && int64(req.Length) > p.opts.MaxBytes:
+			debug.Log("request %v exceeds the memory limit, not prefetched", req)
+		default:
+			e := &entry{done: make(chan struct{})}
+			p.entries[req] = e
+			p.count++
+			p.bytes += int64(req.Length)
+
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.fetch(req, e)
+			}()
+		}
+		p.m.Unlock()
+	}
+}
+
+func (p *Prefetcher) fetch(req Request, e *entry) {
+	debug.Log("prefetching %v", req)
+	e.err = p.load(p.ctx, req.Handle, req.Length, req.Offset, func(rd io.Reader) error {
+		if req.Length == 0 {
+			buf, err := io.ReadAll(rd)
+			e.buf = buf
+			return err
+		}
+
+		if cap(e.buf) < req.Length {
+			e.buf = make([]byte, req.Length)
+		}
+		e.buf = e.buf[:req.Length]
+		_, err := io.ReadFull(rd, e.buf)
+		return err
+	})
+	if e.err != nil {
+		e.buf = nil
+	}
+	close(e.done)
+}
+
+// release frees the budget used by a request.
+func (p *Prefetcher) release(req Request) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.count--
+	p.bytes -= int64(req.Length)
+	p.cond.Broadcast()
+}
+
+// Load calls fn with the data of the requested range. If the range has been
+// prefetched, the buffered data is used, otherwise it is loaded directly.
+func (p *Prefetcher) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	req := Request{Handle: h, Length: length, Offset: offset}
+
+	p.m.Lock()
+	e, ok := p.entries[req]
+	if ok {
+		delete(p.entries, req)
+		p.hits++
+	} else {
+		p.misses++
+		if p.queued[req] > p.skip[req] {
+			// the scheduler has not reached the request yet
+			p.skip[req]++
+		}
+	}
+	p.m.Unlock()
+
+	if !ok {
+		debug.Log("%v was not prefetched, loading directly", req)
+		return p.load(ctx, h, length, offset, fn)
+	}
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		p.release(req)
+		return ctx.Err()
+	}
+
+	if e.err != nil {
+		p.release(req)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		debug.Log("prefetching %v failed, loading directly: %v", req, e.err)
+		return p.load(ctx, h, length, offset, fn)
+	}
+
+	err := fn(bytes.NewReader(e.buf))
+	// the buffer is no longer used
+	p.release(req)
+	var perr *backoff.PermanentError
+	if err != nil && ctx.Err() == nil && !errors.As(err, &perr) {
+		// the download may have been damaged, load it again like the retry
+		// backend would do
+		debug.Log("processing prefetched %v failed, loading directly: %v", req, err)
+		return p.load(ctx, h, length, offset, fn)
+	}
+	return err
+}
+
+// Close aborts all prefetches and waits until they have returned.
+func (p *Prefetcher) Close() {
+	p.cancel()
+	p.wg.Wait()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	debug.Log("prefetcher closed, %d hits, %d misses", p.hits, p.misses)
+	p.entries = make(map[Request]*entry)
+	p.queue = nil
+}
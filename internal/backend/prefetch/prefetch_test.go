@@ -0,0 +1,283 @@
+package prefetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/errors"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+// testLoader serves ranges of in-memory files after a delay.
+type testLoader struct {
+	files   map[string][]byte
+	latency time.Duration
+	// block lets all loads wait until the context is cancelled
+	block bool
+
+	loads    int32
+	inFlight int32
+}
+
+func newTestLoader(n int, size int) *testLoader {
+	l := &testLoader{files: make(map[string][]byte)}
+	for i := 0; i < n; i++ {
+		l.files[fmt.Sprintf("file%d", i)] = rtest.Random(i, size)
+	}
+	return l
+}
+
+func (l *testLoader) load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	atomic.AddInt32(&l.loads, 1)
+	atomic.AddInt32(&l.inFlight, 1)
+	defer atomic.AddInt32(&l.inFlight, -1)
+
+	if l.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	select {
+	case <-time.After(l.latency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	data, ok := l.files[h.Name]
+	if !ok {
+		return errors.Errorf("file %v not found", h.Name)
+	}
+	data = data[offset:]
+	if length > 0 {
+		data = data[:length]
+	}
+	return fn(bytes.NewReader(data))
+}
+
+func testRequest(i int, length int, offset int64) Request {
+	return Request{
+		Handle: backend.Handle{Type: backend.PackFile, Name: fmt.Sprintf("file%d", i)},
+		Length: length,
+		Offset: offset,
+	}
+}
+
+// waitPrefetched waits until the prefetch of req has started.
+func waitPrefetched(p *Prefetcher, req Request) {
+	for {
+		p.m.Lock()
+		_, ok := p.entries[req]
+		p.m.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func loadAndCheck(t testing.TB, p *Prefetcher, l *testLoader, req Request) {
+	var buf []byte
+	err := p.Load(context.TODO(), req.Handle, req.Length, req.Offset, func(rd io.Reader) (err error) {
+		buf, err = io.ReadAll(rd)
+		return err
+	})
+	rtest.OK(t, err)
+
+	want := l.files[req.Handle.Name][req.Offset:]
+	if req.Length > 0 {
+		want = want[:req.Length]
+	}
+	rtest.Equals(t, want, buf)
+}
+
+func TestPrefetch(t *testing.T) {
+	l := newTestLoader(10, 1000)
+	p := New(context.TODO(), l.load, Options{Depth: 3})
+	defer p.Close()
+
+	var reqs []Request
+	for i := 0; i < 10; i++ {
+		reqs = append(reqs, testRequest(i, 100, int64(i)))
+	}
+	// the whole file
+	reqs = append(reqs, testRequest(0, 0, 0))
+	p.Plan(reqs...)
+
+	for _, req := range reqs {
+		waitPrefetched(p, req)
+		loadAndCheck(t, p, l, req)
+	}
+	rtest.Equals(t, len(reqs), p.hits)
+	rtest.Equals(t, int32(len(reqs)), atomic.LoadInt32(&l.loads))
+}
+
+func TestPrefetchOutOfOrder(t *testing.T) {
+	l := newTestLoader(10, 1000)
+	p := New(context.TODO(), l.load, Options{Depth: 2})
+	defer p.Close()
+
+	var reqs []Request
+	for i := 0; i < 10; i++ {
+		reqs = append(reqs, testRequest(i, 100, 0))
+	}
+	p.Plan(reqs...)
+
+	// use the requests in reverse order and add an unplanned one
+	for i := len(reqs) - 1; i >= 0; i-- {
+		loadAndCheck(t, p, l, reqs[i])
+	}
+	loadAndCheck(t, p, l, testRequest(3, 10, 20))
+
+	// requests which were loaded directly are not prefetched afterwards
+	rtest.Assert(t, atomic.LoadInt32(&l.loads) <= int32(len(reqs)+1+2), "too many loads: %v", l.loads)
+	rtest.Equals(t, len(reqs)+1, p.hits+p.misses)
+}
+
+func TestPrefetchLimits(t *testing.T) {
+	l := newTestLoader(20, 1000)
+	p := New(context.TODO(), l.load, Options{Depth: 10, MaxBytes: 350})
+	defer p.Close()
+
+	var reqs []Request
+	for i := 0; i < 20; i++ {
+		reqs = append(reqs, testRequest(i, 100, 0))
+	}
+	// too large to be prefetched
+	reqs = append(reqs, testRequest(0, 500, 0))
+	p.Plan(reqs...)
+
+	for i, req := range reqs {
+		if i < 20 {
+			waitPrefetched(p, req)
+		}
+		p.m.Lock()
+		rtest.Assert(t, p.bytes <= 350, "%v bytes buffered", p.bytes)
+		rtest.Assert(t, p.count <= 3, "%v requests buffered", p.count)
+		p.m.Unlock()
+
+		loadAndCheck(t, p, l, req)
+	}
+	rtest.Equals(t, 20, p.hits)
+	rtest.Equals(t, 1, p.misses)
+}
+
+func TestPrefetchCancel(t *testing.T) {
+	l := newTestLoader(10, 1000)
+	l.block = true
+	ctx, cancel := context.WithCancel(context.Background())
+	p := New(ctx, l.load, Options{Depth: 4})
+
+	var reqs []Request
+	for i := 0; i < 10; i++ {
+		reqs = append(reqs, testRequest(i, 100, 0))
+	}
+	p.Plan(reqs...)
+
+	// wait until the prefetches have started
+	for atomic.LoadInt32(&l.inFlight) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := p.Load(ctx, reqs[0].Handle, reqs[0].Length, reqs[0].Offset, func(rd io.Reader) error {
+			return nil
+		})
+		rtest.Assert(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+	}()
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		p.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prefetches were not aborted")
+	}
+	rtest.Equals(t, int32(0), atomic.LoadInt32(&l.inFlight))
+	rtest.Equals(t, int32(4), atomic.LoadInt32(&l.loads))
+}
+
+func TestPrefetchError(t *testing.T) {
+	l := newTestLoader(2, 1000)
+	var fail int32 = 1
+	load := func(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+		if atomic.CompareAndSwapInt32(&fail, 1, 0) {
+			return errors.New("load failed")
+		}
+		return l.load(ctx, h, length, offset, fn)
+	}
+	p := New(context.TODO(), load, Options{Depth: 2})
+	defer p.Close()
+
+	req := testRequest(1, 100, 0)
+	p.Plan(req)
+	waitPrefetched(p, req)
+
+	// the failed prefetch is repeated as a direct load
+	loadAndCheck(t, p, l, req)
+	rtest.Equals(t, int32(1), atomic.LoadInt32(&l.loads))
+
+	// errors of the callback also lead to a direct load
+	p.Plan(req)
+	waitPrefetched(p, req)
+	calls := 0
+	err := p.Load(context.TODO(), req.Handle, req.Length, req.Offset, func(rd io.Reader) error {
+		calls++
+		if calls == 1 {
+			return errors.New("damaged data")
+		}
+		return nil
+	})
+	rtest.OK(t, err)
+	rtest.Equals(t, 2, calls)
+}
+
+func BenchmarkPrefetch(b *testing.B) {
+	const (
+		packs   = 16
+		latency = 100 * time.Millisecond
+		// time to process each pack after it has been loaded
+		processing = 20 * time.Millisecond
+	)
+
+	for _, depth := range []int{0, 1, 4, 8} {
+		b.Run(fmt.Sprintf("depth-%d", depth), func(b *testing.B) {
+			l := newTestLoader(packs, 64*1024)
+			l.latency = latency
+			for i := 0; i < b.N; i++ {
+				p := New(context.TODO(), l.load, Options{Depth: depth})
+				var reqs []Request
+				for j := 0; j < packs; j++ {
+					reqs = append(reqs, testRequest(j, 0, 0))
+				}
+				p.Plan(reqs...)
+
+				for _, req := range reqs {
+					err := p.Load(context.TODO(), req.Handle, req.Length, req.Offset, func(rd io.Reader) error {
+						_, err := io.Copy(io.Discard, rd)
+						time.Sleep(processing)
+						return err
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				p.Close()
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package rclone
 import (
 	"bufio"
 	"context"
-	"crypto/tls"
 	"fmt"
 	"io"
 	"math/rand"
@@ -12,12 +11,12 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
-	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/backend/limiter"
 	"github.com/restic/restic/internal/backend/location"
 	"github.com/restic/restic/internal/backend/rest"
@@ -30,45 +29,88 @@ import (
 // Backend is used to access data stored somewhere via rclone.
 type Backend struct {
 	*rest.Backend
-	tr         *http2.Transport
-	cmd        *exec.Cmd
-	waitCh     <-chan struct{}
-	waitResult error
-	wg         *sync.WaitGroup
-	conn       *StdioConn
+	s    *supervisor
+	stop func()
 }
 
 func NewFactory() location.Factory {
 	return location.NewLimitedBackendFactory("rclone", ParseConfig, location.NoPassword, Create, Open)
 }
 
+// outputLines is the number of lines printed by rclone which are included in
+// error messages.
+const outputLines = 10
+
+// output keeps the last lines printed by rclone to stderr.
+type output struct {
+	m     sync.Mutex
+	lines []string
+}
+
+func (o *output) add(line string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.lines = append(o.lines, line)
+	if len(o.lines) > outputLines {
+		o.lines = o.lines[len(o.lines)-outputLines:]
+	}
+}
+
+// String returns the lines for use in error messages.
+func (o *output) String() string {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if len(o.lines) == 0 {
+		return ""
+	}
+	return "\nrclone output:\n  " + strings.Join(o.lines, "\n  ")
+}
+
+// process is a running rclone instance.
+type process struct {
+	cmd    *exec.Cmd
+	conn   *StdioConn
+	cc     *http2.ClientConn
+	output *output
+
+	// exited is closed after rclone has exited, waitResult is set afterwards
+	exited     chan struct{}
+	waitResult error
+}
+
 // run starts command with args and initializes the StdioConn.
-func run(command string, args ...string) (*StdioConn, *sync.WaitGroup, chan struct{}, func() error, error) {
+func run(command string, env []string, args ...string) (*process, func() error, error) {
 	cmd := exec.Command(command, args...)
+	cmd.Env = env
 
 	p, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, err
 	}
 
-	var wg sync.WaitGroup
-	waitCh := make(chan struct{})
+	proc := &process{
+		cmd:    cmd,
+		output: &output{},
+		exited: make(chan struct{}),
+	}
+	stderrDone := make(chan struct{})
 
 	// start goroutine to add a prefix to all messages printed by to stderr by rclone
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		defer close(waitCh)
+		defer close(stderrDone)
 		sc := bufio.NewScanner(p)
 		for sc.Scan() {
 			fmt.Fprintf(os.Stderr, "rclone: %v\n", sc.Text())
+			proc.output.add(sc.Text())
 		}
-		debug.Log("command has exited, closing waitCh")
+		debug.Log("command has exited, closing stderr")
 	}()
 
 	r, stdin, err := os.Pipe()
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, err
 	}
 
 	stdout, w, err := os.Pipe()
@@ -76,7 +118,7 @@ func run(command string, args ...string) (*StdioConn, *sync.WaitGroup, chan stru
 		// close first pipe and ignore subsequent errors
 		_ = r.Close()
 		_ = stdin.Close()
-		return nil, nil, nil, nil, err
+		return nil, nil, err
 	}
 
 	cmd.Stdin = r
@@ -95,18 +137,102 @@ func run(command string, args ...string) (*StdioConn, *sync.WaitGroup, chan stru
 	}
 	if err != nil {
 		if util.IsErrDot(err) {
-			return nil, nil, nil, nil, errors.Errorf("cannot implicitly run relative executable %v found in current directory, use -o rclone.program=./<program> to override", cmd.Path)
+			return nil, nil, errors.Errorf("cannot implicitly run relative executable %v found in current directory, use -o rclone.program=./<program> to override", cmd.Path)
 		}
-		return nil, nil, nil, nil, err
+		return nil, nil, err
 	}
 
-	c := &StdioConn{
+	proc.conn = &StdioConn{
 		receive: stdout,
 		send:    stdin,
 		cmd:     cmd,
 	}
 
-	return c, &wg, waitCh, bg, nil
+	go func() {
+		<-stderrDone
+
+		// according to the documentation of StdErrPipe, Wait() must only be called after the former has completed
+		proc.waitResult = cmd.Wait()
+		debug.Log("Wait returned %v", proc.waitResult)
+		// close our side of the pipes to rclone, ignore errors
+		_ = proc.conn.CloseAll()
+		close(proc.exited)
+	}()
+
+	return proc, bg, nil
+}
+
+// probe waits until rclone answers an HTTP request for a random file which
+// does not exist. It returns an error if rclone exits or does not answer
+// within timeout.
+func (p *process) probe(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	go func() {
+		select {
+		case <-p.exited:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	url := fmt.Sprintf("http://localhost/file-%d", rand.Uint64())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", rest.ContentTypeV2)
+
+	res, err := debug.RoundTripper(p.cc).RoundTrip(req)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("rclone did not answer within %v: %w", timeout, err)
+		}
+		return err
+	}
+
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	debug.Log("HTTP status %q returned", res.Status)
+	return nil
+}
+
+// running returns true if rclone has not exited and the connection is usable.
+func (p *process) running() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+	}
+	return p.cc.CanTakeNewRequest()
+}
+
+const waitForExit = 5 * time.Second
+
+// terminate closes the connection to rclone, which lets it exit. If rclone
+// has not exited after waitForExit, the process is killed.
+func (p *process) terminate() error {
+	if p.cc != nil {
+		_ = p.cc.Close()
+	}
+	_ = p.conn.Close()
+
+	select {
+	case <-p.exited:
+		debug.Log("rclone exited")
+	case <-time.After(waitForExit):
+		debug.Log("timeout, killing rclone")
+		_ = p.cmd.Process.Kill()
+		<-p.exited
+	}
+
+	debug.Log("wait for rclone returned: %v", p.waitResult)
+	return p.waitResult
 }
 
 // wrappedConn adds bandwidth limiting capabilities to the StdioConn by
@@ -139,125 +265,161 @@ func wrapConn(c *StdioConn, lim limiter.Limiter) *wrappedConn {
 	return wc
 }
 
-// New initializes a Backend and starts the process.
-func newBackend(ctx context.Context, cfg Config, lim limiter.Limiter) (*Backend, error) {
-	var (
-		args []string
-		err  error
-	)
-
-	// build program args, start with the program
-	if cfg.Program != "" {
-		a, err := backend.SplitShellStrings(cfg.Program)
-		if err != nil {
-			return nil, err
-		}
-		args = append(args, a...)
-	}
-
-	// then add the arguments
-	if cfg.Args != "" {
-		a, err := backend.SplitShellStrings(cfg.Args)
-		if err != nil {
-			return nil, err
-		}
-
-		args = append(args, a...)
-	}
-
-	// finally, add the remote
-	args = append(args, cfg.Remote)
-	arg0, args := args[0], args[1:]
+// supervisor starts rclone and restarts it if it exits unexpectedly. It
+// sends HTTP requests to the current rclone process.
+type supervisor struct {
+	ctx  context.Context
+	cfg  Config
+	args []string
+	env  []string
+	lim  limiter.Limiter
+	tr   *http2.Transport
+
+	m        sync.Mutex
+	proc     *process
+	restarts uint
+	closed   bool
+}
 
-	debug.Log("running command: %v %v", arg0, args)
-	stdioConn, wg, waitCh, bg, err := run(arg0, args...)
+// start runs rclone and waits until it accepts HTTP requests.
+func (s *supervisor) start() (*process, error) {
+	debug.Log("running command: %v", s.args)
+	p, bg, err := run(s.args[0], s.env, s.args[1:]...)
 	if err != nil {
 		return nil, err
 	}
 
-	var conn net.Conn = stdioConn
-	if lim != nil {
-		conn = wrapConn(stdioConn, lim)
-	}
-
-	dialCount := 0
-	tr := &http2.Transport{
-		AllowHTTP: true, // this is not really HTTP, just stdin/stdout
-		DialTLS: func(network, address string, cfg *tls.Config) (net.Conn, error) {
-			debug.Log("new connection requested, %v %v", network, address)
-			if dialCount > 0 {
-				// the connection to the child process is already closed
-				return nil, backoff.Permanent(errors.New("rclone stdio connection already closed"))
-			}
-			dialCount++
-			return conn, nil
-		},
+	var conn net.Conn = p.conn
+	if s.lim != nil {
+		conn = wrapConn(p.conn, s.lim)
 	}
 
-	cmd := stdioConn.cmd
-	be := &Backend{
-		tr:     tr,
-		cmd:    cmd,
-		waitCh: waitCh,
-		conn:   stdioConn,
-		wg:     wg,
+	p.cc, err = s.tr.NewClientConn(conn)
+	if err == nil {
+		err = p.probe(s.ctx, s.cfg.Timeout)
 	}
+	if err != nil {
+		// ignore subsequent errors
+		_ = bg()
+		_ = p.cmd.Process.Kill()
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+		// wait for rclone to exit
+		<-p.exited
+		// try to return the program exit code if communication with rclone has failed
+		if p.waitResult != nil && (errors.Is(err, context.Canceled) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)) {
+			err = p.waitResult
+		}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		<-waitCh
-		cancel()
+		return nil, fmt.Errorf("error talking HTTP to rclone: %w%v", err, p.output)
+	}
 
-		// according to the documentation of StdErrPipe, Wait() must only be called after the former has completed
-		err := cmd.Wait()
-		debug.Log("Wait returned %v", err)
-		be.waitResult = err
-		// close our side of the pipes to rclone, ignore errors
-		_ = stdioConn.CloseAll()
-	}()
+	debug.Log("rclone is ready, moving instance to background")
+	err = bg()
+	if err != nil {
+		_ = p.terminate()
+		return nil, fmt.Errorf("error moving process to background: %w", err)
+	}
+
+	return p, nil
+}
 
-	// send an HTTP request to the base URL, see if the server is there
-	client := http.Client{
-		Transport: debug.RoundTripper(tr),
-		Timeout:   cfg.Timeout,
+// current returns the running rclone process. If rclone has exited, it is
+// restarted at most cfg.MaxRestarts times.
+func (s *supervisor) current() (*process, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.closed {
+		// the connection to the child process is already closed
+		return nil, backoff.Permanent(errors.New("rclone stdio connection already closed"))
+	}
+	if s.proc.running() {
+		return s.proc, nil
 	}
 
-	// request a random file which does not exist. we just want to test when
-	// rclone is able to accept HTTP requests.
-	url := fmt.Sprintf("http://localhost/file-%d", rand.Uint64())
+	// make sure the previous process is gone
+	_ = s.proc.terminate()
+	if s.restarts >= s.cfg.MaxRestarts {
+		return nil, backoff.Permanent(fmt.Errorf("rclone has exited unexpectedly: %v%v", s.proc.waitResult, s.proc.output))
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	s.restarts++
+	fmt.Fprintf(os.Stderr, "rclone has exited unexpectedly (%v), restarting it (%d/%d)\n", s.proc.waitResult, s.restarts, s.cfg.MaxRestarts)
+	p, err := s.start()
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Accept", rest.ContentTypeV2)
+	s.proc = p
+	return p, nil
+}
 
-	res, err := client.Do(req)
+// RoundTrip sends the request to rclone.
+func (s *supervisor) RoundTrip(req *http.Request) (*http.Response, error) {
+	p, err := s.current()
 	if err != nil {
-		// ignore subsequent errors
-		_ = bg()
-		_ = cmd.Process.Kill()
+		return nil, err
+	}
+	return p.cc.RoundTrip(req)
+}
 
-		// wait for rclone to exit
-		wg.Wait()
-		// try to return the program exit code if communication with rclone has failed
-		if be.waitResult != nil && (errors.Is(err, context.Canceled) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)) {
-			err = be.waitResult
-		}
+// close terminates rclone and prevents further restarts.
+func (s *supervisor) close() error {
+	s.m.Lock()
+	s.closed = true
+	p := s.proc
+	s.m.Unlock()
+
+	return p.terminate()
+}
 
-		return nil, fmt.Errorf("error talking HTTP to rclone: %w", err)
+// New initializes a Backend and starts the process.
+func newBackend(ctx context.Context, cfg Config, lim limiter.Limiter) (*Backend, error) {
+	args, err := cfg.command()
+	if err != nil {
+		return nil, err
+	}
+	env, err := cfg.environment()
+	if err != nil {
+		return nil, err
 	}
 
-	debug.Log("HTTP status %q returned, moving instance to background", res.Status)
-	err = bg()
+	s := &supervisor{
+		ctx:  ctx,
+		cfg:  cfg,
+		args: args,
+		env:  env,
+		lim:  lim,
+		tr: &http2.Transport{
+			AllowHTTP: true, // this is not really HTTP, just stdin/stdout
+			// wait for a free stream instead of opening another connection
+			StrictMaxConcurrentStreams: true,
+		},
+	}
+
+	s.proc, err = s.start()
 	if err != nil {
-		return nil, fmt.Errorf("error moving process to background: %w", err)
+		return nil, err
 	}
 
+	// terminate rclone once the context is canceled, rclone runs in a
+	// separate process group and does not receive the interrupt signal.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			debug.Log("context canceled, terminating rclone")
+			_ = s.close()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	be := &Backend{
+		s: s,
+		stop: func() {
+			once.Do(func() { close(done) })
+		},
+	}
 	return be, nil
 }
 
@@ -278,7 +440,7 @@ func Open(ctx context.Context, cfg Config, lim limiter.Limiter) (*Backend, error
 		URL:         url,
 	}
 
-	restBackend, err := rest.Open(ctx, restConfig, debug.RoundTripper(be.tr))
+	restBackend, err := rest.Open(ctx, restConfig, debug.RoundTripper(be.s))
 	if err != nil {
 		_ = be.Close()
 		return nil, err
@@ -307,7 +469,7 @@ func Create(ctx context.Context, cfg Config, lim limiter.Limiter) (*Backend, err
 		URL:         url,
 	}
 
-	restBackend, err := rest.Create(ctx, restConfig, debug.RoundTripper(be.tr))
+	restBackend, err := rest.Create(ctx, restConfig, debug.RoundTripper(be.s))
 	if err != nil {
 		_ = be.Close()
 		return nil, err
@@ -317,25 +479,9 @@ func Create(ctx context.Context, cfg Config, lim limiter.Limiter) (*Backend, err
 	return be, nil
 }
 
-const waitForExit = 5 * time.Second
-
 // Close terminates the backend.
 func (be *Backend) Close() error {
 	debug.Log("exiting rclone")
-	be.tr.CloseIdleConnections()
-
-	select {
-	case <-be.waitCh:
-		debug.Log("rclone exited")
-	case <-time.After(waitForExit):
-		debug.Log("timeout, closing file descriptors")
-		err := be.conn.CloseAll()
-		if err != nil {
-			return err
-		}
-	}
-
-	be.wg.Wait()
-	debug.Log("wait for rclone returned: %v", be.waitResult)
-	return be.waitResult
+	be.stop()
+	return be.s.close()
 }
@@ -4,6 +4,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/options"
 )
@@ -12,9 +13,13 @@ import (
 type Config struct {
 	Program     string `option:"program" help:"path to rclone (default: rclone)"`
 	Args        string `option:"args"    help:"arguments for running rclone (default: serve restic --stdio --b2-hard-delete)"`
+	Flags       string `option:"flags"   help:"additional flags for rclone, appended to the arguments"`
+	ConfigFile  string `option:"config"  help:"path to the rclone config file"`
+	Env         string `option:"env"     help:"environment variables for rclone, as space separated list of NAME=VALUE"`
 	Remote      string
-	Connections uint          `option:"connections" help:"set a limit for the number of concurrent connections (default: 5)"`
-	Timeout     time.Duration `option:"timeout"     help:"set a timeout limit to wait for rclone to establish a connection (default: 1m)"`
+	Connections uint          `option:"connections"  help:"set a limit for the number of concurrent connections (default: 5)"`
+	Timeout     time.Duration `option:"timeout"      help:"set a timeout limit to wait for rclone to establish a connection (default: 1m)"`
+	MaxRestarts uint          `option:"max-restarts" help:"restart rclone at most this many times if it exits unexpectedly (default: 3)"`
 }
 
 var defaultConfig = Config{
@@ -22,6 +27,7 @@ var defaultConfig = Config{
 	Args:        "serve restic --stdio --b2-hard-delete",
 	Connections: 5,
 	Timeout:     time.Minute,
+	MaxRestarts: 3,
 }
 
 func init() {
@@ -44,3 +50,56 @@ func ParseConfig(s string) (*Config, error) {
 	cfg.Remote = s
 	return &cfg, nil
 }
+
+// command returns the program and the arguments used to run rclone.
+func (cfg Config) command() ([]string, error) {
+	var args []string
+
+	// build program args, start with the program
+	if cfg.Program != "" {
+		a, err := backend.SplitShellStrings(cfg.Program)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a...)
+	}
+
+	// then add the arguments and flags
+	for _, s := range []string{cfg.Args, cfg.Flags} {
+		if s == "" {
+			continue
+		}
+		a, err := backend.SplitShellStrings(s)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a...)
+	}
+
+	if cfg.ConfigFile != "" {
+		args = append(args, "--config", cfg.ConfigFile)
+	}
+
+	// finally, add the remote
+	args = append(args, cfg.Remote)
+	return args, nil
+}
+
+// environment returns the environment variables which are set for rclone in
+// addition to the environment of restic.
+func (cfg Config) environment() ([]string, error) {
+	if cfg.Env == "" {
+		return nil, nil
+	}
+
+	env, err := backend.SplitShellStrings(cfg.Env)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range env {
+		if strings.IndexByte(kv, '=') <= 0 {
+			return nil, errors.Fatalf("invalid environment variable %q in rclone.env, expected NAME=VALUE", kv)
+		}
+	}
+	return env, nil
+}
@@ -1,9 +1,11 @@
 package rclone
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/restic/restic/internal/backend/test"
+	rtest "github.com/restic/restic/internal/test"
 )
 
 var configTests = []test.ConfigTestData[Config]{
@@ -15,6 +17,7 @@ var configTests = []test.ConfigTestData[Config]{
 			Args:        defaultConfig.Args,
 			Connections: defaultConfig.Connections,
 			Timeout:     defaultConfig.Timeout,
+			MaxRestarts: defaultConfig.MaxRestarts,
 		},
 	},
 }
@@ -22,3 +25,47 @@ var configTests = []test.ConfigTestData[Config]{
 func TestParseConfig(t *testing.T) {
 	test.ParseConfigTester(t, ParseConfig, configTests)
 }
+
+func TestConfigCommand(t *testing.T) {
+	var tests = []struct {
+		cfg  Config
+		args []string
+	}{
+		{
+			Config{Program: "rclone", Args: "serve restic --stdio", Remote: "b2:foo/bar"},
+			[]string{"rclone", "serve", "restic", "--stdio", "b2:foo/bar"},
+		},
+		{
+			Config{Program: "/path/to/rclone", Args: "serve restic --stdio", Flags: "--bwlimit 1M --verbose",
+				ConfigFile: "/etc/my rclone.conf", Remote: "b2:foo/bar"},
+			[]string{"/path/to/rclone", "serve", "restic", "--stdio", "--bwlimit", "1M", "--verbose",
+				"--config", "/etc/my rclone.conf", "b2:foo/bar"},
+		},
+		{
+			Config{Program: "ssh user@host", Remote: "x"},
+			[]string{"ssh", "user@host", "x"},
+		},
+	}
+
+	for _, test := range tests {
+		args, err := test.cfg.command()
+		rtest.OK(t, err)
+		rtest.Equals(t, test.args, args)
+	}
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	cfg := NewConfig()
+	env, err := cfg.environment()
+	rtest.OK(t, err)
+	rtest.Equals(t, 0, len(env))
+
+	cfg.Env = `"RCLONE_CONFIG_PASS=secret value" RCLONE_FAST_LIST=true`
+	env, err = cfg.environment()
+	rtest.OK(t, err)
+	rtest.Equals(t, []string{"RCLONE_CONFIG_PASS=secret value", "RCLONE_FAST_LIST=true"}, env)
+
+	cfg.Env = "RCLONE_FAST_LIST"
+	_, err = cfg.environment()
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "NAME=VALUE"), "unexpected error %v", err)
+}
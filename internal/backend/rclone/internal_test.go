@@ -2,12 +2,17 @@ package rclone
 
 import (
 	"context"
+	"net/http"
+	"os"
 	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/errors"
 	rtest "github.com/restic/restic/internal/test"
+	"golang.org/x/net/http2"
 )
 
 // restic should detect rclone exiting.
@@ -15,6 +20,7 @@ func TestRcloneExit(t *testing.T) {
 	dir := rtest.TempDir(t)
 	cfg := NewConfig()
 	cfg.Remote = dir
+	cfg.MaxRestarts = 0
 	be, err := Open(context.TODO(), cfg, nil)
 	var e *exec.Error
 	if errors.As(err, &e) && e.Err == exec.ErrNotFound {
@@ -27,7 +33,7 @@ func TestRcloneExit(t *testing.T) {
 		_ = be.Close()
 	}()
 
-	err = be.cmd.Process.Kill()
+	err = be.s.proc.cmd.Process.Kill()
 	rtest.OK(t, err)
 	t.Log("killed rclone")
 
@@ -52,3 +58,101 @@ func TestRcloneFailedStart(t *testing.T) {
 		rtest.OK(t, err)
 	}
 }
+
+// TestHelperProcess is run as a replacement for rclone by the tests below.
+// It serves HTTP/2 requests on stdin/stdout and reports that no file exists.
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("RCLONE_TEST_HELPER") {
+	case "":
+		return
+	case "fail":
+		_, _ = os.Stderr.WriteString("Failed to create file system: didn't find section in config file\n")
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Hour)
+		os.Exit(1)
+	}
+
+	srv := &http2.Server{}
+	srv.ServeConn(&StdioConn{receive: os.Stdin, send: os.Stdout}, &http2.ServeConnOpts{
+		Handler: http.NotFoundHandler(),
+	})
+	os.Exit(0)
+}
+
+func helperConfig(mode string) Config {
+	cfg := NewConfig()
+	cfg.Program = os.Args[0]
+	cfg.Args = "-test.run=^TestHelperProcess$ --"
+	cfg.Env = "RCLONE_TEST_HELPER=" + mode
+	cfg.Remote = "remote:"
+	return cfg
+}
+
+func statNotExist(t *testing.T, be *Backend) {
+	_, err := be.Stat(context.TODO(), backend.Handle{Type: backend.PackFile, Name: "foo"})
+	rtest.Assert(t, be.IsNotExist(err), "unexpected error %v", err)
+}
+
+func TestRcloneRestart(t *testing.T) {
+	cfg := helperConfig("serve")
+	cfg.MaxRestarts = 1
+	be, err := Open(context.TODO(), cfg, nil)
+	rtest.OK(t, err)
+	defer func() {
+		_ = be.Close()
+	}()
+	statNotExist(t, be)
+
+	first := be.s.proc
+	rtest.OK(t, first.cmd.Process.Kill())
+	<-first.exited
+
+	// rclone is restarted once
+	statNotExist(t, be)
+	rtest.Assert(t, be.s.proc != first, "rclone was not restarted")
+
+	rtest.OK(t, be.s.proc.cmd.Process.Kill())
+	<-be.s.proc.exited
+	_, err = be.Stat(context.TODO(), backend.Handle{Type: backend.PackFile, Name: "foo"})
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "exited unexpectedly"), "unexpected error %v", err)
+}
+
+func TestRcloneStartupOutput(t *testing.T) {
+	_, err := Open(context.TODO(), helperConfig("fail"), nil)
+	var e *exec.ExitError
+	rtest.Assert(t, errors.As(err, &e), "unexpected error %v", err)
+	rtest.Assert(t, strings.Contains(err.Error(), "didn't find section in config file"), "rclone output missing from %q", err)
+}
+
+func TestRcloneStartupTimeout(t *testing.T) {
+	cfg := helperConfig("hang")
+	cfg.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := Open(context.TODO(), cfg, nil)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "did not answer within"), "unexpected error %v", err)
+	rtest.Assert(t, time.Since(start) < waitForExit, "startup took %v", time.Since(start))
+}
+
+func TestRcloneContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	be, err := Open(ctx, helperConfig("serve"), nil)
+	rtest.OK(t, err)
+	defer func() {
+		_ = be.Close()
+	}()
+	statNotExist(t, be)
+
+	cancel()
+	select {
+	case <-be.s.proc.exited:
+	case <-time.After(2 * waitForExit):
+		t.Fatal("rclone was not terminated")
+	}
+
+	_, err = be.Stat(context.TODO(), backend.Handle{Type: backend.PackFile, Name: "foo"})
+	rtest.Assert(t, err != nil, "expected an error")
+}
@@ -2,6 +2,7 @@ package rest
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"hash"
@@ -10,6 +11,8 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/backend/layout"
@@ -28,6 +31,13 @@ type Backend struct {
 	connections uint
 	client      http.Client
 	layout.Layout
+
+	// resumable is set once the server has announced API version 3
+	resumable atomic.Bool
+
+	m sync.Mutex
+	// interrupted contains the files whose last upload has failed
+	interrupted map[backend.Handle]struct{}
 }
 
 func NewFactory() location.Factory {
@@ -80,18 +90,14 @@ func Create(ctx context.Context, cfg Config, rt http.RoundTripper) (*Backend, er
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server response unexpected: %v (%v)", resp.Status, resp.StatusCode)
-	}
+	cerr := drain(resp)
 
-	_, err = io.Copy(io.Discard, resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.WithStack(newStatusError("server response unexpected", resp))
 	}
 
-	err = resp.Body.Close()
-	if err != nil {
-		return nil, err
+	if cerr != nil {
+		return nil, cerr
 	}
 
 	return be, nil
@@ -106,8 +112,12 @@ func (b *Backend) Location() string {
 	return b.url.String()
 }
 
-// Hasher may return a hash function for calculating a content hash for the backend
+// Hasher may return a hash function for calculating a content hash for the
+// backend. Only servers which support API version 3 verify the content hash.
 func (b *Backend) Hasher() hash.Hash {
+	if b.resumable.Load() {
+		return sha256.New()
+	}
 	return nil
 }
 
@@ -117,11 +127,35 @@ func (b *Backend) HasAtomicReplace() bool {
 	return false
 }
 
-// Save stores data in the backend at the handle.
+// Save stores data in the backend at the handle. If the previous upload of
+// the file was interrupted and the server supports it, only the missing part
+// of the file is uploaded.
 func (b *Backend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	if b.resumable.Load() && b.wasInterrupted(h) {
+		done, err := b.resume(ctx, h, rd)
+		if done || err != nil {
+			b.setInterrupted(h, err != nil)
+			return err
+		}
+
+		debug.Log("restarting upload of %v", h)
+		if err := rd.Rewind(); err != nil {
+			return err
+		}
+	}
+
+	err := b.upload(ctx, h, rd)
+	if b.resumable.Load() {
+		b.setInterrupted(h, err != nil)
+	}
+	return err
+}
+
+// upload sends the whole file to the server.
+func (b *Backend) upload(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
 	// make sure that client.Post() cannot close the reader by wrapping it
 	req, err := http.NewRequestWithContext(ctx,
 		http.MethodPost, b.Filename(h), io.NopCloser(rd))
@@ -130,17 +164,17 @@ func (b *Backend) Save(ctx context.Context, h backend.Handle, rd backend.RewindR
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
 	req.Header.Set("Accept", ContentTypeV2)
+	setContentDigest(req, rd)
 
 	// explicitly set the content length, this prevents chunked encoding and
 	// let's the server know what's coming.
 	req.ContentLength = rd.Length()
 
-	resp, err := b.client.Do(req)
+	resp, err := b.do(req)
 
 	var cerr error
 	if resp != nil {
-		_, _ = io.Copy(io.Discard, resp.Body)
-		cerr = resp.Body.Close()
+		cerr = drain(resp)
 	}
 
 	if err != nil {
@@ -148,7 +182,7 @@ func (b *Backend) Save(ctx context.Context, h backend.Handle, rd backend.RewindR
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("server response unexpected: %v (%v)", resp.Status, resp.StatusCode)
+		return errors.WithStack(newStatusError("server response unexpected", resp))
 	}
 
 	return errors.Wrap(cerr, "Close")
@@ -170,6 +204,51 @@ func (b *Backend) IsNotExist(err error) bool {
 	return errors.As(err, &e)
 }
 
+// statusError is returned when the server responds with an unexpected HTTP
+// status code.
+type statusError struct {
+	msg        string
+	status     string
+	statusCode int
+}
+
+func newStatusError(msg string, resp *http.Response) *statusError {
+	return &statusError{msg: msg, status: resp.Status, statusCode: resp.StatusCode}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v: %v (%v)", e.msg, e.status, e.statusCode)
+}
+
+// IsPermanentError returns true if the server rejected the credentials, denied
+// access or has no space left.
+func (b *Backend) IsPermanentError(err error) bool {
+	var e *statusError
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusInsufficientStorage:
+		return true
+	}
+	return false
+}
+
+// IsDeletionForbidden returns true if the server does not allow removing the
+// file, which is the case for a rest-server in append-only mode.
+func (b *Backend) IsDeletionForbidden(err error) bool {
+	var e *statusError
+	return errors.As(err, &e) && e.statusCode == http.StatusForbidden
+}
+
+// IsThrottled returns true if the server has rejected the request because too
+// many requests were sent.
+func (b *Backend) IsThrottled(err error) bool {
+	var e *statusError
+	return errors.As(err, &e) && (e.statusCode == http.StatusTooManyRequests || e.statusCode == http.StatusServiceUnavailable)
+}
+
 // Load runs fn with a reader that yields the contents of the file at h at the
 // given offset.
 func (b *Backend) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
@@ -214,24 +293,23 @@ func (b *Backend) openReader(ctx context.Context, h backend.Handle, length int,
 	req.Header.Set("Range", byteRange)
 	req.Header.Set("Accept", ContentTypeV2)
 
-	resp, err := b.client.Do(req)
+	resp, err := b.do(req)
 
 	if err != nil {
 		if resp != nil {
-			_, _ = io.Copy(io.Discard, resp.Body)
-			_ = resp.Body.Close()
+			_ = drain(resp)
 		}
 		return nil, errors.Wrap(err, "client.Do")
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
-		_ = resp.Body.Close()
+		_ = drain(resp)
 		return nil, &notExistError{h}
 	}
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-		_ = resp.Body.Close()
-		return nil, errors.Errorf("unexpected HTTP response (%v): %v", resp.StatusCode, resp.Status)
+		_ = drain(resp)
+		return nil, errors.WithStack(newStatusError("unexpected HTTP response", resp))
 	}
 
 	return resp.Body, nil
@@ -245,23 +323,21 @@ func (b *Backend) Stat(ctx context.Context, h backend.Handle) (backend.FileInfo,
 	}
 	req.Header.Set("Accept", ContentTypeV2)
 
-	resp, err := b.client.Do(req)
+	resp, err := b.do(req)
 	if err != nil {
 		return backend.FileInfo{}, errors.WithStack(err)
 	}
 
-	_, _ = io.Copy(io.Discard, resp.Body)
-	if err = resp.Body.Close(); err != nil {
+	if err = drain(resp); err != nil {
 		return backend.FileInfo{}, errors.Wrap(err, "Close")
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
-		_ = resp.Body.Close()
 		return backend.FileInfo{}, &notExistError{h}
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return backend.FileInfo{}, errors.Errorf("unexpected HTTP response (%v): %v", resp.StatusCode, resp.Status)
+		return backend.FileInfo{}, errors.WithStack(newStatusError("unexpected HTTP response", resp))
 	}
 
 	if resp.ContentLength < 0 {
@@ -284,27 +360,22 @@ func (b *Backend) Remove(ctx context.Context, h backend.Handle) error {
 	}
 	req.Header.Set("Accept", ContentTypeV2)
 
-	resp, err := b.client.Do(req)
+	resp, err := b.do(req)
 
 	if err != nil {
 		return errors.Wrap(err, "client.Do")
 	}
+	cerr := drain(resp)
 
 	if resp.StatusCode == http.StatusNotFound {
-		_ = resp.Body.Close()
 		return &notExistError{h}
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("blob not removed, server response: %v (%v)", resp.Status, resp.StatusCode)
+		return errors.WithStack(newStatusError("blob not removed, server response", resp))
 	}
 
-	_, err = io.Copy(io.Discard, resp.Body)
-	if err != nil {
-		return errors.Wrap(err, "Copy")
-	}
-
-	return errors.Wrap(resp.Body.Close(), "Close")
+	return errors.Wrap(cerr, "Close")
 }
 
 // List runs fn for each file in the backend which has the type t. When an
@@ -321,11 +392,14 @@ func (b *Backend) List(ctx context.Context, t backend.FileType, fn func(backend.
 	}
 	req.Header.Set("Accept", ContentTypeV2)
 
-	resp, err := b.client.Do(req)
+	resp, err := b.do(req)
 
 	if err != nil {
 		return errors.Wrap(err, "List")
 	}
+	defer func() {
+		_ = drain(resp)
+	}()
 
 	if resp.StatusCode == http.StatusNotFound {
 		// ignore missing directories
@@ -333,7 +407,7 @@ func (b *Backend) List(ctx context.Context, t backend.FileType, fn func(backend.
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("List failed, server response: %v (%v)", resp.Status, resp.StatusCode)
+		return errors.WithStack(newStatusError("List failed, server response", resp))
 	}
 
 	if resp.Header.Get("Content-Type") == ContentTypeV2 {
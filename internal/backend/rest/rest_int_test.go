@@ -148,3 +148,44 @@ func TestListAPI(t *testing.T) {
 		})
 	}
 }
+
+func TestPermanentError(t *testing.T) {
+	var tests = []struct {
+		StatusCode int
+		Permanent  bool
+	}{
+		{http.StatusUnauthorized, true},
+		{http.StatusForbidden, true},
+		{http.StatusInsufficientStorage, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusBadGateway, false},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.StatusCode), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(test.StatusCode)
+			}))
+			defer srv.Close()
+
+			srvURL, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			be, err := rest.Open(context.TODO(), rest.Config{Connections: 5, URL: srvURL}, http.DefaultTransport)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = be.Stat(context.TODO(), backend.Handle{Type: backend.PackFile, Name: "foo"})
+			if err == nil {
+				t.Fatal("Stat did not return an error")
+			}
+
+			if be.IsPermanentError(err) != test.Permanent {
+				t.Fatalf("wrong classification for error %v, want permanent %v", err, test.Permanent)
+			}
+		})
+	}
+}
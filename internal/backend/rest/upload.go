@@ -0,0 +1,165 @@
+package rest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// APIVersionHeader is the HTTP response header used by servers to announce
+// support for API version 3, which adds resumable uploads and verifies the
+// content digest of uploaded files.
+const APIVersionHeader = "X-Restic-Api-Version"
+
+const (
+	apiVersionResumable = 3
+
+	headerContentDigest = "Content-Digest"
+	headerUploadOffset  = "Upload-Offset"
+	headerUploadLength  = "Upload-Length"
+)
+
+// do sends the request and records whether the server supports resumable
+// uploads.
+func (b *Backend) do(req *http.Request) (*http.Response, error) {
+	resp, err := b.client.Do(req)
+	if resp != nil && !b.resumable.Load() {
+		v, verr := strconv.Atoi(resp.Header.Get(APIVersionHeader))
+		if verr == nil && v >= apiVersionResumable {
+			debug.Log("server supports API version %d", v)
+			b.resumable.Store(true)
+		}
+	}
+	return resp, err
+}
+
+// drain reads the remaining response body and closes it, so that the
+// connection can be reused.
+func drain(resp *http.Response) error {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// setContentDigest adds the SHA-256 digest of the data in rd to the request
+// as described in RFC 9530, if the digest is known.
+func setContentDigest(req *http.Request, rd backend.RewindReader) {
+	if h := rd.Hash(); len(h) == sha256.Size {
+		req.Header.Set(headerContentDigest, "sha-256=:"+base64.StdEncoding.EncodeToString(h)+":")
+	}
+}
+
+// setInterrupted records whether the last upload of h has failed.
+func (b *Backend) setInterrupted(h backend.Handle, interrupted bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if !interrupted {
+		delete(b.interrupted, h)
+		return
+	}
+	if b.interrupted == nil {
+		b.interrupted = make(map[backend.Handle]struct{})
+	}
+	b.interrupted[h] = struct{}{}
+}
+
+func (b *Backend) wasInterrupted(h backend.Handle) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	_, ok := b.interrupted[h]
+	return ok
+}
+
+// uploadOffset returns the number of bytes the server has stored for an
+// interrupted upload of h, or zero if there is no such upload.
+func (b *Backend) uploadOffset(ctx context.Context, h backend.Handle) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, b.Filename(h)+"?upload", nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	req.Header.Set("Accept", ContentTypeV2)
+
+	resp, err := b.do(req)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if err = drain(resp); err != nil {
+		return 0, errors.Wrap(err, "Close")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return 0, nil
+	default:
+		return 0, errors.WithStack(newStatusError("upload status, server response", resp))
+	}
+
+	offset, err := strconv.ParseInt(resp.Header.Get(headerUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errors.Errorf("invalid %v header %q", headerUploadOffset, resp.Header.Get(headerUploadOffset))
+	}
+	return offset, nil
+}
+
+// resume uploads the part of the file which is missing on the server after
+// an interrupted upload. It returns false if the upload cannot be resumed and
+// must be restarted from the beginning.
+func (b *Backend) resume(ctx context.Context, h backend.Handle, rd backend.RewindReader) (bool, error) {
+	offset, err := b.uploadOffset(ctx, h)
+	if err != nil {
+		return false, err
+	}
+	if offset == 0 || offset > rd.Length() {
+		return false, nil
+	}
+	debug.Log("resuming upload of %v at offset %d", h, offset)
+
+	if err := rd.Rewind(); err != nil {
+		return false, err
+	}
+	if _, err := io.CopyN(io.Discard, rd, offset); err != nil {
+		return false, errors.Wrap(err, "skip uploaded data")
+	}
+
+	var body io.Reader = http.NoBody
+	if offset < rd.Length() {
+		// make sure that client.Do() cannot close the reader by wrapping it
+		body = io.NopCloser(rd)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, b.Filename(h), body)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Accept", ContentTypeV2)
+	req.Header.Set(headerUploadOffset, strconv.FormatInt(offset, 10))
+	req.Header.Set(headerUploadLength, strconv.FormatInt(rd.Length(), 10))
+	setContentDigest(req, rd)
+	req.ContentLength = rd.Length() - offset
+
+	resp, err := b.do(req)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	cerr := drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		// the server no longer has the data uploaded so far
+		return false, nil
+	default:
+		return false, errors.WithStack(newStatusError("server response unexpected", resp))
+	}
+
+	return true, errors.Wrap(cerr, "Close")
+}
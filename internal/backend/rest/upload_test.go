@@ -0,0 +1,279 @@
+package rest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/rest"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+// resumableServer stores files in memory. Unless old is set, it supports
+// API version 3 and keeps the data of interrupted uploads.
+type resumableServer struct {
+	old bool
+
+	m       sync.Mutex
+	files   map[string][]byte
+	partial map[string][]byte
+	posts   int
+	// patches contains the number of bytes sent by each PATCH request
+	patches []int
+	// interrupted receives a value after an interrupted upload was handled
+	interrupted chan struct{}
+}
+
+func newResumableServer(old bool) *resumableServer {
+	return &resumableServer{
+		old:         old,
+		files:       make(map[string][]byte),
+		partial:     make(map[string][]byte),
+		interrupted: make(chan struct{}, 1),
+	}
+}
+
+func checkDigest(r *http.Request, data []byte) bool {
+	digest := r.Header.Get("Content-Digest")
+	if digest == "" {
+		return true
+	}
+	sum := sha256.Sum256(data)
+	return digest == "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":"
+}
+
+func (s *resumableServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.old {
+		w.Header().Set(rest.APIVersionHeader, "3")
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	name := r.URL.Path
+	switch r.Method {
+	case http.MethodHead:
+		if r.URL.Query().Has("upload") && !s.old {
+			data, ok := s.partial[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Upload-Offset", strconv.Itoa(len(data)))
+			return
+		}
+
+		data, ok := s.files[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	case http.MethodGet:
+		data, ok := s.files[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodPost:
+		s.posts++
+		delete(s.partial, name)
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			if !s.old {
+				s.partial[name] = data
+			}
+			s.interrupted <- struct{}{}
+			return
+		}
+		if !s.old && !checkDigest(r, data) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.files[name] = data
+	case http.MethodPatch:
+		offset, _ := strconv.Atoi(r.Header.Get("Upload-Offset"))
+		length, _ := strconv.Atoi(r.Header.Get("Upload-Length"))
+		data, ok := s.partial[name]
+		if !ok || offset != len(data) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		rest, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.patches = append(s.patches, len(rest))
+		data = append(data, rest...)
+		if len(data) != length || !checkDigest(r, data) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(s.partial, name)
+		s.files[name] = data
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// failingBody returns an error after a number of bytes have been read.
+type failingBody struct {
+	io.ReadCloser
+	remaining int
+}
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= n
+	return n, err
+}
+
+// interruptingTransport interrupts the first POST request after it has sent
+// failAfter bytes.
+type interruptingTransport struct {
+	http.RoundTripper
+	failAfter int
+
+	once sync.Once
+}
+
+func (t *interruptingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPost {
+		t.once.Do(func() {
+			req.Body = &failingBody{ReadCloser: req.Body, remaining: t.failAfter}
+		})
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func openResumable(t *testing.T, srv *resumableServer) *rest.Backend {
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	srvURL, err := url.Parse(ts.URL)
+	rtest.OK(t, err)
+
+	tr := &interruptingTransport{RoundTripper: http.DefaultTransport, failAfter: 512 * 1024}
+	be, err := rest.Open(context.TODO(), rest.Config{Connections: 5, URL: srvURL}, tr)
+	rtest.OK(t, err)
+
+	// learn the API version of the server
+	_, err = be.Stat(context.TODO(), backend.Handle{Type: backend.ConfigFile})
+	rtest.Assert(t, be.IsNotExist(err), "unexpected error %v", err)
+	return be
+}
+
+func TestResumeUpload(t *testing.T) {
+	srv := newResumableServer(false)
+	be := openResumable(t, srv)
+	rtest.Assert(t, be.Hasher() != nil, "missing hasher for API version 3")
+
+	data := rtest.Random(23, 1024*1024)
+	h := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	rd := backend.NewByteReader(data, be.Hasher())
+
+	err := be.Save(context.TODO(), h, rd)
+	rtest.Assert(t, err != nil, "interrupted upload did not fail")
+	<-srv.interrupted
+
+	// the retry backend rewinds the reader before each attempt
+	rtest.OK(t, rd.Rewind())
+	rtest.OK(t, be.Save(context.TODO(), h, rd))
+
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	rtest.Equals(t, 1, srv.posts)
+	rtest.Equals(t, 1, len(srv.patches))
+	rtest.Assert(t, srv.patches[0] < len(data), "PATCH sent %d bytes, the whole file has %d bytes", srv.patches[0], len(data))
+	rtest.Assert(t, bytes.Equal(data, srv.files["/data/"+h.Name]), "wrong data stored")
+}
+
+func TestResumeUploadLost(t *testing.T) {
+	srv := newResumableServer(false)
+	be := openResumable(t, srv)
+
+	data := rtest.Random(23, 1024*1024)
+	h := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	rd := backend.NewByteReader(data, be.Hasher())
+
+	rtest.Assert(t, be.Save(context.TODO(), h, rd) != nil, "interrupted upload did not fail")
+	<-srv.interrupted
+
+	// the server has discarded the partial upload, the upload is restarted
+	srv.m.Lock()
+	delete(srv.partial, "/data/"+h.Name)
+	srv.m.Unlock()
+
+	rtest.OK(t, rd.Rewind())
+	rtest.OK(t, be.Save(context.TODO(), h, rd))
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	rtest.Equals(t, 2, srv.posts)
+	rtest.Assert(t, bytes.Equal(data, srv.files["/data/"+h.Name]), "wrong data stored")
+}
+
+func TestUploadWrongDigest(t *testing.T) {
+	srv := newResumableServer(false)
+	be := openResumable(t, srv)
+
+	data := []byte("foobar")
+	wrong := sha256.Sum256([]byte("baz"))
+	h := backend.Handle{Type: backend.SnapshotFile, Name: "0123456789abcdef"}
+
+	err := be.Save(context.TODO(), h, backend.NewByteReader(data, nil))
+	rtest.OK(t, err)
+
+	h.Name = "fedcba9876543210"
+	rd := &wrongHashReader{ByteReader: *backend.NewByteReader(data, nil), hash: wrong[:]}
+	err = be.Save(context.TODO(), h, rd)
+	rtest.Assert(t, err != nil, "upload with wrong digest did not fail")
+}
+
+type wrongHashReader struct {
+	backend.ByteReader
+	hash []byte
+}
+
+func (r *wrongHashReader) Hash() []byte {
+	return r.hash
+}
+
+func TestUploadOldServer(t *testing.T) {
+	srv := newResumableServer(true)
+	be := openResumable(t, srv)
+	rtest.Assert(t, be.Hasher() == nil, "unexpected hasher for API version 2")
+
+	data := rtest.Random(23, 1024*1024)
+	h := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	rd := backend.NewByteReader(data, be.Hasher())
+
+	rtest.Assert(t, be.Save(context.TODO(), h, rd) != nil, "interrupted upload did not fail")
+	<-srv.interrupted
+
+	// the whole file is uploaded again
+	rtest.OK(t, rd.Rewind())
+	rtest.OK(t, be.Save(context.TODO(), h, rd))
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	rtest.Equals(t, 2, srv.posts)
+	rtest.Equals(t, 0, len(srv.patches))
+	rtest.Assert(t, bytes.Equal(data, srv.files["/data/"+h.Name]), "wrong data stored")
+}
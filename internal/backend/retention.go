@@ -0,0 +1,34 @@
+package backend
+
+import (
+	"context"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+// ErrRetained is returned, possibly wrapped, by Remove if a file cannot be
+// deleted yet because it is protected by a retention policy.
+var ErrRetained = errors.New("file is protected by a retention policy")
+
+// Retention describes until when a file is protected against deletion.
+type Retention struct {
+	// Mode is the backend specific retention mode, it is empty if the file is
+	// not protected.
+	Mode string
+	// Until is the time when the protection expires.
+	Until time.Time
+}
+
+// Retained returns true if the file cannot be deleted at time now.
+func (r Retention) Retained(now time.Time) bool {
+	return r.Mode != "" && r.Until.After(now)
+}
+
+// RetentionBackend is implemented by backends which can protect files against
+// deletion for a retention period.
+type RetentionBackend interface {
+	Backend
+	// Retention returns the retention of the file h.
+	Retention(ctx context.Context, h Handle) (Retention, error)
+}
@@ -9,30 +9,32 @@ import (
 	"github.com/cenkalti/backoff/v4"
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
 )
 
 // Backend retries operations on the backend in case of an error with a
 // backoff.
 type Backend struct {
 	backend.Backend
-	MaxTries int
-	Report   func(string, error, time.Duration)
-	Success  func(string, int)
+	Policy  Policy
+	Report  func(msg string, err error, attempt int, d time.Duration)
+	Success func(string, int)
 }
 
 // statically ensure that RetryBackend implements backend.Backend.
 var _ backend.Backend = &Backend{}
 
-// New wraps be with a backend that retries operations after a
-// backoff. report is called with a description and the error, if one occurred.
-// success is called with the number of retries before a successful operation
-// (it is not called if it succeeded on the first try)
-func New(be backend.Backend, maxTries int, report func(string, error, time.Duration), success func(string, int)) *Backend {
+// New wraps be with a backend that retries operations after a backoff
+// according to policy. report is called with a description, the error, the
+// number of the failed attempt and the delay before the next attempt, if one
+// occurred. success is called with the number of retries before a successful
+// operation (it is not called if it succeeded on the first try)
+func New(be backend.Backend, policy Policy, report func(msg string, err error, attempt int, d time.Duration), success func(string, int)) *Backend {
 	return &Backend{
-		Backend:  be,
-		MaxTries: maxTries,
-		Report:   report,
-		Success:  success,
+		Backend: be,
+		Policy:  policy,
+		Report:  report,
+		Success: success,
 	}
 }
 
@@ -57,6 +59,36 @@ func retryNotifyErrorWithSuccess(operation backoff.Operation, b backoff.BackOff,
 
 var fastRetries = false
 
+// isPermanent returns true if retrying the operation which failed with err is
+// pointless.
+func (be *Backend) isPermanent(err error) bool {
+	if isOutOfSpace(err) || errors.Is(err, backend.ErrRetained) || errors.Is(err, backend.ErrCold) {
+		return true
+	}
+
+	if c := backend.AsBackend[backend.DeletionClassifier](be.Backend); c != nil && c.IsDeletionForbidden(err) {
+		return true
+	}
+	if c := backend.AsBackend[backend.PermanentErrorClassifier](be.Backend); c != nil {
+		return c.IsPermanentError(err)
+	}
+	return false
+}
+
+// throttled lowers the rate of operations if the provider has throttled the
+// operation which failed with err.
+func (be *Backend) throttled(err error) {
+	c := backend.AsBackend[backend.ThrottleClassifier](be.Backend)
+	if c == nil || !c.IsThrottled(err) {
+		return
+	}
+
+	if t := backend.AsBackend[backend.Throttler](be.Backend); t != nil {
+		debug.Log("backend throttled the request: %v", err)
+		t.Throttled()
+	}
+}
+
 func (be *Backend) retry(ctx context.Context, msg string, f func() error) error {
 	// Don't do anything when called with an already cancelled context. There would be
 	// no retries in that case either, so be consistent and abort always.
@@ -69,16 +101,34 @@ func (be *Backend) retry(ctx context.Context, msg string, f func() error) error
 	}
 
 	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = be.Policy.InitialDelay
+	bo.MaxInterval = be.Policy.MaxDelay
+	bo.MaxElapsedTime = be.Policy.MaxElapsed
+	bo.RandomizationFactor = float64(be.Policy.Jitter) / 100
 	if fastRetries {
 		// speed up integration tests
 		bo.InitialInterval = 1 * time.Millisecond
 	}
 
-	err := retryNotifyErrorWithSuccess(f,
-		backoff.WithContext(backoff.WithMaxRetries(bo, uint64(be.MaxTries)), ctx),
+	operation := func() error {
+		err := f()
+		if err != nil {
+			be.throttled(err)
+		}
+		if err != nil && be.isPermanent(err) {
+			debug.Log("%v failed with permanent error: %v", msg, err)
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+
+	attempt := 0
+	err := retryNotifyErrorWithSuccess(operation,
+		backoff.WithContext(backoff.WithMaxRetries(bo, uint64(be.Policy.MaxRetries)), ctx),
 		func(err error, d time.Duration) {
+			attempt++
 			if be.Report != nil {
-				be.Report(msg, err, d)
+				be.Report(msg, err, attempt, d)
 			}
 		},
 		func(retries int) {
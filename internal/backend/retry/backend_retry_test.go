@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"runtime"
+	"syscall"
 	"testing"
 	"time"
 
@@ -15,6 +17,12 @@ import (
 	"github.com/restic/restic/internal/test"
 )
 
+func testPolicy(maxRetries uint) Policy {
+	p := DefaultPolicy()
+	p.MaxRetries = maxRetries
+	return p
+}
+
 func TestBackendSaveRetry(t *testing.T) {
 	buf := bytes.NewBuffer(nil)
 	errcount := 0
@@ -36,7 +44,7 @@ func TestBackendSaveRetry(t *testing.T) {
 	}
 
 	TestFastRetries(t)
-	retryBackend := New(be, 10, nil, nil)
+	retryBackend := New(be, testPolicy(10), nil, nil)
 
 	data := test.Random(23, 5*1024*1024+11241)
 	err := retryBackend.Save(context.TODO(), backend.Handle{}, backend.NewByteReader(data, be.Hasher()))
@@ -72,7 +80,7 @@ func TestBackendSaveRetryAtomic(t *testing.T) {
 	}
 
 	TestFastRetries(t)
-	retryBackend := New(be, 10, nil, nil)
+	retryBackend := New(be, testPolicy(10), nil, nil)
 
 	data := test.Random(23, 5*1024*1024+11241)
 	err := retryBackend.Save(context.TODO(), backend.Handle{}, backend.NewByteReader(data, be.Hasher()))
@@ -106,7 +114,7 @@ func TestBackendListRetry(t *testing.T) {
 	}
 
 	TestFastRetries(t)
-	retryBackend := New(be, 10, nil, nil)
+	retryBackend := New(be, testPolicy(10), nil, nil)
 
 	var listed []string
 	err := retryBackend.List(context.TODO(), backend.PackFile, func(fi backend.FileInfo) error {
@@ -136,7 +144,7 @@ func TestBackendListRetryErrorFn(t *testing.T) {
 	}
 
 	TestFastRetries(t)
-	retryBackend := New(be, 10, nil, nil)
+	retryBackend := New(be, testPolicy(10), nil, nil)
 
 	var ErrTest = errors.New("test error")
 
@@ -193,7 +201,7 @@ func TestBackendListRetryErrorBackend(t *testing.T) {
 
 	TestFastRetries(t)
 	const maxRetries = 2
-	retryBackend := New(be, maxRetries, nil, nil)
+	retryBackend := New(be, testPolicy(maxRetries), nil, nil)
 
 	var listed []string
 	err := retryBackend.List(context.TODO(), backend.PackFile, func(fi backend.FileInfo) error {
@@ -263,7 +271,7 @@ func TestBackendLoadRetry(t *testing.T) {
 	}
 
 	TestFastRetries(t)
-	retryBackend := New(be, 10, nil, nil)
+	retryBackend := New(be, testPolicy(10), nil, nil)
 
 	var buf []byte
 	err := retryBackend.Load(context.TODO(), backend.Handle{}, 0, 0, func(rd io.Reader) (err error) {
@@ -294,7 +302,7 @@ func TestBackendLoadNotExists(t *testing.T) {
 	}
 
 	TestFastRetries(t)
-	retryBackend := New(be, 10, nil, nil)
+	retryBackend := New(be, testPolicy(10), nil, nil)
 
 	err := retryBackend.Load(context.TODO(), backend.Handle{}, 0, 0, func(rd io.Reader) (err error) {
 		return nil
@@ -322,7 +330,7 @@ func TestBackendStatNotExists(t *testing.T) {
 	}
 
 	TestFastRetries(t)
-	retryBackend := New(be, 10, nil, nil)
+	retryBackend := New(be, testPolicy(10), nil, nil)
 
 	_, err := retryBackend.Stat(context.TODO(), backend.Handle{})
 	test.Assert(t, be.IsNotExistFn(err), "unexpected error %v", err)
@@ -337,7 +345,7 @@ func TestBackendCanceledContext(t *testing.T) {
 	// unimplemented mock backend functions return an error by default
 	// check that we received the expected context canceled error instead
 	TestFastRetries(t)
-	retryBackend := New(mock.NewBackend(), 2, nil, nil)
+	retryBackend := New(mock.NewBackend(), testPolicy(2), nil, nil)
 	h := backend.Handle{Type: backend.PackFile, Name: restic.NewRandomID().String()}
 
 	// create an already canceled context
@@ -415,3 +423,122 @@ func TestNotifyWithSuccessIsCalled(t *testing.T) {
 		t.Fatalf("Success should have been called only once, but was called %d times instead", successCalled)
 	}
 }
+
+func TestBackendReportAttempts(t *testing.T) {
+	errcount := 0
+	be := &mock.Backend{
+		RemoveFn: func(ctx context.Context, h backend.Handle) error {
+			errcount++
+			return errors.New("injected error")
+		},
+	}
+
+	TestFastRetries(t)
+	var attempts []int
+	report := func(msg string, err error, attempt int, d time.Duration) {
+		attempts = append(attempts, attempt)
+	}
+	retryBackend := New(be, testPolicy(3), report, nil)
+
+	err := retryBackend.Remove(context.TODO(), backend.Handle{})
+	test.Assert(t, err != nil, "missing error")
+	test.Equals(t, 4, errcount)
+	test.Equals(t, []int{1, 2, 3}, attempts)
+}
+
+// classifyingBackend marks an error as permanent.
+type classifyingBackend struct {
+	*mock.Backend
+	permanent error
+}
+
+func (be *classifyingBackend) IsPermanentError(err error) bool {
+	return errors.Is(err, be.permanent)
+}
+
+func TestBackendPermanentError(t *testing.T) {
+	errPermanent := errors.New("access denied")
+	errcount := 0
+	mbe := mock.NewBackend()
+	mbe.StatFn = func(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+		errcount++
+		if errcount == 1 {
+			return backend.FileInfo{}, errors.New("temporary error")
+		}
+		return backend.FileInfo{}, errors.Wrap(errPermanent, "Stat")
+	}
+	mbe.SaveFn = func(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+		errcount++
+		return errors.Wrap(syscall.ENOSPC, "Write")
+	}
+
+	TestFastRetries(t)
+	retryBackend := New(&classifyingBackend{Backend: mbe, permanent: errPermanent}, testPolicy(10), nil, nil)
+
+	_, err := retryBackend.Stat(context.TODO(), backend.Handle{})
+	test.Assert(t, errors.Is(err, errPermanent), "unexpected error %v", err)
+	test.Equals(t, 2, errcount)
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// running out of space is never retried
+	errcount = 0
+	err = retryBackend.Save(context.TODO(), backend.Handle{}, backend.NewByteReader([]byte{}, nil))
+	test.Assert(t, errors.Is(err, syscall.ENOSPC), "unexpected error %v", err)
+	test.Equals(t, 1, errcount)
+}
+
+// throttlingBackend classifies errThrottled as caused by throttling and
+// counts the calls of Throttled.
+type throttlingBackend struct {
+	backend.Backend
+	throttled int
+}
+
+var errThrottled = errors.New("slow down")
+
+func (be *throttlingBackend) IsThrottled(err error) bool {
+	return errors.Is(err, errThrottled)
+}
+
+func (be *throttlingBackend) Throttled() {
+	be.throttled++
+}
+
+func TestBackendThrottled(t *testing.T) {
+	errcount := 0
+	mbe := mock.NewBackend()
+	mbe.StatFn = func(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+		errcount++
+		switch errcount {
+		case 1, 2:
+			return backend.FileInfo{}, errors.Wrap(errThrottled, "Stat")
+		case 3:
+			return backend.FileInfo{}, errors.New("temporary error")
+		}
+		return backend.FileInfo{}, nil
+	}
+
+	TestFastRetries(t)
+	be := &throttlingBackend{Backend: mbe}
+	retryBackend := New(be, testPolicy(10), nil, nil)
+
+	_, err := retryBackend.Stat(context.TODO(), backend.Handle{})
+	test.OK(t, err)
+	test.Equals(t, 4, errcount)
+	test.Equals(t, 2, be.throttled)
+}
+
+func TestPolicyValidate(t *testing.T) {
+	test.OK(t, DefaultPolicy().Validate())
+
+	p := DefaultPolicy()
+	p.Jitter = 101
+	test.Assert(t, p.Validate() != nil, "missing error for invalid jitter")
+
+	p = DefaultPolicy()
+	p.MaxDelay = p.InitialDelay / 2
+	test.Assert(t, p.Validate() != nil, "missing error for invalid max delay")
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package retry
+
+import (
+	"syscall"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+// isOutOfSpace returns true if err was caused by a full or read-only file
+// system.
+func isOutOfSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) || errors.Is(err, syscall.EROFS)
+}
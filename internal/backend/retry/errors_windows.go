@@ -0,0 +1,12 @@
+package retry
+
+import (
+	"github.com/restic/restic/internal/errors"
+	"golang.org/x/sys/windows"
+)
+
+// isOutOfSpace returns true if err was caused by a full or read-only file
+// system.
+func isOutOfSpace(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL) || errors.Is(err, windows.ERROR_WRITE_PROTECT)
+}
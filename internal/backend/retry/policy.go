@@ -0,0 +1,44 @@
+package retry
+
+import (
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/options"
+)
+
+// Policy configures how often and how long failed backend operations are
+// retried.
+type Policy struct {
+	MaxRetries   uint          `option:"max-retries" help:"retry a failed backend operation at most n times (default: 10)"`
+	InitialDelay time.Duration `option:"initial-delay" help:"wait this long before the first retry (default: 500ms)"`
+	MaxDelay     time.Duration `option:"max-delay" help:"maximum delay between two retries (default: 1m)"`
+	MaxElapsed   time.Duration `option:"max-elapsed" help:"give up retrying an operation after this time, 0 disables the limit (default: 15m)"`
+	Jitter       uint          `option:"jitter" help:"randomize each delay by up to this percentage (default: 50)"`
+}
+
+func init() {
+	options.Register("retry", Policy{})
+}
+
+// DefaultPolicy returns the default retry policy.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxRetries:   10,
+		InitialDelay: 500 * time.Millisecond,
+		MaxDelay:     time.Minute,
+		MaxElapsed:   15 * time.Minute,
+		Jitter:       50,
+	}
+}
+
+// Validate checks that the policy can be used.
+func (p Policy) Validate() error {
+	if p.Jitter > 100 {
+		return errors.Fatalf("invalid retry jitter %d%%, must be between 0 and 100", p.Jitter)
+	}
+	if p.MaxDelay < p.InitialDelay {
+		return errors.Fatalf("retry max-delay %v must not be shorter than initial-delay %v", p.MaxDelay, p.InitialDelay)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"context"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// make sure that *Backend implements backend.ColdStorageBackend
+var _ backend.ColdStorageBackend = &Backend{}
+
+const defaultRestoreDays = 7
+
+// parseRestoreTier checks the retrieval tier used for restoring archived
+// objects.
+func parseRestoreTier(cfg Config) (minio.TierType, error) {
+	switch strings.ToLower(cfg.RestoreTier) {
+	case "", "standard":
+		return minio.TierStandard, nil
+	case "bulk":
+		return minio.TierBulk, nil
+	case "expedited":
+		return minio.TierExpedited, nil
+	default:
+		return "", errors.Fatalf(`s3: invalid restore-tier %q, must be "Standard", "Bulk" or "Expedited"`, cfg.RestoreTier)
+	}
+}
+
+// isArchiveStorageClass returns true for the storage classes whose objects
+// must be restored before they can be read.
+func isArchiveStorageClass(class string) bool {
+	switch strings.ToUpper(class) {
+	case "GLACIER", "DEEP_ARCHIVE":
+		return true
+	}
+	return false
+}
+
+// storageClass returns the storage class for new files. Only data packs use
+// the data storage class, all metadata stays readable at any time.
+func (be *Backend) storageClass(h backend.Handle) string {
+	if h.Type == backend.PackFile && !h.IsMetadata && be.cfg.DataStorageClass != "" {
+		return be.cfg.DataStorageClass
+	}
+	return be.cfg.StorageClass
+}
+
+// ColdFile returns true if the file h is saved in an archive storage class.
+func (be *Backend) ColdFile(h backend.Handle) bool {
+	return isArchiveStorageClass(be.storageClass(h))
+}
+
+// Thaw returns true if the file h can be read. For archived files, a restore
+// is requested if request is set.
+func (be *Backend) Thaw(ctx context.Context, h backend.Handle, request bool) (bool, error) {
+	objName := be.Filename(h)
+	info, err := be.client.StatObject(ctx, be.cfg.Bucket, objName, minio.StatObjectOptions{ServerSideEncryption: be.readSSE()})
+	if err != nil {
+		return false, errors.Wrap(err, "client.StatObject")
+	}
+
+	if !isArchiveStorageClass(info.Metadata.Get("X-Amz-Storage-Class")) {
+		return true, nil
+	}
+	if info.Restore != nil {
+		debug.Log("restore of %v in progress: %v", h, info.Restore.OngoingRestore)
+		return !info.Restore.OngoingRestore, nil
+	}
+	if !request {
+		return false, nil
+	}
+
+	days := be.cfg.RestoreDays
+	if days == 0 {
+		days = defaultRestoreDays
+	}
+	req := minio.RestoreRequest{}
+	req.SetDays(int(days))
+	req.SetGlacierJobParameters(minio.GlacierJobParameters{Tier: be.restoreTier})
+
+	debug.Log("requesting restore of %v for %d days", h, days)
+	err = be.client.RestoreObject(ctx, be.cfg.Bucket, objName, "", req)
+	var e minio.ErrorResponse
+	if errors.As(err, &e) && e.Code == "RestoreAlreadyInProgress" {
+		err = nil
+	}
+	return false, errors.Wrap(err, "client.RestoreObject")
+}
+
+// coldError is returned by Load if the file is archived and has not been
+// restored.
+type coldError struct {
+	name string
+	err  error
+}
+
+func (e *coldError) Error() string {
+	return e.name + ": " + backend.ErrCold.Error() + ": " + e.err.Error()
+}
+
+func (e *coldError) Is(target error) bool {
+	return target == backend.ErrCold
+}
+
+func (e *coldError) Unwrap() error {
+	return e.err
+}
+
+// wrapColdError returns a coldError if err reports that the file h is
+// archived, otherwise err is returned.
+func wrapColdError(h backend.Handle, err error) error {
+	var e minio.ErrorResponse
+	if errors.As(err, &e) && e.Code == "InvalidObjectState" {
+		return &coldError{name: h.String(), err: err}
+	}
+	return err
+}
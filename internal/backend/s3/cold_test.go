@@ -0,0 +1,216 @@
+package s3
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/options"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+type fakeObject struct {
+	data         []byte
+	storageClass string
+	// restore is the value of the x-amz-restore header
+	restore string
+}
+
+// fakeArchiveServer implements the parts of the S3 API needed to store,
+// read and restore objects in archive storage classes.
+type fakeArchiveServer struct {
+	m        sync.Mutex
+	objects  map[string]*fakeObject
+	restores []string
+}
+
+func (s *fakeArchiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	name := r.URL.Path
+	obj := s.objects[name]
+	switch {
+	case r.Method == http.MethodPut:
+		data, err := readPayload(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[name] = &fakeObject{data: data, storageClass: r.Header.Get("X-Amz-Storage-Class")}
+		w.Header().Set("ETag", `"etag"`)
+	case obj == nil:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+	case r.Method == http.MethodPost && r.URL.Query().Has("restore"):
+		s.restores = append(s.restores, name)
+		obj.restore = `ongoing-request="true"`
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 01 May 2023 12:00:00 GMT")
+		if obj.storageClass != "" {
+			w.Header().Set("X-Amz-Storage-Class", obj.storageClass)
+		}
+		if obj.restore != "" {
+			w.Header().Set("X-Amz-Restore", obj.restore)
+		}
+	case r.Method == http.MethodGet:
+		if isArchiveStorageClass(obj.storageClass) && !strings.Contains(obj.restore, `ongoing-request="false"`) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>`)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 01 May 2023 12:00:00 GMT")
+		_, _ = w.Write(obj.data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// readPayload returns the request body, without the chunk signatures of
+// streaming uploads.
+func readPayload(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Decoded-Content-Length") == "" {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	rd := bufio.NewReader(r.Body)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:n]...)
+	}
+}
+
+func openFakeArchive(t *testing.T, srv *fakeArchiveServer, cfg Config) *Backend {
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	rtest.OK(t, err)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	cfg.Endpoint = u.Host
+	cfg.UseHTTP = true
+	cfg.Bucket = "bucket"
+	cfg.Prefix = "repo"
+	cfg.Layout = "default"
+	cfg.Region = "us-east-1"
+	cfg.BucketLookup = "path"
+	cfg.KeyID = "key"
+	cfg.Secret = options.NewSecretString("secret")
+
+	be, err := open(context.TODO(), cfg, http.DefaultTransport)
+	rtest.OK(t, err)
+	return be
+}
+
+func TestStorageClass(t *testing.T) {
+	be := &Backend{cfg: Config{StorageClass: "STANDARD_IA", DataStorageClass: "DEEP_ARCHIVE"}}
+
+	for _, test := range []struct {
+		h     backend.Handle
+		class string
+		cold  bool
+	}{
+		{backend.Handle{Type: backend.PackFile}, "DEEP_ARCHIVE", true},
+		{backend.Handle{Type: backend.PackFile, IsMetadata: true}, "STANDARD_IA", false},
+		{backend.Handle{Type: backend.IndexFile}, "STANDARD_IA", false},
+		{backend.Handle{Type: backend.SnapshotFile}, "STANDARD_IA", false},
+	} {
+		rtest.Equals(t, test.class, be.storageClass(test.h))
+		rtest.Equals(t, test.cold, be.ColdFile(test.h))
+	}
+
+	// without a data storage class, all files use the same storage class
+	be = &Backend{cfg: Config{StorageClass: "GLACIER"}}
+	rtest.Equals(t, "GLACIER", be.storageClass(backend.Handle{Type: backend.PackFile, IsMetadata: true}))
+}
+
+func TestParseRestoreTier(t *testing.T) {
+	for _, tier := range []string{"", "Standard", "bulk", "EXPEDITED"} {
+		_, err := parseRestoreTier(Config{RestoreTier: tier})
+		rtest.OK(t, err)
+	}
+	_, err := parseRestoreTier(Config{RestoreTier: "fast"})
+	rtest.Assert(t, err != nil, "missing error for invalid restore tier")
+}
+
+func TestThaw(t *testing.T) {
+	srv := &fakeArchiveServer{objects: make(map[string]*fakeObject)}
+	be := openFakeArchive(t, srv, Config{DataStorageClass: "GLACIER"})
+
+	data := []byte("foobar")
+	dataPack := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	treePack := backend.Handle{Type: backend.PackFile, Name: "fedcba9876543210", IsMetadata: true}
+	for _, h := range []backend.Handle{dataPack, treePack} {
+		rtest.OK(t, be.Save(context.TODO(), h, backend.NewByteReader(data, nil)))
+	}
+
+	// tree packs can be read right away
+	ok, err := be.Thaw(context.TODO(), treePack, false)
+	rtest.OK(t, err)
+	rtest.Assert(t, ok, "tree pack is not readable")
+	rtest.OK(t, be.Load(context.TODO(), treePack, 0, 0, func(rd io.Reader) error {
+		_, err := io.Copy(io.Discard, rd)
+		return err
+	}))
+
+	err = be.Load(context.TODO(), dataPack, 0, 0, func(rd io.Reader) error { return nil })
+	rtest.Assert(t, errors.Is(err, backend.ErrCold), "unexpected error %v", err)
+
+	ok, err = be.Thaw(context.TODO(), dataPack, false)
+	rtest.OK(t, err)
+	rtest.Assert(t, !ok, "archived pack is readable")
+	rtest.Equals(t, 0, len(srv.restores))
+
+	// requesting a restore twice only sends a single request
+	for i := 0; i < 2; i++ {
+		ok, err = be.Thaw(context.TODO(), dataPack, true)
+		rtest.OK(t, err)
+		rtest.Assert(t, !ok, "archived pack is readable")
+	}
+	rtest.Equals(t, []string{"/bucket/repo/data/01/" + dataPack.Name}, srv.restores)
+
+	srv.m.Lock()
+	srv.objects["/bucket/repo/data/01/"+dataPack.Name].restore = `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`
+	srv.m.Unlock()
+
+	ok, err = be.Thaw(context.TODO(), dataPack, true)
+	rtest.OK(t, err)
+	rtest.Assert(t, ok, "restored pack is not readable")
+	rtest.OK(t, be.Load(context.TODO(), dataPack, 0, 0, func(rd io.Reader) error {
+		buf, err := io.ReadAll(rd)
+		rtest.Equals(t, data, buf)
+		return err
+	}))
+}
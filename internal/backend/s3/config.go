@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/errors"
@@ -28,6 +29,17 @@ type Config struct {
 	Region        string `option:"region" help:"set region"`
 	BucketLookup  string `option:"bucket-lookup" help:"bucket lookup style: 'auto', 'dns', or 'path'"`
 	ListObjectsV1 bool   `option:"list-objects-v1" help:"use deprecated V1 api for ListObjects calls"`
+
+	SSEAlgorithm   string               `option:"sse-algorithm" help:"server-side encryption for new files: AES256 (SSE-S3), aws:kms (SSE-KMS) or SSE-C (default: $RESTIC_S3_SSE_ALGORITHM)"`
+	SSEKMSKeyID    string               `option:"sse-kms-key-id" help:"KMS key ID for aws:kms server-side encryption (default: $RESTIC_S3_SSE_KMS_KEY_ID)"`
+	SSECustomerKey options.SecretString // base64 encoded SSE-C key, only read from $RESTIC_S3_SSE_C_KEY
+
+	RetentionMode   string        `option:"retention-mode" help:"set object lock retention mode for new data and snapshot files (governance or compliance)"`
+	RetentionPeriod time.Duration `option:"retention-period" help:"protect new data and snapshot files against deletion for this duration, e.g. 2160h"`
+
+	DataStorageClass string `option:"data-storage-class" help:"set S3 storage class for data packs, e.g. GLACIER or DEEP_ARCHIVE (default: storage-class)"`
+	RestoreDays      uint   `option:"restore-days" help:"keep restored copies of archived data packs for this number of days (default: 7)"`
+	RestoreTier      string `option:"restore-tier" help:"retrieval tier for restoring archived data packs: Standard, Bulk or Expedited (default: Standard)"`
 }
 
 // NewConfig returns a new Config with the default values filled in.
@@ -107,4 +119,13 @@ func (cfg *Config) ApplyEnvironment(prefix string) {
 	if cfg.Region == "" {
 		cfg.Region = os.Getenv(prefix + "AWS_DEFAULT_REGION")
 	}
+	if cfg.SSEAlgorithm == "" {
+		cfg.SSEAlgorithm = os.Getenv(prefix + "RESTIC_S3_SSE_ALGORITHM")
+	}
+	if cfg.SSEKMSKeyID == "" {
+		cfg.SSEKMSKeyID = os.Getenv(prefix + "RESTIC_S3_SSE_KMS_KEY_ID")
+	}
+	if cfg.SSECustomerKey.String() == "" {
+		cfg.SSECustomerKey = options.NewSecretString(os.Getenv(prefix + "RESTIC_S3_SSE_C_KEY"))
+	}
 }
@@ -0,0 +1,111 @@
+package s3
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// make sure that *Backend implements backend.RetentionBackend
+var _ backend.RetentionBackend = &Backend{}
+
+// parseRetentionMode checks the retention settings of the config and
+// returns the object lock mode, which is empty if retention is disabled.
+func parseRetentionMode(cfg Config) (minio.RetentionMode, error) {
+	if cfg.RetentionMode == "" {
+		if cfg.RetentionPeriod != 0 {
+			return "", errors.Fatal("s3: retention-period requires retention-mode to be set")
+		}
+		return "", nil
+	}
+
+	mode := minio.RetentionMode(strings.ToUpper(cfg.RetentionMode))
+	if !mode.IsValid() {
+		return "", errors.Fatalf(`s3: invalid retention-mode %q, must be "governance" or "compliance"`, cfg.RetentionMode)
+	}
+	if cfg.RetentionPeriod <= 0 {
+		return "", errors.Fatal("s3: retention-mode requires a positive retention-period")
+	}
+	return mode, nil
+}
+
+// retainFile returns true for the files which are protected by the configured
+// retention. Lock files are removed regularly, the other files are rewritten
+// by prune and would prevent it from finishing.
+func retainFile(t backend.FileType) bool {
+	return t == backend.PackFile || t == backend.SnapshotFile
+}
+
+// setRetention adds the object lock retention for h to opts.
+func (be *Backend) setRetention(opts *minio.PutObjectOptions, h backend.Handle, now time.Time) {
+	if be.retentionMode == "" || !retainFile(h.Type) {
+		return
+	}
+
+	opts.Mode = be.retentionMode
+	opts.RetainUntilDate = now.Add(be.cfg.RetentionPeriod).UTC()
+}
+
+// Retention returns the object lock retention of the file h.
+func (be *Backend) Retention(ctx context.Context, h backend.Handle) (backend.Retention, error) {
+	mode, until, err := be.client.GetObjectRetention(ctx, be.cfg.Bucket, be.Filename(h), "")
+	if err != nil {
+		var e minio.ErrorResponse
+		if errors.As(err, &e) && (e.Code == "NoSuchObjectLockConfiguration" || e.Code == "ObjectLockConfigurationNotFoundError") {
+			// the file has no retention
+			return backend.Retention{}, nil
+		}
+		return backend.Retention{}, errors.Wrap(err, "client.GetObjectRetention")
+	}
+
+	var r backend.Retention
+	if mode != nil && until != nil {
+		r.Mode = strings.ToLower(string(*mode))
+		r.Until = *until
+	}
+	return r, nil
+}
+
+// retentionError is returned by Remove if the file is protected by its
+// object lock retention.
+type retentionError struct {
+	name  string
+	until time.Time
+	err   error
+}
+
+func (e *retentionError) Error() string {
+	msg := e.name + " is protected by its object lock retention until " + e.until.Format(time.RFC3339)
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+func (e *retentionError) Is(target error) bool {
+	return target == backend.ErrRetained
+}
+
+func (e *retentionError) Unwrap() error {
+	return e.err
+}
+
+// checkRetained returns a retentionError if the file h is protected by its
+// retention, otherwise err is returned.
+func (be *Backend) checkRetained(ctx context.Context, h backend.Handle, err error) error {
+	r, rerr := be.Retention(ctx, h)
+	if rerr != nil {
+		debug.Log("unable to get retention of %v: %v", h, rerr)
+		return err
+	}
+
+	if !r.Retained(time.Now()) {
+		return err
+	}
+	return &retentionError{name: h.String(), until: r.Until, err: err}
+}
@@ -0,0 +1,66 @@
+package s3
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/restic/restic/internal/backend"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestParseRetentionMode(t *testing.T) {
+	for _, test := range []struct {
+		mode   string
+		period time.Duration
+		result minio.RetentionMode
+	}{
+		{"", 0, ""},
+		{"governance", time.Hour, minio.Governance},
+		{"COMPLIANCE", 90 * 24 * time.Hour, minio.Compliance},
+	} {
+		mode, err := parseRetentionMode(Config{RetentionMode: test.mode, RetentionPeriod: test.period})
+		rtest.OK(t, err)
+		rtest.Equals(t, test.result, mode)
+	}
+
+	for _, test := range []struct {
+		mode   string
+		period time.Duration
+	}{
+		{"", time.Hour},
+		{"legal-hold", time.Hour},
+		{"compliance", 0},
+		{"governance", -time.Hour},
+	} {
+		_, err := parseRetentionMode(Config{RetentionMode: test.mode, RetentionPeriod: test.period})
+		rtest.Assert(t, err != nil, "missing error for mode %q, period %v", test.mode, test.period)
+	}
+}
+
+func TestSetRetention(t *testing.T) {
+	be := &Backend{
+		cfg:           Config{RetentionMode: "compliance", RetentionPeriod: 24 * time.Hour},
+		retentionMode: minio.Compliance,
+	}
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tpe := range []backend.FileType{backend.PackFile, backend.SnapshotFile} {
+		var opts minio.PutObjectOptions
+		be.setRetention(&opts, backend.Handle{Type: tpe, Name: "foo"}, now)
+		rtest.Equals(t, minio.Compliance, opts.Mode)
+		rtest.Equals(t, now.Add(24*time.Hour), opts.RetainUntilDate)
+	}
+
+	for _, tpe := range []backend.FileType{backend.LockFile, backend.IndexFile, backend.KeyFile, backend.ConfigFile} {
+		var opts minio.PutObjectOptions
+		be.setRetention(&opts, backend.Handle{Type: tpe, Name: "foo"}, now)
+		rtest.Equals(t, minio.PutObjectOptions{}, opts)
+	}
+
+	// retention is disabled by default
+	be = &Backend{}
+	var opts minio.PutObjectOptions
+	be.setRetention(&opts, backend.Handle{Type: backend.PackFile, Name: "foo"}, now)
+	rtest.Equals(t, minio.PutObjectOptions{}, opts)
+}
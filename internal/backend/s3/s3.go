@@ -20,12 +20,16 @@ import (
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
 // Backend stores data on an S3 endpoint.
 type Backend struct {
-	client *minio.Client
-	cfg    Config
+	client        *minio.Client
+	cfg           Config
+	sse           encrypt.ServerSide
+	retentionMode minio.RetentionMode
+	restoreTier   minio.TierType
 	layout.Layout
 }
 
@@ -110,9 +114,27 @@ func open(ctx context.Context, cfg Config, rt http.RoundTripper) (*Backend, erro
 		return nil, errors.Wrap(err, "minio.New")
 	}
 
+	sse, err := parseSSE(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	retentionMode, err := parseRetentionMode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreTier, err := parseRestoreTier(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	be := &Backend{
-		client: client,
-		cfg:    cfg,
+		client:        client,
+		cfg:           cfg,
+		sse:           sse,
+		retentionMode: retentionMode,
+		restoreTier:   restoreTier,
 	}
 
 	l, err := layout.ParseLayout(ctx, be, cfg.Layout, defaultLayout, cfg.Prefix)
@@ -175,6 +197,43 @@ func (be *Backend) IsNotExist(err error) bool {
 	return errors.As(err, &e) && e.Code == "NoSuchKey"
 }
 
+// IsDeletionForbidden returns true if the bucket policy does not allow removing
+// the file. Files protected by their retention are reported as
+// backend.ErrRetained instead.
+func (be *Backend) IsDeletionForbidden(err error) bool {
+	return isAccessDenied(err) && !errors.Is(err, backend.ErrRetained)
+}
+
+// IsPermanentError returns true if the error is caused by invalid credentials,
+// missing permissions or a missing bucket.
+func (be *Backend) IsPermanentError(err error) bool {
+	var e minio.ErrorResponse
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.Code {
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "NoSuchBucket":
+		return true
+	}
+	return e.StatusCode == http.StatusForbidden
+}
+
+// IsThrottled returns true if the server has rejected the request because too
+// many requests were sent.
+func (be *Backend) IsThrottled(err error) bool {
+	var e minio.ErrorResponse
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.Code {
+	case "SlowDown", "RequestLimitExceeded", "TooManyRequests":
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
 // Join combines path components with slashes.
 func (be *Backend) Join(p ...string) string {
 	return path.Join(p...)
@@ -275,12 +334,14 @@ func (be *Backend) Path() string {
 func (be *Backend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
 	objName := be.Filename(h)
 
-	opts := minio.PutObjectOptions{StorageClass: be.cfg.StorageClass}
+	opts := minio.PutObjectOptions{StorageClass: be.storageClass(h)}
 	opts.ContentType = "application/octet-stream"
 	// the only option with the high-level api is to let the library handle the checksum computation
 	opts.SendContentMd5 = true
+	opts.ServerSideEncryption = be.sse
 	// only use multipart uploads for very large files
 	opts.PartSize = 200 * 1024 * 1024
+	be.setRetention(&opts, h, time.Now())
 
 	info, err := be.client.PutObject(ctx, be.cfg.Bucket, objName, io.NopCloser(rd), int64(rd.Length()), opts)
 
@@ -303,7 +364,7 @@ func (be *Backend) Load(ctx context.Context, h backend.Handle, length int, offse
 
 func (be *Backend) openReader(ctx context.Context, h backend.Handle, length int, offset int64) (io.ReadCloser, error) {
 	objName := be.Filename(h)
-	opts := minio.GetObjectOptions{}
+	opts := minio.GetObjectOptions{ServerSideEncryption: be.readSSE()}
 
 	var err error
 	if length > 0 {
@@ -319,7 +380,7 @@ func (be *Backend) openReader(ctx context.Context, h backend.Handle, length int,
 	coreClient := minio.Core{Client: be.client}
 	rd, _, _, err := coreClient.GetObject(ctx, be.cfg.Bucket, objName, opts)
 	if err != nil {
-		return nil, err
+		return nil, wrapColdError(h, err)
 	}
 
 	return rd, err
@@ -330,7 +391,7 @@ func (be *Backend) Stat(ctx context.Context, h backend.Handle) (bi backend.FileI
 	objName := be.Filename(h)
 	var obj *minio.Object
 
-	opts := minio.GetObjectOptions{}
+	opts := minio.GetObjectOptions{ServerSideEncryption: be.readSSE()}
 
 	obj, err = be.client.GetObject(ctx, be.cfg.Bucket, objName, opts)
 	if err != nil {
@@ -357,11 +418,23 @@ func (be *Backend) Stat(ctx context.Context, h backend.Handle) (bi backend.FileI
 func (be *Backend) Remove(ctx context.Context, h backend.Handle) error {
 	objName := be.Filename(h)
 
+	if be.retentionMode != "" && retainFile(h.Type) {
+		// on a versioned bucket, removing a protected file only adds a
+		// delete marker and the data is kept, so don't remove it in the
+		// first place
+		if err := be.checkRetained(ctx, h, nil); err != nil {
+			return err
+		}
+	}
+
 	err := be.client.RemoveObject(ctx, be.cfg.Bucket, objName, minio.RemoveObjectOptions{})
 
 	if be.IsNotExist(err) {
 		err = nil
 	}
+	if err != nil && isAccessDenied(err) {
+		err = be.checkRetained(ctx, h, err)
+	}
 
 	return errors.Wrap(err, "client.RemoveObject")
 }
@@ -444,13 +517,15 @@ func (be *Backend) Rename(ctx context.Context, h backend.Handle, l layout.Layout
 	debug.Log("  %v -> %v", oldname, newname)
 
 	src := minio.CopySrcOptions{
-		Bucket: be.cfg.Bucket,
-		Object: oldname,
+		Bucket:     be.cfg.Bucket,
+		Object:     oldname,
+		Encryption: be.readSSE(),
 	}
 
 	dst := minio.CopyDestOptions{
-		Bucket: be.cfg.Bucket,
-		Object: newname,
+		Bucket:     be.cfg.Bucket,
+		Object:     newname,
+		Encryption: be.sse,
 	}
 
 	_, err := be.client.CopyObject(ctx, dst, src)
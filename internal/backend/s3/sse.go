@@ -0,0 +1,73 @@
+package s3
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/restic/restic/internal/errors"
+)
+
+// parseSSE checks the server-side encryption settings of the config and
+// returns the encryption to use for new files, which is nil if server-side
+// encryption is not configured.
+func parseSSE(cfg Config) (encrypt.ServerSide, error) {
+	key := cfg.SSECustomerKey.Unwrap()
+
+	switch strings.ToLower(cfg.SSEAlgorithm) {
+	case "":
+		if cfg.SSEKMSKeyID != "" {
+			return nil, errors.Fatal("s3: sse-kms-key-id requires sse-algorithm=aws:kms")
+		}
+		if key != "" {
+			return nil, errors.Fatal("s3: an SSE-C key requires sse-algorithm=SSE-C")
+		}
+		return nil, nil
+
+	case "aes256":
+		if cfg.SSEKMSKeyID != "" || key != "" {
+			return nil, errors.Fatal("s3: sse-algorithm=AES256 does not use a key")
+		}
+		return encrypt.NewSSE(), nil
+
+	case "aws:kms":
+		if key != "" {
+			return nil, errors.Fatal("s3: sse-algorithm=aws:kms does not use an SSE-C key")
+		}
+		sse, err := encrypt.NewSSEKMS(cfg.SSEKMSKeyID, nil)
+		return sse, errors.WithStack(err)
+
+	case "sse-c":
+		if cfg.SSEKMSKeyID != "" {
+			return nil, errors.Fatal("s3: sse-algorithm=SSE-C does not use a KMS key")
+		}
+		if key == "" {
+			return nil, errors.Fatal("s3: sse-algorithm=SSE-C requires a key in $RESTIC_S3_SSE_C_KEY")
+		}
+		if cfg.UseHTTP {
+			return nil, errors.Fatal("s3: SSE-C requires HTTPS")
+		}
+
+		buf, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, errors.Fatalf("s3: invalid SSE-C key, must be base64 encoded: %v", err)
+		}
+		sse, err := encrypt.NewSSEC(buf)
+		if err != nil {
+			return nil, errors.Fatalf("s3: invalid SSE-C key: %v", err)
+		}
+		return sse, nil
+
+	default:
+		return nil, errors.Fatalf(`s3: invalid sse-algorithm %q, must be "AES256", "aws:kms" or "SSE-C"`, cfg.SSEAlgorithm)
+	}
+}
+
+// readSSE returns the encryption which must be sent when reading files. Only
+// SSE-C requires the key for reading.
+func (be *Backend) readSSE() encrypt.ServerSide {
+	if be.sse != nil && be.sse.Type() == encrypt.SSEC {
+		return be.sse
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package s3
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/restic/restic/internal/options"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+var testSSECKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+func TestParseSSE(t *testing.T) {
+	for _, test := range []struct {
+		cfg Config
+		typ encrypt.Type
+	}{
+		{Config{SSEAlgorithm: "AES256"}, encrypt.S3},
+		{Config{SSEAlgorithm: "aws:kms"}, encrypt.KMS},
+		{Config{SSEAlgorithm: "aws:kms", SSEKMSKeyID: "arn:aws:kms:us-east-1:123456789012:key/abcd"}, encrypt.KMS},
+		{Config{SSEAlgorithm: "sse-c", SSECustomerKey: options.NewSecretString(testSSECKey)}, encrypt.SSEC},
+	} {
+		sse, err := parseSSE(test.cfg)
+		rtest.OK(t, err)
+		rtest.Equals(t, test.typ, sse.Type())
+	}
+
+	sse, err := parseSSE(Config{})
+	rtest.OK(t, err)
+	rtest.Assert(t, sse == nil, "unexpected server-side encryption %v", sse)
+}
+
+func TestParseSSEInvalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{SSEKMSKeyID: "key"},
+		{SSECustomerKey: options.NewSecretString(testSSECKey)},
+		{SSEAlgorithm: "AES256", SSEKMSKeyID: "key"},
+		{SSEAlgorithm: "aws:kms", SSECustomerKey: options.NewSecretString(testSSECKey)},
+		{SSEAlgorithm: "SSE-C"},
+		{SSEAlgorithm: "SSE-C", SSECustomerKey: options.NewSecretString("not base64")},
+		{SSEAlgorithm: "SSE-C", SSECustomerKey: options.NewSecretString(base64.StdEncoding.EncodeToString([]byte("short")))},
+		{SSEAlgorithm: "SSE-C", SSECustomerKey: options.NewSecretString(testSSECKey), UseHTTP: true},
+		{SSEAlgorithm: "rot13"},
+	} {
+		_, err := parseSSE(cfg)
+		rtest.Assert(t, err != nil, "missing error for config %#v", cfg)
+	}
+}
+
+func TestApplyEnvironmentSSE(t *testing.T) {
+	t.Setenv("RESTIC_S3_SSE_ALGORITHM", "aws:kms")
+	t.Setenv("RESTIC_S3_SSE_KMS_KEY_ID", "envkey")
+	t.Setenv("RESTIC_S3_SSE_C_KEY", testSSECKey)
+
+	cfg := NewConfig()
+	cfg.ApplyEnvironment("")
+	rtest.Equals(t, "aws:kms", cfg.SSEAlgorithm)
+	rtest.Equals(t, "envkey", cfg.SSEKMSKeyID)
+	rtest.Equals(t, testSSECKey, cfg.SSECustomerKey.Unwrap())
+
+	// extended options take precedence
+	cfg = NewConfig()
+	cfg.SSEAlgorithm = "AES256"
+	cfg.SSEKMSKeyID = "optkey"
+	cfg.ApplyEnvironment("")
+	rtest.Equals(t, "AES256", cfg.SSEAlgorithm)
+	rtest.Equals(t, "optkey", cfg.SSEKMSKeyID)
+}
@@ -0,0 +1,188 @@
+package sema
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+)
+
+const (
+	// initialConnections is the number of connections the adaptive limit
+	// starts with
+	initialConnections = 2
+	// minWindow is the minimum number of operations used to calculate the
+	// average latency
+	minWindow = 4
+	// latencyFactor is how much the average latency may rise above the lowest
+	// one observed before the connections are reduced
+	latencyFactor = 2
+	// maxHistory is the number of changes which are remembered
+	maxHistory = 100
+)
+
+// ConnectionChange records a change of the number of connections.
+type ConnectionChange struct {
+	Time        time.Time
+	Connections uint
+	Reason      string
+}
+
+// ConnectionStats describes the connections chosen by the adaptive limit.
+type ConnectionStats struct {
+	Connections uint
+	Max         uint
+	// History contains the most recent changes, starting with the initial
+	// number of connections.
+	History []ConnectionChange
+}
+
+// latencyClass groups operations which are expected to have a similar latency.
+type latencyClass struct {
+	op string
+	t  backend.FileType
+	// sizeBits is the logarithm of the size in units of 64 KiB
+	sizeBits int
+}
+
+func newLatencyClass(op string, t backend.FileType, size int64) latencyClass {
+	if size < 0 {
+		size = 0
+	}
+	return latencyClass{op: op, t: t, sizeBits: bits.Len64(uint64(size) >> 16)}
+}
+
+// tuner adjusts the capacity of a semaphore like TCP congestion control:
+// the connections are raised by one if the latency does not rise while all
+// connections are in use, lowered by one if the latency rises and halved if
+// the backend reports errors.
+type tuner struct {
+	sem *semaphore
+	max uint
+	now func() time.Time
+
+	m     sync.Mutex
+	limit uint
+	// errors of operations which were started before the last decrease are
+	// ignored, they were caused by the old limit
+	lastDecrease time.Time
+	// windowSum and windowCount collect the latency of successful
+	// operations, relative to the lowest latency of their class
+	windowSum   float64
+	windowCount uint
+	minLatency  map[latencyClass]time.Duration
+	history     []ConnectionChange
+}
+
+func newTuner(sem *semaphore, max uint) *tuner {
+	t := &tuner{
+		sem:        sem,
+		max:        max,
+		now:        time.Now,
+		minLatency: make(map[latencyClass]time.Duration),
+	}
+	limit := uint(initialConnections)
+	if limit > max {
+		limit = max
+	}
+	t.set(limit, "initial")
+	return t
+}
+
+// set changes the limit. The caller must hold the lock, unless the tuner is
+// not in use yet.
+func (t *tuner) set(limit uint, reason string) {
+	debug.Log("connections %d -> %d: %v", t.limit, limit, reason)
+	t.limit = limit
+	t.sem.setLimit(limit)
+	t.windowSum, t.windowCount = 0, 0
+
+	t.history = append(t.history, ConnectionChange{Time: t.now(), Connections: limit, Reason: reason})
+	if len(t.history) > maxHistory {
+		t.history = t.history[len(t.history)-maxHistory:]
+	}
+}
+
+// success records the latency of a successful operation.
+func (t *tuner) success(class latencyClass, latency time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if latency <= 0 {
+		latency = 1
+	}
+	best, ok := t.minLatency[class]
+	if !ok || latency < best {
+		best = latency
+		t.minLatency[class] = best
+	}
+	t.windowSum += float64(latency) / float64(best)
+	t.windowCount++
+	window := 2 * t.limit
+	if window < minWindow {
+		window = minWindow
+	}
+	if t.windowCount < window {
+		return
+	}
+
+	avg := t.windowSum / float64(t.windowCount)
+	t.windowSum, t.windowCount = 0, 0
+	saturated := t.sem.saturated()
+
+	switch {
+	case avg > latencyFactor:
+		if t.limit > 1 {
+			t.lastDecrease = t.now()
+			t.set(t.limit-1, "latency increased")
+		}
+	case saturated && t.limit < t.max:
+		// more connections are only useful if all of them are in use
+		t.set(t.limit+1, "latency stable")
+	}
+}
+
+// failure halves the limit after an operation started at start has failed.
+func (t *tuner) failure(start time.Time, reason string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if start.Before(t.lastDecrease) {
+		return
+	}
+	t.lastDecrease = t.now()
+	if limit := t.limit / 2; limit >= 1 {
+		t.set(limit, reason)
+	}
+}
+
+// Choices returns the number of connections of each change in the history.
+func (s ConnectionStats) Choices() []uint {
+	var choices []uint
+	for _, c := range s.History {
+		choices = append(choices, c.Connections)
+	}
+	return choices
+}
+
+func (t *tuner) stats() ConnectionStats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return ConnectionStats{
+		Connections: t.limit,
+		Max:         t.max,
+		History:     append([]ConnectionChange(nil), t.history...),
+	}
+}
+
+// AdaptiveConnections returns the connections chosen for be. It returns false
+// if be was not created by NewAdaptiveBackend.
+func AdaptiveConnections(be backend.Backend) (ConnectionStats, bool) {
+	cbe := backend.AsBackend[*connectionLimitedBackend](be)
+	if cbe == nil || cbe.tuner == nil {
+		return ConnectionStats{}, false
+	}
+	return cbe.tuner.stats(), true
+}
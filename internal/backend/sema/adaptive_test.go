@@ -0,0 +1,141 @@
+package sema
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/mock"
+	"github.com/restic/restic/internal/errors"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func newTestTuner(t testing.TB, max uint) (*tuner, *semaphore) {
+	sem, err := newSemaphore(max)
+	rtest.OK(t, err)
+	return newTuner(sem, max), sem
+}
+
+// runWindow reports a window of successful operations with the given latency.
+func runWindow(tn *tuner, latency time.Duration, saturated bool) {
+	class := newLatencyClass("save", backend.PackFile, 16*1024*1024)
+	window := 2 * tn.limit
+	if window < minWindow {
+		window = minWindow
+	}
+	for i := uint(0); i < window; i++ {
+		if saturated {
+			tn.sem.m.Lock()
+			tn.sem.waited = true
+			tn.sem.m.Unlock()
+		}
+		tn.success(class, latency)
+	}
+}
+
+func TestTunerIncrease(t *testing.T) {
+	tn, sem := newTestTuner(t, 5)
+	rtest.Equals(t, uint(2), sem.limit)
+
+	// the connections are not raised if they are not all in use
+	runWindow(tn, 10*time.Millisecond, false)
+	rtest.Equals(t, uint(2), tn.limit)
+
+	for i := 0; i < 10; i++ {
+		runWindow(tn, 10*time.Millisecond, true)
+	}
+	rtest.Equals(t, uint(5), tn.limit)
+	rtest.Equals(t, uint(5), sem.limit)
+	rtest.Equals(t, []uint{2, 3, 4, 5}, tn.stats().Choices())
+}
+
+func TestTunerLatency(t *testing.T) {
+	tn, _ := newTestTuner(t, 10)
+	for i := 0; i < 3; i++ {
+		runWindow(tn, 10*time.Millisecond, true)
+	}
+	rtest.Equals(t, uint(5), tn.limit)
+
+	// rising latency lowers the connections
+	runWindow(tn, 30*time.Millisecond, true)
+	rtest.Equals(t, uint(4), tn.limit)
+	rtest.Equals(t, "latency increased", tn.history[len(tn.history)-1].Reason)
+
+	// slower operations of a different class do not count as rising latency
+	class := newLatencyClass("load", backend.PackFile, 0)
+	for i := 0; i < 20; i++ {
+		tn.success(class, time.Second)
+	}
+	rtest.Equals(t, uint(4), tn.limit)
+}
+
+func TestTunerFailure(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tn, sem := newTestTuner(t, 16)
+	tn.now = func() time.Time { return now }
+	for i := 0; i < 6; i++ {
+		runWindow(tn, 10*time.Millisecond, true)
+	}
+	rtest.Equals(t, uint(8), tn.limit)
+
+	start := now
+	now = now.Add(time.Second)
+	tn.failure(start, "throttled")
+	rtest.Equals(t, uint(4), tn.limit)
+	rtest.Equals(t, uint(4), sem.limit)
+
+	// operations which were started before the decrease are ignored
+	tn.failure(start, "throttled")
+	rtest.Equals(t, uint(4), tn.limit)
+
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		tn.failure(now, "error")
+	}
+	// at least one connection remains
+	rtest.Equals(t, uint(1), tn.limit)
+	rtest.Equals(t, []uint{2, 3, 4, 5, 6, 7, 8, 4, 2, 1}, tn.stats().Choices())
+}
+
+func TestTunerMax(t *testing.T) {
+	tn, sem := newTestTuner(t, 1)
+	runWindow(tn, 10*time.Millisecond, true)
+	rtest.Equals(t, uint(1), sem.limit)
+	rtest.Equals(t, ConnectionStats{Connections: 1, Max: 1, History: tn.history}, tn.stats())
+}
+
+func TestAdaptiveBackend(t *testing.T) {
+	errNotExist := errors.New("not found")
+	m := mock.NewBackend()
+	m.ConnectionsFn = func() uint { return 8 }
+	m.IsNotExistFn = func(err error) bool { return err == errNotExist }
+	m.StatFn = func(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+		return backend.FileInfo{}, errNotExist
+	}
+	m.RemoveFn = func(ctx context.Context, h backend.Handle) error {
+		return errors.New("remove failed")
+	}
+
+	_, ok := AdaptiveConnections(NewBackend(m))
+	rtest.Assert(t, !ok, "static limit reported as adaptive")
+
+	be := NewAdaptiveBackend(m)
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	_, err := be.Stat(context.TODO(), h)
+	rtest.Equals(t, errNotExist, err)
+	stats, ok := AdaptiveConnections(be)
+	rtest.Assert(t, ok, "missing adaptive limit")
+	rtest.Equals(t, uint(2), stats.Connections)
+	rtest.Equals(t, uint(8), stats.Max)
+
+	// operations on lock files are not limited
+	rtest.Assert(t, be.Remove(context.TODO(), backend.Handle{Type: backend.LockFile, Name: "foo"}) != nil, "missing error")
+	stats, _ = AdaptiveConnections(be)
+	rtest.Equals(t, uint(2), stats.Connections)
+
+	rtest.Assert(t, be.Remove(context.TODO(), h) != nil, "missing error")
+	stats, _ = AdaptiveConnections(be)
+	rtest.Equals(t, uint(1), stats.Connections)
+	rtest.Equals(t, "error", stats.History[1].Reason)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/restic/restic/internal/backend"
@@ -16,8 +17,13 @@ var _ backend.Backend = &connectionLimitedBackend{}
 // connectionLimitedBackend limits the number of concurrent operations.
 type connectionLimitedBackend struct {
 	backend.Backend
-	sem        semaphore
+	sem        *semaphore
 	freezeLock sync.Mutex
+	// tuner is only set if the limit is adaptive
+	tuner *tuner
+	// uploads limits the uploads of pack files separately from the other
+	// operations, it is nil if they share the same limit
+	uploads *semaphore
 }
 
 // NewBackend creates a backend that limits the concurrent operations on the underlying backend
@@ -33,6 +39,32 @@ func NewBackend(be backend.Backend) backend.Backend {
 	}
 }
 
+// NewAdaptiveBackend creates a backend that limits the concurrent operations
+// on the underlying backend. The limit starts low and is adjusted to the
+// latency and the errors of the operations, up to be.Connections().
+func NewAdaptiveBackend(be backend.Backend) backend.Backend {
+	cbe := NewBackend(be).(*connectionLimitedBackend)
+	cbe.tuner = newTuner(cbe.sem, be.Connections())
+	return cbe
+}
+
+// LimitUploads limits the number of concurrent uploads of pack files to n.
+// These uploads then no longer count towards the connection limit, which only
+// applies to the other operations. It must be called before be is used and
+// returns false if be was not created by NewBackend or NewAdaptiveBackend.
+func LimitUploads(be backend.Backend, n uint) bool {
+	cbe := backend.AsBackend[*connectionLimitedBackend](be)
+	if cbe == nil {
+		return false
+	}
+	sem, err := newSemaphore(n)
+	if err != nil {
+		panic(err)
+	}
+	cbe.uploads = sem
+	return true
+}
+
 // typeDependentLimit acquire a token unless the FileType is a lock file. The returned function
 // must be called to release the token.
 func (be *connectionLimitedBackend) typeDependentLimit(t backend.FileType) func() {
@@ -48,6 +80,40 @@ func (be *connectionLimitedBackend) typeDependentLimit(t backend.FileType) func(
 	return be.sem.ReleaseToken
 }
 
+// uploadLimit acquires a token for uploading a pack file. The returned
+// function must be called to release the token.
+func (be *connectionLimitedBackend) uploadLimit() func() {
+	be.uploads.GetToken()
+	be.freezeLock.Lock()
+	defer be.freezeLock.Unlock()
+
+	return be.uploads.ReleaseToken
+}
+
+// observe reports the result of an operation that was started at start to
+// the adaptive limit.
+func (be *connectionLimitedBackend) observe(op string, t backend.FileType, size int64, start time.Time, err error) {
+	if be.tuner == nil || t == backend.LockFile {
+		return
+	}
+
+	if err == nil {
+		be.tuner.success(newLatencyClass(op, t, size), time.Since(start))
+		return
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || be.Backend.IsNotExist(err) {
+		return
+	}
+	if c := backend.AsBackend[backend.PermanentErrorClassifier](be.Backend); c != nil && c.IsPermanentError(err) {
+		return
+	}
+	if c := backend.AsBackend[backend.ThrottleClassifier](be.Backend); c != nil && c.IsThrottled(err) {
+		be.tuner.failure(start, "throttled")
+		return
+	}
+	be.tuner.failure(start, "error")
+}
+
 // Freeze blocks all backend operations except those on lock files
 func (be *connectionLimitedBackend) Freeze() {
 	be.freezeLock.Lock()
@@ -64,13 +130,24 @@ func (be *connectionLimitedBackend) Save(ctx context.Context, h backend.Handle,
 		return backoff.Permanent(err)
 	}
 
-	defer be.typeDependentLimit(h.Type)()
+	if be.uploads != nil && h.Type == backend.PackFile {
+		defer be.uploadLimit()()
+	} else {
+		defer be.typeDependentLimit(h.Type)()
+	}
 
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 
-	return be.Backend.Save(ctx, h, rd)
+	var size int64
+	if rd != nil {
+		size = rd.Length()
+	}
+	start := time.Now()
+	err := be.Backend.Save(ctx, h, rd)
+	be.observe("save", h.Type, size, start, err)
+	return err
 }
 
 // Load runs fn with a reader that yields the contents of the file at h at the
@@ -92,7 +169,10 @@ func (be *connectionLimitedBackend) Load(ctx context.Context, h backend.Handle,
 		return ctx.Err()
 	}
 
-	return be.Backend.Load(ctx, h, length, offset, fn)
+	start := time.Now()
+	err := be.Backend.Load(ctx, h, length, offset, fn)
+	be.observe("load", h.Type, int64(length), start, err)
+	return err
 }
 
 // Stat returns information about a file in the backend.
@@ -107,7 +187,10 @@ func (be *connectionLimitedBackend) Stat(ctx context.Context, h backend.Handle)
 		return backend.FileInfo{}, ctx.Err()
 	}
 
-	return be.Backend.Stat(ctx, h)
+	start := time.Now()
+	fi, err := be.Backend.Stat(ctx, h)
+	be.observe("stat", h.Type, 0, start, err)
+	return fi, err
 }
 
 // Remove deletes a file from the backend.
@@ -122,7 +205,10 @@ func (be *connectionLimitedBackend) Remove(ctx context.Context, h backend.Handle
 		return ctx.Err()
 	}
 
-	return be.Backend.Remove(ctx, h)
+	start := time.Now()
+	err := be.Backend.Remove(ctx, h)
+	be.observe("remove", h.Type, 0, start, err)
+	return err
 }
 
 func (be *connectionLimitedBackend) Unwrap() backend.Backend {
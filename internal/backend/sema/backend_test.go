@@ -199,6 +199,39 @@ func TestConcurrencyUnlimitedLockSave(t *testing.T) {
 	}, unblock, true)
 }
 
+func TestConcurrencyLimitUploads(t *testing.T) {
+	wait, unblock := countingBlocker()
+	m := mock.NewBackend()
+	m.SaveFn = func(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+		wait()
+		return nil
+	}
+	m.StatFn = func(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+		return backend.FileInfo{}, nil
+	}
+	m.ConnectionsFn = func() uint { return 2 }
+	be := sema.NewBackend(m)
+	test.Assert(t, sema.LimitUploads(be, 4), "LimitUploads failed")
+
+	var wg errgroup.Group
+	for i := 0; i < 5; i++ {
+		wg.Go(func() error {
+			h := backend.Handle{Type: backend.PackFile, Name: "foobar"}
+			return be.Save(context.TODO(), h, nil)
+		})
+	}
+
+	// uploads do not use the connections of other operations
+	for i := 0; i < 3; i++ {
+		_, err := be.Stat(context.TODO(), backend.Handle{Type: backend.PackFile, Name: "foobar"})
+		test.OK(t, err)
+	}
+
+	blocked := unblock(4)
+	test.Equals(t, 4, blocked)
+	test.OK(t, wg.Wait())
+}
+
 func TestFreeze(t *testing.T) {
 	var counter int64
 	m := mock.NewBackend()
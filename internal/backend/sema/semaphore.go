@@ -2,30 +2,67 @@
 package sema
 
 import (
+	"sync"
+
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
 )
 
 // A semaphore limits access to a restricted resource.
 type semaphore struct {
-	ch chan struct{}
+	m     sync.Mutex
+	cond  *sync.Cond
+	limit uint
+	used  uint
+	// waited is set when GetToken had to wait for a token
+	waited bool
 }
 
 // newSemaphore returns a new semaphore with capacity n.
-func newSemaphore(n uint) (semaphore, error) {
+func newSemaphore(n uint) (*semaphore, error) {
 	if n == 0 {
-		return semaphore{}, errors.New("capacity must be a positive number")
+		return nil, errors.New("capacity must be a positive number")
 	}
-	return semaphore{
-		ch: make(chan struct{}, n),
-	}, nil
+	s := &semaphore{limit: n}
+	s.cond = sync.NewCond(&s.m)
+	return s, nil
 }
 
 // GetToken blocks until a Token is available.
-func (s semaphore) GetToken() {
-	s.ch <- struct{}{}
+func (s *semaphore) GetToken() {
+	s.m.Lock()
+	for s.used >= s.limit {
+		s.waited = true
+		s.cond.Wait()
+	}
+	s.used++
+	s.m.Unlock()
 	debug.Log("acquired token")
 }
 
 // ReleaseToken returns a token.
-func (s semaphore) ReleaseToken() { <-s.ch }
+func (s *semaphore) ReleaseToken() {
+	s.m.Lock()
+	s.used--
+	s.m.Unlock()
+	s.cond.Signal()
+}
+
+// setLimit changes the capacity to n. Tokens which are in use beyond the new
+// capacity remain valid until they are released.
+func (s *semaphore) setLimit(n uint) {
+	s.m.Lock()
+	s.limit = n
+	s.m.Unlock()
+	s.cond.Broadcast()
+}
+
+// saturated returns true if GetToken had to wait for a token since the last
+// call.
+func (s *semaphore) saturated() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	waited := s.waited
+	s.waited = false
+	return waited
+}
@@ -18,6 +18,7 @@ type Config struct {
 	Args    string `option:"args"    help:"specify arguments for ssh"`
 
 	Connections uint `option:"connections" help:"set a limit for the number of concurrent connections (default: 5)"`
+	Sessions    uint `option:"sessions" help:"maximum number of SSH sessions used for concurrent operations (default: number of connections)"`
 }
 
 // NewConfig returns a new config with default options applied.
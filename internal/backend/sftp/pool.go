@@ -0,0 +1,237 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+
+	"github.com/pkg/sftp"
+)
+
+// session is a single SFTP session, usually provided by an ssh process.
+type session struct {
+	c *sftp.Client
+
+	// cmd is nil if the session does not use a separate process
+	cmd    *exec.Cmd
+	result <-chan error
+	// lost is closed when the connection of the client has been shut down
+	lost chan struct{}
+}
+
+func newSession(c *sftp.Client, cmd *exec.Cmd, result <-chan error) *session {
+	s := &session{c: c, cmd: cmd, result: result, lost: make(chan struct{})}
+	go func() {
+		err := c.Wait()
+		debug.Log("sftp connection has been shut down: %v", err)
+		close(s.lost)
+	}()
+	return s
+}
+
+// exited returns an error if the ssh process has exited or the connection
+// was lost. Otherwise, nil is returned immediately.
+func (s *session) exited() error {
+	select {
+	case err := <-s.result:
+		debug.Log("client has exited with err %v", err)
+		if err == nil {
+			err = errors.New("ssh command exited")
+		}
+		return err
+	case <-s.lost:
+		return sftp.ErrSSHFxConnectionLost
+	default:
+	}
+
+	return nil
+}
+
+var closeTimeout = 2 * time.Second
+
+// close closes the sftp connection and terminates the underlying command.
+func (s *session) close() error {
+	err := s.c.Close()
+	debug.Log("Close returned error %v", err)
+
+	// wait for closeTimeout before killing the process
+	select {
+	case err := <-s.result:
+		return err
+	case <-time.After(closeTimeout):
+	}
+
+	if s.cmd == nil {
+		return nil
+	}
+	if err := s.cmd.Process.Kill(); err != nil {
+		return err
+	}
+
+	// get the error, but ignore it
+	<-s.result
+	return nil
+}
+
+// pool manages the sessions used by the backend. Sessions are started on
+// demand up to the size of the pool. Sessions whose process has exited or
+// whose connection was lost are replaced by new ones.
+type pool struct {
+	start func() (*session, error)
+	// startMu serializes starting sessions, as ssh may ask for a password
+	startMu sync.Mutex
+
+	// tokens contains one token for each session which may be in use
+	tokens chan struct{}
+
+	m    sync.Mutex
+	idle []*session
+	open int
+	size int
+	// drop is the number of tokens to discard after the pool was shrunk
+	drop int
+}
+
+// newPool returns a pool of at most size sessions, which already contains
+// the session first.
+func newPool(first *session, size int, start func() (*session, error)) *pool {
+	if size < 1 {
+		size = 1
+	}
+
+	p := &pool{
+		start:  start,
+		tokens: make(chan struct{}, size),
+		idle:   []*session{first},
+		open:   1,
+		size:   size,
+	}
+	for i := 0; i < size; i++ {
+		p.tokens <- struct{}{}
+	}
+	return p
+}
+
+// get returns an idle session or starts a new one. It blocks until the pool
+// has room for another session in use.
+func (p *pool) get(ctx context.Context) (*session, error) {
+	for {
+		select {
+		case <-p.tokens:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		s, err := p.take()
+		if s != nil || err != nil {
+			return s, err
+		}
+		// the token was dropped as the pool has been shrunk
+	}
+}
+
+func (p *pool) take() (*session, error) {
+	p.m.Lock()
+	if p.drop > 0 {
+		p.drop--
+		p.m.Unlock()
+		return nil, nil
+	}
+
+	for len(p.idle) > 0 {
+		s := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if s.exited() == nil {
+			p.m.Unlock()
+			return s, nil
+		}
+
+		// replace the dead session
+		p.open--
+		_ = s.c.Close()
+	}
+	p.open++
+	p.m.Unlock()
+
+	p.startMu.Lock()
+	s, err := p.start()
+	p.startMu.Unlock()
+	if err == nil {
+		return s, nil
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.open--
+	if p.open == 0 {
+		// no working session is left
+		p.tokens <- struct{}{}
+		return nil, err
+	}
+
+	// the server probably limits the number of sessions, continue with the
+	// sessions which have been started successfully. The token of this
+	// call is dropped right away.
+	p.drop += p.size - p.open - 1
+	p.size = p.open
+	debug.Log("unable to start session, reducing pool size to %d: %v", p.size, err)
+	fmt.Fprintf(os.Stderr, "sftp: unable to start another session, continuing with %d sessions: %v\n", p.size, err)
+	return nil, nil
+}
+
+// put returns the session s to the pool. err is the result of the last
+// operation, sessions whose connection was lost are discarded.
+func (p *pool) put(s *session, err error) {
+	discard := errors.Is(err, sftp.ErrSSHFxConnectionLost) || s.exited() != nil
+	if discard {
+		debug.Log("discarding session: %v", err)
+		_ = s.close()
+	}
+
+	p.m.Lock()
+	if discard {
+		p.open--
+	} else {
+		p.idle = append(p.idle, s)
+	}
+	if p.drop > 0 {
+		// the pool has been shrunk
+		p.drop--
+		p.m.Unlock()
+		return
+	}
+	p.m.Unlock()
+
+	p.tokens <- struct{}{}
+}
+
+// capacity returns the maximum number of sessions.
+func (p *pool) capacity() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.size
+}
+
+// close closes all idle sessions.
+func (p *pool) close() error {
+	p.m.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	p.m.Unlock()
+
+	var firstErr error
+	for _, s := range idle {
+		if err := s.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
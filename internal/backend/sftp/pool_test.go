@@ -0,0 +1,272 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/limiter"
+	"github.com/restic/restic/internal/backend/location"
+	"github.com/restic/restic/internal/backend/test"
+	"github.com/restic/restic/internal/errors"
+	rtest "github.com/restic/restic/internal/test"
+
+	"github.com/pkg/sftp"
+)
+
+// inProcessServer starts sessions served by an in-process sftp server.
+type inProcessServer struct {
+	// limitKb restricts the bandwidth of each session if it is larger than zero
+	limitKb int
+	// maxSessions restricts the number of concurrent sessions if it is larger than zero
+	maxSessions int32
+	// refuse lets starting new sessions fail
+	refuse bool
+
+	open    int32
+	started int32
+
+	m        sync.Mutex
+	sessions []*session
+	conns    []io.Closer
+}
+
+type pipeCloser struct {
+	io.Writer
+	io.Closer
+}
+
+func (s *inProcessServer) start() (*session, error) {
+	if s.refuse || (s.maxSessions > 0 && atomic.LoadInt32(&s.open) >= s.maxSessions) {
+		return nil, errors.New("administratively prohibited: open failed")
+	}
+
+	c2sR, c2sW := io.Pipe()
+	s2cR, s2cW := io.Pipe()
+
+	srv, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{c2sR, s2cW})
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt32(&s.open, 1)
+	atomic.AddInt32(&s.started, 1)
+	ch := make(chan error, 1)
+	go func() {
+		err := srv.Serve()
+		_ = c2sR.Close()
+		_ = s2cW.Close()
+		atomic.AddInt32(&s.open, -1)
+		for {
+			ch <- err
+		}
+	}()
+
+	var rd io.Reader = s2cR
+	var wr io.WriteCloser = c2sW
+	if s.limitKb > 0 {
+		lim := limiter.NewStaticLimiter(limiter.Limits{UploadKb: s.limitKb, DownloadKb: s.limitKb})
+		rd = lim.Downstream(rd)
+		wr = pipeCloser{Writer: lim.UpstreamWriter(c2sW), Closer: c2sW}
+	}
+
+	client, err := sftp.NewClientPipe(rd, wr)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := newSession(client, nil, ch)
+	s.m.Lock()
+	s.sessions = append(s.sessions, sess)
+	s.conns = append(s.conns, c2sW)
+	s.m.Unlock()
+
+	return sess, nil
+}
+
+// disconnect terminates all sessions started so far and waits until the
+// clients have noticed.
+func (s *inProcessServer) disconnect() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	for _, sess := range s.sessions {
+		<-sess.lost
+	}
+	s.conns = nil
+	s.sessions = nil
+}
+
+func (s *inProcessServer) factory() location.Factory {
+	create := func(ctx context.Context, cfg Config) (*SFTP, error) {
+		return createWith(ctx, cfg, s.start)
+	}
+	open := func(ctx context.Context, cfg Config) (*SFTP, error) {
+		return openWith(ctx, cfg, s.start)
+	}
+	return location.NewLimitedBackendFactory("sftp", ParseConfig, location.NoPassword, limiter.WrapBackendConstructor(create), limiter.WrapBackendConstructor(open))
+}
+
+func newInProcessTestSuite(t testing.TB, srv *inProcessServer, sessions uint) *test.Suite[Config] {
+	return &test.Suite[Config]{
+		NewConfig: func() (*Config, error) {
+			cfg := NewConfig()
+			cfg.Path = rtest.TempDir(t)
+			cfg.Sessions = sessions
+			return &cfg, nil
+		},
+
+		Factory: srv.factory(),
+	}
+}
+
+func TestBackendSFTPInProcess(t *testing.T) {
+	newInProcessTestSuite(t, &inProcessServer{}, 0).RunTests(t)
+}
+
+func newInProcessBackend(t testing.TB, srv *inProcessServer, sessions uint) *SFTP {
+	cfg := NewConfig()
+	cfg.Path = rtest.TempDir(t)
+	cfg.Sessions = sessions
+
+	be, err := createWith(context.TODO(), cfg, srv.start)
+	rtest.OK(t, err)
+	t.Cleanup(func() {
+		_ = be.Close()
+	})
+	return be
+}
+
+func TestPoolReconnect(t *testing.T) {
+	srv := &inProcessServer{}
+	be := newInProcessBackend(t, srv, 2)
+
+	h := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	data := []byte("foobar")
+	rtest.OK(t, be.Save(context.TODO(), h, backend.NewByteReader(data, nil)))
+
+	srv.disconnect()
+	started := atomic.LoadInt32(&srv.started)
+
+	fi, err := be.Stat(context.TODO(), h)
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(len(data)), fi.Size)
+	rtest.Assert(t, atomic.LoadInt32(&srv.started) > started, "no new session was started")
+}
+
+func TestPoolMaxSessions(t *testing.T) {
+	srv := &inProcessServer{maxSessions: 2}
+	be := newInProcessBackend(t, srv, 4)
+
+	h := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	rtest.OK(t, be.Save(context.TODO(), h, backend.NewByteReader([]byte("foobar"), nil)))
+
+	// hold two sessions
+	var readers []io.ReadCloser
+	for i := 0; i < 2; i++ {
+		rd, err := be.openReader(context.TODO(), h, 0, 0)
+		rtest.OK(t, err)
+		readers = append(readers, rd)
+	}
+
+	// starting the third session fails, the operation waits for one of the
+	// other sessions
+	done := make(chan error, 1)
+	go func() {
+		rd, err := be.openReader(context.TODO(), h, 0, 0)
+		if err == nil {
+			err = rd.Close()
+		}
+		done <- err
+	}()
+
+	for _, rd := range readers {
+		rtest.OK(t, rd.Close())
+	}
+	rtest.OK(t, <-done)
+	rtest.Equals(t, 2, be.pool.capacity())
+
+	// the pool keeps working with the reduced size
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := be.Stat(context.TODO(), h)
+			rtest.OK(t, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolNoSession(t *testing.T) {
+	srv := &inProcessServer{}
+	be := newInProcessBackend(t, srv, 1)
+
+	srv.refuse = true
+	srv.disconnect()
+
+	// all sessions are dead and no new session can be started
+	h := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	_, err := be.Stat(context.TODO(), h)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "administratively prohibited"), "unexpected error %v", err)
+}
+
+// saveConcurrently saves n files using the given number of workers.
+func saveConcurrently(tb testing.TB, be *SFTP, workers int, n int, data []byte) {
+	var next int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i > int64(n) {
+					return
+				}
+				h := backend.Handle{Type: backend.PackFile, Name: fmt.Sprintf("%064x", i)}
+				if err := be.Save(context.TODO(), h, backend.NewByteReader(data, nil)); err != nil {
+					tb.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkPoolSessions saves files concurrently using sessions whose
+// bandwidth is limited, similar to ssh processes limited by the speed of a
+// single CPU core.
+func BenchmarkPoolSessions(b *testing.B) {
+	const (
+		workers  = 4
+		fileSize = 256 * 1024
+		limitKb  = 2048
+	)
+	data := bytes.Repeat([]byte("x"), fileSize)
+
+	for _, sessions := range []uint{1, 2, 4} {
+		b.Run(fmt.Sprintf("sessions-%d", sessions), func(b *testing.B) {
+			be := newInProcessBackend(b, &inProcessServer{limitKb: limitKb}, sessions)
+			// start all sessions and use up the initial burst of the limiters
+			saveConcurrently(b, be, workers, int(sessions)*limitKb*1024/fileSize, data)
+
+			b.SetBytes(fileSize)
+			b.ResetTimer()
+			saveConcurrently(b, be, workers, b.N, data)
+		})
+	}
+}
@@ -11,7 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"time"
+	"sync"
 
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/backend/layout"
@@ -26,15 +26,14 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-// SFTP is a backend in a directory accessed via SFTP.
+// SFTP is a backend in a directory accessed via SFTP. Concurrent operations
+// use separate sessions from a pool.
 type SFTP struct {
-	c *sftp.Client
-	p string
-
-	cmd    *exec.Cmd
-	result <-chan error
+	pool *pool
+	p    string
 
 	posixRename bool
+	statVFS     bool
 
 	layout.Layout
 	Config
@@ -49,7 +48,7 @@ func NewFactory() location.Factory {
 
 const defaultLayout = "default"
 
-func startClient(cfg Config) (*SFTP, error) {
+func startClient(cfg Config) (*session, error) {
 	program, args, err := buildSSHCommand(cfg)
 	if err != nil {
 		return nil, err
@@ -112,54 +111,89 @@ func startClient(cfg Config) (*SFTP, error) {
 		return nil, errors.Wrap(err, "bg")
 	}
 
-	_, posixRename := client.HasExtension("posix-rename@openssh.com")
-	return &SFTP{c: client, cmd: cmd, result: ch, posixRename: posixRename}, nil
+	return newSession(client, cmd, ch), nil
 }
 
-// clientError returns an error if the client has exited. Otherwise, nil is
-// returned immediately.
-func (r *SFTP) clientError() error {
-	select {
-	case err := <-r.result:
-		debug.Log("client has exited with err %v", err)
-		return backoff.Permanent(err)
-	default:
+// newBackend starts the first session and creates the session pool.
+func newBackend(cfg Config, start func() (*session, error)) (*SFTP, error) {
+	s, err := start()
+	if err != nil {
+		debug.Log("unable to start program: %v", err)
+		return nil, err
 	}
 
-	return nil
+	size := cfg.Sessions
+	if size == 0 {
+		size = cfg.Connections
+	}
+
+	_, posixRename := s.c.HasExtension("posix-rename@openssh.com")
+	_, statVFS := s.c.HasExtension("statvfs@openssh.com")
+	return &SFTP{
+		pool:        newPool(s, int(size), start),
+		posixRename: posixRename,
+		statVFS:     statVFS,
+	}, nil
+}
+
+func sshStarter(cfg Config) func() (*session, error) {
+	return func() (*session, error) {
+		return startClient(cfg)
+	}
 }
 
 // Open opens an sftp backend as described by the config by running
 // "ssh" with the appropriate arguments (or cfg.Command, if set).
 func Open(ctx context.Context, cfg Config) (*SFTP, error) {
+	return openWith(ctx, cfg, sshStarter(cfg))
+}
+
+func openWith(ctx context.Context, cfg Config, start func() (*session, error)) (*SFTP, error) {
 	debug.Log("open backend with config %#v", cfg)
 
-	sftp, err := startClient(cfg)
+	sftp, err := newBackend(cfg, start)
 	if err != nil {
-		debug.Log("unable to start program: %v", err)
 		return nil, err
 	}
 
 	return open(ctx, sftp, cfg)
 }
 
-func open(ctx context.Context, sftp *SFTP, cfg Config) (*SFTP, error) {
+func open(ctx context.Context, r *SFTP, cfg Config) (*SFTP, error) {
 	var err error
-	sftp.Layout, err = layout.ParseLayout(ctx, sftp, cfg.Layout, defaultLayout, cfg.Path)
+	r.Layout, err = layout.ParseLayout(ctx, r, cfg.Layout, defaultLayout, cfg.Path)
 	if err != nil {
+		_ = r.Close()
 		return nil, err
 	}
 
-	debug.Log("layout: %v\n", sftp.Layout)
+	debug.Log("layout: %v\n", r.Layout)
 
-	fi, err := sftp.c.Stat(sftp.Layout.Filename(backend.Handle{Type: backend.ConfigFile}))
+	var fi os.FileInfo
+	err = r.withClient(ctx, func(c *sftp.Client) error {
+		var err error
+		fi, err = c.Stat(r.Layout.Filename(backend.Handle{Type: backend.ConfigFile}))
+		return err
+	})
 	m := util.DeriveModesFromFileInfo(fi, err)
 	debug.Log("using (%03O file, %03O dir) permissions", m.File, m.Dir)
 
-	sftp.Config = cfg
-	sftp.p = cfg.Path
-	sftp.Modes = m
-	return sftp, nil
+	r.Config = cfg
+	r.p = cfg.Path
+	r.Modes = m
+	return r, nil
+}
+
+// withClient runs fn with the client of a session from the pool.
+func (r *SFTP) withClient(ctx context.Context, fn func(c *sftp.Client) error) error {
+	s, err := r.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(s.c)
+	r.pool.put(s, err)
+	return err
 }
 
 func (r *SFTP) mkdirAllDataSubdirs(ctx context.Context, nconn uint) error {
@@ -173,14 +207,16 @@ func (r *SFTP) mkdirAllDataSubdirs(ctx context.Context, nconn uint) error {
 	for _, d := range r.Paths() {
 		d := d
 		g.Go(func() error {
-			// First try Mkdir. For most directories in Paths, this takes one
-			// round trip, not counting duplicate parent creations causes by
-			// concurrency. MkdirAll first does Stat, then recursive MkdirAll
-			// on the parent, so calls typically take three round trips.
-			if err := r.c.Mkdir(d); err == nil {
-				return nil
-			}
-			return r.c.MkdirAll(d)
+			return r.withClient(ctx, func(c *sftp.Client) error {
+				// First try Mkdir. For most directories in Paths, this takes one
+				// round trip, not counting duplicate parent creations causes by
+				// concurrency. MkdirAll first does Stat, then recursive MkdirAll
+				// on the parent, so calls typically take three round trips.
+				if err := c.Mkdir(d); err == nil {
+					return nil
+				}
+				return c.MkdirAll(d)
+			})
 		})
 	}
 
@@ -193,8 +229,13 @@ func (r *SFTP) Join(p ...string) string {
 }
 
 // ReadDir returns the entries for a directory.
-func (r *SFTP) ReadDir(_ context.Context, dir string) ([]os.FileInfo, error) {
-	fi, err := r.c.ReadDir(dir)
+func (r *SFTP) ReadDir(ctx context.Context, dir string) ([]os.FileInfo, error) {
+	var fi []os.FileInfo
+	err := r.withClient(ctx, func(c *sftp.Client) error {
+		var err error
+		fi, err = c.ReadDir(dir)
+		return err
+	})
 
 	// sftp client does not specify dir name on error, so add it here
 	err = errors.Wrapf(err, "(%v)", dir)
@@ -207,6 +248,13 @@ func (r *SFTP) IsNotExist(err error) bool {
 	return errors.Is(err, os.ErrNotExist)
 }
 
+// IsDeletionForbidden returns true if the server does not allow removing the
+// file.
+func (r *SFTP) IsDeletionForbidden(err error) bool {
+	var e *sftp.StatusError
+	return errors.Is(err, os.ErrPermission) || (errors.As(err, &e) && e.FxCode() == sftp.ErrSSHFxPermissionDenied)
+}
+
 func buildSSHCommand(cfg Config) (cmd string, args []string, err error) {
 	if cfg.Command != "" {
 		args, err := backend.SplitShellStrings(cfg.Command)
@@ -248,32 +296,41 @@ func buildSSHCommand(cfg Config) (cmd string, args []string, err error) {
 // Create creates an sftp backend as described by the config by running "ssh"
 // with the appropriate arguments (or cfg.Command, if set).
 func Create(ctx context.Context, cfg Config) (*SFTP, error) {
-	sftp, err := startClient(cfg)
+	return createWith(ctx, cfg, sshStarter(cfg))
+}
+
+func createWith(ctx context.Context, cfg Config, start func() (*session, error)) (*SFTP, error) {
+	r, err := newBackend(cfg, start)
 	if err != nil {
-		debug.Log("unable to start program: %v", err)
 		return nil, err
 	}
 
-	sftp.Layout, err = layout.ParseLayout(ctx, sftp, cfg.Layout, defaultLayout, cfg.Path)
+	r.Layout, err = layout.ParseLayout(ctx, r, cfg.Layout, defaultLayout, cfg.Path)
 	if err != nil {
+		_ = r.Close()
 		return nil, err
 	}
 
-	sftp.Modes = util.DefaultModes
+	r.Modes = util.DefaultModes
 
 	// test if config file already exists
-	_, err = sftp.c.Lstat(sftp.Layout.Filename(backend.Handle{Type: backend.ConfigFile}))
+	err = r.withClient(ctx, func(c *sftp.Client) error {
+		_, err := c.Lstat(r.Layout.Filename(backend.Handle{Type: backend.ConfigFile}))
+		return err
+	})
 	if err == nil {
+		_ = r.Close()
 		return nil, errors.New("config file already exists")
 	}
 
 	// create paths for data and refs
-	if err = sftp.mkdirAllDataSubdirs(ctx, cfg.Connections); err != nil {
+	if err = r.mkdirAllDataSubdirs(ctx, cfg.Connections); err != nil {
+		_ = r.Close()
 		return nil, err
 	}
 
-	// repurpose existing connection
-	return open(ctx, sftp, cfg)
+	// repurpose existing connections
+	return open(ctx, r, cfg)
 }
 
 func (r *SFTP) Connections() uint {
@@ -313,26 +370,28 @@ func tempSuffix() string {
 }
 
 // Save stores data in the backend at the handle.
-func (r *SFTP) Save(_ context.Context, h backend.Handle, rd backend.RewindReader) error {
-	if err := r.clientError(); err != nil {
-		return err
-	}
+func (r *SFTP) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	return r.withClient(ctx, func(c *sftp.Client) error {
+		return r.save(c, h, rd)
+	})
+}
 
+func (r *SFTP) save(c *sftp.Client, h backend.Handle, rd backend.RewindReader) error {
 	filename := r.Filename(h)
 	tmpFilename := filename + "-restic-temp-" + tempSuffix()
 	dirname := r.Dirname(h)
 
 	// create new file
-	f, err := r.c.OpenFile(tmpFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+	f, err := c.OpenFile(tmpFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
 
 	if r.IsNotExist(err) {
 		// error is caused by a missing directory, try to create it
-		mkdirErr := r.c.MkdirAll(r.Dirname(h))
+		mkdirErr := c.MkdirAll(r.Dirname(h))
 		if mkdirErr != nil {
 			debug.Log("error creating dir %v: %v", r.Dirname(h), mkdirErr)
 		} else {
 			// try again
-			f, err = r.c.OpenFile(tmpFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+			f, err = c.OpenFile(tmpFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
 		}
 	}
 
@@ -351,7 +410,7 @@ func (r *SFTP) Save(_ context.Context, h backend.Handle, rd backend.RewindReader
 		}
 
 		// Try not to leave a partial file behind.
-		rmErr := r.c.Remove(f.Name())
+		rmErr := c.Remove(f.Name())
 		if rmErr != nil {
 			debug.Log("sftp: failed to remove broken file %v: %v",
 				f.Name(), rmErr)
@@ -362,7 +421,7 @@ func (r *SFTP) Save(_ context.Context, h backend.Handle, rd backend.RewindReader
 	wbytes, err := f.ReadFrom(rd)
 	if err != nil {
 		_ = f.Close()
-		err = r.checkNoSpace(dirname, rd.Length(), err)
+		err = r.checkNoSpace(c, dirname, rd.Length(), err)
 		return errors.Wrap(err, "Write")
 	}
 
@@ -379,27 +438,26 @@ func (r *SFTP) Save(_ context.Context, h backend.Handle, rd backend.RewindReader
 
 	// Prefer POSIX atomic rename if available.
 	if r.posixRename {
-		err = r.c.PosixRename(tmpFilename, filename)
+		err = c.PosixRename(tmpFilename, filename)
 	} else {
-		err = r.c.Rename(tmpFilename, filename)
+		err = c.Rename(tmpFilename, filename)
 	}
 	return errors.Wrap(err, "Rename")
 }
 
 // checkNoSpace checks if err was likely caused by lack of available space
 // on the remote, and if so, makes it permanent.
-func (r *SFTP) checkNoSpace(dir string, size int64, origErr error) error {
+func (r *SFTP) checkNoSpace(c *sftp.Client, dir string, size int64, origErr error) error {
 	// The SFTP protocol has a message for ENOSPC,
 	// but pkg/sftp doesn't export it and OpenSSH's sftp-server
 	// sends FX_FAILURE instead.
 
 	e, ok := origErr.(*sftp.StatusError)
-	_, hasExt := r.c.HasExtension("statvfs@openssh.com")
-	if !ok || e.FxCode() != sftp.ErrSSHFxFailure || !hasExt {
+	if !ok || e.FxCode() != sftp.ErrSSHFxFailure || !r.statVFS {
 		return origErr
 	}
 
-	fsinfo, err := r.c.StatVFS(dir)
+	fsinfo, err := c.StatVFS(dir)
 	if err != nil {
 		debug.Log("sftp: StatVFS returned %v", err)
 		return origErr
@@ -417,11 +475,31 @@ func (r *SFTP) Load(ctx context.Context, h backend.Handle, length int, offset in
 	return util.DefaultLoad(ctx, h, length, offset, r.openReader, fn)
 }
 
-func (r *SFTP) openReader(_ context.Context, h backend.Handle, length int, offset int64) (io.ReadCloser, error) {
-	f, err := r.c.Open(r.Filename(h))
+// sessionFile returns its session to the pool when it is closed.
+type sessionFile struct {
+	*sftp.File
+	release func(err error)
+	once    sync.Once
+}
+
+func (f *sessionFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() { f.release(err) })
+	return err
+}
+
+func (r *SFTP) openReader(ctx context.Context, h backend.Handle, length int, offset int64) (io.ReadCloser, error) {
+	s, err := r.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := s.c.Open(r.Filename(h))
 	if err != nil {
+		r.pool.put(s, err)
 		return nil, err
 	}
+	f := &sessionFile{File: file, release: func(err error) { r.pool.put(s, err) }}
 
 	if offset > 0 {
 		_, err = f.Seek(offset, 0)
@@ -441,12 +519,13 @@ func (r *SFTP) openReader(_ context.Context, h backend.Handle, length int, offse
 }
 
 // Stat returns information about a blob.
-func (r *SFTP) Stat(_ context.Context, h backend.Handle) (backend.FileInfo, error) {
-	if err := r.clientError(); err != nil {
-		return backend.FileInfo{}, err
-	}
-
-	fi, err := r.c.Lstat(r.Filename(h))
+func (r *SFTP) Stat(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+	var fi os.FileInfo
+	err := r.withClient(ctx, func(c *sftp.Client) error {
+		var err error
+		fi, err = c.Lstat(r.Filename(h))
+		return err
+	})
 	if err != nil {
 		return backend.FileInfo{}, errors.Wrap(err, "Lstat")
 	}
@@ -455,51 +534,57 @@ func (r *SFTP) Stat(_ context.Context, h backend.Handle) (backend.FileInfo, erro
 }
 
 // Remove removes the content stored at name.
-func (r *SFTP) Remove(_ context.Context, h backend.Handle) error {
-	if err := r.clientError(); err != nil {
-		return err
-	}
-
-	return r.c.Remove(r.Filename(h))
+func (r *SFTP) Remove(ctx context.Context, h backend.Handle) error {
+	return r.withClient(ctx, func(c *sftp.Client) error {
+		return c.Remove(r.Filename(h))
+	})
 }
 
 // List runs fn for each file in the backend which has the type t. When an
 // error occurs (or fn returns an error), List stops and returns it.
 func (r *SFTP) List(ctx context.Context, t backend.FileType, fn func(backend.FileInfo) error) error {
 	basedir, subdirs := r.Basedir(t)
-	walker := r.c.Walk(basedir)
-	for {
-		ok := walker.Step()
-		if !ok {
-			break
-		}
+	if err := r.listDir(ctx, basedir, subdirs, fn); err != nil {
+		return err
+	}
 
-		if walker.Err() != nil {
-			if r.IsNotExist(walker.Err()) {
-				debug.Log("ignoring non-existing directory")
-				return nil
-			}
-			return walker.Err()
-		}
+	return ctx.Err()
+}
 
-		if walker.Path() == basedir {
-			continue
-		}
+// listDir runs fn for each regular file in dir and, if subdirs is set, its
+// subdirectories. The session is only used while reading a directory, so
+// that fn can use the backend.
+func (r *SFTP) listDir(ctx context.Context, dir string, subdirs bool, fn func(backend.FileInfo) error) error {
+	entries, err := r.ReadDir(ctx, dir)
+	if r.IsNotExist(err) {
+		debug.Log("ignoring non-existing directory %v", dir)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range entries {
+		if fi.IsDir() {
+			if !subdirs {
+				continue
+			}
 
-		if walker.Stat().IsDir() && !subdirs {
-			walker.SkipDir()
+			err := r.listDir(ctx, r.Join(dir, fi.Name()), subdirs, fn)
+			if err != nil {
+				return err
+			}
 			continue
 		}
 
-		fi := walker.Stat()
 		if !fi.Mode().IsRegular() {
 			continue
 		}
 
-		debug.Log("send %v\n", path.Base(walker.Path()))
+		debug.Log("send %v\n", fi.Name())
 
 		rfi := backend.FileInfo{
-			Name: path.Base(walker.Path()),
+			Name: fi.Name(),
 			Size: fi.Size(),
 		}
 
@@ -517,34 +602,16 @@ func (r *SFTP) List(ctx context.Context, t backend.FileType, fn func(backend.Fil
 		}
 	}
 
-	return ctx.Err()
+	return nil
 }
 
-var closeTimeout = 2 * time.Second
-
-// Close closes the sftp connection and terminates the underlying command.
+// Close closes all sftp connections and terminates the underlying commands.
 func (r *SFTP) Close() error {
 	if r == nil {
 		return nil
 	}
 
-	err := r.c.Close()
-	debug.Log("Close returned error %v", err)
-
-	// wait for closeTimeout before killing the process
-	select {
-	case err := <-r.result:
-		return err
-	case <-time.After(closeTimeout):
-	}
-
-	if err := r.cmd.Process.Kill(); err != nil {
-		return err
-	}
-
-	// get the error, but ignore it
-	<-r.result
-	return nil
+	return r.pool.close()
 }
 
 func (r *SFTP) deleteRecursive(ctx context.Context, name string) error {
@@ -561,7 +628,9 @@ func (r *SFTP) deleteRecursive(ctx context.Context, name string) error {
 				return errors.Wrap(err, "ReadDir")
 			}
 
-			err = r.c.RemoveDirectory(itemName)
+			err = r.withClient(ctx, func(c *sftp.Client) error {
+				return c.RemoveDirectory(itemName)
+			})
 			if err != nil {
 				return errors.Wrap(err, "RemoveDirectory")
 			}
@@ -569,7 +638,9 @@ func (r *SFTP) deleteRecursive(ctx context.Context, name string) error {
 			continue
 		}
 
-		err := r.c.Remove(itemName)
+		err := r.withClient(ctx, func(c *sftp.Client) error {
+			return c.Remove(itemName)
+		})
 		if err != nil {
 			return errors.Wrap(err, "ReadDir")
 		}
@@ -18,6 +18,7 @@ type Config struct {
 	APIKey         string
 	AuthURL        string
 	Region         string
+	Interface      string
 	Tenant         string
 	TenantID       string
 	TenantDomain   string
@@ -86,6 +87,8 @@ func (cfg *Config) ApplyEnvironment(prefix string) {
 		{&cfg.UserName, prefix + "OS_USERNAME"},
 		{&cfg.APIKey, prefix + "OS_PASSWORD"},
 		{&cfg.Region, prefix + "OS_REGION_NAME"},
+		{&cfg.Interface, prefix + "OS_INTERFACE"},
+		{&cfg.Interface, prefix + "OS_ENDPOINT_TYPE"},
 		{&cfg.AuthURL, prefix + "OS_AUTH_URL"},
 
 		// v3 specific
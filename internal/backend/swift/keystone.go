@@ -0,0 +1,174 @@
+package swift
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/restic/restic/internal/errors"
+
+	"github.com/ncw/swift/v2"
+)
+
+// maxErrorBody limits the length of a response body included in an error.
+const maxErrorBody = 512
+
+// keystoneTransport keeps the last response of the identity service. The
+// swift library discards the body of failed authentication requests, the
+// transport allows reporting the reason given by Keystone instead.
+type keystoneTransport struct {
+	http.RoundTripper
+	authURL string
+
+	m      sync.Mutex
+	status int
+	body   []byte
+}
+
+func newKeystoneTransport(rt http.RoundTripper, authURL string) *keystoneTransport {
+	return &keystoneTransport{RoundTripper: rt, authURL: authURL}
+}
+
+func (t *keystoneTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.authURL == "" || !strings.HasPrefix(req.URL.String(), t.authURL) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	t.m.Lock()
+	t.status, t.body = 0, nil
+	t.m.Unlock()
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.m.Lock()
+	t.status = resp.StatusCode
+	t.body = body
+	t.m.Unlock()
+	return resp, nil
+}
+
+// CloseIdleConnections is called by the swift library before it
+// authenticates.
+func (t *keystoneTransport) CloseIdleConnections() {
+	if tr, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// explain adds the details of the last authentication response to err,
+// which was returned by the authentication.
+func (t *keystoneTransport) explain(err error, region string, iface swift.EndpointType) error {
+	t.m.Lock()
+	status, body := t.status, t.body
+	t.m.Unlock()
+
+	switch {
+	case body == nil:
+		return err
+	case status < 200 || status > 299:
+		return errors.Errorf("%v: %v", err, keystoneError(body))
+	}
+
+	endpoints, ok := objectStoreEndpoints(body)
+	if !ok {
+		return err
+	}
+	var available []string
+	for _, ep := range endpoints {
+		if ep.Interface == string(iface) && (region == "" || ep.Region == region) {
+			// the catalog is not the problem
+			return err
+		}
+		available = append(available, ep.Region+"/"+ep.Interface)
+	}
+	if len(available) == 0 {
+		return errors.Errorf("%v: the service catalog contains no object-store endpoint", err)
+	}
+	sort.Strings(available)
+	return errors.Errorf("%v: no object-store endpoint for region %q and interface %q in the service catalog, available are: %v",
+		err, region, iface, strings.Join(available, ", "))
+}
+
+// keystoneError returns the message of an error response of Keystone.
+func keystoneError(body []byte) string {
+	var resp struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Title   string `json:"title"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Error.Message != "" {
+		return fmt.Sprintf("%v: %v (HTTP %d)", resp.Error.Title, resp.Error.Message, resp.Error.Code)
+	}
+
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > maxErrorBody {
+		msg = msg[:maxErrorBody] + "..."
+	}
+	return msg
+}
+
+type catalogEndpoint struct {
+	Region    string `json:"region"`
+	Interface string `json:"interface"`
+}
+
+// objectStoreEndpoints returns the object-store endpoints in a Keystone v3
+// token response. It returns false if body is not such a response.
+func objectStoreEndpoints(body []byte) ([]catalogEndpoint, bool) {
+	var resp struct {
+		Token *struct {
+			Catalog []struct {
+				Type      string            `json:"type"`
+				Endpoints []catalogEndpoint `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Token == nil {
+		return nil, false
+	}
+
+	var endpoints []catalogEndpoint
+	for _, service := range resp.Token.Catalog {
+		if service.Type == "object-store" {
+			endpoints = append(endpoints, service.Endpoints...)
+		}
+	}
+	return endpoints, true
+}
+
+// parseEndpointType returns the endpoint type for the value of OS_INTERFACE
+// or OS_ENDPOINT_TYPE, which may also use the Keystone v2 names such as
+// "publicURL".
+func parseEndpointType(s string) (swift.EndpointType, error) {
+	t := swift.EndpointType(strings.TrimSuffix(strings.ToLower(s), "url"))
+	switch t {
+	case "":
+		return swift.EndpointTypePublic, nil
+	case swift.EndpointTypePublic, swift.EndpointTypeInternal, swift.EndpointTypeAdmin:
+		return t, nil
+	}
+	return "", errors.Errorf("invalid interface %q, allowed are public, internal and admin", s)
+}
+
+// isUnauthorized returns true if the token was rejected by the server.
+func isUnauthorized(err error) bool {
+	var e *swift.Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusUnauthorized
+}
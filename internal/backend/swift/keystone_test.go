@@ -0,0 +1,210 @@
+package swift
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/options"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+// fakeKeystone implements token requests of the Keystone v3 identity service
+// and a swift container which accepts the issued tokens.
+type fakeKeystone struct {
+	t   testing.TB
+	srv *httptest.Server
+
+	m sync.Mutex
+	// tokens counts the issued tokens, only the latest one is valid
+	tokens  int
+	revoked bool
+	objects map[string][]byte
+	uploads int
+}
+
+func newFakeKeystone(t testing.TB) *fakeKeystone {
+	k := &fakeKeystone{t: t, objects: make(map[string][]byte)}
+	k.srv = httptest.NewServer(http.HandlerFunc(k.handle))
+	t.Cleanup(k.srv.Close)
+	return k
+}
+
+func (k *fakeKeystone) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v3/auth/tokens" {
+		k.authenticate(w, r)
+		return
+	}
+
+	k.m.Lock()
+	valid := !k.revoked && r.Header.Get("X-Auth-Token") == fmt.Sprintf("token%d", k.tokens)
+	k.m.Unlock()
+	if !valid {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// only the endpoint of the internal interface in RegionTwo is used
+	const prefix = "/RegionTwo/internal/container"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("X-Container-Bytes-Used", "0")
+		w.Header().Set("X-Container-Object-Count", "0")
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		rtest.OK(k.t, err)
+		sum := md5.Sum(data)
+		if r.Header.Get("Etag") != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		k.m.Lock()
+		k.objects[name] = data
+		k.uploads++
+		k.m.Unlock()
+		w.Header().Set("Etag", hex.EncodeToString(sum[:]))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (k *fakeKeystone) authenticate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Methods               []string `json:"methods"`
+				ApplicationCredential struct {
+					ID     string `json:"id"`
+					Secret string `json:"secret"`
+				} `json:"application_credential"`
+			} `json:"identity"`
+		} `json:"auth"`
+	}
+	rtest.OK(k.t, json.NewDecoder(r.Body).Decode(&req))
+	id := req.Auth.Identity
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(id.Methods) != 1 || id.Methods[0] != "application_credential" ||
+		id.ApplicationCredential.ID != "credential" || id.ApplicationCredential.Secret != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error": {"code": 401, "title": "Unauthorized", "message": "The request you have made requires authentication."}}`))
+		return
+	}
+
+	k.m.Lock()
+	k.tokens++
+	k.revoked = false
+	token := fmt.Sprintf("token%d", k.tokens)
+	k.m.Unlock()
+
+	var endpoints []map[string]string
+	for _, region := range []string{"RegionOne", "RegionTwo"} {
+		for _, iface := range []string{"public", "internal"} {
+			endpoints = append(endpoints, map[string]string{
+				"region":    region,
+				"region_id": region,
+				"interface": iface,
+				"url":       k.srv.URL + "/" + region + "/" + iface,
+			})
+		}
+	}
+	w.Header().Set("X-Subject-Token", token)
+	w.WriteHeader(http.StatusCreated)
+	rtest.OK(k.t, json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": map[string]interface{}{
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"catalog": []map[string]interface{}{
+				{"type": "identity", "endpoints": []map[string]string{{"region": "RegionOne", "interface": "public", "url": k.srv.URL + "/v3"}}},
+				{"type": "object-store", "endpoints": endpoints},
+			},
+		},
+	}))
+}
+
+func (k *fakeKeystone) config() Config {
+	cfg := NewConfig()
+	cfg.AuthURL = k.srv.URL + "/v3"
+	cfg.ApplicationCredentialID = "credential"
+	cfg.ApplicationCredentialSecret = options.NewSecretString("secret")
+	cfg.Region = "RegionTwo"
+	cfg.Interface = "internalURL"
+	cfg.Container = "container"
+	cfg.Prefix = "repo"
+	return cfg
+}
+
+func TestOpenApplicationCredential(t *testing.T) {
+	k := newFakeKeystone(t)
+	be, err := Open(context.TODO(), k.config(), http.DefaultTransport)
+	rtest.OK(t, err)
+	rtest.OK(t, be.Close())
+	rtest.Equals(t, 1, k.tokens)
+}
+
+func TestOpenKeystoneError(t *testing.T) {
+	k := newFakeKeystone(t)
+	cfg := k.config()
+	cfg.ApplicationCredentialSecret = options.NewSecretString("wrong")
+
+	_, err := Open(context.TODO(), cfg, http.DefaultTransport)
+	rtest.Assert(t, err != nil, "missing error")
+	rtest.Assert(t, strings.Contains(err.Error(), "The request you have made requires authentication."),
+		"error does not contain the Keystone message: %v", err)
+
+	cfg.ApplicationCredentialSecret = options.NewSecretString("")
+	_, err = Open(context.TODO(), cfg, http.DefaultTransport)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "OS_APPLICATION_CREDENTIAL_SECRET"), "unexpected error %v", err)
+}
+
+func TestOpenMissingEndpoint(t *testing.T) {
+	k := newFakeKeystone(t)
+	cfg := k.config()
+	cfg.Region = "RegionThree"
+
+	_, err := Open(context.TODO(), cfg, http.DefaultTransport)
+	rtest.Assert(t, err != nil, "missing error")
+	rtest.Assert(t, strings.Contains(err.Error(), "available are: RegionOne/internal, RegionOne/public, RegionTwo/internal, RegionTwo/public"),
+		"error does not list the endpoints: %v", err)
+
+	cfg.Interface = "private"
+	_, err = Open(context.TODO(), cfg, http.DefaultTransport)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "invalid interface"), "unexpected error %v", err)
+}
+
+func TestTokenRenewal(t *testing.T) {
+	k := newFakeKeystone(t)
+	be, err := Open(context.TODO(), k.config(), http.DefaultTransport)
+	rtest.OK(t, err)
+	defer func() { rtest.OK(t, be.Close()) }()
+
+	data := rtest.Random(5, 10000)
+	// the token expires before the upload
+	k.m.Lock()
+	k.revoked = true
+	k.m.Unlock()
+
+	h := backend.Handle{Type: backend.PackFile, Name: "foo"}
+	rtest.OK(t, be.Save(context.TODO(), h, backend.NewByteReader(data, md5.New())))
+	rtest.Equals(t, 2, k.tokens)
+	rtest.Equals(t, 1, k.uploads)
+	rtest.Equals(t, data, k.objects["/repo/data/fo/foo"])
+}
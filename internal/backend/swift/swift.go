@@ -11,6 +11,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/restic/restic/internal/backend"
@@ -30,6 +31,11 @@ type beSwift struct {
 	container   string // Container name
 	prefix      string // Prefix of object names in the container
 	layout.Layout
+
+	keystone *keystoneTransport
+	// authMu serializes renewing the token, authGen counts the renewals
+	authMu  sync.Mutex
+	authGen uint64
 }
 
 // ensure statically that *beSwift implements backend.Backend.
@@ -44,6 +50,21 @@ func NewFactory() location.Factory {
 func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (backend.Backend, error) {
 	debug.Log("config %#v", cfg)
 
+	endpointType, err := parseEndpointType(cfg.Interface)
+	if err != nil {
+		return nil, errors.Fatalf("unable to open swift backend: %v", err)
+	}
+
+	// application credentials are only supported by Keystone v3
+	authVersion := 0
+	if cfg.ApplicationCredentialID != "" || cfg.ApplicationCredentialName != "" {
+		if cfg.ApplicationCredentialSecret.String() == "" {
+			return nil, errors.Fatalf("unable to open swift backend: application credential secret ($OS_APPLICATION_CREDENTIAL_SECRET) is empty")
+		}
+		authVersion = 3
+	}
+
+	keystone := newKeystoneTransport(rt, cfg.AuthURL)
 	be := &beSwift{
 		conn: &swift.Connection{
 			UserName:                    cfg.UserName,
@@ -52,7 +73,9 @@ func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (backend.Backen
 			DomainId:                    cfg.DomainID,
 			ApiKey:                      cfg.APIKey,
 			AuthUrl:                     cfg.AuthURL,
+			AuthVersion:                 authVersion,
 			Region:                      cfg.Region,
+			EndpointType:                endpointType,
 			Tenant:                      cfg.Tenant,
 			TenantId:                    cfg.TenantID,
 			TenantDomain:                cfg.TenantDomain,
@@ -65,9 +88,13 @@ func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (backend.Backen
 			ApplicationCredentialSecret: cfg.ApplicationCredentialSecret.Unwrap(),
 			ConnectTimeout:              time.Minute,
 			Timeout:                     time.Minute,
+			// the library would repeat uploads with a consumed body after
+			// renewing the token, retryUnauthorized is used instead
+			Retries: -1,
 
-			Transport: rt,
+			Transport: keystone,
 		},
+		keystone:    keystone,
 		connections: cfg.Connections,
 		container:   cfg.Container,
 		prefix:      cfg.Prefix,
@@ -80,7 +107,7 @@ func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (backend.Backen
 	// Authenticate if needed
 	if !be.conn.Authenticated() {
 		if err := be.conn.Authenticate(ctx); err != nil {
-			return nil, errors.Wrap(err, "conn.Authenticate")
+			return nil, errors.Wrap(be.keystone.explain(err, cfg.Region, endpointType), "conn.Authenticate")
 		}
 	}
 
@@ -102,6 +129,42 @@ func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (backend.Backen
 	return be, nil
 }
 
+// retryUnauthorized runs fn. If the server rejects the token, for example
+// because it has expired, the token is renewed and fn is run once more.
+func (be *beSwift) retryUnauthorized(ctx context.Context, fn func() error) error {
+	be.authMu.Lock()
+	gen := be.authGen
+	be.authMu.Unlock()
+
+	err := fn()
+	if be.conn.AuthUrl == "" || !isUnauthorized(err) || ctx.Err() != nil {
+		return err
+	}
+
+	if err := be.reauthenticate(ctx, gen); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// reauthenticate renews the token, unless it was already renewed since
+// generation gen.
+func (be *beSwift) reauthenticate(ctx context.Context, gen uint64) error {
+	be.authMu.Lock()
+	defer be.authMu.Unlock()
+	if be.authGen != gen {
+		return nil
+	}
+
+	debug.Log("token was rejected, authenticating again")
+	be.conn.UnAuthenticate()
+	if err := be.conn.Authenticate(ctx); err != nil {
+		return errors.Wrap(be.keystone.explain(err, be.conn.Region, be.conn.EndpointType), "conn.Authenticate")
+	}
+	be.authGen++
+	return nil
+}
+
 func (be *beSwift) createContainer(ctx context.Context, policy string) error {
 	var h swift.Headers
 	if policy != "" {
@@ -151,7 +214,11 @@ func (be *beSwift) openReader(ctx context.Context, h backend.Handle, length int,
 		headers["Range"] = fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1)
 	}
 
-	obj, _, err := be.conn.ObjectOpen(ctx, be.container, objName, false, headers)
+	var obj *swift.ObjectOpenFile
+	err := be.retryUnauthorized(ctx, func() (err error) {
+		obj, _, err = be.conn.ObjectOpen(ctx, be.container, objName, false, headers)
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "conn.ObjectOpen")
 	}
@@ -165,10 +232,16 @@ func (be *beSwift) Save(ctx context.Context, h backend.Handle, rd backend.Rewind
 	encoding := "binary/octet-stream"
 
 	hdr := swift.Headers{"Content-Length": strconv.FormatInt(rd.Length(), 10)}
-	_, err := be.conn.ObjectPut(ctx,
-		be.container, objName, rd, true, hex.EncodeToString(rd.Hash()),
-		encoding, hdr)
-	// swift does not return the upload length
+	err := be.retryUnauthorized(ctx, func() error {
+		if err := rd.Rewind(); err != nil {
+			return err
+		}
+		_, err := be.conn.ObjectPut(ctx,
+			be.container, objName, rd, true, hex.EncodeToString(rd.Hash()),
+			encoding, hdr)
+		// swift does not return the upload length
+		return err
+	})
 
 	return errors.Wrap(err, "client.PutObject")
 }
@@ -177,7 +250,11 @@ func (be *beSwift) Save(ctx context.Context, h backend.Handle, rd backend.Rewind
 func (be *beSwift) Stat(ctx context.Context, h backend.Handle) (bi backend.FileInfo, err error) {
 	objName := be.Filename(h)
 
-	obj, _, err := be.conn.Object(ctx, be.container, objName)
+	var obj swift.Object
+	err = be.retryUnauthorized(ctx, func() (err error) {
+		obj, _, err = be.conn.Object(ctx, be.container, objName)
+		return err
+	})
 	if err != nil {
 		return backend.FileInfo{}, errors.Wrap(err, "conn.Object")
 	}
@@ -189,7 +266,9 @@ func (be *beSwift) Stat(ctx context.Context, h backend.Handle) (bi backend.FileI
 func (be *beSwift) Remove(ctx context.Context, h backend.Handle) error {
 	objName := be.Filename(h)
 
-	err := be.conn.ObjectDelete(ctx, be.container, objName)
+	err := be.retryUnauthorized(ctx, func() error {
+		return be.conn.ObjectDelete(ctx, be.container, objName)
+	})
 	return errors.Wrap(err, "conn.ObjectDelete")
 }
 
@@ -201,7 +280,11 @@ func (be *beSwift) List(ctx context.Context, t backend.FileType, fn func(backend
 
 	err := be.conn.ObjectsWalk(ctx, be.container, &swift.ObjectsOpts{Prefix: prefix},
 		func(ctx context.Context, opts *swift.ObjectsOpts) (interface{}, error) {
-			newObjects, err := be.conn.Objects(ctx, be.container, opts)
+			var newObjects []swift.Object
+			err := be.retryUnauthorized(ctx, func() (err error) {
+				newObjects, err = be.conn.Objects(ctx, be.container, opts)
+				return err
+			})
 
 			if err != nil {
 				return nil, errors.Wrap(err, "conn.ObjectNames")
@@ -242,6 +325,21 @@ func (be *beSwift) IsNotExist(err error) bool {
 	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
 }
 
+// IsPermanentError returns true if the error is caused by invalid credentials
+// or missing permissions.
+func (be *beSwift) IsPermanentError(err error) bool {
+	var e *swift.Error
+	return errors.As(err, &e) && (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden)
+}
+
+// IsThrottled returns true if the server has rejected the request because too
+// many requests were sent.
+func (be *beSwift) IsThrottled(err error) bool {
+	var e *swift.Error
+	// Swift responds with 498 if the rate limit middleware rejects a request
+	return errors.As(err, &e) && (e.StatusCode == http.StatusTooManyRequests || e.StatusCode == 498)
+}
+
 // Delete removes all restic objects in the container.
 // It will not remove the container itself.
 func (be *beSwift) Delete(ctx context.Context) error {
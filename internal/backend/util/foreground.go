@@ -10,8 +10,10 @@ import (
 // new process group created for cmd. The returned function `bg` switches back
 // to the previous process group.
 //
-// The command's environment has all RESTIC_* variables removed.
+// The command's environment has all RESTIC_* variables removed. Variables
+// which are already set in cmd.Env are added to the environment.
 func StartForeground(cmd *exec.Cmd) (bg func() error, err error) {
+	extra := cmd.Env
 	env := os.Environ() // Returns a copy that we can modify.
 
 	cmd.Env = env[:0]
@@ -21,6 +23,7 @@ func StartForeground(cmd *exec.Cmd) (bg func() error, err error) {
 		}
 		cmd.Env = append(cmd.Env, kv)
 	}
+	cmd.Env = append(cmd.Env, extra...)
 
 	return startForeground(cmd)
 }
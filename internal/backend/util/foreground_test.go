@@ -19,6 +19,7 @@ func TestForeground(t *testing.T) {
 	rtest.OK(t, err)
 
 	cmd := exec.Command("env")
+	cmd.Env = []string{"RCLONE_FAST_LIST=true"}
 	stdout, err := cmd.StdoutPipe()
 	rtest.OK(t, err)
 
@@ -32,10 +33,15 @@ func TestForeground(t *testing.T) {
 	rtest.OK(t, err)
 
 	sc := bufio.NewScanner(stdout)
+	var extra bool
 	for sc.Scan() {
 		if strings.HasPrefix(sc.Text(), "RESTIC_PASSWORD=") {
 			t.Error("subprocess got to see the password")
 		}
+		if sc.Text() == "RCLONE_FAST_LIST=true" {
+			extra = true
+		}
 	}
 	rtest.OK(t, err)
+	rtest.Assert(t, extra, "variable from cmd.Env is missing")
 }
@@ -0,0 +1,272 @@
+// Package davclient contains the parts of a WebDAV client which are shared by
+// the WebDAV backend and the WebDAV source for backups: the authentication of
+// requests and the decoding of PROPFIND responses.
+package davclient
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/restic/restic/internal/debug"
+)
+
+// authTransport adds credentials to the requests. A bearer token is sent with
+// every request. For a username and password, nothing is sent until the
+// server has asked for credentials with a 401 response, afterwards all
+// requests are authorized with the scheme requested by the server. Basic and
+// digest authentication (RFC 7616) are supported.
+type authTransport struct {
+	rt             http.RoundTripper
+	user, password string
+	bearer         string
+
+	m      sync.Mutex
+	scheme string
+	digest *digestChallenge
+	nc     uint32
+}
+
+type digestChallenge struct {
+	realm, nonce, opaque string
+	algorithm            string
+	qop                  string
+}
+
+// NewAuthTransport returns a transport which sends the requests with rt and
+// authenticates them with the bearer token, if it is set, or with user and
+// password.
+func NewAuthTransport(rt http.RoundTripper, user, password, bearer string) http.RoundTripper {
+	return &authTransport{rt: rt, user: user, password: password, bearer: bearer}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.bearer != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.bearer)
+		return t.rt.RoundTrip(req)
+	}
+	if t.user == "" && t.password == "" {
+		return t.rt.RoundTrip(req)
+	}
+
+	resp, err := t.rt.RoundTrip(t.authorize(req))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	if !t.challenge(resp) {
+		// the credentials were rejected
+		return resp, nil
+	}
+
+	// send the request again with the new credentials, which requires the
+	// body to be sent again
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	debug.Log("repeating %v %v with %v authentication", req.Method, req.URL, t.scheme)
+	return t.rt.RoundTrip(t.authorize(retry))
+}
+
+// authorize returns a copy of req with the Authorization header for the
+// scheme requested by the server, or req itself if no scheme is known yet.
+func (t *authTransport) authorize(req *http.Request) *http.Request {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	switch t.scheme {
+	case "basic":
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(t.user, t.password)
+	case "digest":
+		t.nc++
+		cnonce := make([]byte, 8)
+		_, _ = rand.Read(cnonce)
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", t.digest.authorization(t.user, t.password,
+			req.Method, req.URL.RequestURI(), t.nc, hex.EncodeToString(cnonce)))
+	}
+	return req
+}
+
+// challenge processes the authentication challenges of a 401 response and
+// returns true if the request should be sent again with new credentials.
+// Digest authentication is preferred over basic authentication. A request
+// is only repeated with the same scheme if the digest nonce has changed.
+func (t *authTransport) challenge(resp *http.Response) bool {
+	var basic bool
+	var digest *digestChallenge
+	var stale bool
+	for _, value := range resp.Header.Values("WWW-Authenticate") {
+		scheme, params := ParseChallenge(value)
+		switch scheme {
+		case "basic":
+			basic = true
+		case "digest":
+			c := &digestChallenge{
+				realm:     params["realm"],
+				nonce:     params["nonce"],
+				opaque:    params["opaque"],
+				algorithm: params["algorithm"],
+			}
+			if c.newHash() == nil {
+				// unsupported algorithm
+				continue
+			}
+			for _, qop := range strings.Split(params["qop"], ",") {
+				if strings.TrimSpace(qop) == "auth" {
+					c.qop = "auth"
+				}
+			}
+			if params["qop"] != "" && c.qop == "" {
+				// only auth-int is offered
+				continue
+			}
+			if digest == nil {
+				digest = c
+				stale = strings.EqualFold(params["stale"], "true")
+			}
+		}
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	switch {
+	case digest != nil:
+		retry := t.scheme != "digest" || stale || t.digest.nonce != digest.nonce
+		t.scheme, t.digest, t.nc = "digest", digest, 0
+		return retry
+	case basic:
+		retry := t.scheme != "basic"
+		t.scheme = "basic"
+		return retry
+	}
+	return false
+}
+
+// session returns true for the session variants of the algorithms, which
+// include the client nonce in the hash of the credentials.
+func (c *digestChallenge) session() bool {
+	return strings.HasSuffix(strings.ToUpper(c.algorithm), "-SESS")
+}
+
+func (c *digestChallenge) newHash() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(c.algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New()
+	case "SHA-256":
+		return sha256.New()
+	}
+	return nil
+}
+
+func (c *digestChallenge) hash(parts ...string) string {
+	h := c.newHash()
+	_, _ = h.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// response computes the digest response for a request as described in RFC
+// 7616, section 3.4.1.
+func (c *digestChallenge) response(user, password, method, uri string, nc uint32, cnonce string) string {
+	ha1 := c.hash(user, c.realm, password)
+	if c.session() {
+		ha1 = c.hash(ha1, c.nonce, cnonce)
+	}
+	ha2 := c.hash(method, uri)
+
+	if c.qop == "" {
+		return c.hash(ha1, c.nonce, ha2)
+	}
+	return c.hash(ha1, c.nonce, fmt.Sprintf("%08x", nc), cnonce, c.qop, ha2)
+}
+
+func (c *digestChallenge) authorization(user, password, method, uri string, nc uint32, cnonce string) string {
+	params := []string{
+		"username=" + quote(user),
+		"realm=" + quote(c.realm),
+		"nonce=" + quote(c.nonce),
+		"uri=" + quote(uri),
+		"response=" + quote(c.response(user, password, method, uri, nc, cnonce)),
+	}
+	if c.algorithm != "" {
+		params = append(params, "algorithm="+c.algorithm)
+	}
+	if c.opaque != "" {
+		params = append(params, "opaque="+quote(c.opaque))
+	}
+	if c.qop != "" {
+		params = append(params, "qop="+c.qop, fmt.Sprintf("nc=%08x", nc), "cnonce="+quote(cnonce))
+	}
+	return "Digest " + strings.Join(params, ", ")
+}
+
+// quote returns s as a quoted string as used in HTTP headers.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// ParseChallenge splits a single challenge from a WWW-Authenticate header, or
+// the value of an Authorization header, into the lower case scheme and its
+// parameters.
+func ParseChallenge(s string) (string, map[string]string) {
+	s = strings.TrimSpace(s)
+	scheme, rest, _ := strings.Cut(s, " ")
+	params := make(map[string]string)
+
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if rest == "" {
+			break
+		}
+
+		var key string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// quoted string, a backslash escapes the next character
+			var sb strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				sb.WriteByte(rest[i])
+			}
+			value = sb.String()
+			if i < len(rest) {
+				// skip the closing quote
+				i++
+			}
+			rest = rest[i:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+
+	return strings.ToLower(scheme), params
+}
@@ -0,0 +1,29 @@
+package davclient
+
+import (
+	"testing"
+
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestDigestResponse(t *testing.T) {
+	// example from RFC 2617, section 3.5
+	c := digestChallenge{
+		realm: "testrealm@host.com",
+		nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		qop:   "auth",
+	}
+	rtest.Equals(t, "6629fae49393a05397450978507c4ef1",
+		c.response("Mufasa", "Circle Of Life", "GET", "/dir/index.html", 1, "0a4f113b"))
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := ParseChallenge(`Digest realm="a \"quoted\" realm", qop="auth,auth-int", algorithm=SHA-256, stale=TRUE`)
+	rtest.Equals(t, "digest", scheme)
+	rtest.Equals(t, map[string]string{
+		"realm":     `a "quoted" realm`,
+		"qop":       "auth,auth-int",
+		"algorithm": "SHA-256",
+		"stale":     "TRUE",
+	}, params)
+}
@@ -0,0 +1,143 @@
+package davclient
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// PropfindBody is the body of a PROPFIND request for the properties which are
+// decoded by DecodeMultistatus.
+const PropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <d:getetag/>
+  </d:prop>
+</d:propfind>`
+
+// PropfindHeader returns the header of a PROPFIND request with the given
+// depth, which is "0" for the resource itself or "1" to include its members.
+func PropfindHeader(depth string) http.Header {
+	return http.Header{
+		"Depth":        []string{depth},
+		"Content-Type": []string{`application/xml; charset="utf-8"`},
+	}
+}
+
+// Resource describes a file or collection listed in a PROPFIND response.
+type Resource struct {
+	// Path is the cleaned absolute path of the resource on the server.
+	Path  string
+	IsDir bool
+
+	// Size is the length of a file, or -1 if the server did not report a
+	// valid length.
+	Size int64
+	// ModTime is the zero time if the server did not report it.
+	ModTime time.Time
+	ETag    string
+}
+
+// response is a single resource of a multistatus response as described in
+// RFC 4918.
+type response struct {
+	Href      string `xml:"DAV: href"`
+	Propstats []struct {
+		Prop struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"DAV: collection"`
+			} `xml:"DAV: resourcetype"`
+			ContentLength string `xml:"DAV: getcontentlength"`
+			LastModified  string `xml:"DAV: getlastmodified"`
+			ETag          string `xml:"DAV: getetag"`
+		} `xml:"DAV: prop"`
+		Status string `xml:"DAV: status"`
+	} `xml:"DAV: propstat"`
+}
+
+// DecodeMultistatus decodes the multistatus response to a PROPFIND request
+// read from rd and runs fn for each resource. The responses are decoded one
+// by one, as a directory can contain many files. Resources with an invalid
+// href or without properties are skipped.
+func DecodeMultistatus(rd io.Reader, fn func(Resource) error) error {
+	dec := xml.NewDecoder(rd)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "decode PROPFIND response")
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Space != "DAV:" || start.Name.Local != "response" {
+			continue
+		}
+
+		var r response
+		if err := dec.DecodeElement(&r, &start); err != nil {
+			return errors.Wrap(err, "decode PROPFIND response")
+		}
+
+		res, ok := r.resource()
+		if !ok {
+			continue
+		}
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+}
+
+// resource returns the properties of r which were reported with status 200.
+func (r *response) resource() (Resource, bool) {
+	u, err := url.Parse(strings.TrimSpace(r.Href))
+	if err != nil {
+		debug.Log("skipping invalid href %q: %v", r.Href, err)
+		return Resource{}, false
+	}
+	res := Resource{Path: path.Clean("/" + u.Path), Size: -1}
+
+	for _, ps := range r.Propstats {
+		// status has the form "HTTP/1.1 200 OK"
+		fields := strings.Fields(ps.Status)
+		if len(fields) < 2 || fields[1] != "200" {
+			continue
+		}
+		prop := ps.Prop
+
+		if t, err := http.ParseTime(prop.LastModified); err == nil {
+			res.ModTime = t.UTC()
+		}
+		res.ETag = prop.ETag
+
+		if prop.ResourceType.Collection != nil {
+			res.IsDir = true
+			return res, true
+		}
+
+		if prop.ContentLength != "" {
+			size, err := strconv.ParseInt(prop.ContentLength, 10, 64)
+			if err != nil || size < 0 {
+				debug.Log("invalid content length %q for %v", prop.ContentLength, res.Path)
+				size = -1
+			}
+			res.Size = size
+		}
+		return res, true
+	}
+
+	return Resource{}, false
+}
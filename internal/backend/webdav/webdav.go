@@ -0,0 +1,595 @@
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/layout"
+	"github.com/restic/restic/internal/backend/location"
+	"github.com/restic/restic/internal/backend/util"
+	"github.com/restic/restic/internal/backend/webdav/davclient"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+)
+
+// make sure the WebDAV backend implements backend.Backend
+var _ backend.Backend = &Backend{}
+
+// Backend stores data on a WebDAV server.
+type Backend struct {
+	// url contains the scheme and host of the server, the credentials are
+	// handled by the transport of the client
+	url         *url.URL
+	connections uint
+	client      http.Client
+	layout.Layout
+
+	// noRanges is set if the server ignores the Range header
+	noRanges atomic.Bool
+	warnOnce sync.Once
+
+	m sync.Mutex
+	// interrupted contains the files whose last upload has failed
+	interrupted map[backend.Handle]struct{}
+}
+
+func NewFactory() location.Factory {
+	return location.NewHTTPBackendFactory("webdav", ParseConfig, StripPassword, Create, Open)
+}
+
+// Open opens the WebDAV backend with the given config. If the repository
+// exists, Open checks whether the server supports range requests.
+func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (*Backend, error) {
+	be := newBackend(cfg, rt)
+
+	err := be.checkRanges(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return be, nil
+}
+
+func newBackend(cfg Config, rt http.RoundTripper) *Backend {
+	password, _ := cfg.URL.User.Password()
+	rt = davclient.NewAuthTransport(rt, cfg.URL.User.Username(), password, cfg.BearerToken.Unwrap())
+
+	u := *cfg.URL
+	u.User = nil
+
+	// use path without trailing slash for layout
+	dir := u.Path
+	if len(dir) > 1 && dir[len(dir)-1] == '/' {
+		dir = dir[:len(dir)-1]
+	}
+
+	return &Backend{
+		url:         &u,
+		connections: cfg.Connections,
+		client:      http.Client{Transport: rt},
+		Layout:      &layout.DefaultLayout{Path: dir, Join: path.Join},
+	}
+}
+
+// Create creates all directories of a new repository on the server.
+func Create(ctx context.Context, cfg Config, rt http.RoundTripper) (*Backend, error) {
+	be := newBackend(cfg, rt)
+
+	_, err := be.Stat(ctx, backend.Handle{Type: backend.ConfigFile})
+	if err == nil {
+		return nil, errors.New("config file already exists")
+	}
+	if !be.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := be.mkdirAll(ctx, be.url.Path); err != nil {
+		return nil, err
+	}
+	for _, d := range be.Paths() {
+		if err := be.mkdirAll(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+
+	return be, nil
+}
+
+func (b *Backend) Connections() uint {
+	return b.connections
+}
+
+// Location returns this backend's location (the server's URL).
+func (b *Backend) Location() string {
+	return b.url.String()
+}
+
+// Hasher may return a hash function for calculating a content hash for the backend
+func (b *Backend) Hasher() hash.Hash {
+	return nil
+}
+
+// HasAtomicReplace returns whether Save() can atomically replace files
+func (b *Backend) HasAtomicReplace() bool {
+	// most servers write directly to the target file
+	return false
+}
+
+// fileURL returns the URL for the path p on the server.
+func (b *Backend) fileURL(p string) string {
+	u := *b.url
+	u.Path = p
+	u.RawPath = ""
+	return u.String()
+}
+
+func (b *Backend) newRequest(ctx context.Context, method, p string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.fileURL(p), body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return req, nil
+}
+
+// drain reads the remaining response body and closes it, so that the
+// connection can be reused.
+func drain(resp *http.Response) error {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// mkdirAll creates the collection at p and all missing parent collections.
+func (b *Backend) mkdirAll(ctx context.Context, p string) error {
+	if p == "" || p == "/" {
+		return nil
+	}
+
+	req, err := b.newRequest(ctx, "MKCOL", strings.TrimSuffix(p, "/")+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "client.Do")
+	}
+	cerr := drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+	case http.StatusMethodNotAllowed:
+		// the collection already exists
+	case http.StatusConflict:
+		// a parent collection is missing
+		if err := b.mkdirAll(ctx, path.Dir(strings.TrimSuffix(p, "/"))); err != nil {
+			return err
+		}
+		return b.mkdirAll(ctx, p)
+	default:
+		return errors.WithStack(newStatusError("MKCOL "+p+", server response", resp))
+	}
+
+	return errors.Wrap(cerr, "Close")
+}
+
+// Save stores data in the backend at the handle. The first upload of a file
+// fails if the file already exists on the server. If a previous upload of the
+// file was interrupted, the partially written file is overwritten.
+func (b *Backend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	initial := !b.wasInterrupted(h)
+	err := b.put(ctx, h, rd, initial)
+
+	var e *statusError
+	if errors.As(err, &e) && (e.statusCode == http.StatusConflict || e.statusCode == http.StatusNotFound) {
+		// the directory for the file is missing
+		debug.Log("creating directory for %v", h)
+		err = b.mkdirAll(ctx, path.Dir(b.Filename(h)))
+		if err == nil {
+			err = rd.Rewind()
+		}
+		if err == nil {
+			err = b.put(ctx, h, rd, initial)
+		}
+	}
+
+	// a failed upload may have left a partial file behind, which is
+	// overwritten by the next attempt
+	exists := errors.As(err, &e) && e.statusCode == http.StatusPreconditionFailed
+	b.setInterrupted(h, err != nil && !exists)
+	return err
+}
+
+func (b *Backend) put(ctx context.Context, h backend.Handle, rd backend.RewindReader, initial bool) error {
+	// make sure that client.Do() cannot close the reader by wrapping it
+	req, err := b.newRequest(ctx, http.MethodPut, b.Filename(h), io.NopCloser(rd))
+	if err != nil {
+		return err
+	}
+	// allows the transport to repeat the request for authentication
+	req.GetBody = func() (io.ReadCloser, error) {
+		if err := rd.Rewind(); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(rd), nil
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if initial {
+		req.Header.Set("If-None-Match", "*")
+	}
+
+	// explicitly set the content length, this prevents chunked encoding and
+	// let's the server know what's coming.
+	req.ContentLength = rd.Length()
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "client.Do")
+	}
+	cerr := drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+	case http.StatusPreconditionFailed:
+		return errors.WithStack(&statusError{msg: fmt.Sprintf("%v already exists", h), status: resp.Status, statusCode: resp.StatusCode})
+	default:
+		return errors.WithStack(newStatusError("server response unexpected", resp))
+	}
+
+	return errors.Wrap(cerr, "Close")
+}
+
+// setInterrupted records whether the last upload of h has failed.
+func (b *Backend) setInterrupted(h backend.Handle, interrupted bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if !interrupted {
+		delete(b.interrupted, h)
+		return
+	}
+	if b.interrupted == nil {
+		b.interrupted = make(map[backend.Handle]struct{})
+	}
+	b.interrupted[h] = struct{}{}
+}
+
+func (b *Backend) wasInterrupted(h backend.Handle) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	_, ok := b.interrupted[h]
+	return ok
+}
+
+// notExistError is returned whenever the requested file does not exist on the
+// server.
+type notExistError struct {
+	backend.Handle
+}
+
+func (e *notExistError) Error() string {
+	return fmt.Sprintf("%v does not exist", e.Handle)
+}
+
+// IsNotExist returns true if the error was caused by a non-existing file.
+func (b *Backend) IsNotExist(err error) bool {
+	var e *notExistError
+	return errors.As(err, &e)
+}
+
+// statusError is returned when the server responds with an unexpected HTTP
+// status code.
+type statusError struct {
+	msg        string
+	status     string
+	statusCode int
+}
+
+func newStatusError(msg string, resp *http.Response) *statusError {
+	return &statusError{msg: msg, status: resp.Status, statusCode: resp.StatusCode}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v: %v (%v)", e.msg, e.status, e.statusCode)
+}
+
+// IsPermanentError returns true if the server rejected the credentials, denied
+// access, has no space left or the file to be uploaded already exists.
+func (b *Backend) IsPermanentError(err error) bool {
+	var e *statusError
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusPreconditionFailed, http.StatusInsufficientStorage:
+		return true
+	}
+	return false
+}
+
+// IsDeletionForbidden returns true if the server does not allow removing the
+// file.
+func (b *Backend) IsDeletionForbidden(err error) bool {
+	var e *statusError
+	return errors.As(err, &e) && e.statusCode == http.StatusForbidden
+}
+
+// IsThrottled returns true if the server has rejected the request because too
+// many requests were sent.
+func (b *Backend) IsThrottled(err error) bool {
+	var e *statusError
+	return errors.As(err, &e) && (e.statusCode == http.StatusTooManyRequests || e.statusCode == http.StatusServiceUnavailable)
+}
+
+// checkRanges requests the first byte of the config file to find out whether
+// the server supports range requests. If the config file does not exist, the
+// check is done by the first partial Load.
+func (b *Backend) checkRanges(ctx context.Context) error {
+	h := backend.Handle{Type: backend.ConfigFile}
+	rd, err := b.openReader(ctx, h, 1, 0)
+	if b.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return rd.Close()
+}
+
+// rangesUnsupported records that the server ignores range requests.
+func (b *Backend) rangesUnsupported() {
+	b.noRanges.Store(true)
+	b.warnOnce.Do(func() {
+		debug.Log("server ignores range requests")
+		fmt.Fprintf(os.Stderr, "webdav: the server does not support range requests, partial reads download the whole file\n")
+	})
+}
+
+// Load runs fn with a reader that yields the contents of the file at h at the
+// given offset.
+func (b *Backend) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	return util.DefaultLoad(ctx, h, length, offset, b.openReader, fn)
+}
+
+// partialReader returns the requested part of a full download.
+type partialReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (b *Backend) openReader(ctx context.Context, h backend.Handle, length int, offset int64) (io.ReadCloser, error) {
+	req, err := b.newRequest(ctx, http.MethodGet, b.Filename(h), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	partial := length > 0 || offset > 0
+	if partial && !b.noRanges.Load() {
+		byteRange := fmt.Sprintf("bytes=%d-", offset)
+		if length > 0 {
+			byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1)
+		}
+		req.Header.Set("Range", byteRange)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "client.Do")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		if !partial {
+			return resp.Body, nil
+		}
+	case http.StatusNotFound:
+		_ = drain(resp)
+		return nil, &notExistError{h}
+	default:
+		_ = drain(resp)
+		return nil, errors.WithStack(newStatusError("unexpected HTTP response", resp))
+	}
+
+	// the server has sent the whole file
+	if req.Header.Get("Range") != "" {
+		b.rangesUnsupported()
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+		_ = resp.Body.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "skip to offset")
+	}
+
+	var rd io.Reader = resp.Body
+	if length > 0 {
+		rd = io.LimitReader(resp.Body, int64(length))
+	}
+	return partialReader{Reader: rd, Closer: resp.Body}, nil
+}
+
+// propfind runs fn for each resource returned by a PROPFIND request for p.
+// The resource p itself is also passed to fn. The returned bool is false if
+// p does not exist.
+func (b *Backend) propfind(ctx context.Context, p string, depth string, fn func(davclient.Resource) error) (bool, error) {
+	req, err := b.newRequest(ctx, "PROPFIND", p, strings.NewReader(davclient.PropfindBody))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range davclient.PropfindHeader(depth) {
+		req.Header[name] = values
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false, errors.Wrap(err, "client.Do")
+	}
+	defer func() {
+		_ = drain(resp)
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.WithStack(newStatusError("PROPFIND "+p+", server response", resp))
+	}
+
+	if err := davclient.DecodeMultistatus(resp.Body, fn); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// fileInfo returns the file info for the resource res.
+func fileInfo(res davclient.Resource) backend.FileInfo {
+	size := res.Size
+	if size < 0 {
+		size = 0
+	}
+	return backend.FileInfo{Name: path.Base(res.Path), Size: size}
+}
+
+// Stat returns information about a blob.
+func (b *Backend) Stat(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+	var fi *davclient.Resource
+	found, err := b.propfind(ctx, b.Filename(h), "0", func(res davclient.Resource) error {
+		fi = &res
+		return nil
+	})
+	if err != nil {
+		return backend.FileInfo{}, err
+	}
+	if !found {
+		return backend.FileInfo{}, &notExistError{h}
+	}
+	if fi == nil {
+		return backend.FileInfo{}, errors.Errorf("no properties returned for %v", h)
+	}
+	if fi.IsDir {
+		return backend.FileInfo{}, errors.Errorf("%v is a directory", h)
+	}
+
+	info := fileInfo(*fi)
+	info.Name = h.Name
+	return info, nil
+}
+
+// Remove removes the blob with the given name and type.
+func (b *Backend) Remove(ctx context.Context, h backend.Handle) error {
+	req, err := b.newRequest(ctx, http.MethodDelete, b.Filename(h), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "client.Do")
+	}
+	cerr := drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusNotFound:
+		return &notExistError{h}
+	default:
+		return errors.WithStack(newStatusError("blob not removed, server response", resp))
+	}
+
+	return errors.Wrap(cerr, "Close")
+}
+
+// List runs fn for each file in the backend which has the type t. When an
+// error occurs (or fn returns an error), List stops and returns it.
+func (b *Backend) List(ctx context.Context, t backend.FileType, fn func(backend.FileInfo) error) error {
+	basedir, subdirs := b.Basedir(t)
+
+	var dirs []string
+	err := b.listDir(ctx, basedir, func(res davclient.Resource) error {
+		if res.IsDir {
+			if subdirs {
+				dirs = append(dirs, res.Path)
+			}
+			return nil
+		}
+		return fn(fileInfo(res))
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		err := b.listDir(ctx, dir, func(res davclient.Resource) error {
+			if res.IsDir {
+				return nil
+			}
+			return fn(fileInfo(res))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
+
+// listDir runs fn for each resource within the collection dir. Missing
+// collections are ignored.
+func (b *Backend) listDir(ctx context.Context, dir string, fn func(davclient.Resource) error) error {
+	dir = path.Clean("/" + dir)
+	_, err := b.propfind(ctx, strings.TrimSuffix(dir, "/")+"/", "1", func(res davclient.Resource) error {
+		if res.Path == dir {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fn(res)
+	})
+	return err
+}
+
+// Close closes all open files.
+func (b *Backend) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
+
+// Delete removes all data in the backend.
+func (b *Backend) Delete(ctx context.Context) error {
+	req, err := b.newRequest(ctx, http.MethodDelete, b.url.Path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "client.Do")
+	}
+	cerr := drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+	default:
+		return errors.WithStack(newStatusError("repository not removed, server response", resp))
+	}
+
+	return errors.Wrap(cerr, "Close")
+}
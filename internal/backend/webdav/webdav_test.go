@@ -0,0 +1,301 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/test"
+	"github.com/restic/restic/internal/backend/webdav/davclient"
+	"github.com/restic/restic/internal/options"
+	rtest "github.com/restic/restic/internal/test"
+
+	"golang.org/x/net/webdav"
+)
+
+// testServer is a WebDAV server which stores the files in a local directory.
+type testServer struct {
+	dir     string
+	handler *webdav.Handler
+
+	// noRanges lets the server ignore the Range header
+	noRanges bool
+	// auth is the authentication scheme required by the server, one of
+	// "basic", "digest" or "bearer". No authentication is required if it is
+	// empty.
+	auth string
+
+	// ranged counts the GET requests with a Range header
+	ranged int32
+
+	m     sync.Mutex
+	nonce int
+}
+
+const (
+	testUser     = "user"
+	testPassword = "secret"
+	testToken    = "token"
+	testRealm    = "restic"
+)
+
+func newTestServer(t testing.TB) *testServer {
+	dir := rtest.TempDir(t)
+	return &testServer{
+		dir: dir,
+		handler: &webdav.Handler{
+			FileSystem: webdav.Dir(dir),
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+}
+
+// start starts the server and returns the URL of the repository at p.
+func (s *testServer) start(t testing.TB, p string) *url.URL {
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL + p)
+	rtest.OK(t, err)
+	return u
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		s.challenge(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&s.ranged, 1)
+		}
+		if s.noRanges {
+			r.Header.Del("Range")
+		}
+	case http.MethodPut:
+		// the handler does not support conditional requests
+		if r.Header.Get("If-None-Match") == "*" {
+			if _, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(r.URL.Path))); err == nil {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+	}
+
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *testServer) currentNonce() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return fmt.Sprintf("nonce%d", s.nonce)
+}
+
+// expireNonce lets the server reject the current digest nonce as stale.
+func (s *testServer) expireNonce() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.nonce++
+}
+
+func (s *testServer) challenge(w http.ResponseWriter, r *http.Request) {
+	switch s.auth {
+	case "basic":
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, testRealm))
+	case "digest":
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, testRealm))
+		// the nonce is stale if the client has used an old one
+		_, p := davclient.ParseChallenge(r.Header.Get("Authorization"))
+		stale := p["nonce"] != "" && p["nonce"] != s.currentNonce()
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Digest realm=%q, nonce=%q, qop="auth", algorithm=MD5, stale=%v`, testRealm, s.currentNonce(), stale))
+	case "bearer":
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *testServer) authorized(r *http.Request) bool {
+	switch s.auth {
+	case "basic":
+		user, password, ok := r.BasicAuth()
+		return ok && user == testUser && password == testPassword
+	case "digest":
+		scheme, p := davclient.ParseChallenge(r.Header.Get("Authorization"))
+		if scheme != "digest" || p["username"] != testUser || p["nonce"] != s.currentNonce() || p["uri"] != r.URL.RequestURI() {
+			return false
+		}
+		ha1 := md5hex(testUser + ":" + testRealm + ":" + testPassword)
+		ha2 := md5hex(r.Method + ":" + p["uri"])
+		return p["response"] == md5hex(ha1+":"+p["nonce"]+":"+p["nc"]+":"+p["cnonce"]+":auth:"+ha2)
+	case "bearer":
+		return r.Header.Get("Authorization") == "Bearer "+testToken
+	}
+	return true
+}
+
+func newTestSuite(t testing.TB, srv *testServer) *test.Suite[Config] {
+	base := srv.start(t, "/")
+	var n int32
+
+	return &test.Suite[Config]{
+		NewConfig: func() (*Config, error) {
+			cfg := NewConfig()
+			// use a new repository for each call, which is below a
+			// missing collection
+			cfg.URL = base.JoinPath(fmt.Sprintf("parent/repo-%d/", atomic.AddInt32(&n, 1)))
+			return &cfg, nil
+		},
+
+		Factory: NewFactory(),
+	}
+}
+
+func TestBackendWebDAV(t *testing.T) {
+	newTestSuite(t, newTestServer(t)).RunTests(t)
+}
+
+func BenchmarkBackendWebDAV(t *testing.B) {
+	newTestSuite(t, newTestServer(t)).RunBenchmarks(t)
+}
+
+func newTestConfig(u *url.URL, auth string) Config {
+	cfg := NewConfig()
+	cfg.URL = &url.URL{}
+	*cfg.URL = *u
+	switch auth {
+	case "basic", "digest":
+		cfg.URL.User = url.UserPassword(testUser, testPassword)
+	case "bearer":
+		cfg.BearerToken = options.NewSecretString(testToken)
+	}
+	return cfg
+}
+
+func saveAndLoad(t testing.TB, be *Backend) {
+	h := backend.Handle{Type: backend.PackFile, Name: "0123456789abcdef"}
+	data := rtest.Random(23, 64*1024)
+	rtest.OK(t, be.Save(context.TODO(), h, backend.NewByteReader(data, nil)))
+
+	var buf []byte
+	err := be.Load(context.TODO(), h, 100, 1000, func(rd io.Reader) (err error) {
+		buf, err = io.ReadAll(rd)
+		return err
+	})
+	rtest.OK(t, err)
+	rtest.Equals(t, data[1000:1100], buf)
+
+	var names []string
+	err = be.List(context.TODO(), backend.PackFile, func(fi backend.FileInfo) error {
+		rtest.Equals(t, int64(len(data)), fi.Size)
+		names = append(names, fi.Name)
+		return nil
+	})
+	rtest.OK(t, err)
+	rtest.Equals(t, []string{h.Name}, names)
+}
+
+func TestAuth(t *testing.T) {
+	for _, auth := range []string{"basic", "digest", "bearer"} {
+		t.Run(auth, func(t *testing.T) {
+			srv := newTestServer(t)
+			srv.auth = auth
+			u := srv.start(t, "/repo/")
+
+			be, err := Create(context.TODO(), newTestConfig(u, auth), http.DefaultTransport)
+			rtest.OK(t, err)
+			defer func() {
+				rtest.OK(t, be.Close())
+			}()
+			saveAndLoad(t, be)
+
+			_, err = Open(context.TODO(), newTestConfig(u, ""), http.DefaultTransport)
+			rtest.Assert(t, err != nil && be.IsPermanentError(err), "expected permanent error, got %v", err)
+		})
+	}
+}
+
+func TestAuthDigestStaleNonce(t *testing.T) {
+	srv := newTestServer(t)
+	srv.auth = "digest"
+	u := srv.start(t, "/repo/")
+
+	be, err := Create(context.TODO(), newTestConfig(u, "digest"), http.DefaultTransport)
+	rtest.OK(t, err)
+
+	// the upload is repeated with the new nonce
+	srv.expireNonce()
+	saveAndLoad(t, be)
+}
+
+func TestAuthWrongPassword(t *testing.T) {
+	srv := newTestServer(t)
+	srv.auth = "digest"
+	u := srv.start(t, "/repo/")
+
+	cfg := newTestConfig(u, "digest")
+	cfg.URL.User = url.UserPassword(testUser, "wrong")
+	_, err := Create(context.TODO(), cfg, http.DefaultTransport)
+	rtest.Assert(t, err != nil, "Create with wrong password did not fail")
+}
+
+func TestNoRanges(t *testing.T) {
+	srv := newTestServer(t)
+	srv.noRanges = true
+	u := srv.start(t, "/repo/")
+
+	cfg := NewConfig()
+	cfg.URL = u
+	be, err := Create(context.TODO(), cfg, http.DefaultTransport)
+	rtest.OK(t, err)
+	h := backend.Handle{Type: backend.ConfigFile}
+	rtest.OK(t, be.Save(context.TODO(), h, backend.NewByteReader([]byte("config"), nil)))
+
+	// Open detects that the server ignores the Range header
+	be, err = Open(context.TODO(), cfg, http.DefaultTransport)
+	rtest.OK(t, err)
+	rtest.Assert(t, be.noRanges.Load(), "missing range requests were not detected")
+	rtest.Equals(t, int32(1), atomic.LoadInt32(&srv.ranged))
+
+	// partial reads are emulated without sending further range requests
+	saveAndLoad(t, be)
+	rtest.Equals(t, int32(1), atomic.LoadInt32(&srv.ranged))
+}
+
+func TestSaveExisting(t *testing.T) {
+	srv := newTestServer(t)
+	cfg := NewConfig()
+	cfg.URL = srv.start(t, "/repo/")
+
+	be, err := Create(context.TODO(), cfg, http.DefaultTransport)
+	rtest.OK(t, err)
+
+	h := backend.Handle{Type: backend.SnapshotFile, Name: "0123456789abcdef"}
+	rtest.OK(t, be.Save(context.TODO(), h, backend.NewByteReader([]byte("foo"), nil)))
+
+	err = be.Save(context.TODO(), h, backend.NewByteReader([]byte("bar"), nil))
+	rtest.Assert(t, err != nil && be.IsPermanentError(err), "expected permanent error, got %v", err)
+
+	// the file was not replaced
+	data, err := os.ReadFile(filepath.Join(srv.dir, "repo", "snapshots", h.Name))
+	rtest.OK(t, err)
+	rtest.Assert(t, bytes.Equal([]byte("foo"), data), "file was replaced")
+}
@@ -243,3 +243,9 @@ func (c *Cache) Wrap(be backend.Backend) backend.Backend {
 func (c *Cache) BaseDir() string {
 	return c.Base
 }
+
+// LazyIndexFile returns the name of the file which stores the filters of the
+// lazy index.
+func (c *Cache) LazyIndexFile() string {
+	return filepath.Join(c.path, "lazy-index")
+}
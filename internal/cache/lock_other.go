@@ -0,0 +1,17 @@
+//go:build aix || solaris
+
+package cache
+
+import "os"
+
+// lockFile does nothing, flock(2) is not available on this platform and
+// fcntl(2) locks are released as soon as any file descriptor of the process
+// for the file is closed.
+func lockFile(_ *os.File, _ bool) error {
+	return nil
+}
+
+// unlockFile does nothing.
+func unlockFile(_ *os.File) error {
+	return nil
+}
@@ -0,0 +1,406 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/restic"
+)
+
+// PackCache stores complete data pack files, so that restoring or checking
+// the same data again does not need to download them from the repository.
+// The total size of the cached files is kept below a maximum, the files which
+// have not been used for the longest time are removed first.
+//
+// Several restic processes may use the same pack cache. Files are added
+// atomically, a lock file makes sure that no file is removed while another
+// process opens it.
+type PackCache struct {
+	dir     string
+	maxSize int64
+
+	// verified contains the names of the cached files which have been checked
+	// against their ID by this process.
+	verifiedMutex sync.Mutex
+	verified      map[string]struct{}
+
+	// size is the total size of the cached files. It is determined when the
+	// pack cache is opened and updated for the files which this process adds
+	// or removes, files added by other processes are only noticed when the
+	// directory is scanned again to evict files.
+	sizeMutex sync.Mutex
+	size      int64
+
+	hits, misses uint64
+}
+
+// PackCacheStats contains the number of loads served from the pack cache and
+// the number of loads which needed to download the pack file.
+type PackCacheStats struct {
+	Hits, Misses uint64
+}
+
+const packCacheDir = "packs"
+
+// staleTempFileAge is the age after which a temporary file is assumed to be
+// left over from a restic process which has been interrupted.
+const staleTempFileAge = 24 * time.Hour
+
+// NewPackCache returns a pack cache for the repo ID at basedir which holds up
+// to maxSize bytes. If basedir is the empty string, the default cache location
+// is used.
+func NewPackCache(id string, basedir string, maxSize int64) (*PackCache, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("invalid maximum size for the pack cache")
+	}
+
+	if basedir == "" {
+		var err error
+		basedir, err = DefaultDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := fs.MkdirAll(basedir, dirMode)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err = writeCachedirTag(basedir); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(basedir, id, packCacheDir)
+	if err = fs.MkdirAll(dir, dirMode); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	debug.Log("using pack cache dir %v, max size %d", dir, maxSize)
+
+	c := &PackCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		verified: make(map[string]struct{}),
+	}
+	if _, c.size, err = c.scan(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Wrap returns a backend which loads data pack files from the pack cache.
+func (c *PackCache) Wrap(be backend.Backend) backend.Backend {
+	return newPackCacheBackend(be, c)
+}
+
+// Stats returns the number of hits and misses so far.
+func (c *PackCache) Stats() PackCacheStats {
+	return PackCacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+func (c *PackCache) filename(h backend.Handle) string {
+	return filepath.Join(c.dir, h.Name[:2], h.Name)
+}
+
+// lock acquires the lock for the pack cache. A shared lock is held while a
+// file is opened or added, an exclusive lock while files are removed.
+func (c *PackCache) lock(exclusive bool) (unlock func(), err error) {
+	f, err := fs.OpenFile(filepath.Join(c.dir, "lock"), os.O_CREATE|os.O_RDWR, fileMode)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err = lockFile(f, exclusive); err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "lock")
+	}
+
+	return func() {
+		_ = unlockFile(f)
+		_ = f.Close()
+	}, nil
+}
+
+func (c *PackCache) isVerified(name string) bool {
+	c.verifiedMutex.Lock()
+	defer c.verifiedMutex.Unlock()
+	_, ok := c.verified[name]
+	return ok
+}
+
+func (c *PackCache) setVerified(name string, verified bool) {
+	c.verifiedMutex.Lock()
+	defer c.verifiedMutex.Unlock()
+	if verified {
+		c.verified[name] = struct{}{}
+	} else {
+		delete(c.verified, name)
+	}
+}
+
+// verify checks that the content of f matches the pack file ID.
+func verify(f io.ReadSeeker, id restic.ID) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !bytes.Equal(h.Sum(nil), id[:]) {
+		return errors.Errorf("cached pack file %v is damaged", id.Str())
+	}
+
+	_, err := f.Seek(0, io.SeekStart)
+	return errors.WithStack(err)
+}
+
+// load returns a reader for the range of the cached pack file. The file is
+// verified the first time it is used by this process. A damaged file is
+// removed.
+func (c *PackCache) load(h backend.Handle, length int, offset int64) (io.ReadCloser, error) {
+	id, err := restic.ParseID(h.Name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	unlock, err := c.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	filename := c.filename(h)
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if !c.isVerified(h.Name) {
+		if err := verify(f, id); err != nil {
+			debug.Log("removing %v: %v", filename, err)
+			_ = f.Close()
+			_ = c.removeFile(filename)
+			return nil, err
+		}
+		c.setVerified(h.Name, true)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	if fi.Size() < offset+int64(length) {
+		_ = f.Close()
+		return nil, errors.Errorf("cached pack file %v is too small", h)
+	}
+
+	// the modification time records when the file was last used
+	now := time.Now()
+	if err := fs.Chtimes(filename, now, now); err != nil {
+		debug.Log("unable to update timestamp of %v: %v", filename, err)
+	}
+
+	if offset > 0 {
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if length <= 0 {
+		return f, nil
+	}
+	return backend.LimitReadCloser(f, int64(length)), nil
+}
+
+// save stores the pack file read from rd in the pack cache, if its content
+// matches the ID. Files which are larger than the maximum size of the pack
+// cache are not stored.
+func (c *PackCache) save(h backend.Handle, rd io.Reader) error {
+	id, err := restic.ParseID(h.Name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	finalname := c.filename(h)
+	dir := filepath.Dir(finalname)
+	err = fs.Mkdir(dir, dirMode)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.CreateTemp(dir, "tmp-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(f, io.TeeReader(rd, hash))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !bytes.Equal(hash.Sum(nil), id[:]) {
+		err = errors.Errorf("content of pack file %v does not match its ID", id.Str())
+	}
+	if err != nil || n > c.maxSize {
+		_ = fs.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+
+	unlock, err := c.lock(false)
+	if err != nil {
+		_ = fs.Remove(f.Name())
+		return err
+	}
+	err = fs.Rename(f.Name(), finalname)
+	unlock()
+	if err != nil {
+		// on Windows, the file may be in use by another process which has
+		// stored the same file
+		_ = fs.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	c.setVerified(h.Name, true)
+
+	if !c.grow(n) {
+		return nil
+	}
+	return c.evict()
+}
+
+// grow adds n bytes to the total size of the cached files and reports
+// whether it exceeds the maximum.
+func (c *PackCache) grow(n int64) bool {
+	c.sizeMutex.Lock()
+	defer c.sizeMutex.Unlock()
+	c.size += n
+	return c.size > c.maxSize
+}
+
+// remove deletes the pack file from the cache. No error is returned if the
+// file is not cached.
+func (c *PackCache) remove(h backend.Handle) error {
+	c.setVerified(h.Name, false)
+	return c.removeFile(c.filename(h))
+}
+
+// removeFile deletes the cached file name and subtracts its size from the
+// total. No error is returned if the file does not exist.
+func (c *PackCache) removeFile(name string) error {
+	fi, err := fs.Lstat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = fs.Remove(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c.grow(-fi.Size())
+	return nil
+}
+
+type cachedPack struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// scan returns the cached files and their total size. Stale temporary files
+// are removed.
+func (c *PackCache) scan() (files []cachedPack, total int64, err error) {
+	err = filepath.Walk(c.dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrap(err, "Walk")
+		}
+
+		if !isFile(fi) || filepath.Dir(name) == c.dir {
+			return nil
+		}
+
+		if strings.HasPrefix(fi.Name(), "tmp-") {
+			if IsOld(fi.ModTime(), staleTempFileAge) {
+				debug.Log("removing stale temporary file %v", name)
+				_ = fs.Remove(name)
+			}
+			return nil
+		}
+
+		files = append(files, cachedPack{name: name, size: fi.Size(), modTime: fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return files, total, nil
+}
+
+// evict scans the pack cache and removes the least recently used files until
+// the total size is below the maximum. It is only called when the size
+// tracked by this process exceeds the maximum.
+func (c *PackCache) evict() error {
+	unlock, err := c.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files, total, err := c.scan()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		c.sizeMutex.Lock()
+		c.size = total
+		c.sizeMutex.Unlock()
+	}()
+
+	if total <= c.maxSize {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	for _, file := range files {
+		if total <= c.maxSize {
+			break
+		}
+
+		debug.Log("evicting %v from pack cache", file.name)
+		if err := fs.Remove(file.name); err != nil {
+			// the file may still be open on Windows
+			debug.Log("unable to remove %v: %v", file.name, err)
+			continue
+		}
+		c.setVerified(filepath.Base(file.name), false)
+		total -= file.size
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+)
+
+// packCacheBackend wraps a backend.Backend and loads data pack files from
+// the pack cache. Pack files which are not cached yet are downloaded
+// completely and stored in the pack cache, also for ranged reads.
+type packCacheBackend struct {
+	backend.Backend
+	cache *PackCache
+
+	// inProgress contains the handle for all files that are currently
+	// downloaded. The channel in the value is closed as soon as the download
+	// is finished.
+	inProgressMutex sync.Mutex
+	inProgress      map[backend.Handle]chan struct{}
+}
+
+// ensure packCacheBackend implements backend.Backend
+var _ backend.Backend = &packCacheBackend{}
+
+func newPackCacheBackend(be backend.Backend, c *PackCache) *packCacheBackend {
+	return &packCacheBackend{
+		Backend:    be,
+		cache:      c,
+		inProgress: make(map[backend.Handle]chan struct{}),
+	}
+}
+
+// cachePack returns true for data pack files. Pack files with metadata are
+// stored in the metadata cache.
+func cachePack(h backend.Handle) bool {
+	return h.Type == backend.PackFile && !h.IsMetadata && len(h.Name) == 64
+}
+
+// Save stores a new file in the backend. Data pack files are also stored in
+// the pack cache, errors doing so are ignored.
+func (b *packCacheBackend) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	err := b.Backend.Save(ctx, h, rd)
+	if err != nil || !cachePack(h) {
+		return err
+	}
+
+	err = rd.Rewind()
+	if err == nil {
+		err = b.cache.save(h, rd)
+	}
+	if err != nil {
+		debug.Log("unable to save %v to pack cache: %v", h, err)
+	}
+	return nil
+}
+
+// Remove deletes a file from the backend and the pack cache.
+func (b *packCacheBackend) Remove(ctx context.Context, h backend.Handle) error {
+	err := b.Backend.Remove(ctx, h)
+	if err != nil || !cachePack(h) {
+		return err
+	}
+
+	return b.cache.remove(h)
+}
+
+// download stores the pack file in the pack cache. If the file is already
+// being downloaded, download waits for it to finish.
+func (b *packCacheBackend) download(ctx context.Context, h backend.Handle) error {
+	h = backend.Handle{Type: h.Type, Name: h.Name}
+	finish := make(chan struct{})
+
+	b.inProgressMutex.Lock()
+	other, alreadyDownloading := b.inProgress[h]
+	if !alreadyDownloading {
+		b.inProgress[h] = finish
+	}
+	b.inProgressMutex.Unlock()
+
+	if alreadyDownloading {
+		debug.Log("download of %v is already performed by somebody else, waiting...", h)
+		select {
+		case <-other:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	defer func() {
+		close(finish)
+
+		b.inProgressMutex.Lock()
+		delete(b.inProgress, h)
+		b.inProgressMutex.Unlock()
+	}()
+
+	return b.Backend.Load(ctx, h, 0, 0, func(rd io.Reader) error {
+		return b.cache.save(h, rd)
+	})
+}
+
+// loadFromCache runs consumer with the range of the cached pack file. The
+// returned bool is false if the file is not cached.
+func (b *packCacheBackend) loadFromCache(h backend.Handle, length int, offset int64, consumer func(rd io.Reader) error) (bool, error) {
+	rd, err := b.cache.load(h, length, offset)
+	if err != nil {
+		debug.Log("unable to load %v from pack cache: %v", h, err)
+		return false, nil
+	}
+
+	err = consumer(rd)
+	if err != nil {
+		_ = rd.Close() // ignore secondary errors
+		return true, err
+	}
+	return true, rd.Close()
+}
+
+// Load loads a file from the pack cache or the backend.
+func (b *packCacheBackend) Load(ctx context.Context, h backend.Handle, length int, offset int64, consumer func(rd io.Reader) error) error {
+	if !cachePack(h) {
+		return b.Backend.Load(ctx, h, length, offset, consumer)
+	}
+
+	if ok, err := b.loadFromCache(h, length, offset, consumer); ok {
+		atomic.AddUint64(&b.cache.hits, 1)
+		return err
+	}
+
+	atomic.AddUint64(&b.cache.misses, 1)
+	err := b.download(ctx, h)
+	if err == nil {
+		if ok, err := b.loadFromCache(h, length, offset, consumer); ok {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && b.Backend.IsNotExist(err) {
+		return err
+	}
+
+	debug.Log("unable to cache %v: %v, falling back to backend", h, err)
+	return b.Backend.Load(ctx, h, length, offset, consumer)
+}
+
+// Stat returns information about a file in the backend. If it does not
+// exist, it is also removed from the pack cache.
+func (b *packCacheBackend) Stat(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+	fi, err := b.Backend.Stat(ctx, h)
+	if err != nil && cachePack(h) && b.Backend.IsNotExist(err) {
+		// try to remove from the cache, ignore errors
+		_ = b.cache.remove(h)
+	}
+
+	return fi, err
+}
+
+func (b *packCacheBackend) Unwrap() backend.Backend {
+	return b.Backend
+}
@@ -0,0 +1,321 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/mem"
+	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/test"
+)
+
+// countingBackend counts the calls to Load.
+type countingBackend struct {
+	backend.Backend
+
+	m     sync.Mutex
+	loads int
+}
+
+func (be *countingBackend) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	be.m.Lock()
+	be.loads++
+	be.m.Unlock()
+	return be.Backend.Load(ctx, h, length, offset, fn)
+}
+
+func (be *countingBackend) count() int {
+	be.m.Lock()
+	defer be.m.Unlock()
+	return be.loads
+}
+
+func testNewPackCache(t testing.TB, dir string, maxSize int64) *PackCache {
+	c, err := NewPackCache("repo", dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func randomPack(n int) (backend.Handle, []byte) {
+	h, data := randomData(n)
+	h.Type = backend.PackFile
+	return h, data
+}
+
+func loadRange(t testing.TB, be backend.Backend, h backend.Handle, length int, offset int64) []byte {
+	var buf []byte
+	err := be.Load(context.TODO(), h, length, offset, func(rd io.Reader) (err error) {
+		buf, err = io.ReadAll(rd)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func (c *PackCache) has(h backend.Handle) bool {
+	_, err := os.Stat(c.filename(h))
+	return err == nil
+}
+
+func TestPackCacheLoad(t *testing.T) {
+	be := &countingBackend{Backend: mem.New()}
+	c := testNewPackCache(t, test.TempDir(t), 100*1024*1024)
+	wbe := c.Wrap(be)
+
+	h, data := randomPack(1024 * 1024)
+	save(t, be, h, data)
+
+	// a ranged read downloads the whole file
+	test.Equals(t, data[1000:1100], loadRange(t, wbe, h, 100, 1000))
+	test.Assert(t, c.has(h), "pack file was not cached")
+	test.Equals(t, 1, be.count())
+	test.Equals(t, PackCacheStats{Hits: 0, Misses: 1}, c.Stats())
+
+	// further reads are served from the cache
+	test.Equals(t, data[5000:], loadRange(t, wbe, h, 0, 5000))
+	loadAndCompare(t, wbe, h, data)
+	test.Equals(t, 1, be.count())
+	test.Equals(t, PackCacheStats{Hits: 2, Misses: 1}, c.Stats())
+
+	// removing the file also removes it from the cache
+	remove(t, wbe, h)
+	test.Assert(t, !c.has(h), "pack file is still cached")
+	err := wbe.Load(context.TODO(), h, 0, 0, func(rd io.Reader) error { return nil })
+	test.Assert(t, be.IsNotExist(err), "unexpected error %v", err)
+}
+
+func TestPackCacheSave(t *testing.T) {
+	be := &countingBackend{Backend: mem.New()}
+	c := testNewPackCache(t, test.TempDir(t), 100*1024*1024)
+	wbe := c.Wrap(be)
+
+	h, data := randomPack(1024 * 1024)
+	save(t, wbe, h, data)
+	test.Assert(t, c.has(h), "pack file was not cached")
+
+	loadAndCompare(t, wbe, h, data)
+	test.Equals(t, 0, be.count())
+	test.Equals(t, PackCacheStats{Hits: 1, Misses: 0}, c.Stats())
+}
+
+func TestPackCacheOtherFiles(t *testing.T) {
+	be := &countingBackend{Backend: mem.New()}
+	c := testNewPackCache(t, test.TempDir(t), 100*1024*1024)
+	wbe := c.Wrap(be)
+
+	// pack files with metadata are left to the metadata cache
+	h, data := randomPack(1024)
+	h.IsMetadata = true
+	save(t, wbe, h, data)
+	loadAndCompare(t, wbe, h, data)
+
+	h2, data2 := randomData(1024)
+	save(t, wbe, h2, data2)
+	loadAndCompare(t, wbe, h2, data2)
+
+	test.Assert(t, !c.has(h) && !c.has(h2), "file was cached")
+	test.Equals(t, 2, be.count())
+	test.Equals(t, PackCacheStats{}, c.Stats())
+}
+
+func TestPackCacheDamaged(t *testing.T) {
+	dir := test.TempDir(t)
+	be := &countingBackend{Backend: mem.New()}
+	c := testNewPackCache(t, dir, 100*1024*1024)
+
+	h, data := randomPack(64 * 1024)
+	save(t, c.Wrap(be), h, data)
+
+	// damage the cached file, a new process must detect it
+	buf := append([]byte{}, data...)
+	buf[100] ^= 0xff
+	test.OK(t, os.WriteFile(c.filename(h), buf, fileMode))
+
+	c = testNewPackCache(t, dir, 100*1024*1024)
+	loadAndCompare(t, c.Wrap(be), h, data)
+	test.Equals(t, 1, be.count())
+	test.Equals(t, PackCacheStats{Hits: 0, Misses: 1}, c.Stats())
+
+	// the file has been replaced with the content from the backend
+	cached, err := os.ReadFile(c.filename(h))
+	test.OK(t, err)
+	test.Assert(t, bytes.Equal(cached, data), "damaged file was not replaced")
+}
+
+func TestPackCacheInvalidContent(t *testing.T) {
+	be := &countingBackend{Backend: mem.New()}
+	c := testNewPackCache(t, test.TempDir(t), 100*1024*1024)
+	wbe := c.Wrap(be)
+
+	// files whose content does not match their ID are passed on unchanged
+	h, _ := randomPack(1024)
+	_, data := randomPack(1024)
+	test.OK(t, be.Save(context.TODO(), h, backend.NewByteReader(data, be.Hasher())))
+
+	test.Equals(t, data, loadRange(t, wbe, h, 0, 0))
+	test.Assert(t, !c.has(h), "invalid file was cached")
+	test.Equals(t, 2, be.count())
+}
+
+func TestPackCacheEvict(t *testing.T) {
+	be := mem.New()
+	c := testNewPackCache(t, test.TempDir(t), 3*1024)
+	wbe := c.Wrap(be)
+
+	var handles []backend.Handle
+	for i := 0; i < 3; i++ {
+		h, data := randomPack(1024)
+		save(t, wbe, h, data)
+		handles = append(handles, h)
+
+		// make sure the files have different timestamps
+		ts := time.Now().Add(time.Duration(i-10) * time.Hour)
+		test.OK(t, os.Chtimes(c.filename(h), ts, ts))
+	}
+
+	// using the oldest file keeps it in the cache
+	_ = loadRange(t, wbe, handles[0], 10, 0)
+
+	h, data := randomPack(1024)
+	save(t, wbe, h, data)
+
+	test.Assert(t, c.has(handles[0]), "recently used file was removed")
+	test.Assert(t, !c.has(handles[1]), "least recently used file was not removed")
+	test.Assert(t, c.has(handles[2]), "file was removed")
+	test.Assert(t, c.has(h), "new file was removed")
+
+	// files larger than the cache are not stored
+	h, data = randomPack(4 * 1024)
+	save(t, wbe, h, data)
+	test.Assert(t, !c.has(h), "large file was cached")
+}
+
+func TestPackCacheSize(t *testing.T) {
+	basedir := test.TempDir(t)
+	be := mem.New()
+	c := testNewPackCache(t, basedir, 3*1024)
+	wbe := c.Wrap(be)
+
+	var handles []backend.Handle
+	for i := 0; i < 2; i++ {
+		h, data := randomPack(1024)
+		save(t, wbe, h, data)
+		handles = append(handles, h)
+	}
+	test.Equals(t, int64(2*1024), c.size)
+	test.OK(t, c.remove(handles[1]))
+	test.Equals(t, int64(1024), c.size)
+
+	// the size of the files cached before is taken into account
+	c = testNewPackCache(t, basedir, 3*1024)
+	test.Equals(t, int64(1024), c.size)
+	wbe = c.Wrap(be)
+	for i := 0; i < 3; i++ {
+		h, data := randomPack(1024)
+		save(t, wbe, h, data)
+		ts := time.Now().Add(time.Duration(i-10) * time.Hour)
+		test.OK(t, os.Chtimes(c.filename(h), ts, ts))
+	}
+	test.Assert(t, c.size <= 3*1024, "total size %d exceeds the maximum", c.size)
+	files, total, err := c.scan()
+	test.OK(t, err)
+	test.Equals(t, 3, len(files))
+	test.Equals(t, total, c.size)
+}
+
+func TestPackCacheStaleTempFiles(t *testing.T) {
+	basedir := test.TempDir(t)
+	c := testNewPackCache(t, basedir, 100*1024*1024)
+
+	h, _ := randomPack(1024)
+	dir := filepath.Dir(c.filename(h))
+	test.OK(t, os.MkdirAll(dir, dirMode))
+	stale, fresh := filepath.Join(dir, "tmp-stale"), filepath.Join(dir, "tmp-fresh")
+	for _, name := range []string{stale, fresh} {
+		test.OK(t, os.WriteFile(name, []byte("foo"), fileMode))
+	}
+	ts := time.Now().Add(-2 * staleTempFileAge)
+	test.OK(t, os.Chtimes(stale, ts, ts))
+
+	// stale files are removed when the pack cache is opened
+	_ = testNewPackCache(t, basedir, 100*1024*1024)
+
+	_, err := os.Stat(stale)
+	test.Assert(t, os.IsNotExist(err), "stale temporary file was not removed")
+	_, err = os.Stat(fresh)
+	test.OK(t, err)
+}
+
+func TestPackCacheLock(t *testing.T) {
+	if runtime.GOOS == "aix" || runtime.GOOS == "solaris" {
+		t.Skip("file locking is not supported")
+	}
+
+	c := testNewPackCache(t, test.TempDir(t), 1024)
+	unlock, err := c.lock(false)
+	test.OK(t, err)
+
+	// other shared locks are possible
+	unlock2, err := c.lock(false)
+	test.OK(t, err)
+	unlock2()
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := c.lock(true)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("exclusive lock acquired while a shared lock is held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+}
+
+func TestPackCacheConcurrentLoad(t *testing.T) {
+	be := &countingBackend{Backend: mem.New()}
+	c := testNewPackCache(t, test.TempDir(t), 100*1024*1024)
+	wbe := c.Wrap(be)
+
+	h, data := randomPack(1024 * 1024)
+	save(t, be, h, data)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loadAndCompare(t, wbe, h, data)
+		}()
+	}
+	wg.Wait()
+
+	test.Assert(t, be.count() == 1, "pack file was downloaded %d times", be.count())
+	test.Equals(t, uint64(5), c.Stats().Hits+c.Stats().Misses)
+}
+
+func TestNewPackCacheInvalidSize(t *testing.T) {
+	_, err := NewPackCache(restic.NewRandomID().String(), test.TempDir(t), 0)
+	test.Assert(t, err != nil, "missing error for invalid size")
+}
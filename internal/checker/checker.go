@@ -12,6 +12,7 @@ import (
 
 	"github.com/minio/sha256-simd"
 	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/prefetch"
 	"github.com/restic/restic/internal/backend/s3"
 	"github.com/restic/restic/internal/cache"
 	"github.com/restic/restic/internal/debug"
@@ -42,6 +43,10 @@ type Checker struct {
 	snapshots   restic.Lister
 
 	repo restic.Repository
+
+	// Prefetch controls how many pack files are loaded ahead of their use
+	// by ReadPacks.
+	Prefetch prefetch.Options
 }
 
 // New returns a new checker which runs on repo.
@@ -379,6 +384,13 @@ func loadSnapshotTreeIDs(ctx context.Context, lister restic.Lister, repo restic.
 	return ids, errs
 }
 
+// Tombstones returns the tombstones of the repository. The snapshots marked as
+// removed by them are not checked, as prune may already have removed their
+// data.
+func (c *Checker) Tombstones(ctx context.Context) (restic.Tombstones, error) {
+	return restic.FindTombstones(ctx, c.snapshots, c.repo)
+}
+
 // Structure checks that for all snapshots all referenced data blobs and
 // subtrees are available in the index. errChan is closed after all trees have
 // been traversed.
@@ -428,6 +440,7 @@ func (c *Checker) Structure(ctx context.Context, p *progress.Counter, errChan ch
 func (c *Checker) checkTree(id restic.ID, tree *restic.Tree) (errs []error) {
 	debug.Log("checking tree %v", id)
 
+	sizes := c.repo.Config().ChunkerSizes
 	for _, node := range tree.Nodes {
 		switch node.Type {
 		case "file":
@@ -445,10 +458,17 @@ func (c *Checker) checkTree(id restic.ID, tree *restic.Tree) (errs []error) {
 				// unfortunately fails in some cases that are not resolvable
 				// by users, so we omit this check, see #1887
 
-				_, found := c.repo.LookupBlobSize(blobID, restic.DataBlob)
+				size, found := c.repo.LookupBlobSize(blobID, restic.DataBlob)
 				if !found {
 					debug.Log("tree %v references blob %v which isn't contained in index", id, blobID)
 					errs = append(errs, &Error{TreeID: id, Err: errors.Errorf("file %q blob %v not found in index", node.Name, blobID)})
+					continue
+				}
+
+				// only the last chunk of a file may be smaller than the minimum size
+				if size > sizes.Max() || (size < sizes.Min() && b != len(node.Content)-1) {
+					errs = append(errs, &Error{TreeID: id, Err: errors.Errorf("file %q blob %v has size %d, which is not within the chunk sizes %d to %d",
+						node.Name, blobID, size, sizes.Min(), sizes.Max())})
 				}
 			}
 
@@ -526,7 +546,7 @@ func (c *Checker) GetPacks() map[restic.ID]int64 {
 }
 
 // checkPack reads a pack and checks the integrity of all blobs.
-func checkPack(ctx context.Context, r restic.Repository, id restic.ID, blobs []restic.Blob, size int64, bufRd *bufio.Reader) error {
+func checkPack(ctx context.Context, r restic.Repository, load repository.BackendLoadFn, id restic.ID, blobs []restic.Blob, size int64, bufRd *bufio.Reader) error {
 	debug.Log("checking pack %v", id.String())
 
 	if len(blobs) == 0 {
@@ -558,7 +578,7 @@ func checkPack(ctx context.Context, r restic.Repository, id restic.ID, blobs []r
 	var hash restic.ID
 	var hdrBuf []byte
 	hashingLoader := func(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
-		return r.Backend().Load(ctx, h, int(size), 0, func(rd io.Reader) error {
+		return load(ctx, h, int(size), 0, func(rd io.Reader) error {
 			hrd := hashing.NewReader(rd, sha256.New())
 			bufRd.Reset(hrd)
 
@@ -594,10 +614,15 @@ func checkPack(ctx context.Context, r restic.Repository, id restic.ID, blobs []r
 		})
 	}
 
-	err := repository.StreamPack(ctx, hashingLoader, r.Key(), id, blobs, func(blob restic.BlobHandle, buf []byte, err error) error {
+	hasher := r.Config().BlobHasher()
+	err := repository.StreamPack(ctx, hashingLoader, r.Key(), hasher, id, blobs, func(blob restic.BlobHandle, buf []byte, err error) error {
 		debug.Log("  check blob %v: %v", blob.ID, blob)
 		if err != nil {
 			debug.Log("  error verifying blob %v: %v", blob.ID, err)
+			if other, ok := otherBlobHasher(hasher, blob.ID, buf); ok {
+				errs = append(errs, errors.Errorf("blob %v uses the blob hash algorithm %v instead of %v", blob.ID, other, hasher))
+				return nil
+			}
 			errs = append(errs, errors.Errorf("blob %v: %v", blob.ID, err))
 		}
 		return nil
@@ -645,6 +670,21 @@ func checkPack(ctx context.Context, r restic.Repository, id restic.ID, blobs []r
 	return nil
 }
 
+// otherBlobHasher returns the hash algorithm other than hasher which computes
+// the ID of the blob data, if there is one.
+func otherBlobHasher(hasher restic.BlobHasher, id restic.ID, buf []byte) (restic.BlobHasher, bool) {
+	if buf == nil {
+		return restic.BlobHasher{}, false
+	}
+	for _, name := range restic.BlobHashes {
+		other, _ := restic.NewBlobHasher(name)
+		if other != hasher && other.Hash(buf) == id {
+			return other, true
+		}
+	}
+	return restic.BlobHasher{}, false
+}
+
 // ReadData loads all data from the repository and checks the integrity.
 func (c *Checker) ReadData(ctx context.Context, errChan chan<- error) {
 	c.ReadPacks(ctx, c.packs, nil, errChan)
@@ -660,7 +700,16 @@ func (c *Checker) ReadPacks(ctx context.Context, packs map[restic.ID]int64, p *p
 		size  int64
 		blobs []restic.Blob
 	}
-	ch := make(chan checkTask)
+	// the buffered tasks are planned for prefetching
+	ch := make(chan checkTask, c.Prefetch.Depth)
+
+	load := c.repo.Backend().Load
+	var prefetcher *prefetch.Prefetcher
+	if c.Prefetch.Depth > 0 {
+		prefetcher = prefetch.New(ctx, load, c.Prefetch)
+		defer prefetcher.Close()
+		load = prefetcher.Load
+	}
 
 	// as packs are streamed the concurrency is limited by IO
 	workerCount := int(c.repo.Connections())
@@ -683,7 +732,7 @@ func (c *Checker) ReadPacks(ctx context.Context, packs map[restic.ID]int64, p *p
 					}
 				}
 
-				err := checkPack(ctx, c.repo, ps.id, ps.blobs, ps.size, bufRd)
+				err := checkPack(ctx, c.repo, load, ps.id, ps.blobs, ps.size, bufRd)
 				p.Add(1)
 				if err == nil {
 					continue
@@ -707,6 +756,13 @@ func (c *Checker) ReadPacks(ctx context.Context, packs map[restic.ID]int64, p *p
 	for pbs := range c.repo.Index().ListPacks(ctx, packSet) {
 		size := packs[pbs.PackID]
 		debug.Log("listed %v", pbs.PackID)
+		if prefetcher != nil && len(pbs.Blobs) > 0 {
+			// checkPack always loads the whole pack file
+			prefetcher.Plan(prefetch.Request{
+				Handle: backend.Handle{Type: restic.PackFile, Name: pbs.PackID.String()},
+				Length: int(size),
+			})
+		}
 		select {
 		case ch <- checkTask{id: pbs.PackID, size: size, blobs: pbs.Blobs}:
 		case <-ctx.Done():
@@ -2,18 +2,21 @@ package checker_test
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/restic/restic/internal/archiver"
 	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/prefetch"
 	"github.com/restic/restic/internal/checker"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/hashing"
@@ -377,6 +380,23 @@ func TestCheckerModifiedData(t *testing.T) {
 	}
 }
 
+func TestCheckerPrefetch(t *testing.T) {
+	repo := repository.TestRepository(t)
+	archiver.TestSnapshot(t, repo, ".", nil)
+
+	chkr := checker.New(repo, false)
+	chkr.Prefetch = prefetch.Options{Depth: 4, MaxBytes: 64 * 1024 * 1024}
+	hints, errs := chkr.LoadIndex(context.TODO(), nil)
+	if len(errs) > 0 {
+		t.Fatalf("expected no errors, got %v: %v", len(errs), errs)
+	}
+	if len(hints) > 0 {
+		t.Errorf("expected no hints, got %v: %v", len(hints), hints)
+	}
+
+	test.OKs(t, checkData(chkr))
+}
+
 // loadTreesOnceRepository allows each tree to be loaded only once
 type loadTreesOnceRepository struct {
 	restic.Repository
@@ -548,6 +568,77 @@ func TestCheckerBlobTypeConfusion(t *testing.T) {
 	}
 }
 
+func TestCheckerChunkSizes(t *testing.T) {
+	ctx := context.TODO()
+	repo := repository.TestRepository(t)
+
+	wg, wgCtx := errgroup.WithContext(ctx)
+	repo.StartPackUploader(wgCtx, wg)
+	var ids restic.IDs
+	for _, size := range []int{100, 200, 9 * 1024 * 1024} {
+		id, _, _, err := repo.SaveBlob(ctx, restic.DataBlob, test.Random(size, size), restic.ID{}, false)
+		test.OK(t, err)
+		ids = append(ids, id)
+	}
+
+	tree := &restic.Tree{Nodes: []*restic.Node{
+		// only the last chunk may be small
+		{Name: "small", Type: "file", Mode: 0644, Content: restic.IDs{ids[1]}},
+		{Name: "short", Type: "file", Mode: 0644, Content: restic.IDs{ids[0], ids[1]}},
+		{Name: "large", Type: "file", Mode: 0644, Content: restic.IDs{ids[2]}},
+	}}
+	rootID, err := restic.SaveTree(ctx, repo, tree)
+	test.OK(t, err)
+	test.OK(t, repo.Flush(ctx))
+
+	sn, err := restic.NewSnapshot([]string{"/"}, nil, "foo", time.Now())
+	test.OK(t, err)
+	sn.Tree = &rootID
+	_, err = restic.SaveSnapshot(ctx, repo, sn)
+	test.OK(t, err)
+
+	chkr := checker.New(repo, false)
+	_, errs := chkr.LoadIndex(ctx, nil)
+	test.Equals(t, 0, len(errs))
+
+	var files []string
+	for _, err := range checkStruct(chkr) {
+		t.Logf("struct error: %v", err)
+		for _, name := range []string{"small", "short", "large"} {
+			if strings.Contains(err.Error(), fmt.Sprintf("file %q", name)) {
+				files = append(files, name)
+			}
+		}
+	}
+	test.Equals(t, []string{"short", "large"}, files)
+}
+
+func TestCheckerBlobHash(t *testing.T) {
+	ctx := context.TODO()
+	hasher, err := restic.NewBlobHasher(restic.BlobHashBLAKE3)
+	test.OK(t, err)
+	repo := repository.TestRepositoryWithBlobHasher(t, hasher)
+
+	wg, wgCtx := errgroup.WithContext(ctx)
+	repo.StartPackUploader(wgCtx, wg)
+	_, _, _, err = repo.SaveBlob(ctx, restic.DataBlob, test.Random(1, 1000), restic.ID{}, false)
+	test.OK(t, err)
+	// a blob which was hashed using the wrong algorithm
+	data := test.Random(2, 1000)
+	_, _, _, err = repo.SaveBlob(ctx, restic.DataBlob, data, restic.Hash(data), false)
+	test.OK(t, err)
+	test.OK(t, repo.Flush(ctx))
+
+	chkr := checker.New(repo, false)
+	_, errs := chkr.LoadIndex(ctx, nil)
+	test.Equals(t, 0, len(errs))
+
+	errs = checkData(chkr)
+	test.Equals(t, 1, len(errs))
+	want := fmt.Sprintf("blob %v uses the blob hash algorithm sha256 instead of blake3", restic.Hash(data))
+	test.Assert(t, strings.Contains(errs[0].Error(), want), "unexpected error %v", errs[0])
+}
+
 func loadBenchRepository(t *testing.B) (*checker.Checker, restic.Repository, func()) {
 	repodir, cleanup := test.Env(t, checkerTestData)
 
@@ -624,3 +715,32 @@ func BenchmarkCheckerSnapshotScaling(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkCheckerReadData(b *testing.B) {
+	repository.BenchmarkAllBlobHashers(b, benchmarkCheckerReadData)
+}
+
+func benchmarkCheckerReadData(b *testing.B, hasher restic.BlobHasher) {
+	ctx := context.TODO()
+	repo := repository.TestRepositoryWithBlobHasher(b, hasher)
+
+	wg, wgCtx := errgroup.WithContext(ctx)
+	repo.StartPackUploader(wgCtx, wg)
+	const blobs, size = 64, 1 << 20
+	for i := 0; i < blobs; i++ {
+		_, _, _, err := repo.SaveBlob(ctx, restic.DataBlob, test.Random(i, size), restic.ID{}, false)
+		test.OK(b, err)
+	}
+	test.OK(b, repo.Flush(ctx))
+
+	chkr := checker.New(repo, false)
+	_, errs := chkr.LoadIndex(ctx, nil)
+	test.OKs(b, errs)
+
+	b.SetBytes(blobs * size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		test.OKs(b, checkData(chkr))
+	}
+}
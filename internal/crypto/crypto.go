@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 
@@ -36,6 +37,11 @@ var (
 type Key struct {
 	MACKey        `json:"mac"`
 	EncryptionKey `json:"encrypt"`
+
+	// tag is set for session keys, see NewSessionKey.
+	tag []byte
+	// sessions contains the session keys by their tag, see AddSessionKey.
+	sessions map[uint32][]*Key
 }
 
 // EncryptionKey is key used for encryption
@@ -346,6 +352,12 @@ func (k *Key) Open(dst, nonce, ciphertext, _ []byte) ([]byte, error) {
 
 	// verify mac
 	if !poly1305Verify(ct, nonce, &k.MACKey, mac) {
+		// the ciphertext is not modified if the mac does not match
+		for _, s := range k.sessions[binary.BigEndian.Uint32(nonce)] {
+			if ret, err := s.Open(dst, nonce, ciphertext, nil); err == nil {
+				return ret, nil
+			}
+		}
 		return nil, ErrUnauthenticated
 	}
 
@@ -0,0 +1,148 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/restic/restic/internal/errors"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A session key is used by a client which may only add data to a repository.
+// The key is generated for a single session and is only stored encrypted for
+// an X25519 public key, whose private key is not known to the client.
+//
+// The nonces of all ciphertexts created with a session key start with the
+// random tag of the key. This allows readers to select the session key for a
+// ciphertext without trying all of them.
+
+// SessionTagSize is the size of the tag of a session key.
+const SessionTagSize = 4
+
+// X25519KeySize is the size of X25519 public and private keys.
+const X25519KeySize = curve25519.ScalarSize
+
+// NewSessionKey returns a new random session key.
+func NewSessionKey() *Key {
+	k := NewRandomKey()
+	k.tag = NewRandomNonce()[:SessionTagSize]
+	return k
+}
+
+// SessionTag returns the tag of a session key, or nil for other keys.
+func (k *Key) SessionTag() []byte {
+	return k.tag
+}
+
+// NewNonce returns a new random nonce for k. For session keys, the nonce
+// starts with the tag of the key.
+func (k *Key) NewNonce() []byte {
+	nonce := NewRandomNonce()
+	copy(nonce, k.tag)
+	return nonce
+}
+
+// AddSessionKey adds a session key with the given tag, which is then used by
+// Open for ciphertexts whose nonce starts with the tag. It must not be called
+// concurrently with Open.
+func (k *Key) AddSessionKey(tag []byte, session *Key) error {
+	if len(tag) != SessionTagSize {
+		return errors.New("invalid session tag")
+	}
+	if !session.Valid() {
+		return errors.New("invalid session key")
+	}
+
+	if k.sessions == nil {
+		k.sessions = make(map[uint32][]*Key)
+	}
+	t := binary.BigEndian.Uint32(tag)
+	k.sessions[t] = append(k.sessions[t], session)
+	return nil
+}
+
+// NewX25519Key returns a new X25519 key pair.
+func NewX25519Key() (private, public []byte, err error) {
+	private = make([]byte, X25519KeySize)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, nil, errors.Wrap(err, "ReadFull")
+	}
+	public, err = curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "X25519")
+	}
+	return private, public, nil
+}
+
+// sharedKey derives a key from the X25519 shared secret of an ephemeral and
+// a static key pair.
+func sharedKey(scalar, point, ephemeral, public []byte) (*Key, error) {
+	secret, err := curve25519.X25519(scalar, point)
+	if err != nil {
+		return nil, errors.Wrap(err, "X25519")
+	}
+
+	salt := append(append([]byte{}, ephemeral...), public...)
+	buf := make([]byte, aesKeySize+macKeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("restic session key")), buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "hkdf")
+	}
+
+	k := &Key{}
+	copy(k.EncryptionKey[:], buf[:aesKeySize])
+	macKeyFromSlice(&k.MACKey, buf[aesKeySize:])
+	return k, nil
+}
+
+// SealForPublicKey encrypts plaintext such that it can only be decrypted
+// using the private key for the X25519 public key. The result contains an
+// ephemeral public key followed by the ciphertext.
+func SealForPublicKey(public, plaintext []byte) ([]byte, error) {
+	if len(public) != X25519KeySize {
+		return nil, errors.New("invalid public key")
+	}
+
+	ephemeralPrivate, ephemeral, err := NewX25519Key()
+	if err != nil {
+		return nil, err
+	}
+	k, err := sharedKey(ephemeralPrivate, public, ephemeral, public)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := NewRandomNonce()
+	out := make([]byte, 0, X25519KeySize+CiphertextLength(len(plaintext)))
+	out = append(out, ephemeral...)
+	out = append(out, nonce...)
+	return k.Seal(out, nonce, plaintext, nil), nil
+}
+
+// OpenWithPrivateKey decrypts data created by SealForPublicKey using the
+// X25519 private key.
+func OpenWithPrivateKey(private, data []byte) ([]byte, error) {
+	if len(private) != X25519KeySize {
+		return nil, errors.New("invalid private key")
+	}
+	if len(data) < X25519KeySize+Extension {
+		return nil, errors.New("ciphertext too small")
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "X25519")
+	}
+	ephemeral := data[:X25519KeySize]
+	k, err := sharedKey(private, ephemeral, ephemeral, public)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, ciphertext := data[X25519KeySize:X25519KeySize+ivSize], data[X25519KeySize+ivSize:]
+	return k.Open(nil, nonce, ciphertext, nil)
+}
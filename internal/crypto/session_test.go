@@ -0,0 +1,58 @@
+package crypto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/restic/restic/internal/crypto"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestSealForPublicKey(t *testing.T) {
+	private, public, err := crypto.NewX25519Key()
+	rtest.OK(t, err)
+
+	data := rtest.Random(23, 1000)
+	ciphertext, err := crypto.SealForPublicKey(public, data)
+	rtest.OK(t, err)
+
+	plaintext, err := crypto.OpenWithPrivateKey(private, ciphertext)
+	rtest.OK(t, err)
+	rtest.Equals(t, data, plaintext)
+
+	other, _, err := crypto.NewX25519Key()
+	rtest.OK(t, err)
+	_, err = crypto.OpenWithPrivateKey(other, ciphertext)
+	rtest.Assert(t, err == crypto.ErrUnauthenticated, "wrong private key accepted, err %v", err)
+
+	ciphertext[len(ciphertext)-1]++
+	_, err = crypto.OpenWithPrivateKey(private, ciphertext)
+	rtest.Assert(t, err == crypto.ErrUnauthenticated, "modified ciphertext accepted, err %v", err)
+}
+
+func TestSessionKey(t *testing.T) {
+	master := crypto.NewRandomKey()
+	session := crypto.NewSessionKey()
+	rtest.Equals(t, crypto.SessionTagSize, len(session.SessionTag()))
+
+	data := rtest.Random(42, 5000)
+	nonce := session.NewNonce()
+	rtest.Assert(t, bytes.HasPrefix(nonce, session.SessionTag()), "nonce %x does not start with the tag", nonce)
+	ciphertext := session.Seal(nil, nonce, data, nil)
+
+	_, err := master.Open(nil, nonce, ciphertext, nil)
+	rtest.Assert(t, err == crypto.ErrUnauthenticated, "unknown session key used, err %v", err)
+
+	rtest.OK(t, master.AddSessionKey(session.SessionTag(), session))
+	plaintext, err := master.Open(nil, nonce, ciphertext, nil)
+	rtest.OK(t, err)
+	rtest.Equals(t, data, plaintext)
+
+	// the master key itself still works
+	nonce = master.NewNonce()
+	plaintext, err = master.Open(nil, nonce, master.Seal(nil, nonce, data, nil), nil)
+	rtest.OK(t, err)
+	rtest.Equals(t, data, plaintext)
+
+	rtest.Assert(t, master.AddSessionKey([]byte{1}, session) != nil, "invalid tag accepted")
+}
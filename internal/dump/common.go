@@ -9,6 +9,7 @@ import (
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/restic"
 	"github.com/restic/restic/internal/walker"
+	"golang.org/x/sync/errgroup"
 )
 
 // A Dumper writes trees and files from a repository to a Writer
@@ -18,78 +19,122 @@ type Dumper struct {
 	format string
 	repo   restic.Repository
 	w      io.Writer
+
+	// hardlinks maps the files with several hardlinks to the path of their
+	// first occurrence in the archive.
+	hardlinks map[hardlinkKey]string
+
+	// Error is called for errors which affect a single file or directory.
+	// If it returns nil, the file is replaced by zeros or the contents of
+	// the directory are skipped and the archive is continued. It may be
+	// called concurrently.
+	Error func(item string, err error) error
+	// SelectFilter decides which items are included in the archive. The
+	// children of a directory are only visited if childMayBeSelected is true.
+	SelectFilter func(item string, node *restic.Node) (selected bool, childMayBeSelected bool)
+}
+
+type hardlinkKey struct {
+	inode, device uint64
 }
 
 func New(format string, repo restic.Repository, w io.Writer) *Dumper {
 	return &Dumper{
-		cache:  bloblru.New(64 << 20),
-		format: format,
-		repo:   repo,
-		w:      w,
+		cache:        bloblru.New(64 << 20),
+		format:       format,
+		repo:         repo,
+		w:            w,
+		Error:        func(_ string, err error) error { return err },
+		SelectFilter: func(string, *restic.Node) (bool, bool) { return true, true },
 	}
 }
 
 func (d *Dumper) DumpTree(ctx context.Context, tree *restic.Tree, rootPath string) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	wg, ctx := errgroup.WithContext(ctx)
 
 	// ch is buffered to deal with variable download/write speeds.
 	ch := make(chan *restic.Node, 10)
-	go sendTrees(ctx, d.repo, tree, rootPath, ch)
-
-	switch d.format {
-	case "tar":
-		return d.dumpTar(ctx, ch)
-	case "zip":
-		return d.dumpZip(ctx, ch)
-	default:
-		panic("unknown dump format")
-	}
+	wg.Go(func() error {
+		return d.sendTrees(ctx, tree, rootPath, ch)
+	})
+	wg.Go(func() error {
+		switch d.format {
+		case "tar":
+			return d.dumpTar(ctx, ch)
+		case "zip":
+			return d.dumpZip(ctx, ch)
+		default:
+			panic("unknown dump format")
+		}
+	})
+	return wg.Wait()
 }
 
-func sendTrees(ctx context.Context, repo restic.Repository, tree *restic.Tree, rootPath string, ch chan *restic.Node) {
+func (d *Dumper) sendTrees(ctx context.Context, tree *restic.Tree, rootPath string, ch chan *restic.Node) error {
 	defer close(ch)
 
 	for _, root := range tree.Nodes {
 		root.Path = path.Join(rootPath, root.Name)
-		if sendNodes(ctx, repo, root, ch) != nil {
-			break
+		if err := d.sendNodes(ctx, root, ch); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func sendNodes(ctx context.Context, repo restic.Repository, root *restic.Node, ch chan *restic.Node) error {
-	select {
-	case ch <- root:
-	case <-ctx.Done():
-		return ctx.Err()
+func (d *Dumper) sendNodes(ctx context.Context, root *restic.Node, ch chan *restic.Node) error {
+	selected, childMayBeSelected := d.SelectFilter(root.Path, root)
+	if selected || (IsDir(root) && childMayBeSelected) {
+		select {
+		case ch <- root:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	// If this is no directory we are finished
-	if !IsDir(root) {
+	if !IsDir(root) || !childMayBeSelected {
 		return nil
 	}
 
-	err := walker.Walk(ctx, repo, *root.Subtree, nil, func(_ restic.ID, nodepath string, node *restic.Node, err error) (bool, error) {
+	err := walker.Walk(ctx, d.repo, *root.Subtree, nil, func(_ restic.ID, nodepath string, node *restic.Node, err error) (bool, error) {
+		item := root.Path
+		if node != nil {
+			item = path.Join(root.Path, nodepath)
+		}
 		if err != nil {
-			return false, err
+			// skip the contents of directories which cannot be loaded
+			if err := d.Error(item, err); err != nil {
+				return false, err
+			}
+			return false, walker.ErrSkipNode
 		}
 		if node == nil {
 			return false, nil
 		}
 
-		node.Path = path.Join(root.Path, nodepath)
+		node.Path = item
 
 		if !IsFile(node) && !IsDir(node) && !IsLink(node) {
 			return false, nil
 		}
 
-		select {
-		case ch <- node:
-		case <-ctx.Done():
-			return false, ctx.Err()
+		selected, childMayBeSelected := d.SelectFilter(node.Path, node)
+		if IsDir(node) {
+			// parent directories of selected items are included as well
+			selected = selected || childMayBeSelected
+		}
+		if selected {
+			select {
+			case ch <- node:
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
 		}
 
+		if IsDir(node) && !childMayBeSelected {
+			return false, walker.ErrSkipNode
+		}
 		return false, nil
 	})
 
@@ -104,15 +149,24 @@ func (d *Dumper) WriteNode(ctx context.Context, node *restic.Node) error {
 
 func (d *Dumper) writeNode(ctx context.Context, w io.Writer, node *restic.Node) error {
 	var (
-		buf []byte
-		err error
+		buf     []byte
+		err     error
+		written uint64
 	)
 	for _, id := range node.Content {
 		blob, ok := d.cache.Get(id)
 		if !ok {
 			blob, err = d.repo.LoadBlob(ctx, restic.DataBlob, id, buf)
 			if err != nil {
-				return err
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if err := d.Error(node.Path, err); err != nil {
+					return err
+				}
+				// archive entries have a fixed size, thus fill the
+				// remaining file with zeros
+				return writeZeros(w, node.Size-written)
 			}
 
 			buf = d.cache.Add(id, blob) // Reuse evicted buffer.
@@ -121,11 +175,27 @@ func (d *Dumper) writeNode(ctx context.Context, w io.Writer, node *restic.Node)
 		if _, err := w.Write(blob); err != nil {
 			return errors.Wrap(err, "Write")
 		}
+		written += uint64(len(blob))
 	}
 
 	return nil
 }
 
+func writeZeros(w io.Writer, n uint64) error {
+	var zeros [32 * 1024]byte
+	for n > 0 {
+		chunk := uint64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		if _, err := w.Write(zeros[:chunk]); err != nil {
+			return errors.Wrap(err, "Write")
+		}
+		n -= chunk
+	}
+	return nil
+}
+
 // IsDir checks if the given node is a directory.
 func IsDir(node *restic.Node) bool {
 	return node.Type == "dir"
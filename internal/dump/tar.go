@@ -81,6 +81,23 @@ func (d *Dumper) dumpNodeTar(ctx context.Context, node *restic.Node, w *tar.Writ
 
 	if IsFile(node) {
 		header.Typeflag = tar.TypeReg
+
+		if node.Links > 1 {
+			if d.hardlinks == nil {
+				d.hardlinks = make(map[hardlinkKey]string)
+			}
+			key := hardlinkKey{node.Inode, node.DeviceID}
+			if target, ok := d.hardlinks[key]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = target
+				header.Size = 0
+				if err := w.WriteHeader(header); err != nil {
+					return fmt.Errorf("writing header for %q: %w", node.Path, err)
+				}
+				return nil
+			}
+			d.hardlinks[key] = header.Name
+		}
 	}
 
 	if IsLink(node) {
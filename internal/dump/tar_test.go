@@ -14,8 +14,10 @@ import (
 	"time"
 
 	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 	rtest "github.com/restic/restic/internal/test"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestWriteTar(t *testing.T) {
@@ -142,3 +144,94 @@ func TestFieldTooLong(t *testing.T) {
 	rtest.Assert(t, strings.Contains(err.Error(), node.Path),
 		"no filename in %q", err)
 }
+
+// failingRepo fails to load the data blob with the given ID.
+type failingRepo struct {
+	restic.Repository
+	fail restic.ID
+}
+
+func (r failingRepo) LoadBlob(ctx context.Context, t restic.BlobType, id restic.ID, buf []byte) ([]byte, error) {
+	if t == restic.DataBlob && id == r.fail {
+		return nil, errors.New("blob is damaged")
+	}
+	return r.Repository.LoadBlob(ctx, t, id, buf)
+}
+
+func TestDumpTarHardlinksFilterErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repo := repository.TestRepository(t)
+
+	var wg errgroup.Group
+	repo.StartPackUploader(ctx, &wg)
+
+	saveBlob := func(data string) restic.IDs {
+		id, _, _, err := repo.SaveBlob(ctx, restic.DataBlob, []byte(data), restic.ID{}, false)
+		rtest.OK(t, err)
+		return restic.IDs{id}
+	}
+	saveTree := func(nodes ...*restic.Node) *restic.ID {
+		tree := restic.NewTree(len(nodes))
+		for _, node := range nodes {
+			rtest.OK(t, tree.Insert(node))
+		}
+		id, err := restic.SaveTree(ctx, repo, tree)
+		rtest.OK(t, err)
+		return &id
+	}
+
+	damaged := saveBlob("bar")
+	subtree := saveTree(
+		&restic.Node{Name: "b", Type: "file", Mode: 0644, Size: 3, Content: saveBlob("foo"), Links: 2, Inode: 1},
+		&restic.Node{Name: "c", Type: "file", Mode: 0644, Size: 3, Content: damaged, Links: 1, Inode: 2},
+	)
+	root := saveTree(
+		&restic.Node{Name: "a", Type: "file", Mode: 0644, Size: 3, Content: saveBlob("foo"), Links: 2, Inode: 1},
+		&restic.Node{Name: "dir", Type: "dir", Mode: 0755 | os.ModeDir, Subtree: subtree},
+		&restic.Node{Name: "skip", Type: "file", Mode: 0644, Size: 3, Content: saveBlob("baz"), Links: 1, Inode: 3},
+	)
+	rtest.OK(t, repo.Flush(ctx))
+
+	tree, err := restic.LoadTree(ctx, repo, *root)
+	rtest.OK(t, err)
+
+	dst := &bytes.Buffer{}
+	d := New("tar", failingRepo{Repository: repo, fail: damaged[0]}, dst)
+	var errs []string
+	d.Error = func(item string, err error) error {
+		errs = append(errs, item)
+		return nil
+	}
+	d.SelectFilter = func(item string, node *restic.Node) (bool, bool) {
+		return item != "/skip", true
+	}
+	rtest.OK(t, d.DumpTree(ctx, tree, "/"))
+	rtest.Equals(t, []string{"/dir/c"}, errs)
+
+	type entry struct {
+		typeflag byte
+		linkname string
+		content  string
+	}
+	entries := make(map[string]entry)
+	var names []string
+	tr := tar.NewReader(dst)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		rtest.OK(t, err)
+		content, err := io.ReadAll(tr)
+		rtest.OK(t, err)
+		names = append(names, hdr.Name)
+		entries[hdr.Name] = entry{hdr.Typeflag, hdr.Linkname, string(content)}
+	}
+
+	rtest.Equals(t, []string{"a", "dir/", "dir/b", "dir/c"}, names)
+	rtest.Equals(t, entry{tar.TypeReg, "", "foo"}, entries["a"])
+	rtest.Equals(t, entry{tar.TypeLink, "a", ""}, entries["dir/b"])
+	// the damaged file is replaced by zeros
+	rtest.Equals(t, entry{tar.TypeReg, "", "\x00\x00\x00"}, entries["dir/c"])
+}
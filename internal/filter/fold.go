@@ -0,0 +1,53 @@
+package filter
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// FoldName returns a canonical form of s for case-insensitive matching. The
+// string is converted to Unicode normalization form C, so that decomposed
+// names as stored by macOS match their precomposed spelling, and each rune is
+// replaced by a fixed representative of its simple case folding orbit. Two
+// names are equal ignoring case if their folded forms are equal.
+//
+// Pattern metacharacters are not affected, so FoldName can be applied to
+// patterns and names alike. Character ranges are folded bound by bound,
+// which is consistent for ranges within a single case such as [a-z].
+func FoldName(s string) string {
+	if isASCII(s) {
+		return strings.ToUpper(s)
+	}
+
+	s = norm.NFC.String(s)
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range s {
+		sb.WriteRune(foldRune(r))
+	}
+	return sb.String()
+}
+
+// foldRune returns the smallest rune which is equivalent to r under simple
+// case folding.
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/restic/restic/internal/filter"
+)
+
+func TestFoldName(t *testing.T) {
+	var tests = []struct {
+		a, b  string
+		equal bool
+	}{
+		{"Thumbs.db", "thumbs.DB", true},
+		{"Thumbs.db", "Thumbs.db ", false},
+		{"STRASSE", "strasse", true},
+		{"ΣΟΦΟΣ", "σοφος", true},
+		{"σοφος", "σοφος", true},
+		{"Kelvin", "kelvin", true},
+		{"ſite", "SITE", true},
+		{"Ärger", "ärger", true},
+		{"Ärger", "arger", false},
+		// decomposed names as stored by macOS match the precomposed spelling
+		{"Ame\u0301lie", "Am\u00e9lie", true},
+		{"AME\u0301LIE", "am\u00e9lie", true},
+		{"Ame\u0301lie", "Amelie", false},
+	}
+
+	for _, test := range tests {
+		folded := filter.FoldName(test.a) == filter.FoldName(test.b)
+		if folded != test.equal {
+			t.Errorf("FoldName(%q) == FoldName(%q) is %v, want %v",
+				test.a, test.b, folded, test.equal)
+		}
+	}
+}
+
+func TestFoldNameMatch(t *testing.T) {
+	var tests = []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"*.DB", "/home/user/Thumbs.db", true},
+		{"/home/*/thumbs.db", "/HOME/User/Thumbs.db", true},
+		{"[a-z]*.txt", "/data/Notes.TXT", true},
+		{"[A-Z]*.txt", "/data/notes.txt", true},
+		{"[^a-z]*.txt", "/data/Notes.txt", false},
+		{"[^a-z]*.txt", "/data/1notes.txt", true},
+		{"file[ab].go", "/src/FILEB.GO", true},
+		{"file[ab].go", "/src/filec.go", false},
+		{"[\u00e9a]cole", "/\u00c9cole", true},
+		{"caf[\u00e9x]", "/cafe\u0301", true},
+		{"**/Ame\u0301lie/*", "/photos/am\u00e9lie/img.jpg", true},
+		{"Σ*", "/σοφος", true},
+	}
+
+	for _, test := range tests {
+		match, err := filter.Match(filter.FoldName(test.pattern), filter.FoldName(test.path))
+		if err != nil {
+			t.Errorf("pattern %q, path %q: unexpected error %v", test.pattern, test.path, err)
+			continue
+		}
+		if match != test.match {
+			t.Errorf("pattern %q, path %q: want match %v, got %v",
+				test.pattern, test.path, test.match, match)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package fs
+
+import "strings"
+
+// Capabilities describes which features a file system supports. File systems
+// report them via a Capabilities method, see CapabilitiesOf.
+type Capabilities uint
+
+const (
+	// CapXattrs is set if the file system reports extended attributes.
+	CapXattrs Capabilities = 1 << iota
+	// CapACLs is set if access control lists are reported as extended
+	// attributes, see ACLAttributes.
+	CapACLs
+	// CapSparseDetection is set if the holes of sparse files can be
+	// detected, so that they are not read.
+	CapSparseDetection
+	// CapDeviceIDs is set if the file system reports the ID of the device
+	// containing a file.
+	CapDeviceIDs
+	// CapInodes is set if the file system reports inode numbers and the
+	// number of hard links.
+	CapInodes
+	// CapSecondsOnlyMtime is set if modification times are only reported
+	// with a resolution of one second.
+	CapSecondsOnlyMtime
+	// CapCaseInsensitiveNames is set if file names are compared without
+	// regard to case.
+	CapCaseInsensitiveNames
+)
+
+var capabilityNames = []string{
+	"xattrs",
+	"acls",
+	"sparse-detection",
+	"device-ids",
+	"inodes",
+	"seconds-only-mtime",
+	"case-insensitive-names",
+}
+
+// DefaultCapabilities are assumed for file systems without a Capabilities
+// method, e.g. wrappers around another file system. The metadata is then
+// detected for each file, so nothing is dropped based on the assumption.
+const DefaultCapabilities = CapXattrs | CapACLs | CapSparseDetection | CapDeviceIDs | CapInodes
+
+// Has returns true if all capabilities in flags are set.
+func (c Capabilities) Has(flags Capabilities) bool {
+	return c&flags == flags
+}
+
+func (c Capabilities) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if c.Has(1 << i) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// CapabilitiesOf returns the capabilities of filesys, or DefaultCapabilities
+// if filesys does not report them.
+func CapabilitiesOf(filesys FS) Capabilities {
+	if c, ok := filesys.(interface{ Capabilities() Capabilities }); ok {
+		return c.Capabilities()
+	}
+	return DefaultCapabilities
+}
+
+// ACLAttributes are the names of the extended attributes used to store access
+// control lists.
+var ACLAttributes = []string{
+	"system.posix_acl_access",
+	"system.posix_acl_default",
+	"system.nfs4_acl",
+	"system.richacl",
+}
+
+// IsACLAttribute returns true if the extended attribute name holds an access
+// control list.
+func IsACLAttribute(name string) bool {
+	for _, acl := range ACLAttributes {
+		if name == acl {
+			return true
+		}
+	}
+	return false
+}
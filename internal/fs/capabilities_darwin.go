@@ -0,0 +1,7 @@
+package fs
+
+// localCapabilities are the capabilities of the local file system. The
+// default file systems on macOS are case-insensitive.
+func localCapabilities() Capabilities {
+	return CapXattrs | CapDeviceIDs | CapInodes | CapCaseInsensitiveNames
+}
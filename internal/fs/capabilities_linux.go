@@ -0,0 +1,6 @@
+package fs
+
+// localCapabilities are the capabilities of the local file system.
+func localCapabilities() Capabilities {
+	return CapXattrs | CapACLs | CapSparseDetection | CapDeviceIDs | CapInodes
+}
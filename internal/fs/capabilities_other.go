@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package fs
+
+import "runtime"
+
+// localCapabilities are the capabilities of the local file system.
+func localCapabilities() Capabilities {
+	caps := CapDeviceIDs | CapInodes
+	// see internal/restic/node_xattr.go
+	if runtime.GOOS == "freebsd" || runtime.GOOS == "solaris" {
+		caps |= CapXattrs
+	}
+	return caps
+}
@@ -0,0 +1,36 @@
+package fs
+
+import (
+	"testing"
+
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestCapabilitiesString(t *testing.T) {
+	rtest.Equals(t, "", Capabilities(0).String())
+	rtest.Equals(t, "xattrs,inodes", (CapXattrs | CapInodes).String())
+	rtest.Equals(t, "seconds-only-mtime,case-insensitive-names", (CapSecondsOnlyMtime | CapCaseInsensitiveNames).String())
+
+	rtest.Assert(t, (CapXattrs | CapACLs).Has(CapXattrs), "missing capability")
+	rtest.Assert(t, !CapXattrs.Has(CapXattrs|CapACLs), "unexpected capability")
+}
+
+// wrapperFS embeds an FS without forwarding its capabilities.
+type wrapperFS struct {
+	FS
+}
+
+func TestCapabilitiesOf(t *testing.T) {
+	local := CapabilitiesOf(Local{})
+	rtest.Equals(t, localCapabilities(), local)
+	rtest.Equals(t, local, CapabilitiesOf(Track{FS: Local{}}))
+	rtest.Equals(t, local, CapabilitiesOf(&FollowSymlinks{FS: Local{}}))
+
+	rtest.Equals(t, DefaultCapabilities, CapabilitiesOf(wrapperFS{FS: Local{}}))
+	rtest.Equals(t, DefaultCapabilities, CapabilitiesOf(Track{FS: wrapperFS{FS: Local{}}}))
+}
+
+func TestIsACLAttribute(t *testing.T) {
+	rtest.Assert(t, IsACLAttribute("system.posix_acl_access"), "ACL not detected")
+	rtest.Assert(t, !IsACLAttribute("user.comment"), "unexpected ACL")
+}
@@ -0,0 +1,7 @@
+package fs
+
+// localCapabilities are the capabilities of the local file system. Extended
+// attributes, device IDs and inode numbers are not supported on Windows.
+func localCapabilities() Capabilities {
+	return CapCaseInsensitiveNames
+}
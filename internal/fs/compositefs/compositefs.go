@@ -0,0 +1,415 @@
+package compositefs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+)
+
+// Mount describes a file system which is presented below a path of the
+// composite file system.
+type Mount struct {
+	// Path is the absolute, slash-separated path in the composite file
+	// system, e.g. /nas.
+	Path string
+	// FS is the mounted file system.
+	FS fs.FS
+	// Root is the directory (or file) within FS which is presented at Path.
+	Root string
+	// Name identifies the mount in error messages, Path is used if empty.
+	Name string
+}
+
+// FS is a read-only file system which combines several file systems below a
+// virtual root. The root and the parent directories of the mounts are virtual
+// directories which only contain the mounts and other virtual directories,
+// all other operations are passed to the mounted file system.
+type FS struct {
+	fs.SlashPaths
+
+	mounts []Mount
+	dirs   map[string][]string
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// dirModTime is the modification time of the virtual directories.
+var dirModTime = time.Unix(0, 0).UTC()
+
+// Error is returned if the file system of a mount returned an error.
+type Error struct {
+	Mount string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Mount + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New returns a file system which presents the mounts. It is an error if a
+// path is used more than once or if a mount is located within another.
+func New(mounts ...Mount) (*FS, error) {
+	cfs := &FS{dirs: map[string][]string{"/": nil}}
+
+	for _, m := range mounts {
+		p := path.Clean(m.Path)
+		if !path.IsAbs(p) || p == "/" {
+			return nil, errors.Errorf("invalid mount path %q, must be an absolute path below /", m.Path)
+		}
+		if _, ok := cfs.dirs[p]; ok {
+			return nil, errors.Errorf("mount %v contains another mount", p)
+		}
+		for _, other := range cfs.mounts {
+			switch {
+			case p == other.Path:
+				return nil, errors.Errorf("mount %v is used more than once", p)
+			case strings.HasPrefix(p, other.Path+"/"):
+				return nil, errors.Errorf("mount %v is located within mount %v", p, other.Path)
+			}
+		}
+
+		root, err := m.FS.Abs(m.Root)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Path, m.Root = p, root
+		if m.Name == "" {
+			m.Name = p
+		}
+		cfs.mounts = append(cfs.mounts, m)
+
+		// create the virtual parent directories
+		for dir := p; dir != "/"; dir = path.Dir(dir) {
+			parent := path.Dir(dir)
+			names, ok := cfs.dirs[parent]
+			if ok && contains(names, path.Base(dir)) {
+				break
+			}
+			cfs.dirs[parent] = append(names, path.Base(dir))
+		}
+	}
+
+	for _, names := range cfs.dirs {
+		sort.Strings(names)
+	}
+	return cfs, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the mounted file systems which implement io.Closer and
+// returns the first error.
+func (cfs *FS) Close() error {
+	var firstErr error
+	for _, m := range cfs.mounts {
+		if c, ok := m.FS.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// resolve returns the mount for name and the path within the mounted file
+// system. If name is not located within a mount, nil is returned.
+func (cfs *FS) resolve(name string) (*Mount, string) {
+	for i := range cfs.mounts {
+		m := &cfs.mounts[i]
+		if name == m.Path {
+			return m, m.Root
+		}
+		if rel := strings.TrimPrefix(name, m.Path+"/"); rel != name {
+			return m, m.FS.Join(append([]string{m.Root}, strings.Split(rel, "/")...)...)
+		}
+	}
+	return nil, ""
+}
+
+func (m *Mount) wrapError(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &Error{Mount: m.Name, Err: err}
+}
+
+// Capabilities returns the features supported by all mounted file systems.
+// With several mounts, inode numbers and device IDs are not unique, e.g. for
+// two archives, so they are not reported as supported.
+func (cfs *FS) Capabilities() fs.Capabilities {
+	if len(cfs.mounts) == 0 {
+		return fs.DefaultCapabilities
+	}
+
+	caps := ^fs.Capabilities(0)
+	var restrictions fs.Capabilities
+	for _, m := range cfs.mounts {
+		c := fs.CapabilitiesOf(m.FS)
+		caps &= c
+		restrictions |= c & (fs.CapSecondsOnlyMtime | fs.CapCaseInsensitiveNames)
+	}
+	if len(cfs.mounts) > 1 {
+		caps &^= fs.CapInodes | fs.CapDeviceIDs
+	}
+	return (caps &^ (fs.CapSecondsOnlyMtime | fs.CapCaseInsensitiveNames)) | restrictions
+}
+
+// Open opens a file or directory for reading.
+func (cfs *FS) Open(name string) (fs.File, error) {
+	return cfs.OpenFile(name, fs.O_RDONLY, 0)
+}
+
+// OpenFile opens a file or directory for reading. The flags are passed to the
+// mounted file system, virtual directories can only be opened read-only.
+func (cfs *FS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	name = path.Clean("/" + name)
+	m, p := cfs.resolve(name)
+	if m == nil {
+		names, ok := cfs.dirs[name]
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if flag & ^(fs.O_RDONLY|fs.O_NOFOLLOW) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		return &dir{fs: cfs, name: name, names: names}, nil
+	}
+
+	f, err := m.FS.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, m.wrapError(err)
+	}
+
+	cf := &file{File: f, m: m, name: name, path: p}
+	if _, ok := f.(io.ReaderAt); ok {
+		return &readerAtFile{cf}, nil
+	}
+	return cf, nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (cfs *FS) Stat(name string) (os.FileInfo, error) {
+	return cfs.stat(name, false)
+}
+
+// Lstat returns the FileInfo structure describing the named file. If the file
+// is a symbolic link, the returned FileInfo describes the symbolic link.
+func (cfs *FS) Lstat(name string) (os.FileInfo, error) {
+	return cfs.stat(name, true)
+}
+
+func (cfs *FS) stat(name string, lstat bool) (os.FileInfo, error) {
+	op := "stat"
+	if lstat {
+		op = "lstat"
+	}
+
+	name = path.Clean("/" + name)
+	m, p := cfs.resolve(name)
+	if m == nil {
+		if _, ok := cfs.dirs[name]; !ok {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		return dirInfo(path.Base(name)), nil
+	}
+
+	var fi os.FileInfo
+	var err error
+	if lstat {
+		fi, err = m.FS.Lstat(p)
+	} else {
+		fi, err = m.FS.Stat(p)
+	}
+	if err != nil {
+		return nil, m.wrapError(err)
+	}
+	return &fileInfo{FileInfo: fi, name: path.Base(name), localPath: p}, nil
+}
+
+// IsAbs reports whether the path is absolute.
+func (cfs *FS) IsAbs(p string) bool {
+	return path.IsAbs(p)
+}
+
+// fileInfo is an os.FileInfo returned by a mounted file system. The name is
+// that within the composite file system, which differs for the mount points.
+type fileInfo struct {
+	os.FileInfo
+	name      string
+	localPath string
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+// LocalPath returns the path within the mounted file system, which is used
+// to read the metadata of files on the local file system.
+func (fi *fileInfo) LocalPath() string {
+	return fi.localPath
+}
+
+// virtualInfo describes a virtual directory.
+type virtualInfo struct {
+	name string
+}
+
+func dirInfo(name string) *virtualInfo {
+	return &virtualInfo{name: name}
+}
+
+func (fi *virtualInfo) Name() string       { return fi.name }
+func (fi *virtualInfo) Size() int64        { return 0 }
+func (fi *virtualInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (fi *virtualInfo) ModTime() time.Time { return dirModTime }
+func (fi *virtualInfo) IsDir() bool        { return true }
+
+// Sys returns metadata without owner information, so that the owner of the
+// virtual directories does not depend on the user running restic.
+func (fi *virtualInfo) Sys() interface{} {
+	return &fs.Metadata{AccessTime: dirModTime, ChangeTime: dirModTime}
+}
+
+// file is a file or directory opened on a mounted file system. Errors are
+// wrapped so that they contain the name of the mount.
+type file struct {
+	fs.File
+	m    *Mount
+	name string
+	path string
+}
+
+// ensure that file implements fs.File
+var _ fs.File = &file{}
+
+// Unwrap returns the file opened on the mounted file system.
+func (f *file) Unwrap() fs.File {
+	return f.File
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	return n, f.m.wrapError(err)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.File.Seek(offset, whence)
+	return n, f.m.wrapError(err)
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	names, err := f.File.Readdirnames(n)
+	return names, f.m.wrapError(err)
+}
+
+func (f *file) Readdir(n int) ([]os.FileInfo, error) {
+	entries, err := f.File.Readdir(n)
+	for i, fi := range entries {
+		entries[i] = &fileInfo{FileInfo: fi, name: fi.Name(), localPath: f.m.FS.Join(f.path, fi.Name())}
+	}
+	return entries, f.m.wrapError(err)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, f.m.wrapError(err)
+	}
+	return &fileInfo{FileInfo: fi, name: path.Base(f.name), localPath: f.path}, nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+// readerAtFile is a file whose mounted file system supports reading at
+// arbitrary offsets.
+type readerAtFile struct {
+	*file
+}
+
+func (f *readerAtFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.(io.ReaderAt).ReadAt(p, off)
+	return n, f.m.wrapError(err)
+}
+
+// dir is a virtual directory.
+type dir struct {
+	fs    *FS
+	name  string
+	names []string
+}
+
+// ensure that dir implements fs.File
+var _ fs.File = &dir{}
+
+func (d *dir) Read(_ []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Seek(int64, int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Fd() uintptr {
+	return 0
+}
+
+// Readdirnames returns the names of the mounts and virtual directories. Only
+// n <= 0 is supported.
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	if n > 0 {
+		return nil, &os.PathError{Op: "readdirnames", Path: d.name, Err: errors.New("not implemented")}
+	}
+	return append([]string(nil), d.names...), nil
+}
+
+// Readdir returns information about the mounts and virtual directories. Only
+// n <= 0 is supported.
+func (d *dir) Readdir(n int) ([]os.FileInfo, error) {
+	if n > 0 {
+		return nil, &os.PathError{Op: "readdir", Path: d.name, Err: errors.New("not implemented")}
+	}
+
+	entries := make([]os.FileInfo, 0, len(d.names))
+	for _, name := range d.names {
+		fi, err := d.fs.Lstat(path.Join(d.name, name))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fi)
+	}
+	return entries, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return dirInfo(path.Base(d.name)), nil
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
@@ -0,0 +1,246 @@
+package compositefs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/fs/tarfs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func testTarFS(t testing.TB) *tarfs.FS {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range map[string]string{"dir/file": "tar file", "other": "other file"} {
+		rtest.OK(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Unix(1600000000, 0), Uid: 1234}))
+		_, err := io.WriteString(tw, data)
+		rtest.OK(t, err)
+	}
+	rtest.OK(t, tw.Close())
+
+	tfs, err := tarfs.New(&buf, rtest.TempDir(t))
+	rtest.OK(t, err)
+	return tfs
+}
+
+func testFS(t testing.TB) (*FS, string) {
+	tempdir := rtest.TempDir(t)
+	archiver.TestCreateFiles(t, tempdir, archiver.TestDir{
+		"file": archiver.TestFile{Content: "local file"},
+		"sub": archiver.TestDir{
+			"nested": archiver.TestFile{Content: "nested"},
+		},
+		"link": archiver.TestSymlink{Target: "file"},
+	})
+
+	cfs, err := New(
+		Mount{Path: "/local", FS: fs.Local{}, Root: tempdir},
+		Mount{Path: "/archives/tar", FS: testTarFS(t), Root: "/", Name: "backup.tar"},
+	)
+	rtest.OK(t, err)
+	t.Cleanup(func() {
+		rtest.OK(t, cfs.Close())
+	})
+	return cfs, tempdir
+}
+
+func readdirnames(t testing.TB, cfs *FS, name string) []string {
+	f, err := cfs.Open(name)
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return names
+}
+
+func readFile(t testing.TB, cfs *FS, name string) string {
+	f, err := cfs.Open(name)
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return string(buf)
+}
+
+func TestNew(t *testing.T) {
+	for _, mounts := range [][]string{
+		{"/"},
+		{"relative"},
+		{"/a", "/a"},
+		{"/a", "/a/../a/"},
+		{"/a", "/a/b"},
+		{"/a/b", "/a"},
+		{"/a/b/c", "/a/b"},
+	} {
+		var list []Mount
+		for _, p := range mounts {
+			list = append(list, Mount{Path: p, FS: fs.Local{}, Root: "."})
+		}
+		_, err := New(list...)
+		rtest.Assert(t, err != nil, "expected error for %v", mounts)
+	}
+
+	cfs, err := New(
+		Mount{Path: "/a/b", FS: fs.Local{}, Root: "."},
+		Mount{Path: "/a/c/", FS: fs.Local{}, Root: "."},
+		Mount{Path: "/d", FS: fs.Local{}, Root: "."},
+	)
+	rtest.OK(t, err)
+	rtest.Equals(t, []string{"a", "d"}, readdirnames(t, cfs, "/"))
+	rtest.Equals(t, []string{"b", "c"}, readdirnames(t, cfs, "/a"))
+}
+
+func TestFS(t *testing.T) {
+	cfs, tempdir := testFS(t)
+
+	rtest.Equals(t, []string{"archives", "local"}, readdirnames(t, cfs, "/"))
+	rtest.Equals(t, []string{"tar"}, readdirnames(t, cfs, "/archives"))
+
+	fi, err := cfs.Lstat("/archives")
+	rtest.OK(t, err)
+	rtest.Assert(t, fi.IsDir(), "virtual directory is not a directory")
+	rtest.Equals(t, "archives", fi.Name())
+
+	fi, err = cfs.Lstat("/local")
+	rtest.OK(t, err)
+	rtest.Assert(t, fi.IsDir(), "mount is not a directory")
+	rtest.Equals(t, "local", fi.Name())
+	rtest.Equals(t, tempdir, fs.LocalPath(fi, "/local"))
+
+	rtest.Equals(t, "local file", readFile(t, cfs, "/local/file"))
+	rtest.Equals(t, "nested", readFile(t, cfs, "/local/sub/nested"))
+	rtest.Equals(t, "tar file", readFile(t, cfs, "/archives/tar/dir/file"))
+
+	fi, err = cfs.Lstat("/archives/tar/other")
+	rtest.OK(t, err)
+	meta, ok := fs.MetadataOf(fi)
+	rtest.Assert(t, ok, "metadata of the mounted file system is missing")
+	rtest.Equals(t, uint32(1234), meta.UID)
+
+	f, err := cfs.Open("/local/file")
+	rtest.OK(t, err)
+	_, ok = fs.ReaderAt(f)
+	rtest.Assert(t, ok, "local file does not implement io.ReaderAt")
+	rtest.OK(t, f.Close())
+
+	_, err = cfs.Lstat("/missing")
+	rtest.Assert(t, errors.Is(err, os.ErrNotExist), "unexpected error %v", err)
+
+	_, err = cfs.Lstat("/archives/tar/missing")
+	rtest.Assert(t, errors.Is(err, os.ErrNotExist), "unexpected error %v", err)
+	var merr *Error
+	rtest.Assert(t, errors.As(err, &merr), "error %v does not name the mount", err)
+	rtest.Equals(t, "backup.tar", merr.Mount)
+}
+
+func TestCapabilities(t *testing.T) {
+	single, err := New(Mount{Path: "/tar", FS: testTarFS(t), Root: "/"})
+	rtest.OK(t, err)
+	rtest.Equals(t, fs.CapXattrs|fs.CapDeviceIDs|fs.CapInodes, single.Capabilities())
+
+	// inode numbers of different mounts may collide
+	cfs, _ := testFS(t)
+	rtest.Equals(t, fs.CapXattrs, cfs.Capabilities())
+}
+
+// failFS is a file system which fails to list the directory dir.
+type failFS struct {
+	fs.Local
+	dir string
+}
+
+func (f failFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	if name == f.dir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return f.Local.OpenFile(name, flag, perm)
+}
+
+func TestArchiverErrors(t *testing.T) {
+	tempdir := rtest.TempDir(t)
+	archiver.TestCreateFiles(t, tempdir, archiver.TestDir{
+		"ok":     archiver.TestDir{"file": archiver.TestFile{Content: "ok"}},
+		"denied": archiver.TestDir{"file": archiver.TestFile{Content: "denied"}},
+	})
+
+	cfs, err := New(
+		Mount{Path: "/good", FS: fs.Local{}, Root: tempdir, Name: "good"},
+		Mount{Path: "/bad", FS: failFS{dir: filepath.Join(tempdir, "denied")}, Root: tempdir, Name: "bad"},
+	)
+	rtest.OK(t, err)
+
+	repo := repository.TestRepository(t)
+	arch := archiver.New(repo, cfs, archiver.Options{})
+
+	var m sync.Mutex
+	errs := make(map[string]error)
+	arch.Error = func(item string, err error) error {
+		m.Lock()
+		defer m.Unlock()
+		errs[item] = err
+		return nil
+	}
+
+	_, _, err = arch.Snapshot(context.TODO(), []string{"/"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+
+	rtest.Equals(t, 1, len(errs))
+	err = errs["/bad/denied"]
+	rtest.Assert(t, errors.Is(err, os.ErrPermission), "unexpected error %v", err)
+	rtest.Assert(t, strings.Contains(err.Error(), "bad: "), "error %q does not contain the name of the mount", err)
+}
+
+func TestArchiver(t *testing.T) {
+	cfs, _ := testFS(t)
+	repo := repository.TestRepository(t)
+
+	arch := archiver.New(repo, cfs, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+
+	tree, err := restic.LoadTree(context.TODO(), repo, *sn.Tree)
+	rtest.OK(t, err)
+	rtest.Equals(t, 2, len(tree.Nodes))
+
+	local := loadTree(t, repo, *sn.Tree, "local")
+	rtest.Equals(t, 3, len(local.Nodes))
+	if runtime.GOOS != "windows" {
+		// the link target must be read from the local file system
+		link := local.Find("link")
+		rtest.Assert(t, link != nil, "link not found")
+		rtest.Equals(t, "file", link.LinkTarget)
+	}
+
+	tar := loadTree(t, repo, *sn.Tree, "archives", "tar")
+	other := tar.Find("other")
+	rtest.Assert(t, other != nil, "other not found")
+	rtest.Equals(t, uint32(1234), other.UID)
+	rtest.Equals(t, uint64(len("other file")), other.Size)
+}
+
+func loadTree(t testing.TB, repo restic.Repository, id restic.ID, dirs ...string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, dir := range dirs {
+		node := tree.Find(dir)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", dir)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
@@ -0,0 +1,25 @@
+package fs
+
+import "os"
+
+// DeviceSize returns the size of the block device f in bytes. For other
+// files, e.g. character devices, ok is false. Wrapped files which provide an
+// Unwrap method are unwrapped first.
+func DeviceSize(f File) (size uint64, ok bool) {
+	for {
+		if osf, ok := f.(*os.File); ok {
+			return deviceSize(osf)
+		}
+
+		w, ok := f.(interface{ Unwrap() File })
+		if !ok {
+			return 0, false
+		}
+		f = w.Unwrap()
+	}
+}
+
+// IsDevice returns true if fi describes a block or character device.
+func IsDevice(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeDevice != 0
+}
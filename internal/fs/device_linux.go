@@ -0,0 +1,18 @@
+package fs
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceSize queries the size of a block device with the BLKGETSIZE64 ioctl.
+func deviceSize(f *os.File) (uint64, bool) {
+	var size uint64
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, false
+	}
+	return size, true
+}
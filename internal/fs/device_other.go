@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import (
+	"io"
+	"os"
+)
+
+// deviceSize determines the size of a block device by seeking to its end.
+func deviceSize(f *os.File) (uint64, bool) {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice != 0 {
+		return 0, false
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return uint64(size), true
+}
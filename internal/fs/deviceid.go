@@ -0,0 +1,11 @@
+package fs
+
+import "github.com/restic/restic/internal/errors"
+
+// ErrDeviceIDNotSupported is returned by DeviceID if the device ID cannot be
+// determined for a file, e.g. because the file system does not provide it.
+var ErrDeviceIDNotSupported = errors.New("device IDs are not supported")
+
+// ErrInodeNotSupported is returned by Inode if the inode number cannot be
+// determined for a file.
+var ErrInodeNotSupported = errors.New("inode numbers are not supported")
@@ -18,7 +18,11 @@ func DeviceID(fi os.FileInfo) (deviceID uint64, err error) {
 	}
 
 	if fi.Sys() == nil {
-		return 0, errors.New("unable to determine device: fi.Sys() is nil")
+		return 0, errors.Wrap(ErrDeviceIDNotSupported, "unable to determine device: fi.Sys() is nil")
+	}
+
+	if meta, ok := MetadataOf(fi); ok {
+		return meta.DeviceID, nil
 	}
 
 	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
@@ -27,5 +31,23 @@ func DeviceID(fi os.FileInfo) (deviceID uint64, err error) {
 		return uint64(st.Dev), nil
 	}
 
-	return 0, errors.New("Could not cast to syscall.Stat_t")
+	return 0, errors.Wrap(ErrDeviceIDNotSupported, "Could not cast to syscall.Stat_t")
+}
+
+// Inode extracts the inode number and the number of hard links from an
+// os.FileInfo object by casting it to syscall.Stat_t
+func Inode(fi os.FileInfo) (inode, links uint64, err error) {
+	if fi == nil {
+		return 0, 0, errors.New("unable to determine inode: fi is nil")
+	}
+
+	if meta, ok := MetadataOf(fi); ok {
+		return metadataInode(meta)
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino, uint64(st.Nlink), nil
+	}
+
+	return 0, 0, errors.Wrap(ErrInodeNotSupported, "Could not cast to syscall.Stat_t")
 }
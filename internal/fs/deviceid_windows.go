@@ -12,5 +12,17 @@ import (
 // DeviceID extracts the device ID from an os.FileInfo object by casting it
 // to syscall.Stat_t
 func DeviceID(fi os.FileInfo) (deviceID uint64, err error) {
-	return 0, errors.New("Device IDs are not supported on Windows")
+	if meta, ok := MetadataOf(fi); ok {
+		return meta.DeviceID, nil
+	}
+	return 0, errors.Wrap(ErrDeviceIDNotSupported, "Device IDs are not supported on Windows")
+}
+
+// Inode extracts the inode number and the number of hard links from an
+// os.FileInfo object
+func Inode(fi os.FileInfo) (inode, links uint64, err error) {
+	if meta, ok := MetadataOf(fi); ok {
+		return metadataInode(meta)
+	}
+	return 0, 0, errors.Wrap(ErrInodeNotSupported, "Inode numbers are not supported on Windows")
 }
@@ -0,0 +1,27 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+// IsFatalError returns true if err indicates that the file system as a whole
+// cannot be accessed any more (e.g. because the connection to a network file
+// system was lost or the operation was cancelled), so continuing with other
+// files is pointless.
+func IsFatalError(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.IsFatal(err):
+		return true
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.Is(err, syscall.ENOTCONN):
+		// e.g. returned by a FUSE file system whose daemon has died
+		return true
+	}
+	return false
+}
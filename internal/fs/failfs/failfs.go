@@ -0,0 +1,233 @@
+// Package failfs provides a wrapper around a file system which injects
+// failures. It is used to test that the archiver and the scanner handle the
+// errors of unreliable file systems, e.g. network file systems, as documented.
+// Since it wraps any fs.FS, it can also be used to check other file systems.
+package failfs
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/fs"
+)
+
+// Options configures the failures. Files are identified by the names passed
+// to the file system.
+type Options struct {
+	// ReaddirFailures lists the calls to Readdir or Readdirnames, counted
+	// from one over all directories, which fail with EIO.
+	ReaddirFailures []int
+
+	// ShortReads limits the number of bytes each call to Read returns for
+	// the files.
+	ShortReads map[string]int
+
+	// SizeChanges is added to the size of the files reported by Lstat, Stat
+	// and the first call to Stat on the open file. Afterwards the actual size
+	// is reported, as if the file was modified before it was read.
+	SizeChanges map[string]int64
+
+	// OpenErrors are returned when the files are opened.
+	OpenErrors map[string]error
+
+	// Latency delays each operation on the file system and on open files.
+	Latency time.Duration
+}
+
+// FS wraps a file system and injects the failures configured in Options.
+type FS struct {
+	fs.FS
+	opts Options
+
+	m            sync.Mutex
+	readdirCalls int
+	openFiles    int
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// New returns a file system which injects failures into the operations on
+// filesys.
+func New(filesys fs.FS, opts Options) *FS {
+	return &FS{FS: filesys, opts: opts}
+}
+
+// OpenFiles returns the number of files which have been opened, but not
+// closed yet.
+func (f *FS) OpenFiles() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.openFiles
+}
+
+// ReaddirCalls returns the number of calls to Readdir and Readdirnames so far.
+func (f *FS) ReaddirCalls() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.readdirCalls
+}
+
+// Capabilities returns the capabilities of the wrapped file system.
+func (f *FS) Capabilities() fs.Capabilities {
+	return fs.CapabilitiesOf(f.FS)
+}
+
+func (f *FS) delay() {
+	if f.opts.Latency > 0 {
+		time.Sleep(f.opts.Latency)
+	}
+}
+
+// Open opens a file for reading.
+func (f *FS) Open(name string) (fs.File, error) {
+	return f.OpenFile(name, fs.O_RDONLY, 0)
+}
+
+// OpenFile opens a file, the error configured in OpenErrors is returned
+// instead.
+func (f *FS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	f.delay()
+	if err, ok := f.opts.OpenErrors[name]; ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	inner, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	f.m.Lock()
+	f.openFiles++
+	f.m.Unlock()
+
+	file := &file{
+		File:       inner,
+		fs:         f,
+		shortRead:  f.opts.ShortReads[name],
+		sizeChange: f.opts.SizeChanges[name],
+	}
+	if file.shortRead > 0 || file.sizeChange != 0 {
+		// the file must not be read via io.ReaderAt, which would bypass the
+		// injected failures
+		return file, nil
+	}
+	return &transparentFile{file}, nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (f *FS) Stat(name string) (os.FileInfo, error) {
+	f.delay()
+	fi, err := f.FS.Stat(name)
+	return f.changeSize(name, fi), err
+}
+
+// Lstat returns a FileInfo describing the named file, symlinks are not
+// resolved.
+func (f *FS) Lstat(name string) (os.FileInfo, error) {
+	f.delay()
+	fi, err := f.FS.Lstat(name)
+	return f.changeSize(name, fi), err
+}
+
+func (f *FS) changeSize(name string, fi os.FileInfo) os.FileInfo {
+	if delta, ok := f.opts.SizeChanges[name]; ok && fi != nil {
+		return changedFileInfo{FileInfo: fi, size: fi.Size() + delta}
+	}
+	return fi
+}
+
+// failReaddir returns true if the current call to Readdir or Readdirnames
+// must fail.
+func (f *FS) failReaddir() bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.readdirCalls++
+	for _, n := range f.opts.ReaddirFailures {
+		if n == f.readdirCalls {
+			return true
+		}
+	}
+	return false
+}
+
+// changedFileInfo reports a different size than the wrapped FileInfo.
+type changedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi changedFileInfo) Size() int64 { return fi.size }
+
+// file is an open file with injected failures.
+type file struct {
+	fs.File
+	fs *FS
+
+	shortRead  int
+	sizeChange int64
+	statCalls  int
+	closed     bool
+}
+
+// ensure that file implements fs.File
+var _ fs.File = &file{}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.fs.delay()
+	if f.shortRead > 0 && len(p) > f.shortRead {
+		p = p[:f.shortRead]
+	}
+	return f.File.Read(p)
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	f.fs.delay()
+	if f.fs.failReaddir() {
+		return nil, &os.PathError{Op: "readdirent", Path: f.Name(), Err: syscall.EIO}
+	}
+	return f.File.Readdirnames(n)
+}
+
+func (f *file) Readdir(n int) ([]os.FileInfo, error) {
+	f.fs.delay()
+	if f.fs.failReaddir() {
+		return nil, &os.PathError{Op: "readdirent", Path: f.Name(), Err: syscall.EIO}
+	}
+	return f.File.Readdir(n)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	f.fs.delay()
+	fi, err := f.File.Stat()
+	f.statCalls++
+	if err == nil && f.sizeChange != 0 && f.statCalls == 1 {
+		fi = changedFileInfo{FileInfo: fi, size: fi.Size() + f.sizeChange}
+	}
+	return fi, err
+}
+
+func (f *file) Close() error {
+	f.fs.m.Lock()
+	if !f.closed {
+		f.closed = true
+		f.fs.openFiles--
+	}
+	f.fs.m.Unlock()
+
+	return f.File.Close()
+}
+
+// transparentFile is an open file without failures which can be read via
+// io.ReaderAt.
+type transparentFile struct {
+	*file
+}
+
+// Unwrap returns the file opened on the wrapped file system.
+func (f *transparentFile) Unwrap() fs.File {
+	return f.file.File
+}
@@ -0,0 +1,84 @@
+package failfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestFS(t *testing.T) {
+	tempdir := rtest.TempDir(t)
+	filename := filepath.Join(tempdir, "file")
+	other := filepath.Join(tempdir, "other")
+	rtest.OK(t, os.WriteFile(filename, []byte("foobar"), 0600))
+	rtest.OK(t, os.WriteFile(other, []byte("other"), 0600))
+
+	testErr := errors.New("test error")
+	ffs := New(fs.Local{}, Options{
+		ReaddirFailures: []int{2},
+		ShortReads:      map[string]int{filename: 2},
+		SizeChanges:     map[string]int64{filename: -3},
+		OpenErrors:      map[string]error{filepath.Join(tempdir, "missing"): testErr},
+		Latency:         time.Millisecond,
+	})
+
+	// only the second call fails
+	for i := 1; i <= 3; i++ {
+		f, err := ffs.Open(tempdir)
+		rtest.OK(t, err)
+		_, err = f.Readdirnames(-1)
+		if i == 2 {
+			rtest.Assert(t, errors.Is(err, syscall.EIO), "unexpected error %v", err)
+		} else {
+			rtest.OK(t, err)
+		}
+		rtest.OK(t, f.Close())
+	}
+	rtest.Equals(t, 3, ffs.ReaddirCalls())
+
+	fi, err := ffs.Lstat(filename)
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(3), fi.Size())
+
+	f, err := ffs.Open(filename)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, ffs.OpenFiles())
+	_, ok := fs.ReaderAt(f)
+	rtest.Assert(t, !ok, "file with failures implements io.ReaderAt")
+
+	fi, err = f.Stat()
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(3), fi.Size())
+
+	buf := make([]byte, 10)
+	n, err := f.Read(buf)
+	rtest.OK(t, err)
+	rtest.Equals(t, 2, n)
+	rest, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.Equals(t, "obar", string(rest))
+
+	// the size has changed after the file was opened
+	fi, err = f.Stat()
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(6), fi.Size())
+	rtest.OK(t, f.Close())
+	rtest.Equals(t, 0, ffs.OpenFiles())
+
+	f, err = ffs.Open(other)
+	rtest.OK(t, err)
+	_, ok = fs.ReaderAt(f)
+	rtest.Assert(t, ok, "file without failures does not implement io.ReaderAt")
+	rtest.OK(t, f.Close())
+
+	_, err = ffs.Open(filepath.Join(tempdir, "missing"))
+	rtest.Assert(t, errors.Is(err, testErr), "unexpected error %v", err)
+	rtest.Equals(t, 0, ffs.OpenFiles())
+}
@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"os"
+)
+
+// FollowSymlinks is a wrapper around another file system which resolves
+// symbolic links. Lstat returns the information about the target of a link,
+// and files and directories are opened via links. Symlinks whose target
+// cannot be resolved, e.g. because it does not exist, are returned as links.
+type FollowSymlinks struct {
+	FS
+
+	// DanglingLink, if set, is called for symlinks which cannot be resolved.
+	DanglingLink func(name string, err error)
+}
+
+// statically ensure that FollowSymlinks implements FS.
+var _ FS = FollowSymlinks{}
+
+// Capabilities returns the capabilities of the underlying file system.
+func (fs FollowSymlinks) Capabilities() Capabilities {
+	return CapabilitiesOf(fs.FS)
+}
+
+// Lstat returns the FileInfo structure describing the named file. If the file
+// is a symbolic link, the returned FileInfo describes the target of the link
+// if it exists.
+func (fs FollowSymlinks) Lstat(name string) (os.FileInfo, error) {
+	fi, err := fs.FS.Lstat(name)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return fi, err
+	}
+
+	target, err := fs.FS.Stat(name)
+	if err != nil {
+		if fs.DanglingLink != nil {
+			fs.DanglingLink(name, err)
+		}
+		return fi, nil
+	}
+
+	return target, nil
+}
+
+// OpenFile opens the named file, following symbolic links. O_NOFOLLOW is
+// ignored.
+func (fs FollowSymlinks) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return fs.FS.OpenFile(name, flag&^O_NOFOLLOW, perm)
+}
@@ -6,7 +6,12 @@ import (
 )
 
 // Local is the local file system. Most methods are just passed on to the stdlib.
-type Local struct{}
+type Local struct {
+	// UpdateAtime disables opening files with O_NOATIME. By default, Local
+	// tries to prevent reads from updating the access time of a file, where
+	// the platform and the permissions on the file allow it.
+	UpdateAtime bool
+}
 
 // statically ensure that Local implements FS.
 var _ FS = &Local{}
@@ -18,13 +23,21 @@ func (fs Local) VolumeName(path string) string {
 	return filepath.VolumeName(path)
 }
 
+// Capabilities returns the features supported by the local file system on the
+// current platform.
+func (fs Local) Capabilities() Capabilities {
+	return localCapabilities()
+}
+
 // Open opens a file for reading.
 func (fs Local) Open(name string) (File, error) {
 	f, err := os.Open(fixpath(name))
 	if err != nil {
 		return nil, err
 	}
-	_ = setFlags(f)
+	if !fs.UpdateAtime {
+		_ = setFlags(f)
+	}
 	return f, nil
 }
 
@@ -38,7 +51,9 @@ func (fs Local) OpenFile(name string, flag int, perm os.FileMode) (File, error)
 	if err != nil {
 		return nil, err
 	}
-	_ = setFlags(f)
+	if !fs.UpdateAtime {
+		_ = setFlags(f)
+	}
 	return f, nil
 }
 
@@ -21,8 +21,10 @@ type LocalVss struct {
 	FS
 	snapshots       map[string]VssSnapshot
 	failedSnapshots map[string]struct{}
+	deleted         bool
 	mutex           sync.RWMutex
 	msgError        ErrorHandler
+	msgWarning      MessageHandler
 	msgMessage      MessageHandler
 }
 
@@ -30,22 +32,45 @@ type LocalVss struct {
 var _ FS = &LocalVss{}
 
 // NewLocalVss creates a new wrapper around the windows filesystem using volume
-// shadow copy service to access locked files.
-func NewLocalVss(msgError ErrorHandler, msgMessage MessageHandler) *LocalVss {
+// shadow copy service to access locked files. Volumes for which no snapshot
+// can be created are read directly, this is reported via msgWarning.
+func NewLocalVss(msgError ErrorHandler, msgWarning, msgMessage MessageHandler) *LocalVss {
 	return &LocalVss{
 		FS:              Local{},
 		snapshots:       make(map[string]VssSnapshot),
 		failedSnapshots: make(map[string]struct{}),
 		msgError:        msgError,
+		msgWarning:      msgWarning,
 		msgMessage:      msgMessage,
 	}
 }
 
+// Capabilities returns the capabilities of the local file system.
+func (fs *LocalVss) Capabilities() Capabilities {
+	return CapabilitiesOf(fs.FS)
+}
+
+// CreateSnapshots creates a snapshot for each volume containing one of the
+// targets, so that all accesses see the same state of the volume.
+func (fs *LocalVss) CreateSnapshots(targets []string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for _, target := range targets {
+		if volumeNameLower, ok := snapshotVolume(target); ok {
+			fs.ensureSnapshot(volumeNameLower)
+		}
+	}
+}
+
 // DeleteSnapshots deletes all snapshots that were created automatically.
+// Afterwards, no new snapshots are created and files are read directly.
 func (fs *LocalVss) DeleteSnapshots() {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
+	fs.deleted = true
+
 	activeSnapshots := make(map[string]VssSnapshot)
 
 	for volumeName, snapshot := range fs.snapshots {
@@ -83,58 +108,26 @@ func (fs *LocalVss) Lstat(name string) (os.FileInfo, error) {
 // If creation of a snapshot fails the file's original path is returned as
 // a fallback.
 func (fs *LocalVss) snapshotPath(path string) string {
-
-	fixPath := fixpath(path)
-
-	if strings.HasPrefix(fixPath, `\\?\UNC\`) {
-		// UNC network shares are currently not supported so we access the regular file
-		// without snapshotting
-		// TODO: right now there is a problem in fixpath(): "\\host\share" is not returned as a UNC path
-		//       "\\host\share\" is returned as a valid UNC path
+	volumeNameLower, ok := snapshotVolume(path)
+	if !ok {
 		return path
 	}
 
-	fixPath = strings.TrimPrefix(fixpath(path), `\\?\`)
+	fixPath := strings.TrimPrefix(fixpath(path), `\\?\`)
 	fixPathLower := strings.ToLower(fixPath)
 	volumeName := filepath.VolumeName(fixPath)
-	volumeNameLower := strings.ToLower(volumeName)
 
 	fs.mutex.RLock()
 
 	// ensure snapshot for volume exists
 	_, snapshotExists := fs.snapshots[volumeNameLower]
 	_, snapshotFailed := fs.failedSnapshots[volumeNameLower]
-	if !snapshotExists && !snapshotFailed {
+	if !snapshotExists && !snapshotFailed && !fs.deleted {
 		fs.mutex.RUnlock()
 		fs.mutex.Lock()
 		defer fs.mutex.Unlock()
 
-		_, snapshotExists = fs.snapshots[volumeNameLower]
-		_, snapshotFailed = fs.failedSnapshots[volumeNameLower]
-
-		if !snapshotExists && !snapshotFailed {
-			vssVolume := volumeNameLower + string(filepath.Separator)
-			fs.msgMessage("creating VSS snapshot for [%s]\n", vssVolume)
-
-			if snapshot, err := NewVssSnapshot(vssVolume, 120, fs.msgError); err != nil {
-				_ = fs.msgError(vssVolume, errors.Errorf("failed to create snapshot for [%s]: %s",
-					vssVolume, err))
-				fs.failedSnapshots[volumeNameLower] = struct{}{}
-			} else {
-				fs.snapshots[volumeNameLower] = snapshot
-				fs.msgMessage("successfully created snapshot for [%s]\n", vssVolume)
-				if len(snapshot.mountPointInfo) > 0 {
-					fs.msgMessage("mountpoints in snapshot volume [%s]:\n", vssVolume)
-					for mp, mpInfo := range snapshot.mountPointInfo {
-						info := ""
-						if !mpInfo.IsSnapshotted() {
-							info = " (not snapshotted)"
-						}
-						fs.msgMessage(" - %s%s\n", mp, info)
-					}
-				}
-			}
-		}
+		fs.ensureSnapshot(volumeNameLower)
 	} else {
 		defer fs.mutex.RUnlock()
 	}
@@ -178,10 +171,58 @@ func (fs *LocalVss) snapshotPath(path string) string {
 
 	} else {
 		// no snapshot is available for the requested path:
-		//  -> try to backup without a snapshot
-		// TODO: log warning?
+		//  -> try to backup without a snapshot, a warning has already been
+		//     printed when the creation failed
 		snapshotPath = path
 	}
 
 	return snapshotPath
 }
+
+// snapshotVolume returns the lower case volume name of path. UNC network
+// shares are currently not supported, for them false is returned.
+func snapshotVolume(path string) (string, bool) {
+	fixPath := fixpath(path)
+	if strings.HasPrefix(fixPath, `\\?\UNC\`) {
+		// TODO: right now there is a problem in fixpath(): "\\host\share" is not returned as a UNC path
+		//       "\\host\share\" is returned as a valid UNC path
+		return "", false
+	}
+
+	fixPath = strings.TrimPrefix(fixPath, `\\?\`)
+	return strings.ToLower(filepath.VolumeName(fixPath)), true
+}
+
+// ensureSnapshot creates a snapshot for the volume unless it already exists,
+// its creation has failed before or the snapshots have already been deleted.
+// The caller must hold the write lock.
+func (fs *LocalVss) ensureSnapshot(volumeNameLower string) {
+	_, snapshotExists := fs.snapshots[volumeNameLower]
+	_, snapshotFailed := fs.failedSnapshots[volumeNameLower]
+	if snapshotExists || snapshotFailed || fs.deleted {
+		return
+	}
+
+	vssVolume := volumeNameLower + string(filepath.Separator)
+	fs.msgMessage("creating VSS snapshot for [%s]\n", vssVolume)
+
+	snapshot, err := NewVssSnapshot(vssVolume, 120, fs.msgError)
+	if err != nil {
+		fs.msgWarning("failed to create snapshot for [%s], reading files directly: %s\n", vssVolume, err)
+		fs.failedSnapshots[volumeNameLower] = struct{}{}
+		return
+	}
+
+	fs.snapshots[volumeNameLower] = snapshot
+	fs.msgMessage("successfully created snapshot for [%s]\n", vssVolume)
+	if len(snapshot.mountPointInfo) > 0 {
+		fs.msgMessage("mountpoints in snapshot volume [%s]:\n", vssVolume)
+		for mp, mpInfo := range snapshot.mountPointInfo {
+			info := ""
+			if !mpInfo.IsSnapshotted() {
+				info = " (not snapshotted)"
+			}
+			fs.msgMessage(" - %s%s\n", mp, info)
+		}
+	}
+}
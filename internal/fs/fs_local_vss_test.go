@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestLocalVssFallback(t *testing.T) {
+	tempdir := rtest.TempDir(t)
+	filename := filepath.Join(tempdir, "file")
+	rtest.OK(t, os.WriteFile(filename, []byte("foobar"), 0600))
+
+	var warnings []string
+	fs := NewLocalVss(func(item string, err error) error {
+		t.Errorf("unexpected error for %v: %v", item, err)
+		return nil
+	}, func(msg string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(msg, args...))
+	}, func(msg string, args ...interface{}) {})
+
+	// snapshots are not available, the targets are read directly
+	fs.CreateSnapshots([]string{tempdir, filename})
+	rtest.Equals(t, 1, len(warnings))
+
+	fi, err := fs.Lstat(filename)
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(6), fi.Size())
+	rtest.Equals(t, filename, fs.snapshotPath(filename))
+	rtest.Equals(t, 1, len(warnings))
+
+	fs.DeleteSnapshots()
+	_, err = fs.Lstat(filename)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, len(warnings))
+}
+
+func TestLocalVssDeleted(t *testing.T) {
+	var warnings int
+	fs := NewLocalVss(nil, func(msg string, args ...interface{}) {
+		warnings++
+	}, func(msg string, args ...interface{}) {})
+
+	// no snapshots are created after they have been deleted
+	fs.DeleteSnapshots()
+	fs.CreateSnapshots([]string{"/"})
+	rtest.Equals(t, "/", fs.snapshotPath("/"))
+	rtest.Equals(t, 0, warnings)
+}
@@ -23,7 +23,8 @@ type Reader struct {
 	// for FileInfo
 	Mode    os.FileMode
 	ModTime time.Time
-	Size    int64
+	// Size is SizeUnknown if the length of the data is not known beforehand.
+	Size int64
 
 	AllowEmptyFile bool
 
@@ -15,6 +15,11 @@ type Track struct {
 	FS
 }
 
+// Capabilities returns the capabilities of the underlying file system.
+func (fs Track) Capabilities() Capabilities {
+	return CapabilitiesOf(fs.FS)
+}
+
 // Open wraps the Open method of the underlying file system.
 func (fs Track) Open(name string) (File, error) {
 	f, err := fs.FS.Open(fixpath(name))
@@ -52,3 +57,8 @@ func (f *trackFile) Close() error {
 	runtime.SetFinalizer(f, nil)
 	return f.File.Close()
 }
+
+// Unwrap returns the underlying file.
+func (f *trackFile) Unwrap() File {
+	return f.File
+}
@@ -1,6 +1,9 @@
 package fs
 
-import "os"
+import (
+	"io"
+	"os"
+)
 
 // IsRegularFile returns true if fi belongs to a normal file. If fi is nil,
 // false is returned.
@@ -11,3 +14,20 @@ func IsRegularFile(fi os.FileInfo) bool {
 
 	return fi.Mode()&os.ModeType == 0
 }
+
+// ReaderAt returns f as an io.ReaderAt if the file supports reading at
+// arbitrary offsets. Wrapped files which provide an Unwrap method are
+// unwrapped first.
+func ReaderAt(f File) (io.ReaderAt, bool) {
+	for {
+		if rd, ok := f.(io.ReaderAt); ok {
+			return rd, true
+		}
+
+		w, ok := f.(interface{ Unwrap() File })
+		if !ok {
+			return nil, false
+		}
+		f = w.Unwrap()
+	}
+}
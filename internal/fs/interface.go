@@ -23,6 +23,11 @@ type FS interface {
 	Base(path string) string
 }
 
+// SizeUnknown is reported as the size of regular files whose size is not known
+// before they have been read completely, e.g. the output of a command. The
+// size of such files is determined while they are saved.
+const SizeUnknown int64 = -1
+
 // File is an open file on a file system.
 type File interface {
 	io.Reader
@@ -35,3 +40,14 @@ type File interface {
 	Stat() (os.FileInfo, error)
 	Name() string
 }
+
+// WritableFile is a file opened for random access, e.g. to restore its
+// contents. It is implemented by *os.File.
+type WritableFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
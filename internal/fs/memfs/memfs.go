@@ -0,0 +1,164 @@
+// Package memfs provides a read-only file system with files which are
+// registered in memory. It allows applications which embed restic to save
+// data they generate without writing it to disk first, and is a fast fixture
+// for tests. The in-memory directory tree is shared with the file systems
+// for archives and images.
+package memfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+)
+
+// Entry describes a file, directory or symlink which is added to the file
+// system. The type is taken from Mode.
+type Entry struct {
+	Mode    os.FileMode
+	ModTime time.Time
+
+	// Data is the content of a regular file.
+	Data []byte
+
+	// Reader provides the content of a regular file instead of Data. It is
+	// read once when the file is opened for the first time. Size is the
+	// length of the content, or fs.SizeUnknown.
+	Reader io.Reader
+	Size   int64
+
+	// LinkTarget is the target of a symlink.
+	LinkTarget string
+
+	UID, GID    uint32
+	User, Group string
+
+	ExtendedAttributes []fs.ExtendedAttribute
+}
+
+// FS is a read-only file system which contains the entries added to it.
+// Parent directories are created implicitly, directories list their entries
+// sorted by name. Entries can be added concurrently, but all of them should
+// be added before the file system is read, e.g. by the archiver.
+type FS struct {
+	*Tree
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// New returns an empty file system.
+func New() *FS {
+	t := NewTree()
+	t.SortNames = true
+	return &FS{Tree: t}
+}
+
+// Add adds the entry at the absolute path name. Missing parent directories
+// are created with the permissions 0755, a directory created this way can be
+// added later to set its metadata. Other entries cannot be replaced.
+func (fsys *FS) Add(name string, e Entry) error {
+	name = path.Clean("/" + name)
+
+	switch {
+	case e.Mode.IsDir(), e.Mode&os.ModeSymlink != 0:
+		if e.Data != nil || e.Reader != nil {
+			return errors.Errorf("%v: only regular files can have a content", name)
+		}
+	case e.Mode.IsRegular():
+		if e.Data != nil && e.Reader != nil {
+			return errors.Errorf("%v: both data and a reader were specified", name)
+		}
+	default:
+		return errors.Errorf("%v: unsupported mode %v", name, e.Mode)
+	}
+
+	meta := fsys.NewMetadata()
+	meta.UID, meta.GID = e.UID, e.GID
+	meta.User, meta.Group = e.User, e.Group
+	meta.LinkTarget = e.LinkTarget
+	meta.ExtendedAttributes = e.ExtendedAttributes
+	meta.AccessTime, meta.ChangeTime = e.ModTime, e.ModTime
+
+	n := &Node{
+		Mode:    e.Mode,
+		ModTime: e.ModTime,
+		Meta:    meta,
+	}
+	switch {
+	case e.Reader != nil:
+		n.Size = e.Size
+		n.Content = readOnce(e.Reader)
+	case e.Mode.IsRegular():
+		data := e.Data
+		n.Size = int64(len(data))
+		n.Content = func() (io.Reader, error) {
+			return bytes.NewReader(data), nil
+		}
+	}
+
+	return fsys.Create(name, n)
+}
+
+// readOnce returns a content function which returns rd the first time it is
+// called. The content can only be read sequentially.
+func readOnce(rd io.Reader) func() (io.Reader, error) {
+	var opened int32
+	return func() (io.Reader, error) {
+		if !atomic.CompareAndSwapInt32(&opened, 0, 1) {
+			return nil, errors.New("the content has already been read")
+		}
+		return sequentialReader{rd}, nil
+	}
+}
+
+// sequentialReader hides all methods of the reader except Read and Close.
+type sequentialReader struct {
+	rd io.Reader
+}
+
+func (r sequentialReader) Read(p []byte) (int, error) {
+	return r.rd.Read(p)
+}
+
+func (r sequentialReader) Close() error {
+	if c, ok := r.rd.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// AddFile adds a regular file with the content data.
+func (fsys *FS) AddFile(name string, data []byte, mode os.FileMode, modTime time.Time) error {
+	if data == nil {
+		data = []byte{}
+	}
+	return fsys.Add(name, Entry{Mode: mode &^ os.ModeType, ModTime: modTime, Data: data})
+}
+
+// AddReader adds a regular file with the content read from rd, which has the
+// given size or fs.SizeUnknown.
+func (fsys *FS) AddReader(name string, rd io.Reader, size int64, mode os.FileMode, modTime time.Time) error {
+	return fsys.Add(name, Entry{Mode: mode &^ os.ModeType, ModTime: modTime, Reader: rd, Size: size})
+}
+
+// AddDir adds a directory.
+func (fsys *FS) AddDir(name string, mode os.FileMode, modTime time.Time) error {
+	return fsys.Add(name, Entry{Mode: os.ModeDir | mode.Perm(), ModTime: modTime})
+}
+
+// AddSymlink adds a symlink to target.
+func (fsys *FS) AddSymlink(name, target string, modTime time.Time) error {
+	return fsys.Add(name, Entry{Mode: os.ModeSymlink | 0777, ModTime: modTime, LinkTarget: target})
+}
+
+// Capabilities returns the features supported by the file system. Each entry
+// has its own inode number.
+func (fsys *FS) Capabilities() fs.Capabilities {
+	return fs.CapXattrs | fs.CapInodes
+}
@@ -0,0 +1,213 @@
+package memfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+var testTime = time.Unix(1600000000, 0).UTC()
+
+func readFile(t testing.TB, fsys fs.FS, name string) string {
+	f, err := fsys.Open(name)
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return string(buf)
+}
+
+func readDir(t testing.TB, fsys fs.FS, name string) []string {
+	f, err := fsys.Open(name)
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return names
+}
+
+func TestFS(t *testing.T) {
+	fsys := New()
+	rtest.OK(t, fsys.AddFile("/reports/2024/q2.csv", []byte("q2"), 0644, testTime))
+	rtest.OK(t, fsys.AddFile("/reports/2024/q1.csv", []byte("q1"), 0600, testTime))
+	rtest.OK(t, fsys.AddReader("/dump/kv", strings.NewReader("key=value"), fs.SizeUnknown, 0644, testTime))
+	rtest.OK(t, fsys.AddSymlink("/reports/latest", "2024/q2.csv", testTime))
+	rtest.OK(t, fsys.Add("/reports", Entry{Mode: os.ModeDir | 0700, ModTime: testTime.Add(time.Hour), UID: 1000}))
+
+	rtest.Equals(t, []string{"dump", "reports"}, readDir(t, fsys, "/"))
+	rtest.Equals(t, []string{"2024", "latest"}, readDir(t, fsys, "/reports"))
+	rtest.Equals(t, []string{"q1.csv", "q2.csv"}, readDir(t, fsys, "/reports/2024"))
+	rtest.Equals(t, "q1", readFile(t, fsys, "/reports/2024/q1.csv"))
+
+	// the metadata of the implicit directory has been set later
+	fi, err := fsys.Lstat("/reports")
+	rtest.OK(t, err)
+	rtest.Equals(t, os.ModeDir|0700, fi.Mode())
+	rtest.Equals(t, uint32(1000), fi.Sys().(*fs.Metadata).UID)
+
+	fi, err = fsys.Lstat("/reports/2024/q1.csv")
+	rtest.OK(t, err)
+	rtest.Equals(t, os.FileMode(0600), fi.Mode())
+	rtest.Equals(t, int64(2), fi.Size())
+	rtest.Assert(t, fi.ModTime().Equal(testTime), "wrong mtime %v", fi.ModTime())
+
+	fi, err = fsys.Lstat("/reports/latest")
+	rtest.OK(t, err)
+	rtest.Equals(t, "2024/q2.csv", fi.Sys().(*fs.Metadata).LinkTarget)
+
+	f, err := fsys.Open("/reports/2024/q2.csv")
+	rtest.OK(t, err)
+	_, ok := fs.ReaderAt(f)
+	rtest.Assert(t, ok, "file with data does not implement io.ReaderAt")
+	rtest.OK(t, f.Close())
+
+	// the content of a reader can only be read once
+	fi, err = fsys.Lstat("/dump/kv")
+	rtest.OK(t, err)
+	rtest.Equals(t, fs.SizeUnknown, fi.Size())
+	f, err = fsys.Open("/dump/kv")
+	rtest.OK(t, err)
+	_, ok = fs.ReaderAt(f)
+	rtest.Assert(t, !ok, "file with reader implements io.ReaderAt")
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.Equals(t, "key=value", string(buf))
+	rtest.OK(t, f.Close())
+	_, err = fsys.Open("/dump/kv")
+	rtest.Assert(t, err != nil, "expected error for opening a reader twice")
+
+	_, err = fsys.Lstat("/missing")
+	rtest.Assert(t, os.IsNotExist(err), "unexpected error %v", err)
+}
+
+func TestAddErrors(t *testing.T) {
+	fsys := New()
+	rtest.OK(t, fsys.AddFile("/file", []byte("data"), 0644, testTime))
+	rtest.OK(t, fsys.AddDir("/dir", 0755, testTime))
+
+	for _, test := range []struct {
+		name  string
+		entry Entry
+	}{
+		{"/file", Entry{Mode: 0644}},
+		{"/file", Entry{Mode: os.ModeDir | 0755}},
+		{"/dir", Entry{Mode: os.ModeDir | 0755}},
+		{"/file/sub", Entry{Mode: 0644}},
+		{"/other", Entry{Mode: 0644, Data: []byte("data"), Reader: strings.NewReader("data")}},
+		{"/other", Entry{Mode: os.ModeDir | 0755, Data: []byte("data")}},
+		{"/other", Entry{Mode: os.ModeNamedPipe | 0644}},
+	} {
+		err := fsys.Add(test.name, test.entry)
+		rtest.Assert(t, err != nil, "expected error for adding %v %v", test.name, test.entry.Mode)
+	}
+	rtest.Equals(t, []string{"dir", "file"}, readDir(t, fsys, "/"))
+
+	err := fsys.AddFile("/file", nil, 0644, testTime)
+	rtest.Assert(t, errors.Is(err, os.ErrExist), "unexpected error %v", err)
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	fsys := New()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("/data/%02d/file%02d", j%5, i*50+j)
+				rtest.OK(t, fsys.AddFile(name, []byte(name), 0644, testTime))
+			}
+		}()
+	}
+	wg.Wait()
+
+	rtest.Equals(t, []string{"00", "01", "02", "03", "04"}, readDir(t, fsys, "/data"))
+	var files int
+	for _, dir := range readDir(t, fsys, "/data") {
+		names := readDir(t, fsys, "/data/"+dir)
+		for i := 1; i < len(names); i++ {
+			rtest.Assert(t, names[i-1] < names[i], "entries are not sorted: %v", names)
+		}
+		for _, name := range names {
+			filename := "/data/" + dir + "/" + name
+			rtest.Equals(t, filename, readFile(t, fsys, filename))
+		}
+		files += len(names)
+	}
+	rtest.Equals(t, 400, files)
+}
+
+func TestTreePut(t *testing.T) {
+	tree := NewTree()
+	file := func(data string) *Node {
+		return &Node{Mode: 0644, Meta: tree.NewMetadata(), Size: int64(len(data)), Content: func() (io.Reader, error) {
+			return strings.NewReader(data), nil
+		}}
+	}
+
+	tree.Put("/b/file", file("b"))
+	tree.Put("/a", file("a"))
+	tree.Put("/c/sub/file", file("c"))
+	rtest.Equals(t, []string{"b", "a", "c"}, readDir(t, tree, "/"))
+
+	// directories are merged, other nodes are replaced at their position
+	dir := tree.Lookup("/c")
+	rtest.Assert(t, tree.Put("/c", &Node{Mode: os.ModeDir | 0700, Meta: tree.NewMetadata()}) == dir, "directory was replaced")
+	rtest.Equals(t, os.ModeDir|0700, dir.Mode)
+	rtest.Equals(t, []string{"sub"}, readDir(t, tree, "/c"))
+	tree.Put("/b", file("new b"))
+	rtest.Equals(t, []string{"b", "a", "c"}, readDir(t, tree, "/"))
+	rtest.Equals(t, "new b", readFile(t, tree, "/b"))
+	rtest.Assert(t, tree.Lookup("/b/file") == nil, "entry of the replaced directory still exists")
+
+	// a file in the way of a new path is replaced by a directory
+	tree.Put("/a/file", file("a"))
+	fi, err := tree.Lstat("/a")
+	rtest.OK(t, err)
+	rtest.Assert(t, fi.IsDir(), "file /a was not replaced by a directory")
+
+	tree.Remove("/c")
+	rtest.Equals(t, []string{"b", "a"}, readDir(t, tree, "/"))
+	rtest.Assert(t, tree.Lookup("/c/sub/file") == nil, "entry of the removed directory still exists")
+}
+
+func TestArchiver(t *testing.T) {
+	fsys := New()
+	rtest.OK(t, fsys.AddFile("/export/users.json", []byte(`[{"name": "user"}]`), 0644, testTime))
+	rtest.OK(t, fsys.AddReader("/export/events.log", strings.NewReader("event 1\nevent 2\n"), fs.SizeUnknown, 0600, testTime))
+
+	repo := repository.TestRepository(t)
+	arch := archiver.New(repo, fsys, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/export"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+
+	tree, err := restic.LoadTree(context.TODO(), repo, *sn.Tree)
+	rtest.OK(t, err)
+	export := tree.Find("export")
+	rtest.Assert(t, export != nil && export.Subtree != nil, "directory export is missing")
+	tree, err = restic.LoadTree(context.TODO(), repo, *export.Subtree)
+	rtest.OK(t, err)
+
+	users := tree.Find("users.json")
+	rtest.Assert(t, users.ModTime.Equal(testTime), "wrong mtime %v", users.ModTime)
+	archiver.TestEnsureFileContent(context.TODO(), t, repo, "users.json", users, archiver.TestFile{Content: `[{"name": "user"}]`})
+
+	events := tree.Find("events.log")
+	rtest.Equals(t, os.FileMode(0600), events.Mode)
+	rtest.Equals(t, uint64(len("event 1\nevent 2\n")), events.Size)
+	archiver.TestEnsureFileContent(context.TODO(), t, repo, "events.log", events, archiver.TestFile{Content: "event 1\nevent 2\n"})
+}
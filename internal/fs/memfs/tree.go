@@ -0,0 +1,415 @@
+package memfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+)
+
+// Tree is a read-only file system with the nodes stored in it. It is the
+// base of the file systems which present the contents of an archive or
+// image, they embed a Tree and add the nodes while reading it. Directories
+// list their entries in the order they were added, unless SortNames is set.
+type Tree struct {
+	fs.SlashPaths
+
+	// SortNames lists the entries of directories sorted by name.
+	SortNames bool
+
+	m      sync.Mutex
+	nodes  map[string]*Node
+	inodes uint64
+}
+
+// statically ensure that Tree implements fs.FS.
+var _ fs.FS = &Tree{}
+
+// Node is a file, directory or other entry of a Tree.
+type Node struct {
+	Name    string
+	Mode    os.FileMode
+	ModTime time.Time
+	Meta    *fs.Metadata
+
+	// Size is the length of the content of a regular file.
+	Size int64
+
+	// Content returns a reader for the content of a regular file, it is
+	// called each time the file is opened. If the reader implements
+	// io.ReaderAt, io.Seeker or io.Closer, the opened file does so as well.
+	Content func() (io.Reader, error)
+
+	children []*Node
+	// implicit is set for directories which were created for the path of
+	// another node
+	implicit bool
+}
+
+// NewTree returns a tree which only contains the root directory.
+func NewTree() *Tree {
+	t := &Tree{nodes: make(map[string]*Node)}
+	t.nodes["/"] = &Node{
+		Name:     "/",
+		Mode:     os.ModeDir | 0755,
+		Meta:     t.newMetadata(),
+		implicit: true,
+	}
+	return t
+}
+
+// NewMetadata returns the metadata for a new node, each node gets a unique
+// inode number.
+func (t *Tree) NewMetadata() *fs.Metadata {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.newMetadata()
+}
+
+func (t *Tree) newMetadata() *fs.Metadata {
+	t.inodes++
+	return &fs.Metadata{Inode: t.inodes, Links: 1}
+}
+
+// Create adds n at the absolute path name. Missing parent directories are
+// created with the permissions 0755, a directory created this way can be
+// added later to set its metadata. Other nodes cannot be replaced.
+func (t *Tree) Create(name string, n *Node) error {
+	name = path.Clean("/" + name)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if old, ok := t.nodes[name]; ok {
+		if !old.implicit || !n.Mode.IsDir() {
+			return pathError("add", name, os.ErrExist)
+		}
+		merge(old, n)
+		return nil
+	}
+
+	parent, err := t.dir(path.Dir(name), n.ModTime, false)
+	if err != nil {
+		return err
+	}
+	t.insert(parent, name, n)
+	return nil
+}
+
+// Put stores n at the absolute path name and returns the node stored there.
+// Missing parent directories are created, as for Create. A node which already
+// exists is replaced, except for directories, which keep their entries and
+// take the metadata of n. Only a directory can be put at the root.
+func (t *Tree) Put(name string, n *Node) *Node {
+	name = path.Clean("/" + name)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if old, ok := t.nodes[name]; ok && old.Mode.IsDir() && n.Mode.IsDir() {
+		merge(old, n)
+		return old
+	}
+	if name == "/" {
+		return t.nodes[name]
+	}
+
+	parent, _ := t.dir(path.Dir(name), n.ModTime, true)
+	t.insert(parent, name, n)
+	return n
+}
+
+// merge sets the metadata of the directory d to that of n, d keeps its
+// entries and its inode number.
+func merge(d, n *Node) {
+	n.Meta.Inode = d.Meta.Inode
+	d.Mode, d.ModTime, d.Meta, d.implicit = n.Mode, n.ModTime, n.Meta, false
+}
+
+// dir returns the directory name, which is created if it does not exist
+// yet. A node in the way is replaced if replace is set.
+func (t *Tree) dir(name string, modTime time.Time, replace bool) (*Node, error) {
+	if n, ok := t.nodes[name]; ok {
+		if n.Mode.IsDir() {
+			return n, nil
+		}
+		if !replace {
+			return nil, pathError("add", name, syscall.ENOTDIR)
+		}
+	}
+
+	parent, err := t.dir(path.Dir(name), modTime, replace)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		Name:     path.Base(name),
+		Mode:     os.ModeDir | 0755,
+		ModTime:  modTime,
+		Meta:     t.newMetadata(),
+		implicit: true,
+	}
+	n.Meta.AccessTime, n.Meta.ChangeTime = modTime, modTime
+	t.insert(parent, name, n)
+	return n, nil
+}
+
+// insert stores n at name in the directory parent. A node which exists at
+// name is replaced at its position.
+func (t *Tree) insert(parent *Node, name string, n *Node) {
+	n.Name = path.Base(name)
+
+	old, ok := t.nodes[name]
+	if !ok {
+		parent.children = append(parent.children, n)
+		t.nodes[name] = n
+		return
+	}
+
+	t.forget(name)
+	for i, child := range parent.children {
+		if child == old {
+			parent.children[i] = n
+		}
+	}
+	t.nodes[name] = n
+}
+
+// Remove removes the node name and everything below it. The root cannot be
+// removed.
+func (t *Tree) Remove(name string) {
+	name = path.Clean("/" + name)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	n, ok := t.nodes[name]
+	if !ok || name == "/" {
+		return
+	}
+
+	parent := t.nodes[path.Dir(name)]
+	for i, child := range parent.children {
+		if child == n {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			break
+		}
+	}
+	t.forget(name)
+}
+
+// forget removes the node name and everything below it from the index.
+func (t *Tree) forget(name string) {
+	n := t.nodes[name]
+	delete(t.nodes, name)
+	for _, child := range n.children {
+		t.forget(path.Join(name, child.Name))
+	}
+}
+
+// Lookup returns the node name, or nil if it does not exist.
+func (t *Tree) Lookup(name string) *Node {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.nodes[path.Clean("/"+name)]
+}
+
+// Children returns the entries of the directory name, in the order they are
+// listed.
+func (t *Tree) Children(name string) []*Node {
+	n := t.Lookup(name)
+	if n == nil {
+		return nil
+	}
+	return t.children(n)
+}
+
+func (t *Tree) children(n *Node) []*Node {
+	t.m.Lock()
+	children := append([]*Node(nil), n.children...)
+	t.m.Unlock()
+
+	if t.SortNames {
+		sort.Slice(children, func(i, j int) bool {
+			return children[i].Name < children[j].Name
+		})
+	}
+	return children
+}
+
+func (t *Tree) lookup(op, name string) (*Node, error) {
+	n := t.Lookup(name)
+	if n == nil {
+		return nil, pathError(op, name, os.ErrNotExist)
+	}
+	return n, nil
+}
+
+// Open opens a file or directory for reading.
+func (t *Tree) Open(name string) (fs.File, error) {
+	return t.OpenFile(name, fs.O_RDONLY, 0)
+}
+
+// OpenFile opens a file or directory for reading, only the flags O_RDONLY
+// and O_NOFOLLOW are supported. Symbolic links are never followed.
+func (t *Tree) OpenFile(name string, flag int, _ os.FileMode) (fs.File, error) {
+	if flag & ^(fs.O_RDONLY|fs.O_NOFOLLOW) != 0 {
+		return nil, pathError("open", name, errors.Errorf("invalid combination of flags 0x%x", flag))
+	}
+
+	n, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &file{t: t, n: n, name: name}
+	if n.Content == nil {
+		return f, nil
+	}
+
+	f.rd, err = n.Content()
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if _, ok := f.rd.(io.ReaderAt); ok {
+		return fileWithReaderAt{f}, nil
+	}
+	return f, nil
+}
+
+// Stat returns a FileInfo describing the named file. Symbolic links are not
+// resolved.
+func (t *Tree) Stat(name string) (os.FileInfo, error) {
+	return t.Lstat(name)
+}
+
+// Lstat returns the FileInfo structure describing the named file.
+func (t *Tree) Lstat(name string) (os.FileInfo, error) {
+	n, err := t.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{n}, nil
+}
+
+func pathError(op, name string, err error) *os.PathError {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// fileInfo describes a node of the tree.
+type fileInfo struct {
+	n *Node
+}
+
+func (fi fileInfo) Name() string       { return fi.n.Name }
+func (fi fileInfo) Size() int64        { return fi.n.Size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.n.Mode }
+func (fi fileInfo) ModTime() time.Time { return fi.n.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.n.Mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return fi.n.Meta }
+
+// file is an open node. The content of regular files is read from the reader
+// returned by the Content function of the node.
+type file struct {
+	t    *Tree
+	n    *Node
+	name string
+
+	rd io.Reader
+}
+
+// ensure that file implements fs.File
+var _ fs.File = &file{}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.rd == nil {
+		return 0, pathError("read", f.name, syscall.EISDIR)
+	}
+	n, err := f.rd.Read(p)
+	if err != nil && err != io.EOF {
+		err = pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.rd.(io.Seeker)
+	if !ok {
+		return 0, pathError("seek", f.name, syscall.ESPIPE)
+	}
+	pos, err := s.Seek(offset, whence)
+	if err != nil {
+		return pos, pathError("seek", f.name, err)
+	}
+	return pos, nil
+}
+
+func (f *file) Close() error {
+	if c, ok := f.rd.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (f *file) Fd() uintptr {
+	return 0
+}
+
+// Readdirnames returns the names of the entries in the directory.
+func (f *file) Readdirnames(n int) ([]string, error) {
+	entries, err := f.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// Readdir returns the entries in the directory. Only n <= 0 is supported.
+func (f *file) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.n.Mode.IsDir() {
+		return nil, pathError("readdir", f.name, syscall.ENOTDIR)
+	}
+	if n > 0 {
+		return nil, pathError("readdir", f.name, errors.New("not implemented"))
+	}
+
+	children := f.t.children(f.n)
+	entries := make([]os.FileInfo, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fileInfo{child})
+	}
+	return entries, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return fileInfo{f.n}, nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+// fileWithReaderAt is an open file whose content can be read at arbitrary
+// offsets.
+type fileWithReaderAt struct {
+	*file
+}
+
+// ensure that fileWithReaderAt implements fs.File
+var _ fs.File = fileWithReaderAt{}
+
+func (f fileWithReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return f.rd.(io.ReaderAt).ReadAt(p, off)
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"os"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+// Metadata describes a file on a file system which is not the local file
+// system. Such file systems return a *Metadata from the Sys() method of the
+// os.FileInfo values they return. The metadata is then used instead of
+// querying the local file system via stat(), readlink() and listxattr().
+type Metadata struct {
+	DeviceID uint64 // ID of device containing the file
+	Inode    uint64 // Inode number
+	Links    uint64 // Number of hard links
+	UID      uint32 // owner user ID
+	GID      uint32 // owner group ID
+	User     string // owner user name, if known
+	Group    string // owner group name, if known
+	Device   uint64 // Device ID (if this is a device file)
+
+	AccessTime time.Time // last access time stamp
+	ChangeTime time.Time // last status change time stamp
+
+	// LinkTarget is the target of a symbolic link.
+	LinkTarget string
+
+	// ExtendedAttributes holds the extended attributes of the file.
+	ExtendedAttributes []ExtendedAttribute
+}
+
+// ExtendedAttribute is a single extended attribute of a file.
+type ExtendedAttribute struct {
+	Name  string
+	Value []byte
+}
+
+// MetadataOf returns the Metadata stored in fi, if any.
+func MetadataOf(fi os.FileInfo) (*Metadata, bool) {
+	if fi == nil {
+		return nil, false
+	}
+	meta, ok := fi.Sys().(*Metadata)
+	return meta, ok && meta != nil
+}
+
+// extendedStat returns the ExtendedFileInfo for fi, which must contain
+// Metadata. The number of allocated blocks is unknown.
+func (meta *Metadata) extendedStat(fi os.FileInfo) ExtendedFileInfo {
+	return ExtendedFileInfo{
+		FileInfo: fi,
+		DeviceID: meta.DeviceID,
+		Inode:    meta.Inode,
+		Links:    meta.Links,
+		UID:      meta.UID,
+		GID:      meta.GID,
+		Device:   meta.Device,
+		Blocks:   -1,
+		Size:     fi.Size(),
+
+		AccessTime: meta.AccessTime,
+		ModTime:    fi.ModTime(),
+		ChangeTime: meta.ChangeTime,
+	}
+}
+
+// metadataInode returns the inode number and the number of links from meta.
+// File systems without inode numbers leave Inode unset.
+func metadataInode(meta *Metadata) (inode, links uint64, err error) {
+	if meta.Inode == 0 {
+		return 0, 0, errors.Wrap(ErrInodeNotSupported, "file system does not report inode numbers")
+	}
+	return meta.Inode, meta.Links, nil
+}
+
+// LocalPath returns the path of the file described by fi on the local file
+// system. File systems which present local files below a different path, e.g.
+// by combining several file systems, return os.FileInfo values with a
+// LocalPath method. For all other values, path is returned unchanged.
+func LocalPath(fi os.FileInfo, path string) string {
+	if lp, ok := fi.(interface{ LocalPath() string }); ok {
+		return lp.LocalPath()
+	}
+	return path
+}
@@ -0,0 +1,455 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+// Media types of the documents of an image.
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// layerMediaTypes contains the media types of the supported layers. The
+// compression of a layer is detected from its content.
+var layerMediaTypes = map[string]bool{
+	"application/vnd.oci.image.layer.v1.tar":                       true,
+	"application/vnd.oci.image.layer.v1.tar+gzip":                  true,
+	"application/vnd.oci.image.layer.v1.tar+zstd":                  true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar":      true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": true,
+	"application/vnd.docker.image.rootfs.diff.tar":                 true,
+	"application/vnd.docker.image.rootfs.diff.tar.gzip":            true,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    true,
+}
+
+// maxIndexDepth limits the nesting of image indexes.
+const maxIndexDepth = 4
+
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *platform `json:"platform,omitempty"`
+}
+
+type platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// parsePlatform parses a platform in the form os/arch[/variant].
+func parsePlatform(s string) (platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return platform{}, errors.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+	p := platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// matches returns true if p is compatible with the selected platform. The
+// variant is only compared if both specify one.
+func (p platform) matches(sel platform) bool {
+	if p.OS != sel.OS || p.Architecture != sel.Architecture {
+		return false
+	}
+	return p.Variant == "" || sel.Variant == "" || p.Variant == sel.Variant
+}
+
+type imageIndex struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+type imageManifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+type imageConfig struct {
+	platform
+}
+
+// dockerManifest is an entry of the manifest.json file written by docker
+// save.
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// layerBlob is the location of a layer within the image.
+type layerBlob struct {
+	name      string
+	mediaType string
+}
+
+// store provides access to the files of an OCI image layout or a docker
+// archive.
+type store interface {
+	// open returns the file name, relative to the root of the image.
+	open(name string) (io.ReaderAt, int64, error)
+	exists(name string) bool
+	close() error
+}
+
+// dirStore reads the files from an image layout directory.
+type dirStore struct {
+	dir   string
+	files map[string]*os.File
+}
+
+func newDirStore(dir string) *dirStore {
+	return &dirStore{dir: dir, files: make(map[string]*os.File)}
+}
+
+// localName returns the path of name within the directory, names which
+// refer to files outside of it are rejected.
+func (s *dirStore) localName(name string) (string, error) {
+	name = path.Clean(name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// open returns the file name. It is kept open until the store is closed, it
+// must not be called concurrently.
+func (s *dirStore) open(name string) (io.ReaderAt, int64, error) {
+	f, ok := s.files[name]
+	if !ok {
+		filename, err := s.localName(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		f, err = os.Open(filename)
+		if err != nil {
+			return nil, 0, err
+		}
+		s.files[name] = f
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (s *dirStore) exists(name string) bool {
+	filename, err := s.localName(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filename)
+	return err == nil
+}
+
+func (s *dirStore) close() error {
+	var err error
+	for _, f := range s.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// tarStore reads the files from an uncompressed tar archive, e.g. written by
+// docker save.
+type tarStore struct {
+	archive *os.File
+	members map[string]tarMember
+}
+
+type tarMember struct {
+	offset, size int64
+	// linkTarget is set for symlinks, docker save links identical layers
+	linkTarget string
+}
+
+// maxLinks limits the number of symlinks which are followed within the
+// archive.
+const maxLinks = 8
+
+func newTarStore(f *os.File) (*tarStore, error) {
+	s := &tarStore{archive: f, members: make(map[string]tarMember)}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "tar")
+		}
+
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, errors.Wrap(err, "Seek")
+			}
+			s.members[name] = tarMember{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			target := hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(name), target)
+			}
+			s.members[name] = tarMember{linkTarget: path.Clean(target)}
+		}
+	}
+	return s, nil
+}
+
+func (s *tarStore) lookup(name string) (tarMember, bool) {
+	for i := 0; i < maxLinks; i++ {
+		m, ok := s.members[path.Clean(name)]
+		if !ok || m.linkTarget == "" {
+			return m, ok
+		}
+		name = m.linkTarget
+	}
+	return tarMember{}, false
+}
+
+func (s *tarStore) open(name string) (io.ReaderAt, int64, error) {
+	m, ok := s.lookup(name)
+	if !ok {
+		return nil, 0, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return io.NewSectionReader(s.archive, m.offset, m.size), m.size, nil
+}
+
+func (s *tarStore) exists(name string) bool {
+	_, ok := s.lookup(name)
+	return ok
+}
+
+func (s *tarStore) close() error {
+	return s.archive.Close()
+}
+
+// readJSON decodes the file name of the image into v.
+func readJSON(s store, name string, v interface{}) error {
+	rd, size, err := s.open(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(io.NewSectionReader(rd, 0, size)).Decode(v); err != nil {
+		return errors.Wrap(err, name)
+	}
+	return nil
+}
+
+// blobName returns the path of the blob with the digest within an image
+// layout.
+func blobName(digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || !validDigestPart(alg) || !validDigestPart(hex) {
+		return "", errors.Errorf("invalid digest %q", digest)
+	}
+	return path.Join("blobs", alg, hex), nil
+}
+
+func validDigestPart(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return s != "." && s != ".."
+}
+
+// loadLayers returns the layers of the image in s, bottom-most first. For an
+// image layout the image is selected from index.json, for a docker archive
+// from manifest.json. If sel is not nil, the image must be for this platform.
+func loadLayers(s store, sel *platform) ([]layerBlob, error) {
+	if s.exists("oci-layout") && s.exists("index.json") {
+		var index imageIndex
+		if err := readJSON(s, "index.json", &index); err != nil {
+			return nil, err
+		}
+		desc, err := selectManifest(s, index, sel, 0)
+		if err != nil {
+			return nil, err
+		}
+		return loadManifest(s, desc, sel)
+	}
+
+	if s.exists("manifest.json") {
+		return loadDockerManifest(s, sel)
+	}
+
+	return nil, errors.New("neither an OCI image layout nor a docker archive, index.json and manifest.json are missing")
+}
+
+// selectManifest returns the descriptor of the image manifest within index.
+// Nested indexes are resolved, an index with images for several platforms
+// requires that a platform is selected.
+func selectManifest(s store, index imageIndex, sel *platform, depth int) (descriptor, error) {
+	if depth > maxIndexDepth {
+		return descriptor{}, errors.New("image indexes are nested too deeply")
+	}
+
+	var candidates []descriptor
+	var available []string
+	for _, desc := range index.Manifests {
+		if desc.Platform != nil {
+			if desc.Platform.OS == "unknown" {
+				// attestations are stored as manifests with an unknown platform
+				continue
+			}
+			available = append(available, desc.Platform.String())
+			if sel != nil && !desc.Platform.matches(*sel) {
+				continue
+			}
+		}
+		candidates = append(candidates, desc)
+	}
+
+	switch {
+	case len(candidates) == 0 && sel != nil:
+		return descriptor{}, errors.Errorf("the image is not available for platform %v (available: %v)", sel, strings.Join(available, ", "))
+	case len(candidates) == 0:
+		return descriptor{}, errors.New("the image index does not contain any images")
+	case len(candidates) > 1 && sel == nil && len(available) > 1:
+		return descriptor{}, errors.Errorf("the image is available for several platforms (%v), select one of them", strings.Join(available, ", "))
+	case len(candidates) > 1:
+		return descriptor{}, errors.Errorf("the image index contains %d matching images", len(candidates))
+	}
+
+	desc := candidates[0]
+	switch desc.MediaType {
+	case mediaTypeOCIManifest, mediaTypeDockerManifest:
+		return desc, nil
+	case mediaTypeOCIIndex, mediaTypeDockerList:
+		name, err := blobName(desc.Digest)
+		if err != nil {
+			return descriptor{}, err
+		}
+		var nested imageIndex
+		if err := readJSON(s, name, &nested); err != nil {
+			return descriptor{}, err
+		}
+		return selectManifest(s, nested, sel, depth+1)
+	default:
+		return descriptor{}, errors.Errorf("unsupported media type %q of manifest %v", desc.MediaType, desc.Digest)
+	}
+}
+
+// loadManifest returns the layers of the image manifest desc.
+func loadManifest(s store, desc descriptor, sel *platform) ([]layerBlob, error) {
+	name, err := blobName(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest imageManifest
+	if err := readJSON(s, name, &manifest); err != nil {
+		return nil, err
+	}
+
+	if sel != nil {
+		configName, err := blobName(manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPlatform(s, configName, *sel); err != nil {
+			return nil, err
+		}
+	}
+
+	layers := make([]layerBlob, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		if !layerMediaTypes[layer.MediaType] {
+			return nil, errors.Errorf("unsupported media type %q of layer %v", layer.MediaType, layer.Digest)
+		}
+		name, err := blobName(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !s.exists(name) {
+			return nil, errors.Errorf("layer %v is not contained in the image", layer.Digest)
+		}
+		layers = append(layers, layerBlob{name: name, mediaType: layer.MediaType})
+	}
+	return layers, nil
+}
+
+// loadDockerManifest returns the layers of the image in a docker archive.
+func loadDockerManifest(s store, sel *platform) ([]layerBlob, error) {
+	var manifests []dockerManifest
+	if err := readJSON(s, "manifest.json", &manifests); err != nil {
+		return nil, err
+	}
+
+	var candidates []dockerManifest
+	for _, m := range manifests {
+		if sel != nil {
+			if err := checkPlatform(s, m.Config, *sel); err != nil {
+				continue
+			}
+		}
+		candidates = append(candidates, m)
+	}
+
+	switch {
+	case len(candidates) == 0 && sel != nil:
+		return nil, errors.Errorf("the archive does not contain an image for platform %v", sel)
+	case len(candidates) == 0:
+		return nil, errors.New("the archive does not contain any images")
+	case len(candidates) > 1:
+		return nil, errors.Errorf("the archive contains %d images, select the platform of one of them", len(candidates))
+	}
+
+	layers := make([]layerBlob, 0, len(candidates[0].Layers))
+	for _, name := range candidates[0].Layers {
+		if !s.exists(name) {
+			return nil, errors.Errorf("layer %v is not contained in the archive", name)
+		}
+		layers = append(layers, layerBlob{name: name})
+	}
+	return layers, nil
+}
+
+// checkPlatform returns an error if the image with the config name is not
+// for the selected platform.
+func checkPlatform(s store, name string, sel platform) error {
+	var config imageConfig
+	if err := readJSON(s, name, &config); err != nil {
+		return err
+	}
+	if !config.matches(sel) {
+		return errors.Errorf("the image is for platform %v, not %v", config.platform, sel)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package ocifs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/restic/restic/internal/errors"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultOpenLayers is the default number of decompressed layer streams
+// which are kept open.
+const defaultOpenLayers = 4
+
+// layer is a layer tar of the image, which is possibly compressed.
+type layer struct {
+	name        string
+	data        io.ReaderAt
+	size        int64
+	compression string
+}
+
+// compression returns the name of the compression format detected from the
+// first bytes of a layer, or the empty string.
+func compression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	}
+	return ""
+}
+
+func newLayer(name string, data io.ReaderAt, size int64) *layer {
+	magic := make([]byte, 4)
+	n, _ := data.ReadAt(magic, 0)
+	return &layer{name: name, data: data, size: size, compression: compression(magic[:n])}
+}
+
+// open returns a stream of the uncompressed layer tar, positioned at the
+// start.
+func (l *layer) open() (*layerReader, error) {
+	src := io.NewSectionReader(l.data, 0, l.size)
+	switch l.compression {
+	case "gzip":
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, errors.Wrap(err, l.name)
+		}
+		return &layerReader{layer: l, rd: zr, close: func() { _ = zr.Close() }}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, l.name)
+		}
+		return &layerReader{layer: l, rd: zr, close: zr.Close}, nil
+	default:
+		return &layerReader{layer: l, rd: src, close: func() {}}, nil
+	}
+}
+
+// layerReader is a stream of an uncompressed layer tar, pos is the current
+// offset within the stream.
+type layerReader struct {
+	layer *layer
+	rd    io.Reader
+	close func()
+	pos   int64
+}
+
+func (r *layerReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+// layerCache keeps the streams of compressed layers open, so that the files
+// of a layer can be read without decompressing the layer from the start for
+// each of them. Only streams which are positioned before a file can be
+// reused, the least recently used streams are closed if there are more than
+// max of them.
+type layerCache struct {
+	max int
+
+	m      sync.Mutex
+	idle   []*layerReader
+	opened int
+}
+
+func newLayerCache(max int) *layerCache {
+	if max <= 0 {
+		max = defaultOpenLayers
+	}
+	return &layerCache{max: max}
+}
+
+// get returns a stream of l positioned at offset, data before offset is
+// skipped. The stream must be returned with put.
+func (c *layerCache) get(l *layer, offset int64) (*layerReader, error) {
+	c.m.Lock()
+	best := -1
+	for i, r := range c.idle {
+		if r.layer == l && r.pos <= offset && (best < 0 || r.pos > c.idle[best].pos) {
+			best = i
+		}
+	}
+
+	var r *layerReader
+	if best >= 0 {
+		r = c.idle[best]
+		c.idle = append(c.idle[:best], c.idle[best+1:]...)
+	} else {
+		c.opened++
+	}
+	c.m.Unlock()
+
+	if r == nil {
+		var err error
+		r, err = l.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.pos < offset {
+		if _, err := io.CopyN(io.Discard, r, offset-r.pos); err != nil {
+			r.close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, errors.Wrap(err, l.name)
+		}
+	}
+	return r, nil
+}
+
+// put returns the stream r to the cache.
+func (c *layerCache) put(r *layerReader) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.idle = append(c.idle, r)
+	if len(c.idle) > c.max {
+		c.idle[0].close()
+		c.idle = c.idle[1:]
+	}
+}
+
+// openedStreams returns how often a layer was decompressed from the start.
+func (c *layerCache) openedStreams() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.opened
+}
+
+// close closes all streams in the cache.
+func (c *layerCache) close() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, r := range c.idle {
+		r.close()
+	}
+	c.idle = nil
+}
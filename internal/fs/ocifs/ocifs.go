@@ -0,0 +1,319 @@
+// Package ocifs provides a read-only file system with the merged contents of
+// the layers of a container image, read from an OCI image layout or from an
+// archive written by docker save.
+package ocifs
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/fs/memfs"
+	"github.com/restic/restic/internal/fs/tarfs"
+)
+
+// Options configures how the image is read.
+type Options struct {
+	// Platform selects the image from an index with images for several
+	// platforms, in the form os/arch[/variant], e.g. linux/arm64/v8.
+	Platform string
+
+	// OpenLayers is the number of decompressed layer streams which are kept
+	// open while the files are read, the default is four.
+	OpenLayers int
+}
+
+// FS is a read-only file system which contains the files of a container
+// image. The layers are applied in order when the image is opened, whiteout
+// files remove the files of lower layers. The contents of files in
+// uncompressed layers are read from the layer directly, compressed layers
+// are decompressed again while the files are read.
+type FS struct {
+	*memfs.Tree
+
+	// layers is the index of the layer which added a node
+	layers map[*memfs.Node]int
+
+	store store
+	cache *layerCache
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// Names of whiteout files, see the OCI image specification.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutMeta   = ".wh..wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Open returns a file system with the files of the container image in
+// filename, which is either an OCI image layout directory or an uncompressed
+// tar archive, which contains an image layout or was written by docker save.
+func Open(filename string, opts Options) (*FS, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return newFS(newDirStore(filename), opts)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 4)
+	n, _ := f.ReadAt(magic, 0)
+	if compression(magic[:n]) != "" {
+		_ = f.Close()
+		return nil, errors.Errorf("%v is compressed, decompress the archive first", filename)
+	}
+
+	s, err := newTarStore(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return newFS(s, opts)
+}
+
+// newFS reads the image from s and applies its layers. The store is closed
+// if an error occurs.
+func newFS(s store, opts Options) (*FS, error) {
+	fsys := &FS{
+		Tree:   memfs.NewTree(),
+		layers: make(map[*memfs.Node]int),
+		store:  s,
+		cache:  newLayerCache(opts.OpenLayers),
+	}
+	fsys.layers[fsys.Lookup("/")] = -1
+
+	err := fsys.load(opts)
+	if err != nil {
+		_ = fsys.Close()
+		return nil, err
+	}
+	return fsys, nil
+}
+
+func (fsys *FS) load(opts Options) error {
+	var sel *platform
+	if opts.Platform != "" {
+		p, err := parsePlatform(opts.Platform)
+		if err != nil {
+			return err
+		}
+		sel = &p
+	}
+
+	blobs, err := loadLayers(fsys.store, sel)
+	if err != nil {
+		return err
+	}
+
+	for i, blob := range blobs {
+		data, size, err := fsys.store.open(blob.name)
+		if err != nil {
+			return err
+		}
+		if err := fsys.addLayer(i, newLayer(blob.name, data, size)); err != nil {
+			return errors.Wrap(err, blob.name)
+		}
+	}
+	return nil
+}
+
+// addLayer applies the entries of the layer tar l on top of the lower
+// layers.
+func (fsys *FS) addLayer(idx int, l *layer) error {
+	r, err := l.open()
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "tar")
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Dir(name), path.Base(name)
+		switch {
+		case base == whiteoutOpaque:
+			fsys.dir(dir, idx, hdr.ModTime)
+			fsys.opaque(dir, idx)
+			continue
+		case strings.HasPrefix(base, whiteoutMeta):
+			debug.Log("skipping whiteout metadata %v", hdr.Name)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			fsys.whiteout(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), idx)
+			continue
+		}
+
+		n, err := tarfs.NewNode(fsys.Tree, hdr)
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeGNUSparse {
+			if tarfs.IsSparse(hdr) {
+				return errors.Errorf("%v: sparse files are not supported", hdr.Name)
+			}
+			// the content starts at the current position of the stream
+			n.Content = fsys.content(l, r.pos, n.Size)
+		}
+
+		fsys.dir(dir, idx, hdr.ModTime)
+		fsys.layers[fsys.Put(name, n)] = idx
+	}
+
+	return nil
+}
+
+// whiteout removes the node name if it was added by a lower layer.
+func (fsys *FS) whiteout(name string, idx int) {
+	if n := fsys.Lookup(name); n != nil && fsys.layers[n] < idx {
+		fsys.Remove(name)
+	}
+}
+
+// opaque removes all nodes below the directory name which were added by
+// lower layers.
+func (fsys *FS) opaque(name string, idx int) {
+	for _, child := range fsys.Children(name) {
+		childName := path.Join(name, child.Name)
+		if fsys.layers[child] < idx {
+			fsys.Remove(childName)
+			continue
+		}
+		if child.Mode.IsDir() {
+			fsys.opaque(childName, idx)
+		}
+	}
+}
+
+// dir creates the directory name and its parents in the layer idx, if they
+// do not exist yet.
+func (fsys *FS) dir(name string, idx int, modTime time.Time) {
+	if n := fsys.Lookup(name); n != nil && n.Mode.IsDir() {
+		return
+	}
+
+	fsys.dir(path.Dir(name), idx, modTime)
+	n := &memfs.Node{
+		Mode:    os.ModeDir | 0755,
+		ModTime: modTime,
+		Meta:    fsys.NewMetadata(),
+	}
+	fsys.layers[fsys.Put(name, n)] = idx
+}
+
+// content returns a content function for the size bytes at offset in the
+// uncompressed layer tar l.
+func (fsys *FS) content(l *layer, offset, size int64) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		if l.compression == "" {
+			return io.NewSectionReader(l.data, offset, size), nil
+		}
+		return &layerContent{cache: fsys.cache, src: l, offset: offset, size: size}, nil
+	}
+}
+
+// Close closes the image and all open layer streams.
+func (fsys *FS) Close() error {
+	fsys.cache.close()
+	return fsys.store.close()
+}
+
+// Capabilities returns the features supported by the file system. The inode
+// numbers are assigned while the layers are applied, so that hard links
+// within the image can be detected.
+func (fsys *FS) Capabilities() fs.Capabilities {
+	return fs.CapXattrs | fs.CapDeviceIDs | fs.CapInodes
+}
+
+// layerContent is the content of a file in a compressed layer, which can
+// only be read sequentially. The stream of the layer is taken from the cache
+// on the first read and returned when the file is closed.
+type layerContent struct {
+	cache  *layerCache
+	rd     *layerReader
+	src    *layer
+	offset int64
+	size   int64
+	read   int64
+}
+
+func (c *layerContent) Read(p []byte) (int, error) {
+	if c.read >= c.size {
+		return 0, io.EOF
+	}
+
+	if c.rd == nil {
+		rd, err := c.cache.get(c.src, c.offset+c.read)
+		if err != nil {
+			return 0, err
+		}
+		c.rd = rd
+	}
+
+	if remaining := c.size - c.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := c.rd.Read(p)
+	c.read += int64(n)
+	if err == io.EOF {
+		// the layer tar ends with padding, so the file must end before
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.rd.close()
+		c.rd = nil
+		return n, err
+	}
+	return n, nil
+}
+
+// release returns the stream of the layer to the cache.
+func (c *layerContent) release() {
+	if c.rd != nil {
+		c.cache.put(c.rd)
+		c.rd = nil
+	}
+}
+
+// Seek only supports seeking to the start of the file.
+func (c *layerContent) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, syscall.ESPIPE
+	}
+	c.release()
+	c.read = 0
+	return 0, nil
+}
+
+func (c *layerContent) Close() error {
+	c.release()
+	return nil
+}
@@ -0,0 +1,467 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+var testTime = time.Unix(1600000000, 0).UTC()
+
+type testEntry struct {
+	name     string
+	typ      byte
+	mode     int64
+	uid, gid int
+	data     string
+	linkname string
+}
+
+func dirEntry(name string) testEntry {
+	return testEntry{name: name + "/", typ: tar.TypeDir, mode: 0755}
+}
+
+func fileEntry(name, data string) testEntry {
+	return testEntry{name: name, typ: tar.TypeReg, mode: 0644, data: data}
+}
+
+// writeLayer returns a layer tar with the entries, compressed with gzip or
+// zstd, or uncompressed if compression is empty.
+func writeLayer(t testing.TB, compression string, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		rtest.OK(t, err)
+		w = zw
+	default:
+		w = nopCloser{&buf}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		rtest.OK(t, tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Typeflag: e.typ,
+			Mode:     e.mode,
+			Uid:      e.uid,
+			Gid:      e.gid,
+			Size:     int64(len(e.data)),
+			Linkname: e.linkname,
+			ModTime:  testTime,
+			Format:   tar.FormatPAX,
+		}))
+		_, err := io.WriteString(tw, e.data)
+		rtest.OK(t, err)
+	}
+	rtest.OK(t, tw.Close())
+	rtest.OK(t, w.Close())
+	return buf.Bytes()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// testLayout writes an OCI image layout to a temporary directory.
+type testLayout struct {
+	t   testing.TB
+	dir string
+}
+
+func newTestLayout(t testing.TB) *testLayout {
+	l := &testLayout{t: t, dir: rtest.TempDir(t)}
+	rtest.OK(t, os.WriteFile(filepath.Join(l.dir, "oci-layout"), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644))
+	return l
+}
+
+func (l *testLayout) blob(mediaType string, data []byte) descriptor {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	rtest.OK(l.t, os.MkdirAll(filepath.Join(l.dir, "blobs", "sha256"), 0755))
+	rtest.OK(l.t, os.WriteFile(filepath.Join(l.dir, "blobs", "sha256", digest), data, 0644))
+	return descriptor{MediaType: mediaType, Digest: "sha256:" + digest, Size: int64(len(data))}
+}
+
+func (l *testLayout) json(mediaType string, v interface{}) descriptor {
+	buf, err := json.Marshal(v)
+	rtest.OK(l.t, err)
+	return l.blob(mediaType, buf)
+}
+
+// image writes the config and the manifest of an image with the layers.
+func (l *testLayout) image(p platform, layers ...descriptor) descriptor {
+	config := l.json("application/vnd.oci.image.config.v1+json", imageConfig{platform: p})
+	desc := l.json(mediaTypeOCIManifest, imageManifest{
+		MediaType: mediaTypeOCIManifest,
+		Config:    config,
+		Layers:    layers,
+	})
+	desc.Platform = &p
+	return desc
+}
+
+func (l *testLayout) index(manifests ...descriptor) {
+	buf, err := json.Marshal(imageIndex{MediaType: mediaTypeOCIIndex, Manifests: manifests})
+	rtest.OK(l.t, err)
+	rtest.OK(l.t, os.WriteFile(filepath.Join(l.dir, "index.json"), buf, 0644))
+}
+
+var linuxAMD64 = platform{OS: "linux", Architecture: "amd64"}
+
+// testImage returns an image layout with three layers, the upper layers
+// remove and replace the files of the lower ones.
+func testImage(t testing.TB) string {
+	l := newTestLayout(t)
+
+	owned := fileEntry("bin/sh", "shell")
+	owned.mode, owned.uid, owned.gid = 0755, 0, 10
+	home := fileEntry("home/user/file", "user file")
+	home.uid, home.gid = 1000, 1000
+
+	lower := l.blob("application/vnd.oci.image.layer.v1.tar", writeLayer(t, "",
+		dirEntry("bin"),
+		owned,
+		testEntry{name: "bin/sh-link", typ: tar.TypeLink, linkname: "bin/sh"},
+		testEntry{name: "bin/bash", typ: tar.TypeSymlink, mode: 0777, linkname: "sh"},
+		dirEntry("etc"),
+		fileEntry("etc/passwd", "root"),
+		fileEntry("etc/hosts", "hosts"),
+		dirEntry("var/lib/app"),
+		fileEntry("var/lib/app/a", "a"),
+		dirEntry("var/lib/app/sub"),
+		fileEntry("var/lib/app/sub/b", "b"),
+		fileEntry("usr/share/doc/readme", "readme"),
+	))
+	middle := l.blob("application/vnd.oci.image.layer.v1.tar+gzip", writeLayer(t, "gzip",
+		fileEntry("etc/.wh.hosts", ""),
+		fileEntry("etc/passwd", "root\nuser"),
+		dirEntry("var/lib/app"),
+		fileEntry("var/lib/app/.wh..wh..opq", ""),
+		fileEntry("var/lib/app/c", "c"),
+		home,
+	))
+	upper := l.blob("application/vnd.oci.image.layer.v1.tar+zstd", writeLayer(t, "zstd",
+		fileEntry("etc/hosts", "new hosts"),
+		fileEntry(".wh.usr", ""),
+		fileEntry("etc/.wh.missing", ""),
+		fileEntry(".wh..wh.plnk", ""),
+	))
+
+	l.index(l.image(linuxAMD64, lower, middle, upper))
+	return l.dir
+}
+
+func openFS(t testing.TB, filename string, opts Options) *FS {
+	fsys, err := Open(filename, opts)
+	rtest.OK(t, err)
+	t.Cleanup(func() {
+		rtest.OK(t, fsys.Close())
+	})
+	return fsys
+}
+
+func readFile(t testing.TB, fsys fs.FS, name string) string {
+	f, err := fsys.Open(name)
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return string(buf)
+}
+
+func readDir(t testing.TB, fsys fs.FS, name string) []string {
+	f, err := fsys.Open(name)
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return names
+}
+
+func TestLayers(t *testing.T) {
+	fsys := openFS(t, testImage(t), Options{})
+
+	rtest.Equals(t, []string{"bin", "etc", "var", "home"}, readDir(t, fsys, "/"))
+	rtest.Equals(t, []string{"passwd", "hosts"}, readDir(t, fsys, "/etc"))
+	rtest.Equals(t, "root\nuser", readFile(t, fsys, "/etc/passwd"))
+	rtest.Equals(t, "new hosts", readFile(t, fsys, "/etc/hosts"))
+
+	// the opaque directory only contains the entries of the upper layer
+	rtest.Equals(t, []string{"c"}, readDir(t, fsys, "/var/lib/app"))
+	_, err := fsys.Lstat("/var/lib/app/sub/b")
+	rtest.Assert(t, os.IsNotExist(err), "unexpected error %v", err)
+	_, err = fsys.Lstat("/usr/share/doc/readme")
+	rtest.Assert(t, os.IsNotExist(err), "unexpected error %v", err)
+
+	fi, err := fsys.Lstat("/bin/sh")
+	rtest.OK(t, err)
+	rtest.Equals(t, os.FileMode(0755), fi.Mode())
+	rtest.Equals(t, int64(len("shell")), fi.Size())
+	rtest.Assert(t, fi.ModTime().Equal(testTime), "wrong mtime %v", fi.ModTime())
+	meta := fi.Sys().(*fs.Metadata)
+	rtest.Equals(t, uint32(10), meta.GID)
+	rtest.Equals(t, uint64(2), meta.Links)
+
+	fi, err = fsys.Lstat("/bin/sh-link")
+	rtest.OK(t, err)
+	rtest.Equals(t, meta.Inode, fi.Sys().(*fs.Metadata).Inode)
+	rtest.Equals(t, "shell", readFile(t, fsys, "/bin/sh-link"))
+
+	fi, err = fsys.Lstat("/bin/bash")
+	rtest.OK(t, err)
+	rtest.Equals(t, "sh", fi.Sys().(*fs.Metadata).LinkTarget)
+
+	fi, err = fsys.Lstat("/home/user/file")
+	rtest.OK(t, err)
+	rtest.Equals(t, uint32(1000), fi.Sys().(*fs.Metadata).UID)
+
+	// only files in uncompressed layers can be read at arbitrary offsets
+	f, err := fsys.Open("/bin/sh")
+	rtest.OK(t, err)
+	_, ok := fs.ReaderAt(f)
+	rtest.Assert(t, ok, "file in uncompressed layer does not implement io.ReaderAt")
+	rtest.OK(t, f.Close())
+
+	f, err = fsys.Open("/etc/passwd")
+	rtest.OK(t, err)
+	_, ok = fs.ReaderAt(f)
+	rtest.Assert(t, !ok, "file in compressed layer implements io.ReaderAt")
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(f, buf)
+	rtest.OK(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	rtest.OK(t, err)
+	rest, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.Equals(t, "root\nuser", string(rest))
+	_, err = f.Seek(2, io.SeekStart)
+	rtest.Assert(t, err != nil, "expected error for seeking within file in compressed layer")
+	rtest.OK(t, f.Close())
+}
+
+func TestLayerCache(t *testing.T) {
+	l := newTestLayout(t)
+	var entries []testEntry
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		names = append(names, name)
+		entries = append(entries, fileEntry(name, strings.Repeat(name, 1000+i)))
+	}
+	layer := l.blob("application/vnd.oci.image.layer.v1.tar+gzip", writeLayer(t, "gzip", entries...))
+	l.index(l.image(linuxAMD64, layer))
+
+	fsys := openFS(t, l.dir, Options{OpenLayers: 1})
+
+	// reading the files in the order of the layer reuses the stream
+	for _, e := range entries {
+		rtest.Equals(t, e.data, readFile(t, fsys, "/"+e.name))
+	}
+	rtest.Equals(t, 1, fsys.cache.openedStreams())
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		rtest.Equals(t, entries[i].data, readFile(t, fsys, "/"+entries[i].name))
+	}
+
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		e := e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtest.Equals(t, e.data, readFile(t, fsys, "/"+e.name))
+		}()
+	}
+	wg.Wait()
+
+	rtest.Assert(t, len(fsys.cache.idle) <= 1, "too many open streams: %d", len(fsys.cache.idle))
+	rtest.Equals(t, names, readDir(t, fsys, "/"))
+}
+
+func TestPlatforms(t *testing.T) {
+	l := newTestLayout(t)
+	amd64 := l.image(linuxAMD64, l.blob("application/vnd.oci.image.layer.v1.tar", writeLayer(t, "", fileEntry("arch", "amd64"))))
+	arm64 := l.image(platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		l.blob("application/vnd.oci.image.layer.v1.tar", writeLayer(t, "", fileEntry("arch", "arm64"))))
+	attestation := l.image(platform{OS: "unknown", Architecture: "unknown"})
+	nested := l.json(mediaTypeOCIIndex, imageIndex{
+		MediaType: mediaTypeOCIIndex,
+		Manifests: []descriptor{amd64, arm64, attestation},
+	})
+	l.index(nested)
+
+	_, err := Open(l.dir, Options{})
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "linux/amd64, linux/arm64/v8"), "unexpected error %v", err)
+
+	for _, test := range []struct {
+		platform, arch string
+	}{
+		{"linux/amd64", "amd64"},
+		{"linux/arm64", "arm64"},
+		{"linux/arm64/v8", "arm64"},
+	} {
+		fsys := openFS(t, l.dir, Options{Platform: test.platform})
+		rtest.Equals(t, test.arch, readFile(t, fsys, "/arch"))
+	}
+
+	for _, p := range []string{"windows/amd64", "linux/arm64/v7", "linux"} {
+		_, err = Open(l.dir, Options{Platform: p})
+		rtest.Assert(t, err != nil, "expected error for platform %v", p)
+	}
+
+	// an image without a platform in the index is checked against the
+	// platform of its config
+	amd64.Platform = nil
+	l.index(amd64)
+	_, err = Open(l.dir, Options{Platform: "linux/arm64"})
+	rtest.Assert(t, err != nil, "expected error for wrong platform")
+	openFS(t, l.dir, Options{Platform: "linux/amd64"})
+}
+
+func TestMediaTypes(t *testing.T) {
+	l := newTestLayout(t)
+	layer := l.blob("application/vnd.oci.image.layer.v1.tar", writeLayer(t, "", fileEntry("file", "data")))
+
+	image := l.image(linuxAMD64, layer)
+	image.MediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	l.index(image)
+	_, err := Open(l.dir, Options{})
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "unsupported media type"), "unexpected error %v", err)
+
+	encrypted := layer
+	encrypted.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"
+	l.index(l.image(linuxAMD64, encrypted))
+	_, err = Open(l.dir, Options{})
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "unsupported media type"), "unexpected error %v", err)
+
+	missing := layer
+	missing.Digest = "sha256:" + strings.Repeat("0", 64)
+	l.index(l.image(linuxAMD64, missing))
+	_, err = Open(l.dir, Options{})
+	rtest.Assert(t, err != nil, "expected error for missing layer")
+
+	invalid := layer
+	invalid.Digest = "sha256:../../oci-layout"
+	l.index(l.image(linuxAMD64, invalid))
+	_, err = Open(l.dir, Options{})
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "invalid digest"), "unexpected error %v", err)
+}
+
+// writeDockerArchive writes an archive in the format of docker save, the
+// second layer is a symlink to the first one.
+func writeDockerArchive(t testing.TB, filename string) {
+	f, err := os.Create(filename)
+	rtest.OK(t, err)
+	tw := tar.NewWriter(f)
+
+	add := func(name string, data []byte) {
+		rtest.OK(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: testTime}))
+		_, err := tw.Write(data)
+		rtest.OK(t, err)
+	}
+
+	manifest, err := json.Marshal([]dockerManifest{{
+		Config:   "config.json",
+		RepoTags: []string{"example:latest"},
+		Layers:   []string{"a/layer.tar", "b/layer.tar", "c/layer.tar"},
+	}})
+	rtest.OK(t, err)
+	config, err := json.Marshal(imageConfig{platform: linuxAMD64})
+	rtest.OK(t, err)
+
+	add("a/layer.tar", writeLayer(t, "", fileEntry("etc/os-release", "base"), fileEntry("etc/motd", "hello")))
+	rtest.OK(t, tw.WriteHeader(&tar.Header{Name: "b/layer.tar", Typeflag: tar.TypeSymlink, Linkname: "../a/layer.tar", ModTime: testTime}))
+	add("c/layer.tar", writeLayer(t, "", fileEntry("etc/.wh.motd", "")))
+	add("config.json", config)
+	add("manifest.json", manifest)
+
+	rtest.OK(t, tw.Close())
+	rtest.OK(t, f.Close())
+}
+
+func TestDockerArchive(t *testing.T) {
+	filename := filepath.Join(rtest.TempDir(t), "image.tar")
+	writeDockerArchive(t, filename)
+
+	fsys := openFS(t, filename, Options{})
+	rtest.Equals(t, []string{"os-release"}, readDir(t, fsys, "/etc"))
+	rtest.Equals(t, "base", readFile(t, fsys, "/etc/os-release"))
+
+	_, err := Open(filename, Options{Platform: "linux/s390x"})
+	rtest.Assert(t, err != nil, "expected error for wrong platform")
+
+	// compressed archives cannot be read at arbitrary offsets
+	data, err := os.ReadFile(filename)
+	rtest.OK(t, err)
+	compressed := filepath.Join(filepath.Dir(filename), "image.tar.gz")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(data)
+	rtest.OK(t, err)
+	rtest.OK(t, zw.Close())
+	rtest.OK(t, os.WriteFile(compressed, buf.Bytes(), 0644))
+	_, err = Open(compressed, Options{})
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "compressed"), "unexpected error %v", err)
+}
+
+func TestArchiver(t *testing.T) {
+	fsys := openFS(t, testImage(t), Options{})
+	repo := repository.TestRepository(t)
+
+	arch := archiver.New(repo, fsys, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+
+	tree := loadTree(t, repo, *sn.Tree, "etc")
+	rtest.Equals(t, 2, len(tree.Nodes))
+	hosts := tree.Find("hosts")
+	rtest.Equals(t, uint64(len("new hosts")), hosts.Size)
+	rtest.Assert(t, hosts.ModTime.Equal(testTime), "wrong mtime %v", hosts.ModTime)
+
+	tree = loadTree(t, repo, *sn.Tree, "bin")
+	sh := tree.Find("sh")
+	rtest.Equals(t, uint32(10), sh.GID)
+	rtest.Equals(t, os.FileMode(0755), sh.Mode)
+	rtest.Equals(t, "symlink", tree.Find("bash").Type)
+
+	tree = loadTree(t, repo, *sn.Tree, "home", "user")
+	rtest.Equals(t, uint32(1000), tree.Find("file").UID)
+}
+
+func loadTree(t testing.TB, repo restic.Repository, id restic.ID, dirs ...string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, dir := range dirs {
+		node := tree.Find(dir)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", dir)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
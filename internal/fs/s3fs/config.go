@@ -0,0 +1,93 @@
+package s3fs
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/options"
+)
+
+// Config contains all information required to read objects from an S3
+// compatible server.
+type Config struct {
+	Endpoint string
+	UseHTTP  bool
+	KeyID    string
+	Secret   options.SecretString
+	Bucket   string
+
+	Region       string `option:"region" help:"set region"`
+	BucketLookup string `option:"bucket-lookup" help:"bucket lookup style: 'auto', 'dns', or 'path'"`
+	MaxRetries   uint   `option:"retries" help:"set the number of retries attempted"`
+}
+
+func init() {
+	options.Register("s3-source", Config{})
+}
+
+const prefix = "s3:"
+
+// IsTarget returns true if s describes objects in an S3 bucket, e.g.
+// s3:host/bucket/prefix.
+func IsTarget(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// ParseTarget parses a target and returns the configuration for the server
+// and the path of the target within the bucket. The same formats as for the
+// s3 backend are supported: s3:host/bucket/prefix, s3://host/bucket/prefix
+// and s3:https://host/bucket/prefix. The returned path is absolute, the root
+// directory "/" is the whole bucket.
+func ParseTarget(s string) (Config, string, error) {
+	var endpoint, rest string
+	var useHTTP bool
+
+	switch {
+	case strings.HasPrefix(s, "s3:http"):
+		u, err := url.Parse(s[3:])
+		if err != nil {
+			return Config{}, "", errors.WithStack(err)
+		}
+		endpoint, rest = u.Host, strings.TrimPrefix(u.Path, "/")
+		useHTTP = u.Scheme == "http"
+	case strings.HasPrefix(s, "s3://"):
+		endpoint, rest, _ = strings.Cut(s[5:], "/")
+	case strings.HasPrefix(s, prefix):
+		endpoint, rest, _ = strings.Cut(s[3:], "/")
+	default:
+		return Config{}, "", errors.Errorf("invalid target %q, does not start with %q", s, prefix)
+	}
+
+	bucket, key, _ := strings.Cut(rest, "/")
+	if endpoint == "" || bucket == "" {
+		return Config{}, "", errors.Errorf("invalid target %q, host/region or bucket name not found", s)
+	}
+
+	cfg := Config{
+		Endpoint: endpoint,
+		UseHTTP:  useHTTP,
+		Bucket:   bucket,
+	}
+	return cfg, path.Clean("/" + key), nil
+}
+
+// SameBucket returns true if both configurations describe the same bucket.
+func (cfg Config) SameBucket(other Config) bool {
+	return cfg.Endpoint == other.Endpoint && cfg.UseHTTP == other.UseHTTP && cfg.Bucket == other.Bucket
+}
+
+// ApplyEnvironment saves values from the environment to the config.
+func (cfg *Config) ApplyEnvironment(prefix string) {
+	if cfg.KeyID == "" {
+		cfg.KeyID = os.Getenv(prefix + "AWS_ACCESS_KEY_ID")
+	}
+	if cfg.Secret.String() == "" {
+		cfg.Secret = options.NewSecretString(os.Getenv(prefix + "AWS_SECRET_ACCESS_KEY"))
+	}
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv(prefix + "AWS_DEFAULT_REGION")
+	}
+}
@@ -0,0 +1,63 @@
+package s3fs
+
+import (
+	"testing"
+
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestParseTarget(t *testing.T) {
+	var tests = []struct {
+		s   string
+		cfg Config
+		dir string
+	}{
+		{
+			s:   "s3:s3.amazonaws.com/bucket",
+			cfg: Config{Endpoint: "s3.amazonaws.com", Bucket: "bucket"},
+			dir: "/",
+		},
+		{
+			s:   "s3:s3.amazonaws.com/bucket/",
+			cfg: Config{Endpoint: "s3.amazonaws.com", Bucket: "bucket"},
+			dir: "/",
+		},
+		{
+			s:   "s3://eu-central-1/bucket/prefix/dir/",
+			cfg: Config{Endpoint: "eu-central-1", Bucket: "bucket"},
+			dir: "/prefix/dir",
+		},
+		{
+			s:   "s3:https://hostname:9999/bucket/prefix/../other",
+			cfg: Config{Endpoint: "hostname:9999", Bucket: "bucket"},
+			dir: "/other",
+		},
+		{
+			s:   "s3:http://hostname:9999/bucket/file",
+			cfg: Config{Endpoint: "hostname:9999", UseHTTP: true, Bucket: "bucket"},
+			dir: "/file",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			cfg, dir, err := ParseTarget(test.s)
+			rtest.OK(t, err)
+			rtest.Equals(t, test.cfg, cfg)
+			rtest.Equals(t, test.dir, dir)
+		})
+	}
+}
+
+func TestParseTargetInvalid(t *testing.T) {
+	for _, s := range []string{
+		"/local/dir",
+		"s3:",
+		"s3:hostname",
+		"s3:hostname/",
+		"s3:https://hostname",
+	} {
+		_, _, err := ParseTarget(s)
+		rtest.Assert(t, err != nil, "expected error for %q", s)
+	}
+}
@@ -0,0 +1,575 @@
+package s3fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// FS is a read-only file system which presents the objects in an S3 bucket.
+// Object keys are split at slashes, the common prefixes of the keys are
+// directories and the bucket itself is the root directory "/".
+//
+// Zero-byte objects with a trailing slash ("directory markers", as created
+// by many S3 clients) are not presented as files, but provide the
+// modification time of the directory. Directories without a marker have the
+// modification time of the Unix epoch.
+type FS struct {
+	fs.SlashPaths
+
+	ctx    context.Context
+	client *minio.Client
+	bucket string
+
+	// listings caches the files found by Readdir, so that the following
+	// calls to Lstat for the directory entries do not need a request each.
+	listings *lru.Cache[string, map[string]os.FileInfo]
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// listingCacheSize is the number of directory listings kept in the cache.
+const listingCacheSize = 32
+
+// dirModTime is the modification time of directories without a marker
+// object.
+var dirModTime = time.Unix(0, 0).UTC()
+
+// Names of the extended attributes used to store the object metadata.
+const (
+	AttributeETag         = "user.s3.etag"
+	AttributeStorageClass = "user.s3.storage-class"
+)
+
+// Open returns a file system for the bucket described by cfg. All requests
+// are sent with ctx, as the methods of fs.FS do not take a context.
+func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (*FS, error) {
+	debug.Log("open, config %#v", cfg)
+
+	if cfg.KeyID == "" && cfg.Secret.String() != "" {
+		return nil, errors.Fatalf("unable to open S3 bucket: Key ID ($AWS_ACCESS_KEY_ID) is empty")
+	} else if cfg.KeyID != "" && cfg.Secret.String() == "" {
+		return nil, errors.Fatalf("unable to open S3 bucket: Secret ($AWS_SECRET_ACCESS_KEY) is empty")
+	}
+
+	if cfg.MaxRetries > 0 {
+		minio.MaxRetry = int(cfg.MaxRetries)
+	}
+
+	// use the same credential sources as the s3 backend
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.Static{
+			Value: credentials.Value{
+				AccessKeyID:     cfg.KeyID,
+				SecretAccessKey: cfg.Secret.Unwrap(),
+			},
+		},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.FileMinioClient{},
+		&credentials.IAM{
+			Client: &http.Client{
+				Transport: http.DefaultTransport,
+			},
+		},
+	})
+
+	options := &minio.Options{
+		Creds:     creds,
+		Secure:    !cfg.UseHTTP,
+		Region:    cfg.Region,
+		Transport: rt,
+	}
+
+	switch strings.ToLower(cfg.BucketLookup) {
+	case "", "auto":
+		options.BucketLookup = minio.BucketLookupAuto
+	case "dns":
+		options.BucketLookup = minio.BucketLookupDNS
+	case "path":
+		options.BucketLookup = minio.BucketLookupPath
+	default:
+		return nil, fmt.Errorf(`bad bucket-lookup style %q must be "auto", "path" or "dns"`, cfg.BucketLookup)
+	}
+
+	client, err := minio.New(cfg.Endpoint, options)
+	if err != nil {
+		return nil, errors.Wrap(err, "minio.New")
+	}
+
+	listings, err := lru.New[string, map[string]os.FileInfo](listingCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FS{
+		ctx:      ctx,
+		client:   client,
+		bucket:   cfg.Bucket,
+		listings: listings,
+	}, nil
+}
+
+// Close releases the resources of the file system.
+func (sfs *FS) Close() error {
+	sfs.listings.Purge()
+	return nil
+}
+
+// objectKey returns the object key for the absolute path name. The key for
+// the root directory is the empty string.
+func objectKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// dirPrefix returns the prefix of all objects in the directory name.
+func dirPrefix(name string) string {
+	key := objectKey(name)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func isNotExist(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// pathError wraps err in an *os.PathError. Missing objects are reported as
+// os.ErrNotExist, denied requests as os.ErrPermission. Errors which occur
+// before the server has answered (after all retries) are reported as
+// ENOTCONN, so that the archiver treats them as fatal.
+func pathError(op, name string, err error) error {
+	var ue *url.Error
+	switch {
+	case isNotExist(err):
+		err = os.ErrNotExist
+	case minio.ToErrorResponse(err).Code == "AccessDenied":
+		err = os.ErrPermission
+	case errors.As(err, &ue):
+		err = syscall.ENOTCONN
+	}
+
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// Capabilities returns the features supported by the file system. S3 reports
+// modification times with a resolution of one second.
+func (sfs *FS) Capabilities() fs.Capabilities {
+	return fs.CapXattrs | fs.CapSecondsOnlyMtime
+}
+
+// Open opens a file or directory for reading.
+func (sfs *FS) Open(name string) (fs.File, error) {
+	return sfs.OpenFile(name, fs.O_RDONLY, 0)
+}
+
+// OpenFile opens a file or directory for reading, only the flags O_RDONLY and
+// O_NOFOLLOW are supported.
+func (sfs *FS) OpenFile(name string, flag int, _ os.FileMode) (fs.File, error) {
+	if flag & ^(fs.O_RDONLY|fs.O_NOFOLLOW) != 0 {
+		return nil, pathError("open", name,
+			fmt.Errorf("invalid combination of flags 0x%x", flag))
+	}
+
+	fi, err := sfs.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return &dir{fs: sfs, name: name, fi: fi}, nil
+	}
+	return &file{fs: sfs, name: name, key: objectKey(name), fi: fi.(*fileInfo)}, nil
+}
+
+// Stat returns a FileInfo describing the named file. As there are no
+// symbolic links, this is the same as Lstat.
+func (sfs *FS) Stat(name string) (os.FileInfo, error) {
+	return sfs.Lstat(name)
+}
+
+// Lstat returns the FileInfo structure describing the named file. If an
+// object with the key exists, name is a file. Otherwise name is a directory
+// if there is a marker object for it or any object with the prefix name/.
+func (sfs *FS) Lstat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	if m, ok := sfs.listings.Get(path.Dir(name)); ok {
+		if fi, ok := m[path.Base(name)]; ok {
+			return fi, nil
+		}
+	}
+
+	key := objectKey(name)
+	if key == "" {
+		return newDirInfo("/", dirModTime), nil
+	}
+
+	oi, err := sfs.client.StatObject(sfs.ctx, sfs.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return newFileInfo(path.Base(name), oi), nil
+	}
+	if !isNotExist(err) {
+		return nil, pathError("lstat", name, err)
+	}
+
+	oi, err = sfs.client.StatObject(sfs.ctx, sfs.bucket, key+"/", minio.StatObjectOptions{})
+	if err == nil {
+		return newDirInfo(path.Base(name), oi.LastModified), nil
+	}
+	if !isNotExist(err) {
+		return nil, pathError("lstat", name, err)
+	}
+
+	ctx, cancel := context.WithCancel(sfs.ctx)
+	defer cancel()
+	for obj := range sfs.client.ListObjects(ctx, sfs.bucket, minio.ListObjectsOptions{Prefix: key + "/", MaxKeys: 1}) {
+		if obj.Err != nil {
+			return nil, pathError("lstat", name, obj.Err)
+		}
+		return newDirInfo(path.Base(name), dirModTime), nil
+	}
+
+	return nil, pathError("lstat", name, os.ErrNotExist)
+}
+
+// readdir lists all objects and common prefixes in the directory name. The
+// listing is paginated by the client. Entries with names which cannot be
+// represented in a directory (e.g. from keys containing "//") are skipped.
+// If both an object and a common prefix have the same name, the object is
+// returned, matching Lstat.
+func (sfs *FS) readdir(name string) ([]os.FileInfo, error) {
+	prefix := dirPrefix(name)
+
+	ctx, cancel := context.WithCancel(sfs.ctx)
+	defer cancel()
+
+	var entries []os.FileInfo
+	index := make(map[string]int)
+	files := make(map[string]os.FileInfo)
+	for obj := range sfs.client.ListObjects(ctx, sfs.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, pathError("readdir", name, obj.Err)
+		}
+		if obj.Key == prefix {
+			// the marker object of the directory itself
+			continue
+		}
+
+		entry := strings.TrimPrefix(obj.Key, prefix)
+		isDir := strings.HasSuffix(entry, "/")
+		entry = strings.TrimSuffix(entry, "/")
+		if entry == "" || entry == "." || entry == ".." || strings.Contains(entry, "/") {
+			debug.Log("skipping object %q in %v, invalid name", obj.Key, name)
+			continue
+		}
+
+		var fi os.FileInfo
+		if isDir {
+			// the modification time is found by Lstat
+			fi = newDirInfo(entry, dirModTime)
+		} else {
+			fi = newFileInfo(entry, obj)
+			files[entry] = fi
+		}
+
+		if i, ok := index[entry]; ok {
+			if !isDir {
+				entries[i] = fi
+			}
+			continue
+		}
+		index[entry] = len(entries)
+		entries = append(entries, fi)
+	}
+
+	sfs.listings.Add(path.Clean(name), files)
+	return entries, nil
+}
+
+// fileInfo describes an object or a directory.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	etag    string
+	meta    *fs.Metadata
+}
+
+// newFileInfo returns the information for an object. The modification time
+// is truncated to seconds, as listings report milliseconds but HEAD requests
+// only seconds.
+func newFileInfo(name string, oi minio.ObjectInfo) *fileInfo {
+	modTime := oi.LastModified.Truncate(time.Second)
+
+	storageClass := oi.StorageClass
+	if storageClass == "" {
+		storageClass = "STANDARD"
+	}
+
+	meta := &fs.Metadata{
+		AccessTime: modTime,
+		ChangeTime: modTime,
+	}
+	if oi.ETag != "" {
+		meta.ExtendedAttributes = append(meta.ExtendedAttributes,
+			fs.ExtendedAttribute{Name: AttributeETag, Value: []byte(oi.ETag)})
+	}
+	meta.ExtendedAttributes = append(meta.ExtendedAttributes,
+		fs.ExtendedAttribute{Name: AttributeStorageClass, Value: []byte(storageClass)})
+
+	return &fileInfo{
+		name:    name,
+		size:    oi.Size,
+		mode:    0644,
+		modTime: modTime,
+		etag:    oi.ETag,
+		meta:    meta,
+	}
+}
+
+func newDirInfo(name string, modTime time.Time) *fileInfo {
+	modTime = modTime.Truncate(time.Second)
+	return &fileInfo{
+		name:    name,
+		mode:    os.ModeDir | 0755,
+		modTime: modTime,
+		meta: &fs.Metadata{
+			AccessTime: modTime,
+			ChangeTime: modTime,
+		},
+	}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.meta }
+
+// file is an object opened for reading. The content is streamed with a
+// single request for sequential reads, ReadAt sends a range request per
+// call. All requests only succeed if the object has not been modified since
+// it was opened.
+type file struct {
+	fs   *FS
+	name string
+	key  string
+	fi   *fileInfo
+
+	m   sync.Mutex
+	rd  io.ReadCloser
+	pos int64
+}
+
+// ensure that file implements fs.File and io.ReaderAt
+var _ fs.File = &file{}
+var _ io.ReaderAt = &file{}
+
+// get requests the content of the object from start to end (inclusive). If
+// end is negative, the content up to the end of the object is returned.
+func (f *file) get(start, end int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if f.fi.etag != "" {
+		if err := opts.SetMatchETag(f.fi.etag); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	switch {
+	case end >= 0:
+		err = opts.SetRange(start, end)
+	case start > 0:
+		err = opts.SetRange(start, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.fs.client.GetObject(f.fs.ctx, f.fs.bucket, f.key, opts)
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.pos >= f.fi.size {
+		return 0, io.EOF
+	}
+
+	if f.rd == nil {
+		rd, err := f.get(f.pos, -1)
+		if err != nil {
+			return 0, pathError("read", f.name, err)
+		}
+		f.rd = rd
+	}
+
+	n, err := f.rd.Read(p)
+	f.pos += int64(n)
+	if err != nil && err != io.EOF {
+		return n, pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at offset off with a range request.
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.fi.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if remaining := f.fi.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+	if len(p) == 0 {
+		return 0, eof
+	}
+
+	rd, err := f.get(off, off+int64(len(p))-1)
+	if err != nil {
+		return 0, pathError("read", f.name, err)
+	}
+	n, err := io.ReadFull(rd, p)
+	_ = rd.Close()
+	if err != nil {
+		return n, pathError("read", f.name, err)
+	}
+	return n, eof
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	pos := f.pos
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos += offset
+	case io.SeekEnd:
+		pos = f.fi.size + offset
+	}
+	if pos < 0 {
+		return 0, pathError("seek", f.name, syscall.EINVAL)
+	}
+
+	if pos != f.pos && f.rd != nil {
+		_ = f.rd.Close()
+		f.rd = nil
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *file) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.rd == nil {
+		return nil
+	}
+	err := f.rd.Close()
+	f.rd = nil
+	return err
+}
+
+func (f *file) Fd() uintptr {
+	return 0
+}
+
+func (f *file) Readdirnames(_ int) ([]string, error) {
+	return nil, pathError("readdirnames", f.name, syscall.ENOTDIR)
+}
+
+func (f *file) Readdir(_ int) ([]os.FileInfo, error) {
+	return nil, pathError("readdir", f.name, syscall.ENOTDIR)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+// dir is a directory in the bucket. The entries are listed when Readdir or
+// Readdirnames is called.
+type dir struct {
+	fs   *FS
+	name string
+	fi   os.FileInfo
+}
+
+// ensure that dir implements fs.File
+var _ fs.File = &dir{}
+
+func (d *dir) Read(_ []byte) (int, error) {
+	return 0, pathError("read", d.name, syscall.EISDIR)
+}
+
+func (d *dir) Seek(int64, int) (int64, error) {
+	return 0, pathError("seek", d.name, syscall.EISDIR)
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Fd() uintptr {
+	return 0
+}
+
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	entries, err := d.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// Readdir returns the entries of the directory in the order the server sent
+// them. Only n <= 0 is supported.
+func (d *dir) Readdir(n int) ([]os.FileInfo, error) {
+	if n > 0 {
+		return nil, pathError("readdir", d.name, errors.New("not implemented"))
+	}
+	return d.fs.readdir(d.name)
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
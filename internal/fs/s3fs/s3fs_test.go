@@ -0,0 +1,427 @@
+package s3fs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/options"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+type testObject struct {
+	data         []byte
+	modTime      time.Time
+	storageClass string
+}
+
+func (o testObject) etag() string {
+	sum := md5.Sum(o.data)
+	return hex.EncodeToString(sum[:])
+}
+
+// testServer implements the parts of the S3 API used by FS for a single
+// bucket. Listings return at most pageSize entries per request.
+type testServer struct {
+	bucket   string
+	pageSize int
+
+	m       sync.Mutex
+	objects map[string]testObject
+	heads   int
+}
+
+type listContents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	Delimiter             string
+	IsTruncated           bool
+	NextContinuationToken string         `xml:",omitempty"`
+	Contents              []listContents `xml:",omitempty"`
+	CommonPrefixes        []listPrefix   `xml:",omitempty"`
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r.URL.Query())
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		s.get(w, r, key)
+	default:
+		s.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *testServer) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *testServer) get(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := s.objects[key]
+	if !ok {
+		s.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		s.heads++
+	}
+
+	etag := `"` + obj.etag() + `"`
+	if match := r.Header.Get("If-Match"); match != "" && match != etag {
+		s.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+	h.Set("Content-Type", "application/octet-stream")
+	if obj.storageClass != "" {
+		h.Set("X-Amz-Storage-Class", obj.storageClass)
+	}
+
+	data := obj.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int
+		first, last, _ := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+		start, _ = strconv.Atoi(first)
+		end = len(data) - 1
+		if last != "" {
+			end, _ = strconv.Atoi(last)
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		if start > end {
+			s.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (s *testServer) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	token := query.Get("continuation-token")
+	maxKeys := s.pageSize
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n < maxKeys {
+		maxKeys = n
+	}
+
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := listResult{Name: s.bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+	last := ""
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || (token != "" && key <= token) {
+			continue
+		}
+		// skip the remaining keys within the common prefix returned last
+		if token != "" && token != prefix && strings.HasSuffix(token, delimiter) && strings.HasPrefix(key, token) {
+			continue
+		}
+
+		entry := key
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entry = key[:len(prefix)+i+1]
+		}
+		if entry == last {
+			continue
+		}
+
+		if res.KeyCount == maxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = last
+			break
+		}
+
+		if entry == key {
+			obj := s.objects[key]
+			res.Contents = append(res.Contents, listContents{
+				Key:          key,
+				LastModified: obj.modTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag:         `"` + obj.etag() + `"`,
+				Size:         int64(len(obj.data)),
+				StorageClass: obj.storageClass,
+			})
+		} else {
+			res.CommonPrefixes = append(res.CommonPrefixes, listPrefix{Prefix: entry})
+		}
+		res.KeyCount++
+		last = entry
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+func (s *testServer) put(key, data string, modTime time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.objects[key] = testObject{data: []byte(data), modTime: modTime}
+}
+
+var (
+	markerTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	objectTime = time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+)
+
+func newTestServer(t testing.TB) (*testServer, *FS) {
+	s := &testServer{
+		bucket:   "bucket",
+		pageSize: 2,
+		objects: map[string]testObject{
+			"top":               {data: []byte("top content"), modTime: objectTime},
+			"photos/":           {modTime: markerTime},
+			"photos/c.txt":      {data: []byte("c content"), modTime: objectTime, storageClass: "GLACIER"},
+			"photos/2020/a.jpg": {data: []byte("a content"), modTime: objectTime},
+			"photos/2020/b.jpg": {data: []byte("b content"), modTime: objectTime},
+			"photos/2020/d.jpg": {data: []byte("d content"), modTime: objectTime},
+			"docs/readme":       {data: []byte("0123456789"), modTime: objectTime},
+			"dup":               {data: []byte("file wins"), modTime: objectTime},
+			"dup/inner":         {data: []byte("hidden"), modTime: objectTime},
+			"weird//x":          {data: []byte("unreachable"), modTime: objectTime},
+		},
+	}
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	rtest.OK(t, err)
+
+	sfs, err := Open(context.TODO(), Config{
+		Endpoint:     u.Host,
+		UseHTTP:      true,
+		KeyID:        "key",
+		Secret:       options.NewSecretString("secret"),
+		Bucket:       s.bucket,
+		Region:       "us-east-1",
+		BucketLookup: "path",
+		MaxRetries:   1,
+	}, http.DefaultTransport)
+	rtest.OK(t, err)
+	t.Cleanup(func() {
+		rtest.OK(t, sfs.Close())
+	})
+
+	return s, sfs
+}
+
+func readdirnames(t testing.TB, sfs *FS, name string) []string {
+	f, err := sfs.Open(name)
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	sort.Strings(names)
+	return names
+}
+
+func readFile(t testing.TB, sfs *FS, name string) string {
+	f, err := sfs.Open(name)
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return string(buf)
+}
+
+func TestFS(t *testing.T) {
+	srv, sfs := newTestServer(t)
+
+	rtest.Equals(t, []string{"docs", "dup", "photos", "top", "weird"}, readdirnames(t, sfs, "/"))
+	rtest.Equals(t, []string{"2020", "c.txt"}, readdirnames(t, sfs, "/photos"))
+	rtest.Equals(t, []string{"a.jpg", "b.jpg", "d.jpg"}, readdirnames(t, sfs, "/photos/2020"))
+	rtest.Equals(t, []string{}, readdirnames(t, sfs, "/weird"))
+
+	rtest.Equals(t, "top content", readFile(t, sfs, "/top"))
+	rtest.Equals(t, "file wins", readFile(t, sfs, "/dup"))
+	rtest.Equals(t, "a content", readFile(t, sfs, "/photos/2020/a.jpg"))
+
+	fi, err := sfs.Lstat("/photos")
+	rtest.OK(t, err)
+	rtest.Assert(t, fi.IsDir(), "photos is not a directory")
+	rtest.Assert(t, fi.ModTime().Equal(markerTime), "wrong mtime %v", fi.ModTime())
+
+	fi, err = sfs.Lstat("/docs")
+	rtest.OK(t, err)
+	rtest.Assert(t, fi.IsDir(), "docs is not a directory")
+	rtest.Assert(t, fi.ModTime().Equal(dirModTime), "wrong mtime %v", fi.ModTime())
+
+	fi, err = sfs.Lstat("/photos/c.txt")
+	rtest.OK(t, err)
+	rtest.Equals(t, os.FileMode(0644), fi.Mode())
+	rtest.Equals(t, int64(9), fi.Size())
+	rtest.Assert(t, fi.ModTime().Equal(objectTime), "wrong mtime %v", fi.ModTime())
+	meta, ok := fs.MetadataOf(fi)
+	rtest.Assert(t, ok, "no metadata for %v", fi.Name())
+	rtest.Equals(t, []fs.ExtendedAttribute{
+		{Name: AttributeETag, Value: []byte(srv.objects["photos/c.txt"].etag())},
+		{Name: AttributeStorageClass, Value: []byte("GLACIER")},
+	}, meta.ExtendedAttributes)
+
+	_, err = sfs.Lstat("/photos/missing")
+	rtest.Assert(t, errors.Is(err, os.ErrNotExist), "unexpected error %v", err)
+	_, err = sfs.Open("/weird/x")
+	rtest.Assert(t, errors.Is(err, os.ErrNotExist), "unexpected error %v", err)
+}
+
+func TestLstatCache(t *testing.T) {
+	srv, sfs := newTestServer(t)
+
+	readdirnames(t, sfs, "/photos/2020")
+	for _, name := range []string{"a.jpg", "b.jpg", "d.jpg"} {
+		fi, err := sfs.Lstat("/photos/2020/" + name)
+		rtest.OK(t, err)
+		rtest.Equals(t, int64(9), fi.Size())
+		// listings report milliseconds, HEAD requests only seconds
+		rtest.Assert(t, fi.ModTime().Equal(objectTime), "wrong mtime %v", fi.ModTime())
+	}
+	rtest.Equals(t, 0, srv.heads)
+}
+
+func TestFileRead(t *testing.T) {
+	srv, sfs := newTestServer(t)
+
+	f, err := sfs.Open("/docs/readme")
+	rtest.OK(t, err)
+	defer func() {
+		rtest.OK(t, f.Close())
+	}()
+
+	ra, ok := fs.ReaderAt(f)
+	rtest.Assert(t, ok, "file does not implement io.ReaderAt")
+
+	buf := make([]byte, 4)
+	n, err := ra.ReadAt(buf, 3)
+	rtest.OK(t, err)
+	rtest.Equals(t, "3456", string(buf[:n]))
+
+	n, err = ra.ReadAt(buf, 8)
+	rtest.Equals(t, io.EOF, err)
+	rtest.Equals(t, "89", string(buf[:n]))
+
+	_, err = f.Seek(6, io.SeekStart)
+	rtest.OK(t, err)
+	rest, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.Equals(t, "6789", string(rest))
+
+	// reading fails if the object is modified after it has been opened
+	srv.put("docs/readme", "modified", objectTime)
+	_, err = f.Seek(0, io.SeekStart)
+	rtest.OK(t, err)
+	_, err = io.ReadAll(f)
+	rtest.Assert(t, err != nil, "expected error for modified object")
+	_, err = ra.ReadAt(buf, 0)
+	rtest.Assert(t, err != nil, "expected error for modified object")
+}
+
+func TestArchiver(t *testing.T) {
+	_, sfs := newTestServer(t)
+	repo := repository.TestRepository(t)
+
+	arch := archiver.New(repo, sfs, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/photos"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+	rtest.Equals(t, []string{"/photos"}, sn.Paths)
+
+	tree := loadTree(t, repo, *sn.Tree)
+	rtest.Equals(t, 1, len(tree.Nodes))
+	photos := tree.Nodes[0]
+	rtest.Equals(t, "dir", photos.Type)
+	rtest.Assert(t, photos.ModTime.Equal(markerTime), "wrong mtime %v", photos.ModTime)
+
+	tree = loadTree(t, repo, *sn.Tree, "photos")
+	rtest.Equals(t, 2, len(tree.Nodes))
+
+	c := tree.Find("c.txt")
+	rtest.Assert(t, c != nil, "c.txt not found")
+	rtest.Equals(t, "file", c.Type)
+	rtest.Equals(t, uint64(9), c.Size)
+	rtest.Assert(t, c.ModTime.Equal(objectTime), "wrong mtime %v", c.ModTime)
+	rtest.Equals(t, []restic.ExtendedAttribute{
+		{Name: AttributeETag, Value: []byte(testObject{data: []byte("c content")}.etag())},
+		{Name: AttributeStorageClass, Value: []byte("GLACIER")},
+	}, c.ExtendedAttributes)
+
+	tree = loadTree(t, repo, *sn.Tree, "photos", "2020")
+	rtest.Equals(t, 3, len(tree.Nodes))
+	for _, node := range tree.Nodes {
+		rtest.Equals(t, uint64(9), node.Size)
+		rtest.Equals(t, 1, len(node.Content))
+	}
+}
+
+func loadTree(t testing.TB, repo restic.Repository, id restic.ID, dirs ...string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, dir := range dirs {
+		node := tree.Find(dir)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", dir)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
@@ -1,8 +1,11 @@
 package fs
 
 import (
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
@@ -53,6 +56,50 @@ func TestNoatime(t *testing.T) {
 	rtest.Equals(t, atime, getAtime())
 }
 
+func TestNoatimeNotOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("test requires root to access a file as another user")
+	}
+
+	dir := rtest.TempDir(t)
+	rtest.OK(t, os.Chmod(dir, 0755))
+	filename := filepath.Join(dir, "file")
+	rtest.OK(t, os.WriteFile(filename, []byte("Hello!"), 0644))
+
+	f, err := os.Open(filename)
+	rtest.OK(t, err)
+	supported := supportsNoatime(t, f)
+	rtest.OK(t, f.Close())
+	if !supported {
+		t.Skip("temp directory may not support O_NOATIME, skipping")
+	}
+
+	// Changing the filesystem uid away from root drops CAP_FOWNER for this
+	// thread, so we are no longer allowed to set O_NOATIME on the file.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rtest.OK(t, unix.Setfsuid(65534))
+	defer func() {
+		rtest.OK(t, unix.Setfsuid(0))
+	}()
+
+	f, err = os.Open(filename)
+	rtest.OK(t, err)
+	err = setFlags(f)
+	rtest.Assert(t, errors.Is(err, unix.EPERM), "expected EPERM, got %v", err)
+	rtest.OK(t, f.Close())
+
+	// Opening the file must not fail, reads are done without O_NOATIME.
+	for _, fs := range []Local{{}, {UpdateAtime: true}} {
+		f, err := fs.Open(filename)
+		rtest.OK(t, err)
+		buf, err := io.ReadAll(f)
+		rtest.OK(t, err)
+		rtest.Equals(t, "Hello!", string(buf))
+		rtest.OK(t, f.Close())
+	}
+}
+
 func supportsNoatime(t *testing.T, f *os.File) bool {
 	var fsinfo unix.Statfs_t
 	err := unix.Fstatfs(int(f.Fd()), &fsinfo)
@@ -0,0 +1,83 @@
+package sftpfs
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/options"
+)
+
+// Config collects all information required to read files from a remote host
+// via SFTP.
+type Config struct {
+	User, Host, Port string
+
+	Command string `option:"command" help:"specify command to create sftp connection"`
+	Args    string `option:"args"    help:"specify arguments for ssh"`
+
+	Connections uint `option:"connections" help:"set the number of ssh connections used to read files (default: 2)"`
+}
+
+// NewConfig returns a new config with default options applied.
+func NewConfig() Config {
+	return Config{
+		Connections: 2,
+	}
+}
+
+func init() {
+	options.Register("sftp-source", Config{})
+}
+
+const prefix = "sftp://"
+
+// IsTarget returns true if s describes a directory or file on a remote host,
+// e.g. sftp://user@host/path.
+func IsTarget(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// ParseTarget parses a target of the form sftp://user@host[:port]/path and
+// returns the configuration for the host and the path on the remote host.
+// Like for the sftp backend, the path is relative to the home directory of
+// the user unless it starts with two slashes (sftp://host//absolute/path).
+func ParseTarget(s string) (Config, string, error) {
+	if !IsTarget(s) {
+		return Config{}, "", errors.Errorf("invalid target %q, does not start with %q", s, prefix)
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return Config{}, "", errors.WithStack(err)
+	}
+
+	if u.Hostname() == "" {
+		return Config{}, "", errors.Errorf("invalid target %q, no host specified", s)
+	}
+
+	dir := strings.TrimPrefix(u.Path, "/")
+	if dir == "" {
+		dir = "."
+	}
+	dir = path.Clean(dir)
+	if strings.HasPrefix(dir, "~") {
+		return Config{}, "", errors.New("sftp path starts with the tilde (~) character, that fails for most sftp servers.\nUse a relative directory, most servers interpret this as relative to the user's home directory")
+	}
+
+	cfg := NewConfig()
+	if u.User != nil {
+		cfg.User = u.User.Username()
+	}
+	cfg.Host = u.Hostname()
+	cfg.Port = u.Port()
+
+	return cfg, dir, nil
+}
+
+// SameHost returns true if both configurations describe the same host and
+// user.
+func (cfg Config) SameHost(other Config) bool {
+	return cfg.User == other.User && cfg.Host == other.Host && cfg.Port == other.Port
+}
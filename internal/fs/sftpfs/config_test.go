@@ -0,0 +1,62 @@
+package sftpfs
+
+import (
+	"testing"
+
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestParseTarget(t *testing.T) {
+	var tests = []struct {
+		s   string
+		cfg Config
+		dir string
+	}{
+		{
+			s:   "sftp://user@host/dir/subdir",
+			cfg: Config{User: "user", Host: "host", Connections: 2},
+			dir: "dir/subdir",
+		},
+		{
+			s:   "sftp://host//dir/subdir",
+			cfg: Config{Host: "host", Connections: 2},
+			dir: "/dir/subdir",
+		},
+		{
+			s:   "sftp://user@host:10022//dir/../other",
+			cfg: Config{User: "user", Host: "host", Port: "10022", Connections: 2},
+			dir: "/other",
+		},
+		{
+			s:   "sftp://host",
+			cfg: Config{Host: "host", Connections: 2},
+			dir: ".",
+		},
+		{
+			s:   "sftp://user@[::1]:22/dir",
+			cfg: Config{User: "user", Host: "::1", Port: "22", Connections: 2},
+			dir: "dir",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			cfg, dir, err := ParseTarget(test.s)
+			rtest.OK(t, err)
+			rtest.Equals(t, test.cfg, cfg)
+			rtest.Equals(t, test.dir, dir)
+		})
+	}
+}
+
+func TestParseTargetInvalid(t *testing.T) {
+	for _, s := range []string{
+		"/local/dir",
+		"sftp:host:dir",
+		"sftp:///dir",
+		"sftp://host/~/dir",
+	} {
+		_, _, err := ParseTarget(s)
+		rtest.Assert(t, err != nil, "expected error for %q", s)
+	}
+}
@@ -0,0 +1,478 @@
+package sftpfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/util"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+
+	"github.com/pkg/sftp"
+)
+
+// FS is a file system on a remote host which is accessed via SFTP. Besides
+// reading it via fs.FS, snapshots can be restored to it, see OpenWritable.
+// Requests are distributed over a pool of connections, the connections are
+// kept open until Close is called.
+type FS struct {
+	fs.SlashPaths
+
+	clients []*client
+	next    uint32
+	wd      string
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// client is a single SFTP session, usually provided by an ssh process.
+type client struct {
+	c *sftp.Client
+
+	cmd    *exec.Cmd
+	result <-chan error
+}
+
+const closeTimeout = 2 * time.Second
+
+// Open connects to the host described by cfg by running "ssh" with the
+// appropriate arguments (or cfg.Command, if set). Host key verification and
+// the settings from ssh_config are handled by ssh.
+func Open(cfg Config) (*FS, error) {
+	n := cfg.Connections
+	if n == 0 {
+		n = 1
+	}
+
+	clients := make([]*client, 0, n)
+	for i := uint(0); i < n; i++ {
+		c, err := startClient(cfg)
+		if err != nil {
+			for _, c := range clients {
+				_ = c.close()
+			}
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+
+	return newFS(clients)
+}
+
+// New returns a file system which uses the already established SFTP
+// sessions. The sessions are closed by Close.
+func New(sessions ...*sftp.Client) (*FS, error) {
+	if len(sessions) == 0 {
+		return nil, errors.New("no sftp session")
+	}
+
+	clients := make([]*client, 0, len(sessions))
+	for _, c := range sessions {
+		clients = append(clients, &client{c: c})
+	}
+	return newFS(clients)
+}
+
+func newFS(clients []*client) (*FS, error) {
+	wd, err := clients[0].c.Getwd()
+	if err != nil {
+		for _, c := range clients {
+			_ = c.close()
+		}
+		return nil, errors.Wrap(err, "Getwd")
+	}
+
+	return &FS{clients: clients, wd: wd}, nil
+}
+
+func startClient(cfg Config) (*client, error) {
+	program, args, err := buildSSHCommand(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	debug.Log("start client %v %v", program, args)
+	cmd := exec.Command(program, args...)
+
+	// prefix the errors with the program name
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cmd.StderrPipe")
+	}
+
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			fmt.Fprintf(os.Stderr, "subprocess %v: %v\n", program, sc.Text())
+		}
+	}()
+
+	wr, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cmd.StdinPipe")
+	}
+	rd, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cmd.StdoutPipe")
+	}
+
+	bg, err := util.StartForeground(cmd)
+	if err != nil {
+		if util.IsErrDot(err) {
+			return nil, errors.Errorf("cannot implicitly run relative executable %v found in current directory, use -o sftp-source.command=./<command> to override", cmd.Path)
+		}
+		return nil, err
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		debug.Log("ssh command exited, err %v", err)
+		for {
+			ch <- errors.Wrap(err, "ssh command exited")
+		}
+	}()
+
+	c, err := sftp.NewClientPipe(rd, wr, sftp.UseConcurrentReads(true))
+	if err != nil {
+		return nil, errors.Errorf("unable to start the sftp session, error: %v", err)
+	}
+
+	err = bg()
+	if err != nil {
+		return nil, errors.Wrap(err, "bg")
+	}
+
+	return &client{c: c, cmd: cmd, result: ch}, nil
+}
+
+func buildSSHCommand(cfg Config) (cmd string, args []string, err error) {
+	if cfg.Command != "" {
+		args, err := backend.SplitShellStrings(cfg.Command)
+		if err != nil {
+			return "", nil, err
+		}
+		if cfg.Args != "" {
+			return "", nil, errors.New("cannot specify both sftp-source.command and sftp-source.args options")
+		}
+
+		return args[0], args[1:], nil
+	}
+
+	cmd = "ssh"
+
+	args = []string{cfg.Host}
+	if cfg.Port != "" {
+		args = append(args, "-p", cfg.Port)
+	}
+	if cfg.User != "" {
+		args = append(args, "-l", cfg.User)
+	}
+
+	if cfg.Args != "" {
+		a, err := backend.SplitShellStrings(cfg.Args)
+		if err != nil {
+			return "", nil, err
+		}
+
+		args = append(args, a...)
+	}
+
+	args = append(args, "-s", "sftp")
+	return cmd, args, nil
+}
+
+func (c *client) close() error {
+	err := c.c.Close()
+	debug.Log("Close returned error %v", err)
+	if c.cmd == nil {
+		return err
+	}
+
+	// wait for closeTimeout before killing the process
+	select {
+	case err := <-c.result:
+		return err
+	case <-time.After(closeTimeout):
+	}
+
+	if err := c.cmd.Process.Kill(); err != nil {
+		return err
+	}
+
+	// get the error, but ignore it
+	<-c.result
+	return nil
+}
+
+// Close closes all connections to the remote host.
+func (sfs *FS) Close() error {
+	var firstErr error
+	for _, c := range sfs.clients {
+		if err := c.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// client returns the next connection from the pool.
+func (sfs *FS) client() *sftp.Client {
+	n := atomic.AddUint32(&sfs.next, 1)
+	return sfs.clients[int(n)%len(sfs.clients)].c
+}
+
+// pathError wraps err in an *os.PathError. Errors which indicate that the
+// connection to the host was lost are reported as ENOTCONN, so that the
+// archiver treats them as fatal.
+func pathError(op, name string, err error) error {
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, sftp.ErrSSHFxNoConnection) {
+		err = syscall.ENOTCONN
+	}
+
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// Capabilities returns the features supported by the file system. The SFTP
+// protocol reports modification times with a resolution of one second and
+// neither inode numbers nor device IDs.
+func (sfs *FS) Capabilities() fs.Capabilities {
+	return fs.CapSecondsOnlyMtime
+}
+
+// Open opens a file or directory for reading.
+func (sfs *FS) Open(name string) (fs.File, error) {
+	return sfs.OpenFile(name, fs.O_RDONLY, 0)
+}
+
+// OpenFile opens a file or directory for reading, only the flags O_RDONLY and
+// O_NOFOLLOW are supported. With O_NOFOLLOW, symbolic links are not resolved
+// when determining whether name is a directory.
+func (sfs *FS) OpenFile(name string, flag int, _ os.FileMode) (fs.File, error) {
+	if flag & ^(fs.O_RDONLY|fs.O_NOFOLLOW) != 0 {
+		return nil, pathError("open", name,
+			fmt.Errorf("invalid combination of flags 0x%x", flag))
+	}
+
+	c := sfs.client()
+
+	var fi os.FileInfo
+	var err error
+	if flag&fs.O_NOFOLLOW != 0 {
+		fi, err = c.Lstat(name)
+	} else {
+		fi, err = c.Stat(name)
+	}
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	if fi.IsDir() {
+		return &dir{c: c, name: name, fi: newFileInfo(c, name, fi)}, nil
+	}
+
+	f, err := c.Open(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &file{f: f, c: c, name: name}, nil
+}
+
+// Stat returns a FileInfo describing the named file, symbolic links are
+// resolved.
+func (sfs *FS) Stat(name string) (os.FileInfo, error) {
+	c := sfs.client()
+	fi, err := c.Stat(name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return newFileInfo(c, name, fi), nil
+}
+
+// Lstat returns the FileInfo structure describing the named file. If the file
+// is a symbolic link, the returned FileInfo describes the symbolic link.
+func (sfs *FS) Lstat(name string) (os.FileInfo, error) {
+	c := sfs.client()
+	fi, err := c.Lstat(name)
+	if err != nil {
+		return nil, pathError("lstat", name, err)
+	}
+	return newFileInfo(c, name, fi), nil
+}
+
+// fileInfo converts the information returned by the server into a FileInfo
+// which carries the remote owner and the target of symbolic links.
+func newFileInfo(c *sftp.Client, name string, fi os.FileInfo) os.FileInfo {
+	meta := &fs.Metadata{}
+	if st, ok := fi.Sys().(*sftp.FileStat); ok {
+		meta.UID, meta.GID = st.UID, st.GID
+		meta.AccessTime = time.Unix(int64(st.Atime), 0)
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := c.ReadLink(name)
+		if err != nil {
+			debug.Log("ReadLink(%v) failed: %v", name, err)
+		}
+		meta.LinkTarget = target
+	}
+
+	return fileInfo{FileInfo: fi, meta: meta}
+}
+
+// IsAbs reports whether the path is absolute.
+func (sfs *FS) IsAbs(p string) bool {
+	return path.IsAbs(p)
+}
+
+// Abs returns an absolute representation of path. Relative paths are
+// interpreted relative to the working directory of the sftp session, which
+// is usually the home directory of the user.
+func (sfs *FS) Abs(p string) (string, error) {
+	if !path.IsAbs(p) {
+		p = path.Join(sfs.wd, p)
+	}
+	return path.Clean(p), nil
+}
+
+// fileInfo is an os.FileInfo returned by the server, with the metadata
+// restic needs exposed via Sys().
+type fileInfo struct {
+	os.FileInfo
+	meta *fs.Metadata
+}
+
+func (fi fileInfo) Sys() interface{} {
+	return fi.meta
+}
+
+// file is a regular file opened on the remote host.
+type file struct {
+	f    *sftp.File
+	c    *sftp.Client
+	name string
+}
+
+// ensure that file implements fs.File
+var _ fs.File = &file{}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.f.Read(p)
+	if err != nil && err != io.EOF {
+		return n, pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+func (f *file) Close() error {
+	return f.f.Close()
+}
+
+func (f *file) Fd() uintptr {
+	return 0
+}
+
+func (f *file) Readdirnames(_ int) ([]string, error) {
+	return nil, pathError("readdirnames", f.name, syscall.ENOTDIR)
+}
+
+func (f *file) Readdir(_ int) ([]os.FileInfo, error) {
+	return nil, pathError("readdir", f.name, syscall.ENOTDIR)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return nil, pathError("stat", f.name, err)
+	}
+	return newFileInfo(f.c, f.name, fi), nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+// dir is a directory on the remote host. The entries are read from the
+// server when Readdir or Readdirnames is called.
+type dir struct {
+	c    *sftp.Client
+	name string
+	fi   os.FileInfo
+}
+
+// ensure that dir implements fs.File
+var _ fs.File = &dir{}
+
+func (d *dir) Read(_ []byte) (int, error) {
+	return 0, pathError("read", d.name, syscall.EISDIR)
+}
+
+func (d *dir) Seek(int64, int) (int64, error) {
+	return 0, pathError("seek", d.name, syscall.EISDIR)
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Fd() uintptr {
+	return 0
+}
+
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	entries, err := d.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// Readdir returns the entries of the directory in the order the server sent
+// them. Only n <= 0 is supported.
+func (d *dir) Readdir(n int) ([]os.FileInfo, error) {
+	if n > 0 {
+		return nil, pathError("readdir", d.name, errors.New("not implemented"))
+	}
+
+	entries, err := d.c.ReadDir(d.name)
+	if err != nil {
+		return nil, pathError("readdir", d.name, err)
+	}
+
+	for i, fi := range entries {
+		entries[i] = newFileInfo(d.c, path.Join(d.name, fi.Name()), fi)
+	}
+	return entries, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
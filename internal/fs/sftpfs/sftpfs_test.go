@@ -0,0 +1,433 @@
+package sftpfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/restorer"
+	rtest "github.com/restic/restic/internal/test"
+
+	"github.com/pkg/sftp"
+)
+
+// testEntry is a file, directory or symlink served by testServer.
+type testEntry struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	uid     uint32
+	gid     uint32
+	data    []byte
+	target  string
+
+	children []string // in the order the server returns them
+	listErr  error
+}
+
+func (e *testEntry) Name() string       { return e.name }
+func (e *testEntry) Size() int64        { return int64(len(e.data)) }
+func (e *testEntry) Mode() os.FileMode  { return e.mode }
+func (e *testEntry) ModTime() time.Time { return e.modTime }
+func (e *testEntry) IsDir() bool        { return e.mode.IsDir() }
+func (e *testEntry) Sys() interface{}   { return nil }
+func (e *testEntry) Uid() uint32        { return e.uid }
+func (e *testEntry) Gid() uint32        { return e.gid }
+
+// testServer is a read-only, in-memory file system served via the sftp
+// request server.
+type testServer struct {
+	m       sync.Mutex
+	entries map[string]*testEntry
+	lists   []string
+}
+
+func (s *testServer) add(p string, e *testEntry) {
+	if e.modTime.IsZero() {
+		e.modTime = time.Unix(1700000000, 0)
+	}
+	e.name = path.Base(p)
+	s.entries[p] = e
+	if parent, ok := s.entries[path.Dir(p)]; ok && p != "/" {
+		parent.children = append(parent.children, e.name)
+	}
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(fis []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(fis, l[offset:])
+	if n < len(fis) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *testServer) lookup(p string, follow bool) (*testEntry, error) {
+	e, ok := s.entries[path.Clean(p)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if follow && e.mode&os.ModeSymlink != 0 {
+		return s.lookup(path.Join(path.Dir(p), e.target), follow)
+	}
+	return e, nil
+}
+
+func (s *testServer) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	e, err := s.lookup(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(e.data), nil
+}
+
+func (s *testServer) Filewrite(_ *sftp.Request) (io.WriterAt, error) {
+	return nil, os.ErrPermission
+}
+
+func (s *testServer) Filecmd(_ *sftp.Request) error {
+	return os.ErrPermission
+}
+
+func (s *testServer) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		s.m.Lock()
+		s.lists = append(s.lists, r.Filepath)
+		s.m.Unlock()
+
+		e, err := s.lookup(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		if e.listErr != nil {
+			return nil, e.listErr
+		}
+		var fis listerAt
+		for _, name := range e.children {
+			fis = append(fis, s.entries[path.Join(r.Filepath, name)])
+		}
+		return fis, nil
+	case "Stat":
+		e, err := s.lookup(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{e}, nil
+	}
+	return nil, syscall.ENOSYS
+}
+
+func (s *testServer) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	e, err := s.lookup(r.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{e}, nil
+}
+
+func (s *testServer) Readlink(p string) (string, error) {
+	e, err := s.lookup(p, false)
+	if err != nil {
+		return "", err
+	}
+	return e.target, nil
+}
+
+func newTestServer() *testServer {
+	s := &testServer{entries: make(map[string]*testEntry)}
+	s.add("/", &testEntry{mode: os.ModeDir | 0755})
+	s.add("/home", &testEntry{mode: os.ModeDir | 0755})
+	s.add("/home/user", &testEntry{mode: os.ModeDir | 0750, uid: 1000, gid: 1000})
+	s.add("/home/user/work", &testEntry{mode: os.ModeDir | 0755, uid: 1000, gid: 1000})
+	s.add("/home/user/work/zeta", &testEntry{mode: 0644, uid: 1000, gid: 100, data: []byte("zeta content")})
+	s.add("/home/user/work/alpha", &testEntry{mode: 0600, uid: 1001, gid: 1001, data: []byte("alpha content"),
+		modTime: time.Unix(1600000000, 0)})
+	s.add("/home/user/work/link", &testEntry{mode: os.ModeSymlink | 0777, uid: 1000, gid: 1000, target: "alpha"})
+	s.add("/home/user/work/sub", &testEntry{mode: os.ModeDir | 0700, uid: 0, gid: 0})
+	s.add("/home/user/work/sub/file", &testEntry{mode: 0644, data: []byte("nested")})
+	return s
+}
+
+// newTestFS returns a file system connected to s via n in-process sftp
+// sessions.
+func newTestFS(t testing.TB, s *testServer, n int) *FS {
+	var clients []*sftp.Client
+	for i := 0; i < n; i++ {
+		serverConn, clientConn := net.Pipe()
+		server := sftp.NewRequestServer(serverConn, sftp.Handlers{
+			FileGet:  s,
+			FilePut:  s,
+			FileCmd:  s,
+			FileList: s,
+		}, sftp.WithStartDirectory("/home/user"))
+		go func() {
+			_ = server.Serve()
+		}()
+
+		c, err := sftp.NewClientPipe(clientConn, clientConn)
+		rtest.OK(t, err)
+		clients = append(clients, c)
+	}
+
+	sfs, err := New(clients...)
+	rtest.OK(t, err)
+	t.Cleanup(func() {
+		_ = sfs.Close()
+	})
+	return sfs
+}
+
+func TestFS(t *testing.T) {
+	sfs := newTestFS(t, newTestServer(), 2)
+
+	abs, err := sfs.Abs("work")
+	rtest.OK(t, err)
+	rtest.Equals(t, "/home/user/work", abs)
+
+	f, err := sfs.OpenFile(abs, fs.O_RDONLY|fs.O_NOFOLLOW, 0)
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	rtest.Equals(t, []string{"zeta", "alpha", "link", "sub"}, names)
+
+	fi, err := sfs.Lstat("/home/user/work/alpha")
+	rtest.OK(t, err)
+	rtest.Equals(t, os.FileMode(0600), fi.Mode())
+	rtest.Equals(t, int64(13), fi.Size())
+	rtest.Assert(t, fi.ModTime().Equal(time.Unix(1600000000, 0)), "wrong mtime %v", fi.ModTime())
+	meta, ok := fs.MetadataOf(fi)
+	rtest.Assert(t, ok, "no metadata for %v", fi.Name())
+	rtest.Equals(t, uint32(1001), meta.UID)
+	rtest.Equals(t, uint32(1001), meta.GID)
+
+	fi, err = sfs.Lstat("/home/user/work/link")
+	rtest.OK(t, err)
+	rtest.Assert(t, fi.Mode()&os.ModeSymlink != 0, "link is not a symlink: %v", fi.Mode())
+	meta, _ = fs.MetadataOf(fi)
+	rtest.Equals(t, "alpha", meta.LinkTarget)
+
+	fi, err = sfs.Stat("/home/user/work/link")
+	rtest.OK(t, err)
+	rtest.Equals(t, os.FileMode(0600), fi.Mode())
+
+	f, err = sfs.Open("/home/user/work/link")
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	rtest.Equals(t, "alpha content", string(buf))
+
+	_, err = sfs.Lstat("/home/user/work/missing")
+	rtest.Assert(t, errors.Is(err, os.ErrNotExist), "unexpected error %v", err)
+}
+
+func TestScannerErrors(t *testing.T) {
+	srv := newTestServer()
+	srv.entries["/home/user/work/sub"].listErr = sftp.ErrSSHFxPermissionDenied
+	sfs := newTestFS(t, srv, 2)
+
+	var m sync.Mutex
+	var errs []string
+	var stats archiver.ScanStats
+
+	sc := archiver.NewScanner(sfs)
+	sc.Error = func(item string, err error) error {
+		m.Lock()
+		defer m.Unlock()
+		rtest.Assert(t, errors.Is(err, os.ErrPermission), "unexpected error %v", err)
+		errs = append(errs, item)
+		return nil
+	}
+	sc.Result = func(item string, s archiver.ScanStats) {
+		if item == "" {
+			stats = s
+		}
+	}
+
+	rtest.OK(t, sc.Scan(context.TODO(), []string{"/home/user/work"}))
+	rtest.Equals(t, []string{"/home/user/work/sub"}, errs)
+	rtest.Equals(t, uint(2), stats.Files)
+	rtest.Equals(t, uint(1), stats.Others)
+	rtest.Equals(t, uint64(len("zeta content")+len("alpha content")), stats.Bytes)
+
+	srv.m.Lock()
+	lists := append([]string(nil), srv.lists...)
+	srv.m.Unlock()
+	sort.Strings(lists)
+	rtest.Equals(t, []string{"/home/user/work", "/home/user/work/sub"}, lists)
+}
+
+func TestArchiver(t *testing.T) {
+	sfs := newTestFS(t, newTestServer(), 2)
+	repo := repository.TestRepository(t)
+
+	arch := archiver.New(repo, sfs, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/home/user/work"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+	rtest.Equals(t, []string{"/home/user/work"}, sn.Paths)
+
+	tree := loadTree(t, repo, *sn.Tree, "home", "user", "work")
+
+	var names []string
+	nodes := make(map[string]*restic.Node)
+	for _, node := range tree.Nodes {
+		names = append(names, node.Name)
+		nodes[node.Name] = node
+	}
+	rtest.Equals(t, []string{"alpha", "link", "sub", "zeta"}, names)
+
+	alpha := nodes["alpha"]
+	rtest.Equals(t, "file", alpha.Type)
+	rtest.Equals(t, uint32(1001), alpha.UID)
+	rtest.Equals(t, uint32(1001), alpha.GID)
+	rtest.Equals(t, os.FileMode(0600), alpha.Mode)
+	rtest.Assert(t, alpha.ModTime.Equal(time.Unix(1600000000, 0)), "wrong mtime %v", alpha.ModTime)
+	rtest.Equals(t, uint64(13), alpha.Size)
+
+	link := nodes["link"]
+	rtest.Equals(t, "symlink", link.Type)
+	rtest.Equals(t, "alpha", link.LinkTarget)
+	rtest.Equals(t, uint32(1000), link.UID)
+
+	sub := nodes["sub"]
+	rtest.Equals(t, "dir", sub.Type)
+	rtest.Equals(t, os.ModeDir|0700, sub.Mode)
+
+	subtree := loadTree(t, repo, *sub.Subtree)
+	rtest.Equals(t, 1, len(subtree.Nodes))
+	rtest.Equals(t, "file", subtree.Nodes[0].Name)
+}
+
+func loadTree(t testing.TB, repo restic.Repository, id restic.ID, dirs ...string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, dir := range dirs {
+		node := tree.Find(dir)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", dir)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
+
+// statically ensure that FS can be restored to.
+var _ restorer.RemoteFS = &FS{}
+
+// newLocalFS returns a file system connected via an in-process sftp session to
+// a server which serves the local file system.
+func newLocalFS(t testing.TB) *FS {
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	rtest.OK(t, err)
+	go func() {
+		_ = server.Serve()
+	}()
+
+	c, err := sftp.NewClientPipe(clientConn, clientConn)
+	rtest.OK(t, err)
+	sfs, err := New(c)
+	rtest.OK(t, err)
+	t.Cleanup(func() {
+		_ = sfs.Close()
+	})
+	return sfs
+}
+
+// chownDeniedFS is a file system on which the owner cannot be changed.
+type chownDeniedFS struct {
+	*FS
+}
+
+func (chownDeniedFS) Chown(name string, _, _ int) error {
+	return pathError("chown", name, os.ErrPermission)
+}
+
+func TestRestorer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the sftp test server does not serve Windows paths")
+	}
+
+	repo := repository.TestRepository(t)
+	arch := archiver.New(repo, newTestFS(t, newTestServer(), 1), archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/home/user/work"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+
+	// the test server resolves relative symlink targets if it has a working
+	// directory, thus an absolute target is used
+	target := filepath.Join(rtest.TempDir(t), "restore")
+	dst := restorer.NewRemoteDestination(chownDeniedFS{newLocalFS(t)})
+
+	var warnings []string
+	res := restorer.NewRestorer(repo, sn, false, nil)
+	res.Destination = dst
+	res.Warn = func(msg string) {
+		warnings = append(warnings, msg)
+	}
+	rtest.OK(t, res.RestoreTo(context.TODO(), target))
+	rtest.Equals(t, []string{"the owner of restored items cannot be changed on the destination"}, warnings)
+
+	work := filepath.Join(target, "home", "user", "work")
+	for name, content := range map[string]string{
+		"alpha":    "alpha content",
+		"zeta":     "zeta content",
+		"sub/file": "nested",
+	} {
+		data, err := os.ReadFile(filepath.Join(work, name))
+		rtest.OK(t, err)
+		rtest.Equals(t, content, string(data))
+	}
+
+	fi, err := os.Lstat(filepath.Join(work, "alpha"))
+	rtest.OK(t, err)
+	rtest.Equals(t, os.FileMode(0600), fi.Mode())
+	rtest.Assert(t, fi.ModTime().Equal(time.Unix(1600000000, 0)), "wrong mtime %v", fi.ModTime())
+
+	fi, err = os.Lstat(filepath.Join(work, "sub"))
+	rtest.OK(t, err)
+	rtest.Equals(t, os.ModeDir|0700, fi.Mode())
+
+	link, err := os.Readlink(filepath.Join(work, "link"))
+	rtest.OK(t, err)
+	rtest.Equals(t, "alpha", link)
+
+	n, err := res.VerifyFiles(context.TODO(), target)
+	rtest.OK(t, err)
+	rtest.Equals(t, 3, n)
+
+	// restoring again keeps the unchanged items, extraneous ones are deleted
+	rtest.OK(t, os.WriteFile(filepath.Join(work, "extra"), []byte("extra"), 0644))
+	res = restorer.NewRestorer(repo, sn, false, nil)
+	res.Destination = dst
+	res.Overwrite = restorer.OverwriteIfChanged
+	res.Ownership.Policy = restorer.OwnershipSkip
+	res.Delete = true
+	rtest.OK(t, res.RestoreTo(context.TODO(), target))
+	// the modification time of symlinks cannot be set, thus link is replaced
+	rtest.Equals(t, uint64(3), res.Stats().FilesSkipped)
+	rtest.Equals(t, uint64(1), res.Stats().FilesReplaced)
+	rtest.Equals(t, uint64(1), res.Stats().FilesDeleted)
+	_, err = os.Lstat(filepath.Join(work, "extra"))
+	rtest.Assert(t, errors.Is(err, os.ErrNotExist), "extra was not deleted: %v", err)
+}
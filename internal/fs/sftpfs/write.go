@@ -0,0 +1,134 @@
+package sftpfs
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/restic/restic/internal/fs"
+)
+
+// The following methods modify the remote file system, they are used to
+// restore snapshots to the host.
+
+// OpenWritable opens a regular file for random access. The flags O_RDONLY,
+// O_WRONLY, O_RDWR, O_CREATE, O_EXCL and O_TRUNC are supported. The server
+// determines the permissions of newly created files, perm is ignored.
+func (sfs *FS) OpenWritable(name string, flag int, _ os.FileMode) (fs.WritableFile, error) {
+	f, err := sfs.client().OpenFile(name, flag)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return f, nil
+}
+
+// ReadDir returns the entries of the directory name.
+func (sfs *FS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := sfs.client().ReadDir(name)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	return entries, nil
+}
+
+// Readlink returns the target of the symbolic link name.
+func (sfs *FS) Readlink(name string) (string, error) {
+	target, err := sfs.client().ReadLink(name)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	return target, nil
+}
+
+// MkdirAll creates the directory name and all missing parents. The server
+// determines the permissions of the directories, perm is ignored.
+func (sfs *FS) MkdirAll(name string, _ os.FileMode) error {
+	if err := sfs.client().MkdirAll(name); err != nil {
+		return pathError("mkdir", name, err)
+	}
+	return nil
+}
+
+// Remove removes the file or empty directory name.
+func (sfs *FS) Remove(name string) error {
+	if err := sfs.client().Remove(name); err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+// RemoveAll removes name and all of its children. Unlike
+// sftp.Client.RemoveAll, symbolic links to directories are not followed. A
+// missing name is not an error.
+func (sfs *FS) RemoveAll(name string) error {
+	c := sfs.client()
+	fi, err := c.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return pathError("lstat", name, err)
+	}
+
+	if !fi.IsDir() {
+		return sfs.Remove(name)
+	}
+
+	entries, err := c.ReadDir(name)
+	if err != nil {
+		return pathError("readdir", name, err)
+	}
+	for _, entry := range entries {
+		if err := sfs.RemoveAll(path.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	if err := c.RemoveDirectory(name); err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+func (sfs *FS) Symlink(oldname, newname string) error {
+	if err := sfs.client().Symlink(oldname, newname); err != nil {
+		return pathError("symlink", newname, err)
+	}
+	return nil
+}
+
+// Link creates newname as a hard link to oldname. This requires the
+// hardlink@openssh.com extension of the server.
+func (sfs *FS) Link(oldname, newname string) error {
+	if err := sfs.client().Link(oldname, newname); err != nil {
+		return pathError("link", newname, err)
+	}
+	return nil
+}
+
+// Chmod changes the permissions of name. Symbolic links are followed.
+func (sfs *FS) Chmod(name string, mode os.FileMode) error {
+	if err := sfs.client().Chmod(name, mode); err != nil {
+		return pathError("chmod", name, err)
+	}
+	return nil
+}
+
+// Chown changes the numeric owner and group of name. Symbolic links are
+// followed.
+func (sfs *FS) Chown(name string, uid, gid int) error {
+	if err := sfs.client().Chown(name, uid, gid); err != nil {
+		return pathError("chown", name, err)
+	}
+	return nil
+}
+
+// Chtimes changes the access and modification times of name with a
+// resolution of one second. Symbolic links are followed.
+func (sfs *FS) Chtimes(name string, atime, mtime time.Time) error {
+	if err := sfs.client().Chtimes(name, atime, mtime); err != nil {
+		return pathError("chtimes", name, err)
+	}
+	return nil
+}
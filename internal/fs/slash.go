@@ -0,0 +1,52 @@
+package fs
+
+import "path"
+
+// SlashPaths implements the path handling of FS for file systems which use
+// forward slashes as separator and have neither volume names nor a working
+// directory. It is meant to be embedded, relative paths are interpreted
+// relative to the root.
+type SlashPaths struct{}
+
+// VolumeName returns leading volume name, which is always the empty string.
+func (SlashPaths) VolumeName(_ string) string {
+	return ""
+}
+
+// Join joins any number of path elements into a single path, adding a
+// separator if necessary.
+func (SlashPaths) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// Separator returns the separator for dirs/subdirs/files, which is always a
+// forward slash.
+func (SlashPaths) Separator() string {
+	return "/"
+}
+
+// IsAbs reports whether the path is absolute. All paths are relative to the
+// root, thus this is always true.
+func (SlashPaths) IsAbs(_ string) bool {
+	return true
+}
+
+// Abs returns an absolute representation of path.
+func (SlashPaths) Abs(p string) (string, error) {
+	return path.Clean("/" + p), nil
+}
+
+// Clean returns the cleaned path.
+func (SlashPaths) Clean(p string) string {
+	return path.Clean(p)
+}
+
+// Base returns the last element of p.
+func (SlashPaths) Base(p string) string {
+	return path.Base(p)
+}
+
+// Dir returns p without the last element.
+func (SlashPaths) Dir(p string) string {
+	return path.Dir(p)
+}
@@ -0,0 +1,469 @@
+package snapshotfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/restic"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// Repository is the part of a repository required to read a snapshot. The
+// index must have been loaded.
+type Repository interface {
+	restic.BlobLoader
+	LookupBlobSize(restic.ID, restic.BlobType) (uint, bool)
+}
+
+// FS is a read-only file system which presents the contents of a snapshot.
+// Directories are read from the trees of the snapshot, the content of files
+// is loaded from the data blobs, and the metadata stored in the nodes is
+// reported via the Sys() method of the returned os.FileInfo values.
+// Symbolic links are never followed.
+type FS struct {
+	fs.SlashPaths
+
+	ctx  context.Context
+	repo Repository
+	sn   *restic.Snapshot
+
+	trees *lru.Cache[restic.ID, *restic.Tree]
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// treeCacheSize is the number of trees kept in memory.
+const treeCacheSize = 128
+
+// New returns a file system for the snapshot sn. All blobs are loaded with
+// ctx, as the methods of fs.FS do not take a context.
+func New(ctx context.Context, repo Repository, sn *restic.Snapshot) (*FS, error) {
+	if sn.Tree == nil {
+		return nil, errors.Errorf("snapshot %v has no tree", sn.ID().Str())
+	}
+
+	trees, err := lru.New[restic.ID, *restic.Tree](treeCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FS{ctx: ctx, repo: repo, sn: sn, trees: trees}, nil
+}
+
+// Close releases the resources of the file system.
+func (sfs *FS) Close() error {
+	sfs.trees.Purge()
+	return nil
+}
+
+// Targets returns the paths saved in the snapshot, as paths within the file
+// system. For snapshots created on Windows, the volume name is the first
+// directory, e.g. C:\Users becomes /C/Users.
+func (sfs *FS) Targets() []string {
+	targets := make([]string, 0, len(sfs.sn.Paths))
+	for _, p := range sfs.sn.Paths {
+		p = strings.ReplaceAll(p, "\\", "/")
+		if len(p) >= 2 && p[1] == ':' {
+			p = p[:1] + p[2:]
+		}
+		targets = append(targets, path.Clean("/"+p))
+	}
+	return targets
+}
+
+func (sfs *FS) loadTree(id restic.ID) (*restic.Tree, error) {
+	if tree, ok := sfs.trees.Get(id); ok {
+		return tree, nil
+	}
+
+	tree, err := restic.LoadTree(sfs.ctx, sfs.repo, id)
+	if err != nil {
+		return nil, err
+	}
+	sfs.trees.Add(id, tree)
+	return tree, nil
+}
+
+// lookup returns the node for the absolute path name. The root directory is
+// represented by a node without metadata except for the snapshot time.
+func (sfs *FS) lookup(op, name string) (*restic.Node, error) {
+	name = path.Clean("/" + name)
+
+	node := &restic.Node{
+		Name:    "/",
+		Type:    "dir",
+		Mode:    os.ModeDir | 0755,
+		ModTime: sfs.sn.Time,
+		Subtree: sfs.sn.Tree,
+	}
+	if name == "/" {
+		return node, nil
+	}
+
+	for _, elem := range strings.Split(name[1:], "/") {
+		if node.Type != "dir" || node.Subtree == nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+
+		tree, err := sfs.loadTree(*node.Subtree)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: err}
+		}
+
+		node = tree.Find(elem)
+		if node == nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+	}
+
+	return node, nil
+}
+
+// Capabilities returns the features supported by the file system, which are
+// those recorded in the nodes of the snapshot.
+func (sfs *FS) Capabilities() fs.Capabilities {
+	return fs.CapXattrs | fs.CapACLs | fs.CapDeviceIDs | fs.CapInodes
+}
+
+// Open opens a file or directory for reading.
+func (sfs *FS) Open(name string) (fs.File, error) {
+	return sfs.OpenFile(name, fs.O_RDONLY, 0)
+}
+
+// OpenFile opens a file or directory for reading, only the flags O_RDONLY and
+// O_NOFOLLOW are supported.
+func (sfs *FS) OpenFile(name string, flag int, _ os.FileMode) (fs.File, error) {
+	if flag & ^(fs.O_RDONLY|fs.O_NOFOLLOW) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name,
+			Err: fmt.Errorf("invalid combination of flags 0x%x", flag)}
+	}
+
+	node, err := sfs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.Type == "dir" {
+		return &dir{fs: sfs, name: name, node: node}, nil
+	}
+
+	f := &file{fs: sfs, name: name, node: node, cached: -1}
+	if node.Type == "file" {
+		// offsets[i] is the position of content blob i within the file
+		f.offsets = make([]int64, len(node.Content)+1)
+		for i, id := range node.Content {
+			size, found := sfs.repo.LookupBlobSize(id, restic.DataBlob)
+			if !found {
+				return nil, &os.PathError{Op: "open", Path: name,
+					Err: errors.Errorf("blob %v not found in repository", id.Str())}
+			}
+			f.offsets[i+1] = f.offsets[i] + int64(size)
+		}
+	}
+	return f, nil
+}
+
+// Stat returns a FileInfo describing the named file. As symbolic links are
+// not followed, this is the same as Lstat.
+func (sfs *FS) Stat(name string) (os.FileInfo, error) {
+	return sfs.Lstat(name)
+}
+
+// Lstat returns the FileInfo structure describing the named file.
+func (sfs *FS) Lstat(name string) (os.FileInfo, error) {
+	node, err := sfs.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(node), nil
+}
+
+// Abs returns an absolute representation of path.
+func (sfs *FS) Abs(p string) (string, error) {
+	return path.Clean("/" + filepath.ToSlash(p)), nil
+}
+
+// fileInfo describes a node of the snapshot.
+type fileInfo struct {
+	node *restic.Node
+	mode os.FileMode
+	meta *fs.Metadata
+}
+
+var nodeTypeModes = map[string]os.FileMode{
+	"dir":     os.ModeDir,
+	"symlink": os.ModeSymlink,
+	"dev":     os.ModeDevice,
+	"chardev": os.ModeDevice | os.ModeCharDevice,
+	"fifo":    os.ModeNamedPipe,
+	"socket":  os.ModeSocket,
+}
+
+func newFileInfo(node *restic.Node) *fileInfo {
+	meta := &fs.Metadata{
+		DeviceID:   node.DeviceID,
+		Inode:      node.Inode,
+		Links:      node.Links,
+		UID:        node.UID,
+		GID:        node.GID,
+		User:       node.User,
+		Group:      node.Group,
+		Device:     node.Device,
+		AccessTime: node.AccessTime,
+		ChangeTime: node.ChangeTime,
+		LinkTarget: node.LinkTarget,
+	}
+	for _, attr := range node.ExtendedAttributes {
+		meta.ExtendedAttributes = append(meta.ExtendedAttributes, fs.ExtendedAttribute{
+			Name:  attr.Name,
+			Value: attr.Value,
+		})
+	}
+
+	return &fileInfo{
+		node: node,
+		mode: nodeTypeModes[node.Type] | node.Mode&^os.ModeType,
+		meta: meta,
+	}
+}
+
+func (fi *fileInfo) Name() string       { return fi.node.Name }
+func (fi *fileInfo) Size() int64        { return int64(fi.node.Size) }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.node.ModTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.meta }
+
+// file is a node of the snapshot opened for reading. Only regular files have
+// content, which is loaded blob by blob.
+type file struct {
+	fs      *FS
+	name    string
+	node    *restic.Node
+	offsets []int64
+
+	m      sync.Mutex
+	pos    int64
+	buf    []byte
+	cached int // index of the blob in buf
+}
+
+// ensure that file implements fs.File and io.ReaderAt
+var _ fs.File = &file{}
+var _ io.ReaderAt = &file{}
+
+func (f *file) size() int64 {
+	if len(f.offsets) == 0 {
+		return 0
+	}
+	return f.offsets[len(f.offsets)-1]
+}
+
+// blobAt returns the index of the blob containing the byte at offset off.
+func (f *file) blobAt(off int64) int {
+	return sort.Search(len(f.node.Content), func(i int) bool {
+		return f.offsets[i+1] > off
+	})
+}
+
+func (f *file) loadBlob(i int, buf []byte) ([]byte, error) {
+	buf, err := f.fs.repo.LoadBlob(f.fs.ctx, restic.DataBlob, f.node.Content[i], buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	return buf, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.pos >= f.size() {
+		return 0, io.EOF
+	}
+
+	i := f.blobAt(f.pos)
+	if f.cached != i {
+		buf, err := f.loadBlob(i, f.buf)
+		if err != nil {
+			f.cached = -1
+			return 0, err
+		}
+		f.buf, f.cached = buf, i
+	}
+
+	n := copy(p, f.buf[f.pos-f.offsets[i]:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes starting at offset off. It does not share any
+// state with Read, so it can be called concurrently.
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	var buf []byte
+	var n int
+	for len(p) > 0 {
+		if off >= f.size() {
+			return n, io.EOF
+		}
+
+		i := f.blobAt(off)
+		var err error
+		buf, err = f.loadBlob(i, buf)
+		if err != nil {
+			return n, err
+		}
+
+		c := copy(p, buf[off-f.offsets[i]:])
+		n += c
+		off += int64(c)
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	pos := f.pos
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos += offset
+	case io.SeekEnd:
+		pos = f.size() + offset
+	}
+	if pos < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *file) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.buf, f.cached = nil, -1
+	return nil
+}
+
+func (f *file) Fd() uintptr {
+	return 0
+}
+
+func (f *file) Readdirnames(_ int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdirnames", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+func (f *file) Readdir(_ int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return newFileInfo(f.node), nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+// dir is a directory of the snapshot. The tree is loaded when Readdir or
+// Readdirnames is called.
+type dir struct {
+	fs   *FS
+	name string
+	node *restic.Node
+}
+
+// ensure that dir implements fs.File
+var _ fs.File = &dir{}
+
+func (d *dir) Read(_ []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Seek(int64, int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Fd() uintptr {
+	return 0
+}
+
+func (d *dir) nodes() ([]*restic.Node, error) {
+	if d.node.Subtree == nil {
+		return nil, nil
+	}
+
+	tree, err := d.fs.loadTree(*d.node.Subtree)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: d.name, Err: err}
+	}
+	return tree.Nodes, nil
+}
+
+// Readdirnames returns the names of the directory entries. Only n <= 0 is
+// supported.
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	if n > 0 {
+		return nil, &os.PathError{Op: "readdirnames", Path: d.name, Err: errors.New("not implemented")}
+	}
+
+	nodes, err := d.nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	return names, nil
+}
+
+// Readdir returns the entries of the directory. Only n <= 0 is supported.
+func (d *dir) Readdir(n int) ([]os.FileInfo, error) {
+	if n > 0 {
+		return nil, &os.PathError{Op: "readdir", Path: d.name, Err: errors.New("not implemented")}
+	}
+
+	nodes, err := d.nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]os.FileInfo, 0, len(nodes))
+	for _, node := range nodes {
+		entries = append(entries, newFileInfo(node))
+	}
+	return entries, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return newFileInfo(d.node), nil
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
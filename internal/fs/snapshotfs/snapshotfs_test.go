@@ -0,0 +1,203 @@
+package snapshotfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func testSnapshot(t testing.TB) (restic.Repository, *restic.Snapshot, string, []byte) {
+	tempdir := rtest.TempDir(t)
+	large := make([]byte, 5*1024*1024+123)
+	_, err := rand.New(rand.NewSource(23)).Read(large)
+	rtest.OK(t, err)
+
+	archiver.TestCreateFiles(t, tempdir, archiver.TestDir{
+		"large": archiver.TestFile{Content: string(large)},
+		"empty": archiver.TestFile{Content: ""},
+		"sub": archiver.TestDir{
+			"file": archiver.TestFile{Content: "sub file"},
+		},
+		"link": archiver.TestSymlink{Target: "large"},
+	})
+
+	repo := repository.TestRepository(t)
+	arch := archiver.New(repo, fs.Local{}, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{tempdir}, archiver.SnapshotOptions{
+		Time:     time.Now(),
+		Hostname: "localhost",
+	})
+	rtest.OK(t, err)
+
+	return repo, sn, tempdir, large
+}
+
+func TestFS(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("snapshot paths differ on Windows")
+	}
+
+	repo, sn, tempdir, large := testSnapshot(t)
+	sfs, err := New(context.TODO(), repo, sn)
+	rtest.OK(t, err)
+	defer func() {
+		rtest.OK(t, sfs.Close())
+	}()
+
+	rtest.Equals(t, []string{tempdir}, sfs.Targets())
+
+	f, err := sfs.Open(tempdir)
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	rtest.Equals(t, []string{"empty", "large", "link", "sub"}, names)
+
+	for _, name := range []string{"large", "link", "sub"} {
+		want, err := os.Lstat(filepath.Join(tempdir, name))
+		rtest.OK(t, err)
+		fi, err := sfs.Lstat(filepath.Join(tempdir, name))
+		rtest.OK(t, err)
+
+		rtest.Equals(t, want.Mode(), fi.Mode())
+		rtest.Assert(t, want.ModTime().Equal(fi.ModTime()), "%v: wrong mtime %v", name, fi.ModTime())
+		if want.Mode().IsRegular() {
+			rtest.Equals(t, want.Size(), fi.Size())
+		}
+
+		meta, ok := fs.MetadataOf(fi)
+		rtest.Assert(t, ok, "no metadata for %v", name)
+		rtest.Equals(t, fs.ExtendedStat(want).Inode, meta.Inode)
+	}
+
+	fi, err := sfs.Lstat(filepath.Join(tempdir, "link"))
+	rtest.OK(t, err)
+	meta, _ := fs.MetadataOf(fi)
+	rtest.Equals(t, "large", meta.LinkTarget)
+
+	f, err = sfs.Open(filepath.Join(tempdir, "large"))
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.Assert(t, bytes.Equal(large, buf), "wrong content")
+
+	ra, ok := fs.ReaderAt(f)
+	rtest.Assert(t, ok, "file does not implement io.ReaderAt")
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 20; i++ {
+		off := rnd.Int63n(int64(len(large)))
+		p := make([]byte, rnd.Intn(2*1024*1024))
+		n, err := ra.ReadAt(p, off)
+		if off+int64(len(p)) > int64(len(large)) {
+			rtest.Equals(t, io.EOF, err)
+		} else {
+			rtest.OK(t, err)
+		}
+		rtest.Assert(t, bytes.Equal(large[off:off+int64(n)], p[:n]), "wrong content at offset %d", off)
+	}
+	rtest.OK(t, f.Close())
+
+	rtest.Equals(t, "", readFile(t, sfs, filepath.Join(tempdir, "empty")))
+	rtest.Equals(t, "sub file", readFile(t, sfs, filepath.Join(tempdir, "sub", "file")))
+
+	_, err = sfs.Lstat(filepath.Join(tempdir, "missing"))
+	rtest.Assert(t, os.IsNotExist(err), "unexpected error %v", err)
+	_, err = sfs.Lstat(filepath.Join(tempdir, "large", "file"))
+	rtest.Assert(t, err != nil, "expected error for path below file")
+}
+
+func TestCancel(t *testing.T) {
+	repo, sn, _, _ := testSnapshot(t)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	sfs, err := New(ctx, repo, sn)
+	rtest.OK(t, err)
+
+	f, err := sfs.Open(sfs.Targets()[0] + "/large")
+	rtest.OK(t, err)
+	cancel()
+
+	_, err = io.ReadAll(f)
+	rtest.Assert(t, err != nil, "expected error after cancellation")
+	_, err = sfs.Open(sfs.Targets()[0] + "/sub/file")
+	rtest.Assert(t, err != nil, "expected error after cancellation")
+}
+
+func TestArchiver(t *testing.T) {
+	repo, sn, tempdir, _ := testSnapshot(t)
+	sfs, err := New(context.TODO(), repo, sn)
+	rtest.OK(t, err)
+
+	arch := archiver.New(repo, sfs, archiver.Options{})
+	arch.SelectByName = func(item string) bool {
+		return path.Base(item) != "sub"
+	}
+	filtered, _, err := arch.Snapshot(context.TODO(), sfs.Targets(), archiver.SnapshotOptions{
+		Time:     time.Now(),
+		Hostname: "localhost",
+	})
+	rtest.OK(t, err)
+
+	orig := loadDir(t, repo, *sn.Tree, sfs.Targets()[0])
+	nodes := loadDir(t, repo, *filtered.Tree, sfs.Targets()[0])
+	rtest.Equals(t, 3, len(nodes.Nodes))
+	rtest.Assert(t, nodes.Find("sub") == nil, "excluded directory was saved")
+
+	for _, name := range []string{"empty", "large", "link"} {
+		want, node := orig.Find(name), nodes.Find(name)
+		rtest.Assert(t, node != nil, "%v not found in %v", name, tempdir)
+		rtest.Equals(t, want.Type, node.Type)
+		rtest.Equals(t, want.Mode, node.Mode)
+		rtest.Equals(t, want.Size, node.Size)
+		rtest.Equals(t, want.Content, node.Content)
+		rtest.Equals(t, want.UID, node.UID)
+		rtest.Equals(t, want.Inode, node.Inode)
+		rtest.Equals(t, want.LinkTarget, node.LinkTarget)
+		rtest.Assert(t, want.ModTime.Equal(node.ModTime), "%v: wrong mtime %v", name, node.ModTime)
+	}
+}
+
+func readFile(t testing.TB, sfs *FS, name string) string {
+	f, err := sfs.Open(name)
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return string(buf)
+}
+
+// loadDir returns the tree for the directory dir within the tree id.
+func loadDir(t testing.TB, repo restic.Repository, id restic.ID, dir string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, elem := range splitPath(dir) {
+		node := tree.Find(elem)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", elem)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
+
+func splitPath(p string) []string {
+	var elems []string
+	for p != "/" && p != "." {
+		elems = append([]string{path.Base(p)}, elems...)
+		p = path.Dir(p)
+	}
+	return elems
+}
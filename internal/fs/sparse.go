@@ -0,0 +1,44 @@
+package fs
+
+import "os"
+
+// SparseFile is implemented by files which can report the location of holes,
+// for example via SEEK_DATA and SEEK_HOLE.
+type SparseFile interface {
+	// NextData returns the start of the first data region at or after
+	// offset and the start of the hole following it. If there is no more data
+	// after offset, io.EOF is returned.
+	NextData(offset int64) (data, hole int64, err error)
+}
+
+// Sparse returns f as a SparseFile if it supports finding holes. Wrapped
+// files which provide an Unwrap method are unwrapped first.
+func Sparse(f File) (SparseFile, bool) {
+	for {
+		if sf, ok := f.(SparseFile); ok {
+			return sf, true
+		}
+
+		if osf, ok := f.(*os.File); ok {
+			return newOSSparseFile(osf)
+		}
+
+		w, ok := f.(interface{ Unwrap() File })
+		if !ok {
+			return nil, false
+		}
+		f = w.Unwrap()
+	}
+}
+
+// AllocatedSize returns the number of bytes allocated on disk for the file. If
+// the file system does not report it, ok is false.
+func (fi ExtendedFileInfo) AllocatedSize() (size uint64, ok bool) {
+	// BlockSize is only set if the information came from stat()
+	if fi.BlockSize <= 0 || fi.Blocks < 0 {
+		return 0, false
+	}
+
+	// st_blocks is always counted in units of 512 bytes
+	return uint64(fi.Blocks) * 512, true
+}
@@ -0,0 +1,39 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// osSparseFile finds holes with lseek(2).
+type osSparseFile struct {
+	f *os.File
+}
+
+func newOSSparseFile(f *os.File) (SparseFile, bool) {
+	return osSparseFile{f: f}, true
+}
+
+// NextData uses SEEK_DATA and SEEK_HOLE to find the next data region. This
+// modifies the file offset, so the data must be read with ReadAt.
+func (f osSparseFile) NextData(offset int64) (data, hole int64, err error) {
+	fd := int(f.f.Fd())
+
+	data, err = unix.Seek(fd, offset, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		return 0, 0, io.EOF
+	}
+	if err != nil {
+		return 0, 0, &os.PathError{Op: "seek", Path: f.f.Name(), Err: err}
+	}
+
+	hole, err = unix.Seek(fd, data, unix.SEEK_HOLE)
+	if err != nil {
+		return 0, 0, &os.PathError{Op: "seek", Path: f.f.Name(), Err: err}
+	}
+
+	return data, hole, nil
+}
@@ -0,0 +1,45 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestSparseNextData(t *testing.T) {
+	const size = 4 * 1024 * 1024
+	const dataOffset = 2 * 1024 * 1024
+
+	f, err := os.Create(filepath.Join(rtest.TempDir(t), "sparse"))
+	rtest.OK(t, err)
+	defer func() {
+		rtest.OK(t, f.Close())
+	}()
+
+	rtest.OK(t, f.Truncate(size))
+	_, err = f.WriteAt([]byte("data"), dataOffset)
+	rtest.OK(t, err)
+
+	// the file must be found behind wrappers
+	sf, ok := Sparse(&trackFile{File: f})
+	rtest.Assert(t, ok, "file does not support finding holes")
+
+	data, hole, err := sf.NextData(0)
+	rtest.OK(t, err)
+	if data == 0 && hole == size {
+		t.Skip("file system does not report holes")
+	}
+
+	if data > dataOffset || hole <= dataOffset {
+		t.Fatalf("data region [%d, %d) does not contain offset %d", data, hole, dataOffset)
+	}
+
+	_, _, err = sf.NextData(hole)
+	if hole < size {
+		// the rest of the file is a hole
+		rtest.Equals(t, io.EOF, err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import "os"
+
+func newOSSparseFile(_ *os.File) (SparseFile, bool) {
+	return nil, false
+}
@@ -31,5 +31,9 @@ func ExtendedStat(fi os.FileInfo) ExtendedFileInfo {
 		panic("os.FileInfo is nil")
 	}
 
+	if meta, ok := MetadataOf(fi); ok {
+		return meta.extendedStat(fi)
+	}
+
 	return extendedStat(fi)
 }
@@ -0,0 +1,314 @@
+// Package tarfs provides a read-only file system with the contents of a tar
+// archive.
+package tarfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/fs/memfs"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// FS is a read-only file system which contains the entries of a tar archive.
+// Tar archives can only be read sequentially, so New reads the whole archive
+// and builds the directory tree from the paths of the entries. Since the
+// archiver reads files in a different order, the contents of files are
+// stored in a spill file, unless the archive is an uncompressed regular
+// file, from which the contents are read directly.
+type FS struct {
+	*memfs.Tree
+
+	archive *os.File
+
+	spillDir  string
+	spill     *os.File
+	spillSize int64
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// Open returns a file system for the tar archive filename, which may be
+// compressed with gzip, bzip2 or zstd. If filename is "-", the archive is
+// read from stdin. File contents are stored in a temporary file in spillDir
+// (or the default directory for temporary files, if spillDir is empty) if
+// they cannot be read from the archive directly.
+func Open(filename string, spillDir string) (*FS, error) {
+	if filename == "-" {
+		return New(os.Stdin, spillDir)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if fi.Mode().IsRegular() {
+		magic := make([]byte, 4)
+		n, _ := f.ReadAt(magic, 0)
+		if compression(magic[:n]) == "" {
+			fsys := newFS(spillDir)
+			fsys.archive = f
+			if err := fsys.read(f, f); err != nil {
+				_ = fsys.Close()
+				return nil, err
+			}
+			return fsys, nil
+		}
+	}
+
+	fsys, err := New(f, spillDir)
+	_ = f.Close()
+	return fsys, err
+}
+
+// New reads the (possibly compressed) tar archive from rd and returns a file
+// system with its entries. The contents of all files are stored in a
+// temporary file in spillDir, which is removed when the file system is
+// closed.
+func New(rd io.Reader, spillDir string) (*FS, error) {
+	br := bufio.NewReader(rd)
+	magic, _ := br.Peek(4)
+
+	var src io.Reader = br
+	switch compression(magic) {
+	case "gzip":
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		defer func() {
+			_ = zr.Close()
+		}()
+		src = zr
+	case "bzip2":
+		src = bzip2.NewReader(br)
+	case "zstd":
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "zstd")
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	fsys := newFS(spillDir)
+	if err := fsys.read(src, nil); err != nil {
+		_ = fsys.Close()
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// compression returns the name of the compression format detected from the
+// first bytes of a file, or the empty string.
+func compression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return "bzip2"
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	}
+	return ""
+}
+
+func newFS(spillDir string) *FS {
+	return &FS{
+		Tree:     memfs.NewTree(),
+		spillDir: spillDir,
+	}
+}
+
+// read adds the entries of the archive read from rd. If archive is set, it
+// must provide the same data as rd, and file contents are read from it at the
+// offsets where rd was positioned. Otherwise the contents are copied to the
+// spill file.
+func (fsys *FS) read(rd io.Reader, archive io.ReaderAt) error {
+	seeker, _ := rd.(io.Seeker)
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "tar")
+		}
+
+		n, err := NewNode(fsys.Tree, hdr)
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeGNUSparse {
+			var data io.ReaderAt
+			var offset int64
+			if archive != nil && seeker != nil && !IsSparse(hdr) {
+				// read the content directly from the archive
+				offset, err = seeker.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return errors.Wrap(err, "Seek")
+				}
+				data = archive
+			} else {
+				data, offset, n.Size, err = fsys.spillContent(tr)
+				if err != nil {
+					return err
+				}
+			}
+			n.Content = section(data, offset, n.Size)
+		}
+
+		fsys.Put(hdr.Name, n)
+	}
+
+	return nil
+}
+
+// section returns a content function for the size bytes at offset in data.
+func section(data io.ReaderAt, offset, size int64) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		return io.NewSectionReader(data, offset, size), nil
+	}
+}
+
+// spillContent copies the content of the current entry of tr to the end of
+// the spill file, which is created on first use.
+func (fsys *FS) spillContent(tr *tar.Reader) (data io.ReaderAt, offset, size int64, err error) {
+	if fsys.spill == nil {
+		fsys.spill, err = os.CreateTemp(fsys.spillDir, "restic-tar-")
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	offset = fsys.spillSize
+	size, err = io.Copy(fsys.spill, tr)
+	if err != nil {
+		return nil, 0, 0, errors.Wrap(err, "spill")
+	}
+	fsys.spillSize += size
+	return fsys.spill, offset, size, nil
+}
+
+// IsSparse returns true if the entry is a sparse file. The content of such
+// files is not stored contiguously in the archive.
+func IsSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// mkdev encodes a device number like the Linux kernel does.
+func mkdev(major, minor int64) uint64 {
+	maj, min := uint64(major), uint64(minor)
+	return (maj&0xfffff000)<<32 | (maj&0xfff)<<8 | (min&0xffffff00)<<12 | (min & 0xff)
+}
+
+const xattrPrefix = "SCHILY.xattr."
+
+// NewNode returns the node of t for the entry hdr of a tar archive. The
+// content of regular files is not set. Hard links share the content and the
+// metadata of the linked file, which must have been stored in t before. Nil
+// is returned for entries of unsupported types.
+func NewNode(t *memfs.Tree, hdr *tar.Header) (*memfs.Node, error) {
+	n := &memfs.Node{
+		Mode:    hdr.FileInfo().Mode(),
+		ModTime: hdr.ModTime,
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		n.Size = hdr.Size
+	case tar.TypeLink:
+		target := t.Lookup(hdr.Linkname)
+		if target == nil || !target.Mode.IsRegular() {
+			return nil, errors.Errorf("%v: hard link to unknown file %v", hdr.Name, hdr.Linkname)
+		}
+		// all links share the content and the inode of the first one
+		target.Meta.Links++
+		n.Mode, n.Size, n.Content, n.Meta = target.Mode, target.Size, target.Content, target.Meta
+		return n, nil
+	case tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+	default:
+		debug.Log("skipping %v with unsupported type %c", hdr.Name, hdr.Typeflag)
+		return nil, nil
+	}
+
+	meta := t.NewMetadata()
+	meta.UID, meta.GID = uint32(hdr.Uid), uint32(hdr.Gid)
+	meta.User, meta.Group = hdr.Uname, hdr.Gname
+	meta.AccessTime, meta.ChangeTime = hdr.AccessTime, hdr.ChangeTime
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		meta.LinkTarget = hdr.Linkname
+	case tar.TypeChar, tar.TypeBlock:
+		meta.Device = mkdev(hdr.Devmajor, hdr.Devminor)
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+		meta.ExtendedAttributes = append(meta.ExtendedAttributes, fs.ExtendedAttribute{
+			Name:  strings.TrimPrefix(key, xattrPrefix),
+			Value: []byte(value),
+		})
+	}
+
+	n.Meta = meta
+	return n, nil
+}
+
+// Close closes the archive and removes the spill file.
+func (fsys *FS) Close() error {
+	var err error
+	if fsys.archive != nil {
+		err = fsys.archive.Close()
+	}
+	if fsys.spill != nil {
+		if cerr := fsys.spill.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if rerr := os.Remove(fsys.spill.Name()); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// Capabilities returns the features supported by the file system. The inode
+// numbers are assigned while reading the archive, so that hard links within
+// the archive can be detected.
+func (fsys *FS) Capabilities() fs.Capabilities {
+	return fs.CapXattrs | fs.CapDeviceIDs | fs.CapInodes
+}
@@ -0,0 +1,209 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var longName = "dir/" + strings.Repeat("very-long-directory-name/", 8) + "file"
+
+// testArchive returns an uncompressed tar archive.
+func testArchive(t testing.TB) []byte {
+	mtime := time.Unix(1600000000, 0)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0700, ModTime: mtime}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755, ModTime: mtime, Uid: 1000, Gid: 100, Uname: "user", Gname: "users"}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "dir/zeta", Mode: 0644, ModTime: mtime, Uid: 1000, Gid: 100, Uname: "user", Gname: "users"},
+			data: "zeta content"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "dir/alpha", Mode: 0600, ModTime: mtime.Add(time.Hour), Uid: 1001, Gid: 1001,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.comment": "hello"}, Format: tar.FormatPAX},
+			data: "alpha content"},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "dir/link", Linkname: "alpha", Mode: 0777, ModTime: mtime}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "dir/hardlink", Linkname: "dir/zeta", Mode: 0644, ModTime: mtime, Uid: 1000, Gid: 100}},
+		{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "dir/null", Devmajor: 1, Devminor: 3, Mode: 0666, ModTime: mtime}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: longName, Mode: 0644, ModTime: mtime}, data: "deeply nested"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./implicit/sub/file", Mode: 0644, ModTime: mtime}, data: "implicit parents"},
+	} {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		rtest.OK(t, tw.WriteHeader(&hdr))
+		_, err := io.WriteString(tw, e.data)
+		rtest.OK(t, err)
+	}
+	rtest.OK(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipData(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	rtest.OK(t, err)
+	rtest.OK(t, zw.Close())
+	return buf.Bytes()
+}
+
+func zstdData(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	rtest.OK(t, err)
+	_, err = zw.Write(data)
+	rtest.OK(t, err)
+	rtest.OK(t, zw.Close())
+	return buf.Bytes()
+}
+
+func testFilesystems(t *testing.T) map[string]*FS {
+	tempdir := rtest.TempDir(t)
+	archive := testArchive(t)
+
+	filename := filepath.Join(tempdir, "archive.tar")
+	rtest.OK(t, os.WriteFile(filename, archive, 0600))
+	direct, err := Open(filename, tempdir)
+	rtest.OK(t, err)
+
+	gzipped, err := New(bytes.NewReader(gzipData(t, archive)), tempdir)
+	rtest.OK(t, err)
+
+	zstdFilename := filepath.Join(tempdir, "archive.tar.zst")
+	rtest.OK(t, os.WriteFile(zstdFilename, zstdData(t, archive), 0600))
+	zstded, err := Open(zstdFilename, tempdir)
+	rtest.OK(t, err)
+
+	filesystems := map[string]*FS{"direct": direct, "gzip": gzipped, "zstd": zstded}
+	for _, fsys := range filesystems {
+		fsys := fsys
+		t.Cleanup(func() {
+			rtest.OK(t, fsys.Close())
+		})
+	}
+	return filesystems
+}
+
+func readFile(t testing.TB, fsys fs.FS, name string) string {
+	f, err := fsys.Open(name)
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return string(buf)
+}
+
+func TestFS(t *testing.T) {
+	for name, fsys := range testFilesystems(t) {
+		t.Run(name, func(t *testing.T) {
+			f, err := fsys.Open("/dir")
+			rtest.OK(t, err)
+			names, err := f.Readdirnames(-1)
+			rtest.OK(t, err)
+			rtest.OK(t, f.Close())
+			rtest.Equals(t, []string{"zeta", "alpha", "link", "hardlink", "null", "very-long-directory-name"}, names)
+
+			rtest.Equals(t, "zeta content", readFile(t, fsys, "/dir/zeta"))
+			rtest.Equals(t, "alpha content", readFile(t, fsys, "/dir/alpha"))
+			rtest.Equals(t, "zeta content", readFile(t, fsys, "/dir/hardlink"))
+			rtest.Equals(t, "deeply nested", readFile(t, fsys, "/"+longName))
+			rtest.Equals(t, "implicit parents", readFile(t, fsys, "/implicit/sub/file"))
+
+			fi, err := fsys.Lstat("/")
+			rtest.OK(t, err)
+			rtest.Equals(t, os.ModeDir|0700, fi.Mode())
+
+			fi, err = fsys.Lstat("/implicit/sub")
+			rtest.OK(t, err)
+			rtest.Assert(t, fi.IsDir(), "implicit parent is not a directory")
+
+			_, err = fsys.Lstat("/dir/missing")
+			rtest.Assert(t, os.IsNotExist(err), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestArchiver(t *testing.T) {
+	for name, fsys := range testFilesystems(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := repository.TestRepository(t)
+
+			arch := archiver.New(repo, fsys, archiver.Options{})
+			sn, _, err := arch.Snapshot(context.TODO(), []string{"/"}, archiver.SnapshotOptions{Time: time.Now()})
+			rtest.OK(t, err)
+
+			tree := loadTree(t, repo, *sn.Tree, "dir")
+			nodes := make(map[string]*restic.Node)
+			for _, node := range tree.Nodes {
+				nodes[node.Name] = node
+			}
+
+			zeta := nodes["zeta"]
+			rtest.Equals(t, "file", zeta.Type)
+			rtest.Equals(t, uint32(1000), zeta.UID)
+			rtest.Equals(t, uint32(100), zeta.GID)
+			rtest.Equals(t, "user", zeta.User)
+			rtest.Equals(t, "users", zeta.Group)
+			rtest.Equals(t, os.FileMode(0644), zeta.Mode)
+			rtest.Equals(t, uint64(2), zeta.Links)
+
+			hardlink := nodes["hardlink"]
+			rtest.Equals(t, zeta.Inode, hardlink.Inode)
+			rtest.Equals(t, zeta.Content, hardlink.Content)
+
+			alpha := nodes["alpha"]
+			rtest.Assert(t, alpha.ModTime.Equal(time.Unix(1600000000+3600, 0)), "wrong mtime %v", alpha.ModTime)
+			rtest.Equals(t, []restic.ExtendedAttribute{{Name: "user.comment", Value: []byte("hello")}}, alpha.ExtendedAttributes)
+
+			link := nodes["link"]
+			rtest.Equals(t, "symlink", link.Type)
+			rtest.Equals(t, "alpha", link.LinkTarget)
+
+			null := nodes["null"]
+			rtest.Equals(t, "chardev", null.Type)
+			rtest.Equals(t, uint64(1<<8|3), null.Device)
+
+			tree = loadTree(t, repo, *sn.Tree, strings.Split(longName, "/")[:9]...)
+			rtest.Equals(t, 1, len(tree.Nodes))
+			rtest.Equals(t, "file", tree.Nodes[0].Name)
+			rtest.Equals(t, uint64(len("deeply nested")), tree.Nodes[0].Size)
+		})
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	archive := testArchive(t)
+	_, err := New(bytes.NewReader(archive[:1500]), rtest.TempDir(t))
+	rtest.Assert(t, err != nil, "expected error for truncated archive")
+}
+
+func loadTree(t testing.TB, repo restic.Repository, id restic.ID, dirs ...string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, dir := range dirs {
+		node := tree.Find(dir)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", dir)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
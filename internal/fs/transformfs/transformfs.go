@@ -0,0 +1,589 @@
+package transformfs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/filter"
+	"github.com/restic/restic/internal/fs"
+)
+
+// Rename presents the file or directory Source of the wrapped file system at
+// the path Target.
+type Rename struct {
+	Source string
+	Target string
+}
+
+// Transform replaces the content of the regular files matching Pattern with
+// the output of Command, which reads the original content from stdin.
+type Transform struct {
+	// Pattern uses the syntax of exclude patterns and is matched against
+	// the path presented by the wrapper.
+	Pattern string
+	Command []string
+}
+
+// Options configure the wrapper.
+type Options struct {
+	Renames    []Rename
+	Transforms []Transform
+
+	// Stderr receives the standard error output of the commands, it is
+	// discarded if nil.
+	Stderr io.Writer
+}
+
+// FS wraps another file system. It presents files and directories below
+// different paths and optionally passes the content of files through external
+// commands. Paths not affected by a rename are passed through unchanged.
+//
+// The size of transformed files is not known before the command has run, it
+// is reported as zero.
+type FS struct {
+	fs.FS
+
+	ctx        context.Context
+	renames    []Rename
+	transforms []transform
+	// dirs maps the parent directories of the rename targets to the names
+	// of their children which must be listed in addition to the entries of
+	// the wrapped file system.
+	dirs   map[string][]string
+	stderr io.Writer
+}
+
+type transform struct {
+	patterns []filter.Pattern
+	command  []string
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// dirModTime is the modification time of parent directories of rename targets
+// which do not exist in the wrapped file system.
+var dirModTime = time.Unix(0, 0).UTC()
+
+// New returns a wrapper for inner. The commands are stopped when ctx is
+// cancelled.
+func New(ctx context.Context, inner fs.FS, opts Options) (*FS, error) {
+	wfs := &FS{
+		FS:     inner,
+		ctx:    ctx,
+		dirs:   make(map[string][]string),
+		stderr: opts.Stderr,
+	}
+	if wfs.stderr == nil {
+		wfs.stderr = io.Discard
+	}
+
+	for _, r := range opts.Renames {
+		source, err := inner.Abs(r.Source)
+		if err != nil {
+			return nil, err
+		}
+		target := inner.Clean(r.Target)
+		if !inner.IsAbs(target) || inner.Dir(target) == target {
+			return nil, errors.Errorf("invalid rename target %q, must be an absolute path below the root directory", r.Target)
+		}
+
+		for _, other := range wfs.renames {
+			if _, ok := wfs.within(target, other.Target); ok {
+				return nil, errors.Errorf("rename target %v is located within rename target %v", target, other.Target)
+			}
+			if _, ok := wfs.within(other.Target, target); ok {
+				return nil, errors.Errorf("rename target %v is located within rename target %v", other.Target, target)
+			}
+		}
+		wfs.renames = append(wfs.renames, Rename{Source: source, Target: target})
+
+		for dir := target; inner.Dir(dir) != dir; dir = inner.Dir(dir) {
+			parent := inner.Dir(dir)
+			names := wfs.dirs[parent]
+			if contains(names, inner.Base(dir)) {
+				break
+			}
+			wfs.dirs[parent] = append(names, inner.Base(dir))
+		}
+	}
+
+	for _, names := range wfs.dirs {
+		sort.Strings(names)
+	}
+
+	for _, t := range opts.Transforms {
+		if err := filter.ValidatePatterns([]string{t.Pattern}); err != nil {
+			return nil, err
+		}
+		if len(t.Command) == 0 {
+			return nil, errors.Errorf("no command given for pattern %q", t.Pattern)
+		}
+		wfs.transforms = append(wfs.transforms, transform{
+			patterns: filter.ParsePatterns([]string{t.Pattern}),
+			command:  t.Command,
+		})
+	}
+
+	return wfs, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// within returns the path of p relative to dir, if p is dir or located
+// within dir.
+func (wfs *FS) within(p, dir string) (string, bool) {
+	if p == dir {
+		return "", true
+	}
+	prefix := dir
+	if !strings.HasSuffix(prefix, wfs.Separator()) {
+		prefix += wfs.Separator()
+	}
+	if rel := strings.TrimPrefix(p, prefix); rel != p {
+		return rel, true
+	}
+	return "", false
+}
+
+// Target returns the path at which the file name of the wrapped file system is
+// presented. Paths which are not renamed are returned unchanged.
+func (wfs *FS) Target(name string) string {
+	abs, err := wfs.Abs(name)
+	if err != nil {
+		return name
+	}
+
+	best := -1
+	var bestRel string
+	for i, r := range wfs.renames {
+		rel, ok := wfs.within(abs, r.Source)
+		if ok && (best < 0 || len(r.Source) > len(wfs.renames[best].Source)) {
+			best, bestRel = i, rel
+		}
+	}
+	if best < 0 {
+		return name
+	}
+	if bestRel == "" {
+		return wfs.renames[best].Target
+	}
+	return wfs.Join(wfs.renames[best].Target, bestRel)
+}
+
+// source returns the path of name within the wrapped file system.
+func (wfs *FS) source(name string) string {
+	name = wfs.Clean(name)
+	for _, r := range wfs.renames {
+		if rel, ok := wfs.within(name, r.Target); ok {
+			if rel == "" {
+				return r.Source
+			}
+			return wfs.Join(r.Source, rel)
+		}
+	}
+	return name
+}
+
+// transform returns the command for the file name, if any.
+func (wfs *FS) transform(name string) []string {
+	for _, t := range wfs.transforms {
+		// the patterns have been validated in New()
+		if matched, _ := filter.List(t.patterns, name); matched {
+			return t.command
+		}
+	}
+	return nil
+}
+
+// Capabilities returns the capabilities of the wrapped file system.
+func (wfs *FS) Capabilities() fs.Capabilities {
+	return fs.CapabilitiesOf(wfs.FS)
+}
+
+// Open opens a file or directory for reading.
+func (wfs *FS) Open(name string) (fs.File, error) {
+	return wfs.OpenFile(name, fs.O_RDONLY, 0)
+}
+
+// OpenFile opens a file or directory. The content of regular files matching a
+// transform is the output of the command.
+func (wfs *FS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	name = wfs.Clean(name)
+	source := wfs.source(name)
+
+	f, err := wfs.FS.OpenFile(source, flag, perm)
+	if errors.Is(err, os.ErrNotExist) && wfs.isVirtualDir(name) {
+		return &dir{fs: wfs, name: name, names: wfs.dirs[name]}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if command := wfs.transform(name); command != nil && fi.Mode().IsRegular() {
+		tf, err := wfs.startCommand(f, name, source, fi, command)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return tf, nil
+	}
+
+	return &file{File: f, fs: wfs, name: name, source: source}, nil
+}
+
+// isVirtualDir returns true if name is a parent directory of a rename target.
+func (wfs *FS) isVirtualDir(name string) bool {
+	_, ok := wfs.dirs[name]
+	return ok
+}
+
+// Stat returns a FileInfo describing the named file.
+func (wfs *FS) Stat(name string) (os.FileInfo, error) {
+	return wfs.stat(name, wfs.FS.Stat)
+}
+
+// Lstat returns the FileInfo structure describing the named file. If the file
+// is a symbolic link, the returned FileInfo describes the symbolic link.
+func (wfs *FS) Lstat(name string) (os.FileInfo, error) {
+	return wfs.stat(name, wfs.FS.Lstat)
+}
+
+func (wfs *FS) stat(name string, stat func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	name = wfs.Clean(name)
+	source := wfs.source(name)
+
+	fi, err := stat(source)
+	if errors.Is(err, os.ErrNotExist) && wfs.isVirtualDir(name) {
+		return dirInfo{name: wfs.Base(name)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wfs.fileInfo(fi, name, source), nil
+}
+
+// fileInfo wraps fi, which describes the file source of the wrapped file
+// system presented at name.
+func (wfs *FS) fileInfo(fi os.FileInfo, name, source string) os.FileInfo {
+	return &fileInfo{
+		FileInfo:    fi,
+		name:        wfs.Base(name),
+		localPath:   fs.LocalPath(fi, source),
+		transformed: fi.Mode().IsRegular() && wfs.transform(name) != nil,
+	}
+}
+
+// fileInfo describes a file of the wrapped file system.
+type fileInfo struct {
+	os.FileInfo
+	name        string
+	localPath   string
+	transformed bool
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+// Size returns fs.SizeUnknown for transformed files, the size is unknown
+// until the command has run.
+func (fi *fileInfo) Size() int64 {
+	if fi.transformed {
+		return fs.SizeUnknown
+	}
+	return fi.FileInfo.Size()
+}
+
+// LocalPath returns the path within the wrapped file system, which is used
+// to read the metadata of files on the local file system.
+func (fi *fileInfo) LocalPath() string {
+	return fi.localPath
+}
+
+// dirInfo describes a parent directory of a rename target which does not
+// exist in the wrapped file system.
+type dirInfo struct {
+	name string
+}
+
+func (fi dirInfo) Name() string       { return fi.name }
+func (fi dirInfo) Size() int64        { return 0 }
+func (fi dirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (fi dirInfo) ModTime() time.Time { return dirModTime }
+func (fi dirInfo) IsDir() bool        { return true }
+
+// Sys returns metadata without owner information, so that the owner of the
+// directory does not depend on the user running restic.
+func (fi dirInfo) Sys() interface{} {
+	return &fs.Metadata{AccessTime: dirModTime, ChangeTime: dirModTime}
+}
+
+// file is a file or directory of the wrapped file system.
+type file struct {
+	fs.File
+	fs     *FS
+	name   string
+	source string
+}
+
+// ensure that file implements fs.File
+var _ fs.File = &file{}
+
+// Unwrap returns the file opened on the wrapped file system.
+func (f *file) Unwrap() fs.File {
+	return f.File
+}
+
+// Readdirnames returns the names of the entries, including rename targets
+// located in the directory.
+func (f *file) Readdirnames(n int) ([]string, error) {
+	names, err := f.File.Readdirnames(n)
+	if err != nil || n > 0 {
+		return names, err
+	}
+	for _, name := range f.fs.dirs[f.name] {
+		if !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Readdir returns information about the entries, including rename targets
+// located in the directory.
+func (f *file) Readdir(n int) ([]os.FileInfo, error) {
+	entries, err := f.File.Readdir(n)
+	if err != nil {
+		return entries, err
+	}
+
+	var names []string
+	for i, fi := range entries {
+		name := f.fs.Join(f.name, fi.Name())
+		entries[i] = f.fs.fileInfo(fi, name, f.fs.Join(f.source, fi.Name()))
+		names = append(names, fi.Name())
+	}
+
+	if n > 0 {
+		return entries, nil
+	}
+	for _, name := range f.fs.dirs[f.name] {
+		if contains(names, name) {
+			continue
+		}
+		fi, err := f.fs.Lstat(f.fs.Join(f.name, name))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fi)
+	}
+	return entries, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.fs.fileInfo(fi, f.name, f.source), nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+// dir is a parent directory of a rename target which does not exist in the
+// wrapped file system.
+type dir struct {
+	fs    *FS
+	name  string
+	names []string
+}
+
+// ensure that dir implements fs.File
+var _ fs.File = &dir{}
+
+func (d *dir) Read(_ []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Seek(int64, int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Fd() uintptr {
+	return 0
+}
+
+// Readdirnames returns the names of the children. Only n <= 0 is supported.
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	if n > 0 {
+		return nil, &os.PathError{Op: "readdirnames", Path: d.name, Err: errors.New("not implemented")}
+	}
+	return append([]string(nil), d.names...), nil
+}
+
+// Readdir returns information about the children. Only n <= 0 is supported.
+func (d *dir) Readdir(n int) ([]os.FileInfo, error) {
+	if n > 0 {
+		return nil, &os.PathError{Op: "readdir", Path: d.name, Err: errors.New("not implemented")}
+	}
+
+	entries := make([]os.FileInfo, 0, len(d.names))
+	for _, name := range d.names {
+		fi, err := d.fs.Lstat(d.fs.Join(d.name, name))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fi)
+	}
+	return entries, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return dirInfo{name: d.fs.Base(d.name)}, nil
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
+
+// transformedFile is a file whose content is the output of a command.
+type transformedFile struct {
+	orig   fs.File
+	fi     os.FileInfo
+	name   string
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+
+	// cmd.Wait() must only be called once
+	waited bool
+	err    error
+}
+
+// ensure that transformedFile implements fs.File
+var _ fs.File = &transformedFile{}
+
+// startCommand runs the command with the content of f as its input.
+func (wfs *FS) startCommand(f fs.File, name, source string, fi os.FileInfo, command []string) (*transformedFile, error) {
+	cmd := exec.CommandContext(wfs.ctx, command[0], command[1:]...)
+	cmd.Stdin = f
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup stdout pipe: %w", err)
+	}
+
+	// Use a Go routine to handle the stderr to avoid deadlocks
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, &os.PathError{Op: "transform", Path: name, Err: err}
+	}
+
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			_, _ = fmt.Fprintf(wfs.stderr, "subprocess %v: %v\n", command[0], sc.Text())
+		}
+	}()
+
+	return &transformedFile{
+		orig:   f,
+		fi:     wfs.fileInfo(fi, name, source),
+		name:   name,
+		cmd:    cmd,
+		stdout: stdout,
+	}, nil
+}
+
+// Read returns the output of the command. If the command fails, the error is
+// returned instead of io.EOF.
+func (f *transformedFile) Read(p []byte) (int, error) {
+	if f.waited {
+		return 0, f.err
+	}
+
+	n, err := f.stdout.Read(p)
+	if err == io.EOF {
+		err = f.wait()
+		if err == nil {
+			err = io.EOF
+		}
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *transformedFile) wait() error {
+	f.waited = true
+	err := f.cmd.Wait()
+	if err != nil {
+		return &os.PathError{Op: "transform", Path: f.name, Err: fmt.Errorf("command failed: %w", err)}
+	}
+	return nil
+}
+
+// Close stops the command if it is still running and closes the original
+// file.
+func (f *transformedFile) Close() error {
+	if !f.waited {
+		_ = f.cmd.Process.Kill()
+		_ = f.wait()
+	}
+	return f.orig.Close()
+}
+
+func (f *transformedFile) Seek(int64, int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.ESPIPE}
+}
+
+func (f *transformedFile) Fd() uintptr {
+	return f.orig.Fd()
+}
+
+func (f *transformedFile) Readdirnames(int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdirnames", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+func (f *transformedFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+func (f *transformedFile) Stat() (os.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *transformedFile) Name() string {
+	return f.name
+}
@@ -0,0 +1,220 @@
+package transformfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func testFS(t testing.TB, transforms ...Transform) (*FS, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("rename targets use Unix paths")
+	}
+
+	tempdir := rtest.TempDir(t)
+	archiver.TestCreateFiles(t, tempdir, archiver.TestDir{
+		"file": archiver.TestFile{Content: "not renamed"},
+		"app": archiver.TestDir{
+			"data":     archiver.TestFile{Content: "data"},
+			"app.log":  archiver.TestFile{Content: "log message"},
+			"link":     archiver.TestSymlink{Target: "data"},
+			"sub":      archiver.TestDir{"other.log": archiver.TestFile{Content: "other"}},
+			"data.bak": archiver.TestFile{Content: "backup"},
+		},
+	})
+
+	wfs, err := New(context.TODO(), fs.Local{}, Options{
+		Renames:    []Rename{{Source: filepath.Join(tempdir, "app"), Target: "/srv/app"}},
+		Transforms: transforms,
+	})
+	rtest.OK(t, err)
+	return wfs, tempdir
+}
+
+func upper(t testing.TB) Transform {
+	if _, err := exec.LookPath("tr"); err != nil {
+		t.Skip("tr not available")
+	}
+	return Transform{Pattern: "*.log", Command: []string{"tr", "a-z", "A-Z"}}
+}
+
+func readdirnames(t testing.TB, wfs *FS, name string) []string {
+	f, err := wfs.Open(name)
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return names
+}
+
+func readFile(t testing.TB, wfs *FS, name string) (string, error) {
+	f, err := wfs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, f.Close())
+	return string(buf), err
+}
+
+func TestNew(t *testing.T) {
+	for _, opts := range []Options{
+		{Renames: []Rename{{Source: "/a", Target: "/"}}},
+		{Renames: []Rename{{Source: "/a", Target: "relative"}}},
+		{Renames: []Rename{{Source: "/a", Target: "/x"}, {Source: "/b", Target: "/x/y"}}},
+		{Renames: []Rename{{Source: "/a", Target: "/x/y"}, {Source: "/b", Target: "/x"}}},
+		{Renames: []Rename{{Source: "/a", Target: "/x"}, {Source: "/b", Target: "/x"}}},
+		{Transforms: []Transform{{Pattern: "*.log"}}},
+		{Transforms: []Transform{{Pattern: "[", Command: []string{"cat"}}}},
+	} {
+		_, err := New(context.TODO(), fs.Local{}, opts)
+		rtest.Assert(t, err != nil, "expected error for %v", opts)
+	}
+}
+
+func TestRename(t *testing.T) {
+	wfs, tempdir := testFS(t)
+
+	rtest.Equals(t, "/srv/app/data", wfs.Target(filepath.Join(tempdir, "app", "data")))
+	rtest.Equals(t, "/srv/app", wfs.Target(filepath.Join(tempdir, "app")))
+	rtest.Equals(t, filepath.Join(tempdir, "file"), wfs.Target(filepath.Join(tempdir, "file")))
+
+	fi, err := wfs.Lstat("/srv")
+	if _, serr := os.Lstat("/srv"); os.IsNotExist(serr) {
+		rtest.OK(t, err)
+		rtest.Assert(t, fi.IsDir(), "parent of rename target is not a directory")
+		rtest.Equals(t, []string{"app"}, readdirnames(t, wfs, "/srv"))
+	}
+	rtest.Assert(t, strings.Contains(strings.Join(readdirnames(t, wfs, "/"), " "), "srv"),
+		"parent of rename target not listed")
+
+	fi, err = wfs.Lstat("/srv/app")
+	rtest.OK(t, err)
+	rtest.Equals(t, "app", fi.Name())
+	rtest.Equals(t, filepath.Join(tempdir, "app"), fs.LocalPath(fi, "/srv/app"))
+
+	names := readdirnames(t, wfs, "/srv/app")
+	sort.Strings(names)
+	rtest.Equals(t, []string{"app.log", "data", "data.bak", "link", "sub"}, names)
+
+	content, err := readFile(t, wfs, "/srv/app/data")
+	rtest.OK(t, err)
+	rtest.Equals(t, "data", content)
+
+	content, err = readFile(t, wfs, filepath.Join(tempdir, "file"))
+	rtest.OK(t, err)
+	rtest.Equals(t, "not renamed", content)
+
+	f, err := wfs.Open("/srv/app/sub")
+	rtest.OK(t, err)
+	entries, err := f.Readdir(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	rtest.Equals(t, 1, len(entries))
+	rtest.Equals(t, filepath.Join(tempdir, "app", "sub", "other.log"), fs.LocalPath(entries[0], ""))
+
+	f, err = wfs.Open("/srv/app/data")
+	rtest.OK(t, err)
+	rtest.Equals(t, "/srv/app/data", f.Name())
+	_, ok := fs.ReaderAt(f)
+	rtest.Assert(t, ok, "renamed file does not implement io.ReaderAt")
+	rtest.OK(t, f.Close())
+
+	_, err = wfs.Lstat("/srv/app/missing")
+	rtest.Assert(t, os.IsNotExist(err), "unexpected error %v", err)
+}
+
+func TestTransform(t *testing.T) {
+	wfs, _ := testFS(t, upper(t))
+
+	content, err := readFile(t, wfs, "/srv/app/app.log")
+	rtest.OK(t, err)
+	rtest.Equals(t, "LOG MESSAGE", content)
+	content, err = readFile(t, wfs, "/srv/app/sub/other.log")
+	rtest.OK(t, err)
+	rtest.Equals(t, "OTHER", content)
+	content, err = readFile(t, wfs, "/srv/app/data")
+	rtest.OK(t, err)
+	rtest.Equals(t, "data", content)
+
+	// the size of transformed files is unknown
+	fi, err := wfs.Lstat("/srv/app/app.log")
+	rtest.OK(t, err)
+	rtest.Equals(t, fs.SizeUnknown, fi.Size())
+	fi, err = wfs.Lstat("/srv/app/data")
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(len("data")), fi.Size())
+
+	f, err := wfs.Open("/srv/app/app.log")
+	rtest.OK(t, err)
+	_, ok := fs.ReaderAt(f)
+	rtest.Assert(t, !ok, "transformed file implements io.ReaderAt")
+	fi, err = f.Stat()
+	rtest.OK(t, err)
+	rtest.Equals(t, fs.SizeUnknown, fi.Size())
+	// closing the file before reading all data stops the command
+	rtest.OK(t, f.Close())
+}
+
+func TestTransformError(t *testing.T) {
+	if _, err := exec.LookPath("false"); err != nil {
+		t.Skip("false not available")
+	}
+	wfs, _ := testFS(t, Transform{Pattern: "*.log", Command: []string{"false"}})
+
+	_, err := readFile(t, wfs, "/srv/app/app.log")
+	rtest.Assert(t, err != nil, "expected error for failing command")
+	rtest.Assert(t, strings.Contains(err.Error(), "/srv/app/app.log"), "error %v does not contain the path", err)
+}
+
+func TestArchiver(t *testing.T) {
+	wfs, tempdir := testFS(t, upper(t))
+	repo := repository.TestRepository(t)
+
+	arch := archiver.New(repo, wfs, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{wfs.Target(filepath.Join(tempdir, "app"))}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+	rtest.Equals(t, []string{"/srv/app"}, sn.Paths)
+
+	tree := loadTree(t, repo, *sn.Tree, "srv", "app")
+	rtest.Equals(t, 5, len(tree.Nodes))
+
+	log := tree.Find("app.log")
+	rtest.Assert(t, log != nil, "app.log not found")
+	rtest.Equals(t, uint64(len("LOG MESSAGE")), log.Size)
+	rtest.Equals(t, 1, len(log.Content))
+	buf, err := repo.LoadBlob(context.TODO(), restic.DataBlob, log.Content[0], nil)
+	rtest.OK(t, err)
+	rtest.Equals(t, "LOG MESSAGE", string(buf))
+
+	// the link target must be read from the source path
+	link := tree.Find("link")
+	rtest.Assert(t, link != nil, "link not found")
+	rtest.Equals(t, "data", link.LinkTarget)
+}
+
+func loadTree(t testing.TB, repo restic.Repository, id restic.ID, dirs ...string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, dir := range dirs {
+		node := tree.Find(dir)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", dir)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
@@ -0,0 +1,95 @@
+package webdavfs
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/options"
+)
+
+// Config contains all information required to read files from a WebDAV
+// server.
+type Config struct {
+	// URL contains the scheme, host and credentials of the server, the
+	// path is always empty.
+	URL *url.URL
+
+	CACert      string `option:"cacert" help:"read the root certificates for the server from a PEM file (overrides --cacert)"`
+	Connections uint   `option:"connections" help:"set the number of concurrent requests (default: 2)"`
+	MaxRetries  uint   `option:"retries" help:"set the number of retries for throttled requests (default: 5)"`
+}
+
+// NewConfig returns a new config with default options applied.
+func NewConfig() Config {
+	return Config{
+		Connections: 2,
+		MaxRetries:  5,
+	}
+}
+
+func init() {
+	options.Register("webdav-source", Config{})
+}
+
+const prefix = "webdav:"
+
+// IsTarget returns true if s describes a directory or file on a WebDAV
+// server, e.g. webdav:https://host/path.
+func IsTarget(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// ParseTarget parses a target of the form webdav:https://user@host[:port]/path
+// and returns the configuration for the server and the path of the target on
+// the server. The path is absolute, the root directory "/" is the root of the
+// server.
+func ParseTarget(s string) (Config, string, error) {
+	if !IsTarget(s) {
+		return Config{}, "", errors.Errorf("invalid target %q, does not start with %q", s, prefix)
+	}
+
+	u, err := url.Parse(s[len(prefix):])
+	if err != nil {
+		return Config{}, "", errors.WithStack(err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Config{}, "", errors.Errorf("invalid target %q, scheme must be http or https", s)
+	}
+	if u.Host == "" {
+		return Config{}, "", errors.Errorf("invalid target %q, no host specified", s)
+	}
+
+	cfg := NewConfig()
+	cfg.URL = &url.URL{
+		Scheme: u.Scheme,
+		User:   u.User,
+		Host:   u.Host,
+	}
+	return cfg, path.Clean("/" + u.Path), nil
+}
+
+// SameServer returns true if both configurations describe the same server
+// and user.
+func (cfg Config) SameServer(other Config) bool {
+	return cfg.URL.Scheme == other.URL.Scheme && cfg.URL.Host == other.URL.Host &&
+		cfg.URL.User.Username() == other.URL.User.Username()
+}
+
+// ApplyEnvironment saves values from the environment to the config.
+func (cfg *Config) ApplyEnvironment(prefix string) {
+	username := cfg.URL.User.Username()
+	_, pwdSet := cfg.URL.User.Password()
+
+	// Only apply env variable values if neither username nor password are provided.
+	if username == "" && !pwdSet {
+		envName := os.Getenv(prefix + "RESTIC_WEBDAV_USERNAME")
+		envPwd := os.Getenv(prefix + "RESTIC_WEBDAV_PASSWORD")
+		if envName != "" || envPwd != "" {
+			cfg.URL.User = url.UserPassword(envName, envPwd)
+		}
+	}
+}
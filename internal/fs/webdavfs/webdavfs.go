@@ -0,0 +1,758 @@
+package webdavfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/restic/restic/internal/backend/webdav/davclient"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+
+	"github.com/cenkalti/backoff/v4"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// FS is a read-only file system which presents the files on a WebDAV server.
+// Directories are listed with PROPFIND requests, the content of files is read
+// with (ranged) GET requests. At most Config.Connections requests are active
+// at the same time, a request counts as active until its response body has
+// been closed.
+//
+// Requests which are rejected because the server is overloaded (429 Too Many
+// Requests, 503 Service Unavailable or 507 Insufficient Storage) are retried
+// with exponential backoff, respecting the Retry-After header. If the request
+// still fails, an error for the file is returned and handled by the error
+// policy of the archiver.
+type FS struct {
+	fs.SlashPaths
+
+	ctx    context.Context
+	client *http.Client
+	base   url.URL
+
+	sem        chan struct{}
+	maxRetries uint
+	newBackOff func() backoff.BackOff
+
+	// listings caches the entries found by Readdir, so that the following
+	// calls to Lstat for the directory entries do not need a request each.
+	listings *lru.Cache[string, map[string]os.FileInfo]
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// listingCacheSize is the number of directory listings kept in the cache.
+const listingCacheSize = 32
+
+// maxRetryAfter limits the delay requested by the server with Retry-After.
+const maxRetryAfter = time.Minute
+
+// dirModTime is the modification time of collections for which the server
+// does not report one.
+var dirModTime = time.Unix(0, 0).UTC()
+
+// Open returns a file system for the server described by cfg. All requests
+// are sent with ctx, as the methods of fs.FS do not take a context.
+func Open(ctx context.Context, cfg Config, rt http.RoundTripper) (*FS, error) {
+	if cfg.URL == nil || cfg.URL.Host == "" {
+		return nil, errors.New("no WebDAV server specified")
+	}
+	debug.Log("open, url %v", cfg.URL.Redacted())
+
+	n := cfg.Connections
+	if n == 0 {
+		n = 1
+	}
+
+	listings, err := lru.New[string, map[string]os.FileInfo](listingCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	password, _ := cfg.URL.User.Password()
+	client := &http.Client{
+		Transport: davclient.NewAuthTransport(rt, cfg.URL.User.Username(), password, ""),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// only follow redirects which keep the method, PROPFIND
+			// requests are redirected again by propfind
+			if req.Method != via[0].Method {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+
+	return &FS{
+		ctx:        ctx,
+		client:     client,
+		base:       url.URL{Scheme: cfg.URL.Scheme, Host: cfg.URL.Host},
+		sem:        make(chan struct{}, n),
+		maxRetries: cfg.MaxRetries,
+		newBackOff: func() backoff.BackOff {
+			return backoff.NewExponentialBackOff()
+		},
+		listings: listings,
+	}, nil
+}
+
+// Close releases the resources of the file system.
+func (wfs *FS) Close() error {
+	wfs.listings.Purge()
+	wfs.client.CloseIdleConnections()
+	return nil
+}
+
+// statusError is returned for unexpected responses of the server.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	if e.code == http.StatusPreconditionFailed {
+		return "file has been modified since it was opened"
+	}
+	return fmt.Sprintf("server returned %v", e.status)
+}
+
+// checkStatus returns nil if the status code of resp is one of codes.
+// Otherwise the body is closed and a *statusError is returned.
+func checkStatus(resp *http.Response, codes ...int) error {
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	discard(resp)
+	return &statusError{code: resp.StatusCode, status: resp.Status}
+}
+
+// discard reads the remaining body of resp (up to a limit, so that the
+// connection can be reused) and closes it.
+func discard(resp *http.Response) {
+	_, _ = io.CopyN(io.Discard, resp.Body, 64*1024)
+	_ = resp.Body.Close()
+}
+
+// pathError wraps err in an *os.PathError. Missing files are reported as
+// os.ErrNotExist, denied requests as os.ErrPermission. Errors which occur
+// before the server has answered are reported as ENOTCONN, so that the
+// archiver treats them as fatal.
+func pathError(op, name string, err error) error {
+	var se *statusError
+	var ue *url.Error
+	switch {
+	case errors.As(err, &se) && (se.code == http.StatusNotFound || se.code == http.StatusGone):
+		err = os.ErrNotExist
+	case errors.As(err, &se) && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden):
+		err = os.ErrPermission
+	case errors.As(err, &ue):
+		err = syscall.ENOTCONN
+	}
+
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// request describes an HTTP request which may be sent several times.
+type request struct {
+	method string
+	url    url.URL
+	header http.Header
+	body   []byte
+}
+
+// isThrottled returns true for status codes which indicate that the request
+// should be repeated later.
+func isThrottled(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusInsufficientStorage:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header, which
+// contains either a number of seconds or a date.
+func retryAfter(h http.Header) time.Duration {
+	value := h.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	var d time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = time.Until(t)
+	}
+
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d
+}
+
+// do sends the request and returns the response. Throttled requests are
+// repeated with backoff.
+func (wfs *FS) do(r request) (*http.Response, error) {
+	bo := backoff.WithContext(backoff.WithMaxRetries(wfs.newBackOff(), uint64(wfs.maxRetries)), wfs.ctx)
+
+	for {
+		resp, err := wfs.send(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isThrottled(resp.StatusCode) {
+			return resp, nil
+		}
+
+		delay := bo.NextBackOff()
+		if delay == backoff.Stop {
+			return resp, nil
+		}
+		if d := retryAfter(resp.Header); d > delay {
+			delay = d
+		}
+		debug.Log("%v %v: %v, retry in %v", r.method, r.url.Path, resp.Status, delay)
+		discard(resp)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-wfs.ctx.Done():
+			t.Stop()
+			return nil, wfs.ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// send sends the request once. The response body must be closed to allow
+// other requests to be sent.
+func (wfs *FS) send(r request) (*http.Response, error) {
+	select {
+	case wfs.sem <- struct{}{}:
+	case <-wfs.ctx.Done():
+		return nil, wfs.ctx.Err()
+	}
+	release := func() { <-wfs.sem }
+
+	req, err := http.NewRequestWithContext(wfs.ctx, r.method, r.url.String(), bytes.NewReader(r.body))
+	if err != nil {
+		release()
+		return nil, errors.WithStack(err)
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+
+	resp, err := wfs.client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseBody releases the request slot when the body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (rb *releaseBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.once.Do(rb.release)
+	return err
+}
+
+// resourceURL returns the URL of the file or directory name.
+func (wfs *FS) resourceURL(name string) url.URL {
+	u := wfs.base
+	u.Path = name
+	return u
+}
+
+// propfind requests the properties of the resource name and, for depth "1",
+// its members. It returns the file info for each resource by path.
+func (wfs *FS) propfind(name, depth string) (map[string]*fileInfo, error) {
+	r := request{
+		method: "PROPFIND",
+		url:    wfs.resourceURL(name),
+		header: davclient.PropfindHeader(depth),
+		body:   []byte(davclient.PropfindBody),
+	}
+
+	var resp *http.Response
+	for redirects := 0; ; redirects++ {
+		var err error
+		resp, err = wfs.do(r)
+		if err != nil {
+			return nil, err
+		}
+
+		// the client does not follow redirects which change the method
+		if redirects < 10 && (resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == http.StatusFound) {
+			loc, err := resp.Location()
+			discard(resp)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if loc.Host != wfs.base.Host {
+				return nil, errors.Errorf("redirected to other host %v", loc.Host)
+			}
+			r.url.Path = loc.Path
+			continue
+		}
+		break
+	}
+
+	if err := checkStatus(resp, http.StatusMultiStatus); err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]*fileInfo)
+	err := davclient.DecodeMultistatus(resp.Body, func(res davclient.Resource) error {
+		modTime := res.ModTime
+		if modTime.IsZero() {
+			modTime = dirModTime
+		}
+
+		if res.IsDir {
+			infos[res.Path] = newDirInfo(path.Base(res.Path), modTime)
+			return nil
+		}
+
+		size := res.Size
+		if size < 0 {
+			size = fs.SizeUnknown
+		}
+		infos[res.Path] = newFileInfo(path.Base(res.Path), size, modTime, res.ETag)
+		return nil
+	})
+	discard(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// Capabilities returns the features supported by the file system. WebDAV
+// servers report modification times with a resolution of one second.
+func (wfs *FS) Capabilities() fs.Capabilities {
+	return fs.CapSecondsOnlyMtime
+}
+
+// Open opens a file or directory for reading.
+func (wfs *FS) Open(name string) (fs.File, error) {
+	return wfs.OpenFile(name, fs.O_RDONLY, 0)
+}
+
+// OpenFile opens a file or directory for reading, only the flags O_RDONLY and
+// O_NOFOLLOW are supported.
+func (wfs *FS) OpenFile(name string, flag int, _ os.FileMode) (fs.File, error) {
+	if flag & ^(fs.O_RDONLY|fs.O_NOFOLLOW) != 0 {
+		return nil, pathError("open", name,
+			fmt.Errorf("invalid combination of flags 0x%x", flag))
+	}
+
+	fi, err := wfs.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return &dir{fs: wfs, name: name, fi: fi}, nil
+	}
+
+	f := &file{fs: wfs, name: name, path: path.Clean("/" + name), fi: fi.(*fileInfo)}
+	if f.fi.size == fs.SizeUnknown {
+		// the content can only be streamed
+		return f, nil
+	}
+	return &fileWithReaderAt{f}, nil
+}
+
+// Stat returns a FileInfo describing the named file. As there are no
+// symbolic links, this is the same as Lstat.
+func (wfs *FS) Stat(name string) (os.FileInfo, error) {
+	return wfs.Lstat(name)
+}
+
+// Lstat returns the FileInfo structure describing the named file. The
+// information is taken from the listing of the parent directory if it has
+// been read before, otherwise a PROPFIND request with depth 0 is sent.
+func (wfs *FS) Lstat(name string) (os.FileInfo, error) {
+	p := path.Clean("/" + name)
+	if m, ok := wfs.listings.Get(path.Dir(p)); ok {
+		if fi, ok := m[path.Base(p)]; ok {
+			return fi, nil
+		}
+	}
+
+	infos, err := wfs.propfind(p, "0")
+	if err != nil {
+		return nil, pathError("lstat", name, err)
+	}
+
+	// the server may have used a different path for the resource
+	fi, ok := infos[p]
+	if !ok && len(infos) == 1 {
+		for _, info := range infos {
+			fi = info
+		}
+		ok = true
+	}
+	if !ok {
+		return nil, pathError("lstat", name, os.ErrNotExist)
+	}
+
+	info := *fi
+	info.name = path.Base(p)
+	return &info, nil
+}
+
+// readdir lists the members of the collection name. Entries with names which
+// cannot be represented in a directory are skipped.
+func (wfs *FS) readdir(name string) ([]os.FileInfo, error) {
+	p := path.Clean("/" + name)
+	// collections are usually addressed with a trailing slash, this avoids
+	// a redirect for many servers
+	dirPath := p
+	if dirPath != "/" {
+		dirPath += "/"
+	}
+
+	infos, err := wfs.propfind(dirPath, "1")
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+
+	entries := make([]os.FileInfo, 0, len(infos))
+	listing := make(map[string]os.FileInfo, len(infos))
+	for entryPath, fi := range infos {
+		if entryPath == p {
+			// the collection itself
+			continue
+		}
+		if path.Dir(entryPath) != p || fi.name == "." || fi.name == ".." {
+			debug.Log("skipping entry %q in %v, invalid name", entryPath, name)
+			continue
+		}
+		entries = append(entries, fi)
+		listing[fi.name] = fi
+	}
+
+	wfs.listings.Add(p, listing)
+	return entries, nil
+}
+
+// fileInfo describes a file or a collection.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	etag    string
+	meta    *fs.Metadata
+}
+
+func newFileInfo(name string, size int64, modTime time.Time, etag string) *fileInfo {
+	return &fileInfo{
+		name:    name,
+		size:    size,
+		mode:    0644,
+		modTime: modTime,
+		etag:    etag,
+		meta: &fs.Metadata{
+			AccessTime: modTime,
+			ChangeTime: modTime,
+		},
+	}
+}
+
+func newDirInfo(name string, modTime time.Time) *fileInfo {
+	return &fileInfo{
+		name:    name,
+		mode:    os.ModeDir | 0755,
+		modTime: modTime,
+		meta: &fs.Metadata{
+			AccessTime: modTime,
+			ChangeTime: modTime,
+		},
+	}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.meta }
+
+// file is a file opened for reading. The content is streamed with a single
+// request for sequential reads. If the server reported a strong ETag, the
+// requests only succeed if the file has not been modified since it was
+// opened.
+type file struct {
+	fs   *FS
+	name string
+	path string
+	fi   *fileInfo
+
+	m   sync.Mutex
+	rd  io.ReadCloser
+	pos int64
+}
+
+// ensure that file implements fs.File
+var _ fs.File = &file{}
+
+// fileWithReaderAt is a file with a known size, ReadAt sends a range request
+// per call.
+type fileWithReaderAt struct {
+	*file
+}
+
+// ensure that fileWithReaderAt implements fs.File and io.ReaderAt
+var _ fs.File = &fileWithReaderAt{}
+var _ io.ReaderAt = &fileWithReaderAt{}
+
+// get requests the content of the file from start to end (inclusive). If end
+// is negative, the content up to the end of the file is returned. It returns
+// io.EOF if start is beyond the end of the file.
+func (f *file) get(start, end int64) (io.ReadCloser, error) {
+	r := request{
+		method: http.MethodGet,
+		url:    f.fs.resourceURL(f.path),
+		header: http.Header{},
+	}
+	if f.fi.etag != "" && !strings.HasPrefix(f.fi.etag, "W/") {
+		// weak ETags cannot be used with If-Match
+		r.header.Set("If-Match", f.fi.etag)
+	}
+	switch {
+	case end >= 0:
+		r.header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	case start > 0:
+		r.header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+
+	resp, err := f.fs.do(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		discard(resp)
+		return nil, io.EOF
+	}
+	if err := checkStatus(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK && start > 0 {
+		// the server ignored the range
+		if _, err := io.CopyN(io.Discard, resp.Body, start); err != nil {
+			_ = resp.Body.Close()
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+	}
+	return resp.Body, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.fi.size != fs.SizeUnknown && f.pos >= f.fi.size {
+		return 0, io.EOF
+	}
+
+	if f.rd == nil {
+		rd, err := f.get(f.pos, -1)
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, pathError("read", f.name, err)
+		}
+		f.rd = rd
+	}
+
+	n, err := f.rd.Read(p)
+	f.pos += int64(n)
+	if err != nil && err != io.EOF {
+		return n, pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at offset off with a range request.
+func (f *fileWithReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.fi.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if remaining := f.fi.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+	if len(p) == 0 {
+		return 0, eof
+	}
+
+	rd, err := f.get(off, off+int64(len(p))-1)
+	if err == io.EOF {
+		return 0, pathError("read", f.name, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return 0, pathError("read", f.name, err)
+	}
+	n, err := io.ReadFull(rd, p)
+	_ = rd.Close()
+	if err != nil {
+		return n, pathError("read", f.name, err)
+	}
+	return n, eof
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	pos := f.pos
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos += offset
+	case io.SeekEnd:
+		if f.fi.size == fs.SizeUnknown {
+			return 0, pathError("seek", f.name, syscall.EINVAL)
+		}
+		pos = f.fi.size + offset
+	}
+	if pos < 0 {
+		return 0, pathError("seek", f.name, syscall.EINVAL)
+	}
+
+	if pos != f.pos && f.rd != nil {
+		_ = f.rd.Close()
+		f.rd = nil
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *file) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.rd == nil {
+		return nil
+	}
+	err := f.rd.Close()
+	f.rd = nil
+	return err
+}
+
+func (f *file) Fd() uintptr {
+	return 0
+}
+
+func (f *file) Readdirnames(_ int) ([]string, error) {
+	return nil, pathError("readdirnames", f.name, syscall.ENOTDIR)
+}
+
+func (f *file) Readdir(_ int) ([]os.FileInfo, error) {
+	return nil, pathError("readdir", f.name, syscall.ENOTDIR)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+// dir is a collection on the server. The members are listed when Readdir or
+// Readdirnames is called.
+type dir struct {
+	fs   *FS
+	name string
+	fi   os.FileInfo
+}
+
+// ensure that dir implements fs.File
+var _ fs.File = &dir{}
+
+func (d *dir) Read(_ []byte) (int, error) {
+	return 0, pathError("read", d.name, syscall.EISDIR)
+}
+
+func (d *dir) Seek(int64, int) (int64, error) {
+	return 0, pathError("seek", d.name, syscall.EISDIR)
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Fd() uintptr {
+	return 0
+}
+
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	entries, err := d.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// Readdir returns the members of the collection in no particular order. Only
+// n <= 0 is supported.
+func (d *dir) Readdir(n int) ([]os.FileInfo, error) {
+	if n > 0 {
+		return nil, pathError("readdir", d.name, errors.New("not implemented"))
+	}
+	return d.fs.readdir(d.name)
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
@@ -0,0 +1,413 @@
+package webdavfs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/backend/webdav/davclient"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+
+	"github.com/cenkalti/backoff/v4"
+	"golang.org/x/net/webdav"
+)
+
+// testServer serves a local directory via WebDAV. It can require
+// authentication, reject requests as throttled and records the requests.
+type testServer struct {
+	handler http.Handler
+
+	m         sync.Mutex
+	auth      string // "", "basic" or "digest"
+	throttle  int
+	status    int // status code for throttled requests
+	requests  map[string]int
+	active    int
+	maxActive int
+	delay     time.Duration
+}
+
+const (
+	testUser     = "user"
+	testPassword = "secret"
+	testRealm    = "test"
+	testNonce    = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+)
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	auth, delay, status := s.auth, s.delay, s.status
+	throttled := s.throttle > 0
+	if throttled {
+		s.throttle--
+	}
+	s.m.Unlock()
+
+	defer func() {
+		s.m.Lock()
+		s.active--
+		s.m.Unlock()
+	}()
+
+	time.Sleep(delay)
+
+	if throttled {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+		return
+	}
+
+	if !s.authorized(auth, r) {
+		switch auth {
+		case "basic":
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+testRealm+`"`)
+		case "digest":
+			w.Header().Set("WWW-Authenticate", `Digest realm="`+testRealm+`", qop="auth,auth-int", algorithm=MD5, nonce="`+testNonce+`", opaque="opaque"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.m.Lock()
+	s.requests[r.Method]++
+	s.m.Unlock()
+
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *testServer) authorized(auth string, r *http.Request) bool {
+	switch auth {
+	case "basic":
+		user, password, ok := r.BasicAuth()
+		return ok && user == testUser && password == testPassword
+	case "digest":
+		scheme, params := davclient.ParseChallenge(r.Header.Get("Authorization"))
+		if scheme != "digest" || params["username"] != testUser || params["uri"] != r.URL.RequestURI() ||
+			params["nonce"] != testNonce || params["opaque"] != "opaque" || params["qop"] != "auth" {
+			return false
+		}
+		ha1 := md5hex(testUser + ":" + testRealm + ":" + testPassword)
+		ha2 := md5hex(r.Method + ":" + params["uri"])
+		return params["response"] == md5hex(ha1+":"+testNonce+":"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2)
+	}
+	return true
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *testServer) count(method string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.requests[method]
+}
+
+var (
+	dirTime  = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fileTime = time.Date(2021, 6, 7, 8, 9, 10, 123456789, time.UTC)
+)
+
+func newTestServer(t testing.TB, cfg Config) (*testServer, *FS, string) {
+	tempdir := rtest.TempDir(t)
+	for name, data := range map[string]string{
+		"top":                  "top content",
+		"docs/readme":          "0123456789",
+		"photos/c.txt":         "c content",
+		"photos/2020/a.jpg":    "a content",
+		"photos/2020/b b.jpg":  "b content",
+		"photos/2020/d%20.jpg": "d content",
+	} {
+		filename := filepath.Join(tempdir, filepath.FromSlash(name))
+		rtest.OK(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		rtest.OK(t, os.WriteFile(filename, []byte(data), 0644))
+		rtest.OK(t, os.Chtimes(filename, fileTime, fileTime))
+	}
+	for _, name := range []string{"docs", "photos/2020", "photos"} {
+		rtest.OK(t, os.Chtimes(filepath.Join(tempdir, filepath.FromSlash(name)), dirTime, dirTime))
+	}
+
+	s := &testServer{
+		handler: &webdav.Handler{
+			FileSystem: webdav.Dir(tempdir),
+			LockSystem: webdav.NewMemLS(),
+		},
+		status:   http.StatusTooManyRequests,
+		requests: make(map[string]int),
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	rtest.OK(t, err)
+	if cfg.URL != nil {
+		u.User = cfg.URL.User
+	}
+	cfg.URL = u
+
+	wfs, err := Open(context.TODO(), cfg, http.DefaultTransport)
+	rtest.OK(t, err)
+	wfs.newBackOff = func() backoff.BackOff {
+		return &backoff.ZeroBackOff{}
+	}
+	t.Cleanup(func() {
+		rtest.OK(t, wfs.Close())
+	})
+
+	return s, wfs, tempdir
+}
+
+func readdirnames(t testing.TB, wfs *FS, name string) []string {
+	f, err := wfs.Open(name)
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	sort.Strings(names)
+	return names
+}
+
+func readFile(t testing.TB, wfs *FS, name string) string {
+	f, err := wfs.Open(name)
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return string(buf)
+}
+
+func TestFS(t *testing.T) {
+	_, wfs, _ := newTestServer(t, NewConfig())
+
+	rtest.Equals(t, []string{"docs", "photos", "top"}, readdirnames(t, wfs, "/"))
+	rtest.Equals(t, []string{"2020", "c.txt"}, readdirnames(t, wfs, "/photos"))
+	rtest.Equals(t, []string{"a.jpg", "b b.jpg", "d%20.jpg"}, readdirnames(t, wfs, "/photos/2020"))
+
+	rtest.Equals(t, "top content", readFile(t, wfs, "/top"))
+	rtest.Equals(t, "b content", readFile(t, wfs, "/photos/2020/b b.jpg"))
+	rtest.Equals(t, "d content", readFile(t, wfs, "/photos/2020/d%20.jpg"))
+
+	fi, err := wfs.Lstat("/photos")
+	rtest.OK(t, err)
+	rtest.Assert(t, fi.IsDir(), "photos is not a directory")
+	rtest.Equals(t, "photos", fi.Name())
+	rtest.Assert(t, fi.ModTime().Equal(dirTime), "wrong mtime %v", fi.ModTime())
+
+	fi, err = wfs.Lstat("/photos/c.txt")
+	rtest.OK(t, err)
+	rtest.Equals(t, os.FileMode(0644), fi.Mode())
+	rtest.Equals(t, int64(9), fi.Size())
+	// the server only reports seconds
+	rtest.Assert(t, fi.ModTime().Equal(fileTime.Truncate(time.Second)), "wrong mtime %v", fi.ModTime())
+
+	_, err = wfs.Lstat("/photos/missing")
+	rtest.Assert(t, errors.Is(err, os.ErrNotExist), "unexpected error %v", err)
+	_, err = wfs.Open("/top/x")
+	rtest.Assert(t, err != nil, "expected error for /top/x")
+
+	f, err := wfs.Open("/top")
+	rtest.OK(t, err)
+	_, err = f.Readdirnames(-1)
+	rtest.Assert(t, err != nil, "expected error for Readdirnames on a file")
+	rtest.OK(t, f.Close())
+}
+
+func TestLstatCache(t *testing.T) {
+	srv, wfs, _ := newTestServer(t, NewConfig())
+
+	readdirnames(t, wfs, "/photos")
+	propfinds := srv.count("PROPFIND")
+	for _, name := range []string{"2020", "c.txt"} {
+		_, err := wfs.Lstat("/photos/" + name)
+		rtest.OK(t, err)
+	}
+	rtest.Equals(t, propfinds, srv.count("PROPFIND"))
+}
+
+func TestFileRead(t *testing.T) {
+	_, wfs, tempdir := newTestServer(t, NewConfig())
+
+	f, err := wfs.Open("/docs/readme")
+	rtest.OK(t, err)
+	defer func() {
+		rtest.OK(t, f.Close())
+	}()
+
+	ra, ok := fs.ReaderAt(f)
+	rtest.Assert(t, ok, "file does not implement io.ReaderAt")
+
+	buf := make([]byte, 4)
+	n, err := ra.ReadAt(buf, 3)
+	rtest.OK(t, err)
+	rtest.Equals(t, "3456", string(buf[:n]))
+
+	n, err = ra.ReadAt(buf, 8)
+	rtest.Equals(t, io.EOF, err)
+	rtest.Equals(t, "89", string(buf[:n]))
+
+	_, err = f.Seek(6, io.SeekStart)
+	rtest.OK(t, err)
+	rest, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.Equals(t, "6789", string(rest))
+
+	// reading fails if the file is modified after it has been opened
+	filename := filepath.Join(tempdir, "docs", "readme")
+	rtest.OK(t, os.WriteFile(filename, []byte("modified"), 0644))
+	_, err = f.Seek(0, io.SeekStart)
+	rtest.OK(t, err)
+	_, err = io.ReadAll(f)
+	rtest.Assert(t, err != nil, "expected error for modified file")
+	_, err = ra.ReadAt(buf, 0)
+	rtest.Assert(t, err != nil, "expected error for modified file")
+}
+
+func TestAuth(t *testing.T) {
+	for _, auth := range []string{"basic", "digest"} {
+		t.Run(auth, func(t *testing.T) {
+			cfg := NewConfig()
+			cfg.URL = &url.URL{User: url.UserPassword(testUser, testPassword)}
+			srv, wfs, _ := newTestServer(t, cfg)
+			srv.auth = auth
+
+			rtest.Equals(t, []string{"2020", "c.txt"}, readdirnames(t, wfs, "/photos"))
+			rtest.Equals(t, "c content", readFile(t, wfs, "/photos/c.txt"))
+
+			f, err := wfs.Open("/docs/readme")
+			rtest.OK(t, err)
+			ra, _ := fs.ReaderAt(f)
+			buf := make([]byte, 3)
+			_, err = ra.ReadAt(buf, 2)
+			rtest.OK(t, err)
+			rtest.Equals(t, "234", string(buf))
+			rtest.OK(t, f.Close())
+		})
+
+		t.Run(auth+"-wrong-password", func(t *testing.T) {
+			cfg := NewConfig()
+			cfg.URL = &url.URL{User: url.UserPassword(testUser, "wrong")}
+			srv, wfs, _ := newTestServer(t, cfg)
+			srv.auth = auth
+
+			_, err := wfs.Lstat("/photos")
+			rtest.Assert(t, errors.Is(err, os.ErrPermission), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	cfg := NewConfig()
+	cfg.MaxRetries = 3
+	srv, wfs, _ := newTestServer(t, cfg)
+
+	srv.throttle = 3
+	rtest.Equals(t, "top content", readFile(t, wfs, "/top"))
+
+	srv.status = http.StatusInsufficientStorage
+	srv.throttle = 3
+	rtest.Equals(t, "0123456789", readFile(t, wfs, "/docs/readme"))
+	srv.status = http.StatusTooManyRequests
+
+	// the error after the last retry is handled by the error policy
+	srv.throttle = 4
+	_, err := wfs.Lstat("/docs")
+	rtest.Assert(t, err != nil, "expected error for throttled request")
+	rtest.Assert(t, !fs.IsFatalError(err), "error for throttled request is fatal: %v", err)
+	var se *statusError
+	rtest.Assert(t, errors.As(err, &se) && se.code == http.StatusTooManyRequests, "unexpected error %v", err)
+}
+
+func TestConnections(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Connections = 2
+	srv, wfs, _ := newTestServer(t, cfg)
+	srv.delay = 10 * time.Millisecond
+
+	f, err := wfs.Open("/docs/readme")
+	rtest.OK(t, err)
+	ra, _ := fs.ReaderAt(f)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1)
+			_, err := ra.ReadAt(buf, int64(i))
+			rtest.OK(t, err)
+			rtest.Equals(t, strconv.Itoa(i), string(buf))
+		}()
+	}
+	wg.Wait()
+	rtest.OK(t, f.Close())
+
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	rtest.Assert(t, srv.maxActive <= 2, "%d concurrent requests, want at most 2", srv.maxActive)
+}
+
+func TestArchiver(t *testing.T) {
+	srv, wfs, _ := newTestServer(t, NewConfig())
+	repo := repository.TestRepository(t)
+
+	arch := archiver.New(repo, wfs, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/photos"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+	rtest.Equals(t, []string{"/photos"}, sn.Paths)
+
+	tree := loadTree(t, repo, *sn.Tree)
+	rtest.Equals(t, 1, len(tree.Nodes))
+	photos := tree.Nodes[0]
+	rtest.Equals(t, "dir", photos.Type)
+	rtest.Assert(t, photos.ModTime.Equal(dirTime), "wrong mtime %v", photos.ModTime)
+
+	tree = loadTree(t, repo, *sn.Tree, "photos", "2020")
+	rtest.Equals(t, 3, len(tree.Nodes))
+	for _, node := range tree.Nodes {
+		rtest.Equals(t, uint64(9), node.Size)
+		rtest.Equals(t, 1, len(node.Content))
+	}
+	rtest.Equals(t, 4, srv.count(http.MethodGet))
+
+	// the modification times only have a resolution of one second, files
+	// are not read again if they have not been modified
+	arch = archiver.New(repo, wfs, archiver.Options{})
+	_, _, err = arch.Snapshot(context.TODO(), []string{"/photos"}, archiver.SnapshotOptions{Time: time.Now(), ParentSnapshot: sn})
+	rtest.OK(t, err)
+	rtest.Equals(t, 4, srv.count(http.MethodGet))
+}
+
+func loadTree(t testing.TB, repo restic.Repository, id restic.ID, dirs ...string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, dir := range dirs {
+		node := tree.Find(dir)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", dir)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
@@ -0,0 +1,239 @@
+// Package zipfs provides a read-only file system with the contents of a zip
+// archive.
+package zipfs
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/fs/memfs"
+)
+
+// FS is a read-only file system which contains the entries of a zip archive.
+// The central directory of the archive lists all entries, so the directory
+// tree is built without reading the archive sequentially. The contents of
+// stored entries are read from the archive at arbitrary offsets, deflated
+// entries are decompressed while they are read.
+type FS struct {
+	*memfs.Tree
+
+	archive *os.File
+}
+
+// statically ensure that FS implements fs.FS.
+var _ fs.FS = &FS{}
+
+// Open returns a file system for the zip archive filename.
+func Open(filename string) (*FS, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	fsys, err := New(f, fi.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	fsys.archive = f
+	return fsys, nil
+}
+
+// New returns a file system with the entries of the zip archive of the given
+// size read from rd. Encrypted entries and compression methods other than
+// store and deflate are rejected.
+func New(rd io.ReaderAt, size int64) (*FS, error) {
+	zr, err := zip.NewReader(rd, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "zip")
+	}
+
+	fsys := &FS{Tree: memfs.NewTree()}
+
+	for _, f := range zr.File {
+		if err := fsys.addFile(rd, f); err != nil {
+			return nil, err
+		}
+	}
+	return fsys, nil
+}
+
+// flagEncrypted is set in the general purpose flags of encrypted entries.
+const flagEncrypted = 0x1
+
+func (fsys *FS) addFile(rd io.ReaderAt, f *zip.File) error {
+	if f.Flags&flagEncrypted != 0 {
+		return errors.Errorf("%v: encrypted zip archives are not supported", f.Name)
+	}
+
+	n := &memfs.Node{
+		Mode:    f.Mode(),
+		ModTime: f.Modified,
+		Meta:    fsys.NewMetadata(),
+	}
+	n.Meta.AccessTime, n.Meta.ChangeTime = f.Modified, f.Modified
+	parseUnixExtra(f.Extra, n.Meta)
+
+	switch {
+	case n.Mode.IsDir():
+	case n.Mode.IsRegular(), n.Mode&os.ModeSymlink != 0:
+		switch f.Method {
+		case zip.Store:
+			offset, err := f.DataOffset()
+			if err != nil {
+				return errors.Wrap(err, f.Name)
+			}
+			if f.CompressedSize64 != f.UncompressedSize64 {
+				return errors.Errorf("%v: invalid size of stored entry", f.Name)
+			}
+			size := int64(f.UncompressedSize64)
+			n.Content = func() (io.Reader, error) {
+				return io.NewSectionReader(rd, offset, size), nil
+			}
+		case zip.Deflate:
+			n.Content = func() (io.Reader, error) {
+				r := &deflateReader{f: f}
+				if err := r.reset(); err != nil {
+					return nil, err
+				}
+				return r, nil
+			}
+		default:
+			return errors.Errorf("%v: unsupported compression method %d", f.Name, f.Method)
+		}
+		n.Size = int64(f.UncompressedSize64)
+
+		if n.Mode&os.ModeSymlink != 0 {
+			target, err := readAll(n)
+			if err != nil {
+				return errors.Wrap(err, f.Name)
+			}
+			n.Meta.LinkTarget = string(target)
+			n.Content = nil
+		}
+	default:
+		debug.Log("skipping %v with unsupported mode %v", f.Name, n.Mode)
+		return nil
+	}
+
+	fsys.Put(f.Name, n)
+	return nil
+}
+
+// readAll returns the content of the node.
+func readAll(n *memfs.Node) ([]byte, error) {
+	rd, err := n.Content()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(rd)
+	if c, ok := rd.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return buf, err
+}
+
+// unixExtraID is the header ID of the extra field written by Info-ZIP which
+// contains the UID and GID of an entry.
+const unixExtraID = 0x7875
+
+// parseUnixExtra sets the UID and GID of meta from the Info-ZIP Unix extra
+// field, if it is present.
+func parseUnixExtra(extra []byte, meta *fs.Metadata) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		if id != unixExtraID || len(field) < 1 || field[0] != 1 {
+			continue
+		}
+		field = field[1:]
+
+		var ids [2]uint32
+		for i := range ids {
+			if len(field) < 1 || len(field) < 1+int(field[0]) {
+				return
+			}
+			n := int(field[0])
+			var v uint64
+			for j := n - 1; j >= 0; j-- {
+				v = v<<8 | uint64(field[1+j])
+			}
+			ids[i] = uint32(v)
+			field = field[1+n:]
+		}
+		meta.UID, meta.GID = ids[0], ids[1]
+		return
+	}
+}
+
+// Close closes the archive if it was opened by Open.
+func (fsys *FS) Close() error {
+	if fsys.archive != nil {
+		return fsys.archive.Close()
+	}
+	return nil
+}
+
+// Capabilities returns the features supported by the file system. The inode
+// numbers are assigned while reading the archive, each entry has its own.
+func (fsys *FS) Capabilities() fs.Capabilities {
+	return fs.CapDeviceIDs | fs.CapInodes
+}
+
+// deflateReader decompresses a deflated entry of the archive, which can only
+// be read sequentially.
+type deflateReader struct {
+	f  *zip.File
+	rd io.ReadCloser
+}
+
+// reset starts decompressing the entry from the beginning.
+func (r *deflateReader) reset() error {
+	if r.rd != nil {
+		_ = r.rd.Close()
+	}
+
+	rd, err := r.f.Open()
+	if err != nil {
+		return err
+	}
+	r.rd = rd
+	return nil
+}
+
+func (r *deflateReader) Read(p []byte) (int, error) {
+	return r.rd.Read(p)
+}
+
+// Seek only supports seeking to the start of the file, which decompresses
+// the entry again.
+func (r *deflateReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, syscall.ESPIPE
+	}
+	return 0, r.reset()
+}
+
+func (r *deflateReader) Close() error {
+	return r.rd.Close()
+}
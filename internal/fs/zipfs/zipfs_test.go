@@ -0,0 +1,195 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+// unixExtra returns an Info-ZIP Unix extra field with uid and gid.
+func unixExtra(uid, gid uint32) []byte {
+	return []byte{0x75, 0x78, 11, 0, 1,
+		4, byte(uid), byte(uid >> 8), byte(uid >> 16), byte(uid >> 24),
+		4, byte(gid), byte(gid >> 8), byte(gid >> 16), byte(gid >> 24)}
+}
+
+type testEntry struct {
+	hdr  zip.FileHeader
+	mode os.FileMode
+	data string
+}
+
+func writeArchive(t testing.TB, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.SetMode(e.mode)
+		w, err := zw.CreateHeader(&hdr)
+		rtest.OK(t, err)
+		_, err = io.WriteString(w, e.data)
+		rtest.OK(t, err)
+	}
+	rtest.OK(t, zw.Close())
+	return buf.Bytes()
+}
+
+// testArchive returns a zip archive which contains stored and deflated
+// entries, most parent directories are missing.
+func testArchive(t testing.TB) []byte {
+	mtime := time.Unix(1600000000, 0).UTC()
+	return writeArchive(t, []testEntry{
+		{hdr: zip.FileHeader{Name: "dir/", Modified: mtime}, mode: os.ModeDir | 0700},
+		{hdr: zip.FileHeader{Name: "dir/stored", Method: zip.Store, Modified: mtime, Extra: unixExtra(1000, 100)},
+			mode: 0644, data: "stored content"},
+		{hdr: zip.FileHeader{Name: "dir/deflated", Method: zip.Deflate, Modified: mtime.Add(time.Hour)},
+			mode: 0600, data: string(bytes.Repeat([]byte("deflated content "), 100))},
+		{hdr: zip.FileHeader{Name: "dir/link", Method: zip.Store, Modified: mtime}, mode: os.ModeSymlink | 0777, data: "stored"},
+		{hdr: zip.FileHeader{Name: "./implicit/sub/file", Method: zip.Deflate, Modified: mtime}, mode: 0644, data: "implicit parents"},
+	})
+}
+
+func testFS(t testing.TB) *FS {
+	filename := filepath.Join(rtest.TempDir(t), "archive.zip")
+	rtest.OK(t, os.WriteFile(filename, testArchive(t), 0600))
+
+	fsys, err := Open(filename)
+	rtest.OK(t, err)
+	t.Cleanup(func() {
+		rtest.OK(t, fsys.Close())
+	})
+	return fsys
+}
+
+func readFile(t testing.TB, fsys fs.FS, name string) string {
+	f, err := fsys.Open(name)
+	rtest.OK(t, err)
+	buf, err := io.ReadAll(f)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	return string(buf)
+}
+
+func TestFS(t *testing.T) {
+	fsys := testFS(t)
+
+	f, err := fsys.Open("/dir")
+	rtest.OK(t, err)
+	names, err := f.Readdirnames(-1)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+	rtest.Equals(t, []string{"stored", "deflated", "link"}, names)
+
+	rtest.Equals(t, "stored content", readFile(t, fsys, "/dir/stored"))
+	rtest.Equals(t, string(bytes.Repeat([]byte("deflated content "), 100)), readFile(t, fsys, "/dir/deflated"))
+	rtest.Equals(t, "implicit parents", readFile(t, fsys, "/implicit/sub/file"))
+
+	fi, err := fsys.Lstat("/dir")
+	rtest.OK(t, err)
+	rtest.Equals(t, os.ModeDir|0700, fi.Mode())
+
+	fi, err = fsys.Lstat("/implicit/sub")
+	rtest.OK(t, err)
+	rtest.Assert(t, fi.IsDir(), "implicit parent is not a directory")
+
+	fi, err = fsys.Lstat("/dir/deflated")
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(len("deflated content ")*100), fi.Size())
+
+	// only stored entries can be read at arbitrary offsets
+	f, err = fsys.Open("/dir/stored")
+	rtest.OK(t, err)
+	_, ok := fs.ReaderAt(f)
+	rtest.Assert(t, ok, "stored entry does not implement io.ReaderAt")
+	rtest.OK(t, f.Close())
+
+	f, err = fsys.Open("/dir/deflated")
+	rtest.OK(t, err)
+	_, ok = fs.ReaderAt(f)
+	rtest.Assert(t, !ok, "deflated entry implements io.ReaderAt")
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(f, buf)
+	rtest.OK(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	rtest.OK(t, err)
+	_, err = io.ReadFull(f, buf)
+	rtest.OK(t, err)
+	rtest.Equals(t, "deflated", string(buf))
+	_, err = f.Seek(5, io.SeekStart)
+	rtest.Assert(t, err != nil, "expected error for seeking within deflated entry")
+	rtest.OK(t, f.Close())
+
+	_, err = fsys.Lstat("/dir/missing")
+	rtest.Assert(t, os.IsNotExist(err), "unexpected error %v", err)
+}
+
+func TestArchiver(t *testing.T) {
+	fsys := testFS(t)
+	repo := repository.TestRepository(t)
+
+	arch := archiver.New(repo, fsys, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/"}, archiver.SnapshotOptions{Time: time.Now()})
+	rtest.OK(t, err)
+
+	tree := loadTree(t, repo, *sn.Tree, "dir")
+	nodes := make(map[string]*restic.Node)
+	for _, node := range tree.Nodes {
+		nodes[node.Name] = node
+	}
+
+	stored := nodes["stored"]
+	rtest.Equals(t, "file", stored.Type)
+	rtest.Equals(t, uint32(1000), stored.UID)
+	rtest.Equals(t, uint32(100), stored.GID)
+	rtest.Equals(t, os.FileMode(0644), stored.Mode)
+	rtest.Equals(t, uint64(len("stored content")), stored.Size)
+
+	deflated := nodes["deflated"]
+	rtest.Equals(t, os.FileMode(0600), deflated.Mode)
+	rtest.Equals(t, uint64(len("deflated content ")*100), deflated.Size)
+	rtest.Assert(t, deflated.ModTime.Equal(time.Unix(1600000000+3600, 0)), "wrong mtime %v", deflated.ModTime)
+
+	link := nodes["link"]
+	rtest.Equals(t, "symlink", link.Type)
+	rtest.Equals(t, "stored", link.LinkTarget)
+
+	tree = loadTree(t, repo, *sn.Tree, "implicit", "sub")
+	rtest.Equals(t, 1, len(tree.Nodes))
+	rtest.Equals(t, uint64(len("implicit parents")), tree.Nodes[0].Size)
+}
+
+func TestInvalid(t *testing.T) {
+	archive := testArchive(t)
+	_, err := New(bytes.NewReader(archive[:len(archive)-10]), int64(len(archive)-10))
+	rtest.Assert(t, err != nil, "expected error for truncated archive")
+
+	encrypted := writeArchive(t, []testEntry{
+		{hdr: zip.FileHeader{Name: "secret", Method: zip.Store, Flags: flagEncrypted}, mode: 0644, data: "secret"},
+	})
+	_, err = New(bytes.NewReader(encrypted), int64(len(encrypted)))
+	rtest.Assert(t, err != nil, "expected error for encrypted archive")
+}
+
+func loadTree(t testing.TB, repo restic.Repository, id restic.ID, dirs ...string) *restic.Tree {
+	tree, err := restic.LoadTree(context.TODO(), repo, id)
+	rtest.OK(t, err)
+
+	for _, dir := range dirs {
+		node := tree.Find(dir)
+		rtest.Assert(t, node != nil && node.Subtree != nil, "directory %v not found", dir)
+		tree, err = restic.LoadTree(context.TODO(), repo, *node.Subtree)
+		rtest.OK(t, err)
+	}
+	return tree
+}
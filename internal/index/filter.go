@@ -0,0 +1,57 @@
+package index
+
+import (
+	"encoding/binary"
+
+	"github.com/restic/restic/internal/restic"
+)
+
+const (
+	// filterBitsPerBlob and filterHashes result in a false positive rate of
+	// less than 0.01 percent.
+	filterBitsPerBlob = 20
+	filterHashes      = 14
+)
+
+// blobFilter is a bloom filter for blob handles. It never misses a blob which
+// was added, but reports other blobs as contained with a small probability.
+type blobFilter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+func newBlobFilter(blobs uint) *blobFilter {
+	words := (blobs*filterBitsPerBlob + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &blobFilter{bits: make([]uint64, words), hashes: filterHashes}
+}
+
+// positions derives the hash values from the ID, which already is a
+// cryptographic hash. The blob type is mixed in as data and tree blobs may
+// share the same ID.
+func (f *blobFilter) positions(bh restic.BlobHandle) (h1, h2, m uint64) {
+	h1 = binary.LittleEndian.Uint64(bh.ID[0:8]) ^ uint64(bh.Type)*0x9e3779b97f4a7c15
+	h2 = binary.LittleEndian.Uint64(bh.ID[8:16]) | 1
+	return h1, h2, uint64(len(f.bits)) * 64
+}
+
+func (f *blobFilter) add(bh restic.BlobHandle) {
+	h1, h2, m := f.positions(bh)
+	for i := uint32(0); i < f.hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % m
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (f *blobFilter) mayContain(bh restic.BlobHandle) bool {
+	h1, h2, m := f.positions(bh)
+	for i := uint32(0); i < f.hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % m
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/restic/restic/internal/restic"
+)
+
+func TestBlobFilter(t *testing.T) {
+	const blobs = 10000
+	f := newBlobFilter(blobs)
+
+	added := make([]restic.BlobHandle, blobs)
+	for i := range added {
+		added[i] = restic.BlobHandle{ID: restic.NewRandomID(), Type: restic.DataBlob}
+		f.add(added[i])
+	}
+
+	for _, bh := range added {
+		if !f.mayContain(bh) {
+			t.Fatalf("blob %v is missing from the filter", bh)
+		}
+	}
+
+	// the filter should have a false positive rate of less than 0.01 percent
+	falsePositives := 0
+	for i := 0; i < 100*blobs; i++ {
+		if f.mayContain(restic.BlobHandle{ID: restic.NewRandomID(), Type: restic.DataBlob}) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 2*blobs/100 {
+		t.Fatalf("too many false positives: %d", falsePositives)
+	}
+
+	// blobs of a different type are not contained
+	falsePositives = 0
+	for _, bh := range added {
+		if f.mayContain(restic.BlobHandle{ID: bh.ID, Type: restic.TreeBlob}) {
+			falsePositives++
+		}
+	}
+	if falsePositives > blobs/100 {
+		t.Fatalf("too many false positives for tree blobs: %d", falsePositives)
+	}
+}
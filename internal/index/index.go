@@ -20,10 +20,13 @@ import (
 // Hence the index data structure defined here is one of the main contributions
 // to the total memory requirements of restic.
 //
-// We store the index entries in indexMaps. In these maps, entries take 56
-// bytes each, plus 8/4 = 2 bytes of unused pointers on average, not counting
-// malloc and header struct overhead and ignoring duplicates (those are only
-// present in edge cases and are also removed by prune runs).
+// We store the index entries in indexMaps. Most entries are kept in arrays
+// sorted by ID, where they take 48 bytes each. Recently added entries are
+// kept in a hash table instead, where they take 56 bytes each, plus 8/4 = 2
+// bytes of unused pointers on average. The hash table is merged into the
+// sorted array once it exceeds a quarter of its size. These numbers do not
+// count malloc and header struct overhead and ignore duplicates (those are
+// only present in edge cases and are also removed by prune runs).
 //
 // In the index entries, we need to reference the packID. As one pack may
 // contain many blobs the packIDs are saved in a separate array and only the index
@@ -34,12 +37,12 @@ import (
 // size is 1.5 MB and the minimum pack size is 4 MB)
 //
 // We have the following sizes:
-// indexEntry:  56 bytes  (on amd64)
+// indexEntry:  48 bytes  (on amd64)
 // each packID: 32 bytes
 //
-// To save N index entries, we therefore need:
-// N * (56 + 2) bytes + N * 32 bytes / BP = N * 62 bytes,
-// i.e., fewer than 64 bytes per blob in an index.
+// To save N index entries in a sorted array, we therefore need:
+// N * 48 bytes + N * 32 bytes / BP = N * 52 bytes,
+// i.e., fewer than 56 bytes per blob in an index.
 
 // Index holds lookup tables for id -> pack.
 type Index struct {
@@ -77,6 +80,7 @@ func (idx *Index) store(packIndex int, blob restic.Blob) {
 
 	m := &idx.byType[blob.Type]
 	m.add(blob.ID, packIndex, uint32(blob.Offset), uint32(blob.Length), uint32(blob.UncompressedLength))
+	m.maybeCompact()
 }
 
 // Final returns true iff the index is already written to the repository, it is
@@ -384,6 +388,28 @@ func (idx *Index) Finalize() {
 	defer idx.m.Unlock()
 
 	idx.final = true
+	idx.compact()
+}
+
+// compact moves all entries into sorted arrays, as a final index is no longer
+// modified. The caller must hold the lock.
+func (idx *Index) compact() {
+	for typ := range idx.byType {
+		idx.byType[typ].compact()
+	}
+}
+
+// memoryUsage returns the number of entries in the index and the bytes
+// allocated to store them.
+func (idx *Index) memoryUsage() (entries uint, size uint) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+
+	for typ := range idx.byType {
+		entries += idx.byType[typ].len()
+		size += idx.byType[typ].memoryUsage()
+	}
+	return entries, size + uint(len(idx.packs))*uint(len(restic.ID{}))
 }
 
 // IDs returns the IDs of the index, if available. If the index is not yet
@@ -486,7 +512,8 @@ func (idx *Index) merge(idx2 *Index) error {
 		m2.foreach(func(e2 *indexEntry) bool {
 			if !hasIdenticalEntry(e2) {
 				// packIndex needs to be changed as idx2.pack was appended to idx.pack, see above
-				m.add(e2.id, e2.packIndex+packlen, e2.offset, e2.length, e2.uncompressedLength)
+				m.add(e2.id, int(e2.packIndex)+packlen, e2.offset, e2.length, e2.uncompressedLength)
+				m.maybeCompact()
 			}
 			return true
 		})
@@ -541,6 +568,7 @@ func DecodeIndex(buf []byte, id restic.ID) (idx *Index, oldFormat bool, err erro
 	idx.supersedes = idxJSON.Supersedes
 	idx.ids = append(idx.ids, id)
 	idx.final = true
+	idx.compact()
 
 	debug.Log("done")
 	return idx, false, nil
@@ -573,6 +601,7 @@ func decodeOldIndex(buf []byte) (idx *Index, err error) {
 		}
 	}
 	idx.final = true
+	idx.compact()
 
 	debug.Log("done")
 	return idx, nil
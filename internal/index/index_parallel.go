@@ -6,6 +6,8 @@ import (
 	"sync"
 
 	"github.com/restic/restic/internal/restic"
+
+	"golang.org/x/sync/errgroup"
 )
 
 // ForAllIndexes loads all index files in parallel and calls the given callback.
@@ -14,23 +16,53 @@ import (
 func ForAllIndexes(ctx context.Context, lister restic.Lister, repo restic.Repository,
 	fn func(id restic.ID, index *Index, oldFormat bool, err error) error) error {
 
-	// decoding an index can take quite some time such that this can be both CPU- or IO-bound
-	// as the whole index is kept in memory anyways, a few workers too much don't matter
-	workerCount := repo.Connections() + uint(runtime.GOMAXPROCS(0))
+	type loadedIndex struct {
+		id  restic.ID
+		buf []byte
+		err error
+	}
 
-	var m sync.Mutex
-	return restic.ParallelList(ctx, lister, restic.IndexFile, workerCount, func(ctx context.Context, id restic.ID, size int64) error {
-		var err error
-		var idx *Index
-		oldFormat := false
-
-		buf, err := repo.LoadUnpacked(ctx, restic.IndexFile, id)
-		if err == nil {
-			idx, oldFormat, err = DecodeIndex(buf, id)
-		}
-
-		m.Lock()
-		defer m.Unlock()
-		return fn(id, idx, oldFormat, err)
+	// downloading is limited by the backend connections, while decoding is
+	// CPU-bound and thus runs on separate workers. The buffer allows the
+	// downloads to continue while all decoders are busy.
+	decoders := runtime.GOMAXPROCS(0)
+	wg, wgCtx := errgroup.WithContext(ctx)
+	loaded := make(chan loadedIndex, int(repo.Connections())+decoders)
+
+	wg.Go(func() error {
+		defer close(loaded)
+		return restic.ParallelList(wgCtx, lister, restic.IndexFile, repo.Connections(), func(ctx context.Context, id restic.ID, _ int64) error {
+			buf, err := repo.LoadUnpacked(ctx, restic.IndexFile, id)
+			select {
+			case loaded <- loadedIndex{id: id, buf: buf, err: err}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
 	})
+
+	var m sync.Mutex
+	for i := 0; i < decoders; i++ {
+		wg.Go(func() error {
+			for l := range loaded {
+				var idx *Index
+				oldFormat := false
+				err := l.err
+				if err == nil {
+					idx, oldFormat, err = DecodeIndex(l.buf, l.id)
+				}
+
+				m.Lock()
+				err = fn(l.id, idx, oldFormat, err)
+				m.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	return wg.Wait()
 }
@@ -2,12 +2,18 @@ package index
 
 import (
 	"hash/maphash"
+	"sort"
+	"unsafe"
 
 	"github.com/restic/restic/internal/restic"
 )
 
-// An indexMap is a chained hash table that maps blob IDs to indexEntries.
-// It allows storing multiple entries with the same key.
+// An indexMap maps blob IDs to indexEntries. It allows storing multiple
+// entries with the same key.
+//
+// New entries are added to a chained hash table. Once the hash table has
+// grown large enough, its entries are moved into an array sorted by ID,
+// which needs less memory per entry. Lookups search both parts.
 //
 // IndexMap uses some optimizations that are not compatible with supporting
 // deletions.
@@ -23,11 +29,18 @@ type indexMap struct {
 	mh maphash.Hash
 
 	blockList hashedArrayTree
+
+	sorted sortedEntries
 }
 
 const (
 	growthFactor = 2 // Must be a power of 2.
 	maxLoad      = 4 // Max. number of entries per bucket.
+
+	// The hash table is compacted into the sorted array once it contains
+	// minCompact entries and at least 1/compactRatio of the sorted entries.
+	minCompact   = 1 << 12
+	compactRatio = 4
 )
 
 // add inserts an indexEntry for the given arguments into the map,
@@ -44,7 +57,7 @@ func (m *indexMap) add(id restic.ID, packIdx int, offset, length uint32, uncompr
 	e, idx := m.newEntry()
 	e.id = id
 	e.next = m.buckets[h] // Prepend to existing chain.
-	e.packIndex = packIdx
+	e.packIndex = uint32(packIdx)
 	e.offset = offset
 	e.length = length
 	e.uncompressedLength = uncompressedLength
@@ -53,11 +66,53 @@ func (m *indexMap) add(id restic.ID, packIdx int, offset, length uint32, uncompr
 	m.numentries++
 }
 
+// maybeCompact compacts the map if the hash table has grown large enough.
+func (m *indexMap) maybeCompact() {
+	if m.numentries >= minCompact && m.numentries*compactRatio >= m.sorted.len() {
+		m.compact()
+	}
+}
+
+// compact moves all entries of the hash table into the sorted array.
+func (m *indexMap) compact() {
+	if m.numentries == 0 {
+		return
+	}
+
+	entries := make([]indexEntry, 0, m.numentries)
+	m.foreachHashed(func(e *indexEntry) bool {
+		entries = append(entries, *e)
+		return true
+	})
+	// allow GC of the hash table before merging
+	m.buckets = nil
+	m.numentries = 0
+	m.blockList = hashedArrayTree{}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return compareID(entries[i].id, entries[j].id) < 0
+	})
+	m.sorted = mergeSorted(&m.sorted, entries)
+}
+
 // foreach calls fn for all entries in the map, until fn returns false.
 func (m *indexMap) foreach(fn func(*indexEntry) bool) {
+	stopped := false
+	m.sorted.foreach(func(e *indexEntry) bool {
+		stopped = !fn(e)
+		return !stopped
+	})
+	if !stopped {
+		m.foreachHashed(fn)
+	}
+}
+
+// foreachHashed calls fn for all entries in the hash table, until fn returns
+// false.
+func (m *indexMap) foreachHashed(fn func(*indexEntry) bool) {
 	blockCount := m.blockList.Size()
 	for i := uint(1); i < blockCount; i++ {
-		if !fn(m.resolve(i)) {
+		if !fn(&m.resolve(i).indexEntry) {
 			return
 		}
 	}
@@ -65,6 +120,7 @@ func (m *indexMap) foreach(fn func(*indexEntry) bool) {
 
 // foreachWithID calls fn for all entries with the given id.
 func (m *indexMap) foreachWithID(id restic.ID, fn func(*indexEntry)) {
+	m.sorted.foreachWithID(id, fn)
 	if len(m.buckets) == 0 {
 		return
 	}
@@ -77,12 +133,15 @@ func (m *indexMap) foreachWithID(id restic.ID, fn func(*indexEntry)) {
 		if e.id != id {
 			continue
 		}
-		fn(e)
+		fn(&e.indexEntry)
 	}
 }
 
 // get returns the first entry for the given id.
 func (m *indexMap) get(id restic.ID) *indexEntry {
+	if e := m.sorted.get(id); e != nil {
+		return e
+	}
 	if len(m.buckets) == 0 {
 		return nil
 	}
@@ -92,7 +151,7 @@ func (m *indexMap) get(id restic.ID) *indexEntry {
 	for ei != 0 {
 		e := m.resolve(ei)
 		if e.id == id {
-			return e
+			return &e.indexEntry
 		}
 		ei = e.next
 	}
@@ -132,32 +191,46 @@ func (m *indexMap) init() {
 	m.newEntry()
 }
 
-func (m *indexMap) len() uint { return m.numentries }
+func (m *indexMap) len() uint { return m.numentries + m.sorted.len() }
 
-func (m *indexMap) newEntry() (*indexEntry, uint) {
+// memoryUsage returns the number of bytes allocated for the map.
+func (m *indexMap) memoryUsage() uint {
+	size := uint(cap(m.buckets))*uint(unsafe.Sizeof(uint(0))) + m.sorted.memoryUsage()
+	for _, b := range m.blockList.blockList {
+		size += uint(cap(b)) * uint(unsafe.Sizeof(hashedEntry{}))
+	}
+	return size
+}
+
+func (m *indexMap) newEntry() (*hashedEntry, uint) {
 	return m.blockList.Alloc()
 }
 
-func (m *indexMap) resolve(idx uint) *indexEntry {
+func (m *indexMap) resolve(idx uint) *hashedEntry {
 	return m.blockList.Ref(idx)
 }
 
 type indexEntry struct {
 	id                 restic.ID
-	next               uint
-	packIndex          int // Position in containing Index's packs field.
+	packIndex          uint32 // Position in containing Index's packs field.
 	offset             uint32
 	length             uint32
 	uncompressedLength uint32
 }
 
+// hashedEntry is an indexEntry in the hash table.
+type hashedEntry struct {
+	indexEntry
+	next uint
+}
+
 type hashedArrayTree struct {
 	mask      uint
 	maskShift uint
 	blockSize uint
 
 	size      uint
-	blockList [][]indexEntry
+	blockList [][]hashedEntry
 }
 
 func newHAT() *hashedArrayTree {
@@ -170,11 +243,11 @@ func newHAT() *hashedArrayTree {
 		maskShift: blockSizePower,
 		blockSize: blockSize,
 		size:      0,
-		blockList: make([][]indexEntry, blockSize),
+		blockList: make([][]hashedEntry, blockSize),
 	}
 }
 
-func (h *hashedArrayTree) Alloc() (*indexEntry, uint) {
+func (h *hashedArrayTree) Alloc() (*hashedEntry, uint) {
 	h.grow()
 	size := h.size
 	idx, subIdx := h.index(size)
@@ -188,7 +261,7 @@ func (h *hashedArrayTree) index(pos uint) (idx uint, subIdx uint) {
 	return
 }
 
-func (h *hashedArrayTree) Ref(pos uint) *indexEntry {
+func (h *hashedArrayTree) Ref(pos uint) *hashedEntry {
 	if pos >= h.size {
 		panic("array index out of bounds")
 	}
@@ -211,11 +284,11 @@ func (h *hashedArrayTree) grow() {
 		idx = idx / 2
 
 		oldBlocks := h.blockList
-		h.blockList = make([][]indexEntry, h.blockSize)
+		h.blockList = make([][]hashedEntry, h.blockSize)
 
 		// pairwise merging of blocks
 		for i := 0; i < len(oldBlocks); i += 2 {
-			block := make([]indexEntry, 0, h.blockSize)
+			block := make([]hashedEntry, 0, h.blockSize)
 			block = append(block, oldBlocks[i]...)
 			block = append(block, oldBlocks[i+1]...)
 			h.blockList[i/2] = block
@@ -226,6 +299,6 @@ func (h *hashedArrayTree) grow() {
 	}
 	if subIdx == 0 {
 		// new index entry batch
-		h.blockList[idx] = make([]indexEntry, h.blockSize)
+		h.blockList[idx] = make([]hashedEntry, h.blockSize)
 	}
 }
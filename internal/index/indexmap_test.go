@@ -2,6 +2,7 @@ package index
 
 import (
 	"math/rand"
+	"sort"
 	"testing"
 	"time"
 
@@ -48,7 +49,7 @@ func TestIndexMapForeach(t *testing.T) {
 	m.foreach(func(e *indexEntry) bool {
 		i := int(e.id[0])
 		rtest.Assert(t, i < N, "unknown id %v in indexMap", e.id)
-		rtest.Equals(t, i, e.packIndex)
+		rtest.Equals(t, i, int(e.packIndex))
 		rtest.Equals(t, i, int(e.length))
 		rtest.Equals(t, i, int(e.offset))
 		rtest.Equals(t, i/2, int(e.uncompressedLength))
@@ -108,6 +109,94 @@ func TestIndexMapForeachWithID(t *testing.T) {
 	}
 }
 
+func TestIndexMapCompact(t *testing.T) {
+	t.Parallel()
+
+	var (
+		m   indexMap
+		ids []restic.ID
+		r   = rand.New(rand.NewSource(4711))
+	)
+
+	// more entries than fit into a hash table before it is compacted
+	const n = 3*minCompact + 17
+	for i := 0; i < n; i++ {
+		var id restic.ID
+		r.Read(id[:])
+		ids = append(ids, id)
+		m.add(id, i, uint32(i), uint32(i), 0)
+		m.maybeCompact()
+	}
+	rtest.Assert(t, m.sorted.len() > 0, "entries were not compacted")
+	rtest.Assert(t, m.numentries > 0, "all entries were compacted")
+	rtest.Equals(t, uint(n), m.len())
+
+	// a duplicate of an entry in the sorted array is kept in the hash table
+	m.add(ids[0], n, 1, 1, 0)
+
+	check := func() {
+		for i, id := range ids {
+			e := m.get(id)
+			rtest.Assert(t, e != nil, "%v not found", id)
+			rtest.Equals(t, uint32(i), e.offset)
+		}
+
+		var packs []int
+		m.foreachWithID(ids[0], func(e *indexEntry) {
+			packs = append(packs, int(e.packIndex))
+		})
+		sort.Ints(packs)
+		rtest.Equals(t, []int{0, n}, packs)
+
+		var unknown restic.ID
+		r.Read(unknown[:])
+		rtest.Assert(t, m.get(unknown) == nil, "unknown id %v found", unknown)
+
+		count := 0
+		m.foreach(func(*indexEntry) bool {
+			count++
+			return true
+		})
+		rtest.Equals(t, n+1, count)
+	}
+
+	check()
+	m.compact()
+	rtest.Equals(t, uint(0), m.numentries)
+	rtest.Equals(t, uint(n+1), m.sorted.len())
+	check()
+
+	// the sorted array uses fewer bytes per entry than the hash table
+	rtest.Assert(t, m.memoryUsage() < 52*(n+1), "sorted entries use %d bytes", m.memoryUsage())
+}
+
+func TestSortedEntriesMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	var s sortedEntries
+	for _, size := range []int{0, 1, 15, sortedBlockSize - 1, 3*sortedBlockSize + 5} {
+		entries := make([]indexEntry, size)
+		for i := range entries {
+			r.Read(entries[i].id[:])
+			// the entries are sorted by their ID only
+			entries[i].id[0] &= 0x7f
+		}
+		sort.Slice(entries, func(i, j int) bool { return compareID(entries[i].id, entries[j].id) < 0 })
+
+		oldLen := s.len()
+		s = mergeSorted(&s, entries)
+		rtest.Equals(t, oldLen+uint(size), s.len())
+		for pos := uint(1); pos < s.len(); pos++ {
+			rtest.Assert(t, compareID(s.at(pos-1).id, s.at(pos).id) <= 0, "entries not sorted at %d", pos)
+		}
+		for i := range entries {
+			rtest.Equals(t, entries[i].id, s.get(entries[i].id).id)
+		}
+		// IDs outside the stored range
+		rtest.Assert(t, s.get(restic.ID{0xff}) == nil, "unexpected entry")
+		rtest.Assert(t, s.get(restic.ID{}) == nil, "unexpected entry")
+	}
+}
+
 func TestHashedArrayTree(t *testing.T) {
 	hat := newHAT()
 	const testSize = 1024
@@ -143,3 +232,31 @@ func BenchmarkIndexMapHash(b *testing.B) {
 		}
 	}
 }
+
+func benchmarkIndexMapGet(b *testing.B, compact bool) {
+	const n = 1 << 20
+
+	var m indexMap
+	ids := make([]restic.ID, n)
+	r := rand.New(rand.NewSource(12345))
+	for i := range ids {
+		r.Read(ids[i][:])
+		m.add(ids[i], 0, 0, 0, 0)
+	}
+	if compact {
+		m.compact()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if m.get(ids[i%n]) == nil {
+			b.Fatal("entry not found")
+		}
+	}
+	b.ReportMetric(float64(m.memoryUsage())/n, "bytes/entry")
+}
+
+func BenchmarkIndexMapGet(b *testing.B) {
+	b.Run("hashed", func(b *testing.B) { benchmarkIndexMapGet(b, false) })
+	b.Run("sorted", func(b *testing.B) { benchmarkIndexMapGet(b, true) })
+}
@@ -0,0 +1,437 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/ui/progress"
+)
+
+const (
+	// lazySegmentMaxBlobs is the number of blobs after which a new segment
+	// is started. A segment can exceed this by the size of one index file.
+	lazySegmentMaxBlobs = 100000
+	// lazyLoadedSegments is the number of segments kept in memory once they
+	// have been loaded.
+	lazyLoadedSegments = 4
+)
+
+// LazyIndex answers queries for blobs without keeping the index in memory.
+// The index files are grouped into segments, for each segment a bloom filter
+// records which blobs it contains. The index files of a segment are only
+// loaded once its filter reports a probable match.
+//
+// The filters are stored in a file in the local cache, such that only the
+// filters for new index files must be built. As index files are never
+// modified, a filter stays valid until one of the index files of its segment
+// is removed from the repository.
+type LazyIndex struct {
+	segments []*lazySegment
+	load     func(id restic.ID) (*Index, error)
+
+	m sync.Mutex
+	// loaded contains the segments which were used most recently, the most
+	// recent one first.
+	loaded []*loadedSegment
+}
+
+type lazySegment struct {
+	indexes restic.IDs
+	blobs   uint32
+	filter  *blobFilter
+}
+
+type loadedSegment struct {
+	segment *lazySegment
+	indexes []*Index
+}
+
+// LazyIndexOptions configures OpenLazyIndex.
+type LazyIndexOptions struct {
+	// Filename is the file which stores the filters.
+	Filename string
+	// RepoID is the ID of the repository, filters stored for a different
+	// repository are ignored.
+	RepoID string
+	// DamagedIndex is called for each index file which cannot be loaded. If
+	// it is set, such index files are skipped, otherwise opening the index
+	// fails.
+	DamagedIndex func(id restic.ID, err error)
+}
+
+// OpenLazyIndex returns a lazy index for the index files returned by lister.
+// It reads the filters from the file in opts and builds the missing filters
+// by loading the index files which are not covered yet. The updated filters
+// are written back to the file. p is updated for each loaded index file.
+func OpenLazyIndex(ctx context.Context, lister restic.Lister, repo restic.Repository, opts LazyIndexOptions, p *progress.Counter) (*LazyIndex, error) {
+	existing := restic.NewIDSet()
+	err := lister.List(ctx, restic.IndexFile, func(id restic.ID, _ int64) error {
+		existing.Insert(id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := readLazySegments(opts.Filename, opts.RepoID)
+	if err != nil {
+		debug.Log("ignoring filters in %v: %v", opts.Filename, err)
+		stored = nil
+	}
+
+	// keep the segments whose index files all still exist
+	var segments []*lazySegment
+	covered := restic.NewIDSet()
+	for _, seg := range stored {
+		if len(restic.NewIDSet(seg.indexes...).Sub(existing)) > 0 {
+			debug.Log("dropping segment of %d index files, as some were removed", len(seg.indexes))
+			continue
+		}
+		segments = append(segments, seg)
+		covered.Merge(restic.NewIDSet(seg.indexes...))
+	}
+
+	todo := existing.Sub(covered)
+	if len(todo) > 0 {
+		// rebuild small segments together with the new index files instead
+		// of adding ever more small segments
+		kept := segments[:0]
+		for _, seg := range segments {
+			if seg.blobs < lazySegmentMaxBlobs/2 {
+				todo.Merge(restic.NewIDSet(seg.indexes...))
+			} else {
+				kept = append(kept, seg)
+			}
+		}
+		segments = kept
+	}
+	changed := len(todo) > 0 || len(segments) != len(stored)
+
+	if p != nil {
+		p.SetMax(uint64(len(todo)))
+		defer p.Done()
+	}
+
+	var pending []restic.BlobHandle
+	var pendingIndexes restic.IDs
+	flush := func() {
+		if len(pendingIndexes) == 0 {
+			return
+		}
+		seg := &lazySegment{
+			indexes: pendingIndexes,
+			blobs:   uint32(len(pending)),
+			filter:  newBlobFilter(uint(len(pending))),
+		}
+		for _, bh := range pending {
+			seg.filter.add(bh)
+		}
+		segments = append(segments, seg)
+		pending, pendingIndexes = nil, nil
+	}
+
+	err = ForAllIndexes(ctx, idLister(todo.List()), repo, func(id restic.ID, idx *Index, _ bool, err error) error {
+		if p != nil {
+			p.Add(1)
+		}
+		if err != nil {
+			if opts.DamagedIndex == nil || ctx.Err() != nil {
+				return errors.Wrapf(err, "index %v", id.Str())
+			}
+			opts.DamagedIndex(id, err)
+			return nil
+		}
+
+		idx.Each(ctx, func(pb restic.PackedBlob) {
+			pending = append(pending, pb.BlobHandle)
+		})
+		pendingIndexes = append(pendingIndexes, id)
+		if len(pending) >= lazySegmentMaxBlobs {
+			flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+
+	if changed {
+		// the filters can be built again, thus failing to store them is not fatal
+		err = writeLazySegments(opts.Filename, opts.RepoID, segments)
+		if err != nil {
+			debug.Log("unable to store filters in %v: %v", opts.Filename, err)
+		}
+	}
+
+	return &LazyIndex{
+		segments: segments,
+		load: func(id restic.ID) (*Index, error) {
+			buf, err := repo.LoadUnpacked(ctx, restic.IndexFile, id)
+			if err != nil {
+				return nil, err
+			}
+			idx, _, err := DecodeIndex(buf, id)
+			return idx, err
+		},
+	}, nil
+}
+
+// IDs returns the IDs of all index files covered by the lazy index.
+func (l *LazyIndex) IDs() restic.IDSet {
+	ids := restic.NewIDSet()
+	for _, seg := range l.segments {
+		ids.Merge(restic.NewIDSet(seg.indexes...))
+	}
+	return ids
+}
+
+// each calls fn for the index files of all segments which probably contain
+// the blob, until fn returns true.
+func (l *LazyIndex) each(bh restic.BlobHandle, fn func(idx *Index) bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for _, seg := range l.segments {
+		if !seg.filter.mayContain(bh) {
+			continue
+		}
+		loaded, err := l.loadSegment(seg)
+		if err != nil {
+			// treating the blob as unknown at worst stores it again
+			debug.Log("unable to load segment: %v", err)
+			continue
+		}
+		for _, idx := range loaded.indexes {
+			if fn(idx) {
+				return
+			}
+		}
+	}
+}
+
+// loadSegment returns the index files of seg. l.m must be held.
+func (l *LazyIndex) loadSegment(seg *lazySegment) (*loadedSegment, error) {
+	for i, loaded := range l.loaded {
+		if loaded.segment == seg {
+			copy(l.loaded[1:i+1], l.loaded[:i])
+			l.loaded[0] = loaded
+			return loaded, nil
+		}
+	}
+
+	debug.Log("loading segment of %d index files", len(seg.indexes))
+	loaded := &loadedSegment{segment: seg}
+	for _, id := range seg.indexes {
+		idx, err := l.load(id)
+		if err != nil {
+			return nil, fmt.Errorf("index %v: %w", id.Str(), err)
+		}
+		loaded.indexes = append(loaded.indexes, idx)
+	}
+
+	if len(l.loaded) < lazyLoadedSegments {
+		l.loaded = append(l.loaded, nil)
+	}
+	copy(l.loaded[1:], l.loaded)
+	l.loaded[0] = loaded
+	return loaded, nil
+}
+
+// Has returns true if one of the index files contains the blob.
+func (l *LazyIndex) Has(bh restic.BlobHandle) bool {
+	found := false
+	l.each(bh, func(idx *Index) bool {
+		found = idx.Has(bh)
+		return found
+	})
+	return found
+}
+
+// Lookup appends all entries for the blob to pbs.
+func (l *LazyIndex) Lookup(bh restic.BlobHandle, pbs []restic.PackedBlob) []restic.PackedBlob {
+	l.each(bh, func(idx *Index) bool {
+		pbs = idx.Lookup(bh, pbs)
+		return false
+	})
+	return pbs
+}
+
+// LookupSize returns the plaintext size of the blob.
+func (l *LazyIndex) LookupSize(bh restic.BlobHandle) (size uint, found bool) {
+	l.each(bh, func(idx *Index) bool {
+		size, found = idx.LookupSize(bh)
+		return found
+	})
+	return size, found
+}
+
+// idLister lists a fixed set of index files.
+type idLister restic.IDs
+
+func (l idLister) List(ctx context.Context, _ restic.FileType, fn func(restic.ID, int64) error) error {
+	for _, id := range l {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := fn(id, 0); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+const (
+	lazyFileMagic   = "RSTLAZYI"
+	lazyFileVersion = 1
+)
+
+// writeLazySegments atomically replaces filename with the segments. The
+// file ends with the hash of its contents to detect damage.
+func writeLazySegments(filename string, repoID string, segments []*lazySegment) error {
+	buf := bytes.NewBufferString(lazyFileMagic)
+	le := binary.LittleEndian
+	write := func(data interface{}) {
+		// writing to a bytes.Buffer cannot fail
+		_ = binary.Write(buf, le, data)
+	}
+
+	write(uint32(lazyFileVersion))
+	write(uint32(len(repoID)))
+	buf.WriteString(repoID)
+	write(uint32(len(segments)))
+	for _, seg := range segments {
+		write(uint32(len(seg.indexes)))
+		for _, id := range seg.indexes {
+			buf.Write(id[:])
+		}
+		write(seg.blobs)
+		write(seg.filter.hashes)
+		write(uint32(len(seg.filter.bits)))
+		write(seg.filter.bits)
+	}
+	hash := restic.Hash(buf.Bytes())
+	buf.Write(hash[:])
+
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+"-tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// readLazySegments reads the segments from filename, which must have been
+// written for the same repository.
+func readLazySegments(filename string, repoID string) ([]*lazySegment, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < len(lazyFileMagic)+len(restic.ID{}) || string(buf[:len(lazyFileMagic)]) != lazyFileMagic {
+		return nil, errors.New("invalid file format")
+	}
+	data := buf[:len(buf)-len(restic.ID{})]
+	if !restic.Hash(data).Equal(restic.IDFromHash(buf[len(data):])) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	rd := bytes.NewReader(data[len(lazyFileMagic):])
+	le := binary.LittleEndian
+	readUint32 := func() (v uint32, err error) {
+		err = binary.Read(rd, le, &v)
+		return v, err
+	}
+	// readCount reads a number of items of size bytes each, which must be
+	// available in the remaining data
+	readCount := func(size int) (int, error) {
+		v, err := readUint32()
+		if err != nil {
+			return 0, err
+		}
+		if uint64(v)*uint64(size) > uint64(rd.Len()) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return int(v), nil
+	}
+
+	version, err := readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if version != lazyFileVersion {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	n, err := readCount(1)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, n)
+	_, _ = rd.Read(id)
+	if string(id) != repoID {
+		return nil, errors.New("file belongs to a different repository")
+	}
+
+	n, err = readCount(1)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]*lazySegment, 0, n)
+	for i := 0; i < n; i++ {
+		seg := &lazySegment{filter: &blobFilter{}}
+		indexes, err := readCount(len(restic.ID{}))
+		if err != nil {
+			return nil, err
+		}
+		seg.indexes = make(restic.IDs, indexes)
+		for j := range seg.indexes {
+			_, _ = rd.Read(seg.indexes[j][:])
+		}
+		if seg.blobs, err = readUint32(); err != nil {
+			return nil, err
+		}
+		if seg.filter.hashes, err = readUint32(); err != nil {
+			return nil, err
+		}
+		if seg.filter.hashes == 0 || seg.filter.hashes > 64 {
+			return nil, errors.New("invalid number of hashes")
+		}
+		words, err := readCount(8)
+		if err != nil {
+			return nil, err
+		}
+		if words == 0 {
+			return nil, errors.New("empty filter")
+		}
+		seg.filter.bits = make([]uint64, words)
+		if err = binary.Read(rd, le, seg.filter.bits); err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	if rd.Len() != 0 {
+		return nil, errors.New("unexpected data at the end of the file")
+	}
+
+	return segments, nil
+}
@@ -0,0 +1,93 @@
+package index_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/index"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+	"github.com/restic/restic/internal/ui/progress"
+)
+
+// openLazyIndex opens a lazy index and returns how many index files had to be
+// loaded for it.
+func openLazyIndex(t *testing.T, repo restic.Repository, opts index.LazyIndexOptions) (*index.LazyIndex, uint64) {
+	p := progress.NewCounter(0, 0, func(value uint64, total uint64, runtime time.Duration, final bool) {})
+	lazy, err := index.OpenLazyIndex(context.TODO(), repo, repo, opts, p)
+	rtest.OK(t, err)
+	loaded, _ := p.Get()
+	return lazy, loaded
+}
+
+func TestLazyIndex(t *testing.T) {
+	repodir, cleanup := rtest.Env(t, repoFixture)
+	defer cleanup()
+
+	repo := repository.TestOpenLocal(t, repodir)
+	rtest.OK(t, repo.LoadIndex(context.TODO(), nil))
+	var blobs []restic.PackedBlob
+	repo.Index().Each(context.TODO(), func(pb restic.PackedBlob) {
+		blobs = append(blobs, pb)
+	})
+	indexIDs := repo.Index().(*index.MasterIndex).IDs()
+
+	opts := index.LazyIndexOptions{
+		Filename: filepath.Join(t.TempDir(), "lazy-index"),
+		RepoID:   repo.Config().ID,
+	}
+	lazy, loaded := openLazyIndex(t, repo, opts)
+	rtest.Equals(t, uint64(len(indexIDs)), loaded)
+	rtest.Equals(t, indexIDs, lazy.IDs())
+
+	for _, pb := range blobs {
+		rtest.Assert(t, lazy.Has(pb.BlobHandle), "blob %v not found", pb.BlobHandle)
+		rtest.Equals(t, repo.Index().Lookup(pb.BlobHandle), lazy.Lookup(pb.BlobHandle, nil))
+		size, found := lazy.LookupSize(pb.BlobHandle)
+		rtest.Assert(t, found, "size of blob %v not found", pb.BlobHandle)
+		rtest.Equals(t, pb.DataLength(), size)
+	}
+	unknown := restic.BlobHandle{ID: restic.NewRandomID(), Type: restic.DataBlob}
+	rtest.Assert(t, !lazy.Has(unknown), "unknown blob found")
+
+	// the filters are reused
+	_, loaded = openLazyIndex(t, repo, opts)
+	rtest.Equals(t, uint64(0), loaded)
+
+	// filters of a different repository are ignored
+	other := opts
+	other.RepoID = restic.NewRandomID().String()
+	_, loaded = openLazyIndex(t, repo, other)
+	rtest.Equals(t, uint64(len(indexIDs)), loaded)
+	_, loaded = openLazyIndex(t, repo, opts)
+	rtest.Equals(t, uint64(len(indexIDs)), loaded)
+
+	// a damaged file is ignored
+	buf, err := os.ReadFile(opts.Filename)
+	rtest.OK(t, err)
+	buf[len(buf)/2] ^= 1
+	rtest.OK(t, os.WriteFile(opts.Filename, buf, 0600))
+	_, loaded = openLazyIndex(t, repo, opts)
+	rtest.Equals(t, uint64(len(indexIDs)), loaded)
+
+	// removing an index file, for example by prune, invalidates its segment
+	removed := indexIDs.List()[0]
+	removedIdx, err := repo.LoadUnpacked(context.TODO(), restic.IndexFile, removed)
+	rtest.OK(t, err)
+	idx, _, err := index.DecodeIndex(removedIdx, removed)
+	rtest.OK(t, err)
+	rtest.OK(t, repo.Backend().Remove(context.TODO(), backend.Handle{Type: restic.IndexFile, Name: removed.String()}))
+	indexIDs.Delete(removed)
+
+	lazy, loaded = openLazyIndex(t, repo, opts)
+	rtest.Equals(t, uint64(len(indexIDs)), loaded)
+	rtest.Equals(t, indexIDs, lazy.IDs())
+	for _, pb := range blobs {
+		rtest.Equals(t, !idx.Has(pb.BlobHandle), lazy.Has(pb.BlobHandle))
+	}
+}
@@ -19,6 +19,7 @@ type MasterIndex struct {
 	pendingBlobs restic.BlobSet
 	idxMutex     sync.RWMutex
 	compress     bool
+	lazy         *LazyIndex
 }
 
 // NewMasterIndex creates a new master index.
@@ -35,6 +36,16 @@ func (mi *MasterIndex) MarkCompressed() {
 	mi.compress = true
 }
 
+// SetLazyIndex consults the lazy index for all blobs which are not found in
+// the other indexes. Each, Packs, ListPacks and Save do not cover the index
+// files of the lazy index.
+func (mi *MasterIndex) SetLazyIndex(lazy *LazyIndex) {
+	mi.idxMutex.Lock()
+	defer mi.idxMutex.Unlock()
+
+	mi.lazy = lazy
+}
+
 // Lookup queries all known Indexes for the ID and returns all matches.
 func (mi *MasterIndex) Lookup(bh restic.BlobHandle) (pbs []restic.PackedBlob) {
 	mi.idxMutex.RLock()
@@ -43,6 +54,9 @@ func (mi *MasterIndex) Lookup(bh restic.BlobHandle) (pbs []restic.PackedBlob) {
 	for _, idx := range mi.idx {
 		pbs = idx.Lookup(bh, pbs)
 	}
+	if mi.lazy != nil {
+		pbs = mi.lazy.Lookup(bh, pbs)
+	}
 
 	return pbs
 }
@@ -57,6 +71,9 @@ func (mi *MasterIndex) LookupSize(bh restic.BlobHandle) (uint, bool) {
 			return size, found
 		}
 	}
+	if mi.lazy != nil {
+		return mi.lazy.LookupSize(bh)
+	}
 
 	return 0, false
 }
@@ -80,6 +97,9 @@ func (mi *MasterIndex) AddPending(bh restic.BlobHandle) bool {
 			return false
 		}
 	}
+	if mi.lazy != nil && mi.lazy.Has(bh) {
+		return false
+	}
 
 	// really not known -> insert
 	mi.pendingBlobs.Insert(bh)
@@ -102,6 +122,9 @@ func (mi *MasterIndex) Has(bh restic.BlobHandle) bool {
 			return true
 		}
 	}
+	if mi.lazy != nil {
+		return mi.lazy.Has(bh)
+	}
 
 	return false
 }
@@ -125,6 +148,9 @@ func (mi *MasterIndex) IDs() restic.IDSet {
 			ids.Insert(id)
 		}
 	}
+	if mi.lazy != nil {
+		ids.Merge(mi.lazy.IDs())
+	}
 	return ids
 }
 
@@ -262,6 +288,8 @@ func (mi *MasterIndex) MergeFinalIndexes() error {
 	}
 	mi.idx = newIdx
 
+	entries, size := mi.idx[0].memoryUsage()
+	debug.Log("merged index contains %d entries using %d bytes", entries, size)
 	return nil
 }
 
@@ -0,0 +1,164 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"sort"
+	"unsafe"
+
+	"github.com/restic/restic/internal/restic"
+)
+
+// sortedBlockSize is the number of entries per block of sortedEntries.
+const sortedBlockSize = 1 << 12
+
+// sortedEntries is an immutable array of indexEntries sorted by ID. The
+// entries are stored in blocks of a fixed size, such that merging arrays
+// can release the blocks which were already copied.
+//
+// A lookup first uses a fanout table indexed by the leading bits of the ID.
+// As IDs are uniformly distributed, this leaves a binary search across a few
+// entries on average.
+type sortedEntries struct {
+	blocks [][]indexEntry
+	n      uint
+
+	// fanout[p] holds the position of the first entry whose ID starts with
+	// the prefix p of fanoutBits bits.
+	fanout     []uint32
+	fanoutBits uint
+}
+
+func (s *sortedEntries) len() uint { return s.n }
+
+func (s *sortedEntries) at(pos uint) *indexEntry {
+	return &s.blocks[pos/sortedBlockSize][pos%sortedBlockSize]
+}
+
+func (s *sortedEntries) prefix(id restic.ID) uint {
+	return uint(uint64(binary.BigEndian.Uint32(id[:4])) >> (32 - s.fanoutBits))
+}
+
+// search returns the position of the first entry with the given id, or the
+// position at which it would be stored.
+func (s *sortedEntries) search(id restic.ID) uint {
+	if s.n == 0 {
+		return 0
+	}
+	p := s.prefix(id)
+	start, end := uint(s.fanout[p]), uint(s.fanout[p+1])
+	return start + uint(sort.Search(int(end-start), func(i int) bool {
+		return compareID(s.at(start+uint(i)).id, id) >= 0
+	}))
+}
+
+// foreachWithID calls fn for all entries with the given id.
+func (s *sortedEntries) foreachWithID(id restic.ID, fn func(*indexEntry)) {
+	for pos := s.search(id); pos < s.n; pos++ {
+		e := s.at(pos)
+		if e.id != id {
+			return
+		}
+		fn(e)
+	}
+}
+
+// get returns the first entry for the given id.
+func (s *sortedEntries) get(id restic.ID) *indexEntry {
+	pos := s.search(id)
+	if pos < s.n && s.at(pos).id == id {
+		return s.at(pos)
+	}
+	return nil
+}
+
+// foreach calls fn for all entries in the order of their ID, until fn
+// returns false.
+func (s *sortedEntries) foreach(fn func(*indexEntry) bool) {
+	for pos := uint(0); pos < s.n; pos++ {
+		if !fn(s.at(pos)) {
+			return
+		}
+	}
+}
+
+// memoryUsage returns the number of bytes allocated for the entries.
+func (s *sortedEntries) memoryUsage() uint {
+	size := uint(cap(s.fanout)) * 4
+	for _, b := range s.blocks {
+		size += uint(cap(b)) * uint(unsafe.Sizeof(indexEntry{}))
+	}
+	return size
+}
+
+func compareID(a, b restic.ID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// mergeSorted merges the entries of s and the sorted slice entries into a
+// new sortedEntries. The blocks of s are released while they are copied, s
+// must not be used afterwards.
+func mergeSorted(s *sortedEntries, entries []indexEntry) sortedEntries {
+	total := s.n + uint(len(entries))
+	out := sortedEntries{
+		blocks: make([][]indexEntry, 0, (total+sortedBlockSize-1)/sortedBlockSize),
+		n:      total,
+	}
+
+	var block []indexEntry
+	appendEntry := func(e *indexEntry) {
+		if len(block) == cap(block) {
+			// the last block only has the remaining size
+			size := total - uint(len(out.blocks))*sortedBlockSize
+			if size > sortedBlockSize {
+				size = sortedBlockSize
+			}
+			block = make([]indexEntry, 0, size)
+			out.blocks = append(out.blocks, nil)
+		}
+		block = append(block, *e)
+		out.blocks[len(out.blocks)-1] = block
+	}
+
+	var pos uint
+	for len(entries) > 0 || pos < s.n {
+		if len(entries) == 0 || (pos < s.n && compareID(s.at(pos).id, entries[0].id) <= 0) {
+			appendEntry(s.at(pos))
+			pos++
+			if pos%sortedBlockSize == 0 || pos == s.n {
+				// allow GC of the copied block
+				s.blocks[(pos-1)/sortedBlockSize] = nil
+			}
+		} else {
+			appendEntry(&entries[0])
+			entries = entries[1:]
+		}
+	}
+	*s = sortedEntries{}
+
+	out.buildFanout()
+	return out
+}
+
+// buildFanout creates the fanout table with about 16 entries per prefix.
+func (s *sortedEntries) buildFanout() {
+	s.fanoutBits = 0
+	if s.n > 16 {
+		s.fanoutBits = uint(bits.Len(s.n/16)) - 1
+	}
+	if s.fanoutBits > 24 {
+		s.fanoutBits = 24
+	}
+
+	s.fanout = make([]uint32, (1<<s.fanoutBits)+1)
+	var p uint
+	for pos := uint(0); pos < s.n; pos++ {
+		for prefix := s.prefix(s.at(pos).id); p <= prefix; p++ {
+			s.fanout[p] = uint32(pos)
+		}
+	}
+	for ; p < uint(len(s.fanout)); p++ {
+		s.fanout[p] = uint32(s.n)
+	}
+}
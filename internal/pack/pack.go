@@ -80,7 +80,7 @@ func (p *Packer) Finalize() error {
 	}
 
 	encryptedHeader := make([]byte, 0, crypto.CiphertextLength(len(header)))
-	nonce := crypto.NewRandomNonce()
+	nonce := p.k.NewNonce()
 	encryptedHeader = append(encryptedHeader, nonce...)
 	encryptedHeader = p.k.Seal(encryptedHeader, nonce, header, nil)
 
@@ -0,0 +1,19 @@
+package repository
+
+import (
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/restic"
+)
+
+// IsDeletionForbidden returns true if err was returned while removing a file
+// from the repository because its backend does not allow deleting files,
+// for example a rest-server in append-only mode or a bucket whose policy
+// forbids deletions. Files protected by a retention period are reported as
+// backend.ErrRetained instead.
+func IsDeletionForbidden(repo restic.Repository, err error) bool {
+	if err == nil {
+		return false
+	}
+	c := backend.AsBackend[backend.DeletionClassifier](repo.Backend())
+	return c != nil && c.IsDeletionForbidden(err)
+}
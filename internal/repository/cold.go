@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/restic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ColdPacksError is returned by ThawPacks if pack files are stored in an
+// archive storage tier and must be restored before they can be read.
+type ColdPacksError struct {
+	Packs restic.IDs
+}
+
+func (e *ColdPacksError) Error() string {
+	return fmt.Sprintf("%d pack files are in cold storage and must be restored before they can be read", len(e.Packs))
+}
+
+func (e *ColdPacksError) Is(target error) bool {
+	return target == backend.ErrCold
+}
+
+// ThawOptions control how ThawPacks handles archived pack files.
+type ThawOptions struct {
+	// Request lets ThawPacks request the restore of archived pack files and
+	// wait until all of them can be read.
+	Request bool
+	// PollInterval is the time between checks whether the requested
+	// restores have completed.
+	PollInterval time.Duration
+	// Progress, if set, is called with the number of pack files which cannot
+	// be read yet after each check.
+	Progress func(pending, total int)
+}
+
+// ThawPacks makes sure that the data pack files can be read. Without
+// opts.Request, a ColdPacksError listing the archived pack files is returned.
+// Nothing is checked if the backend does not store data packs in an archive
+// storage tier and no restore was requested.
+func ThawPacks(ctx context.Context, repo restic.Repository, packs restic.IDs, opts ThawOptions) error {
+	be := backend.AsBackend[backend.ColdStorageBackend](repo.Backend())
+	if be == nil || len(packs) == 0 {
+		return nil
+	}
+	if !opts.Request && !be.ColdFile(backend.Handle{Type: restic.PackFile}) {
+		return nil
+	}
+
+	pending := packs
+	for {
+		var err error
+		pending, err = thawPending(ctx, be, pending, opts.Request, int(repo.Connections()))
+		if err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(len(pending), len(packs))
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if !opts.Request {
+			return &ColdPacksError{Packs: pending}
+		}
+
+		debug.Log("waiting for %d of %d pack files", len(pending), len(packs))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(opts.PollInterval):
+		}
+	}
+}
+
+// thawPending returns the sorted list of pack files which cannot be read yet.
+func thawPending(ctx context.Context, be backend.ColdStorageBackend, packs restic.IDs, request bool, workers int) (restic.IDs, error) {
+	wg, ctx := errgroup.WithContext(ctx)
+	ch := make(chan restic.ID)
+
+	var m sync.Mutex
+	var pending restic.IDs
+
+	wg.Go(func() error {
+		defer close(ch)
+		for _, id := range packs {
+			select {
+			case ch <- id:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Go(func() error {
+			for id := range ch {
+				ok, err := be.Thaw(ctx, backend.Handle{Type: restic.PackFile, Name: id.String()}, request)
+				if err != nil {
+					return fmt.Errorf("pack %v: %w", id.Str(), err)
+				}
+				if !ok {
+					m.Lock()
+					pending = append(pending, id)
+					m.Unlock()
+				}
+			}
+			return nil
+		})
+	}
+
+	if err := wg.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Sort(pending)
+	return pending, nil
+}
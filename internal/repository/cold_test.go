@@ -0,0 +1,89 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/mem"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+// archiveBackend stores all data packs in a simulated archive storage tier.
+// A requested restore completes after the file was checked delay times.
+type archiveBackend struct {
+	backend.Backend
+	delay int
+
+	m        sync.Mutex
+	requests map[string]int
+}
+
+func (be *archiveBackend) ColdFile(h backend.Handle) bool {
+	return h.Type == backend.PackFile && !h.IsMetadata
+}
+
+func (be *archiveBackend) Thaw(_ context.Context, h backend.Handle, request bool) (bool, error) {
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	checks, ok := be.requests[h.Name]
+	if !ok {
+		if request {
+			be.requests[h.Name] = 0
+		}
+		return false, nil
+	}
+	be.requests[h.Name] = checks + 1
+	return checks+1 >= be.delay, nil
+}
+
+func TestThawPacks(t *testing.T) {
+	be := &archiveBackend{Backend: mem.New(), delay: 2, requests: make(map[string]int)}
+	repo := repository.TestRepositoryWithBackend(t, be, 0)
+	packs := restic.IDs{restic.NewRandomID(), restic.NewRandomID(), restic.NewRandomID()}
+
+	err := repository.ThawPacks(context.TODO(), repo, packs, repository.ThawOptions{})
+	var cerr *repository.ColdPacksError
+	rtest.Assert(t, errors.As(err, &cerr), "unexpected error %v", err)
+	rtest.Assert(t, errors.Is(err, backend.ErrCold), "error %v does not match ErrCold", err)
+	rtest.Equals(t, 3, len(cerr.Packs))
+	rtest.Equals(t, 0, len(be.requests))
+
+	var progress []int
+	rtest.OK(t, repository.ThawPacks(context.TODO(), repo, packs, repository.ThawOptions{
+		Request:      true,
+		PollInterval: time.Millisecond,
+		Progress: func(pending, total int) {
+			rtest.Equals(t, 3, total)
+			progress = append(progress, pending)
+		},
+	}))
+	rtest.Equals(t, []int{3, 3, 0}, progress)
+
+	// all packs are readable now
+	rtest.OK(t, repository.ThawPacks(context.TODO(), repo, packs, repository.ThawOptions{}))
+}
+
+func TestThawPacksCanceled(t *testing.T) {
+	be := &archiveBackend{Backend: mem.New(), delay: 1000, requests: make(map[string]int)}
+	repo := repository.TestRepositoryWithBackend(t, be, 0)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	err := repository.ThawPacks(ctx, repo, restic.IDs{restic.NewRandomID()}, repository.ThawOptions{
+		Request:      true,
+		PollInterval: time.Hour,
+		Progress:     func(int, int) { cancel() },
+	})
+	rtest.Assert(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+}
+
+func TestThawPacksHotBackend(t *testing.T) {
+	repo := repository.TestRepository(t)
+	rtest.OK(t, repository.ThawPacks(context.TODO(), repo, restic.IDs{restic.NewRandomID()}, repository.ThawOptions{Request: true}))
+}
@@ -22,6 +22,10 @@ var (
 
 	// ErrMaxKeysReached is returned when the maximum number of keys was checked and no key could be found.
 	ErrMaxKeysReached = errors.New("maximum number of keys reached")
+
+	// errNotPasswordKey is returned when opening a key which is not protected
+	// by a password.
+	errNotPasswordKey = errors.New("key is not protected by a password")
 )
 
 // Key represents an encrypted master key for a repository.
@@ -37,6 +41,13 @@ type Key struct {
 	Salt []byte `json:"salt"`
 	Data []byte `json:"data"`
 
+	// Type is empty for password keys, see KeyTypeWriteOnly and
+	// KeyTypeSession for the other types.
+	Type         string     `json:"type,omitempty"`
+	PublicKey    []byte     `json:"public_key,omitempty"`
+	WriteOnlyKey *restic.ID `json:"write_only_key,omitempty"`
+	Tag          []byte     `json:"tag,omitempty"`
+
 	user   *crypto.Key
 	master *crypto.Key
 
@@ -69,6 +80,15 @@ func OpenKey(ctx context.Context, s *Repository, id restic.ID, password string)
 		return nil, err
 	}
 
+	return openKey(k, id, password)
+}
+
+// openKey decrypts the master key stored in the loaded key file k.
+func openKey(k *Key, id restic.ID, password string) (*Key, error) {
+	if k.Type != "" {
+		return nil, errNotPasswordKey
+	}
+
 	// check KDF
 	if k.KDF != "scrypt" {
 		return nil, errors.New("only supported KDF is scrypt()")
@@ -80,6 +100,7 @@ func OpenKey(ctx context.Context, s *Repository, id restic.ID, password string)
 		R: k.R,
 		P: k.P,
 	}
+	var err error
 	k.user, err = crypto.KDF(params, k.Salt, password)
 	if err != nil {
 		return nil, errors.Wrap(err, "crypto.KDF")
@@ -113,6 +134,13 @@ func OpenKey(ctx context.Context, s *Repository, id restic.ID, password string)
 // maxKeys is reached, ErrMaxKeysReached is returned. When setting maxKeys to
 // zero, all keys in the repo are checked.
 func SearchKey(ctx context.Context, s *Repository, password string, maxKeys int, keyHint string) (k *Key, err error) {
+	k, _, err = searchKey(ctx, s, password, maxKeys, keyHint)
+	return k, err
+}
+
+// searchKey works like SearchKey and additionally returns the IDs of all key
+// files, unless the hinted key was opened without listing the key files.
+func searchKey(ctx context.Context, s *Repository, password string, maxKeys int, keyHint string) (k *Key, ids restic.IDs, err error) {
 	checked := 0
 
 	if len(keyHint) > 0 {
@@ -123,7 +151,7 @@ func SearchKey(ctx context.Context, s *Repository, password string, maxKeys int,
 
 			if err == nil {
 				debug.Log("successfully opened hinted key %v", id)
-				return key, nil
+				return key, nil, nil
 			}
 
 			debug.Log("could not open hinted key %v", id)
@@ -132,18 +160,32 @@ func SearchKey(ctx context.Context, s *Repository, password string, maxKeys int,
 		}
 	}
 
-	listCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
 	// try at most maxKeys keys in repo
-	err = s.List(listCtx, restic.KeyFile, func(id restic.ID, size int64) error {
+	err = s.List(ctx, restic.KeyFile, func(id restic.ID, size int64) error {
+		// the remaining key files are only collected, as they are listed only once
+		ids = append(ids, id)
+		if k != nil {
+			return nil
+		}
+
+		key, err := LoadKey(ctx, s, id)
+		if err != nil {
+			debug.Log("LoadKey(%v) returned error %v", id.String(), err)
+			return err
+		}
+		if key.Type != "" {
+			// write-only and session keys are not protected by a password,
+			// they do not count towards maxKeys
+			return nil
+		}
+
 		checked++
 		if maxKeys > 0 && checked > maxKeys {
 			return ErrMaxKeysReached
 		}
 
 		debug.Log("trying key %q", id.String())
-		key, err := OpenKey(ctx, s, id, password)
+		key, err = openKey(key, id, password)
 		if err != nil {
 			debug.Log("key %v returned error %v", id.String(), err)
 
@@ -157,23 +199,18 @@ func SearchKey(ctx context.Context, s *Repository, password string, maxKeys int,
 
 		debug.Log("successfully opened key %v", id.String())
 		k = key
-		cancel()
 		return nil
 	})
 
-	if err == context.Canceled {
-		err = nil
-	}
-
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if k == nil {
-		return nil, ErrNoKeyFound
+		return nil, nil, ErrNoKeyFound
 	}
 
-	return k, nil
+	return k, ids, nil
 }
 
 // LoadKey loads a key from the backend.
@@ -206,16 +243,27 @@ func AddKey(ctx context.Context, s *Repository, password, username, hostname str
 		debug.Log("calibrated KDF parameters are %v", p)
 	}
 
-	// fill meta data about key
+	newkey := newKeyMetadata(username, hostname)
+
+	if template == nil {
+		// generate new random master keys
+		template = crypto.NewRandomKey()
+	}
+
+	err := saveKey(ctx, s, newkey, password, *Params, template)
+	if err != nil {
+		return nil, err
+	}
+	return newkey, nil
+}
+
+// newKeyMetadata returns a key for the user and host, which default to the
+// current ones.
+func newKeyMetadata(username, hostname string) *Key {
 	newkey := &Key{
 		Created:  time.Now(),
 		Username: username,
 		Hostname: hostname,
-
-		KDF: "scrypt",
-		N:   Params.N,
-		R:   Params.R,
-		P:   Params.P,
 	}
 
 	if newkey.Hostname == "" {
@@ -228,6 +276,57 @@ func AddKey(ctx context.Context, s *Repository, password, username, hostname str
 			newkey.Username = usr.Username
 		}
 	}
+	return newkey
+}
+
+// RewriteKey stores the master keys of k in a new key file, using the KDF
+// parameters params and a new salt. k must have been opened with password.
+// The new key file is verified before the key file of k is removed, other
+// key files are not modified.
+func RewriteKey(ctx context.Context, s *Repository, k *Key, password string, params crypto.Params) (*Key, error) {
+	if k.master == nil {
+		return nil, errors.New("key is not opened")
+	}
+
+	newkey := &Key{
+		Created:  k.Created,
+		Username: k.Username,
+		Hostname: k.Hostname,
+	}
+	err := saveKey(ctx, s, newkey, password, params, k.master)
+	if err != nil {
+		return nil, err
+	}
+
+	// a broken key file could render the repository inaccessible
+	check, err := OpenKey(ctx, s, newkey.ID(), password)
+	if err == nil && !sameMasterKey(check.master, k.master) {
+		err = errors.New("master keys do not match")
+	}
+	if err != nil {
+		_ = s.be.Remove(ctx, backend.Handle{Type: restic.KeyFile, Name: newkey.ID().String()})
+		return nil, errors.Wrap(err, "verifying new key failed")
+	}
+
+	oldID := k.ID()
+	err = s.be.Remove(ctx, backend.Handle{Type: restic.KeyFile, Name: oldID.String()})
+	if err != nil {
+		return newkey, errors.Wrapf(err, "removing old key %v failed", oldID.Str())
+	}
+	return newkey, nil
+}
+
+func sameMasterKey(a, b *crypto.Key) bool {
+	return a.EncryptionKey == b.EncryptionKey && a.MACKey.K == b.MACKey.K && a.MACKey.R == b.MACKey.R
+}
+
+// saveKey encrypts the master keys with a key derived from password and
+// stores newkey in the repository.
+func saveKey(ctx context.Context, s *Repository, newkey *Key, password string, params crypto.Params, master *crypto.Key) error {
+	newkey.KDF = "scrypt"
+	newkey.N = params.N
+	newkey.R = params.R
+	newkey.P = params.P
 
 	// generate random salt
 	var err error
@@ -237,23 +336,16 @@ func AddKey(ctx context.Context, s *Repository, password, username, hostname str
 	}
 
 	// call KDF to derive user key
-	newkey.user, err = crypto.KDF(*Params, newkey.Salt, password)
+	newkey.user, err = crypto.KDF(params, newkey.Salt, password)
 	if err != nil {
-		return nil, err
-	}
-
-	if template == nil {
-		// generate new random master keys
-		newkey.master = crypto.NewRandomKey()
-	} else {
-		// copy master keys from old key
-		newkey.master = template
+		return err
 	}
+	newkey.master = master
 
 	// encrypt master keys (as json) with user key
 	buf, err := json.Marshal(newkey.master)
 	if err != nil {
-		return nil, errors.Wrap(err, "Marshal")
+		return errors.Wrap(err, "Marshal")
 	}
 
 	nonce := crypto.NewRandomNonce()
@@ -262,10 +354,15 @@ func AddKey(ctx context.Context, s *Repository, password, username, hostname str
 	ciphertext = newkey.user.Seal(ciphertext, nonce, buf, nil)
 	newkey.Data = ciphertext
 
+	return storeKey(ctx, s, newkey)
+}
+
+// storeKey saves newkey as a key file in the repository and sets its ID.
+func storeKey(ctx context.Context, s *Repository, newkey *Key) error {
 	// dump as json
-	buf, err = json.Marshal(newkey)
+	buf, err := json.Marshal(newkey)
 	if err != nil {
-		return nil, errors.Wrap(err, "Marshal")
+		return errors.Wrap(err, "Marshal")
 	}
 
 	id := restic.Hash(buf)
@@ -277,12 +374,16 @@ func AddKey(ctx context.Context, s *Repository, password, username, hostname str
 
 	err = s.be.Save(ctx, h, backend.NewByteReader(buf, s.be.Hasher()))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	newkey.id = id
+	return nil
+}
 
-	return newkey, nil
+// KDFParams returns the parameters of the KDF used for the key.
+func (k *Key) KDFParams() crypto.Params {
+	return crypto.Params{N: k.N, R: k.R, P: k.P}
 }
 
 func (k *Key) String() string {
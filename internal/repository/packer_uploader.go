@@ -2,9 +2,12 @@ package repository
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/restic/restic/internal/restic"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 // SavePacker implements saving a pack in the repository.
@@ -15,18 +18,91 @@ type SavePacker interface {
 type uploadTask struct {
 	packer *Packer
 	tpe    restic.BlobType
+	size   int64
 }
 
 type packerUploader struct {
 	uploadQueue chan uploadTask
+	stats       *uploadStats
+
+	// inFlight limits the size of the queued and running uploads, it is nil
+	// if only the number of uploads is limited
+	inFlight    *semaphore.Weighted
+	maxInFlight int64
+}
+
+// UploadStats describes the pack uploads since the repository was opened.
+type UploadStats struct {
+	Uploads uint
+	// Parallelism is the average number of concurrent uploads while at least
+	// one upload was running.
+	Parallelism float64
+	// Waited is the time spent waiting for a free upload slot.
+	Waited time.Duration
+}
+
+type uploadStats struct {
+	m       sync.Mutex
+	uploads uint
+	waited  time.Duration
+
+	active     uint
+	lastChange time.Time
+	// busy is the time at least one upload was active, area is the sum of the
+	// durations of all uploads
+	busy, area time.Duration
+}
+
+// update accounts the time since the last change to the running uploads.
+func (s *uploadStats) update(delta int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	if s.active > 0 {
+		d := now.Sub(s.lastChange)
+		s.busy += d
+		s.area += d * time.Duration(s.active)
+	}
+	s.lastChange = now
+	if delta > 0 {
+		s.active++
+	} else {
+		s.active--
+		s.uploads++
+	}
 }
 
-func newPackerUploader(ctx context.Context, wg *errgroup.Group, repo SavePacker, connections uint) *packerUploader {
+func (s *uploadStats) addWaited(d time.Duration) {
+	s.m.Lock()
+	s.waited += d
+	s.m.Unlock()
+}
+
+func (s *uploadStats) get() UploadStats {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	stats := UploadStats{Uploads: s.uploads, Waited: s.waited}
+	if s.busy > 0 {
+		stats.Parallelism = float64(s.area) / float64(s.busy)
+	}
+	return stats
+}
+
+// newPackerUploader starts uploads workers. If maxInFlight is not zero, it
+// limits the size of the packs which are queued or uploaded concurrently.
+func newPackerUploader(ctx context.Context, wg *errgroup.Group, repo SavePacker, uploads uint, maxInFlight uint64, stats *uploadStats) *packerUploader {
 	pu := &packerUploader{
 		uploadQueue: make(chan uploadTask),
+		stats:       stats,
+	}
+	if maxInFlight > 0 {
+		pu.maxInFlight = int64(maxInFlight)
+		pu.inFlight = semaphore.NewWeighted(pu.maxInFlight)
 	}
 
-	for i := 0; i < int(connections); i++ {
+	for i := 0; i < int(uploads); i++ {
 		wg.Go(func() error {
 			for {
 				select {
@@ -34,7 +110,12 @@ func newPackerUploader(ctx context.Context, wg *errgroup.Group, repo SavePacker,
 					if !ok {
 						return nil
 					}
+					pu.stats.update(1)
 					err := repo.savePacker(ctx, t.tpe, t.packer)
+					pu.stats.update(-1)
+					if pu.inFlight != nil {
+						pu.inFlight.Release(t.size)
+					}
 					if err != nil {
 						return err
 					}
@@ -49,10 +130,30 @@ func newPackerUploader(ctx context.Context, wg *errgroup.Group, repo SavePacker,
 }
 
 func (pu *packerUploader) QueuePacker(ctx context.Context, t restic.BlobType, p *Packer) (err error) {
+	start := time.Now()
+	defer func() {
+		pu.stats.addWaited(time.Since(start))
+	}()
+
+	task := uploadTask{tpe: t, packer: p}
+	if pu.inFlight != nil {
+		// a pack larger than the limit is uploaded on its own
+		task.size = int64(p.Size())
+		if task.size > pu.maxInFlight {
+			task.size = pu.maxInFlight
+		}
+		if err := pu.inFlight.Acquire(ctx, task.size); err != nil {
+			return err
+		}
+	}
+
 	select {
 	case <-ctx.Done():
+		if pu.inFlight != nil {
+			pu.inFlight.Release(task.size)
+		}
 		return ctx.Err()
-	case pu.uploadQueue <- uploadTask{tpe: t, packer: p}:
+	case pu.uploadQueue <- task:
 	}
 
 	return nil
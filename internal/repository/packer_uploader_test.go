@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/crypto"
+	"github.com/restic/restic/internal/pack"
+	"github.com/restic/restic/internal/restic"
+	"github.com/restic/restic/internal/test"
+	"golang.org/x/sync/errgroup"
+)
+
+// blockingSaver blocks all uploads until release is closed.
+type blockingSaver struct {
+	started chan struct{}
+	release chan struct{}
+
+	m         sync.Mutex
+	active    int
+	maxActive int
+}
+
+func newBlockingSaver() *blockingSaver {
+	return &blockingSaver{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *blockingSaver) savePacker(_ context.Context, _ restic.BlobType, _ *Packer) error {
+	s.m.Lock()
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.m.Unlock()
+
+	s.started <- struct{}{}
+	<-s.release
+
+	s.m.Lock()
+	s.active--
+	s.m.Unlock()
+	return nil
+}
+
+func testPacker(t *testing.T, size int) *Packer {
+	p := pack.NewPacker(crypto.NewRandomKey(), io.Discard)
+	_, err := p.Add(restic.DataBlob, restic.NewRandomID(), make([]byte, size), 0)
+	test.OK(t, err)
+	return &Packer{Packer: p}
+}
+
+func TestPackerUploaderConcurrency(t *testing.T) {
+	saver := newBlockingSaver()
+	var stats uploadStats
+	var wg errgroup.Group
+	pu := newPackerUploader(context.TODO(), &wg, saver, 3, 0, &stats)
+
+	for i := 0; i < 3; i++ {
+		test.OK(t, pu.QueuePacker(context.TODO(), restic.DataBlob, testPacker(t, 100)))
+		<-saver.started
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(saver.release)
+	for i := 0; i < 3; i++ {
+		test.OK(t, pu.QueuePacker(context.TODO(), restic.DataBlob, testPacker(t, 100)))
+	}
+	pu.TriggerShutdown()
+	test.OK(t, wg.Wait())
+
+	test.Equals(t, 3, saver.maxActive)
+	s := stats.get()
+	test.Equals(t, uint(6), s.Uploads)
+	test.Assert(t, s.Parallelism > 1 && s.Parallelism <= 3, "unexpected parallelism %v", s.Parallelism)
+}
+
+func TestPackerUploaderMemoryLimit(t *testing.T) {
+	saver := newBlockingSaver()
+	var stats uploadStats
+	var wg errgroup.Group
+	packs := []*Packer{testPacker(t, 1000), testPacker(t, 1000), testPacker(t, 1000)}
+	pu := newPackerUploader(context.TODO(), &wg, saver, 4, uint64(2*packs[0].Size()), &stats)
+
+	for _, p := range packs[:2] {
+		test.OK(t, pu.QueuePacker(context.TODO(), restic.DataBlob, p))
+		<-saver.started
+	}
+
+	// the third pack exceeds the memory limit although uploads are available
+	queued := make(chan error)
+	go func() {
+		queued <- pu.QueuePacker(context.TODO(), restic.DataBlob, packs[2])
+	}()
+	select {
+	case <-queued:
+		t.Fatal("pack was queued despite the memory limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(saver.release)
+	test.OK(t, <-queued)
+	pu.TriggerShutdown()
+	test.OK(t, wg.Wait())
+
+	test.Equals(t, 2, saver.maxActive)
+	s := stats.get()
+	test.Equals(t, uint(3), s.Uploads)
+	test.Assert(t, s.Waited >= 50*time.Millisecond, "waiting time %v was not recorded", s.Waited)
+}
@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/pack"
+	"github.com/restic/restic/internal/restic"
+)
+
+// minQuotaSlack is the lower bound for how far a backup may exceed the size
+// limit of the repository in order to finish writing its metadata.
+const minQuotaSlack = 64 * 1024 * 1024
+
+// QuotaStatus describes the size of a repository relative to its size limit.
+type QuotaStatus struct {
+	// Limit is the size limit from the config, zero if there is none.
+	Limit uint64
+	// Slack is how far the limit may be exceeded by tree blobs and pack
+	// files which are still being written.
+	Slack uint64
+	// Size is the size of all pack files according to the index.
+	Size uint64
+}
+
+// Exceeded returns true if the repository has reached its size limit.
+func (s QuotaStatus) Exceeded() bool {
+	return s.Limit > 0 && s.Size >= s.Limit
+}
+
+// QuotaSlack returns the slack allowed for the size limit: two percent of the
+// limit, but at least 64 MiB.
+func QuotaSlack(limit uint64) uint64 {
+	slack := limit / 50
+	if slack < minQuotaSlack {
+		slack = minQuotaSlack
+	}
+	return slack
+}
+
+// QuotaStatus returns the size of the repository and its size limit. The
+// size is computed from the index, which must already be loaded.
+func (r *Repository) QuotaStatus(ctx context.Context) QuotaStatus {
+	var size uint64
+	for _, s := range pack.Size(ctx, r.idx, false) {
+		size += uint64(s)
+	}
+	return QuotaStatus{
+		Limit: r.cfg.MaxRepoSize,
+		Slack: QuotaSlack(r.cfg.MaxRepoSize),
+		Size:  size,
+	}
+}
+
+// EnforceQuota limits the blobs saved to the repository, starting at the size
+// from status. New data blobs are refused once they would exceed the limit,
+// tree blobs are refused once they would exceed the limit plus the slack.
+// The limit is only advisory, as data written concurrently by other clients
+// is not accounted for. EnforceQuota does nothing without a size limit.
+func (r *Repository) EnforceQuota(status QuotaStatus) {
+	if status.Limit == 0 {
+		return
+	}
+	r.quota = &quota{QuotaStatus: status}
+}
+
+// SetMaxRepoSize stores a new size limit in the config of the repository,
+// zero removes the limit.
+func (r *Repository) SetMaxRepoSize(ctx context.Context, limit uint64) error {
+	cfg := r.cfg
+	cfg.MaxRepoSize = limit
+
+	atomic := r.be.HasAtomicReplace()
+	if !atomic {
+		// remove the original file for backends which do not support atomic overwriting
+		err := r.be.Remove(ctx, backend.Handle{Type: restic.ConfigFile})
+		if err != nil {
+			return fmt.Errorf("remove config failed: %w", err)
+		}
+	}
+
+	err := restic.SaveConfig(ctx, r, cfg)
+	if err != nil {
+		if !atomic {
+			if rerr := restic.SaveConfig(ctx, r, r.cfg); rerr != nil {
+				return fmt.Errorf("save new config file failed: %w, restoring the old config failed: %v", err, rerr)
+			}
+		}
+		return fmt.Errorf("save new config file failed: %w", err)
+	}
+
+	r.setConfig(cfg)
+	return nil
+}
+
+// quota tracks the size of the repository while saving blobs.
+type quota struct {
+	m sync.Mutex
+	QuotaStatus
+	exceeded bool
+}
+
+// reserve checks whether a new blob of the given plaintext size may be saved.
+func (q *quota) reserve(t restic.BlobType, size int) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	limit := q.Limit
+	if t == restic.TreeBlob {
+		limit += q.Slack
+	}
+	if !q.exceeded && t == restic.DataBlob && q.Size+uint64(size) > limit {
+		debug.Log("size limit %d exceeded at %d bytes", q.Limit, q.Size)
+		q.exceeded = true
+	}
+	if (q.exceeded && t == restic.DataBlob) || q.Size+uint64(size) > limit {
+		return fmt.Errorf("saving %v blob: %w", t, restic.ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// add accounts for a blob which was saved using size bytes.
+func (q *quota) add(size int) {
+	q.m.Lock()
+	q.Size += uint64(size)
+	q.m.Unlock()
+}
@@ -31,6 +31,10 @@ func Repack(ctx context.Context, repo restic.Repository, dstRepo restic.Reposito
 	if repo == dstRepo && dstRepo.Connections() < 2 {
 		return nil, errors.New("repack step requires a backend connection limit of at least two")
 	}
+	// the blobs are saved using their existing IDs
+	if repo.Config().BlobHasher() != dstRepo.Config().BlobHasher() {
+		return nil, errors.New("repack step requires repositories with the same blob hash algorithm")
+	}
 
 	wg, wgCtx := errgroup.WithContext(ctx)
 
@@ -77,7 +81,7 @@ func repack(ctx context.Context, repo restic.Repository, dstRepo restic.Reposito
 
 	worker := func() error {
 		for t := range downloadQueue {
-			err := StreamPack(wgCtx, repo.Backend().Load, repo.Key(), t.PackID, t.Blobs, func(blob restic.BlobHandle, buf []byte, err error) error {
+			err := StreamPack(wgCtx, repo.Backend().Load, repo.Key(), repo.Config().BlobHasher(), t.PackID, t.Blobs, func(blob restic.BlobHandle, buf []byte, err error) error {
 				if err != nil {
 					var ierr error
 					// check whether we can get a valid copy somewhere else
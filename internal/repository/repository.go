@@ -16,6 +16,7 @@ import (
 	"github.com/restic/chunker"
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/backend/dryrun"
+	"github.com/restic/restic/internal/backend/prefetch"
 	"github.com/restic/restic/internal/cache"
 	"github.com/restic/restic/internal/crypto"
 	"github.com/restic/restic/internal/debug"
@@ -32,7 +33,7 @@ const MaxStreamBufferSize = 4 * 1024 * 1024
 
 const MinPackSize = 4 * 1024 * 1024
 const DefaultPackSize = 16 * 1024 * 1024
-const MaxPackSize = 128 * 1024 * 1024
+const MaxPackSize = 512 * 1024 * 1024
 
 // Repository is used to access a repository in a backend.
 type Repository struct {
@@ -43,26 +44,63 @@ type Repository struct {
 	idx   *index.MasterIndex
 	Cache *cache.Cache
 
+	PackCache *cache.PackCache
+
+	// zeroChunk is the ID of an all-zero chunk with the minimum chunk size
+	zeroChunk restic.ID
+
 	opts Options
 
 	noAutoIndexUpdate bool
+	writeOnly         bool
+	skippedIndexes    restic.IDs
+	// keyFiles contains the IDs of the key files listed by SearchKey, it is
+	// nil if the key files were not listed
+	keyFiles restic.IDs
+
+	// quota is nil unless the size limit is enforced
+	quota *quota
 
 	packerWg *errgroup.Group
 	uploader *packerUploader
 	treePM   *packerManager
 	dataPM   *packerManager
 
-	allocEnc sync.Once
+	uploadStats uploadStats
+
+	encMutex sync.Mutex
+	enc      map[zstd.EncoderLevel]*zstd.Encoder
 	allocDec sync.Once
-	enc      *zstd.Encoder
 	dec      *zstd.Decoder
 }
 
 type Options struct {
 	Compression CompressionMode
-	PackSize    uint
+	// DataCompressionLevel is the zstd level used for data blobs, zero selects
+	// the level of the compression mode.
+	DataCompressionLevel int
+	// MinCompressionSavings is the percentage by which compression must shrink
+	// a data blob, otherwise the blob is stored uncompressed. Zero always
+	// stores the compressed blob.
+	MinCompressionSavings uint
+	PackSize              uint
+
+	// UploadConcurrency is the number of pack files which are uploaded
+	// concurrently, zero uses the number of backend connections.
+	UploadConcurrency uint
+	// UploadMemory limits the size of the pack files which are queued or
+	// uploaded concurrently, zero only limits their number.
+	UploadMemory uint64
+
+	// DamagedIndex is called for each index file which cannot be loaded. If
+	// it is set, such index files are skipped, otherwise loading the index
+	// fails.
+	DamagedIndex func(id restic.ID, err error)
 }
 
+// MaxCompressionLevel is the highest zstd level accepted for data blobs.
+const MaxCompressionLevel = 22
+
 // CompressionMode configures if data should be compressed.
 type CompressionMode uint
 
@@ -113,6 +151,15 @@ func New(be backend.Backend, opts Options) (*Repository, error) {
 	if opts.Compression == CompressionInvalid {
 		return nil, errors.New("invalid compression mode")
 	}
+	if opts.DataCompressionLevel < 0 || opts.DataCompressionLevel > MaxCompressionLevel {
+		return nil, fmt.Errorf("invalid compression level %d, must be between 1 and %d", opts.DataCompressionLevel, MaxCompressionLevel)
+	}
+	if opts.Compression == CompressionOff && (opts.DataCompressionLevel != 0 || opts.MinCompressionSavings != 0) {
+		return nil, errors.New("disabled compression cannot be combined with a compression level or minimum savings")
+	}
+	if opts.MinCompressionSavings >= 100 {
+		return nil, fmt.Errorf("minimum compression savings of %d%% must be less than 100%%", opts.MinCompressionSavings)
+	}
 
 	if opts.PackSize == 0 {
 		opts.PackSize = DefaultPackSize
@@ -127,6 +174,9 @@ func New(be backend.Backend, opts Options) (*Repository, error) {
 		be:   be,
 		opts: opts,
 		idx:  index.NewMasterIndex(),
+		enc:  make(map[zstd.EncoderLevel]*zstd.Encoder),
+
+		zeroChunk: ZeroChunk(),
 	}
 
 	return repo, nil
@@ -144,6 +194,7 @@ func (r *Repository) setConfig(cfg restic.Config) {
 	if r.cfg.Version >= 2 {
 		r.idx.MarkCompressed()
 	}
+	r.zeroChunk = ZeroChunkFor(cfg)
 }
 
 // Config returns the repository configuration.
@@ -166,6 +217,17 @@ func (r *Repository) UseCache(c *cache.Cache) {
 	r.be = c.Wrap(r.be)
 }
 
+// UsePackCache replaces the backend with the wrapped pack cache. It must be
+// called before UseCache.
+func (r *Repository) UsePackCache(c *cache.PackCache) {
+	if c == nil {
+		return
+	}
+	debug.Log("using pack cache")
+	r.PackCache = c
+	r.be = c.Wrap(r.be)
+}
+
 // SetDryRun sets the repo backend into dry-run mode.
 func (r *Repository) SetDryRun() {
 	r.be = dryrun.New(r.be)
@@ -324,7 +386,7 @@ func (r *Repository) LoadBlob(ctx context.Context, t restic.BlobType, id restic.
 		}
 
 		// check hash
-		if !restic.Hash(plaintext).Equal(id) {
+		if !r.cfg.BlobHasher().Hash(plaintext).Equal(id) {
 			lastError = errors.Errorf("blob %v returned invalid hash", id)
 			continue
 		}
@@ -350,31 +412,62 @@ func (r *Repository) LookupBlobSize(id restic.ID, tpe restic.BlobType) (uint, bo
 	return r.idx.LookupSize(restic.BlobHandle{ID: id, Type: tpe})
 }
 
-func (r *Repository) getZstdEncoder() *zstd.Encoder {
-	r.allocEnc.Do(func() {
-		level := zstd.SpeedDefault
-		if r.opts.Compression == CompressionMax {
-			level = zstd.SpeedBestCompression
-		}
+// compressionLevel returns the level used for the compression mode, which
+// applies to everything except blobs.
+func (r *Repository) compressionLevel() zstd.EncoderLevel {
+	if r.opts.Compression == CompressionMax {
+		return zstd.SpeedBestCompression
+	}
+	return zstd.SpeedDefault
+}
 
-		opts := []zstd.EOption{
-			// Set the compression level configured.
-			zstd.WithEncoderLevel(level),
-			// Disable CRC, we have enough checks in place, makes the
-			// compressed data four bytes shorter.
-			zstd.WithEncoderCRC(false),
-			// Set a window of 512kbyte, so we have good lookbehind for usual
-			// blob sizes.
-			zstd.WithWindowSize(512 * 1024),
-		}
+// blobCompressionLevel returns the level used for blobs of type t. Tree blobs
+// compress very well and are small compared to the data, thus they always use
+// the best compression.
+func (r *Repository) blobCompressionLevel(t restic.BlobType) zstd.EncoderLevel {
+	if t == restic.TreeBlob {
+		return zstd.SpeedBestCompression
+	}
+	if r.opts.DataCompressionLevel != 0 {
+		return zstd.EncoderLevelFromZstd(r.opts.DataCompressionLevel)
+	}
+	return r.compressionLevel()
+}
 
-		enc, err := zstd.NewWriter(nil, opts...)
-		if err != nil {
-			panic(err)
-		}
-		r.enc = enc
-	})
-	return r.enc
+func (r *Repository) getZstdEncoder(level zstd.EncoderLevel) *zstd.Encoder {
+	r.encMutex.Lock()
+	defer r.encMutex.Unlock()
+
+	if enc, ok := r.enc[level]; ok {
+		return enc
+	}
+
+	opts := []zstd.EOption{
+		// Set the compression level configured.
+		zstd.WithEncoderLevel(level),
+		// Disable CRC, we have enough checks in place, makes the
+		// compressed data four bytes shorter.
+		zstd.WithEncoderCRC(false),
+		// Set a window of 512kbyte, so we have good lookbehind for usual
+		// blob sizes.
+		zstd.WithWindowSize(512 * 1024),
+	}
+
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		panic(err)
+	}
+	r.enc[level] = enc
+	return enc
+}
+
+// compressionSaves returns true if compressing a data blob of length raw to
+// length compressed saves at least the configured minimum.
+func (r *Repository) compressionSaves(raw, compressed int) bool {
+	if r.opts.MinCompressionSavings == 0 {
+		return true
+	}
+	return uint64(compressed)*100 <= uint64(raw)*uint64(100-r.opts.MinCompressionSavings)
 }
 
 func (r *Repository) getZstdDecoder() *zstd.Decoder {
@@ -408,14 +501,17 @@ func (r *Repository) saveAndEncrypt(ctx context.Context, t restic.BlobType, data
 
 		// we have a repo v2, so compression is available. if the user opts to
 		// not compress, we won't compress any data, but everything else is
-		// compressed.
+		// compressed. Data blobs which barely shrink are stored as is.
 		if r.opts.Compression != CompressionOff || t != restic.DataBlob {
-			uncompressedLength = len(data)
-			data = r.getZstdEncoder().EncodeAll(data, nil)
+			compressed := r.getZstdEncoder(r.blobCompressionLevel(t)).EncodeAll(data, nil)
+			if t != restic.DataBlob || r.compressionSaves(len(data), len(compressed)) {
+				uncompressedLength = len(data)
+				data = compressed
+			}
 		}
 	}
 
-	nonce := crypto.NewRandomNonce()
+	nonce := r.key.NewNonce()
 
 	ciphertext := make([]byte, 0, crypto.CiphertextLength(len(data)))
 	ciphertext = append(ciphertext, nonce...)
@@ -446,7 +542,7 @@ func (r *Repository) compressUnpacked(p []byte) ([]byte, error) {
 
 	// version byte
 	out := []byte{2}
-	out = r.getZstdEncoder().EncodeAll(p, out)
+	out = r.getZstdEncoder(r.compressionLevel()).EncodeAll(p, out)
 	return out, nil
 }
 
@@ -484,7 +580,7 @@ func (r *Repository) SaveUnpacked(ctx context.Context, t restic.FileType, p []by
 
 	ciphertext := crypto.NewBlobBuffer(len(p))
 	ciphertext = ciphertext[:0]
-	nonce := crypto.NewRandomNonce()
+	nonce := r.key.NewNonce()
 	ciphertext = append(ciphertext, nonce...)
 
 	ciphertext = r.key.Seal(ciphertext, nonce, p, nil)
@@ -526,7 +622,11 @@ func (r *Repository) StartPackUploader(ctx context.Context, wg *errgroup.Group)
 
 	innerWg, ctx := errgroup.WithContext(ctx)
 	r.packerWg = innerWg
-	r.uploader = newPackerUploader(ctx, innerWg, r, r.be.Connections())
+	uploads := r.opts.UploadConcurrency
+	if uploads == 0 {
+		uploads = r.be.Connections()
+	}
+	r.uploader = newPackerUploader(ctx, innerWg, r, uploads, r.opts.UploadMemory, &r.uploadStats)
 	r.treePM = newPackerManager(r.key, restic.TreeBlob, r.PackSize(), r.uploader.QueuePacker)
 	r.dataPM = newPackerManager(r.key, restic.DataBlob, r.PackSize(), r.uploader.QueuePacker)
 
@@ -569,6 +669,11 @@ func (r *Repository) Connections() uint {
 	return r.be.Connections()
 }
 
+// UploadStats returns statistics about the pack files uploaded so far.
+func (r *Repository) UploadStats() UploadStats {
+	return r.uploadStats.get()
+}
+
 // Index returns the currently used MasterIndex.
 func (r *Repository) Index() restic.MasterIndex {
 	return r.idx
@@ -602,9 +707,18 @@ func (r *Repository) LoadIndex(ctx context.Context, p *progress.Counter) error {
 		defer p.Done()
 	}
 
+	r.skippedIndexes = nil
 	err = index.ForAllIndexes(ctx, indexList, r, func(id restic.ID, idx *index.Index, oldFormat bool, err error) error {
 		if err != nil {
-			return err
+			if r.opts.DamagedIndex == nil || ctx.Err() != nil {
+				return errors.Wrapf(err, "index %v", id.Str())
+			}
+			r.opts.DamagedIndex(id, err)
+			r.skippedIndexes = append(r.skippedIndexes, id)
+			if p != nil {
+				p.Add(1)
+			}
+			return nil
 		}
 		r.idx.Insert(idx)
 		if p != nil {
@@ -645,6 +759,54 @@ func (r *Repository) LoadIndex(ctx context.Context, p *progress.Counter) error {
 	return r.prepareCache()
 }
 
+// SkippedIndexes returns the index files which were skipped by LoadIndex or
+// LoadIndexLazy as they are damaged, see Options.DamagedIndex. Packs which are
+// only listed in these index files are missing from the index.
+func (r *Repository) SkippedIndexes() restic.IDs {
+	return r.skippedIndexes
+}
+
+// LoadIndexLazy prepares the index such that index files are only loaded once
+// they probably contain a requested blob, see index.LazyIndex. This requires
+// the local cache. Iterating over the index afterwards only returns the blobs
+// which were saved by this repository instance.
+func (r *Repository) LoadIndexLazy(ctx context.Context, p *progress.Counter) error {
+	if r.Cache == nil {
+		return errors.New("the lazy index requires the local cache")
+	}
+	debug.Log("Loading lazy index")
+
+	indexList, err := restic.MemorizeList(ctx, r, restic.IndexFile)
+	if err != nil {
+		return err
+	}
+
+	r.skippedIndexes = nil
+	opts := index.LazyIndexOptions{
+		Filename: r.Cache.LazyIndexFile(),
+		RepoID:   r.cfg.ID,
+	}
+	if r.opts.DamagedIndex != nil {
+		opts.DamagedIndex = func(id restic.ID, err error) {
+			r.opts.DamagedIndex(id, err)
+			r.skippedIndexes = append(r.skippedIndexes, id)
+		}
+	}
+	lazy, err := index.OpenLazyIndex(ctx, indexList, r, opts, p)
+	if err != nil {
+		return err
+	}
+	r.idx.SetLazyIndex(lazy)
+
+	// remove index files from the cache which have been removed in the repo,
+	// the cached packs cannot be checked without loading the index
+	err = r.Cache.Clear(restic.IndexFile, r.idx.IDs())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error clearing index files in cache: %v\n", err)
+	}
+	return nil
+}
+
 // CreateIndexFromPacks creates a new index by reading all given pack files (with sizes).
 // The index is added to the MasterIndex but not marked as finalized.
 // Returned is the list of pack files which could not be read.
@@ -738,7 +900,7 @@ func (r *Repository) prepareCache() error {
 // SearchKey finds a key with the supplied password, afterwards the config is
 // read and parsed. It tries at most maxKeys key files in the repo.
 func (r *Repository) SearchKey(ctx context.Context, password string, maxKeys int, keyHint string) error {
-	key, err := SearchKey(ctx, r, password, maxKeys, keyHint)
+	key, ids, err := searchKey(ctx, r, password, maxKeys, keyHint)
 	if err != nil {
 		return err
 	}
@@ -753,12 +915,14 @@ func (r *Repository) SearchKey(ctx context.Context, password string, maxKeys int
 	}
 
 	r.setConfig(cfg)
-	return nil
+	r.keyFiles = ids
+	return r.loadSessionKeys(ctx, ids)
 }
 
 // Init creates a new master key with the supplied password, initializes and
-// saves the repository config.
-func (r *Repository) Init(ctx context.Context, version uint, password string, chunkerPolynomial *chunker.Pol) error {
+// saves the repository config. Zero chunk sizes select the defaults of the
+// chunker, the zero hasher selects SHA-256 for the blob IDs.
+func (r *Repository) Init(ctx context.Context, version uint, password string, chunkerPolynomial *chunker.Pol, chunkerSizes restic.ChunkerSizes, hasher restic.BlobHasher) error {
 	if version > restic.MaxRepoVersion {
 		return fmt.Errorf("repository version %v too high", version)
 	}
@@ -782,6 +946,16 @@ func (r *Repository) Init(ctx context.Context, version uint, password string, ch
 	if chunkerPolynomial != nil {
 		cfg.ChunkerPolynomial = *chunkerPolynomial
 	}
+	cfg.ChunkerSizes = chunkerSizes
+	if err := cfg.ValidateChunkerSizes(); err != nil {
+		return err
+	}
+	if hasher != (restic.BlobHasher{}) {
+		cfg.BlobHash = hasher.String()
+	}
+	if err := cfg.ValidateBlobHash(); err != nil {
+		return err
+	}
 
 	return r.init(ctx, password, cfg)
 }
@@ -855,21 +1029,32 @@ func (r *Repository) SaveBlob(ctx context.Context, t restic.BlobType, buf []byte
 		// Special case the hash calculation for all zero chunks. This is especially
 		// useful for sparse files containing large all zero regions. For these we can
 		// process chunks as fast as we can read the from disk.
-		if len(buf) == chunker.MinSize && restic.ZeroPrefixLen(buf) == chunker.MinSize {
-			newID = ZeroChunk()
+		if minSize := int(r.cfg.Min()); len(buf) == minSize && restic.ZeroPrefixLen(buf) == minSize {
+			newID = r.zeroChunk
 		} else {
-			newID = restic.Hash(buf)
+			newID = r.cfg.BlobHasher().Hash(buf)
 		}
 	} else {
 		newID = id
 	}
 
+	// check the size limit before the blob becomes pending, a refused blob
+	// must not be considered as known afterwards
+	if r.quota != nil && (storeDuplicate || !r.idx.Has(restic.BlobHandle{ID: newID, Type: t})) {
+		if err := r.quota.reserve(t, len(buf)); err != nil {
+			return newID, false, 0, err
+		}
+	}
+
 	// first try to add to pending blobs; if not successful, this blob is already known
 	known = !r.idx.AddPending(restic.BlobHandle{ID: newID, Type: t})
 
 	// only save when needed or explicitly told
 	if !known || storeDuplicate {
 		size, err = r.saveAndEncrypt(ctx, t, buf, newID)
+		if err == nil && r.quota != nil {
+			r.quota.add(size)
+		}
 	}
 
 	return newID, known, size, err
@@ -881,41 +1066,72 @@ type BackendLoadFn func(ctx context.Context, h backend.Handle, length int, offse
 const maxUnusedRange = 4 * 1024 * 1024
 
 // StreamPack loads the listed blobs from the specified pack file. The plaintext blob is passed to
-// the handleBlobFn callback or an error if decryption failed or the blob hash does not match.
-// handleBlobFn is never called multiple times for the same blob. If the callback returns an error,
-// then StreamPack will abort and not retry it.
-func StreamPack(ctx context.Context, beLoad BackendLoadFn, key *crypto.Key, packID restic.ID, blobs []restic.Blob, handleBlobFn func(blob restic.BlobHandle, buf []byte, err error) error) error {
+// the handleBlobFn callback or an error if decryption failed or the blob hash computed using hasher
+// does not match. handleBlobFn is never called multiple times for the same blob. If the callback
+// returns an error, then StreamPack will abort and not retry it.
+func StreamPack(ctx context.Context, beLoad BackendLoadFn, key *crypto.Key, hasher restic.BlobHasher, packID restic.ID, blobs []restic.Blob, handleBlobFn func(blob restic.BlobHandle, buf []byte, err error) error) error {
+	parts, err := splitPack(packID, blobs)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		err := streamPackPart(ctx, beLoad, key, hasher, packID, part, handleBlobFn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamPackRequests returns the ranges of the pack file which StreamPack
+// loads for blobs, in the same order.
+func StreamPackRequests(packID restic.ID, blobs []restic.Blob) ([]prefetch.Request, error) {
+	parts, err := splitPack(packID, blobs)
+	if err != nil {
+		return nil, err
+	}
+	h := backend.Handle{Type: restic.PackFile, Name: packID.String(), IsMetadata: false}
+	reqs := make([]prefetch.Request, 0, len(parts))
+	for _, part := range parts {
+		dataStart := part[0].Offset
+		dataEnd := part[len(part)-1].Offset + part[len(part)-1].Length
+		reqs = append(reqs, prefetch.Request{Handle: h, Length: int(dataEnd - dataStart), Offset: int64(dataStart)})
+	}
+	return reqs, nil
+}
+
+// splitPack sorts blobs by offset and splits them into parts which are
+// loaded at once.
+func splitPack(packID restic.ID, blobs []restic.Blob) ([][]restic.Blob, error) {
 	if len(blobs) == 0 {
 		// nothing to do
-		return nil
+		return nil, nil
 	}
 
 	sort.Slice(blobs, func(i, j int) bool {
 		return blobs[i].Offset < blobs[j].Offset
 	})
 
+	var parts [][]restic.Blob
 	lowerIdx := 0
 	lastPos := blobs[0].Offset
 	for i := 0; i < len(blobs); i++ {
 		if blobs[i].Offset < lastPos {
 			// don't wait for streamPackPart to fail
-			return errors.Errorf("overlapping blobs in pack %v", packID)
+			return nil, errors.Errorf("overlapping blobs in pack %v", packID)
 		}
 		if blobs[i].Offset-lastPos > maxUnusedRange {
 			// load everything up to the skipped file section
-			err := streamPackPart(ctx, beLoad, key, packID, blobs[lowerIdx:i], handleBlobFn)
-			if err != nil {
-				return err
-			}
+			parts = append(parts, blobs[lowerIdx:i])
 			lowerIdx = i
 		}
 		lastPos = blobs[i].Offset + blobs[i].Length
 	}
 	// load remainder
-	return streamPackPart(ctx, beLoad, key, packID, blobs[lowerIdx:], handleBlobFn)
+	return append(parts, blobs[lowerIdx:]), nil
 }
 
-func streamPackPart(ctx context.Context, beLoad BackendLoadFn, key *crypto.Key, packID restic.ID, blobs []restic.Blob, handleBlobFn func(blob restic.BlobHandle, buf []byte, err error) error) error {
+func streamPackPart(ctx context.Context, beLoad BackendLoadFn, key *crypto.Key, hasher restic.BlobHasher, packID restic.ID, blobs []restic.Blob, handleBlobFn func(blob restic.BlobHandle, buf []byte, err error) error) error {
 	h := backend.Handle{Type: restic.PackFile, Name: packID.String(), IsMetadata: false}
 
 	dataStart := blobs[0].Offset
@@ -996,7 +1212,7 @@ func streamPackPart(ctx context.Context, beLoad BackendLoadFn, key *crypto.Key,
 				}
 			}
 			if err == nil {
-				id := restic.Hash(plaintext)
+				id := hasher.Hash(plaintext)
 				if !id.Equal(entry.ID) {
 					debug.Log("read blob %v/%v from %v: wrong data returned, hash is %v",
 						h.Type, h.ID, packID.Str(), id)
@@ -1028,3 +1244,12 @@ func ZeroChunk() restic.ID {
 	})
 	return zeroChunkID
 }
+
+// ZeroChunkFor returns the ID of an all-zero chunk with the minimum chunk size
+// of the config, computed using its blob hash algorithm.
+func ZeroChunkFor(cfg restic.Config) restic.ID {
+	if cfg.Min() == chunker.MinSize && cfg.BlobHasher() == (restic.BlobHasher{}) {
+		return ZeroChunk()
+	}
+	return cfg.BlobHasher().Hash(make([]byte, cfg.Min()))
+}
@@ -1,6 +1,7 @@
 package repository
 
 import (
+	"context"
 	"math/rand"
 	"sort"
 	"testing"
@@ -8,6 +9,8 @@ import (
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/restic"
 	rtest "github.com/restic/restic/internal/test"
+
+	"golang.org/x/sync/errgroup"
 )
 
 type mapcache map[backend.Handle]bool
@@ -73,3 +76,50 @@ func BenchmarkSortCachedPacksFirst(b *testing.B) {
 		sortCachedPacksFirst(cache, cpy[:])
 	}
 }
+
+func TestCompressionMinSavings(t *testing.T) {
+	repo := TestRepositoryWithVersion(t, 2).(*Repository)
+	repo.opts.DataCompressionLevel = 1
+	repo.opts.MinCompressionSavings = 10
+
+	incompressible := rtest.Random(23, 64*1024)
+	compressible := make([]byte, 64*1024)
+
+	for _, test := range []struct {
+		tpe          restic.BlobType
+		data         []byte
+		uncompressed bool
+	}{
+		{restic.DataBlob, incompressible, true},
+		{restic.DataBlob, compressible, false},
+		// tree blobs are always compressed
+		{restic.TreeBlob, incompressible, false},
+	} {
+		var wg errgroup.Group
+		repo.StartPackUploader(context.TODO(), &wg)
+		id, _, _, err := repo.SaveBlob(context.TODO(), test.tpe, test.data, restic.ID{}, false)
+		rtest.OK(t, err)
+		rtest.OK(t, repo.Flush(context.TODO()))
+
+		pbs := repo.Index().Lookup(restic.BlobHandle{ID: id, Type: test.tpe})
+		rtest.Equals(t, 1, len(pbs))
+		rtest.Equals(t, test.uncompressed, !pbs[0].IsCompressed())
+
+		buf, err := repo.LoadBlob(context.TODO(), test.tpe, id, nil)
+		rtest.OK(t, err)
+		rtest.Equals(t, test.data, buf)
+	}
+}
+
+func TestInvalidCompressionOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{DataCompressionLevel: -1},
+		{DataCompressionLevel: MaxCompressionLevel + 1},
+		{MinCompressionSavings: 100},
+		{Compression: CompressionOff, DataCompressionLevel: 3},
+		{Compression: CompressionOff, MinCompressionSavings: 10},
+	} {
+		_, err := New(nil, opts)
+		rtest.Assert(t, err != nil, "missing error for %+v", opts)
+	}
+}
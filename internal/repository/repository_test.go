@@ -20,6 +20,7 @@ import (
 	"github.com/klauspost/compress/zstd"
 	"github.com/restic/restic/internal/backend"
 	"github.com/restic/restic/internal/backend/local"
+	"github.com/restic/restic/internal/backend/sema"
 	"github.com/restic/restic/internal/crypto"
 	"github.com/restic/restic/internal/index"
 	"github.com/restic/restic/internal/repository"
@@ -112,6 +113,42 @@ func testSaveFrom(t *testing.T, version uint) {
 	}
 }
 
+func TestSaveBlobHasher(t *testing.T) {
+	repository.TestAllBlobHashers(t, testSaveBlobHasher)
+}
+
+func testSaveBlobHasher(t *testing.T, hasher restic.BlobHasher) {
+	repo := repository.TestRepositoryWithBlobHasher(t, hasher)
+	rtest.Equals(t, hasher, repo.Config().BlobHasher())
+
+	data := rtest.Random(23, 50000)
+	otherHasher, err := restic.NewBlobHasher(restic.BlobHashBLAKE3)
+	rtest.OK(t, err)
+	if hasher == otherHasher {
+		otherHasher = restic.BlobHasher{}
+	}
+	other := otherHasher.Hash(data)
+
+	var wg errgroup.Group
+	repo.StartPackUploader(context.TODO(), &wg)
+
+	id, _, _, err := repo.SaveBlob(context.TODO(), restic.DataBlob, data, restic.ID{}, false)
+	rtest.OK(t, err)
+	rtest.Equals(t, hasher.Hash(data), id)
+
+	// a blob stored using an ID of a different hash must not be readable
+	_, _, _, err = repo.SaveBlob(context.TODO(), restic.DataBlob, data, other, false)
+	rtest.OK(t, err)
+	rtest.OK(t, repo.Flush(context.Background()))
+
+	buf, err := repo.LoadBlob(context.TODO(), restic.DataBlob, id, nil)
+	rtest.OK(t, err)
+	rtest.Assert(t, bytes.Equal(buf, data), "data does not match")
+
+	_, err = repo.LoadBlob(context.TODO(), restic.DataBlob, other, nil)
+	rtest.Assert(t, err != nil, "missing error for blob with wrong ID")
+}
+
 func BenchmarkSaveAndEncrypt(t *testing.B) {
 	repository.BenchmarkAllVersions(t, benchmarkSaveAndEncrypt)
 }
@@ -330,6 +367,36 @@ func TestRepositoryLoadUnpackedRetryBroken(t *testing.T) {
 	rtest.OK(t, repo.LoadIndex(context.TODO(), nil))
 }
 
+func TestRepositoryLoadIndexDamaged(t *testing.T) {
+	repodir, cleanup := rtest.Env(t, repoFixture)
+	defer cleanup()
+
+	be, err := local.Open(context.TODO(), local.Config{Path: repodir, Connections: 2})
+	rtest.OK(t, err)
+	data := rtest.Random(23, 12345)
+	id := restic.Hash(data)
+	rtest.OK(t, be.Save(context.TODO(), backend.Handle{Type: restic.IndexFile, Name: id.String()}, backend.NewByteReader(data, nil)))
+
+	repo, err := repository.New(be, repository.Options{})
+	rtest.OK(t, err)
+	rtest.OK(t, repo.SearchKey(context.TODO(), rtest.TestPassword, 10, ""))
+	err = repo.LoadIndex(context.TODO(), nil)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), id.Str()), "unexpected error %v", err)
+
+	var damaged restic.IDs
+	repo, err = repository.New(be, repository.Options{
+		DamagedIndex: func(id restic.ID, err error) {
+			damaged = append(damaged, id)
+		},
+	})
+	rtest.OK(t, err)
+	rtest.OK(t, repo.SearchKey(context.TODO(), rtest.TestPassword, 10, ""))
+	rtest.OK(t, repo.LoadIndex(context.TODO(), nil))
+	rtest.Equals(t, restic.IDs{id}, damaged)
+	rtest.Equals(t, restic.IDs{id}, repo.SkippedIndexes())
+	rtest.Assert(t, len(repo.Index().(*index.MasterIndex).IDs()) > 0, "intact index files were not loaded")
+}
+
 func BenchmarkLoadIndex(b *testing.B) {
 	repository.BenchmarkAllVersions(b, benchmarkLoadIndex)
 }
@@ -367,6 +434,61 @@ func benchmarkLoadIndex(b *testing.B, version uint) {
 	}
 }
 
+// latencyBackend delays loading files to simulate a remote backend.
+type latencyBackend struct {
+	backend.Backend
+	connections uint
+	latency     time.Duration
+}
+
+func (be *latencyBackend) Connections() uint {
+	return be.connections
+}
+
+func (be *latencyBackend) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	time.Sleep(be.latency)
+	return be.Backend.Load(ctx, h, length, offset, fn)
+}
+
+func BenchmarkLoadIndexFiles(b *testing.B) {
+	be := repository.TestBackend(b)
+	repo := repository.TestRepositoryWithBackend(b, be, restic.StableRepoVersion)
+
+	for i := 0; i < 500; i++ {
+		idx := index.NewIndex()
+		for j := 0; j < 100; j++ {
+			blobs := make([]restic.Blob, 0, 20)
+			for k := 0; k < cap(blobs); k++ {
+				blobs = append(blobs, restic.Blob{
+					BlobHandle: restic.NewRandomBlobHandle(),
+					Length:     1234,
+					Offset:     uint(k) * 1234,
+				})
+			}
+			idx.StorePack(restic.NewRandomID(), blobs)
+		}
+		idx.Finalize()
+		_, err := index.SaveIndex(context.TODO(), repo, idx)
+		rtest.OK(b, err)
+	}
+
+	for _, connections := range []uint{1, 2, 5, 8} {
+		b.Run(fmt.Sprintf("connections=%d", connections), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				// the connections are limited as for a real backend
+				lbe := sema.NewBackend(&latencyBackend{Backend: be, connections: connections, latency: 10 * time.Millisecond})
+				repo, err := repository.New(lbe, repository.Options{})
+				rtest.OK(b, err)
+				rtest.OK(b, repo.SearchKey(context.TODO(), rtest.TestPassword, 10, ""))
+				b.StartTimer()
+
+				rtest.OK(b, repo.LoadIndex(context.TODO(), nil))
+			}
+		})
+	}
+}
+
 // saveRandomDataBlobs generates random data blobs and saves them to the repository.
 func saveRandomDataBlobs(t testing.TB, repo restic.Repository, num int, sizeMax int) {
 	var wg errgroup.Group
@@ -522,7 +644,7 @@ func testStreamPack(t *testing.T, version uint) {
 	switch version {
 	case 1:
 		compress = false
-	case 2:
+	case 2, 3:
 		compress = true
 	default:
 		t.Fatal("test does not support repository version", version)
@@ -622,7 +744,7 @@ func testStreamPack(t *testing.T, version uint) {
 
 				loadCalls = 0
 				shortFirstLoad = test.shortFirstLoad
-				err = repository.StreamPack(ctx, load, &key, restic.ID{}, test.blobs, handleBlob)
+				err = repository.StreamPack(ctx, load, &key, restic.BlobHasher{}, restic.ID{}, test.blobs, handleBlob)
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -685,7 +807,7 @@ func testStreamPack(t *testing.T, version uint) {
 					return err
 				}
 
-				err = repository.StreamPack(ctx, load, &key, restic.ID{}, test.blobs, handleBlob)
+				err = repository.StreamPack(ctx, load, &key, restic.BlobHasher{}, restic.ID{}, test.blobs, handleBlob)
 				if err == nil {
 					t.Fatalf("wanted error %v, got nil", test.err)
 				}
@@ -705,3 +827,48 @@ func TestInvalidCompression(t *testing.T) {
 	_, err = repository.New(nil, repository.Options{Compression: comp})
 	rtest.Assert(t, err != nil, "missing error")
 }
+
+func TestQuota(t *testing.T) {
+	repo := repository.TestRepository(t).(*repository.Repository)
+	saveRandomDataBlobs(t, repo, 10, 1<<15)
+	rtest.OK(t, repo.Flush(context.TODO()))
+
+	status := repo.QuotaStatus(context.TODO())
+	rtest.Assert(t, status.Size > 0, "missing repository size")
+	rtest.Equals(t, uint64(0), status.Limit)
+
+	limit := status.Size + 100000
+	rtest.OK(t, repo.SetMaxRepoSize(context.TODO(), limit))
+	cfg, err := restic.LoadConfig(context.TODO(), repo)
+	rtest.OK(t, err)
+	rtest.Equals(t, limit, cfg.MaxRepoSize)
+
+	status = repo.QuotaStatus(context.TODO())
+	rtest.Equals(t, repository.QuotaStatus{Limit: limit, Slack: 64 * 1024 * 1024, Size: limit - 100000}, status)
+	repo.EnforceQuota(status)
+
+	var wg errgroup.Group
+	repo.StartPackUploader(context.TODO(), &wg)
+	save := func(tpe restic.BlobType, size int) (restic.ID, error) {
+		buf := make([]byte, size)
+		_, err := io.ReadFull(rnd, buf)
+		rtest.OK(t, err)
+		id, _, _, err := repo.SaveBlob(context.TODO(), tpe, buf, restic.ID{}, false)
+		return id, err
+	}
+	_, err = save(restic.DataBlob, 50000)
+	rtest.OK(t, err)
+
+	// data blobs are refused once the limit would be exceeded
+	id, err := save(restic.DataBlob, 60000)
+	rtest.Assert(t, errors.Is(err, restic.ErrQuotaExceeded), "unexpected error %v", err)
+	rtest.Assert(t, !repo.Index().Has(restic.BlobHandle{ID: id, Type: restic.DataBlob}), "refused blob is known")
+	_, err = save(restic.DataBlob, 10)
+	rtest.Assert(t, errors.Is(err, restic.ErrQuotaExceeded), "unexpected error %v", err)
+
+	// but metadata can still be saved
+	_, err = save(restic.TreeBlob, 100000)
+	rtest.OK(t, err)
+	rtest.OK(t, repo.Flush(context.TODO()))
+	rtest.Assert(t, repo.QuotaStatus(context.TODO()).Exceeded(), "limit not exceeded")
+}
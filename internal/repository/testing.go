@@ -45,6 +45,18 @@ const TestChunkerPol = chunker.Pol(0x3DA3358B4DC173)
 // password. If be is nil, an in-memory backend is used. A constant polynomial
 // is used for the chunker and low-security test parameters.
 func TestRepositoryWithBackend(t testing.TB, be backend.Backend, version uint) restic.Repository {
+	t.Helper()
+	return testRepositoryWithConfig(t, be, version, restic.BlobHasher{})
+}
+
+// TestRepositoryWithBlobHasher returns a repository on an in-memory backend
+// which uses hasher to compute the blob IDs.
+func TestRepositoryWithBlobHasher(t testing.TB, hasher restic.BlobHasher) restic.Repository {
+	t.Helper()
+	return testRepositoryWithConfig(t, nil, restic.MinBlobHashRepoVersion, hasher)
+}
+
+func testRepositoryWithConfig(t testing.TB, be backend.Backend, version uint, hasher restic.BlobHasher) restic.Repository {
 	t.Helper()
 	TestUseLowSecurityKDFParameters(t)
 	restic.TestDisableCheckPolynomial(t)
@@ -59,6 +71,9 @@ func TestRepositoryWithBackend(t testing.TB, be backend.Backend, version uint) r
 	}
 
 	cfg := restic.TestCreateConfig(t, TestChunkerPol, version)
+	if hasher != (restic.BlobHasher{}) {
+		cfg.BlobHash = hasher.String()
+	}
 	err = repo.init(context.TODO(), test.TestPassword, cfg)
 	if err != nil {
 		t.Fatalf("TestRepository(): initialize repo failed: %v", err)
@@ -105,7 +120,9 @@ func TestOpenLocal(t testing.TB, dir string) (r restic.Repository) {
 		t.Fatal(err)
 	}
 
-	be = retry.New(be, 3, nil, nil)
+	policy := retry.DefaultPolicy()
+	policy.MaxRetries = 3
+	be = retry.New(be, policy, nil, nil)
 
 	repo, err := New(be, Options{})
 	if err != nil {
@@ -138,3 +155,33 @@ func BenchmarkAllVersions(b *testing.B, bench VersionedBenchmark) {
 		})
 	}
 }
+
+type BlobHasherTest func(t *testing.T, hasher restic.BlobHasher)
+
+// TestAllBlobHashers runs test for each supported blob hash algorithm.
+func TestAllBlobHashers(t *testing.T, test BlobHasherTest) {
+	for _, name := range restic.BlobHashes {
+		hasher, err := restic.NewBlobHasher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) {
+			test(t, hasher)
+		})
+	}
+}
+
+type BlobHasherBenchmark func(b *testing.B, hasher restic.BlobHasher)
+
+// BenchmarkAllBlobHashers runs bench for each supported blob hash algorithm.
+func BenchmarkAllBlobHashers(b *testing.B, bench BlobHasherBenchmark) {
+	for _, name := range restic.BlobHashes {
+		hasher, err := restic.NewBlobHasher(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			bench(b, hasher)
+		})
+	}
+}
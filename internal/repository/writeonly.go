@@ -0,0 +1,451 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/crypto"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+)
+
+const (
+	// KeyTypeWriteOnly is the type of key files which store an X25519 public
+	// key together with its private key, encrypted using the master key.
+	// Clients which only know the public key can add backups which they
+	// cannot read afterwards.
+	KeyTypeWriteOnly = "write-only"
+
+	// KeyTypeSession is the type of key files which store the session key
+	// used by a client which opened the repository with a write-only key.
+	// The session key is encrypted for the public key of the write-only key,
+	// until FoldSessionKeys moves it into a session list.
+	KeyTypeSession = "session"
+
+	// KeyTypeSessionList is the type of key files which store a list of
+	// session keys, encrypted using the master key. FoldSessionKeys moves the
+	// session keys into such a file, such that the number of key files does
+	// not grow with each backup.
+	KeyTypeSessionList = "session-list"
+)
+
+// sessionListEntry is a session key stored in a key file of type
+// KeyTypeSessionList.
+type sessionListEntry struct {
+	Tag []byte      `json:"tag"`
+	Key *crypto.Key `json:"key"`
+}
+
+// MinWriteOnlyRepoVersion is the first repository version which can contain
+// write-only and session keys. Older restic versions cannot use these key
+// files, but refuse to open repositories with this version.
+const MinWriteOnlyRepoVersion = 3
+
+// checkWriteOnlyVersion returns an error if the repository version does not
+// allow write-only keys.
+func checkWriteOnlyVersion(version uint) error {
+	if version < MinWriteOnlyRepoVersion {
+		return fmt.Errorf("write-only keys require repository version %d or later, the repository has version %d", MinWriteOnlyRepoVersion, version)
+	}
+	return nil
+}
+
+// WriteOnlyKey contains everything a client needs to add data to a
+// repository without being able to read it.
+type WriteOnlyKey struct {
+	// Key is the ID of the key file of the write-only key.
+	Key       restic.ID     `json:"key"`
+	PublicKey []byte        `json:"public_key"`
+	Config    restic.Config `json:"config"`
+}
+
+// ParseWriteOnlyKey decodes a write-only key created by AddWriteOnlyKey.
+func ParseWriteOnlyKey(buf []byte) (*WriteOnlyKey, error) {
+	var k WriteOnlyKey
+	err := json.Unmarshal(buf, &k)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unmarshal")
+	}
+	if len(k.PublicKey) != crypto.X25519KeySize || k.Key.IsNull() || k.Config.ID == "" {
+		return nil, errors.New("invalid write-only key")
+	}
+	if k.Config.Version < restic.MinRepoVersion || k.Config.Version > restic.MaxRepoVersion {
+		return nil, fmt.Errorf("unsupported repository version %v", k.Config.Version)
+	}
+	return &k, nil
+}
+
+// AddWriteOnlyKey adds a new write-only key to the repository. The returned
+// WriteOnlyKey allows opening the repository using OpenWriteOnly.
+func AddWriteOnlyKey(ctx context.Context, s *Repository, username, hostname string) (*Key, *WriteOnlyKey, error) {
+	if err := checkWriteOnlyVersion(s.Config().Version); err != nil {
+		return nil, nil, err
+	}
+
+	private, public, err := crypto.NewX25519Key()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newkey := newKeyMetadata(username, hostname)
+	newkey.Type = KeyTypeWriteOnly
+	newkey.PublicKey = public
+
+	newkey.Data = s.sealWithMasterKey(private)
+
+	err = storeKey(ctx, s, newkey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newkey, &WriteOnlyKey{Key: newkey.ID(), PublicKey: public, Config: s.cfg}, nil
+}
+
+// OpenWriteOnly prepares the repository for adding data using the write-only
+// key k. A new session key is stored in the repository, which encrypts all
+// files saved afterwards. The repository cannot decrypt any files, this
+// includes the index, snapshots and locks of other clients.
+func (r *Repository) OpenWriteOnly(ctx context.Context, k *WriteOnlyKey) error {
+	if err := checkWriteOnlyVersion(k.Config.Version); err != nil {
+		return err
+	}
+
+	// the write-only key is removed to revoke access
+	_, err := r.be.Stat(ctx, backend.Handle{Type: restic.KeyFile, Name: k.Key.String()})
+	if err != nil {
+		if r.be.IsNotExist(err) {
+			return fmt.Errorf("write-only key %v was removed from the repository", k.Key.Str())
+		}
+		return err
+	}
+
+	session := crypto.NewSessionKey()
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "Marshal")
+	}
+
+	newkey := newKeyMetadata("", "")
+	newkey.Type = KeyTypeSession
+	newkey.WriteOnlyKey = &k.Key
+	newkey.Tag = session.SessionTag()
+	newkey.Data, err = crypto.SealForPublicKey(k.PublicKey, buf)
+	if err != nil {
+		return err
+	}
+
+	err = storeKey(ctx, r, newkey)
+	if err != nil {
+		return err
+	}
+
+	r.key = session
+	r.keyID = newkey.ID()
+	r.writeOnly = true
+	r.setConfig(k.Config)
+	return nil
+}
+
+// WriteOnly returns true if the repository was opened using OpenWriteOnly.
+func (r *Repository) WriteOnly() bool {
+	return r.writeOnly
+}
+
+// loadSessionKeys makes the session keys available for decrypting files, this
+// requires the master key. The key files are listed unless their IDs are
+// given.
+func (r *Repository) loadSessionKeys(ctx context.Context, ids restic.IDs) error {
+	var lister restic.Lister = r
+	if ids != nil {
+		lister = keyLister(ids)
+	}
+
+	keys, err := r.loadWriteOnlyKeyFiles(ctx, lister)
+	if err != nil {
+		return err
+	}
+
+	loaded := 0
+	for _, k := range keys.lists {
+		entries, err := r.decryptSessionList(k)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to load session list %v: %v\n", k.id.Str(), err)
+			continue
+		}
+		for _, e := range entries {
+			err := r.key.AddSessionKey(e.Tag, e.Key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "unable to load session key from session list %v: %v\n", k.id.Str(), err)
+				continue
+			}
+			loaded++
+		}
+	}
+
+	for _, k := range keys.sessions {
+		err := r.addSessionKey(k, keys.private)
+		if err != nil {
+			// only the files written using the session key are affected
+			fmt.Fprintf(os.Stderr, "unable to load session key %v: %v\n", k.id.Str(), err)
+			continue
+		}
+		loaded++
+	}
+	debug.Log("loaded %d session keys", loaded)
+	return nil
+}
+
+// writeOnlyKeyFiles contains the key files which are not password keys.
+type writeOnlyKeyFiles struct {
+	// private contains the private keys of the write-only keys by ID
+	private  map[restic.ID][]byte
+	sessions []*Key
+	lists    []*Key
+}
+
+// loadWriteOnlyKeyFiles loads the write-only, session and session list key
+// files listed by lister and decrypts the private keys of the write-only keys.
+func (r *Repository) loadWriteOnlyKeyFiles(ctx context.Context, lister restic.Lister) (writeOnlyKeyFiles, error) {
+	var m sync.Mutex
+	keys := writeOnlyKeyFiles{private: make(map[restic.ID][]byte)}
+
+	err := restic.ParallelList(ctx, lister, restic.KeyFile, r.Connections(), func(ctx context.Context, id restic.ID, _ int64) error {
+		if id == r.keyID {
+			return nil
+		}
+		k, err := LoadKey(ctx, r, id)
+		if err != nil {
+			return err
+		}
+		k.id = id
+
+		m.Lock()
+		defer m.Unlock()
+		switch k.Type {
+		case KeyTypeWriteOnly:
+			key, err := r.openWithMasterKey(k.Data)
+			if err != nil {
+				// the session keys of this key are reported as missing later
+				fmt.Fprintf(os.Stderr, "unable to load write-only key %v: %v\n", id.Str(), err)
+				return nil
+			}
+			keys.private[id] = key
+		case KeyTypeSession:
+			keys.sessions = append(keys.sessions, k)
+		case KeyTypeSessionList:
+			keys.lists = append(keys.lists, k)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// keyLister lists a fixed set of key files.
+type keyLister restic.IDs
+
+func (l keyLister) List(ctx context.Context, _ restic.FileType, fn func(restic.ID, int64) error) error {
+	for _, id := range l {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := fn(id, 0); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// sealWithMasterKey encrypts data using the master key, the result is stored
+// in the Data field of key files.
+func (r *Repository) sealWithMasterKey(data []byte) []byte {
+	nonce := crypto.NewRandomNonce()
+	ciphertext := make([]byte, 0, crypto.CiphertextLength(len(data)))
+	ciphertext = append(ciphertext, nonce...)
+	return r.key.Seal(ciphertext, nonce, data, nil)
+}
+
+func (r *Repository) openWithMasterKey(data []byte) ([]byte, error) {
+	if len(data) < crypto.Extension {
+		return nil, errors.New("ciphertext too small")
+	}
+	nonce, ciphertext := data[:r.key.NonceSize()], data[r.key.NonceSize():]
+	return r.key.Open(nil, nonce, ciphertext, nil)
+}
+
+// decryptSessionKey returns the session key stored in k, using the private
+// keys of the write-only keys.
+func (r *Repository) decryptSessionKey(k *Key, private map[restic.ID][]byte) (*crypto.Key, error) {
+	var buf []byte
+	var err error
+	if k.WriteOnlyKey == nil {
+		buf, err = r.openWithMasterKey(k.Data)
+	} else {
+		priv, ok := private[*k.WriteOnlyKey]
+		if !ok {
+			return nil, fmt.Errorf("write-only key %v is missing", k.WriteOnlyKey.Str())
+		}
+		buf, err = crypto.OpenWithPrivateKey(priv, k.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := &crypto.Key{}
+	err = json.Unmarshal(buf, session)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unmarshal")
+	}
+	return session, nil
+}
+
+// decryptSessionList returns the session keys stored in the session list k.
+func (r *Repository) decryptSessionList(k *Key) ([]sessionListEntry, error) {
+	buf, err := r.openWithMasterKey(k.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []sessionListEntry
+	err = json.Unmarshal(buf, &entries)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unmarshal")
+	}
+	return entries, nil
+}
+
+func (r *Repository) addSessionKey(k *Key, private map[restic.ID][]byte) error {
+	session, err := r.decryptSessionKey(k, private)
+	if err != nil {
+		return err
+	}
+	return r.key.AddSessionKey(k.Tag, session)
+}
+
+// FoldSessionKeys moves the session keys from their key files into a single
+// session list, which is encrypted using the master key, and removes the old
+// key files, including previous session lists. Session keys which cannot be
+// decrypted stay in their key files. The repository must not be used by other
+// processes which require the master key, which is ensured by an exclusive
+// lock. Only the key files which existed when the repository was opened are
+// considered. It returns the number of session keys which were moved.
+func FoldSessionKeys(ctx context.Context, r *Repository) (int, error) {
+	var lister restic.Lister = r
+	if r.keyFiles != nil {
+		lister = keyLister(r.keyFiles)
+	}
+	folded, _, err := foldSessionKeys(ctx, r, lister)
+	if err == nil {
+		// some of the listed key files were removed
+		r.keyFiles = nil
+	}
+	return len(folded), err
+}
+
+// foldSessionKeys works like FoldSessionKeys for the key files listed by
+// lister, it returns the session key files which were folded and those which
+// were kept.
+func foldSessionKeys(ctx context.Context, r *Repository, lister restic.Lister) (folded, kept []*Key, err error) {
+	if r.writeOnly {
+		return nil, nil, errors.New("the session keys cannot be moved using a write-only key")
+	}
+	if r.Config().Version < MinWriteOnlyRepoVersion {
+		// the repository cannot contain session keys
+		return nil, nil, nil
+	}
+
+	keys, err := r.loadWriteOnlyKeyFiles(ctx, lister)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys.sessions) == 0 && len(keys.lists) <= 1 {
+		return nil, nil, nil
+	}
+
+	var entries []sessionListEntry
+	for _, k := range keys.lists {
+		list, err := r.decryptSessionList(k)
+		if err != nil {
+			return nil, nil, fmt.Errorf("session list %v: %w", k.id.Str(), err)
+		}
+		entries = append(entries, list...)
+	}
+	for _, k := range keys.sessions {
+		session, err := r.decryptSessionKey(k, keys.private)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to load session key %v, keeping it: %v\n", k.id.Str(), err)
+			kept = append(kept, k)
+			continue
+		}
+		entries = append(entries, sessionListEntry{Tag: k.Tag, Key: session})
+		folded = append(folded, k)
+	}
+
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Marshal")
+	}
+	newkey := newKeyMetadata("", "")
+	newkey.Type = KeyTypeSessionList
+	newkey.Data = r.sealWithMasterKey(buf)
+
+	// the old files are only removed once the new one is stored
+	err = storeKey(ctx, r, newkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	debug.Log("stored %d session keys in session list %v", len(entries), newkey.ID())
+
+	for _, k := range append(keys.lists, folded...) {
+		err := r.be.Remove(ctx, backend.Handle{Type: restic.KeyFile, Name: k.id.String()})
+		if err != nil {
+			return folded, kept, err
+		}
+	}
+	return folded, kept, nil
+}
+
+// RemoveWriteOnlyKey removes the write-only key id from the repository, such
+// that it cannot be used to add data anymore. The session keys are moved into
+// a session list using FoldSessionKeys first, thus the data added using the
+// key stays readable. It returns the number of moved session keys which were
+// created using the write-only key.
+func RemoveWriteOnlyKey(ctx context.Context, r *Repository, id restic.ID) (int, error) {
+	k, err := LoadKey(ctx, r, id)
+	if err != nil {
+		return 0, err
+	}
+	if k.Type != KeyTypeWriteOnly {
+		return 0, fmt.Errorf("key %v is not a write-only key", id.Str())
+	}
+	_, err = r.openWithMasterKey(k.Data)
+	if err != nil {
+		return 0, fmt.Errorf("write-only key %v: %w", id.Str(), err)
+	}
+
+	// the session keys which were created since the repository was opened
+	// must be moved as well
+	folded, kept, err := foldSessionKeys(ctx, r, r)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range kept {
+		if s.WriteOnlyKey != nil && *s.WriteOnlyKey == id {
+			return 0, fmt.Errorf("session key %v of write-only key %v could not be moved", s.id.Str(), id.Str())
+		}
+	}
+
+	moved := 0
+	for _, s := range folded {
+		if s.WriteOnlyKey != nil && *s.WriteOnlyKey == id {
+			moved++
+		}
+	}
+
+	err = r.be.Remove(ctx, backend.Handle{Type: restic.KeyFile, Name: id.String()})
+	return moved, err
+}
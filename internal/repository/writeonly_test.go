@@ -0,0 +1,151 @@
+package repository_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestWriteOnlyKey(t *testing.T) {
+	be := repository.TestBackend(t)
+	repo := repository.TestRepositoryWithBackend(t, be, repository.MinWriteOnlyRepoVersion).(*repository.Repository)
+
+	_, key, err := repository.AddWriteOnlyKey(context.TODO(), repo, "user", "host")
+	rtest.OK(t, err)
+
+	wo, err := repository.New(be, repository.Options{})
+	rtest.OK(t, err)
+	rtest.OK(t, wo.OpenWriteOnly(context.TODO(), key))
+	rtest.Assert(t, wo.WriteOnly(), "repository is not write-only")
+
+	// the write-only key cannot read the config
+	_, err = restic.LoadConfig(context.TODO(), wo)
+	rtest.Assert(t, err != nil, "config could be read using a write-only key")
+
+	var wg errgroup.Group
+	wo.StartPackUploader(context.TODO(), &wg)
+	data := rtest.Random(23, 10000)
+	blobID, _, _, err := wo.SaveBlob(context.TODO(), restic.DataBlob, data, restic.ID{}, false)
+	rtest.OK(t, err)
+	rtest.OK(t, wo.Flush(context.TODO()))
+	fileID, err := wo.SaveUnpacked(context.TODO(), restic.SnapshotFile, []byte("{}"))
+	rtest.OK(t, err)
+
+	check := func() {
+		t.Helper()
+		r, err := repository.New(be, repository.Options{})
+		rtest.OK(t, err)
+		rtest.OK(t, r.SearchKey(context.TODO(), rtest.TestPassword, 0, ""))
+		rtest.OK(t, r.LoadIndex(context.TODO(), nil))
+
+		buf, err := r.LoadBlob(context.TODO(), restic.DataBlob, blobID, nil)
+		rtest.OK(t, err)
+		rtest.Equals(t, data, buf)
+		buf, err = r.LoadUnpacked(context.TODO(), restic.SnapshotFile, fileID)
+		rtest.OK(t, err)
+		rtest.Equals(t, []byte("{}"), buf)
+	}
+	check()
+
+	rewritten, err := repository.RemoveWriteOnlyKey(context.TODO(), repo, key.Key)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, rewritten)
+
+	// the data stays readable, but the key cannot be used anymore
+	check()
+	wo, err = repository.New(be, repository.Options{})
+	rtest.OK(t, err)
+	rtest.Assert(t, wo.OpenWriteOnly(context.TODO(), key) != nil, "removed write-only key could be used")
+}
+
+func TestSessionKeysDoNotCountTowardsMaxKeys(t *testing.T) {
+	be := repository.TestBackend(t)
+	repo := repository.TestRepositoryWithBackend(t, be, repository.MinWriteOnlyRepoVersion).(*repository.Repository)
+
+	_, key, err := repository.AddWriteOnlyKey(context.TODO(), repo, "user", "host")
+	rtest.OK(t, err)
+
+	const maxKeys = 20
+	for i := 0; i < maxKeys+1; i++ {
+		wo, err := repository.New(be, repository.Options{})
+		rtest.OK(t, err)
+		rtest.OK(t, wo.OpenWriteOnly(context.TODO(), key))
+	}
+
+	r, err := repository.New(be, repository.Options{})
+	rtest.OK(t, err)
+	rtest.OK(t, r.SearchKey(context.TODO(), rtest.TestPassword, maxKeys, ""))
+}
+
+func TestWriteOnlyKeyRepoVersion(t *testing.T) {
+	repo := repository.TestRepositoryWithVersion(t, 2).(*repository.Repository)
+	_, _, err := repository.AddWriteOnlyKey(context.TODO(), repo, "user", "host")
+	rtest.Assert(t, err != nil, "write-only key added to repository version 2")
+}
+
+func TestFoldSessionKeys(t *testing.T) {
+	be := repository.TestBackend(t)
+	repo := repository.TestRepositoryWithBackend(t, be, repository.MinWriteOnlyRepoVersion).(*repository.Repository)
+
+	_, key, err := repository.AddWriteOnlyKey(context.TODO(), repo, "user", "host")
+	rtest.OK(t, err)
+
+	blobs := make(map[restic.ID][]byte)
+	backup := func() {
+		t.Helper()
+		wo, err := repository.New(be, repository.Options{})
+		rtest.OK(t, err)
+		rtest.OK(t, wo.OpenWriteOnly(context.TODO(), key))
+
+		var wg errgroup.Group
+		wo.StartPackUploader(context.TODO(), &wg)
+		data := rtest.Random(len(blobs), 1000)
+		id, _, _, err := wo.SaveBlob(context.TODO(), restic.DataBlob, data, restic.ID{}, false)
+		rtest.OK(t, err)
+		rtest.OK(t, wo.Flush(context.TODO()))
+		blobs[id] = data
+	}
+	countKeys := func() int {
+		t.Helper()
+		n := 0
+		rtest.OK(t, repo.List(context.TODO(), restic.KeyFile, func(restic.ID, int64) error {
+			n++
+			return nil
+		}))
+		return n
+	}
+
+	backup()
+	backup()
+	moved, err := repository.FoldSessionKeys(context.TODO(), repo)
+	rtest.OK(t, err)
+	rtest.Equals(t, 2, moved)
+	// password key, write-only key and session list
+	rtest.Equals(t, 3, countKeys())
+
+	// the new session key and the old session list are folded again
+	backup()
+	moved, err = repository.FoldSessionKeys(context.TODO(), repo)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, moved)
+	rtest.Equals(t, 3, countKeys())
+
+	moved, err = repository.FoldSessionKeys(context.TODO(), repo)
+	rtest.OK(t, err)
+	rtest.Equals(t, 0, moved)
+	rtest.Equals(t, 3, countKeys())
+
+	r, err := repository.New(be, repository.Options{})
+	rtest.OK(t, err)
+	rtest.OK(t, r.SearchKey(context.TODO(), rtest.TestPassword, 0, ""))
+	rtest.OK(t, r.LoadIndex(context.TODO(), nil))
+	for id, data := range blobs {
+		buf, err := r.LoadBlob(context.TODO(), restic.DataBlob, id, nil)
+		rtest.OK(t, err)
+		rtest.Equals(t, data, buf)
+	}
+}
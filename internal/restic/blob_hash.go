@@ -0,0 +1,71 @@
+package restic
+
+import (
+	"hash"
+
+	"github.com/minio/sha256-simd"
+	"github.com/restic/restic/internal/errors"
+	"github.com/zeebo/blake3"
+)
+
+// The hash algorithms which can compute the IDs of data and tree blobs. The
+// IDs of the files in the repository always use SHA-256.
+const (
+	BlobHashSHA256 = "sha256"
+	BlobHashBLAKE3 = "blake3"
+)
+
+// BlobHashes contains the names of all blob hash algorithms.
+var BlobHashes = []string{BlobHashSHA256, BlobHashBLAKE3}
+
+// MinBlobHashRepoVersion is the first repository version whose config can
+// select the blob hash algorithm.
+const MinBlobHashRepoVersion = 3
+
+// BlobHasher computes the IDs of blobs. The zero value uses SHA-256.
+type BlobHasher struct {
+	// name is empty for SHA-256, such that hashers can be compared
+	name string
+}
+
+// NewBlobHasher returns the hasher for the algorithm name.
+func NewBlobHasher(name string) (BlobHasher, error) {
+	switch name {
+	case "", BlobHashSHA256:
+		return BlobHasher{}, nil
+	case BlobHashBLAKE3:
+		return BlobHasher{name: name}, nil
+	}
+	return BlobHasher{}, errors.Errorf("unknown blob hash algorithm %q", name)
+}
+
+// String returns the name of the algorithm.
+func (h BlobHasher) String() string {
+	if h.name == "" {
+		return BlobHashSHA256
+	}
+	return h.name
+}
+
+// New returns a hash.Hash which computes blob IDs.
+func (h BlobHasher) New() hash.Hash {
+	if h.name == BlobHashBLAKE3 {
+		return blake3.New()
+	}
+	return sha256.New()
+}
+
+// Hash returns the ID of the blob data.
+func (h BlobHasher) Hash(data []byte) ID {
+	if h.name == BlobHashBLAKE3 {
+		return blake3.Sum256(data)
+	}
+	return sha256.Sum256(data)
+}
+
+// BlobHasher returns the hasher for the blob IDs of the repository.
+func (cfg Config) BlobHasher() BlobHasher {
+	// the algorithm is checked when loading the config
+	h, _ := NewBlobHasher(cfg.BlobHash)
+	return h
+}
@@ -2,6 +2,8 @@ package restic
 
 import (
 	"context"
+	"io"
+	"math/bits"
 	"testing"
 
 	"github.com/restic/restic/internal/errors"
@@ -16,10 +18,108 @@ type Config struct {
 	Version           uint        `json:"version"`
 	ID                string      `json:"id"`
 	ChunkerPolynomial chunker.Pol `json:"chunker_polynomial"`
+	ChunkerSizes
+
+	// MaxRepoSize is the size limit of the repository in bytes, backups stop
+	// uploading data once it is reached. Zero means no limit. The limit is
+	// only advisory and not tied to a repository version: it is enforced by
+	// each client on its own, restic versions without support for it ignore
+	// the field.
+	MaxRepoSize uint64 `json:"max_repo_size,omitempty"`
+
+	// BlobHash selects the hash algorithm for the IDs of data and tree blobs,
+	// see BlobHasher. It is empty for SHA-256.
+	BlobHash string `json:"blob_hash,omitempty"`
+}
+
+// ErrQuotaExceeded is returned when saving a blob would exceed the size limit
+// of the repository.
+var ErrQuotaExceeded = errors.New("repository size limit exceeded")
+
+// ChunkerSizes are the size boundaries used by the chunker. A value of zero
+// selects the default of the chunker, such that the sizes are only stored in
+// the config if they were changed.
+type ChunkerSizes struct {
+	MinSize uint `json:"chunker_min_size,omitempty"`
+	MaxSize uint `json:"chunker_max_size,omitempty"`
+	// AverageSize must be a power of two.
+	AverageSize uint `json:"chunker_average_size,omitempty"`
+}
+
+const (
+	// defaultAverageChunkSize is the average chunk size of the chunker.
+	defaultAverageChunkSize = 1 << 20
+
+	// MinChunkSize and MaxChunkSize limit the configurable chunk sizes.
+	MinChunkSize = 64 * 1024
+	MaxChunkSize = 64 * 1024 * 1024
+)
+
+// MinChunkerSizesRepoVersion is the first repository version whose config can
+// select the chunker sizes. Older restic versions ignore the sizes.
+const MinChunkerSizesRepoVersion = 3
+
+// Min returns the minimum size of a chunk.
+func (s ChunkerSizes) Min() uint {
+	if s.MinSize == 0 {
+		return chunker.MinSize
+	}
+	return s.MinSize
+}
+
+// Max returns the maximum size of a chunk.
+func (s ChunkerSizes) Max() uint {
+	if s.MaxSize == 0 {
+		return chunker.MaxSize
+	}
+	return s.MaxSize
+}
+
+// Average returns the average size of a chunk.
+func (s ChunkerSizes) Average() uint {
+	if s.AverageSize == 0 {
+		return defaultAverageChunkSize
+	}
+	return s.AverageSize
+}
+
+// Normalize returns the sizes with the defaults filled in.
+func (s ChunkerSizes) Normalize() ChunkerSizes {
+	return ChunkerSizes{MinSize: s.Min(), MaxSize: s.Max(), AverageSize: s.Average()}
+}
+
+// Validate checks that the sizes can be used by the chunker.
+func (s ChunkerSizes) Validate() error {
+	min, avg, max := s.Min(), s.Average(), s.Max()
+	if min < MinChunkSize || max > MaxChunkSize {
+		return errors.Errorf("chunk sizes must be between %d and %d bytes", MinChunkSize, MaxChunkSize)
+	}
+	if bits.OnesCount(avg) != 1 {
+		return errors.Errorf("average chunk size %d is not a power of two", avg)
+	}
+	if min > avg || avg > max {
+		return errors.Errorf("chunk sizes must satisfy min (%d) <= average (%d) <= max (%d)", min, avg, max)
+	}
+	return nil
+}
+
+// NewChunker returns a chunker for rd which uses the polynomial and the
+// chunk sizes of the config.
+func (cfg Config) NewChunker(rd io.Reader) *chunker.Chunker {
+	c := chunker.NewWithBoundaries(rd, cfg.ChunkerPolynomial, cfg.Min(), cfg.Max())
+	c.SetAverageBits(bits.Len(cfg.Average()) - 1)
+	return c
+}
+
+// ResetChunker reinitializes c with a new reader, using the polynomial and the
+// chunk sizes of the config.
+func (cfg Config) ResetChunker(c *chunker.Chunker, rd io.Reader) {
+	c.ResetWithBoundaries(rd, cfg.ChunkerPolynomial, cfg.Min(), cfg.Max())
+	c.SetAverageBits(bits.Len(cfg.Average()) - 1)
 }
 
 const MinRepoVersion = 1
-const MaxRepoVersion = 2
+const MaxRepoVersion = 3
 
 // StableRepoVersion is the version that is written to the config when a repository
 // is newly created with Init().
@@ -96,9 +196,42 @@ func LoadConfig(ctx context.Context, r LoaderUnpacked) (Config, error) {
 		}
 	}
 
+	if err := cfg.ValidateChunkerSizes(); err != nil {
+		return Config{}, err
+	}
+
+	if err := cfg.ValidateBlobHash(); err != nil {
+		return Config{}, err
+	}
+
 	return cfg, nil
 }
 
+// ValidateChunkerSizes checks that the chunker sizes are valid and can be
+// used with the repository version.
+func (cfg Config) ValidateChunkerSizes() error {
+	if err := cfg.ChunkerSizes.Validate(); err != nil {
+		return errors.Wrap(err, "invalid chunker sizes")
+	}
+	if cfg.ChunkerSizes != (ChunkerSizes{}) && cfg.Version < MinChunkerSizesRepoVersion {
+		return errors.Errorf("custom chunker sizes require repository version %d", MinChunkerSizesRepoVersion)
+	}
+	return nil
+}
+
+// ValidateBlobHash checks that the blob hash algorithm is known and can be
+// used with the repository version.
+func (cfg Config) ValidateBlobHash() error {
+	h, err := NewBlobHasher(cfg.BlobHash)
+	if err != nil {
+		return err
+	}
+	if h != (BlobHasher{}) && cfg.Version < MinBlobHashRepoVersion {
+		return errors.Errorf("blob hash algorithm %v requires repository version %d", h, MinBlobHashRepoVersion)
+	}
+	return nil
+}
+
 func SaveConfig(ctx context.Context, r SaverUnpacked, cfg Config) error {
 	_, err := SaveJSONUnpacked(ctx, r, ConfigFile, cfg)
 	return err
@@ -1,7 +1,9 @@
 package restic_test
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"testing"
 
 	"github.com/restic/restic/internal/restic"
@@ -63,3 +65,85 @@ func TestConfig(t *testing.T) {
 	rtest.Assert(t, cfg1 == cfg2,
 		"configs aren't equal: %v != %v", cfg1, cfg2)
 }
+
+func TestChunkerSizes(t *testing.T) {
+	var sizes restic.ChunkerSizes
+	rtest.OK(t, sizes.Validate())
+	rtest.Equals(t, restic.ChunkerSizes{MinSize: 512 * 1024, MaxSize: 8 * 1024 * 1024, AverageSize: 1024 * 1024}, sizes.Normalize())
+
+	for _, sizes := range []restic.ChunkerSizes{
+		{MinSize: 1024},
+		{MaxSize: 128 * 1024 * 1024},
+		{AverageSize: 3 * 1024 * 1024},
+		{MinSize: 2 * 1024 * 1024},
+		{MaxSize: 512 * 1024, MinSize: 128 * 1024},
+	} {
+		rtest.Assert(t, sizes.Validate() != nil, "missing error for %v", sizes)
+	}
+
+	cfg, err := restic.CreateConfig(restic.MaxRepoVersion)
+	rtest.OK(t, err)
+	cfg.ChunkerSizes = restic.ChunkerSizes{MinSize: 64 * 1024, AverageSize: 128 * 1024, MaxSize: 256 * 1024}
+	rtest.OK(t, cfg.ValidateChunkerSizes())
+
+	// older repository versions only support the default sizes
+	old := restic.Config{Version: restic.MinChunkerSizesRepoVersion - 1}
+	rtest.OK(t, old.ValidateChunkerSizes())
+	old.ChunkerSizes = cfg.ChunkerSizes
+	rtest.Assert(t, old.ValidateChunkerSizes() != nil, "missing error for chunker sizes in repository version %v", old.Version)
+
+	data := rtest.Random(23, 4*1024*1024)
+	chnk := cfg.NewChunker(bytes.NewReader(data))
+	buf := make([]byte, cfg.Max())
+	var chunks int
+	for {
+		c, err := chnk.Next(buf)
+		if err == io.EOF {
+			break
+		}
+		rtest.OK(t, err)
+		chunks++
+		rtest.Assert(t, c.Length <= cfg.Max(), "chunk too large: %v", c.Length)
+		rtest.Assert(t, c.Length >= cfg.Min() || c.Start+c.Length == uint(len(data)), "chunk too small: %v", c.Length)
+	}
+	// about 128 KiB per chunk on average
+	rtest.Assert(t, chunks > 16 && chunks < 64, "unexpected number of chunks %v", chunks)
+}
+
+func TestBlobHasher(t *testing.T) {
+	data := rtest.Random(42, 1000)
+
+	var cfg restic.Config
+	rtest.Equals(t, restic.BlobHashSHA256, cfg.BlobHasher().String())
+	rtest.Equals(t, restic.Hash(data), cfg.BlobHasher().Hash(data))
+
+	cfg.BlobHash = restic.BlobHashBLAKE3
+	hasher := cfg.BlobHasher()
+	rtest.Equals(t, restic.BlobHashBLAKE3, hasher.String())
+	rtest.Equals(t, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262", hasher.Hash(nil).String())
+	rtest.Assert(t, hasher.Hash(data) != restic.Hash(data), "blake3 returned the sha256 hash")
+
+	h := hasher.New()
+	_, err := h.Write(data)
+	rtest.OK(t, err)
+	rtest.Equals(t, hasher.Hash(data), restic.IDFromHash(h.Sum(nil)))
+
+	_, err = restic.NewBlobHasher("md5")
+	rtest.Assert(t, err != nil, "missing error for unknown algorithm")
+
+	for _, test := range []struct {
+		version uint
+		hash    string
+		valid   bool
+	}{
+		{1, "", true},
+		{2, restic.BlobHashSHA256, true},
+		{2, restic.BlobHashBLAKE3, false},
+		{restic.MinBlobHashRepoVersion, restic.BlobHashBLAKE3, true},
+		{restic.MinBlobHashRepoVersion, "md5", false},
+	} {
+		cfg := restic.Config{Version: test.version, BlobHash: test.hash}
+		err := cfg.ValidateBlobHash()
+		rtest.Assert(t, (err == nil) == test.valid, "unexpected result for version %v and %q: %v", test.version, test.hash, err)
+	}
+}
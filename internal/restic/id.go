@@ -9,7 +9,8 @@ import (
 	"github.com/minio/sha256-simd"
 )
 
-// Hash returns the ID for data.
+// Hash returns the SHA-256 ID for data. It is used for the files in the
+// repository, the IDs of blobs are computed by Config.BlobHasher.
 func Hash(data []byte) ID {
 	return sha256.Sum256(data)
 }
@@ -88,14 +88,21 @@ var ErrRemovedLock = errors.New("lock file was removed in the meantime")
 // exclusive lock is already held by another process, it returns an error
 // that satisfies IsAlreadyLocked.
 func NewLock(ctx context.Context, repo Repository) (*Lock, error) {
-	return newLock(ctx, repo, false)
+	return newLock(ctx, repo, false, true)
+}
+
+// NewWriteOnlyLock returns a new, non-exclusive lock for a repository which
+// was opened using a write-only key. As the locks of other processes cannot
+// be decrypted using such a key, they are not checked.
+func NewWriteOnlyLock(ctx context.Context, repo Repository) (*Lock, error) {
+	return newLock(ctx, repo, false, false)
 }
 
 // NewExclusiveLock returns a new, exclusive lock for the repository. If
 // another lock (normal and exclusive) is already held by another process,
 // it returns an error that satisfies IsAlreadyLocked.
 func NewExclusiveLock(ctx context.Context, repo Repository) (*Lock, error) {
-	return newLock(ctx, repo, true)
+	return newLock(ctx, repo, true, true)
 }
 
 var waitBeforeLockCheck = 200 * time.Millisecond
@@ -106,7 +113,7 @@ func TestSetLockTimeout(t testing.TB, d time.Duration) {
 	waitBeforeLockCheck = d
 }
 
-func newLock(ctx context.Context, repo Repository, excl bool) (*Lock, error) {
+func newLock(ctx context.Context, repo Repository, excl bool, checkOthers bool) (*Lock, error) {
 	lock := &Lock{
 		Time:      time.Now(),
 		PID:       os.Getpid(),
@@ -123,8 +130,10 @@ func newLock(ctx context.Context, repo Repository, excl bool) (*Lock, error) {
 		return nil, err
 	}
 
-	if err = lock.checkForOtherLocks(ctx); err != nil {
-		return nil, err
+	if checkOthers {
+		if err = lock.checkForOtherLocks(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	lockID, err := lock.createLock(ctx)
@@ -133,6 +142,9 @@ func newLock(ctx context.Context, repo Repository, excl bool) (*Lock, error) {
 	}
 
 	lock.lockID = &lockID
+	if !checkOthers {
+		return lock, nil
+	}
 
 	time.Sleep(waitBeforeLockCheck)
 
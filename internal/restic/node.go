@@ -55,6 +55,14 @@ type Node struct {
 
 	Error string `json:"error,omitempty"`
 
+	// ModifiedDuringBackup is set if the file changed while it was read, so
+	// the content may be inconsistent.
+	ModifiedDuringBackup bool `json:"modified_during_backup,omitempty"`
+
+	// DeviceType is "dev" or "chardev" if the node is a regular file holding
+	// the contents of a device.
+	DeviceType string `json:"device_type,omitempty"`
+
 	Path string `json:"-"`
 }
 
@@ -100,11 +108,11 @@ func NodeFromFileInfo(path string, fi os.FileInfo) (*Node, error) {
 	}
 
 	node.Type = nodeTypeFromFileInfo(fi)
-	if node.Type == "file" {
+	if node.Type == "file" && fi.Size() != fs.SizeUnknown {
 		node.Size = uint64(fi.Size())
 	}
 
-	err := node.fillExtra(path, fi)
+	err := node.fillExtra(fs.LocalPath(fi, path), fi)
 	return node, err
 }
 
@@ -179,9 +187,28 @@ func (node *Node) CreateAt(ctx context.Context, path string, repo Repository) er
 	return nil
 }
 
+// ErrXattrUnsupported is returned if extended attributes are not supported by
+// the file system.
+var ErrXattrUnsupported = errors.New("extended attributes are not supported")
+
+// MetadataOptions selects which metadata is restored by RestoreMetadataWith.
+type MetadataOptions struct {
+	// SkipOwner leaves the owner and group of the file unchanged.
+	SkipOwner bool
+	// XattrError, if set, is called for each extended attribute which cannot
+	// be restored. The error is ignored if it returns nil. Otherwise, errors
+	// wrapping ErrXattrUnsupported are ignored.
+	XattrError func(name string, err error) error
+}
+
 // RestoreMetadata restores node metadata
 func (node Node) RestoreMetadata(path string) error {
-	err := node.restoreMetadata(path)
+	return node.RestoreMetadataWith(path, MetadataOptions{})
+}
+
+// RestoreMetadataWith restores the node metadata selected by opts.
+func (node Node) RestoreMetadataWith(path string, opts MetadataOptions) error {
+	err := node.restoreMetadata(path, opts)
 	if err != nil {
 		debug.Log("restoreMetadata(%s) error %v", path, err)
 	}
@@ -189,23 +216,25 @@ func (node Node) RestoreMetadata(path string) error {
 	return err
 }
 
-func (node Node) restoreMetadata(path string) error {
+func (node Node) restoreMetadata(path string, opts MetadataOptions) error {
 	var firsterr error
 
-	if err := lchown(path, int(node.UID), int(node.GID)); err != nil {
-		// Like "cp -a" and "rsync -a" do, we only report lchown permission errors
-		// if we run as root.
-		if os.Geteuid() > 0 && os.IsPermission(err) {
-			debug.Log("not running as root, ignoring lchown permission error for %v: %v",
-				path, err)
-		} else {
-			firsterr = errors.WithStack(err)
+	if !opts.SkipOwner {
+		if err := lchown(path, int(node.UID), int(node.GID)); err != nil {
+			// Like "cp -a" and "rsync -a" do, we only report lchown permission errors
+			// if we run as root.
+			if os.Geteuid() > 0 && os.IsPermission(err) {
+				debug.Log("not running as root, ignoring lchown permission error for %v: %v",
+					path, err)
+			} else {
+				firsterr = errors.WithStack(err)
+			}
 		}
 	}
 
 	if node.Type != "symlink" {
 		if err := fs.Chmod(path, node.Mode); err != nil {
-			if firsterr != nil {
+			if firsterr == nil {
 				firsterr = errors.WithStack(err)
 			}
 		}
@@ -213,14 +242,14 @@ func (node Node) restoreMetadata(path string) error {
 
 	if err := node.RestoreTimestamps(path); err != nil {
 		debug.Log("error restoring timestamps for dir %v: %v", path, err)
-		if firsterr != nil {
+		if firsterr == nil {
 			firsterr = err
 		}
 	}
 
-	if err := node.restoreExtendedAttributes(path); err != nil {
+	if err := node.restoreExtendedAttributes(path, opts.XattrError); err != nil {
 		debug.Log("error restoring extended attributes for %v: %v", path, err)
-		if firsterr != nil {
+		if firsterr == nil {
 			firsterr = err
 		}
 	}
@@ -228,14 +257,26 @@ func (node Node) restoreMetadata(path string) error {
 	return firsterr
 }
 
-func (node Node) restoreExtendedAttributes(path string) error {
+// restoreExtendedAttributes sets all extended attributes of node, even if some
+// of them fail. It returns the first error which was not ignored by
+// handleError.
+func (node Node) restoreExtendedAttributes(path string, handleError func(name string, err error) error) error {
+	var firsterr error
 	for _, attr := range node.ExtendedAttributes {
 		err := Setxattr(path, attr.Name, attr.Value)
-		if err != nil {
-			return err
+		if err == nil {
+			continue
+		}
+		if handleError != nil {
+			err = handleError(attr.Name, err)
+		} else if errors.Is(err, ErrXattrUnsupported) {
+			err = nil
+		}
+		if err != nil && firsterr == nil {
+			firsterr = err
 		}
 	}
-	return nil
+	return firsterr
 }
 
 func (node Node) RestoreTimestamps(path string) error {
@@ -454,6 +495,12 @@ func (node Node) Equals(other Node) bool {
 	if node.Error != other.Error {
 		return false
 	}
+	if node.ModifiedDuringBackup != other.ModifiedDuringBackup {
+		return false
+	}
+	if node.DeviceType != other.DeviceType {
+		return false
+	}
 
 	return true
 }
@@ -587,6 +634,11 @@ func lookupGroup(gid uint32) string {
 }
 
 func (node *Node) fillExtra(path string, fi os.FileInfo) error {
+	if meta, ok := fs.MetadataOf(fi); ok {
+		node.fillMetadata(meta)
+		return nil
+	}
+
 	stat, ok := toStatT(fi.Sys())
 	if !ok {
 		// fill minimal info with current values for uid, gid
@@ -630,6 +682,41 @@ func (node *Node) fillExtra(path string, fi os.FileInfo) error {
 	return node.fillExtendedAttributes(path)
 }
 
+// fillMetadata fills the node from the metadata reported by a file system
+// which is not the local file system.
+func (node *Node) fillMetadata(meta *fs.Metadata) {
+	node.Inode = meta.Inode
+	node.DeviceID = meta.DeviceID
+	node.UID, node.GID = meta.UID, meta.GID
+	node.User, node.Group = meta.User, meta.Group
+	node.AccessTime, node.ChangeTime = meta.AccessTime, meta.ChangeTime
+	if node.AccessTime.IsZero() {
+		node.AccessTime = node.ModTime
+	}
+	if node.ChangeTime.IsZero() {
+		node.ChangeTime = node.ModTime
+	}
+
+	switch node.Type {
+	case "file", "symlink", "dev", "chardev":
+		node.Links = meta.Links
+	}
+
+	switch node.Type {
+	case "symlink":
+		node.LinkTarget = meta.LinkTarget
+	case "dev", "chardev":
+		node.Device = meta.Device
+	}
+
+	for _, attr := range meta.ExtendedAttributes {
+		node.ExtendedAttributes = append(node.ExtendedAttributes, ExtendedAttribute{
+			Name:  attr.Name,
+			Value: attr.Value,
+		})
+	}
+}
+
 func (node *Node) fillExtendedAttributes(path string) error {
 	xattrs, err := Listxattr(path)
 	debug.Log("fillExtendedAttributes(%v) %v %v", path, xattrs, err)
@@ -287,6 +287,20 @@ func AssertFsTimeEqual(t *testing.T, label string, nodeType string, t1 time.Time
 	rtest.Assert(t, equal, "%s: %s doesn't match (%v != %v)", label, nodeType, t1, t2)
 }
 
+func TestNodeRestoreMetadataError(t *testing.T) {
+	tempdir := t.TempDir()
+
+	node := restic.Node{
+		Name:    "missing",
+		Type:    "file",
+		Mode:    0600,
+		ModTime: parseTime("2005-05-14 21:07:03.111"),
+	}
+	// the error of the first failing step must be returned
+	err := node.RestoreMetadataWith(filepath.Join(tempdir, node.Name), restic.MetadataOptions{SkipOwner: true})
+	rtest.Assert(t, err != nil, "missing error for restoring the metadata of a nonexistent file")
+}
+
 func parseTimeNano(t testing.TB, s string) time.Time {
 	// 2006-01-02T15:04:05.999999999Z07:00
 	ts, err := time.Parse(time.RFC3339Nano, s)
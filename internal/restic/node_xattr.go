@@ -24,9 +24,15 @@ func Listxattr(path string) ([]string, error) {
 	return l, handleXattrErr(err)
 }
 
-// Setxattr associates name and data together as an attribute of path.
+// Setxattr associates name and data together as an attribute of path. If the
+// file system does not support extended attributes, the returned error wraps
+// ErrXattrUnsupported.
 func Setxattr(path, name string, data []byte) error {
-	return handleXattrErr(xattr.LSet(path, name, data))
+	err := xattr.LSet(path, name, data)
+	if e, ok := err.(*xattr.Error); ok && e.Err == syscall.ENOTSUP {
+		return errors.Wrapf(ErrXattrUnsupported, "setxattr %v %v", e.Path, e.Name)
+	}
+	return handleXattrErr(err)
 }
 
 func handleXattrErr(err error) error {
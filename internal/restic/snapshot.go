@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
 )
 
 // Snapshot is the state of a resource at one point in time.
@@ -27,6 +28,24 @@ type Snapshot struct {
 
 	ProgramVersion string `json:"program_version,omitempty"`
 
+	// Command is the command line whose standard output was saved by
+	// backup --stdin-from-command.
+	Command []string `json:"command,omitempty"`
+
+	// Metadata holds user-defined key/value pairs, see ValidateMetadata.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// ChangeDetection is the mode the archiver used to detect changed files.
+	ChangeDetection string `json:"change_detection,omitempty"`
+
+	// ExcludedXattrs lists the patterns of extended attributes which were
+	// not saved.
+	ExcludedXattrs []string `json:"excluded_xattrs,omitempty"`
+
+	// Tombstone is set if this is not a snapshot but a tombstone which marks
+	// other snapshots as removed.
+	Tombstone *Tombstone `json:"tombstone,omitempty"`
+
 	id *ID // plaintext ID, used during restore
 }
 
@@ -78,17 +97,38 @@ func SaveSnapshot(ctx context.Context, repo SaverUnpacked, sn *Snapshot) (ID, er
 // given function. It is guaranteed that the function is not run concurrently.
 // If the called function returns an error, this function is cancelled and
 // also returns this error.
-// If a snapshot ID is in excludeIDs, it will be ignored.
+// If a snapshot ID is in excludeIDs, it will be ignored. Tombstones and the
+// snapshots marked as removed by them are ignored, too. They are searched
+// before calling fn, such that the snapshot files of repositories which can
+// contain tombstones are loaded twice.
 func ForAllSnapshots(ctx context.Context, be Lister, loader LoaderUnpacked, excludeIDs IDSet, fn func(ID, *Snapshot, error) error) error {
+	var tombstones Tombstones
+	if canContainTombstones(loader) {
+		// only list the snapshot files once for both passes
+		var err error
+		be, err = MemorizeList(ctx, be, SnapshotFile)
+		if err != nil {
+			return err
+		}
+		tombstones, err = FindTombstones(ctx, be, loader)
+		if err != nil {
+			return err
+		}
+	}
+
 	var m sync.Mutex
 
 	// For most snapshots decoding is nearly for free, thus just assume were only limited by IO
 	return ParallelList(ctx, be, SnapshotFile, loader.Connections(), func(ctx context.Context, id ID, size int64) error {
-		if excludeIDs.Has(id) {
+		if excludeIDs.Has(id) || tombstones.IDs.Has(id) || tombstones.Marked.Has(id) {
 			return nil
 		}
 
 		sn, err := LoadSnapshot(ctx, loader, id)
+		if err == nil && sn.IsTombstone() {
+			// the tombstone could not be loaded while searching for tombstones
+			return nil
+		}
 		m.Lock()
 		defer m.Unlock()
 		return fn(id, sn, err)
@@ -211,6 +251,45 @@ func (sn *Snapshot) HasPaths(paths []string) bool {
 	return true
 }
 
+// HasMetadata returns true if the snapshot has all the given key/value pairs.
+func (sn *Snapshot) HasMetadata(metadata map[string]string) bool {
+	for key, value := range metadata {
+		if v, ok := sn.Metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Limits for the metadata of a snapshot, to keep snapshot files small.
+const (
+	MaxMetadataEntries     = 32
+	MaxMetadataKeyLength   = 128
+	MaxMetadataValueLength = 1024
+)
+
+// ValidateMetadata returns an error if metadata exceeds the limits or contains
+// empty keys.
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return errors.Errorf("too many metadata entries: %d, at most %d are allowed", len(metadata), MaxMetadataEntries)
+	}
+
+	for key, value := range metadata {
+		switch {
+		case key == "":
+			return errors.New("metadata key must not be empty")
+		case len(key) > MaxMetadataKeyLength:
+			return errors.Errorf("metadata key %q is longer than %d bytes", key, MaxMetadataKeyLength)
+		case len(value) > MaxMetadataValueLength:
+			return errors.Errorf("metadata value for key %q is longer than %d bytes", key, MaxMetadataValueLength)
+		}
+	}
+
+	return nil
+}
+
 // HasHostname returns true if either
 // - the snapshot hostname is in the list of the given hostnames, or
 // - the list of given hostnames is empty
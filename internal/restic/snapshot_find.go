@@ -20,16 +20,18 @@ type SnapshotFilter struct {
 	Hosts []string
 	Tags  TagLists
 	Paths []string
+	// Metadata contains key/value pairs which must all be present.
+	Metadata map[string]string
 	// Match snapshots from before this timestamp. Zero for no limit.
 	TimestampLimit time.Time
 }
 
 func (f *SnapshotFilter) empty() bool {
-	return len(f.Hosts)+len(f.Tags)+len(f.Paths) == 0
+	return len(f.Hosts)+len(f.Tags)+len(f.Paths)+len(f.Metadata) == 0
 }
 
 func (f *SnapshotFilter) matches(sn *Snapshot) bool {
-	return sn.HasHostname(f.Hosts) && sn.HasTagList(f.Tags) && sn.HasPaths(f.Paths)
+	return sn.HasHostname(f.Hosts) && sn.HasTagList(f.Tags) && sn.HasPaths(f.Paths) && sn.HasMetadata(f.Metadata)
 }
 
 // findLatest finds the latest snapshot with optional target/directory,
@@ -103,6 +105,9 @@ func FindSnapshot(ctx context.Context, be Lister, loader LoaderUnpacked, s strin
 		}
 	}
 	sn, err := LoadSnapshot(ctx, loader, id)
+	if err == nil && sn.IsTombstone() {
+		return nil, "", fmt.Errorf("%v: %w", id.Str(), ErrTombstone)
+	}
 	return sn, subfolder, err
 }
 
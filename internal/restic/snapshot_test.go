@@ -2,6 +2,8 @@ package restic_test
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,6 +29,45 @@ func TestTagList(t *testing.T) {
 	rtest.Assert(t, r, "Failed to match untagged snapshot")
 }
 
+func TestHasMetadata(t *testing.T) {
+	sn, _ := restic.NewSnapshot([]string{"/home/foobar"}, nil, "foo", time.Now())
+	sn.Metadata = map[string]string{"ticket": "42", "env": "prod"}
+
+	rtest.Assert(t, sn.HasMetadata(nil), "empty metadata filter must match")
+	rtest.Assert(t, sn.HasMetadata(map[string]string{"env": "prod"}), "expected match")
+	rtest.Assert(t, !sn.HasMetadata(map[string]string{"env": "dev"}), "unexpected match for different value")
+	rtest.Assert(t, !sn.HasMetadata(map[string]string{"owner": ""}), "unexpected match for missing key")
+}
+
+func TestValidateMetadata(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := 0; i <= restic.MaxMetadataEntries; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+
+	for _, test := range []struct {
+		metadata map[string]string
+		valid    bool
+	}{
+		{nil, true},
+		{map[string]string{"ticket": "42"}, true},
+		{map[string]string{"ticket": ""}, true},
+		{map[string]string{"": "42"}, false},
+		{map[string]string{strings.Repeat("k", restic.MaxMetadataKeyLength): "v"}, true},
+		{map[string]string{strings.Repeat("k", restic.MaxMetadataKeyLength+1): "v"}, false},
+		{map[string]string{"k": strings.Repeat("v", restic.MaxMetadataValueLength+1)}, false},
+		{tooMany, false},
+	} {
+		err := restic.ValidateMetadata(test.metadata)
+		if test.valid && err != nil {
+			t.Errorf("unexpected error for %v: %v", test.metadata, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("expected error for %v", test.metadata)
+		}
+	}
+}
+
 func TestLoadJSONUnpacked(t *testing.T) {
 	repository.TestAllVersions(t, testLoadJSONUnpacked)
 }
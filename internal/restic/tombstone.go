@@ -0,0 +1,99 @@
+package restic
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+// MinTombstoneRepoVersion is the first repository version which can contain
+// tombstones. Older restic versions do not know about tombstones, but refuse
+// to open repositories with this version.
+const MinTombstoneRepoVersion = 3
+
+// Tombstone marks snapshots as removed in repositories which do not allow
+// deleting files, for example a rest-server in append-only mode. Tombstones
+// are stored as snapshot files. Both the tombstone and the snapshots marked
+// by it are ignored by ForAllSnapshots until prune removes them, which must
+// be requested explicitly.
+type Tombstone struct {
+	Snapshots IDs `json:"snapshots"`
+}
+
+// NewTombstone returns a snapshot which marks the given snapshots as removed.
+func NewTombstone(snapshots IDs, hostname string, time time.Time) (*Snapshot, error) {
+	sn := &Snapshot{
+		Time:      time,
+		Hostname:  hostname,
+		Tombstone: &Tombstone{Snapshots: snapshots},
+	}
+
+	err := sn.fillUserInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	return sn, nil
+}
+
+// IsTombstone returns true if sn only marks other snapshots as removed.
+func (sn *Snapshot) IsTombstone() bool {
+	return sn.Tombstone != nil
+}
+
+// ErrTombstone is returned when a tombstone is loaded instead of a snapshot.
+var ErrTombstone = errors.New("snapshot is a tombstone")
+
+// Tombstones contains the tombstones of a repository.
+type Tombstones struct {
+	// IDs are the IDs of the tombstones.
+	IDs IDSet
+	// Marked are the IDs of the snapshots marked as removed. Snapshots which
+	// have already been deleted are not included.
+	Marked IDSet
+}
+
+// canContainTombstones returns false if loader is a repository whose version
+// does not support tombstones.
+func canContainTombstones(loader LoaderUnpacked) bool {
+	repo, ok := loader.(interface{ Config() Config })
+	return !ok || repo.Config().Version >= MinTombstoneRepoVersion
+}
+
+// FindTombstones loads all snapshot files and returns the tombstones found.
+// Snapshot files which cannot be loaded are ignored. If loader is a repository
+// whose version cannot contain tombstones, the snapshot files are not loaded.
+func FindTombstones(ctx context.Context, be Lister, loader LoaderUnpacked) (Tombstones, error) {
+	t := Tombstones{IDs: NewIDSet(), Marked: NewIDSet()}
+	if !canContainTombstones(loader) {
+		return t, nil
+	}
+
+	var m sync.Mutex
+	snapshots := NewIDSet()
+	var marked IDs
+	err := ParallelList(ctx, be, SnapshotFile, loader.Connections(), func(ctx context.Context, id ID, size int64) error {
+		sn, err := LoadSnapshot(ctx, loader, id)
+		m.Lock()
+		defer m.Unlock()
+		snapshots.Insert(id)
+		if err != nil || !sn.IsTombstone() {
+			return nil
+		}
+		t.IDs.Insert(id)
+		marked = append(marked, sn.Tombstone.Snapshots...)
+		return nil
+	})
+	if err != nil {
+		return Tombstones{}, err
+	}
+
+	for _, id := range marked {
+		if snapshots.Has(id) {
+			t.Marked.Insert(id)
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,65 @@
+package restic_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestTombstone(t *testing.T) {
+	repo := repository.TestRepositoryWithVersion(t, restic.MinTombstoneRepoVersion)
+	ctx := context.TODO()
+
+	sn1 := restic.TestCreateSnapshot(t, repo, time.Unix(1000, 0), 1)
+	sn2 := restic.TestCreateSnapshot(t, repo, time.Unix(2000, 0), 1)
+
+	tombstone, err := restic.NewTombstone(restic.IDs{*sn1.ID(), restic.NewRandomID()}, "foo", time.Now())
+	rtest.OK(t, err)
+	id, err := restic.SaveSnapshot(ctx, repo, tombstone)
+	rtest.OK(t, err)
+
+	tombstones, err := restic.FindTombstones(ctx, repo, repo)
+	rtest.OK(t, err)
+	rtest.Equals(t, restic.NewIDSet(id), tombstones.IDs)
+	// snapshots which no longer exist are not included
+	rtest.Equals(t, restic.NewIDSet(*sn1.ID()), tombstones.Marked)
+
+	snapshots, err := restic.TestLoadAllSnapshots(ctx, repo, nil)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, len(snapshots))
+	rtest.Equals(t, *sn2.ID(), *snapshots[0].ID())
+
+	// excluding the tombstone does not bring back the marked snapshot
+	snapshots, err = restic.TestLoadAllSnapshots(ctx, repo, restic.NewIDSet(id))
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, len(snapshots))
+	rtest.Equals(t, *sn2.ID(), *snapshots[0].ID())
+
+	_, _, err = restic.FindSnapshot(ctx, repo, repo, id.String())
+	rtest.Assert(t, errors.Is(err, restic.ErrTombstone), "unexpected error %v", err)
+}
+
+func TestTombstoneRepoVersion(t *testing.T) {
+	repo := repository.TestRepositoryWithVersion(t, restic.MinTombstoneRepoVersion-1)
+	ctx := context.TODO()
+
+	sn := restic.TestCreateSnapshot(t, repo, time.Unix(1000, 0), 1)
+	tombstone, err := restic.NewTombstone(restic.IDs{*sn.ID()}, "foo", time.Now())
+	rtest.OK(t, err)
+	_, err = restic.SaveSnapshot(ctx, repo, tombstone)
+	rtest.OK(t, err)
+
+	// older repository versions cannot contain tombstones
+	tombstones, err := restic.FindTombstones(ctx, repo, repo)
+	rtest.OK(t, err)
+	rtest.Equals(t, 0, len(tombstones.IDs))
+	snapshots, err := restic.TestLoadAllSnapshots(ctx, repo, nil)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, len(snapshots))
+	rtest.Equals(t, *sn.ID(), *snapshots[0].ID())
+}
@@ -0,0 +1,273 @@
+package restorer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/restic"
+)
+
+// Destination is the file system a snapshot is restored to. Paths use the
+// separator of the local platform, see filepath.
+type Destination interface {
+	// Abs returns an absolute representation of path.
+	Abs(path string) (string, error)
+	Lstat(name string) (os.FileInfo, error)
+	Readlink(name string) (string, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	// MkdirAll creates a directory and all missing parents.
+	MkdirAll(name string, perm os.FileMode) error
+	// OpenFile opens a regular file, the flags are those of os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (fs.WritableFile, error)
+	Remove(name string) error
+	// RemoveAll removes name and its children. A missing name is not an
+	// error.
+	RemoveAll(name string) error
+	// Link creates newname as a hardlink to oldname.
+	Link(oldname, newname string) error
+	// CreateNode creates the symlink or special file described by node.
+	CreateNode(node *restic.Node, name string) error
+	// RestoreMetadata restores the metadata of node selected by opts to
+	// name.
+	RestoreMetadata(node *restic.Node, name string, opts restic.MetadataOptions) error
+
+	// Capabilities returns the metadata supported by the destination.
+	Capabilities() fs.Capabilities
+}
+
+// errOwnerDenied and errSpecialUnsupported are returned by a Destination if
+// the owner of an item cannot be changed or a special file cannot be
+// created. The restorer turns them into warnings.
+var (
+	errOwnerDenied        = errors.New("changing the owner is not permitted")
+	errSpecialUnsupported = errors.New("special files are not supported")
+)
+
+// LocalDestination restores to the local file system.
+type LocalDestination struct{}
+
+// statically ensure that LocalDestination implements Destination.
+var _ Destination = LocalDestination{}
+
+// Abs returns an absolute representation of path.
+func (LocalDestination) Abs(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	return filepath.Abs(path)
+}
+
+func (LocalDestination) Lstat(name string) (os.FileInfo, error) {
+	return fs.Lstat(name)
+}
+
+func (LocalDestination) Readlink(name string) (string, error) {
+	return fs.Readlink(name)
+}
+
+// ReadDir returns the entries of the directory name.
+func (LocalDestination) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// removed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+func (LocalDestination) MkdirAll(name string, perm os.FileMode) error {
+	return fs.MkdirAll(name, perm)
+}
+
+func (LocalDestination) OpenFile(name string, flag int, perm os.FileMode) (fs.WritableFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// do not return a typed nil
+		return nil, err
+	}
+	return f, nil
+}
+
+func (LocalDestination) Remove(name string) error {
+	return fs.Remove(name)
+}
+
+func (LocalDestination) RemoveAll(name string) error {
+	return fs.RemoveAll(name)
+}
+
+func (LocalDestination) Link(oldname, newname string) error {
+	return fs.Link(oldname, newname)
+}
+
+// CreateNode creates the symlink or special file described by node.
+func (LocalDestination) CreateNode(node *restic.Node, name string) error {
+	// the repository is only needed to restore the contents of files
+	return node.CreateAt(context.TODO(), name, nil)
+}
+
+// RestoreMetadata restores the metadata of node, including the metadata
+// specific to the local platform.
+func (LocalDestination) RestoreMetadata(node *restic.Node, name string, opts restic.MetadataOptions) error {
+	return node.RestoreMetadataWith(name, opts)
+}
+
+// Capabilities returns the capabilities of the local file system.
+func (LocalDestination) Capabilities() fs.Capabilities {
+	return fs.CapabilitiesOf(fs.Local{})
+}
+
+// RemoteFS is a file system on another host which snapshots can be restored
+// to, e.g. sftpfs.FS. Paths always use forward slashes. Only the metadata
+// common to all platforms is restored to it.
+type RemoteFS interface {
+	Abs(path string) (string, error)
+	Lstat(name string) (os.FileInfo, error)
+	Readlink(name string) (string, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	MkdirAll(name string, perm os.FileMode) error
+	OpenWritable(name string, flag int, perm os.FileMode) (fs.WritableFile, error)
+	Remove(name string) error
+	RemoveAll(name string) error
+	Symlink(oldname, newname string) error
+	Link(oldname, newname string) error
+
+	// Chmod, Chown and Chtimes follow symbolic links.
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Chtimes(name string, atime, mtime time.Time) error
+
+	Capabilities() fs.Capabilities
+}
+
+// NewRemoteDestination returns a Destination which restores to remote.
+// Extended attributes are not supported and special files cannot be created.
+// The owner is only changed if the remote user is permitted to do so. As the
+// metadata of symbolic links cannot be changed, only the links are created.
+func NewRemoteDestination(remote RemoteFS) Destination {
+	return remoteDestination{remote: remote}
+}
+
+type remoteDestination struct {
+	remote RemoteFS
+}
+
+// Abs returns an absolute representation of path on the remote host. The
+// result uses the separator of the local platform like all paths passed to
+// the destination.
+func (d remoteDestination) Abs(path string) (string, error) {
+	abs, err := d.remote.Abs(filepath.ToSlash(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(abs), nil
+}
+
+func (d remoteDestination) Lstat(name string) (os.FileInfo, error) {
+	return d.remote.Lstat(filepath.ToSlash(name))
+}
+
+func (d remoteDestination) Readlink(name string) (string, error) {
+	return d.remote.Readlink(filepath.ToSlash(name))
+}
+
+func (d remoteDestination) ReadDir(name string) ([]os.FileInfo, error) {
+	return d.remote.ReadDir(filepath.ToSlash(name))
+}
+
+func (d remoteDestination) MkdirAll(name string, perm os.FileMode) error {
+	return d.remote.MkdirAll(filepath.ToSlash(name), perm)
+}
+
+func (d remoteDestination) OpenFile(name string, flag int, perm os.FileMode) (fs.WritableFile, error) {
+	return d.remote.OpenWritable(filepath.ToSlash(name), flag, perm)
+}
+
+func (d remoteDestination) Remove(name string) error {
+	return d.remote.Remove(filepath.ToSlash(name))
+}
+
+func (d remoteDestination) RemoveAll(name string) error {
+	return d.remote.RemoveAll(filepath.ToSlash(name))
+}
+
+func (d remoteDestination) Link(oldname, newname string) error {
+	return d.remote.Link(filepath.ToSlash(oldname), filepath.ToSlash(newname))
+}
+
+// CreateNode creates symbolic links, other special files are not supported.
+func (d remoteDestination) CreateNode(node *restic.Node, name string) error {
+	if node.Type != "symlink" {
+		return errSpecialUnsupported
+	}
+	return d.remote.Symlink(node.LinkTarget, filepath.ToSlash(name))
+}
+
+// RestoreMetadata restores the owner, mode and timestamps of node. Extended
+// attributes are passed to opts.XattrError as unsupported. If the owner
+// cannot be changed due to missing permissions, errOwnerDenied is returned
+// unless another error occurred.
+func (d remoteDestination) RestoreMetadata(node *restic.Node, name string, opts restic.MetadataOptions) error {
+	name = filepath.ToSlash(name)
+	var firsterr, ownerErr error
+
+	// the remote host provides no way to change symbolic links themselves
+	if node.Type != "symlink" {
+		if !opts.SkipOwner {
+			if err := d.remote.Chown(name, int(node.UID), int(node.GID)); err != nil {
+				if errors.Is(err, os.ErrPermission) {
+					debug.Log("ignoring chown permission error for %v: %v", name, err)
+					ownerErr = errOwnerDenied
+				} else {
+					firsterr = err
+				}
+			}
+		}
+
+		if err := d.remote.Chmod(name, node.Mode); err != nil && firsterr == nil {
+			firsterr = err
+		}
+
+		if err := d.remote.Chtimes(name, node.AccessTime, node.ModTime); err != nil && firsterr == nil {
+			firsterr = err
+		}
+	}
+
+	for _, attr := range node.ExtendedAttributes {
+		if opts.XattrError == nil {
+			break
+		}
+		if err := opts.XattrError(attr.Name, restic.ErrXattrUnsupported); err != nil && firsterr == nil {
+			firsterr = err
+		}
+	}
+
+	if firsterr != nil {
+		return firsterr
+	}
+	return ownerErr
+}
+
+// Capabilities returns the capabilities of the remote file system.
+func (d remoteDestination) Capabilities() fs.Capabilities {
+	return d.remote.Capabilities()
+}
@@ -14,7 +14,11 @@
 //	  write pack blobs to the files that need them  [3]
 //
 // Retrieval of repository packs (step [2]) and writing target files (step [3])
-// are performed concurrently on multiple goroutines.
+// are performed concurrently on multiple goroutines. The download goroutines
+// pass each blob to a separate pool of write goroutines, the amount of blob
+// data waiting to be written is limited. Directories, special files and
+// metadata are also restored by a pool of goroutines, the metadata of a
+// directory is restored once all of its children have been restored.
 //
 // Implementation does not guarantee order in which blobs are written to the
 // target files and, for example, the last blob of a file can be written to the
@@ -0,0 +1,251 @@
+package restorer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+)
+
+// PlanAction is the kind of a step which RestoreTo would perform.
+type PlanAction string
+
+const (
+	// PlanCreateDir creates a directory.
+	PlanCreateDir PlanAction = "create_dir"
+	// PlanWriteFile writes the contents of a regular file.
+	PlanWriteFile PlanAction = "write_file"
+	// PlanCreate creates an empty file, a symlink or a special file.
+	PlanCreate PlanAction = "create"
+	// PlanLink creates a hardlink to another restored file.
+	PlanLink PlanAction = "link"
+	// PlanSkip keeps an existing item due to the overwrite behavior.
+	PlanSkip PlanAction = "skip_existing"
+	// PlanDelete removes an item which is not contained in the snapshot.
+	PlanDelete PlanAction = "delete"
+	// PlanMetadata sets the mode, owner and other metadata of an item.
+	PlanMetadata PlanAction = "set_metadata"
+)
+
+// PlannedStep is a single step of a restore determined by DryRun.
+type PlannedStep struct {
+	Action   PlanAction
+	Location string
+
+	// Size is the number of bytes written by PlanWriteFile.
+	Size uint64
+	// Replace is set if an existing item is replaced, Patch if only the
+	// changed parts of an existing file are written.
+	Replace bool
+	Patch   bool
+	// LinkTarget is the location of the file a PlanLink refers to.
+	LinkTarget string
+
+	// Mode, UID and GID are set by PlanMetadata. The owner is only changed
+	// if SetOwner is true.
+	Mode     os.FileMode
+	UID, GID uint32
+	SetOwner bool
+}
+
+// Plan summarizes the steps determined by DryRun.
+type Plan struct {
+	Dirs    uint64
+	Files   uint64
+	Skipped uint64
+	Deleted uint64
+	// BytesToDownload is the size of the deduplicated blobs loaded from the
+	// repository, BytesToWrite the size of the written file contents. Both
+	// are upper bounds for patched files.
+	BytesToDownload uint64
+	BytesToWrite    uint64
+}
+
+// DryRun determines the steps RestoreTo would perform to restore the snapshot
+// to dst and passes them to step, without modifying dst. Only the trees of the
+// snapshot are loaded from the repository. Conflicts which would cause errors
+// during the restore are passed to res.Error.
+func (res *Restorer) DryRun(ctx context.Context, dst string, step func(PlannedStep)) (Plan, error) {
+	dst, err := res.prepare(dst)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	var plan Plan
+	idx := NewHardlinkIndex[string]()
+	links := newPartialLinks()
+	blobs := restic.NewIDSet()
+	res.owners = newOwnerMapper(res.Ownership, &res.stats.OwnersUnmapped)
+
+	// absent are the targets which would be deleted, they and their
+	// children are treated as missing
+	absent := make(map[string]struct{})
+	lstat := func(target string) (os.FileInfo, bool) {
+		if _, ok := absent[target]; ok {
+			return nil, false
+		}
+		if _, ok := absent[filepath.Dir(target)]; ok {
+			absent[target] = struct{}{}
+			return nil, false
+		}
+		fi, err := res.Destination.Lstat(target)
+		return fi, err == nil
+	}
+
+	// conflicts are the directories which cannot be created, as another
+	// type of file exists at their target
+	conflicts := make(map[string]struct{})
+
+	// dirs are the directories which exist or would be created
+	dirs := make(map[string]struct{})
+	var mkdirAll func(target, location string)
+	mkdirAll = func(target, location string) {
+		if _, ok := dirs[target]; ok {
+			return
+		}
+		dirs[target] = struct{}{}
+		if target != dst {
+			mkdirAll(filepath.Dir(target), filepath.Dir(location))
+		}
+		if _, exists := lstat(target); !exists {
+			plan.Dirs++
+			step(PlannedStep{Action: PlanCreateDir, Location: location})
+		}
+	}
+
+	setMetadata := func(node *restic.Node, location string) {
+		mapped := res.owners.mapNode(node)
+		step(PlannedStep{
+			Action:   PlanMetadata,
+			Location: location,
+			Mode:     node.Mode,
+			UID:      mapped.UID,
+			GID:      mapped.GID,
+			SetOwner: res.Ownership.Policy != OwnershipSkip,
+		})
+	}
+
+	var enterTree func(tree *restic.Tree, target, location string) error
+	if res.Delete {
+		enterTree = func(tree *restic.Tree, target, location string) error {
+			if _, exists := lstat(target); !exists {
+				return nil
+			}
+			entries, err := res.extraneousEntries(tree, target)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				absent[filepath.Join(target, entry.Name())] = struct{}{}
+				plan.Deleted++
+				step(PlannedStep{Action: PlanDelete, Location: filepath.Join(location, entry.Name())})
+			}
+			return nil
+		}
+	}
+
+	_, err = res.traverseTree(ctx, dst, string(filepath.Separator), *res.sn.Tree, treeVisitor{
+		enterTree: enterTree,
+		enterDir: func(node *restic.Node, target, location string) error {
+			if fi, exists := lstat(target); exists && !fi.IsDir() {
+				conflicts[target] = struct{}{}
+				return errors.Errorf("%v exists and is not a directory", target)
+			}
+			mkdirAll(target, location)
+			return nil
+		},
+
+		visitNode: func(node *restic.Node, target, location string) error {
+			debug.Log("dry run, visitNode %q", location)
+			links.add(node, true)
+			mkdirAll(filepath.Dir(target), filepath.Dir(location))
+
+			device := node.Type == "file" && node.DeviceType != "" && res.isDevice(target)
+			if device && !res.WriteToDevices {
+				return errors.Errorf("%v is a device, refusing to overwrite it", target)
+			}
+
+			hardlink := node.Type == "file" && node.Links > 1 && idx.Has(node.Inode, node.DeviceID)
+			replace := false
+			if fi, exists := lstat(target); exists && !device {
+				kept := res.keepExisting(node, target, fi)
+				if !kept && hardlink && res.Overwrite != OverwriteAlways {
+					kept = res.isSameFile(filepath.Join(dst, idx.Value(node.Inode, node.DeviceID)), target)
+				}
+				if kept {
+					if node.Type == "file" && node.Links > 1 && !hardlink {
+						// the other links to the file refer to the kept file
+						idx.Add(node.Inode, node.DeviceID, location)
+					}
+					plan.Skipped++
+					step(PlannedStep{Action: PlanSkip, Location: location})
+					return nil
+				}
+				if fi.IsDir() {
+					return errors.Errorf("%v is a directory, refusing to replace it", target)
+				}
+				replace = true
+			}
+
+			plan.Files++
+			switch {
+			case hardlink:
+				step(PlannedStep{Action: PlanLink, Location: location, Replace: replace,
+					LinkTarget: idx.Value(node.Inode, node.DeviceID)})
+			case node.Type == "file" && node.Size > 0:
+				if err := res.addBlobs(node, blobs, &plan); err != nil {
+					return err
+				}
+				plan.BytesToWrite += node.Size
+				step(PlannedStep{Action: PlanWriteFile, Location: location, Size: node.Size,
+					Replace: replace, Patch: replace && res.DeltaContent})
+			default:
+				step(PlannedStep{Action: PlanCreate, Location: location, Replace: replace})
+			}
+			if node.Type == "file" && node.Links > 1 && !hardlink {
+				idx.Add(node.Inode, node.DeviceID, location)
+			}
+
+			// links share the metadata of their target
+			if !device && !hardlink {
+				setMetadata(node, location)
+			}
+			return nil
+		},
+		leaveDir: func(node *restic.Node, target, location string) error {
+			if _, ok := conflicts[target]; ok {
+				return nil
+			}
+			mkdirAll(target, location)
+			setMetadata(node, location)
+			return nil
+		},
+		visitExcluded: func(node *restic.Node, _ string) {
+			links.add(node, false)
+		},
+	})
+	if err == nil {
+		res.warnPartialLinks(links)
+	}
+	return plan, err
+}
+
+// addBlobs adds the size of the blobs of node which are not contained in
+// blobs yet to plan.BytesToDownload.
+func (res *Restorer) addBlobs(node *restic.Node, blobs restic.IDSet, plan *Plan) error {
+	for _, id := range node.Content {
+		if blobs.Has(id) {
+			continue
+		}
+		pbs := res.repo.Index().Lookup(restic.BlobHandle{ID: id, Type: restic.DataBlob})
+		if len(pbs) == 0 {
+			return errors.Errorf("data blob %v not found in the repository index", id.Str())
+		}
+		blobs.Insert(id)
+		plan.BytesToDownload += uint64(pbs[0].Length)
+	}
+	return nil
+}
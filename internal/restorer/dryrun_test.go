@@ -0,0 +1,149 @@
+package restorer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestRestorerDryRun(t *testing.T) {
+	timeForTest := time.Date(2019, time.January, 9, 1, 46, 40, 0, time.UTC)
+
+	repo := repository.TestRepository(t)
+	sn, _ := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"unchanged": File{Data: "unchanged content", ModTime: timeForTest},
+			"modified":  File{Data: "modified content", ModTime: timeForTest},
+			"new":       File{Data: "modified content", ModTime: timeForTest},
+			"empty":     File{ModTime: timeForTest},
+			"link":      Symlink{Target: "unchanged", ModTime: timeForTest},
+			"dir": Dir{
+				Nodes: map[string]Node{
+					"file": File{Data: "file in dir", ModTime: timeForTest},
+				},
+				ModTime: timeForTest,
+			},
+			"subdir": Dir{
+				Nodes: map[string]Node{
+					"file1": File{Data: "hardlinked", Links: 2, Inode: 7, ModTime: timeForTest},
+					"file2": File{Data: "hardlinked", Links: 2, Inode: 7, ModTime: timeForTest},
+				},
+				ModTime: timeForTest,
+			},
+		},
+	})
+
+	tempdir := rtest.TempDir(t)
+	rtest.OK(t, NewRestorer(repo, sn, false, nil).RestoreTo(context.TODO(), tempdir))
+	rtest.OK(t, os.WriteFile(filepath.Join(tempdir, "modified"), []byte("MODIFIED content"), 0644))
+	rtest.OK(t, os.Remove(filepath.Join(tempdir, "new")))
+	rtest.OK(t, os.RemoveAll(filepath.Join(tempdir, "subdir")))
+	rtest.OK(t, os.WriteFile(filepath.Join(tempdir, "dir", "extra"), []byte("extra"), 0644))
+
+	// a dry run must not load any file contents
+	ctx := context.TODO()
+	dataPacks := restic.NewIDSet()
+	repo.Index().Each(ctx, func(pb restic.PackedBlob) {
+		if pb.Type == restic.DataBlob {
+			dataPacks.Insert(pb.PackID)
+		}
+	})
+	for id := range dataPacks {
+		rtest.OK(t, repo.Backend().Remove(ctx, backend.Handle{Type: restic.PackFile, Name: id.String()}))
+	}
+
+	res := NewRestorer(repo, sn, false, nil)
+	res.Overwrite = OverwriteIfChanged
+	res.Delete = true
+	var steps []PlannedStep
+	plan, err := res.DryRun(ctx, tempdir, func(step PlannedStep) {
+		if step.Action == PlanMetadata {
+			rtest.Equals(t, uint32(os.Getuid()), step.UID)
+			return
+		}
+		steps = append(steps, step)
+	})
+	rtest.OK(t, err)
+
+	rtest.Equals(t, []PlannedStep{
+		{Action: PlanDelete, Location: "/dir/extra"},
+		{Action: PlanSkip, Location: "/dir/file"},
+		{Action: PlanSkip, Location: "/empty"},
+		{Action: PlanSkip, Location: "/link"},
+		{Action: PlanWriteFile, Location: "/modified", Size: 16, Replace: true},
+		{Action: PlanWriteFile, Location: "/new", Size: 16},
+		{Action: PlanCreateDir, Location: "/subdir"},
+		{Action: PlanWriteFile, Location: "/subdir/file1", Size: 10},
+		{Action: PlanLink, Location: "/subdir/file2", LinkTarget: "/subdir/file1"},
+		{Action: PlanSkip, Location: "/unchanged"},
+	}, steps)
+
+	// the contents of modified and new are only downloaded once
+	var download uint64
+	hasher := repo.Config().BlobHasher()
+	for _, data := range []string{"modified content", "hardlinked"} {
+		pbs := repo.Index().Lookup(restic.BlobHandle{ID: hasher.Hash([]byte(data)), Type: restic.DataBlob})
+		rtest.Assert(t, len(pbs) > 0, "blob for %q not found", data)
+		download += uint64(pbs[0].Length)
+	}
+	rtest.Equals(t, Plan{
+		Dirs:            1,
+		Files:           4,
+		Skipped:         4,
+		Deleted:         1,
+		BytesToDownload: download,
+		BytesToWrite:    16 + 16 + 10,
+	}, plan)
+
+	data, err := os.ReadFile(filepath.Join(tempdir, "modified"))
+	rtest.OK(t, err)
+	rtest.Equals(t, "MODIFIED content", string(data))
+	_, err = os.Lstat(filepath.Join(tempdir, "dir", "extra"))
+	rtest.OK(t, err)
+	_, err = os.Lstat(filepath.Join(tempdir, "subdir"))
+	rtest.Assert(t, os.IsNotExist(err), "subdir was created: %v", err)
+}
+
+func TestRestorerDryRunConflicts(t *testing.T) {
+	repo := repository.TestRepository(t)
+	sn, _ := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"dir": Dir{
+				Nodes: map[string]Node{
+					"file": File{Data: "content"},
+				},
+			},
+			"file": File{Data: "content"},
+		},
+	})
+
+	tempdir := rtest.TempDir(t)
+	rtest.OK(t, os.WriteFile(filepath.Join(tempdir, "dir"), []byte("not a dir"), 0644))
+	rtest.OK(t, os.Mkdir(filepath.Join(tempdir, "file"), 0755))
+
+	res := NewRestorer(repo, sn, false, nil)
+	var conflicts []string
+	res.Error = func(location string, err error) error {
+		conflicts = append(conflicts, location)
+		return nil
+	}
+	_, err := res.DryRun(context.TODO(), tempdir, func(PlannedStep) {})
+	rtest.OK(t, err)
+	rtest.Equals(t, []string{"/dir", "/file"}, conflicts)
+
+	// the conflicts are resolved by deleting the existing items
+	res.Delete = true
+	conflicts = nil
+	plan, err := res.DryRun(context.TODO(), tempdir, func(PlannedStep) {})
+	rtest.OK(t, err)
+	rtest.Equals(t, []string(nil), conflicts)
+	rtest.Equals(t, uint64(2), plan.Deleted)
+	rtest.Equals(t, uint64(1), plan.Dirs)
+}
@@ -2,11 +2,16 @@ package restorer
 
 import (
 	"context"
+	"io"
+	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 
+	"github.com/restic/restic/internal/backend/prefetch"
 	"github.com/restic/restic/internal/crypto"
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
@@ -16,12 +21,13 @@ import (
 )
 
 // TODO if a blob is corrupt, there may be good blob copies in other packs
-// TODO evaluate if it makes sense to split download and processing workers
-//      pro: can (slowly) read network and decrypt/write files concurrently
-//      con: each worker needs to keep one pack in memory
 
 const (
 	largeFileBlobCount = 25
+
+	// maxInFlightBlobData limits the amount of blob data which has been
+	// downloaded but not yet written to all files using it.
+	maxInFlightBlobData = 64 * 1024 * 1024
 )
 
 // information about regular file being restored
@@ -29,11 +35,28 @@ type fileInfo struct {
 	lock       sync.Mutex
 	inProgress bool
 	sparse     bool
+	device     bool               // existing devices are never written sparsely
+	existing   bool               // the file replaces an existing file
+	patch      bool               // only write the blobs which differ from the existing file
+	unchanged  map[int64]struct{} // offsets of blobs which match the existing file
 	size       int64
+	remaining  int64       // bytes which remain to be written
 	location   string      // file on local filesystem relative to restorer basedir
 	blobs      interface{} // blobs of the file
 }
 
+// action returns how the file is reported once it is restored.
+func (f *fileInfo) action() restore.ItemAction {
+	switch {
+	case f.patch:
+		return restore.ActionPatched
+	case f.existing:
+		return restore.ActionReplaced
+	default:
+		return restore.ActionRestored
+	}
+}
+
 type fileBlobInfo struct {
 	id     restic.ID // the blob id
 	offset int64     // blob offset in the file
@@ -43,23 +66,42 @@ type fileBlobInfo struct {
 type packInfo struct {
 	id    restic.ID              // the pack id
 	files map[*fileInfo]struct{} // set of files that use blobs from this pack
+	blobs *packBlobs             // blobs to load, calculated on demand
+}
+
+// blobs of a pack and where they are written to
+type packBlobs struct {
+	list  []restic.Blob
+	files map[restic.ID]map[*fileInfo][]int64 // blob -> file -> offsets (plural!) of the blob in the file
 }
 
 // fileRestorer restores set of files
 type fileRestorer struct {
 	key        *crypto.Key
+	hasher     restic.BlobHasher
 	idx        func(restic.BlobHandle) []restic.PackedBlob
 	packLoader repository.BackendLoadFn
 
-	workerCount int
-	filesWriter *filesWriter
-	zeroChunk   restic.ID
-	sparse      bool
-	progress    *restore.Progress
-
-	dst   string
-	files []*fileInfo
-	Error func(string, error) error
+	workerCount  int
+	writeWorkers int
+	maxInFlight  int64
+	filesWriter  *filesWriter
+	zeroChunk    restic.ID
+	sparse       bool
+	progress     *restore.Progress
+	prefetch     prefetch.Options
+
+	// stats, if set, collects the number of patched files and written bytes
+	stats *Stats
+
+	dst          string
+	dest         Destination
+	files        []*fileInfo
+	Error        func(string, error) error
+	PreparePacks func(context.Context, restic.IDs) error
+	// completed, if set, is called with the location of each file whose
+	// contents have been written completely
+	completed func(location string) error
 }
 
 func newFileRestorer(dst string,
@@ -74,21 +116,26 @@ func newFileRestorer(dst string,
 	workerCount := int(connections)
 
 	return &fileRestorer{
-		key:         key,
-		idx:         idx,
-		packLoader:  packLoader,
-		filesWriter: newFilesWriter(workerCount),
-		zeroChunk:   repository.ZeroChunk(),
-		sparse:      sparse,
-		progress:    progress,
-		workerCount: workerCount,
-		dst:         dst,
-		Error:       restorerAbortOnAllErrors,
+		key:          key,
+		idx:          idx,
+		packLoader:   packLoader,
+		filesWriter:  newFilesWriter(workerCount),
+		zeroChunk:    repository.ZeroChunk(),
+		sparse:       sparse,
+		progress:     progress,
+		workerCount:  workerCount,
+		writeWorkers: workerCount,
+		maxInFlight:  maxInFlightBlobData,
+		dst:          dst,
+		dest:         LocalDestination{},
+		Error:        restorerAbortOnAllErrors,
 	}
 }
 
-func (r *fileRestorer) addFile(location string, content restic.IDs, size int64) {
-	r.files = append(r.files, &fileInfo{location: location, blobs: content, size: size})
+func (r *fileRestorer) addFile(location string, content restic.IDs, size int64, device bool) *fileInfo {
+	file := &fileInfo{location: location, blobs: content, size: size, device: device}
+	r.files = append(r.files, file)
+	return file
 }
 
 func (r *fileRestorer) targetPath(location string) string {
@@ -119,6 +166,11 @@ func (r *fileRestorer) restoreFiles(ctx context.Context) error {
 	// approximation to shorten restore times by up to 19% in some test.
 	var packOrder restic.IDs
 
+	err := r.compareExistingFiles(ctx)
+	if err != nil {
+		return err
+	}
+
 	// create packInfo from fileInfo
 	for _, file := range r.files {
 		fileBlobs := file.blobs.(restic.IDs)
@@ -127,11 +179,19 @@ func (r *fileRestorer) restoreFiles(ctx context.Context) error {
 		if largeFile {
 			packsMap = make(map[restic.ID][]fileBlobInfo)
 		}
+		// sparse files are not preallocated, thus holes remain unallocated
+		file.sparse = r.sparse && !file.device && !file.patch
 		fileOffset := int64(0)
+		skipped := int64(0)
 		err := r.forEachBlob(fileBlobs, func(packID restic.ID, blob restic.Blob) {
-			if largeFile {
+			skip := r.skipBlob(file, blob.ID, fileOffset)
+			if largeFile && !skip {
 				packsMap[packID] = append(packsMap[packID], fileBlobInfo{id: blob.ID, offset: fileOffset})
-				fileOffset += int64(blob.DataLength())
+			}
+			fileOffset += int64(blob.DataLength())
+			if skip {
+				skipped += int64(blob.DataLength())
+				return
 			}
 			pack, ok := packs[packID]
 			if !ok {
@@ -143,15 +203,7 @@ func (r *fileRestorer) restoreFiles(ctx context.Context) error {
 				packOrder = append(packOrder, packID)
 			}
 			pack.files[file] = struct{}{}
-			if blob.ID.Equal(r.zeroChunk) {
-				file.sparse = r.sparse
-			}
 		})
-		if len(fileBlobs) == 1 {
-			// no need to preallocate files with a single block, thus we can always consider them to be sparse
-			// in addition, a short chunk will never match r.zeroChunk which would prevent sparseness for short files
-			file.sparse = r.sparse
-		}
 
 		if err != nil {
 			// repository index is messed up, can't do anything
@@ -160,26 +212,96 @@ func (r *fileRestorer) restoreFiles(ctx context.Context) error {
 		if largeFile {
 			file.blobs = packsMap
 		}
+
+		file.remaining = file.size - skipped
+		if skipped > 0 {
+			if skipped == file.size && !file.patch {
+				// the file only consists of holes, no blob is written to it
+				err := r.sanitizeError(file, r.filesWriter.writeToFile(r.targetPath(file.location), nil, 0, file.size, true))
+				if err != nil {
+					return err
+				}
+			}
+			if skipped == file.size {
+				if err := r.sanitizeError(file, r.fileWritten(file, 0)); err != nil {
+					return err
+				}
+			}
+			if r.progress != nil {
+				r.progress.AddProgress(file.location, file.action(), uint64(skipped), uint64(file.size))
+			}
+		}
+	}
+
+	if r.PreparePacks != nil && len(packOrder) > 0 {
+		if err := r.PreparePacks(ctx, packOrder); err != nil {
+			return err
+		}
 	}
 
 	wg, ctx := errgroup.WithContext(ctx)
 	downloadCh := make(chan *packInfo)
+	// blobs are decoded by the download workers and written to the files by
+	// the write workers, so that slow file creation does not stall downloads
+	writeCh := make(chan writeJob, r.writeWorkers)
+	inFlight := semaphore.NewWeighted(r.maxInFlight)
+
+	packLoader := r.packLoader
+	var prefetcher *prefetch.Prefetcher
+	if r.prefetch.Depth > 0 {
+		prefetcher = prefetch.New(ctx, prefetch.LoadFn(r.packLoader), r.prefetch)
+		defer prefetcher.Close()
+		packLoader = prefetcher.Load
+	}
+	// plan packs up to this many packs ahead of the scheduled ones
+	planAhead := r.workerCount + r.prefetch.Depth
+	planned := 0
 
+	var downloaders sync.WaitGroup
 	worker := func() error {
+		defer downloaders.Done()
 		for pack := range downloadCh {
-			if err := r.downloadPack(ctx, pack); err != nil {
+			if err := r.downloadPack(ctx, pack, packLoader, writeCh, inFlight); err != nil {
 				return err
 			}
 		}
 		return nil
 	}
+	downloaders.Add(r.workerCount)
 	for i := 0; i < r.workerCount; i++ {
 		wg.Go(worker)
 	}
+	wg.Go(func() error {
+		downloaders.Wait()
+		close(writeCh)
+		return nil
+	})
+
+	writer := func() error {
+		for job := range writeCh {
+			if err := r.writeBlob(job, inFlight); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < r.writeWorkers; i++ {
+		wg.Go(writer)
+	}
 
 	// the main restore loop
 	wg.Go(func() error {
-		for _, id := range packOrder {
+		for i, id := range packOrder {
+			for prefetcher != nil && planned < len(packOrder) && planned <= i+planAhead {
+				pack := packs[packOrder[planned]]
+				planned++
+				pack.blobs = r.collectBlobs(pack)
+				reqs, err := repository.StreamPackRequests(pack.id, pack.blobs.list)
+				if err == nil {
+					prefetcher.Plan(reqs...)
+				}
+			}
+
 			pack := packs[id]
 			// allow garbage collection of packInfo
 			delete(packs, id)
@@ -197,27 +319,140 @@ func (r *fileRestorer) restoreFiles(ctx context.Context) error {
 	return wg.Wait()
 }
 
-func (r *fileRestorer) downloadPack(ctx context.Context, pack *packInfo) error {
+// skipBlob returns true if the blob with the given id at offset does not have
+// to be written. This is the case if the blob only contains zeros and the file
+// is restored as a sparse file, or if the existing file already contains it.
+func (r *fileRestorer) skipBlob(file *fileInfo, id restic.ID, offset int64) bool {
+	if file.sparse && id.Equal(r.zeroChunk) {
+		return true
+	}
+	_, ok := file.unchanged[offset]
+	return ok
+}
+
+// compareExistingFiles determines which blobs of the files to patch are
+// already contained in the existing files, and truncates the files to their
+// final size.
+func (r *fileRestorer) compareExistingFiles(ctx context.Context) error {
+	wg, ctx := errgroup.WithContext(ctx)
+	ch := make(chan *fileInfo)
 
-	// calculate blob->[]files->[]offsets mappings
-	blobs := make(map[restic.ID]struct {
-		files map[*fileInfo][]int64 // file -> offsets (plural!) of the blob in the file
+	wg.Go(func() error {
+		defer close(ch)
+		for _, file := range r.files {
+			if !file.patch {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ch <- file:
+			}
+		}
+		return nil
 	})
-	var blobList []restic.Blob
+
+	for i := 0; i < r.writeWorkers; i++ {
+		wg.Go(func() error {
+			var buf []byte
+			for file := range ch {
+				var err error
+				buf, err = r.compareExistingFile(file, buf)
+				if err != nil {
+					// the file is replaced instead
+					debug.Log("comparing %v failed: %v", file.location, err)
+					file.patch = false
+					file.unchanged = nil
+					if r.stats != nil {
+						atomic.AddUint64(&r.stats.FilesReplaced, 1)
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	err := wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range r.files {
+		if !file.patch || r.stats == nil {
+			continue
+		}
+		atomic.AddUint64(&r.stats.FilesPatched, 1)
+	}
+	return nil
+}
+
+func (r *fileRestorer) compareExistingFile(file *fileInfo, buf []byte) ([]byte, error) {
+	f, err := r.dest.OpenFile(r.targetPath(file.location), os.O_RDWR, 0)
+	if err != nil {
+		return buf, err
+	}
+
+	file.unchanged = make(map[int64]struct{})
+	offset := int64(0)
+	for _, id := range file.blobs.(restic.IDs) {
+		packs := r.idx(restic.BlobHandle{ID: id, Type: restic.DataBlob})
+		if len(packs) == 0 {
+			_ = f.Close()
+			return buf, errors.Errorf("Unknown blob %s", id.String())
+		}
+		length := int(packs[0].DataLength())
+		if cap(buf) < length {
+			buf = make([]byte, length)
+		}
+		buf = buf[:length]
+
+		n, err := f.ReadAt(buf, offset)
+		if n == length && id.Equal(r.hasher.Hash(buf)) {
+			file.unchanged[offset] = struct{}{}
+		}
+		if err != nil && err != io.EOF {
+			_ = f.Close()
+			return buf, err
+		}
+		offset += int64(length)
+	}
+
+	// the remaining blobs are written to the existing file
+	err = f.Truncate(file.size)
+	if err != nil {
+		_ = f.Close()
+		return buf, err
+	}
+	file.inProgress = true
+	return buf, f.Close()
+}
+
+// fileWritten accounts for n bytes written to file and calls r.completed
+// once all of its contents have been written.
+func (r *fileRestorer) fileWritten(file *fileInfo, n int64) error {
+	if r.completed == nil || atomic.AddInt64(&file.remaining, -n) != 0 {
+		return nil
+	}
+	return r.completed(file.location)
+}
+
+// collectBlobs calculates the blob->[]files->[]offsets mappings for pack.
+func (r *fileRestorer) collectBlobs(pack *packInfo) *packBlobs {
+	blobs := &packBlobs{files: make(map[restic.ID]map[*fileInfo][]int64)}
 	for file := range pack.files {
 		addBlob := func(blob restic.Blob, fileOffset int64) {
-			blobInfo, ok := blobs[blob.ID]
+			blobFiles, ok := blobs.files[blob.ID]
 			if !ok {
-				blobInfo.files = make(map[*fileInfo][]int64)
-				blobList = append(blobList, blob)
-				blobs[blob.ID] = blobInfo
+				blobFiles = make(map[*fileInfo][]int64)
+				blobs.list = append(blobs.list, blob)
+				blobs.files[blob.ID] = blobFiles
 			}
-			blobInfo.files[file] = append(blobInfo.files[file], fileOffset)
+			blobFiles[file] = append(blobFiles[file], fileOffset)
 		}
 		if fileBlobs, ok := file.blobs.(restic.IDs); ok {
 			fileOffset := int64(0)
 			err := r.forEachBlob(fileBlobs, func(packID restic.ID, blob restic.Blob) {
-				if packID.Equal(pack.id) {
+				if packID.Equal(pack.id) && !r.skipBlob(file, blob.ID, fileOffset) {
 					addBlob(blob, fileOffset)
 				}
 				fileOffset += int64(blob.DataLength())
@@ -238,57 +473,63 @@ func (r *fileRestorer) downloadPack(ctx context.Context, pack *packInfo) error {
 			}
 		}
 	}
+	return blobs
+}
 
-	sanitizeError := func(file *fileInfo, err error) error {
-		if err != nil {
-			err = r.Error(file.location, err)
-		}
-		return err
+// writeJob writes a blob to one file at the given offsets.
+type writeJob struct {
+	file    *fileInfo
+	offsets []int64
+	blob    *blobData
+}
+
+// blobData holds a blob until it has been written to all files using it.
+type blobData struct {
+	data  []byte
+	users int32 // Reference count.
+}
+
+func (r *fileRestorer) sanitizeError(file *fileInfo, err error) error {
+	if err != nil {
+		err = r.Error(file.location, err)
 	}
+	return err
+}
+
+func (r *fileRestorer) downloadPack(ctx context.Context, pack *packInfo, packLoader repository.BackendLoadFn,
+	writeCh chan<- writeJob, inFlight *semaphore.Weighted) error {
+
+	blobs := pack.blobs
+	if blobs == nil {
+		blobs = r.collectBlobs(pack)
+	}
+	blobList := blobs.list
 
 	// track already processed blobs for precise error reporting
 	processedBlobs := restic.NewBlobSet()
-	err := repository.StreamPack(ctx, r.packLoader, r.key, pack.id, blobList, func(h restic.BlobHandle, blobData []byte, err error) error {
+	err := repository.StreamPack(ctx, packLoader, r.key, r.hasher, pack.id, blobList, func(h restic.BlobHandle, data []byte, err error) error {
 		processedBlobs.Insert(h)
-		blob := blobs[h.ID]
+		blobFiles := blobs.files[h.ID]
 		if err != nil {
-			for file := range blob.files {
-				if errFile := sanitizeError(file, err); errFile != nil {
+			for file := range blobFiles {
+				if errFile := r.sanitizeError(file, err); errFile != nil {
 					return errFile
 				}
 			}
 			return nil
 		}
-		for file, offsets := range blob.files {
-			for _, offset := range offsets {
-				writeToFile := func() error {
-					// this looks overly complicated and needs explanation
-					// two competing requirements:
-					// - must create the file once and only once
-					// - should allow concurrent writes to the file
-					// so write the first blob while holding file lock
-					// write other blobs after releasing the lock
-					createSize := int64(-1)
-					file.lock.Lock()
-					if file.inProgress {
-						file.lock.Unlock()
-					} else {
-						defer file.lock.Unlock()
-						file.inProgress = true
-						createSize = file.size
-					}
-					writeErr := r.filesWriter.writeToFile(r.targetPath(file.location), blobData, offset, createSize, file.sparse)
 
-					if r.progress != nil {
-						r.progress.AddProgress(file.location, uint64(len(blobData)), uint64(file.size))
-					}
-
-					return writeErr
-				}
-				err := sanitizeError(file, writeToFile())
-				if err != nil {
-					return err
-				}
+		// data is only valid until the callback returns, thus the blob is
+		// copied once and shared by all files which contain it
+		if err := inFlight.Acquire(ctx, r.inFlightWeight(data)); err != nil {
+			return err
+		}
+		blob := &blobData{data: append([]byte(nil), data...), users: int32(len(blobFiles))}
+		for file, offsets := range blobFiles {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case writeCh <- writeJob{file: file, offsets: offsets, blob: blob}:
 			}
 		}
 		return nil
@@ -301,14 +542,13 @@ func (r *fileRestorer) downloadPack(ctx context.Context, pack *packInfo) error {
 			if processedBlobs.Has(blob.BlobHandle) {
 				continue
 			}
-			blob := blobs[blob.ID]
-			for file := range blob.files {
+			for file := range blobs.files[blob.ID] {
 				affectedFiles[file] = struct{}{}
 			}
 		}
 
 		for file := range affectedFiles {
-			if errFile := sanitizeError(file, err); errFile != nil {
+			if errFile := r.sanitizeError(file, err); errFile != nil {
 				return errFile
 			}
 		}
@@ -316,3 +556,62 @@ func (r *fileRestorer) downloadPack(ctx context.Context, pack *packInfo) error {
 
 	return nil
 }
+
+// inFlightWeight returns the amount of in-flight memory accounted for data.
+// A single blob larger than the limit must still be processed.
+func (r *fileRestorer) inFlightWeight(data []byte) int64 {
+	if int64(len(data)) > r.maxInFlight {
+		return r.maxInFlight
+	}
+	return int64(len(data))
+}
+
+// writeBlob writes a blob to a file and releases its memory once it has been
+// written to all files.
+func (r *fileRestorer) writeBlob(job writeJob, inFlight *semaphore.Weighted) error {
+	file := job.file
+	blobData := job.blob.data
+	defer func() {
+		if atomic.AddInt32(&job.blob.users, -1) == 0 {
+			inFlight.Release(r.inFlightWeight(blobData))
+		}
+	}()
+
+	for _, offset := range job.offsets {
+		writeToFile := func() error {
+			// this looks overly complicated and needs explanation
+			// two competing requirements:
+			// - must create the file once and only once
+			// - should allow concurrent writes to the file
+			// so write the first blob while holding file lock
+			// write other blobs after releasing the lock
+			createSize := int64(-1)
+			file.lock.Lock()
+			if file.inProgress {
+				file.lock.Unlock()
+			} else {
+				defer file.lock.Unlock()
+				file.inProgress = true
+				createSize = file.size
+			}
+			writeErr := r.filesWriter.writeToFile(r.targetPath(file.location), blobData, offset, createSize, file.sparse)
+			if writeErr == nil && r.stats != nil {
+				atomic.AddUint64(&r.stats.BytesWritten, uint64(len(blobData)))
+			}
+			if writeErr == nil {
+				writeErr = r.fileWritten(file, int64(len(blobData)))
+			}
+
+			if r.progress != nil {
+				r.progress.AddProgress(file.location, file.action(), uint64(len(blobData)), uint64(file.size))
+			}
+
+			return writeErr
+		}
+		err := r.sanitizeError(file, writeToFile())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync/atomic"
 	"testing"
 
 	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/prefetch"
 	"github.com/restic/restic/internal/crypto"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/repository"
@@ -248,6 +250,36 @@ func TestFileRestorerPackSkip(t *testing.T) {
 	}
 }
 
+func TestFileRestorerPrefetch(t *testing.T) {
+	var content []TestFile
+	for i := 0; i < 10; i++ {
+		content = append(content, TestFile{
+			name: fmt.Sprintf("file%d", i),
+			blobs: []TestBlob{
+				{fmt.Sprintf("data%d-1", i), fmt.Sprintf("pack%d", i)},
+				{fmt.Sprintf("data%d-2", i), fmt.Sprintf("pack%d", (i+1)%10)},
+			},
+		})
+	}
+	repo := newTestRepo(content)
+
+	var loads int32
+	loader := repo.loader
+	repo.loader = func(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+		atomic.AddInt32(&loads, 1)
+		return loader(ctx, h, length, offset, fn)
+	}
+
+	r := newFileRestorer(rtest.TempDir(t), repo.loader, repo.key, repo.Lookup, 2, false, nil)
+	r.prefetch = prefetch.Options{Depth: 3}
+	r.files = repo.files
+
+	rtest.OK(t, r.restoreFiles(context.TODO()))
+	verifyRestore(t, r, repo)
+	// each pack is either prefetched or loaded directly
+	rtest.Equals(t, int32(10), atomic.LoadInt32(&loads))
+}
+
 func TestErrorRestoreFiles(t *testing.T) {
 	tempdir := rtest.TempDir(t)
 	content := []TestFile{
@@ -273,6 +305,44 @@ func TestErrorRestoreFiles(t *testing.T) {
 	rtest.Assert(t, errors.Is(err, loadError), "got %v, expected contained error %v", err, loadError)
 }
 
+func TestPreparePacks(t *testing.T) {
+	tempdir := rtest.TempDir(t)
+	content := []TestFile{
+		{
+			name: "file1",
+			blobs: []TestBlob{
+				{"data1-1", "pack1"},
+				{"data1-2", "pack2"},
+			},
+		}}
+
+	repo := newTestRepo(content)
+	loaded := false
+	loader := repo.loader
+	repo.loader = func(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+		loaded = true
+		return loader(ctx, h, length, offset, fn)
+	}
+
+	prepareError := errors.New("prepare error")
+	r := newFileRestorer(tempdir, repo.loader, repo.key, repo.Lookup, 2, false, nil)
+	r.files = repo.files
+	var prepared restic.IDs
+	r.PreparePacks = func(_ context.Context, packs restic.IDs) error {
+		prepared = packs
+		return prepareError
+	}
+
+	err := r.restoreFiles(context.TODO())
+	rtest.Assert(t, errors.Is(err, prepareError), "got %v, expected contained error %v", err, prepareError)
+	rtest.Equals(t, restic.IDs{repo.packsNameToID["pack1"], repo.packsNameToID["pack2"]}, prepared)
+	rtest.Assert(t, !loaded, "pack was loaded although preparing the packs failed")
+
+	r.PreparePacks = func(context.Context, restic.IDs) error { return nil }
+	rtest.OK(t, r.restoreFiles(context.TODO()))
+	verifyRestore(t, r, repo)
+}
+
 func TestDownloadError(t *testing.T) {
 	for i := 0; i < 100; i += 10 {
 		testPartialDownloadError(t, i)
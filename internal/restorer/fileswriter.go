@@ -16,6 +16,8 @@ import (
 // to use multiple os.File to write to the same target file
 type filesWriter struct {
 	buckets []filesWriterBucket
+	// dest is the file system the files are written to
+	dest Destination
 }
 
 type filesWriterBucket struct {
@@ -24,7 +26,7 @@ type filesWriterBucket struct {
 }
 
 type partialFile struct {
-	*os.File
+	fs.WritableFile
 	users  int // Reference count.
 	sparse bool
 }
@@ -36,6 +38,7 @@ func newFilesWriter(count int) *filesWriter {
 	}
 	return &filesWriter{
 		buckets: buckets,
+		dest:    LocalDestination{},
 	}
 }
 
@@ -58,22 +61,24 @@ func (w *filesWriter) writeToFile(path string, blob []byte, offset int64, create
 			flags = os.O_WRONLY
 		}
 
-		f, err := os.OpenFile(path, flags, 0600)
+		f, err := w.dest.OpenFile(path, flags, 0600)
 		if err != nil {
 			return nil, err
 		}
 
-		wr := &partialFile{File: f, users: 1, sparse: sparse}
+		wr := &partialFile{WritableFile: f, users: 1, sparse: sparse}
 		bucket.files[path] = wr
 
 		if createSize >= 0 {
-			if sparse {
-				err = truncateSparse(f, createSize)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				err := fs.PreallocateFile(wr.File, createSize)
+			local, isLocal := f.(*os.File)
+			switch {
+			case sparse && isLocal:
+				err = truncateSparse(local, createSize)
+			case sparse:
+				// files on other hosts cannot be marked as sparse
+				err = f.Truncate(createSize)
+			case isLocal:
+				err := fs.PreallocateFile(local, createSize)
 				if err != nil {
 					// Just log the preallocate error but don't let it cause the restore process to fail.
 					// Preallocate might return an error if the filesystem (implementation) does not
@@ -83,6 +88,9 @@ func (w *filesWriter) writeToFile(path string, blob []byte, offset int64, create
 					debug.Log("Failed to preallocate %v with size %v: %v", path, createSize, err)
 				}
 			}
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		return wr, nil
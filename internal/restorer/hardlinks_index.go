@@ -2,6 +2,8 @@ package restorer
 
 import (
 	"sync"
+
+	"github.com/restic/restic/internal/restic"
 )
 
 // HardlinkKey is a composed key for finding inodes on a specific device.
@@ -55,3 +57,41 @@ func (idx *HardlinkIndex[T]) Remove(inode uint64, device uint64) {
 	defer idx.m.Unlock()
 	delete(idx.Index, HardlinkKey{inode, device})
 }
+
+// partialLinks tracks hardlinked files of which only some links are restored.
+// It is not safe for concurrent use.
+type partialLinks struct {
+	restored map[HardlinkKey]struct{}
+	excluded map[HardlinkKey]struct{}
+}
+
+func newPartialLinks() *partialLinks {
+	return &partialLinks{
+		restored: make(map[HardlinkKey]struct{}),
+		excluded: make(map[HardlinkKey]struct{}),
+	}
+}
+
+// add records a restored or excluded node.
+func (l *partialLinks) add(node *restic.Node, restored bool) {
+	if node.Type != "file" || node.Links < 2 {
+		return
+	}
+	key := HardlinkKey{node.Inode, node.DeviceID}
+	if restored {
+		l.restored[key] = struct{}{}
+	} else {
+		l.excluded[key] = struct{}{}
+	}
+}
+
+// count returns the number of restored files of which a link was excluded.
+func (l *partialLinks) count() int {
+	n := 0
+	for key := range l.restored {
+		if _, ok := l.excluded[key]; ok {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,221 @@
+package restorer
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+)
+
+// OwnershipPolicy controls how the owner and group of restored items are
+// determined. It implements pflag.Value.
+type OwnershipPolicy int
+
+const (
+	// OwnershipNumeric restores the numeric user and group IDs stored in the
+	// snapshot.
+	OwnershipNumeric OwnershipPolicy = iota
+	// OwnershipName restores the local user and group with the names stored
+	// in the snapshot. Items whose names do not exist locally are assigned to
+	// the default owner.
+	OwnershipName
+	// OwnershipSkip does not change the owner and group of restored items.
+	OwnershipSkip
+)
+
+var ownershipPolicies = map[OwnershipPolicy]string{
+	OwnershipNumeric: "numeric",
+	OwnershipName:    "name",
+	OwnershipSkip:    "skip",
+}
+
+// Set parses the name of an ownership policy.
+func (p *OwnershipPolicy) Set(s string) error {
+	for policy, name := range ownershipPolicies {
+		if name == s {
+			*p = policy
+			return nil
+		}
+	}
+	return errors.Fatalf("invalid ownership policy %q, must be one of numeric, name or skip", s)
+}
+
+func (p *OwnershipPolicy) String() string {
+	return ownershipPolicies[*p]
+}
+
+// Type returns the type name shown in the help text.
+func (p *OwnershipPolicy) Type() string {
+	return "policy"
+}
+
+// IDMap maps numeric user or group IDs from the snapshot to local IDs.
+type IDMap map[uint32]uint32
+
+// ParseIDMap parses a list of mappings like "1000:2000,33:48". Mappings are
+// separated by commas or whitespace.
+func ParseIDMap(s string) (IDMap, error) {
+	m := make(IDMap)
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		from, to, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, errors.Errorf("invalid ID mapping %q, expected from:to", entry)
+		}
+		fromID, err := strconv.ParseUint(from, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid ID mapping %q: %v", entry, err)
+		}
+		toID, err := strconv.ParseUint(to, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid ID mapping %q: %v", entry, err)
+		}
+		m[uint32(fromID)] = uint32(toID)
+	}
+	return m, nil
+}
+
+// Ownership configures how the owner and group of restored items are set.
+type Ownership struct {
+	Policy OwnershipPolicy
+	// UIDMap and GIDMap replace the IDs stored in the snapshot. They take
+	// precedence over name based mapping.
+	UIDMap IDMap
+	GIDMap IDMap
+	// DefaultUID and DefaultGID are used for items whose user or group name
+	// does not exist locally. They default to the current user and group.
+	DefaultUID uint32
+	DefaultGID uint32
+}
+
+// ownerMapper maps the owners of nodes according to an Ownership, the results
+// of name lookups are cached.
+type ownerMapper struct {
+	Ownership
+
+	m      sync.Mutex
+	users  map[string]int64
+	groups map[string]int64
+
+	// unmapped counts the items which were assigned to the default owner
+	unmapped *uint64
+}
+
+func newOwnerMapper(o Ownership, unmapped *uint64) *ownerMapper {
+	return &ownerMapper{
+		Ownership: o,
+		users:     make(map[string]int64),
+		groups:    make(map[string]int64),
+		unmapped:  unmapped,
+	}
+}
+
+// mapNode returns node with the owner and group which must be restored.
+func (m *ownerMapper) mapNode(node *restic.Node) *restic.Node {
+	if m.Policy == OwnershipSkip {
+		return node
+	}
+
+	unmapped := false
+	uid, ok := m.UIDMap[node.UID]
+	if !ok {
+		uid = node.UID
+		if m.Policy == OwnershipName {
+			if uid, ok = m.lookup(m.users, node.User, lookupUID); !ok {
+				uid = m.DefaultUID
+				unmapped = true
+			}
+		}
+	}
+	gid, ok := m.GIDMap[node.GID]
+	if !ok {
+		gid = node.GID
+		if m.Policy == OwnershipName {
+			if gid, ok = m.lookup(m.groups, node.Group, lookupGID); !ok {
+				gid = m.DefaultGID
+				unmapped = true
+			}
+		}
+	}
+	if unmapped {
+		atomic.AddUint64(m.unmapped, 1)
+	}
+	if uid == node.UID && gid == node.GID {
+		return node
+	}
+
+	n := *node
+	n.UID = uid
+	n.GID = gid
+	return &n
+}
+
+// lookup returns the cached ID of name, it is determined using lookupID if
+// necessary.
+func (m *ownerMapper) lookup(cache map[string]int64, name string, lookupID func(string) (uint32, bool)) (uint32, bool) {
+	if name == "" {
+		return 0, false
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	id, ok := cache[name]
+	if !ok {
+		id = -1
+		if localID, found := lookupID(name); found {
+			id = int64(localID)
+		}
+		cache[name] = id
+	}
+	return uint32(id), id >= 0
+}
+
+func lookupUID(name string) (uint32, bool) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(id), err == nil
+}
+
+func lookupGID(name string) (uint32, bool) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(id), err == nil
+}
+
+// ParseOwner parses an owner given as "user:group", where user and group are
+// either local names or numeric IDs.
+func ParseOwner(s string) (uid, gid uint32, err error) {
+	userName, groupName, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, errors.Errorf("invalid owner %q, expected user:group", s)
+	}
+
+	if id, err := strconv.ParseUint(userName, 10, 32); err == nil {
+		uid = uint32(id)
+	} else if uid, ok = lookupUID(userName); !ok {
+		return 0, 0, errors.Errorf("unknown user %q", userName)
+	}
+	if id, err := strconv.ParseUint(groupName, 10, 32); err == nil {
+		gid = uint32(id)
+	} else if gid, ok = lookupGID(groupName); !ok {
+		return 0, 0, errors.Errorf("unknown group %q", groupName)
+	}
+	return uid, gid, nil
+}
+
+// currentOwner returns the user and group of the current process.
+func currentOwner() (uid, gid uint32) {
+	return uint32(os.Geteuid()), uint32(os.Getegid())
+}
@@ -0,0 +1,65 @@
+package restorer
+
+import (
+	"os/user"
+	"runtime"
+	"testing"
+
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := ParseIDMap("1000:2000,33:48\n5:6")
+	rtest.OK(t, err)
+	rtest.Equals(t, IDMap{1000: 2000, 33: 48, 5: 6}, m)
+
+	for _, s := range []string{"1000", "a:1", "1:-1", "1:4294967296"} {
+		_, err := ParseIDMap(s)
+		rtest.Assert(t, err != nil, "expected error for %q", s)
+	}
+}
+
+func TestOwnerMapper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("users and groups have no numeric IDs on Windows")
+	}
+
+	current, err := user.Current()
+	rtest.OK(t, err)
+	uid, _ := lookupUID(current.Username)
+	group, err := user.LookupGroupId(current.Gid)
+	rtest.OK(t, err)
+	gid, _ := lookupGID(group.Name)
+
+	ownership := Ownership{
+		UIDMap:     IDMap{1000: 2000},
+		GIDMap:     IDMap{33: 48},
+		DefaultUID: 4000,
+		DefaultGID: 4001,
+	}
+
+	for _, test := range []struct {
+		policy   OwnershipPolicy
+		node     restic.Node
+		uid, gid uint32
+		unmapped uint64
+	}{
+		{OwnershipNumeric, restic.Node{UID: 5, GID: 6, User: current.Username}, 5, 6, 0},
+		{OwnershipNumeric, restic.Node{UID: 1000, GID: 33}, 2000, 48, 0},
+		{OwnershipSkip, restic.Node{UID: 1000, GID: 33}, 1000, 33, 0},
+		{OwnershipName, restic.Node{UID: 5, GID: 6, User: current.Username, Group: group.Name}, uid, gid, 0},
+		{OwnershipName, restic.Node{UID: 1000, GID: 6, User: "restic-missing-user", Group: group.Name}, 2000, gid, 0},
+		{OwnershipName, restic.Node{UID: 5, GID: 6, User: "restic-missing-user", Group: "restic-missing-group"}, 4000, 4001, 1},
+		{OwnershipName, restic.Node{UID: 5, GID: 33}, 4000, 48, 1},
+	} {
+		ownership.Policy = test.policy
+		var unmapped uint64
+		m := newOwnerMapper(ownership, &unmapped)
+
+		node := m.mapNode(&test.node)
+		rtest.Equals(t, test.uid, node.UID)
+		rtest.Equals(t, test.gid, node.GID)
+		rtest.Equals(t, test.unmapped, unmapped)
+	}
+}
@@ -2,13 +2,21 @@ package restorer
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/restic/restic/internal/backend/prefetch"
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/fs"
+	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 	restoreui "github.com/restic/restic/internal/ui/restore"
 
@@ -25,6 +33,132 @@ type Restorer struct {
 
 	Error        func(location string, err error) error
 	SelectFilter func(item string, dstpath string, node *restic.Node) (selectedForRestore bool, childMayBeSelected bool)
+
+	// Destination is the file system the snapshot is restored to. It
+	// defaults to LocalDestination.
+	Destination Destination
+
+	// WriteToDevices allows writing the contents of files which were saved
+	// from a device (see restic.Node.DeviceType) into an existing device at
+	// the target path. Otherwise such targets are reported as an error and
+	// left untouched.
+	WriteToDevices bool
+
+	// Warn, if set, is called once for each kind of metadata which cannot be
+	// restored because the destination does not support it, and for
+	// hardlinked files of which some links were excluded.
+	Warn func(msg string)
+
+	// NoXattrs does not restore extended attributes, except for access
+	// control lists. NoACLs does not restore access control lists.
+	NoXattrs bool
+	NoACLs   bool
+	// skippedAttrs counts the extended attributes per kind which were not
+	// restored, as they are not supported or require more privileges
+	skippedAttrs sync.Map
+
+	// PreparePacks, if set, is called with the pack files needed to restore
+	// the contents of the selected files before any of them is downloaded.
+	PreparePacks func(ctx context.Context, packs restic.IDs) error
+
+	// Prefetch controls how many pack files are loaded ahead of their use.
+	Prefetch prefetch.Options
+
+	// Workers is the number of goroutines which create directories, write
+	// file contents and restore metadata. It defaults to the number of CPUs.
+	Workers int
+
+	// Overwrite controls which existing files, symlinks and special files
+	// in the target directory are replaced. Directories are always restored.
+	Overwrite OverwriteBehavior
+	// DeltaContent compares the contents of existing files which are
+	// overwritten with the snapshot and only writes the blobs which have
+	// changed.
+	DeltaContent bool
+	// Delete removes files and directories within the restored directories
+	// which are not contained in the snapshot.
+	Delete bool
+
+	// VerifySkipped also verifies existing files which were kept due to
+	// Overwrite. Otherwise VerifyFiles ignores them.
+	VerifySkipped bool
+	// skipped are the locations of the existing items kept by RestoreTo
+	skipped map[string]struct{}
+
+	// State, if set, records the regular files whose contents are complete.
+	// Files recorded by an interrupted restore are not written again if they
+	// are unchanged, see OpenState.
+	State *State
+
+	// Ownership controls the owner and group of restored items.
+	Ownership Ownership
+	owners    *ownerMapper
+
+	stats Stats
+
+	// caps are the capabilities of the destination
+	caps     fs.Capabilities
+	warnOnce sync.Map
+}
+
+// Stats counts how existing files in the target directory were handled.
+type Stats struct {
+	FilesSkipped  uint64
+	FilesPatched  uint64
+	FilesReplaced uint64
+	FilesDeleted  uint64
+	// FilesResumed counts the files which were completed by an interrupted
+	// restore, see State.
+	FilesResumed uint64
+	// BytesWritten is the amount of file contents written.
+	BytesWritten uint64
+	// OwnersUnmapped counts the items which were assigned to the default
+	// owner, as their user or group does not exist locally.
+	OwnersUnmapped uint64
+}
+
+// OverwriteBehavior controls which existing items in the target directory
+// are replaced. It implements pflag.Value.
+type OverwriteBehavior int
+
+const (
+	// OverwriteAlways replaces all existing items.
+	OverwriteAlways OverwriteBehavior = iota
+	// OverwriteIfChanged replaces items whose type, size, modification time
+	// or symlink target differs from the snapshot.
+	OverwriteIfChanged
+	// OverwriteIfNewer replaces items which were modified before the item
+	// in the snapshot.
+	OverwriteIfNewer
+	// OverwriteNever keeps all existing items.
+	OverwriteNever
+)
+
+var overwriteBehaviors = map[OverwriteBehavior]string{
+	OverwriteAlways:    "always",
+	OverwriteIfChanged: "if-changed",
+	OverwriteIfNewer:   "if-newer",
+	OverwriteNever:     "never",
+}
+
+// Set parses the name of an overwrite behavior.
+func (b *OverwriteBehavior) Set(s string) error {
+	for behavior, name := range overwriteBehaviors {
+		if name == s {
+			*b = behavior
+			return nil
+		}
+	}
+	return errors.Fatalf("invalid overwrite behavior %q, must be one of always, if-changed, if-newer or never", s)
+}
+
+func (b *OverwriteBehavior) String() string {
+	return overwriteBehaviors[*b]
+}
+
+// Type returns the type name shown in the help text.
+func (b *OverwriteBehavior) Type() string {
+	return "behavior"
 }
 
 var restorerAbortOnAllErrors = func(location string, err error) error { return err }
@@ -39,15 +173,23 @@ func NewRestorer(repo restic.Repository, sn *restic.Snapshot, sparse bool,
 		SelectFilter: func(string, string, *restic.Node) (bool, bool) { return true, true },
 		progress:     progress,
 		sn:           sn,
+		Destination:  LocalDestination{},
+		Workers:      runtime.GOMAXPROCS(0),
 	}
+	r.Ownership.DefaultUID, r.Ownership.DefaultGID = currentOwner()
 
 	return r
 }
 
 type treeVisitor struct {
+	// enterTree is called for each traversed tree before its nodes
+	enterTree func(tree *restic.Tree, target, location string) error
 	enterDir  func(node *restic.Node, target, location string) error
 	visitNode func(node *restic.Node, target, location string) error
 	leaveDir  func(node *restic.Node, target, location string) error
+	// visitExcluded is called for files and other non-directory nodes which
+	// were not selected by SelectFilter
+	visitExcluded func(node *restic.Node, location string)
 }
 
 // traverseTree traverses a tree from the repo and calls treeVisitor.
@@ -60,6 +202,13 @@ func (res *Restorer) traverseTree(ctx context.Context, target, location string,
 		return hasRestored, res.Error(location, err)
 	}
 
+	if visitor.enterTree != nil {
+		err = res.sanitizeError(location, visitor.enterTree(tree, target, location))
+		if err != nil {
+			return hasRestored, err
+		}
+	}
+
 	for _, node := range tree.Nodes {
 
 		// ensure that the node name does not contain anything that refers to a
@@ -154,23 +303,29 @@ func (res *Restorer) traverseTree(ctx context.Context, target, location string,
 			if err != nil {
 				return hasRestored, err
 			}
+		} else if visitor.visitExcluded != nil {
+			visitor.visitExcluded(node, nodeLocation)
 		}
 	}
 
 	return hasRestored, nil
 }
 
-func (res *Restorer) restoreNodeTo(ctx context.Context, node *restic.Node, target, location string) error {
+func (res *Restorer) restoreNodeTo(node *restic.Node, target, location string, action restoreui.ItemAction) error {
 	debug.Log("restoreNode %v %v %v", node.Name, target, location)
 
-	err := node.CreateAt(ctx, target, res.repo)
+	err := res.Destination.CreateNode(node, target)
+	if errors.Is(err, errSpecialUnsupported) {
+		res.warn("special files are not supported by the destination and are not restored")
+		return nil
+	}
 	if err != nil {
-		debug.Log("node.CreateAt(%s) error %v", target, err)
+		debug.Log("CreateNode(%s) error %v", target, err)
 		return err
 	}
 
 	if res.progress != nil {
-		res.progress.AddProgress(location, 0, 0)
+		res.progress.AddProgress(location, action, 0, 0)
 	}
 
 	return res.restoreNodeMetadataTo(node, target, location)
@@ -178,32 +333,135 @@ func (res *Restorer) restoreNodeTo(ctx context.Context, node *restic.Node, targe
 
 func (res *Restorer) restoreNodeMetadataTo(node *restic.Node, target, location string) error {
 	debug.Log("restoreNodeMetadata %v %v %v", node.Name, target, location)
-	err := node.RestoreMetadata(target)
+	node = res.owners.mapNode(res.supportedMetadata(node))
+	err := res.Destination.RestoreMetadata(node, target, restic.MetadataOptions{
+		SkipOwner:  res.Ownership.Policy == OwnershipSkip,
+		XattrError: res.xattrError,
+	})
+	if errors.Is(err, errOwnerDenied) {
+		res.warn("the owner of restored items cannot be changed on the destination")
+		return nil
+	}
 	if err != nil {
 		debug.Log("node.RestoreMetadata(%s) error %v", target, err)
 	}
 	return err
 }
 
-func (res *Restorer) restoreHardlinkAt(node *restic.Node, target, path, location string) error {
-	if err := fs.Remove(path); !os.IsNotExist(err) {
+// supportedMetadata returns node without the extended attributes which cannot
+// be restored on the destination or which were disabled.
+func (res *Restorer) supportedMetadata(node *restic.Node) *restic.Node {
+	if len(node.ExtendedAttributes) == 0 ||
+		(res.caps.Has(fs.CapXattrs|fs.CapACLs) && !res.NoXattrs && !res.NoACLs) {
+		return node
+	}
+
+	n := *node
+	n.ExtendedAttributes = nil
+	if !res.caps.Has(fs.CapXattrs) {
+		res.warn("extended attributes are not supported by the destination and are not restored")
+		return &n
+	}
+
+	for _, attr := range node.ExtendedAttributes {
+		if fs.IsACLAttribute(attr.Name) {
+			if !res.caps.Has(fs.CapACLs) {
+				res.warn("access control lists are not supported by the destination and are not restored")
+				continue
+			}
+			if res.NoACLs {
+				continue
+			}
+		} else if res.NoXattrs {
+			continue
+		}
+		n.ExtendedAttributes = append(n.ExtendedAttributes, attr)
+	}
+	return &n
+}
+
+// Kinds of extended attributes which are counted separately if they cannot be
+// restored.
+const (
+	AttrKindXattr        = "extended attributes"
+	AttrKindACL          = "access control lists"
+	AttrKindSecurity     = "security attributes"
+	AttrKindResourceFork = "resource forks"
+)
+
+// attrKind returns the kind of the extended attribute name.
+func attrKind(name string) string {
+	switch {
+	case fs.IsACLAttribute(name):
+		return AttrKindACL
+	case strings.HasPrefix(name, "security.") || strings.HasPrefix(name, "trusted."):
+		return AttrKindSecurity
+	case name == "com.apple.ResourceFork":
+		return AttrKindResourceFork
+	default:
+		return AttrKindXattr
+	}
+}
+
+// xattrError ignores errors for extended attributes which are not supported by
+// the file system and counts them instead. Other errors are returned.
+func (res *Restorer) xattrError(name string, err error) error {
+	kind := attrKind(name)
+	switch {
+	case errors.Is(err, restic.ErrXattrUnsupported):
+	case kind == AttrKindSecurity && errors.Is(err, os.ErrPermission):
+		// the security and trusted namespaces require CAP_SYS_ADMIN
+	case kind == AttrKindResourceFork && (errors.Is(err, syscall.E2BIG) || errors.Is(err, syscall.ENOSPC)):
+		// resource forks can exceed the size limit of extended attributes
+		// on other file systems
+	default:
+		return err
+	}
+
+	debug.Log("unable to restore %v: %v", name, err)
+	count, _ := res.skippedAttrs.LoadOrStore(kind, new(uint64))
+	atomic.AddUint64(count.(*uint64), 1)
+	return nil
+}
+
+// SkippedAttributes returns the number of extended attributes per kind which
+// were not restored, as the file system does not support them or restic lacks
+// the required privileges.
+func (res *Restorer) SkippedAttributes() map[string]uint64 {
+	skipped := make(map[string]uint64)
+	res.skippedAttrs.Range(func(kind, count interface{}) bool {
+		skipped[kind.(string)] = atomic.LoadUint64(count.(*uint64))
+		return true
+	})
+	return skipped
+}
+
+// warn calls Warn for the first occurrence of msg.
+func (res *Restorer) warn(msg string) {
+	if _, loaded := res.warnOnce.LoadOrStore(msg, struct{}{}); !loaded && res.Warn != nil {
+		res.Warn(msg)
+	}
+}
+
+// restoreHardlinkAt creates path as a hardlink to target. The metadata is
+// shared with target and therefore only restored for target.
+func (res *Restorer) restoreHardlinkAt(target, path, location string, action restoreui.ItemAction) error {
+	if err := res.Destination.Remove(path); !os.IsNotExist(err) {
 		return errors.Wrap(err, "RemoveCreateHardlink")
 	}
-	err := fs.Link(target, path)
+	err := res.Destination.Link(target, path)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	if res.progress != nil {
-		res.progress.AddProgress(location, 0, 0)
+		res.progress.AddProgress(location, action, 0, 0)
 	}
-
-	// TODO investigate if hardlinks have separate metadata on any supported system
-	return res.restoreNodeMetadataTo(node, path, location)
+	return nil
 }
 
-func (res *Restorer) restoreEmptyFileAt(node *restic.Node, target, location string) error {
-	wr, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+func (res *Restorer) restoreEmptyFileAt(node *restic.Node, target, location string, action restoreui.ItemAction) error {
+	wr, err := res.Destination.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
@@ -213,7 +471,7 @@ func (res *Restorer) restoreEmptyFileAt(node *restic.Node, target, location stri
 	}
 
 	if res.progress != nil {
-		res.progress.AddProgress(location, 0, 0)
+		res.progress.AddProgress(location, action, 0, 0)
 	}
 
 	return res.restoreNodeMetadataTo(node, target, location)
@@ -222,79 +480,184 @@ func (res *Restorer) restoreEmptyFileAt(node *restic.Node, target, location stri
 // RestoreTo creates the directories and files in the snapshot below dst.
 // Before an item is created, res.Filter is called.
 func (res *Restorer) RestoreTo(ctx context.Context, dst string) error {
-	var err error
-	if !filepath.IsAbs(dst) {
-		dst, err = filepath.Abs(dst)
-		if err != nil {
-			return errors.Wrap(err, "Abs")
-		}
+	dst, err := res.prepare(dst)
+	if err != nil {
+		return err
 	}
 
 	idx := NewHardlinkIndex[string]()
+	// devices are the locations whose target is an existing device, their
+	// metadata is never modified
+	devices := make(map[string]struct{})
 	filerestorer := newFileRestorer(dst, res.repo.Backend().Load, res.repo.Key(), res.repo.Index().Lookup,
 		res.repo.Connections(), res.sparse, res.progress)
+	filerestorer.zeroChunk = repository.ZeroChunkFor(res.repo.Config())
+	filerestorer.hasher = res.repo.Config().BlobHasher()
 	filerestorer.Error = res.Error
+	filerestorer.PreparePacks = res.PreparePacks
+	filerestorer.prefetch = res.Prefetch
+	filerestorer.writeWorkers = res.Workers
+	filerestorer.stats = &res.stats
+	filerestorer.dest = res.Destination
+	filerestorer.filesWriter.dest = res.Destination
+	res.owners = newOwnerMapper(res.Ownership, &res.stats.OwnersUnmapped)
+	// nodes are the files whose completion is recorded in res.State
+	nodes := make(map[string]*restic.Node)
+	if res.State != nil {
+		filerestorer.completed = func(location string) error {
+			node, ok := nodes[location]
+			if !ok {
+				// existing devices are not recorded
+				return nil
+			}
+			return res.recordCompleted(node, filerestorer.targetPath(location), location)
+		}
+	}
 
 	debug.Log("first pass for %q", dst)
 
 	// first tree pass: create directories and collect all files to restore
-	_, err = res.traverseTree(ctx, dst, string(filepath.Separator), *res.sn.Tree, treeVisitor{
+	pool := newWorkerPool(ctx, res.Workers)
+	// the parent directory of the last visited node, which is known to be
+	// created by an already submitted job
+	var lastDir string
+	mkdir := func(target, location string) error {
+		lastDir = target
+		return pool.submit(func() error {
+			// MkdirAll also succeeds if another worker creates target
+			// concurrently
+			return res.sanitizeError(location, res.Destination.MkdirAll(target, 0700))
+		})
+	}
+	// skipped are the locations of existing items which are kept, existing
+	// those of items which replace an existing item
+	skipped := make(map[string]struct{})
+	res.skipped = skipped
+	existing := make(map[string]struct{})
+	links := newPartialLinks()
+	var deleteExtraneous func(tree *restic.Tree, target, location string) error
+	if res.Delete {
+		deleteExtraneous = res.deleteExtraneous
+	}
+	_, err = res.traverseTree(pool.ctx, dst, string(filepath.Separator), *res.sn.Tree, treeVisitor{
+		enterTree: deleteExtraneous,
 		enterDir: func(node *restic.Node, target, location string) error {
 			debug.Log("first pass, enterDir: mkdir %q, leaveDir should restore metadata", location)
-			if res.progress != nil {
-				res.progress.AddFile(0)
+			if fi, err := res.Destination.Lstat(target); err == nil && fi.IsDir() {
+				existing[location] = struct{}{}
 			}
 			// create dir with default permissions
 			// #leaveDir restores dir metadata after visiting all children
-			return fs.MkdirAll(target, 0700)
+			return mkdir(target, location)
 		},
 
 		visitNode: func(node *restic.Node, target, location string) error {
 			debug.Log("first pass, visitNode: mkdir %q, leaveDir on second pass should restore metadata", location)
+			links.add(node, true)
 			// create parent dir with default permissions
 			// second pass #leaveDir restores dir metadata after visiting/restoring all children
-			err := fs.MkdirAll(filepath.Dir(target), 0700)
-			if err != nil {
-				return err
+			if filepath.Dir(target) != lastDir {
+				err := mkdir(filepath.Dir(target), filepath.Dir(location))
+				if err != nil {
+					return err
+				}
 			}
 
-			if node.Type != "file" {
+			device := node.Type == "file" && node.DeviceType != "" && res.isDevice(target)
+			if device {
+				devices[location] = struct{}{}
+				if !res.WriteToDevices {
+					return res.Error(location, errors.Errorf("%v is a device, refusing to overwrite it", target))
+				}
+				debug.Log("writing %v to the device %v", location, target)
+			}
+
+			// a hardlinked file does not increase the restore size
+			hardlink := node.Type == "file" && node.Links > 1 && node.Size > 0 && idx.Has(node.Inode, node.DeviceID)
+			var size uint64
+			if node.Type == "file" && !hardlink {
+				size = node.Size
+			}
+			if res.progress != nil {
+				res.progress.AddFile(size)
+			}
+
+			if !device && !hardlink && res.isCompleted(node, target, location) {
+				debug.Log("%v was completed by the interrupted restore", location)
+				atomic.AddUint64(&res.stats.FilesResumed, 1)
 				if res.progress != nil {
-					res.progress.AddFile(0)
+					res.progress.AddSkippedFile(location, size)
+				}
+				if node.Links > 1 {
+					idx.Add(node.Inode, node.DeviceID, location)
 				}
+				// the metadata is restored by the second pass
 				return nil
 			}
 
-			if node.Size == 0 {
+			state := existingMissing
+			if !device {
+				state, err = res.existingItem(node, target)
+				if err != nil {
+					return err
+				}
+			}
+			// only the contents of non-empty files can be patched
+			patch := state == existingReplace && res.DeltaContent &&
+				node.Type == "file" && node.Size > 0 && !hardlink
+
+			switch state {
+			case existingSkip:
+				debug.Log("keeping existing %v", location)
+				skipped[location] = struct{}{}
+				atomic.AddUint64(&res.stats.FilesSkipped, 1)
 				if res.progress != nil {
-					res.progress.AddFile(node.Size)
+					res.progress.AddSkippedFile(location, size)
 				}
-				return nil // deal with empty files later
+				if node.Type == "file" && node.Links > 1 && node.Size > 0 && !hardlink {
+					// the other links to the file refer to the kept file
+					idx.Add(node.Inode, node.DeviceID, location)
+				}
+				return nil
+			case existingReplace:
+				existing[location] = struct{}{}
+				if !patch {
+					atomic.AddUint64(&res.stats.FilesReplaced, 1)
+				}
+			}
+
+			if node.Type != "file" || node.Size == 0 || hardlink {
+				return nil // deal with special and empty files and hardlinks later
 			}
 
 			if node.Links > 1 {
-				if idx.Has(node.Inode, node.DeviceID) {
-					if res.progress != nil {
-						// a hardlinked file does not increase the restore size
-						res.progress.AddFile(0)
-					}
-					return nil
-				}
 				idx.Add(node.Inode, node.DeviceID, location)
 			}
 
+			if res.State != nil && !device {
+				nodes[location] = node
+			}
+			file := filerestorer.addFile(location, node.Content, int64(node.Size), device)
+			file.existing = state == existingReplace
+			file.patch = patch
+			return nil
+		},
+		leaveDir: func(node *restic.Node, target, location string) error {
+			// also called for directories which were not selected, but
+			// contain selected items. Their metadata is restored as well.
 			if res.progress != nil {
-				res.progress.AddFile(node.Size)
+				res.progress.AddFile(0)
 			}
-
-			filerestorer.addFile(location, node.Content, int64(node.Size))
-
 			return nil
 		},
+		visitExcluded: func(node *restic.Node, _ string) {
+			links.add(node, false)
+		},
 	})
-	if err != nil {
+	if err = res.waitPool(pool, err); err != nil {
 		return err
 	}
+	res.warnPartialLinks(links)
 
 	err = filerestorer.restoreFiles(ctx)
 	if err != nil {
@@ -303,39 +666,296 @@ func (res *Restorer) RestoreTo(ctx context.Context, dst string) error {
 
 	debug.Log("second pass for %q", dst)
 
-	// second tree pass: restore special files and filesystem metadata
-	_, err = res.traverseTree(ctx, dst, string(filepath.Separator), *res.sn.Tree, treeVisitor{
+	// second tree pass: restore special files and filesystem metadata. The
+	// metadata of a directory is restored once all of its children are done.
+	pool = newWorkerPool(ctx, res.Workers)
+	dirs := newPendingDirs(dst)
+	submit := func(target, location string, restore func() error) error {
+		dir := dirs.addChild(target)
+		return pool.submit(func() error {
+			if err := res.sanitizeError(location, restore()); err != nil {
+				return err
+			}
+			return dir.done()
+		})
+	}
+	_, err = res.traverseTree(pool.ctx, dst, string(filepath.Separator), *res.sn.Tree, treeVisitor{
 		visitNode: func(node *restic.Node, target, location string) error {
 			debug.Log("second pass, visitNode: restore node %q", location)
+			if _, ok := skipped[location]; ok {
+				return nil
+			}
+			action := restoreui.ActionRestored
+			if _, ok := existing[location]; ok {
+				action = restoreui.ActionReplaced
+			}
+
 			if node.Type != "file" {
-				return res.restoreNodeTo(ctx, node, target, location)
+				return submit(target, location, func() error {
+					return res.restoreNodeTo(node, target, location, action)
+				})
+			}
+
+			if _, ok := devices[location]; ok {
+				// the contents of non-empty files have already been written
+				if res.progress != nil && res.WriteToDevices && node.Size == 0 {
+					res.progress.AddProgress(location, action, 0, 0)
+				}
+				return nil
 			}
 
 			// create empty files, but not hardlinks to empty files
 			if node.Size == 0 && (node.Links < 2 || !idx.Has(node.Inode, node.DeviceID)) {
 				if node.Links > 1 {
 					idx.Add(node.Inode, node.DeviceID, location)
+					// hardlinks to this file may be restored by any
+					// worker, thus it must exist before they are scheduled
+					return res.restoreEmptyFileAt(node, target, location, action)
 				}
-				return res.restoreEmptyFileAt(node, target, location)
+				return submit(target, location, func() error {
+					return res.restoreEmptyFileAt(node, target, location, action)
+				})
 			}
 
 			if idx.Has(node.Inode, node.DeviceID) && idx.Value(node.Inode, node.DeviceID) != location {
-				return res.restoreHardlinkAt(node, filerestorer.targetPath(idx.Value(node.Inode, node.DeviceID)), target, location)
+				linkTarget := filerestorer.targetPath(idx.Value(node.Inode, node.DeviceID))
+				return submit(target, location, func() error {
+					if res.Overwrite != OverwriteAlways && res.isSameFile(linkTarget, target) {
+						atomic.AddUint64(&res.stats.FilesSkipped, 1)
+						if res.progress != nil {
+							res.progress.AddSkippedFile(location, 0)
+						}
+						return nil
+					}
+					return res.restoreHardlinkAt(linkTarget, target, location, action)
+				})
 			}
 
-			return res.restoreNodeMetadataTo(node, target, location)
+			return submit(target, location, func() error {
+				if err := res.restoreNodeMetadataTo(node, target, location); err != nil {
+					return err
+				}
+				// update the modification time recorded for complete files
+				if res.State != nil && res.State.has(location) {
+					return res.recordCompleted(node, target, location)
+				}
+				return nil
+			})
 		},
 		leaveDir: func(node *restic.Node, target, location string) error {
-			err := res.restoreNodeMetadataTo(node, target, location)
-			if err == nil && res.progress != nil {
-				res.progress.AddProgress(location, 0, 0)
+			action := restoreui.ActionRestored
+			if _, ok := existing[location]; ok {
+				action = restoreui.ActionReplaced
 			}
-			return err
+			done := dirs.leave(target, func() error {
+				err := res.restoreNodeMetadataTo(node, target, location)
+				if err == nil && res.progress != nil {
+					res.progress.AddProgress(location, action, 0, 0)
+				}
+				return res.sanitizeError(location, err)
+			})
+			return pool.submit(done)
 		},
 	})
+	if err == nil {
+		// release the target directory, the traversal is complete
+		err = dirs.root.done()
+	}
+	return res.waitPool(pool, err)
+}
+
+// prepare sets up the restore to dst and returns its absolute path.
+func (res *Restorer) prepare(dst string) (string, error) {
+	if res.Destination == nil {
+		res.Destination = LocalDestination{}
+	}
+	res.caps = res.Destination.Capabilities()
+
+	dst, err := res.Destination.Abs(dst)
+	if err != nil {
+		return "", errors.Wrap(err, "Abs")
+	}
+	return dst, nil
+}
+
+// sanitizeError passes errors which occurred while restoring location to
+// res.Error. Context errors are permanent.
+func (res *Restorer) sanitizeError(location string, err error) error {
+	switch err {
+	case nil, context.Canceled, context.DeadlineExceeded:
+		return err
+	default:
+		return res.Error(location, err)
+	}
+}
+
+// waitPool waits for the jobs of a tree pass to complete. Errors of the jobs
+// take precedence over err, which was returned by the tree traversal and is
+// likely caused by canceling the pool.
+func (res *Restorer) waitPool(pool *workerPool, err error) error {
+	if poolErr := pool.wait(); poolErr != nil {
+		return poolErr
+	}
 	return err
 }
 
+// Stats returns how existing files were handled by RestoreTo.
+func (res *Restorer) Stats() Stats {
+	return res.stats
+}
+
+type existingState int
+
+const (
+	existingMissing existingState = iota
+	existingSkip
+	existingReplace
+)
+
+// existingItem decides according to res.Overwrite whether an existing item at
+// target is replaced by node. Replaced entries are removed unless both are
+// regular files, whose contents are then overwritten.
+func (res *Restorer) existingItem(node *restic.Node, target string) (existingState, error) {
+	fi, err := res.Destination.Lstat(target)
+	if os.IsNotExist(err) {
+		return existingMissing, nil
+	}
+	if err != nil {
+		return existingMissing, err
+	}
+
+	if res.keepExisting(node, target, fi) {
+		return existingSkip, nil
+	}
+
+	switch {
+	case fi.IsDir():
+		// only removed with Delete, replacing it fails
+	case fi.Mode().IsRegular() && node.Type == "file":
+	default:
+		if err := res.Destination.Remove(target); err != nil {
+			return existingMissing, errors.Wrap(err, "Remove")
+		}
+	}
+	return existingReplace, nil
+}
+
+// keepExisting returns true if the existing item at target with the file info
+// fi must not be replaced by node.
+func (res *Restorer) keepExisting(node *restic.Node, target string, fi os.FileInfo) bool {
+	modTime := node.ModTime
+	if res.caps.Has(fs.CapSecondsOnlyMtime) {
+		modTime = modTime.Truncate(time.Second)
+	}
+
+	switch res.Overwrite {
+	case OverwriteNever:
+		return true
+	case OverwriteIfNewer:
+		return !modTime.After(fi.ModTime())
+	case OverwriteIfChanged:
+		if !fi.ModTime().Equal(modTime) {
+			return false
+		}
+		switch node.Type {
+		case "file":
+			return fi.Mode().IsRegular() && fi.Size() == int64(node.Size)
+		case "symlink":
+			if fi.Mode()&os.ModeSymlink == 0 {
+				return false
+			}
+			linkTarget, err := res.Destination.Readlink(target)
+			return err == nil && linkTarget == node.LinkTarget
+		default:
+			return !fi.IsDir() && fi.Mode().Type() == node.Mode.Type()
+		}
+	default:
+		return false
+	}
+}
+
+// deleteExtraneous removes the entries of the directory target which are not
+// contained in tree, or whose type differs between a directory and other
+// files.
+func (res *Restorer) deleteExtraneous(tree *restic.Tree, target, location string) error {
+	entries, err := res.extraneousEntries(tree, target)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryLocation := filepath.Join(location, entry.Name())
+		debug.Log("deleting %v", entryLocation)
+		err := res.Destination.RemoveAll(filepath.Join(target, entry.Name()))
+		if err != nil {
+			if err := res.Error(entryLocation, errors.Wrap(err, "RemoveAll")); err != nil {
+				return err
+			}
+			continue
+		}
+		atomic.AddUint64(&res.stats.FilesDeleted, 1)
+		if res.progress != nil {
+			res.progress.AddDeletedItem(entryLocation)
+		}
+	}
+	return nil
+}
+
+// extraneousEntries returns the entries of the directory target which are not
+// contained in tree, or whose type differs between a directory and other
+// files. A missing directory has no entries.
+func (res *Restorer) extraneousEntries(tree *restic.Tree, target string) ([]os.FileInfo, error) {
+	entries, err := res.Destination.ReadDir(target)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*restic.Node, len(tree.Nodes))
+	for _, node := range tree.Nodes {
+		nodes[node.Name] = node
+	}
+
+	var extraneous []os.FileInfo
+	for _, entry := range entries {
+		if res.State != nil && filepath.Join(target, entry.Name()) == res.State.Path() {
+			continue
+		}
+		node, ok := nodes[entry.Name()]
+		if !ok || entry.IsDir() != (node.Type == "dir") {
+			extraneous = append(extraneous, entry)
+		}
+	}
+	return extraneous, nil
+}
+
+// warnPartialLinks warns about hardlinked files which are restored without
+// the links excluded by SelectFilter.
+func (res *Restorer) warnPartialLinks(links *partialLinks) {
+	if n := links.count(); n > 0 {
+		res.warn(fmt.Sprintf("%d hardlinked files are restored independently of their excluded links", n))
+	}
+}
+
+// isSameFile returns true if both paths refer to the same file. This is only
+// known for the local file system.
+func (res *Restorer) isSameFile(a, b string) bool {
+	fa, err := res.Destination.Lstat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := res.Destination.Lstat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+// isDevice returns true if target exists and is a device.
+func (res *Restorer) isDevice(target string) bool {
+	fi, err := res.Destination.Lstat(target)
+	return err == nil && fs.IsDevice(fi)
+}
+
 // Snapshot returns the snapshot this restorer is configured to use.
 func (res *Restorer) Snapshot() *restic.Snapshot {
 	return res.sn
@@ -345,9 +965,11 @@ func (res *Restorer) Snapshot() *restic.Snapshot {
 const nVerifyWorkers = 8
 
 // VerifyFiles checks whether all regular files in the snapshot res.sn
-// have been successfully written to dst. It stops when it encounters an
-// error. It returns that error and the number of files it has successfully
-// verified.
+// have been successfully written to dst. The files are read in the blob
+// boundaries recorded in the snapshot and each segment is compared to the
+// hash of its blob. Existing files kept by RestoreTo are only checked if
+// VerifySkipped is set. It stops when it encounters an error. It returns that
+// error and the number of files it has successfully verified.
 func (res *Restorer) VerifyFiles(ctx context.Context, dst string) (int, error) {
 	type mustCheck struct {
 		node *restic.Node
@@ -370,6 +992,10 @@ func (res *Restorer) VerifyFiles(ctx context.Context, dst string) (int, error) {
 				if node.Type != "file" {
 					return nil
 				}
+				if _, ok := res.skipped[location]; ok && !res.VerifySkipped {
+					debug.Log("not verifying kept file %v", location)
+					return nil
+				}
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
@@ -385,14 +1011,15 @@ func (res *Restorer) VerifyFiles(ctx context.Context, dst string) (int, error) {
 		g.Go(func() (err error) {
 			var buf []byte
 			for job := range work {
-				buf, err = res.verifyFile(job.path, job.node, buf)
-				if err != nil {
+				buf, err = res.verifyFile(ctx, job.path, job.node, buf)
+				if err == nil {
+					atomic.AddUint64(&nchecked, 1)
+				} else {
 					err = res.Error(job.path, err)
 				}
 				if err != nil || ctx.Err() != nil {
 					break
 				}
-				atomic.AddUint64(&nchecked, 1)
 			}
 			return err
 		})
@@ -406,8 +1033,8 @@ func (res *Restorer) VerifyFiles(ctx context.Context, dst string) (int, error) {
 // buf and the first return value are scratch space, passed around for reuse.
 // Reusing buffers prevents the verifier goroutines allocating all of RAM and
 // flushing the filesystem cache (at least on Linux).
-func (res *Restorer) verifyFile(target string, node *restic.Node, buf []byte) ([]byte, error) {
-	f, err := os.Open(target)
+func (res *Restorer) verifyFile(ctx context.Context, target string, node *restic.Node, buf []byte) ([]byte, error) {
+	f, err := res.Destination.OpenFile(target, os.O_RDONLY, 0)
 	if err != nil {
 		return buf, err
 	}
@@ -424,6 +1051,7 @@ func (res *Restorer) verifyFile(target string, node *restic.Node, buf []byte) ([
 			target, node.Size, fi.Size())
 	}
 
+	hasher := res.repo.Config().BlobHasher()
 	var offset int64
 	for _, blobID := range node.Content {
 		length, found := res.repo.LookupBlobSize(blobID, restic.DataBlob)
@@ -440,13 +1068,30 @@ func (res *Restorer) verifyFile(target string, node *restic.Node, buf []byte) ([
 		if err != nil {
 			return buf, err
 		}
-		if !blobID.Equal(restic.Hash(buf)) {
+		if !blobID.Equal(hasher.Hash(buf)) {
 			return buf, errors.Errorf(
 				"Unexpected content in %s, starting at offset %d",
-				target, offset)
+				target, offset+res.mismatchOffset(ctx, blobID, buf))
 		}
 		offset += int64(length)
 	}
 
 	return buf, nil
 }
+
+// mismatchOffset returns the offset of the first byte in buf which differs
+// from the blob id. If the blob cannot be loaded, it returns zero.
+func (res *Restorer) mismatchOffset(ctx context.Context, id restic.ID, buf []byte) int64 {
+	blob, err := res.repo.LoadBlob(ctx, restic.DataBlob, id, nil)
+	if err != nil {
+		debug.Log("unable to load blob %v: %v", id, err)
+		return 0
+	}
+
+	for i := range buf {
+		if i >= len(blob) || buf[i] != blob[i] {
+			return int64(i)
+		}
+	}
+	return 0
+}
@@ -3,16 +3,19 @@ package restorer
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/errors"
 	"github.com/restic/restic/internal/fs"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
@@ -32,6 +35,13 @@ type File struct {
 	Inode   uint64
 	Mode    os.FileMode
 	ModTime time.Time
+
+	DeviceType string
+}
+
+type Symlink struct {
+	Target  string
+	ModTime time.Time
 }
 
 type Dir struct {
@@ -88,6 +98,21 @@ func saveDir(t testing.TB, repo restic.Repository, nodes map[string]Node, inode
 				Size:    uint64(len(n.(File).Data)),
 				Inode:   fi,
 				Links:   lc,
+
+				DeviceType: node.DeviceType,
+			})
+			rtest.OK(t, err)
+		case Symlink:
+			err := tree.Insert(&restic.Node{
+				Type:       "symlink",
+				Mode:       os.ModeSymlink | 0777,
+				ModTime:    node.ModTime,
+				Name:       name,
+				UID:        uint32(os.Getuid()),
+				GID:        uint32(os.Getgid()),
+				LinkTarget: node.Target,
+				Inode:      inode,
+				Links:      1,
 			})
 			rtest.OK(t, err)
 		case Dir:
@@ -791,6 +816,144 @@ func TestRestorerConsistentTimestampsAndPermissions(t *testing.T) {
 	}
 }
 
+// manyFilesSnapshot returns a snapshot with dirs directories, each containing
+// files small or empty files and a subdirectory with files files which share
+// their content.
+func manyFilesSnapshot(dirs, files int, modtime time.Time) Snapshot {
+	nodes := make(map[string]Node)
+	for i := 0; i < dirs; i++ {
+		dirNodes := make(map[string]Node)
+		subdirNodes := make(map[string]Node)
+		for j := 0; j < files; j++ {
+			data := ""
+			if j%10 != 0 {
+				data = fmt.Sprintf("content of file %d in dir %d\n", j, i)
+			}
+			dirNodes[fmt.Sprintf("file%d", j)] = File{Data: data, ModTime: modtime}
+			subdirNodes[fmt.Sprintf("file%d", j)] = File{Data: "shared content\n", ModTime: modtime}
+		}
+		dirNodes["subdir"] = Dir{Nodes: subdirNodes, ModTime: modtime}
+		nodes[fmt.Sprintf("dir%d", i)] = Dir{Nodes: dirNodes, ModTime: modtime}
+	}
+	return Snapshot{Nodes: nodes}
+}
+
+func TestRestorerWorkersTimestamps(t *testing.T) {
+	timeForTest := time.Date(2019, time.January, 9, 1, 46, 40, 0, time.UTC)
+
+	repo := repository.TestRepository(t)
+	sn, _ := saveSnapshot(t, repo, manyFilesSnapshot(5, 50, timeForTest))
+
+	for _, workers := range []int{1, 8} {
+		t.Run(fmt.Sprintf("workers-%d", workers), func(t *testing.T) {
+			res := NewRestorer(repo, sn, false, nil)
+			res.Workers = workers
+
+			tempdir := rtest.TempDir(t)
+			rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+
+			// directories must only be modified before their metadata is restored
+			err := filepath.Walk(tempdir, func(path string, fi os.FileInfo, err error) error {
+				if err != nil || path == tempdir {
+					return err
+				}
+				if !fi.ModTime().Equal(timeForTest) {
+					t.Errorf("%v has modification time %v, want %v", path, fi.ModTime(), timeForTest)
+				}
+				return nil
+			})
+			rtest.OK(t, err)
+
+			count, err := res.VerifyFiles(context.TODO(), tempdir)
+			rtest.OK(t, err)
+			rtest.Equals(t, 5*2*50, count)
+		})
+	}
+}
+
+// BenchmarkRestoreManyFiles compares restoring many small files sequentially
+// and using several workers.
+func BenchmarkRestoreManyFiles(b *testing.B) {
+	repo := repository.TestRepository(b)
+	sn, _ := saveSnapshot(b, repo, manyFilesSnapshot(100, 100, time.Now()))
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res := NewRestorer(repo, sn, false, nil)
+				res.Workers = workers
+				rtest.OK(b, res.RestoreTo(context.TODO(), b.TempDir()))
+			}
+		})
+	}
+}
+
+func TestRestorerDelta(t *testing.T) {
+	timeForTest := time.Date(2019, time.January, 9, 1, 46, 40, 0, time.UTC)
+
+	repo := repository.TestRepository(t)
+	sn, _ := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"unchanged": File{Data: "unchanged content", ModTime: timeForTest},
+			"touched":   File{Data: "touched content", ModTime: timeForTest},
+			"modified":  File{Data: "modified content", ModTime: timeForTest},
+			"empty":     File{ModTime: timeForTest},
+			"dir": Dir{
+				Nodes: map[string]Node{
+					"file": File{Data: "file in dir", ModTime: timeForTest},
+				},
+				ModTime: timeForTest,
+			},
+		},
+	})
+
+	for _, deltaContent := range []bool{false, true} {
+		tempdir := rtest.TempDir(t)
+		rtest.OK(t, NewRestorer(repo, sn, false, nil).RestoreTo(context.TODO(), tempdir))
+
+		rtest.OK(t, os.Chtimes(filepath.Join(tempdir, "touched"), time.Now(), time.Now()))
+		rtest.OK(t, os.WriteFile(filepath.Join(tempdir, "modified"), []byte("MODIFIED content"), 0644))
+		rtest.OK(t, os.WriteFile(filepath.Join(tempdir, "extra"), []byte("extra"), 0644))
+		rtest.OK(t, os.Mkdir(filepath.Join(tempdir, "dir", "extradir"), 0755))
+
+		res := NewRestorer(repo, sn, false, nil)
+		res.Overwrite = OverwriteIfChanged
+		res.DeltaContent = deltaContent
+		res.Delete = true
+		rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+
+		expected := Stats{
+			FilesSkipped: 3,
+			FilesDeleted: 2,
+			BytesWritten: uint64(len("touched content") + len("modified content")),
+		}
+		if deltaContent {
+			// the contents of touched have not changed
+			expected.FilesPatched = 2
+			expected.BytesWritten = uint64(len("modified content"))
+		} else {
+			expected.FilesReplaced = 2
+		}
+		rtest.Equals(t, expected, res.Stats())
+
+		for name, content := range map[string]string{
+			"unchanged": "unchanged content",
+			"touched":   "touched content",
+			"modified":  "modified content",
+			"empty":     "",
+			"dir/file":  "file in dir",
+		} {
+			data, err := os.ReadFile(filepath.Join(tempdir, name))
+			rtest.OK(t, err)
+			rtest.Equals(t, content, string(data))
+		}
+		for _, name := range []string{"extra", "dir/extradir"} {
+			_, err := os.Lstat(filepath.Join(tempdir, name))
+			rtest.Assert(t, os.IsNotExist(err), "%v was not deleted: %v", name, err)
+		}
+	}
+}
+
 // VerifyFiles must not report cancellation of its context through res.Error.
 func TestVerifyCancel(t *testing.T) {
 	snapshot := Snapshot{
@@ -825,6 +988,39 @@ func TestVerifyCancel(t *testing.T) {
 	rtest.Assert(t, strings.Contains(errs[0].Error(), "Invalid file size for"), "wrong error %q", errs[0].Error())
 }
 
+func TestVerifyFilesSkipped(t *testing.T) {
+	repo := repository.TestRepository(t)
+	sn, _ := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"kept":     File{Data: "content: kept\n"},
+			"restored": File{Data: "content: restored\n"},
+		},
+	})
+
+	tempdir := rtest.TempDir(t)
+	rtest.OK(t, os.WriteFile(filepath.Join(tempdir, "kept"), []byte("content: KEPT\n"), 0644))
+
+	res := NewRestorer(repo, sn, false, nil)
+	res.Overwrite = OverwriteNever
+	rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+
+	count, err := res.VerifyFiles(context.TODO(), tempdir)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, count)
+
+	var errs []error
+	res.Error = func(location string, err error) error {
+		errs = append(errs, err)
+		return nil
+	}
+	res.VerifySkipped = true
+	count, err = res.VerifyFiles(context.TODO(), tempdir)
+	rtest.OK(t, err)
+	rtest.Equals(t, 1, count)
+	rtest.Equals(t, 1, len(errs))
+	rtest.Assert(t, strings.Contains(errs[0].Error(), "starting at offset 9"), "wrong error %q", errs[0].Error())
+}
+
 func TestRestorerSparseFiles(t *testing.T) {
 	repo := repository.TestRepository(t)
 
@@ -875,3 +1071,85 @@ func TestRestorerSparseFiles(t *testing.T) {
 	t.Logf("wrote %d zeros as %d blocks, %.1f%% sparse",
 		len(zeros), blocks, 100*sparsity)
 }
+
+func TestRestorerSupportedMetadata(t *testing.T) {
+	node := &restic.Node{
+		Name: "file",
+		ExtendedAttributes: []restic.ExtendedAttribute{
+			{Name: "user.comment", Value: []byte("foo")},
+			{Name: "system.posix_acl_access", Value: []byte("bar")},
+		},
+	}
+
+	var tests = []struct {
+		caps     fs.Capabilities
+		noXattrs bool
+		noACLs   bool
+		attrs    []string
+		warns    int
+	}{
+		{caps: fs.CapXattrs | fs.CapACLs, attrs: []string{"user.comment", "system.posix_acl_access"}},
+		{caps: fs.CapXattrs, attrs: []string{"user.comment"}, warns: 1},
+		{caps: 0, warns: 1},
+		{caps: fs.CapXattrs | fs.CapACLs, noXattrs: true, attrs: []string{"system.posix_acl_access"}},
+		{caps: fs.CapXattrs | fs.CapACLs, noACLs: true, attrs: []string{"user.comment"}},
+		{caps: fs.CapXattrs | fs.CapACLs, noXattrs: true, noACLs: true},
+	}
+
+	for _, test := range tests {
+		var warnings []string
+		res := &Restorer{caps: test.caps, NoXattrs: test.noXattrs, NoACLs: test.noACLs}
+		res.Warn = func(msg string) {
+			warnings = append(warnings, msg)
+		}
+
+		// each warning is only printed once
+		for i := 0; i < 2; i++ {
+			var attrs []string
+			for _, attr := range res.supportedMetadata(node).ExtendedAttributes {
+				attrs = append(attrs, attr.Name)
+			}
+			rtest.Equals(t, test.attrs, attrs)
+		}
+		rtest.Equals(t, test.warns, len(warnings))
+		rtest.Equals(t, 2, len(node.ExtendedAttributes))
+	}
+}
+
+func TestRestorerXattrError(t *testing.T) {
+	unsupported := errors.Wrap(restic.ErrXattrUnsupported, "setxattr")
+	permission := &os.PathError{Op: "setxattr", Path: "file", Err: syscall.EPERM}
+	tooBig := &os.PathError{Op: "setxattr", Path: "file", Err: syscall.E2BIG}
+
+	res := &Restorer{}
+	for _, test := range []struct {
+		name    string
+		err     error
+		ignored bool
+	}{
+		{"user.comment", unsupported, true},
+		{"system.posix_acl_access", unsupported, true},
+		{"system.posix_acl_default", unsupported, true},
+		{"security.selinux", permission, true},
+		{"trusted.overlay", permission, true},
+		{"com.apple.ResourceFork", tooBig, true},
+		// real failures are reported
+		{"user.comment", permission, false},
+		{"system.posix_acl_access", permission, false},
+		{"user.comment", tooBig, false},
+	} {
+		err := res.xattrError(test.name, test.err)
+		if test.ignored {
+			rtest.OK(t, err)
+		} else {
+			rtest.Equals(t, test.err, err)
+		}
+	}
+
+	rtest.Equals(t, map[string]uint64{
+		AttrKindXattr:        1,
+		AttrKindACL:          2,
+		AttrKindSecurity:     2,
+		AttrKindResourceFork: 1,
+	}, res.SkippedAttributes())
+}
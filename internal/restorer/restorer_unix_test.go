@@ -4,13 +4,20 @@
 package restorer
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/restic/restic/internal/archiver"
+	"github.com/restic/restic/internal/fs"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 	rtest "github.com/restic/restic/internal/test"
@@ -59,6 +66,72 @@ func TestRestorerRestoreEmptyHardlinkedFileds(t *testing.T) {
 	}
 }
 
+func TestRestorerHardlinks(t *testing.T) {
+	repo := repository.TestRepository(t)
+
+	// the modes differ to check that the metadata is only restored once per
+	// inode, for the first link
+	sn, _ := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"dir1": Dir{
+				Nodes: map[string]Node{
+					"file1": File{Links: 3, Inode: 5, Data: "content", Mode: 0600},
+				},
+			},
+			"dir2": Dir{
+				Nodes: map[string]Node{
+					"file2": File{Links: 3, Inode: 5, Data: "content", Mode: 0644},
+					"file3": File{Links: 3, Inode: 5, Data: "content", Mode: 0644},
+				},
+			},
+		},
+	})
+
+	for _, test := range []struct {
+		name     string
+		excluded string
+		restored []string
+		warnings int
+	}{
+		{"all", "", []string{"dir1/file1", "dir2/file2", "dir2/file3"}, 0},
+		{"excluded target", "/dir1/file1", []string{"dir2/file2", "dir2/file3"}, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			res := NewRestorer(repo, sn, false, nil)
+			res.SelectFilter = func(item string, dstpath string, node *restic.Node) (bool, bool) {
+				return item != test.excluded, true
+			}
+			var warnings []string
+			res.Warn = func(msg string) {
+				warnings = append(warnings, msg)
+			}
+
+			tempdir := rtest.TempDir(t)
+			rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+			rtest.Equals(t, test.warnings, len(warnings))
+
+			var first *syscall.Stat_t
+			for _, name := range test.restored {
+				data, err := os.ReadFile(filepath.Join(tempdir, name))
+				rtest.OK(t, err)
+				rtest.Equals(t, "content", string(data))
+
+				fi, err := os.Stat(filepath.Join(tempdir, name))
+				rtest.OK(t, err)
+				st := fi.Sys().(*syscall.Stat_t)
+				if first == nil {
+					first = st
+				}
+				rtest.Equals(t, first.Ino, st.Ino)
+				rtest.Equals(t, uint64(len(test.restored)), uint64(st.Nlink))
+				if test.excluded == "" {
+					rtest.Equals(t, os.FileMode(0600), fi.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
 func getBlockCount(t *testing.T, filename string) int64 {
 	fi, err := os.Stat(filename)
 	rtest.OK(t, err)
@@ -71,6 +144,7 @@ func getBlockCount(t *testing.T, filename string) int64 {
 
 type printerMock struct {
 	filesFinished, filesTotal, allBytesWritten, allBytesTotal uint64
+	actions                                                   map[string]restoreui.ItemAction
 }
 
 func (p *printerMock) Update(_, _, _, _ uint64, _ time.Duration) {
@@ -81,6 +155,17 @@ func (p *printerMock) Finish(filesFinished, filesTotal, allBytesWritten, allByte
 	p.allBytesWritten = allBytesWritten
 	p.allBytesTotal = allBytesTotal
 }
+func (p *printerMock) CompleteItem(action restoreui.ItemAction, item string, _ uint64) {
+	if p.actions == nil {
+		p.actions = make(map[string]restoreui.ItemAction)
+	}
+	p.actions[item] = action
+}
+func (p *printerMock) StartItem(_ string, _ uint64) {
+}
+func (p *printerMock) Error(_ string, err error) error {
+	return err
+}
 
 func TestRestorerProgressBar(t *testing.T) {
 	repo := repository.TestRepository(t)
@@ -121,3 +206,192 @@ func TestRestorerProgressBar(t *testing.T) {
 	rtest.Assert(t, mock.allBytesWritten == allBytesWritten, "allBytesWritten: expected %v, got %v", allBytesWritten, mock.allBytesWritten)
 	rtest.Assert(t, mock.allBytesTotal == allBytesTotal, "allBytesTotal: expected %v, got %v", allBytesTotal, mock.allBytesTotal)
 }
+
+func TestRestorerWriteToDevices(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the device numbers of /dev/null are only known on Linux")
+	}
+
+	repo := repository.TestRepository(t)
+
+	sn, _ := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"device": File{Data: "contents of a block device", DeviceType: "dev"},
+		},
+	})
+
+	for _, writeToDevices := range []bool{false, true} {
+		tempdir := rtest.TempDir(t)
+		target := filepath.Join(tempdir, "device")
+		// use a character device which behaves like /dev/null
+		if err := syscall.Mknod(target, syscall.S_IFCHR|0600, 1<<8|3); err != nil {
+			t.Skipf("unable to create device: %v", err)
+		}
+
+		res := NewRestorer(repo, sn, false, nil)
+		res.WriteToDevices = writeToDevices
+		var errs []error
+		res.Error = func(location string, err error) error {
+			errs = append(errs, err)
+			return nil
+		}
+
+		rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+		rtest.Equals(t, !writeToDevices, len(errs) == 1)
+
+		fi, err := os.Lstat(target)
+		rtest.OK(t, err)
+		rtest.Assert(t, fi.Mode()&os.ModeDevice != 0, "device at %v was replaced", target)
+		rtest.Equals(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	// without an existing device, a regular file is created
+	tempdir := rtest.TempDir(t)
+	res := NewRestorer(repo, sn, false, nil)
+	rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+
+	data, err := os.ReadFile(filepath.Join(tempdir, "device"))
+	rtest.OK(t, err)
+	rtest.Equals(t, "contents of a block device", string(data))
+}
+
+// supportsSparseFiles returns true if the file system containing dir does
+// not allocate blocks for holes.
+func supportsSparseFiles(t *testing.T, dir string) bool {
+	f, err := os.CreateTemp(dir, "sparse-probe")
+	rtest.OK(t, err)
+	defer func() {
+		rtest.OK(t, f.Close())
+		rtest.OK(t, os.Remove(f.Name()))
+	}()
+
+	rtest.OK(t, f.Truncate(1<<20))
+	_, err = f.WriteAt([]byte{1}, 1<<20-1)
+	rtest.OK(t, err)
+	return getBlockCount(t, f.Name())*512 < 1<<20
+}
+
+func TestRestorerSparseHoles(t *testing.T) {
+	repo := repository.TestRepository(t)
+
+	// zeros within a chunk, surrounded by data
+	data := make([]byte, 5<<20)
+	rnd := rand.New(rand.NewSource(42))
+	_, _ = rnd.Read(data[:100<<10])
+	_, _ = rnd.Read(data[len(data)-100<<10:])
+
+	target := &fs.Reader{
+		Mode:       0600,
+		Name:       "/image",
+		ReadCloser: io.NopCloser(bytes.NewReader(data)),
+	}
+	arch := archiver.New(repo, target, archiver.Options{})
+	sn, _, err := arch.Snapshot(context.TODO(), []string{"/image"}, archiver.SnapshotOptions{})
+	rtest.OK(t, err)
+
+	blocks := make(map[bool]int64)
+	for _, sparse := range []bool{false, true} {
+		tempdir := rtest.TempDir(t)
+		if sparse && !supportsSparseFiles(t, tempdir) {
+			t.Skip("file system does not support sparse files")
+		}
+
+		res := NewRestorer(repo, sn, sparse, nil)
+		rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+
+		filename := filepath.Join(tempdir, "image")
+		content, err := os.ReadFile(filename)
+		rtest.OK(t, err)
+		rtest.Assert(t, bytes.Equal(data, content), "restored file has wrong content")
+		blocks[sparse] = getBlockCount(t, filename)
+	}
+
+	t.Logf("restored %d bytes as %d blocks, sparse %d blocks", len(data), blocks[false], blocks[true])
+	// st.Blocks is the size in 512-byte blocks.
+	rtest.Assert(t, blocks[false]*512 >= int64(len(data)), "dense file only uses %d blocks", blocks[false])
+	rtest.Assert(t, blocks[true]*512 < 1<<20, "sparse file uses %d blocks", blocks[true])
+}
+
+func TestRestorerOverwrite(t *testing.T) {
+	timeForTest := time.Date(2019, time.January, 9, 1, 46, 40, 0, time.UTC)
+
+	repo := repository.TestRepository(t)
+	sn, _ := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"dir": Dir{
+				Nodes: map[string]Node{
+					"file": File{Data: "content", ModTime: timeForTest},
+					"link": Symlink{Target: "file", ModTime: timeForTest},
+				},
+				Mode:    0700,
+				ModTime: timeForTest,
+			},
+		},
+	})
+
+	for _, test := range []struct {
+		overwrite OverwriteBehavior
+		// fileTime is the modification time of the existing file
+		fileTime time.Time
+		fileKept bool
+		linkKept bool
+	}{
+		{OverwriteAlways, timeForTest, false, false},
+		{OverwriteIfChanged, timeForTest, false, false},
+		{OverwriteIfNewer, timeForTest.Add(-time.Hour), false, true},
+		{OverwriteIfNewer, timeForTest.Add(time.Hour), true, true},
+		{OverwriteNever, timeForTest, true, true},
+	} {
+		t.Run(fmt.Sprintf("%v-%v", test.overwrite.String(), test.fileKept), func(t *testing.T) {
+			tempdir := rtest.TempDir(t)
+			dir := filepath.Join(tempdir, "dir")
+			rtest.OK(t, os.Mkdir(dir, 0755))
+			rtest.OK(t, os.WriteFile(filepath.Join(dir, "file"), []byte("local"), 0644))
+			rtest.OK(t, os.Chtimes(filepath.Join(dir, "file"), test.fileTime, test.fileTime))
+			// the symlink is newer than the snapshot
+			rtest.OK(t, os.Symlink("other", filepath.Join(dir, "link")))
+
+			mock := &printerMock{}
+			progress := restoreui.NewProgress(mock, 0)
+			res := NewRestorer(repo, sn, false, progress)
+			res.Overwrite = test.overwrite
+			rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+			progress.Finish()
+
+			data, err := os.ReadFile(filepath.Join(dir, "file"))
+			rtest.OK(t, err)
+			linkTarget, err := os.Readlink(filepath.Join(dir, "link"))
+			rtest.OK(t, err)
+
+			var expected Stats
+			actions := map[string]restoreui.ItemAction{"/dir": restoreui.ActionReplaced}
+			if test.fileKept {
+				rtest.Equals(t, "local", string(data))
+				expected.FilesSkipped++
+				actions["/dir/file"] = restoreui.ActionSkipped
+			} else {
+				rtest.Equals(t, "content", string(data))
+				expected.FilesReplaced++
+				expected.BytesWritten = uint64(len("content"))
+				actions["/dir/file"] = restoreui.ActionReplaced
+			}
+			if test.linkKept {
+				rtest.Equals(t, "other", linkTarget)
+				expected.FilesSkipped++
+				actions["/dir/link"] = restoreui.ActionSkipped
+			} else {
+				rtest.Equals(t, "file", linkTarget)
+				expected.FilesReplaced++
+				actions["/dir/link"] = restoreui.ActionReplaced
+			}
+			rtest.Equals(t, expected, res.Stats())
+			rtest.Equals(t, actions, mock.actions)
+
+			// the directory metadata is restored in all cases
+			fi, err := os.Lstat(dir)
+			rtest.OK(t, err)
+			rtest.Equals(t, os.FileMode(0700), fi.Mode().Perm())
+			rtest.Assert(t, fi.ModTime().Equal(timeForTest), "unexpected modification time %v of dir", fi.ModTime())
+		})
+	}
+}
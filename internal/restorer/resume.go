@@ -0,0 +1,274 @@
+package restorer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+)
+
+// StateFileName is the name of the state file in the target directory, unless
+// another path is used.
+const StateFileName = ".restic-restore-state"
+
+// Completed files are appended to the state file in batches of
+// stateBatchSize entries, or after stateBatchInterval.
+const (
+	stateBatchSize     = 1000
+	stateBatchInterval = 5 * time.Second
+)
+
+// State records the regular files completed by RestoreTo, so that an
+// interrupted restore can be resumed without rewriting them. The state file is
+// a header followed by one JSON line per file. Completed files are appended in
+// batches, each with a single write. An incomplete last line left by a crash
+// is ignored when the file is loaded.
+type State struct {
+	path string
+
+	m         sync.Mutex
+	f         *os.File
+	buf       bytes.Buffer
+	pending   int
+	lastFlush time.Time
+
+	// completed are the files recorded by the interrupted restore and those
+	// added since
+	completed map[string]stateEntry
+}
+
+type stateHeader struct {
+	Version  int       `json:"version"`
+	Snapshot restic.ID `json:"snapshot"`
+	Tree     restic.ID `json:"tree"`
+}
+
+type stateEntry struct {
+	Path    string    `json:"path"`
+	Size    uint64    `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Content is the hash of the blob IDs of the file
+	Content restic.ID `json:"content"`
+}
+
+const stateVersion = 1
+
+// OpenState opens the state file at path for the restore of tree from the
+// snapshot. With resume, the files recorded by an interrupted restore are
+// loaded. It is an error if that restore was started for another snapshot or
+// tree. A missing state file is created. Without resume, an existing state
+// file is replaced.
+func OpenState(path string, snapshot, tree restic.ID, resume bool) (*State, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Abs")
+	}
+	s := &State{path: path, completed: make(map[string]stateEntry), lastFlush: time.Now()}
+
+	if resume {
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err == nil {
+			err = s.load(f, snapshot, tree)
+			if err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+			s.f = f
+			return s, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "OpenFile")
+		}
+		debug.Log("state file %v does not exist, starting a new restore", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenFile")
+	}
+	s.f = f
+
+	header, err := json.Marshal(stateHeader{Version: stateVersion, Snapshot: snapshot, Tree: tree})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "Write")
+	}
+	return s, nil
+}
+
+// load reads the header and the completed files from f and positions f after
+// the last complete line.
+func (s *State) load(f *os.File, snapshot, tree restic.ID) error {
+	rd := bufio.NewReader(f)
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return errors.Fatalf("state file %v is damaged, restore without --resume", s.path)
+	}
+
+	var header stateHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.Version != stateVersion {
+		return errors.Fatalf("state file %v is damaged, restore without --resume", s.path)
+	}
+	if !header.Snapshot.Equal(snapshot) {
+		return errors.Fatalf("state file %v belongs to snapshot %v, cannot resume the restore of snapshot %v",
+			s.path, header.Snapshot.Str(), snapshot.Str())
+	}
+	if !header.Tree.Equal(tree) {
+		return errors.Fatalf("state file %v belongs to another subfolder of snapshot %v", s.path, snapshot.Str())
+	}
+
+	offset := int64(len(line))
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			// drop an incomplete last line
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "ReadBytes")
+		}
+		offset += int64(len(line))
+
+		var entry stateEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			debug.Log("ignoring invalid line in state file: %v", err)
+			continue
+		}
+		s.completed[entry.Path] = entry
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		return errors.Wrap(err, "Truncate")
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	return errors.Wrap(err, "Seek")
+}
+
+// contentHash returns the hash of the blob IDs of node.
+func contentHash(node *restic.Node) restic.ID {
+	buf := make([]byte, 0, len(node.Content)*len(restic.ID{}))
+	for _, id := range node.Content {
+		buf = append(buf, id[:]...)
+	}
+	return restic.Hash(buf)
+}
+
+// isCompleted returns true if the file at location was recorded as complete
+// and fi, the current file info of its target, still matches the recorded
+// size and modification time.
+func (s *State) isCompleted(node *restic.Node, location string, fi os.FileInfo) bool {
+	s.m.Lock()
+	entry, ok := s.completed[location]
+	s.m.Unlock()
+
+	return ok && node.Type == "file" && entry.Size == node.Size &&
+		fi.Mode().IsRegular() && fi.Size() == int64(entry.Size) &&
+		fi.ModTime().Equal(entry.ModTime) && entry.Content.Equal(contentHash(node))
+}
+
+// has returns true if the file at location was recorded as complete.
+func (s *State) has(location string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok := s.completed[location]
+	return ok
+}
+
+// add records that the contents of the file node at location are complete,
+// fi is the current file info of its target.
+func (s *State) add(node *restic.Node, location string, fi os.FileInfo) error {
+	entry := stateEntry{
+		Path:    location,
+		Size:    node.Size,
+		ModTime: fi.ModTime(),
+		Content: contentHash(node),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.completed[location] = entry
+	s.buf.Write(line)
+	s.buf.WriteByte('\n')
+	s.pending++
+	if s.pending < stateBatchSize && time.Since(s.lastFlush) < stateBatchInterval {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush appends the pending entries to the state file. s.m must be held.
+func (s *State) flush() error {
+	s.lastFlush = time.Now()
+	if s.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := s.f.Write(s.buf.Bytes())
+	s.buf.Reset()
+	s.pending = 0
+	if err != nil {
+		return errors.Wrap(err, "Write")
+	}
+	return errors.Wrap(s.f.Sync(), "Sync")
+}
+
+// Path returns the path of the state file.
+func (s *State) Path() string {
+	return s.path
+}
+
+// Close writes the pending entries and closes the state file.
+func (s *State) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := s.flush()
+	if cerr := s.f.Close(); err == nil {
+		err = errors.Wrap(cerr, "Close")
+	}
+	return err
+}
+
+// Remove closes and removes the state file once the restore is complete.
+func (s *State) Remove() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return errors.Wrap(os.Remove(s.path), "Remove")
+}
+
+// isCompleted returns true if the file node at target was completed by an
+// interrupted restore and has not been modified since.
+func (res *Restorer) isCompleted(node *restic.Node, target, location string) bool {
+	if res.State == nil || node.Type != "file" || node.Size == 0 {
+		return false
+	}
+	fi, err := res.Destination.Lstat(target)
+	return err == nil && res.State.isCompleted(node, location, fi)
+}
+
+// recordCompleted records in res.State that the contents of the file node at
+// target are complete.
+func (res *Restorer) recordCompleted(node *restic.Node, target, location string) error {
+	fi, err := res.Destination.Lstat(target)
+	if err != nil {
+		return err
+	}
+	return res.State.add(node, location, fi)
+}
@@ -0,0 +1,186 @@
+package restorer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/repository"
+	"github.com/restic/restic/internal/restic"
+	rtest "github.com/restic/restic/internal/test"
+)
+
+func TestRestorerResume(t *testing.T) {
+	timeForTest := time.Date(2019, time.January, 9, 1, 46, 40, 0, time.UTC)
+
+	repo := repository.TestRepository(t)
+	sn, id := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"complete": File{Data: "complete content", ModTime: timeForTest},
+			"partial":  File{Data: "partial content", ModTime: timeForTest},
+			"missing":  File{Data: "missing content", ModTime: timeForTest},
+			"dir": Dir{
+				Nodes: map[string]Node{
+					"file": File{Data: "file in dir", ModTime: timeForTest},
+				},
+				ModTime: timeForTest,
+			},
+		},
+	})
+
+	tempdir := rtest.TempDir(t)
+	stateFile := filepath.Join(tempdir, StateFileName)
+
+	res := NewRestorer(repo, sn, false, nil)
+	state, err := OpenState(stateFile, id, *sn.Tree, false)
+	rtest.OK(t, err)
+	res.State = state
+	rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+	// keep the state file as if the restore was interrupted
+	rtest.OK(t, state.Close())
+
+	// partial was not written completely and missing not at all
+	rtest.OK(t, os.Truncate(filepath.Join(tempdir, "partial"), 4))
+	rtest.OK(t, os.Remove(filepath.Join(tempdir, "missing")))
+
+	res = NewRestorer(repo, sn, false, nil)
+	res.Delete = true
+	state, err = OpenState(stateFile, id, *sn.Tree, true)
+	rtest.OK(t, err)
+	res.State = state
+	rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+
+	stats := res.Stats()
+	rtest.Equals(t, uint64(2), stats.FilesResumed)
+	rtest.Equals(t, uint64(len("partial content")+len("missing content")), stats.BytesWritten)
+	// the state file is not deleted by --delete
+	rtest.Equals(t, uint64(0), stats.FilesDeleted)
+
+	for name, data := range map[string]string{
+		"complete": "complete content",
+		"partial":  "partial content",
+		"missing":  "missing content",
+		"dir/file": "file in dir",
+	} {
+		buf, err := os.ReadFile(filepath.Join(tempdir, filepath.FromSlash(name)))
+		rtest.OK(t, err)
+		rtest.Equals(t, data, string(buf))
+		fi, err := os.Lstat(filepath.Join(tempdir, filepath.FromSlash(name)))
+		rtest.OK(t, err)
+		rtest.Assert(t, fi.ModTime().Equal(timeForTest), "wrong mtime %v for %v", fi.ModTime(), name)
+	}
+
+	rtest.OK(t, state.Remove())
+	_, err = os.Lstat(stateFile)
+	rtest.Assert(t, os.IsNotExist(err), "state file was not removed: %v", err)
+}
+
+func TestRestorerResumeWithoutData(t *testing.T) {
+	repo := repository.TestRepository(t)
+	sn, id := saveSnapshot(t, repo, Snapshot{
+		Nodes: map[string]Node{
+			"foo": File{Data: "content: foo"},
+			"dir": Dir{
+				Nodes: map[string]Node{
+					"bar": File{Data: "content: bar"},
+				},
+			},
+		},
+	})
+
+	tempdir := rtest.TempDir(t)
+	stateFile := filepath.Join(rtest.TempDir(t), "state")
+
+	res := NewRestorer(repo, sn, false, nil)
+	state, err := OpenState(stateFile, id, *sn.Tree, false)
+	rtest.OK(t, err)
+	res.State = state
+	rtest.OK(t, res.RestoreTo(context.TODO(), tempdir))
+	rtest.OK(t, state.Close())
+
+	// completed files must not be loaded again
+	ctx := context.TODO()
+	repo.Index().Each(ctx, func(pb restic.PackedBlob) {
+		if pb.Type == restic.DataBlob {
+			_ = repo.Backend().Remove(ctx, backend.Handle{Type: restic.PackFile, Name: pb.PackID.String()})
+		}
+	})
+
+	res = NewRestorer(repo, sn, false, nil)
+	state, err = OpenState(stateFile, id, *sn.Tree, true)
+	rtest.OK(t, err)
+	res.State = state
+	rtest.OK(t, res.RestoreTo(ctx, tempdir))
+	rtest.OK(t, state.Close())
+	rtest.Equals(t, uint64(2), res.Stats().FilesResumed)
+	rtest.Equals(t, uint64(0), res.Stats().BytesWritten)
+}
+
+func TestStateMismatch(t *testing.T) {
+	stateFile := filepath.Join(rtest.TempDir(t), "state")
+	snapshot, tree := restic.NewRandomID(), restic.NewRandomID()
+
+	state, err := OpenState(stateFile, snapshot, tree, false)
+	rtest.OK(t, err)
+	rtest.OK(t, state.Close())
+
+	_, err = OpenState(stateFile, restic.NewRandomID(), tree, true)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "belongs to snapshot"), "unexpected error %v", err)
+	_, err = OpenState(stateFile, snapshot, restic.NewRandomID(), true)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "another subfolder"), "unexpected error %v", err)
+
+	// without resume, the state file is replaced
+	state, err = OpenState(stateFile, restic.NewRandomID(), tree, false)
+	rtest.OK(t, err)
+	rtest.OK(t, state.Close())
+
+	rtest.OK(t, os.WriteFile(stateFile, []byte("garbage"), 0600))
+	_, err = OpenState(stateFile, snapshot, tree, true)
+	rtest.Assert(t, err != nil && strings.Contains(err.Error(), "damaged"), "unexpected error %v", err)
+}
+
+func TestStateIncompleteLine(t *testing.T) {
+	stateFile := filepath.Join(rtest.TempDir(t), "state")
+	snapshot, tree := restic.NewRandomID(), restic.NewRandomID()
+	node := &restic.Node{Type: "file", Size: 4, Content: restic.IDs{restic.NewRandomID()}}
+
+	tempfile := filepath.Join(rtest.TempDir(t), "file")
+	rtest.OK(t, os.WriteFile(tempfile, []byte("data"), 0600))
+	fi, err := os.Lstat(tempfile)
+	rtest.OK(t, err)
+
+	state, err := OpenState(stateFile, snapshot, tree, false)
+	rtest.OK(t, err)
+	rtest.OK(t, state.add(node, "/file", fi))
+	rtest.OK(t, state.Close())
+
+	// simulate a crash while appending an entry
+	f, err := os.OpenFile(stateFile, os.O_APPEND|os.O_WRONLY, 0600)
+	rtest.OK(t, err)
+	_, err = f.WriteString(`{"path":"/oth`)
+	rtest.OK(t, err)
+	rtest.OK(t, f.Close())
+
+	state, err = OpenState(stateFile, snapshot, tree, true)
+	rtest.OK(t, err)
+	rtest.Assert(t, state.isCompleted(node, "/file", fi), "entry was not loaded")
+	rtest.Assert(t, !state.has("/oth"), "incomplete entry was loaded")
+
+	// a file with another size or modification time is incomplete
+	rtest.OK(t, os.WriteFile(tempfile, []byte("da"), 0600))
+	fi, err = os.Lstat(tempfile)
+	rtest.OK(t, err)
+	rtest.Assert(t, !state.isCompleted(node, "/file", fi), "modified file is complete")
+
+	// new entries are appended after the last complete line
+	rtest.OK(t, state.add(node, "/other", fi))
+	rtest.OK(t, state.Close())
+	data, err := os.ReadFile(stateFile)
+	rtest.OK(t, err)
+	rtest.Equals(t, 3, strings.Count(string(data), "\n"))
+	rtest.Assert(t, strings.Count(string(data), `"/oth`) == 1, "incomplete entry was not removed: %q", data)
+}
@@ -4,34 +4,64 @@
 package restorer
 
 import (
+	"bytes"
+
 	"github.com/restic/restic/internal/restic"
 )
 
-// WriteAt writes p to f.File at offset. It tries to do a sparse write
+// minHoleSize is the minimum length of a run of zeros which is skipped
+// instead of written. Shorter runs are written together with the
+// surrounding data to avoid excessive numbers of small writes.
+const minHoleSize = 4096
+
+// WriteAt writes p to f.WritableFile at offset. It tries to do a sparse write
 // and updates f.size.
 func (f *partialFile) WriteAt(p []byte, offset int64) (n int, err error) {
 	if !f.sparse {
-		return f.File.WriteAt(p, offset)
+		return f.WritableFile.WriteAt(p, offset)
 	}
 
-	n = len(p)
-
-	// Skip the longest all-zero prefix of p.
-	// If it's long enough, we can punch a hole in the file.
-	skipped := restic.ZeroPrefixLen(p)
-	p = p[skipped:]
-	offset += int64(skipped)
-
-	switch {
-	case len(p) == 0:
-		// All zeros, file already big enough. A previous WriteAt or
-		// Truncate will have produced the zeros in f.File.
+	// The file has already been truncated to its final size, thus all
+	// regions which are not written read as zeros. On file systems which
+	// support sparse files, these regions do not consume disk space.
+	for len(p) > 0 {
+		// Skip the longest all-zero prefix of p.
+		skipped := restic.ZeroPrefixLen(p)
+		p = p[skipped:]
+		offset += int64(skipped)
+		n += skipped
+		if len(p) == 0 {
+			break
+		}
 
-	default:
+		length := dataLen(p)
 		var n2 int
-		n2, err = f.File.WriteAt(p, offset)
-		n = skipped + n2
+		n2, err = f.WritableFile.WriteAt(p[:length], offset)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+		p = p[length:]
+		offset += int64(length)
 	}
 
-	return n, err
+	return n, nil
+}
+
+// dataLen returns the length of the prefix of p which ends at the first run
+// of at least minHoleSize zeros.
+func dataLen(p []byte) int {
+	i := 0
+	for {
+		zero := bytes.IndexByte(p[i:], 0)
+		if zero < 0 {
+			return len(p)
+		}
+		i += zero
+		zeros := restic.ZeroPrefixLen(p[i:])
+		if zeros >= minHoleSize || i+zeros == len(p) {
+			return i
+		}
+		i += zeros
+	}
 }
@@ -0,0 +1,131 @@
+package restorer
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// workerPool runs jobs on a fixed number of goroutines. The context of the
+// pool is canceled as soon as a job returns an error.
+type workerPool struct {
+	ctx  context.Context
+	wg   *errgroup.Group
+	jobs chan func() error
+}
+
+func newWorkerPool(ctx context.Context, workers int) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	wg, ctx := errgroup.WithContext(ctx)
+	p := &workerPool{
+		ctx:  ctx,
+		wg:   wg,
+		jobs: make(chan func() error, workers),
+	}
+	for i := 0; i < workers; i++ {
+		wg.Go(func() error {
+			for job := range p.jobs {
+				if err := job(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return p
+}
+
+// submit schedules job, it blocks until a worker is available.
+func (p *workerPool) submit(job func() error) error {
+	select {
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	case p.jobs <- job:
+		return nil
+	}
+}
+
+// wait waits until all submitted jobs have completed and returns the first
+// error. No jobs must be submitted afterwards.
+func (p *workerPool) wait() error {
+	close(p.jobs)
+	return p.wg.Wait()
+}
+
+// pendingDir is a directory whose metadata can only be restored once all of
+// its children have been restored, as creating them modifies the directory.
+type pendingDir struct {
+	parent *pendingDir
+	// pending is the number of children which have not been restored yet,
+	// plus one while the directory is still being traversed.
+	pending int32
+	// finish restores the metadata of the directory.
+	finish func() error
+}
+
+// done marks a child of d as restored. Once no children are pending, the
+// metadata of d is restored and d is reported as done to its parent.
+func (d *pendingDir) done() error {
+	for ; d != nil; d = d.parent {
+		if atomic.AddInt32(&d.pending, -1) != 0 {
+			return nil
+		}
+		if d.finish != nil {
+			if err := d.finish(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pendingDirs tracks the directories on the current path of a tree
+// traversal. It must only be used from the traversing goroutine, only done
+// may be called concurrently.
+type pendingDirs struct {
+	root *pendingDir
+	dirs map[string]*pendingDir
+}
+
+func newPendingDirs(root string) *pendingDirs {
+	d := &pendingDir{pending: 1}
+	return &pendingDirs{
+		root: d,
+		dirs: map[string]*pendingDir{root: d},
+	}
+}
+
+// get returns the directory at target, it is added to its parent
+// directory if necessary.
+func (p *pendingDirs) get(target string) *pendingDir {
+	if d, ok := p.dirs[target]; ok {
+		return d
+	}
+	parent := p.get(filepath.Dir(target))
+	atomic.AddInt32(&parent.pending, 1)
+	d := &pendingDir{parent: parent, pending: 1}
+	p.dirs[target] = d
+	return d
+}
+
+// addChild adds a child to the directory containing target.
+func (p *pendingDirs) addChild(target string) *pendingDir {
+	d := p.get(filepath.Dir(target))
+	atomic.AddInt32(&d.pending, 1)
+	return d
+}
+
+// leave marks the traversal of the directory at target as complete. The
+// metadata of the directory is restored using finish once all children are
+// done. The returned function must be called to release the directory.
+func (p *pendingDirs) leave(target string, finish func() error) (done func() error) {
+	d := p.get(target)
+	d.finish = finish
+	delete(p.dirs, target)
+	return d.done
+}
@@ -39,7 +39,7 @@ func (b *JSONProgress) error(status interface{}) {
 }
 
 // Update updates the status lines.
-func (b *JSONProgress) Update(total, processed Counter, errors uint, currentFiles map[string]struct{}, start time.Time, secs uint64) {
+func (b *JSONProgress) Update(total, processed Counter, errors uint, currentFiles map[string]FileProgress, start time.Time, secs uint64) {
 	status := statusUpdate{
 		MessageType:      "status",
 		SecondsElapsed:   uint64(time.Since(start) / time.Second),
@@ -52,13 +52,23 @@ func (b *JSONProgress) Update(total, processed Counter, errors uint, currentFile
 	}
 
 	if total.Bytes > 0 {
-		status.PercentDone = float64(processed.Bytes) / float64(total.Bytes)
+		status.PercentDone = float64(processed.sizedBytes()) / float64(total.Bytes)
 	}
 
-	for filename := range currentFiles {
+	for filename, fp := range currentFiles {
 		status.CurrentFiles = append(status.CurrentFiles, filename)
+		if fp.Total > 0 {
+			status.CurrentFileProgress = append(status.CurrentFileProgress, fileProgressUpdate{
+				Path:       filename,
+				BytesDone:  fp.Read,
+				TotalBytes: fp.Total,
+			})
+		}
 	}
 	sort.Strings(status.CurrentFiles)
+	sort.Slice(status.CurrentFileProgress, func(i, k int) bool {
+		return status.CurrentFileProgress[i].Path < status.CurrentFileProgress[k].Path
+	})
 
 	b.print(status)
 }
@@ -149,6 +159,22 @@ func (b *JSONProgress) CompleteItem(messageType, item string, s archiver.ItemSta
 	}
 }
 
+// DryRunFile prints a file which would be added or modified by a dry run.
+func (b *JSONProgress) DryRunFile(action, item string, reason archiver.ChangeReason, size uint64, s archiver.ItemStats) {
+	if b.v < 2 {
+		return
+	}
+	b.print(dryRunFileUpdate{
+		MessageType:    "dry_run_file",
+		Action:         action,
+		Item:           item,
+		Reason:         string(reason),
+		Size:           size,
+		DataSize:       s.DataSize,
+		DataSizeInRepo: s.DataSizeInRepo,
+	})
+}
+
 // ReportTotal sets the total stats up to now
 func (b *JSONProgress) ReportTotal(start time.Time, s archiver.ScanStats) {
 	if b.v >= 2 {
@@ -164,7 +190,13 @@ func (b *JSONProgress) ReportTotal(start time.Time, s archiver.ScanStats) {
 
 // Finish prints the finishing messages.
 func (b *JSONProgress) Finish(snapshotID restic.ID, start time.Time, summary *Summary, dryRun bool) {
-	b.print(summaryOutput{
+	id := ""
+	// a null ID means the snapshot was skipped
+	if !snapshotID.IsNull() {
+		id = snapshotID.String()
+	}
+
+	out := summaryOutput{
 		MessageType:         "summary",
 		FilesNew:            summary.Files.New,
 		FilesChanged:        summary.Files.Changed,
@@ -175,12 +207,34 @@ func (b *JSONProgress) Finish(snapshotID restic.ID, start time.Time, summary *Su
 		DataBlobs:           summary.ItemStats.DataBlobs,
 		TreeBlobs:           summary.ItemStats.TreeBlobs,
 		DataAdded:           summary.ItemStats.DataSize + summary.ItemStats.TreeSize,
+		DataSize:            summary.ItemStats.DataSize,
+		DataSizeInRepo:      summary.ItemStats.DataSizeInRepo,
+		MetadataSize:        summary.ItemStats.TreeSize,
+		MetadataSizeInRepo:  summary.ItemStats.TreeSizeInRepo,
 		TotalFilesProcessed: summary.Files.New + summary.Files.Changed + summary.Files.Unchanged,
 		TotalBytesProcessed: summary.ProcessedBytes,
 		TotalDuration:       time.Since(start).Seconds(),
-		SnapshotID:          snapshotID.String(),
+		SnapshotID:          id,
+		SnapshotSkipped:     snapshotID.IsNull(),
 		DryRun:              dryRun,
-	})
+		ModifiedFiles:       summary.ModifiedFiles,
+		ExpectedBytes:       summary.ExpectedBytes,
+		FailedItems:         summary.FailedItems,
+		StalledDuration:     summary.Stalled.Seconds(),
+		Connections:         summary.Connections,
+		ConnectionHistory:   summary.ConnectionHistory,
+		Uploads:             summary.Uploads,
+		UploadParallelism:   summary.UploadParallelism,
+		UploadWaitDuration:  summary.UploadWaited.Seconds(),
+	}
+	if dryRun {
+		out.BytesToRead = summary.BytesToRead
+		if summary.Scanned != nil {
+			out.ScannedFiles = summary.Scanned.Files
+			out.ScannedBytes = summary.Scanned.Bytes
+		}
+	}
+	b.print(out)
 }
 
 // Reset no-op
@@ -198,6 +252,14 @@ type statusUpdate struct {
 	BytesDone        uint64   `json:"bytes_done,omitempty"`
 	ErrorCount       uint     `json:"error_count,omitempty"`
 	CurrentFiles     []string `json:"current_files,omitempty"`
+
+	CurrentFileProgress []fileProgressUpdate `json:"current_file_progress,omitempty"`
+}
+
+type fileProgressUpdate struct {
+	Path       string `json:"path"`
+	BytesDone  uint64 `json:"bytes_done"`
+	TotalBytes uint64 `json:"total_bytes"`
 }
 
 type errorUpdate struct {
@@ -220,19 +282,46 @@ type verboseUpdate struct {
 }
 
 type summaryOutput struct {
-	MessageType         string  `json:"message_type"` // "summary"
-	FilesNew            uint    `json:"files_new"`
-	FilesChanged        uint    `json:"files_changed"`
-	FilesUnmodified     uint    `json:"files_unmodified"`
-	DirsNew             uint    `json:"dirs_new"`
-	DirsChanged         uint    `json:"dirs_changed"`
-	DirsUnmodified      uint    `json:"dirs_unmodified"`
-	DataBlobs           int     `json:"data_blobs"`
-	TreeBlobs           int     `json:"tree_blobs"`
-	DataAdded           uint64  `json:"data_added"`
-	TotalFilesProcessed uint    `json:"total_files_processed"`
-	TotalBytesProcessed uint64  `json:"total_bytes_processed"`
-	TotalDuration       float64 `json:"total_duration"` // in seconds
-	SnapshotID          string  `json:"snapshot_id"`
-	DryRun              bool    `json:"dry_run,omitempty"`
+	MessageType         string   `json:"message_type"` // "summary"
+	FilesNew            uint     `json:"files_new"`
+	FilesChanged        uint     `json:"files_changed"`
+	FilesUnmodified     uint     `json:"files_unmodified"`
+	DirsNew             uint     `json:"dirs_new"`
+	DirsChanged         uint     `json:"dirs_changed"`
+	DirsUnmodified      uint     `json:"dirs_unmodified"`
+	DataBlobs           int      `json:"data_blobs"`
+	TreeBlobs           int      `json:"tree_blobs"`
+	DataAdded           uint64   `json:"data_added"`
+	DataSize            uint64   `json:"data_size"`
+	DataSizeInRepo      uint64   `json:"data_size_in_repo"`
+	MetadataSize        uint64   `json:"metadata_size"`
+	MetadataSizeInRepo  uint64   `json:"metadata_size_in_repo"`
+	TotalFilesProcessed uint     `json:"total_files_processed"`
+	TotalBytesProcessed uint64   `json:"total_bytes_processed"`
+	TotalDuration       float64  `json:"total_duration"` // in seconds
+	SnapshotID          string   `json:"snapshot_id"`
+	DryRun              bool     `json:"dry_run,omitempty"`
+	ModifiedFiles       uint     `json:"modified_files,omitempty"`
+	ExpectedBytes       uint64   `json:"expected_bytes,omitempty"`
+	SnapshotSkipped     bool     `json:"snapshot_skipped,omitempty"`
+	FailedItems         []string `json:"failed_items,omitempty"`
+	StalledDuration     float64  `json:"stalled_duration,omitempty"` // in seconds
+	Connections         uint     `json:"connections,omitempty"`
+	ConnectionHistory   []uint   `json:"connection_history,omitempty"`
+	Uploads             uint     `json:"uploads,omitempty"`
+	UploadParallelism   float64  `json:"upload_parallelism,omitempty"`
+	UploadWaitDuration  float64  `json:"upload_wait_duration,omitempty"` // in seconds
+	BytesToRead         uint64   `json:"bytes_to_read,omitempty"`
+	ScannedFiles        uint     `json:"scanned_files,omitempty"`
+	ScannedBytes        uint64   `json:"scanned_bytes,omitempty"`
+}
+
+type dryRunFileUpdate struct {
+	MessageType    string `json:"message_type"` // "dry_run_file"
+	Action         string `json:"action"`
+	Item           string `json:"item"`
+	Reason         string `json:"reason"`
+	Size           uint64 `json:"size"`
+	DataSize       uint64 `json:"data_size"`
+	DataSizeInRepo uint64 `json:"data_size_in_repo"`
 }
@@ -12,20 +12,41 @@ import (
 // A ProgressPrinter can print various progress messages.
 // It must be safe to call its methods from concurrent goroutines.
 type ProgressPrinter interface {
-	Update(total, processed Counter, errors uint, currentFiles map[string]struct{}, start time.Time, secs uint64)
+	Update(total, processed Counter, errors uint, currentFiles map[string]FileProgress, start time.Time, secs uint64)
 	Error(item string, err error) error
 	ScannerError(item string, err error) error
 	CompleteItem(messageType string, item string, s archiver.ItemStats, d time.Duration)
+	// DryRunFile is called instead of CompleteItem for each file which would
+	// be added ("new") or modified ("modified") by a dry run. size is the
+	// size of the file, s contains the data which would be uploaded.
+	DryRunFile(action string, item string, reason archiver.ChangeReason, size uint64, s archiver.ItemStats)
 	ReportTotal(start time.Time, s archiver.ScanStats)
 	Finish(snapshotID restic.ID, start time.Time, summary *Summary, dryRun bool)
 	Reset()
 
 	P(msg string, args ...interface{})
 	V(msg string, args ...interface{})
+	VV(msg string, args ...interface{})
 }
 
 type Counter struct {
 	Files, Dirs, Bytes uint64
+
+	// UnknownSizeBytes is the part of Bytes read from files with an unknown
+	// size. These are not contained in the total, so they are not taken
+	// into account for the percentage and the remaining time.
+	UnknownSizeBytes uint64
+}
+
+// sizedBytes returns the number of bytes which are contained in the total.
+func (c Counter) sizedBytes() uint64 {
+	return c.Bytes - c.UnknownSizeBytes
+}
+
+// FileProgress is the progress of reading a file. Both values are zero until
+// the archiver reports progress for the file.
+type FileProgress struct {
+	Read, Total uint64
 }
 
 type Summary struct {
@@ -35,6 +56,34 @@ type Summary struct {
 		Unchanged uint
 	}
 	ProcessedBytes uint64
+	// ModifiedFiles is the number of files which changed while being read
+	ModifiedFiles uint
+	// ExpectedBytes is the size announced for data read from stdin, zero if
+	// no size was given
+	ExpectedBytes uint64
+	// FailedItems lists the paths for which an error was reported
+	FailedItems []string
+	// Stalled is the time reading was blocked while waiting for the
+	// repository to store data, summed over all readers
+	Stalled time.Duration
+	// Connections is the number of backend connections chosen by the
+	// adaptive limit, zero if the limit is static. ConnectionHistory lists
+	// the previous choices.
+	Connections       uint
+	ConnectionHistory []uint
+	// Uploads is the number of uploaded pack files, UploadParallelism the
+	// average number of concurrent uploads and UploadWaited the time spent
+	// waiting for a free upload slot.
+	Uploads           uint
+	UploadParallelism float64
+	UploadWaited      time.Duration
+	// BytesToRead is the size of the files which are read because they are
+	// new or changed, it is only determined for dry runs.
+	BytesToRead uint64
+	// Scanned are the totals determined by the scanner, nil if the scan
+	// has not finished. They differ from the processed files if files
+	// were modified in the meantime.
+	Scanned *archiver.ScanStats
 	archiver.ItemStats
 }
 
@@ -48,7 +97,8 @@ type Progress struct {
 
 	scanStarted, scanFinished bool
 
-	currentFiles     map[string]struct{}
+	currentFiles     map[string]FileProgress
+	changedFiles     map[string]changedFile
 	processed, total Counter
 	errors           uint
 
@@ -59,7 +109,8 @@ type Progress struct {
 func NewProgress(printer ProgressPrinter, interval time.Duration) *Progress {
 	p := &Progress{
 		start:        time.Now(),
-		currentFiles: make(map[string]struct{}),
+		currentFiles: make(map[string]FileProgress),
+		changedFiles: make(map[string]changedFile),
 		printer:      printer,
 		estimator:    *newRateEstimator(time.Now()),
 	}
@@ -79,8 +130,8 @@ func NewProgress(printer ProgressPrinter, interval time.Duration) *Progress {
 				tooSlowCutoff := 1024.
 				if rate <= tooSlowCutoff {
 					secondsRemaining = 0
-				} else {
-					todo := float64(p.total.Bytes - p.processed.Bytes)
+				} else if done := p.processed.sizedBytes(); done < p.total.Bytes {
+					todo := float64(p.total.Bytes - done)
 					secondsRemaining = uint64(todo / rate)
 				}
 			}
@@ -96,6 +147,7 @@ func (p *Progress) Error(item string, err error) error {
 	p.mu.Lock()
 	p.errors++
 	p.scanStarted = true
+	p.summary.FailedItems = append(p.summary.FailedItems, item)
 	p.mu.Unlock()
 
 	return p.printer.Error(item, err)
@@ -105,17 +157,68 @@ func (p *Progress) Error(item string, err error) error {
 func (p *Progress) StartFile(filename string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.currentFiles[filename] = struct{}{}
+	p.currentFiles[filename] = FileProgress{}
+}
+
+// FileProgress is called periodically while a large file is read.
+func (p *Progress) FileProgress(filename string, read, total uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.currentFiles[filename]; ok {
+		p.currentFiles[filename] = FileProgress{Read: read, Total: total}
+	}
 }
 
 func (p *Progress) addProcessed(c Counter) {
 	p.processed.Files += c.Files
 	p.processed.Dirs += c.Dirs
 	p.processed.Bytes += c.Bytes
-	p.estimator.recordBytes(time.Now(), c.Bytes)
+	p.processed.UnknownSizeBytes += c.UnknownSizeBytes
+	p.estimator.recordBytes(time.Now(), c.sizedBytes())
 	p.scanStarted = true
 }
 
+// Stalled is called with the time reading was blocked by the repository.
+func (p *Progress) Stalled(d time.Duration) {
+	p.mu.Lock()
+	p.summary.Stalled += d
+	p.mu.Unlock()
+}
+
+// Connections is called with the number of backend connections chosen by
+// the adaptive limit and the history of the choices.
+func (p *Progress) Connections(current uint, history []uint) {
+	p.mu.Lock()
+	p.summary.Connections = current
+	p.summary.ConnectionHistory = history
+	p.mu.Unlock()
+}
+
+// Uploads is called with the number of uploaded pack files, their average
+// parallelism and the time spent waiting for a free upload slot.
+func (p *Progress) Uploads(uploads uint, parallelism float64, waited time.Duration) {
+	p.mu.Lock()
+	p.summary.Uploads = uploads
+	p.summary.UploadParallelism = parallelism
+	p.summary.UploadWaited = waited
+	p.mu.Unlock()
+}
+
+type changedFile struct {
+	reason archiver.ChangeReason
+	size   uint64
+}
+
+// ChangedFile is called in dry-run mode for each file which is read because
+// it is new or has changed. The file is reported via DryRunFile once it is
+// complete.
+func (p *Progress) ChangedFile(item string, reason archiver.ChangeReason, size uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.changedFiles[item] = changedFile{reason: reason, size: size}
+	p.summary.BytesToRead += size
+}
+
 // CompleteBlob is called for all saved blobs for files.
 func (p *Progress) CompleteBlob(bytes uint64) {
 	p.mu.Lock()
@@ -123,6 +226,14 @@ func (p *Progress) CompleteBlob(bytes uint64) {
 	p.mu.Unlock()
 }
 
+// CompleteUnknownSizeBlob is called for the saved blobs of files with an
+// unknown size.
+func (p *Progress) CompleteUnknownSizeBlob(bytes uint64) {
+	p.mu.Lock()
+	p.addProcessed(Counter{Bytes: bytes, UnknownSizeBytes: bytes})
+	p.mu.Unlock()
+}
+
 // CompleteItem is the status callback function for the archiver when a
 // file/dir has been saved successfully.
 func (p *Progress) CompleteItem(item string, previous, current *restic.Node, s archiver.ItemStats, d time.Duration) {
@@ -174,11 +285,20 @@ func (p *Progress) CompleteItem(item string, previous, current *restic.Node, s a
 		p.mu.Lock()
 		p.addProcessed(Counter{Files: 1})
 		delete(p.currentFiles, item)
+		if current.ModifiedDuringBackup {
+			p.summary.ModifiedFiles++
+		}
+		changed, isChanged := p.changedFiles[item]
+		delete(p.changedFiles, item)
 		p.mu.Unlock()
 
 		switch {
 		case previous == nil:
-			p.printer.CompleteItem("file new", item, s, d)
+			if isChanged {
+				p.printer.DryRunFile("new", item, changed.reason, changed.size, s)
+			} else {
+				p.printer.CompleteItem("file new", item, s, d)
+			}
 			p.mu.Lock()
 			p.summary.Files.New++
 			p.mu.Unlock()
@@ -190,7 +310,11 @@ func (p *Progress) CompleteItem(item string, previous, current *restic.Node, s a
 			p.mu.Unlock()
 
 		default:
-			p.printer.CompleteItem("file modified", item, s, d)
+			if isChanged {
+				p.printer.DryRunFile("modified", item, changed.reason, changed.size, s)
+			} else {
+				p.printer.CompleteItem("file modified", item, s, d)
+			}
 			p.mu.Lock()
 			p.summary.Files.Changed++
 			p.mu.Unlock()
@@ -208,10 +332,19 @@ func (p *Progress) ReportTotal(item string, s archiver.ScanStats) {
 
 	if item == "" {
 		p.scanFinished = true
+		p.summary.Scanned = &s
 		p.printer.ReportTotal(p.start, s)
 	}
 }
 
+// SetExpectedBytes records the announced size of the data read from stdin.
+// The discrepancy to the number of bytes actually read is reported by Finish.
+func (p *Progress) SetExpectedBytes(bytes uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.summary.ExpectedBytes = bytes
+}
+
 // Finish prints the finishing messages.
 func (p *Progress) Finish(snapshotID restic.ID, dryrun bool) {
 	// wait for the status update goroutine to shut down
@@ -15,7 +15,7 @@ type mockPrinter struct {
 	id                    restic.ID
 }
 
-func (p *mockPrinter) Update(_, _ Counter, _ uint, _ map[string]struct{}, _ time.Time, _ uint64) {
+func (p *mockPrinter) Update(_, _ Counter, _ uint, _ map[string]FileProgress, _ time.Time, _ uint64) {
 }
 func (p *mockPrinter) Error(_ string, err error) error        { return err }
 func (p *mockPrinter) ScannerError(_ string, err error) error { return err }
@@ -32,6 +32,9 @@ func (p *mockPrinter) CompleteItem(messageType string, _ string, _ archiver.Item
 	}
 }
 
+func (p *mockPrinter) DryRunFile(_, _ string, _ archiver.ChangeReason, _ uint64, _ archiver.ItemStats) {
+}
+
 func (p *mockPrinter) ReportTotal(_ time.Time, _ archiver.ScanStats) {}
 func (p *mockPrinter) Finish(id restic.ID, _ time.Time, summary *Summary, _ bool) {
 	p.Lock()
@@ -43,8 +46,9 @@ func (p *mockPrinter) Finish(id restic.ID, _ time.Time, summary *Summary, _ bool
 
 func (p *mockPrinter) Reset() {}
 
-func (p *mockPrinter) P(_ string, _ ...interface{}) {}
-func (p *mockPrinter) V(_ string, _ ...interface{}) {}
+func (p *mockPrinter) P(_ string, _ ...interface{})  {}
+func (p *mockPrinter) V(_ string, _ ...interface{})  {}
+func (p *mockPrinter) VV(_ string, _ ...interface{}) {}
 
 func TestProgress(t *testing.T) {
 	t.Parallel()
@@ -76,3 +80,38 @@ func TestProgress(t *testing.T) {
 		t.Errorf("id not stored (has %v)", prnt.id)
 	}
 }
+
+func TestProgressFileProgress(t *testing.T) {
+	prog := NewProgress(&mockPrinter{}, time.Hour)
+	defer prog.Finish(restic.ID{}, false)
+
+	prog.StartFile("foo")
+	prog.FileProgress("foo", 10, 100)
+	// progress for files which have already completed is ignored
+	prog.FileProgress("bar", 10, 100)
+
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	if len(prog.currentFiles) != 1 || prog.currentFiles["foo"] != (FileProgress{Read: 10, Total: 100}) {
+		t.Errorf("unexpected current files %v", prog.currentFiles)
+	}
+}
+
+func TestProgressUnknownSize(t *testing.T) {
+	prog := NewProgress(&mockPrinter{}, time.Hour)
+	defer prog.Finish(restic.ID{}, false)
+
+	prog.CompleteBlob(100)
+	prog.CompleteUnknownSizeBlob(50)
+
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	want := Counter{Bytes: 150, UnknownSizeBytes: 50}
+	if prog.processed != want {
+		t.Errorf("unexpected processed counter %v, want %v", prog.processed, want)
+	}
+	// only the bytes of files with a known size count towards the total
+	if prog.processed.sizedBytes() != 100 {
+		t.Errorf("unexpected sized bytes %v", prog.processed.sizedBytes())
+	}
+}
@@ -30,7 +30,7 @@ func NewTextProgress(term *termstatus.Terminal, verbosity uint) *TextProgress {
 }
 
 // Update updates the status lines.
-func (b *TextProgress) Update(total, processed Counter, errors uint, currentFiles map[string]struct{}, start time.Time, secs uint64) {
+func (b *TextProgress) Update(total, processed Counter, errors uint, currentFiles map[string]FileProgress, start time.Time, secs uint64) {
 	var status string
 	if total.Files == 0 && total.Dirs == 0 {
 		// no total count available yet
@@ -41,9 +41,9 @@ func (b *TextProgress) Update(total, processed Counter, errors uint, currentFile
 	} else {
 		var eta, percent string
 
-		if secs > 0 && processed.Bytes < total.Bytes {
+		if done := processed.sizedBytes(); secs > 0 && done < total.Bytes {
 			eta = fmt.Sprintf(" ETA %s", ui.FormatSeconds(secs))
-			percent = ui.FormatPercent(processed.Bytes, total.Bytes)
+			percent = ui.FormatPercent(done, total.Bytes)
 			percent += "  "
 		}
 
@@ -61,7 +61,14 @@ func (b *TextProgress) Update(total, processed Counter, errors uint, currentFile
 	}
 
 	lines := make([]string, 0, len(currentFiles)+1)
-	for filename := range currentFiles {
+	for filename, fp := range currentFiles {
+		if fp.Total > 0 {
+			filename = fmt.Sprintf("%v %s (%s / %s)", filename,
+				ui.FormatPercent(fp.Read, fp.Total), ui.FormatBytes(fp.Read), ui.FormatBytes(fp.Total))
+		} else if fp.Read > 0 {
+			// the size of the file is unknown
+			filename = fmt.Sprintf("%v (%s)", filename, ui.FormatBytes(fp.Read))
+		}
 		lines = append(lines, filename)
 	}
 	sort.Strings(lines)
@@ -110,12 +117,27 @@ func (b *TextProgress) CompleteItem(messageType, item string, s archiver.ItemSta
 	}
 }
 
+// DryRunFile prints a file which would be added or modified by a dry run.
+func (b *TextProgress) DryRunFile(action, item string, reason archiver.ChangeReason, size uint64, s archiver.ItemStats) {
+	verb := "would add   "
+	if action == "modified" {
+		verb = "would modify"
+	}
+	b.V("%s %v (%s, %s), %v to upload", verb, termstatus.Quote(item), ui.FormatBytes(size), reason,
+		ui.FormatBytes(s.DataSize))
+}
+
 // ReportTotal sets the total stats up to now
 func (b *TextProgress) ReportTotal(start time.Time, s archiver.ScanStats) {
 	b.V("scan finished in %.3fs: %v files, %s",
 		time.Since(start).Seconds(),
 		s.Files, ui.FormatBytes(s.Bytes),
 	)
+	if s.ExcludedFiles > 0 || s.ExcludedDirs > 0 {
+		b.V("excluded %v files, %v dirs (%s)",
+			s.ExcludedFiles, s.ExcludedDirs, ui.FormatBytes(s.ExcludedBytes),
+		)
+	}
 }
 
 // Reset status
@@ -130,19 +152,53 @@ func (b *TextProgress) Finish(_ restic.ID, start time.Time, summary *Summary, dr
 	b.P("\n")
 	b.P("Files:       %5d new, %5d changed, %5d unmodified\n", summary.Files.New, summary.Files.Changed, summary.Files.Unchanged)
 	b.P("Dirs:        %5d new, %5d changed, %5d unmodified\n", summary.Dirs.New, summary.Dirs.Changed, summary.Dirs.Unchanged)
-	b.V("Data Blobs:  %5d new\n", summary.ItemStats.DataBlobs)
-	b.V("Tree Blobs:  %5d new\n", summary.ItemStats.TreeBlobs)
+	b.V("Data Blobs:  %5d new, %-5s (%-5s stored)\n", summary.ItemStats.DataBlobs,
+		ui.FormatBytes(summary.ItemStats.DataSize), ui.FormatBytes(summary.ItemStats.DataSizeInRepo))
+	b.V("Tree Blobs:  %5d new, %-5s (%-5s stored)\n", summary.ItemStats.TreeBlobs,
+		ui.FormatBytes(summary.ItemStats.TreeSize), ui.FormatBytes(summary.ItemStats.TreeSizeInRepo))
+	if summary.Stalled > 0 {
+		b.V("Stalled:     %5s waiting for the repository to store data\n", ui.FormatDuration(summary.Stalled))
+	}
+	if summary.Connections > 0 {
+		b.V("Connections: %5d chosen adaptively, history: %v\n", summary.Connections, summary.ConnectionHistory)
+	}
+	if summary.Uploads > 0 {
+		b.V("Uploads:     %5d packs, %.1f in parallel on average, %s waiting for upload slots\n",
+			summary.Uploads, summary.UploadParallelism, ui.FormatDuration(summary.UploadWaited))
+	}
 	verb := "Added"
 	if dryRun {
 		verb = "Would add"
+		b.P("Would read %v from new and changed files\n", ui.FormatBytes(summary.BytesToRead))
 	}
 	b.P("%s to the repository: %-5s (%-5s stored)\n", verb,
 		ui.FormatBytes(summary.ItemStats.DataSize+summary.ItemStats.TreeSize),
 		ui.FormatBytes(summary.ItemStats.DataSizeInRepo+summary.ItemStats.TreeSizeInRepo))
+	if dryRun && summary.Scanned != nil {
+		processed := summary.Files.New + summary.Files.Changed + summary.Files.Unchanged
+		b.P("Scanned %v files, %v, processed %v files, %v\n", summary.Scanned.Files,
+			ui.FormatBytes(summary.Scanned.Bytes), processed, ui.FormatBytes(summary.ProcessedBytes))
+		if summary.Scanned.Files != processed || summary.Scanned.Bytes != summary.ProcessedBytes {
+			b.P("Note: the scan differs as files were modified in the meantime or are hard links to the same file\n")
+		}
+	}
 	b.P("\n")
 	b.P("processed %v files, %v in %s",
 		summary.Files.New+summary.Files.Changed+summary.Files.Unchanged,
 		ui.FormatBytes(summary.ProcessedBytes),
 		ui.FormatDuration(time.Since(start)),
 	)
+	if summary.ModifiedFiles > 0 {
+		b.E("\nWarning: %d files were modified while being read, their contents in the snapshot may be inconsistent\n", summary.ModifiedFiles)
+	}
+	if len(summary.FailedItems) > 0 {
+		b.E("\nWarning: the snapshot is incomplete, %d items could not be read:\n", len(summary.FailedItems))
+		for _, item := range summary.FailedItems {
+			b.E("  %v\n", item)
+		}
+	}
+	if summary.ExpectedBytes > 0 && summary.ExpectedBytes != summary.ProcessedBytes {
+		b.E("\nNote: read %v from stdin, but the expected size was %v\n",
+			ui.FormatBytes(summary.ProcessedBytes), ui.FormatBytes(summary.ExpectedBytes))
+	}
 }
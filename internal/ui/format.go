@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/bits"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -60,12 +61,17 @@ func FormatSeconds(sec uint64) string {
 }
 
 // ParseBytes parses a size in bytes from s. It understands the suffixes
-// B, K, M, G and T for powers of 1024.
+// B, K, M, G and T for powers of 1024, the latter four may also be written as
+// KiB, MiB, GiB and TiB.
 func ParseBytes(s string) (int64, error) {
 	if s == "" {
 		return 0, errors.New("expected size, got empty string")
 	}
 
+	if n := len(s); n >= 3 && strings.EqualFold(s[n-2:], "ib") && strings.ContainsRune("kKmMgGtT", rune(s[n-3])) {
+		s = s[:n-2]
+	}
+
 	numStr := s[:len(s)-1]
 	var unit uint64 = 1
 
@@ -58,6 +58,11 @@ func TestParseBytes(t *testing.T) {
 		{"10g", 10737418240},
 		{"2T", 2199023255552},
 		{"2t", 2199023255552},
+		{"1KiB", 1024},
+		{"10MiB", 10485760},
+		{"2GiB", 2147483648},
+		{"2gib", 2147483648},
+		{"1TiB", 1099511627776},
 		{"9223372036854775807", 1<<63 - 1},
 	} {
 		actual, err := ParseBytes(tt.in)
@@ -72,6 +77,8 @@ func TestParseBytesInvalid(t *testing.T) {
 		" ",
 		"foobar",
 		"zzz",
+		"1iB",
+		"GiB",
 		"18446744073709551615", // 1<<64-1.
 		"9223372036854775807k", // 1<<63-1 kiB.
 		"9999999999999M",
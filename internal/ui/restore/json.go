@@ -6,13 +6,19 @@ import (
 	"github.com/restic/restic/internal/ui"
 )
 
+// JSONVersion is the version of the JSON messages printed by restore. It is
+// incremented for changes which are not backwards compatible.
+const JSONVersion = 1
+
 type jsonPrinter struct {
-	terminal term
+	terminal  term
+	verbosity uint
 }
 
-func NewJSONProgress(terminal term) ProgressPrinter {
+func NewJSONProgress(terminal term, verbosity uint) ProgressPrinter {
 	return &jsonPrinter{
-		terminal: terminal,
+		terminal:  terminal,
+		verbosity: verbosity,
 	}
 }
 
@@ -23,6 +29,7 @@ func (t *jsonPrinter) print(status interface{}) {
 func (t *jsonPrinter) Update(filesFinished, filesTotal, allBytesWritten, allBytesTotal uint64, duration time.Duration) {
 	status := statusUpdate{
 		MessageType:    "status",
+		Version:        JSONVersion,
 		SecondsElapsed: uint64(duration / time.Second),
 		TotalFiles:     filesTotal,
 		FilesRestored:  filesFinished,
@@ -33,6 +40,10 @@ func (t *jsonPrinter) Update(filesFinished, filesTotal, allBytesWritten, allByte
 	if allBytesTotal > 0 {
 		status.PercentDone = float64(allBytesWritten) / float64(allBytesTotal)
 	}
+	if allBytesWritten > 0 && allBytesTotal > allBytesWritten {
+		// extrapolate from the average throughput so far
+		status.SecondsRemaining = uint64(duration.Seconds() / float64(allBytesWritten) * float64(allBytesTotal-allBytesWritten))
+	}
 
 	t.print(status)
 }
@@ -40,6 +51,7 @@ func (t *jsonPrinter) Update(filesFinished, filesTotal, allBytesWritten, allByte
 func (t *jsonPrinter) Finish(filesFinished, filesTotal, allBytesWritten, allBytesTotal uint64, duration time.Duration) {
 	status := summaryOutput{
 		MessageType:    "summary",
+		Version:        JSONVersion,
 		SecondsElapsed: uint64(duration / time.Second),
 		TotalFiles:     filesTotal,
 		FilesRestored:  filesFinished,
@@ -49,21 +61,83 @@ func (t *jsonPrinter) Finish(filesFinished, filesTotal, allBytesWritten, allByte
 	t.print(status)
 }
 
+func (t *jsonPrinter) StartItem(item string, size uint64) {
+	if t.verbosity < 2 {
+		return
+	}
+
+	t.print(verboseUpdate{
+		MessageType: "verbose_status",
+		Version:     JSONVersion,
+		Action:      "started",
+		Item:        item,
+		Size:        size,
+	})
+}
+
+func (t *jsonPrinter) CompleteItem(action ItemAction, item string, size uint64) {
+	if t.verbosity < 2 {
+		return
+	}
+
+	t.print(verboseUpdate{
+		MessageType: "verbose_status",
+		Version:     JSONVersion,
+		Action:      string(action),
+		Item:        item,
+		Size:        size,
+	})
+}
+
+func (t *jsonPrinter) Error(item string, err error) error {
+	var status errorUpdate
+	status.MessageType = "error"
+	status.Version = JSONVersion
+	status.Error.Message = err.Error()
+	status.During = "restore"
+	status.Item = item
+	t.print(status)
+	return nil
+}
+
 type statusUpdate struct {
-	MessageType    string  `json:"message_type"` // "status"
-	SecondsElapsed uint64  `json:"seconds_elapsed,omitempty"`
-	PercentDone    float64 `json:"percent_done"`
-	TotalFiles     uint64  `json:"total_files,omitempty"`
-	FilesRestored  uint64  `json:"files_restored,omitempty"`
-	TotalBytes     uint64  `json:"total_bytes,omitempty"`
-	BytesRestored  uint64  `json:"bytes_restored,omitempty"`
+	MessageType      string  `json:"message_type"` // "status"
+	Version          int     `json:"version"`
+	SecondsElapsed   uint64  `json:"seconds_elapsed,omitempty"`
+	SecondsRemaining uint64  `json:"seconds_remaining,omitempty"`
+	PercentDone      float64 `json:"percent_done"`
+	TotalFiles       uint64  `json:"total_files,omitempty"`
+	FilesRestored    uint64  `json:"files_restored,omitempty"`
+	TotalBytes       uint64  `json:"total_bytes,omitempty"`
+	BytesRestored    uint64  `json:"bytes_restored,omitempty"`
+}
+
+type errorObject struct {
+	Message string `json:"message"`
+}
+
+type errorUpdate struct {
+	MessageType string      `json:"message_type"` // "error"
+	Version     int         `json:"version"`
+	Error       errorObject `json:"error"`
+	During      string      `json:"during"`
+	Item        string      `json:"item"`
 }
 
 type summaryOutput struct {
 	MessageType    string `json:"message_type"` // "summary"
+	Version        int    `json:"version"`
 	SecondsElapsed uint64 `json:"seconds_elapsed,omitempty"`
 	TotalFiles     uint64 `json:"total_files,omitempty"`
 	FilesRestored  uint64 `json:"files_restored,omitempty"`
 	TotalBytes     uint64 `json:"total_bytes,omitempty"`
 	BytesRestored  uint64 `json:"bytes_restored,omitempty"`
 }
+
+type verboseUpdate struct {
+	MessageType string `json:"message_type"` // "verbose_status"
+	Version     int    `json:"version"`
+	Action      string `json:"action"`
+	Item        string `json:"item"`
+	Size        uint64 `json:"size"`
+}
@@ -1,6 +1,7 @@
 package restore
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -9,21 +10,47 @@ import (
 
 func TestJSONPrintUpdate(t *testing.T) {
 	term := &mockTerm{}
-	printer := NewJSONProgress(term)
+	printer := NewJSONProgress(term, 2)
 	printer.Update(3, 11, 29, 47, 5*time.Second)
-	test.Equals(t, []string{"{\"message_type\":\"status\",\"seconds_elapsed\":5,\"percent_done\":0.6170212765957447,\"total_files\":11,\"files_restored\":3,\"total_bytes\":47,\"bytes_restored\":29}\n"}, term.output)
+	test.Equals(t, []string{"{\"message_type\":\"status\",\"version\":1,\"seconds_elapsed\":5,\"seconds_remaining\":3,\"percent_done\":0.6170212765957447,\"total_files\":11,\"files_restored\":3,\"total_bytes\":47,\"bytes_restored\":29}\n"}, term.output)
 }
 
 func TestJSONPrintSummaryOnSuccess(t *testing.T) {
 	term := &mockTerm{}
-	printer := NewJSONProgress(term)
+	printer := NewJSONProgress(term, 2)
 	printer.Finish(11, 11, 47, 47, 5*time.Second)
-	test.Equals(t, []string{"{\"message_type\":\"summary\",\"seconds_elapsed\":5,\"total_files\":11,\"files_restored\":11,\"total_bytes\":47,\"bytes_restored\":47}\n"}, term.output)
+	test.Equals(t, []string{"{\"message_type\":\"summary\",\"version\":1,\"seconds_elapsed\":5,\"total_files\":11,\"files_restored\":11,\"total_bytes\":47,\"bytes_restored\":47}\n"}, term.output)
 }
 
 func TestJSONPrintSummaryOnErrors(t *testing.T) {
 	term := &mockTerm{}
-	printer := NewJSONProgress(term)
+	printer := NewJSONProgress(term, 2)
 	printer.Finish(3, 11, 29, 47, 5*time.Second)
-	test.Equals(t, []string{"{\"message_type\":\"summary\",\"seconds_elapsed\":5,\"total_files\":11,\"files_restored\":3,\"total_bytes\":47,\"bytes_restored\":29}\n"}, term.output)
+	test.Equals(t, []string{"{\"message_type\":\"summary\",\"version\":1,\"seconds_elapsed\":5,\"total_files\":11,\"files_restored\":3,\"total_bytes\":47,\"bytes_restored\":29}\n"}, term.output)
+}
+
+func TestJSONPrintStartItem(t *testing.T) {
+	term := &mockTerm{}
+	printer := NewJSONProgress(term, 2)
+	printer.StartItem("test", 10)
+	test.Equals(t, []string{"{\"message_type\":\"verbose_status\",\"version\":1,\"action\":\"started\",\"item\":\"test\",\"size\":10}\n"}, term.output)
+
+	// only printed with -v
+	term = &mockTerm{}
+	NewJSONProgress(term, 1).StartItem("test", 10)
+	test.Equals(t, []string(nil), term.output)
+}
+
+func TestJSONPrintCompleteItem(t *testing.T) {
+	term := &mockTerm{}
+	printer := NewJSONProgress(term, 2)
+	printer.CompleteItem(ActionSkipped, "test", 10)
+	test.Equals(t, []string{"{\"message_type\":\"verbose_status\",\"version\":1,\"action\":\"skipped\",\"item\":\"test\",\"size\":10}\n"}, term.output)
+}
+
+func TestJSONPrintError(t *testing.T) {
+	term := &mockTerm{}
+	printer := NewJSONProgress(term, 2)
+	test.OK(t, printer.Error("/path", errors.New("error \"message\"")))
+	test.Equals(t, []string{"{\"message_type\":\"error\",\"version\":1,\"error\":{\"message\":\"error \\\"message\\\"\"},\"during\":\"restore\",\"item\":\"/path\"}\n"}, term.output)
 }
@@ -24,16 +24,44 @@ type Progress struct {
 type progressInfoEntry struct {
 	bytesWritten uint64
 	bytesTotal   uint64
+	action       ItemAction
 }
 
+// ItemAction describes how an item was handled by the restore.
+type ItemAction string
+
+const (
+	// ActionRestored is used for items which did not exist before.
+	ActionRestored ItemAction = "restored"
+	// ActionReplaced is used for existing items which were overwritten.
+	ActionReplaced ItemAction = "replaced"
+	// ActionPatched is used for existing files of which only the changed
+	// parts were written.
+	ActionPatched ItemAction = "patched"
+	// ActionSkipped is used for existing items which were left untouched.
+	ActionSkipped ItemAction = "skipped"
+	// ActionDeleted is used for items which were removed, as they are not
+	// contained in the snapshot.
+	ActionDeleted ItemAction = "deleted"
+)
+
 type term interface {
 	Print(line string)
+	Error(line string)
 	SetStatus(lines []string)
 }
 
 type ProgressPrinter interface {
 	Update(filesFinished, filesTotal, allBytesWritten, allBytesTotal uint64, duration time.Duration)
 	Finish(filesFinished, filesTotal, allBytesWritten, allBytesTotal uint64, duration time.Duration)
+	// StartItem is called before the first bytes of a file are written. It
+	// is always called before CompleteItem for the same file.
+	StartItem(item string, size uint64)
+	// CompleteItem is called once an item has been handled.
+	CompleteItem(action ItemAction, item string, size uint64)
+	// Error reports an error for an item, the restore continues unless an
+	// error is returned.
+	Error(item string, err error) error
 }
 
 func NewProgress(printer ProgressPrinter, interval time.Duration) *Progress {
@@ -67,13 +95,15 @@ func (p *Progress) AddFile(size uint64) {
 }
 
 // AddProgress accumulates the number of bytes written for a file
-func (p *Progress) AddProgress(name string, bytesWrittenPortion uint64, bytesTotal uint64) {
+func (p *Progress) AddProgress(name string, action ItemAction, bytesWrittenPortion uint64, bytesTotal uint64) {
 	p.m.Lock()
 	defer p.m.Unlock()
 
 	entry, exists := p.progressInfoMap[name]
 	if !exists {
 		entry.bytesTotal = bytesTotal
+		entry.action = action
+		p.printer.StartItem(name, bytesTotal)
 	}
 	entry.bytesWritten += bytesWrittenPortion
 	p.progressInfoMap[name] = entry
@@ -82,9 +112,41 @@ func (p *Progress) AddProgress(name string, bytesWrittenPortion uint64, bytesTot
 	if entry.bytesWritten == entry.bytesTotal {
 		delete(p.progressInfoMap, name)
 		p.filesFinished++
+		p.printer.CompleteItem(entry.action, name, entry.bytesTotal)
 	}
 }
 
+// AddSkippedFile marks a file which was added using AddFile as finished
+// without writing it.
+func (p *Progress) AddSkippedFile(name string, size uint64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.allBytesWritten += size
+	p.filesFinished++
+	p.printer.CompleteItem(ActionSkipped, name, size)
+}
+
+// AddDeletedItem reports an item which was removed from the target.
+func (p *Progress) AddDeletedItem(name string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.printer.CompleteItem(ActionDeleted, name, 0)
+}
+
+// Error reports an error for the given item. The error is passed to the
+// printer while holding the lock, such that it is ordered with respect to the
+// other events for the item.
+func (p *Progress) Error(item string, err error) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.printer.Error(item, err)
+}
+
+// Finish stops the progress updates and prints the summary. It must also be
+// called if the restore was aborted.
 func (p *Progress) Finish() {
 	p.updater.Done()
 }
@@ -1,6 +1,7 @@
 package restore
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -17,7 +18,8 @@ type printerTraceEntry struct {
 type printerTrace []printerTraceEntry
 
 type mockPrinter struct {
-	trace printerTrace
+	trace  printerTrace
+	events []string
 }
 
 const mockFinishDuration = 42 * time.Second
@@ -25,6 +27,16 @@ const mockFinishDuration = 42 * time.Second
 func (p *mockPrinter) Update(filesFinished, filesTotal, allBytesWritten, allBytesTotal uint64, duration time.Duration) {
 	p.trace = append(p.trace, printerTraceEntry{filesFinished, filesTotal, allBytesWritten, allBytesTotal, duration, false})
 }
+func (p *mockPrinter) StartItem(item string, _ uint64) {
+	p.events = append(p.events, "started "+item)
+}
+func (p *mockPrinter) CompleteItem(action ItemAction, item string, _ uint64) {
+	p.events = append(p.events, string(action)+" "+item)
+}
+func (p *mockPrinter) Error(item string, err error) error {
+	p.events = append(p.events, "error "+item+": "+err.Error())
+	return nil
+}
 func (p *mockPrinter) Finish(filesFinished, filesTotal, allBytesWritten, allBytesTotal uint64, _ time.Duration) {
 	p.trace = append(p.trace, printerTraceEntry{filesFinished, filesTotal, allBytesWritten, allBytesTotal, mockFinishDuration, true})
 }
@@ -67,7 +79,7 @@ func TestFirstProgressOnAFile(t *testing.T) {
 
 	result := testProgress(func(progress *Progress) bool {
 		progress.AddFile(expectedBytesTotal)
-		progress.AddProgress("test", expectedBytesWritten, expectedBytesTotal)
+		progress.AddProgress("test", ActionRestored, expectedBytesWritten, expectedBytesTotal)
 		return false
 	})
 	test.Equals(t, printerTrace{
@@ -80,9 +92,9 @@ func TestLastProgressOnAFile(t *testing.T) {
 
 	result := testProgress(func(progress *Progress) bool {
 		progress.AddFile(fileSize)
-		progress.AddProgress("test", 30, fileSize)
-		progress.AddProgress("test", 35, fileSize)
-		progress.AddProgress("test", 35, fileSize)
+		progress.AddProgress("test", ActionRestored, 30, fileSize)
+		progress.AddProgress("test", ActionRestored, 35, fileSize)
+		progress.AddProgress("test", ActionRestored, 35, fileSize)
 		return false
 	})
 	test.Equals(t, printerTrace{
@@ -96,9 +108,9 @@ func TestLastProgressOnLastFile(t *testing.T) {
 	result := testProgress(func(progress *Progress) bool {
 		progress.AddFile(fileSize)
 		progress.AddFile(50)
-		progress.AddProgress("test1", 50, 50)
-		progress.AddProgress("test2", 50, fileSize)
-		progress.AddProgress("test2", 50, fileSize)
+		progress.AddProgress("test1", ActionRestored, 50, 50)
+		progress.AddProgress("test2", ActionRestored, 50, fileSize)
+		progress.AddProgress("test2", ActionRestored, 50, fileSize)
 		return false
 	})
 	test.Equals(t, printerTrace{
@@ -112,8 +124,8 @@ func TestSummaryOnSuccess(t *testing.T) {
 	result := testProgress(func(progress *Progress) bool {
 		progress.AddFile(fileSize)
 		progress.AddFile(50)
-		progress.AddProgress("test1", 50, 50)
-		progress.AddProgress("test2", fileSize, fileSize)
+		progress.AddProgress("test1", ActionRestored, 50, 50)
+		progress.AddProgress("test2", ActionRestored, fileSize, fileSize)
 		return true
 	})
 	test.Equals(t, printerTrace{
@@ -127,11 +139,35 @@ func TestSummaryOnErrors(t *testing.T) {
 	result := testProgress(func(progress *Progress) bool {
 		progress.AddFile(fileSize)
 		progress.AddFile(50)
-		progress.AddProgress("test1", 50, 50)
-		progress.AddProgress("test2", fileSize/2, fileSize)
+		progress.AddProgress("test1", ActionRestored, 50, 50)
+		progress.AddProgress("test2", ActionRestored, fileSize/2, fileSize)
 		return true
 	})
 	test.Equals(t, printerTrace{
 		printerTraceEntry{1, 2, 50 + fileSize/2, 50 + fileSize, mockFinishDuration, true},
 	}, result)
 }
+
+func TestItemEvents(t *testing.T) {
+	printer := &mockPrinter{}
+	progress := NewProgress(printer, 0)
+	progress.AddFile(100)
+	progress.AddFile(50)
+	progress.AddFile(10)
+	progress.AddProgress("test1", ActionRestored, 30, 100)
+	progress.AddProgress("test2", ActionReplaced, 50, 50)
+	progress.AddProgress("test1", ActionRestored, 70, 100)
+	progress.AddSkippedFile("test3", 10)
+	test.OK(t, progress.Error("test4", errors.New("broken")))
+	progress.Finish()
+
+	test.Equals(t, []string{
+		"started test1",
+		"started test2",
+		"replaced test2",
+		"restored test1",
+		"skipped test3",
+		"error test4: broken",
+	}, printer.events)
+	test.Equals(t, printerTraceEntry{3, 3, 160, 160, mockFinishDuration, true}, printer.trace[len(printer.trace)-1])
+}
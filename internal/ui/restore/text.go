@@ -8,12 +8,14 @@ import (
 )
 
 type textPrinter struct {
-	terminal term
+	terminal  term
+	verbosity uint
 }
 
-func NewTextProgress(terminal term) ProgressPrinter {
+func NewTextProgress(terminal term, verbosity uint) ProgressPrinter {
 	return &textPrinter{
-		terminal: terminal,
+		terminal:  terminal,
+		verbosity: verbosity,
 	}
 }
 
@@ -45,3 +47,23 @@ func (t *textPrinter) Finish(filesFinished, filesTotal, allBytesWritten, allByte
 
 	t.terminal.Print(summary)
 }
+
+func (t *textPrinter) CompleteItem(action ItemAction, item string, size uint64) {
+	if t.verbosity < 3 {
+		return
+	}
+
+	switch action {
+	case ActionDeleted:
+		t.terminal.Print(fmt.Sprintf("%-9v %v", action, item))
+	default:
+		t.terminal.Print(fmt.Sprintf("%-9v %v with size %v", action, item, ui.FormatBytes(size)))
+	}
+}
+
+func (t *textPrinter) StartItem(_ string, _ uint64) {}
+
+func (t *textPrinter) Error(item string, err error) error {
+	t.terminal.Error(fmt.Sprintf("ignoring error for %s: %s", item, err))
+	return nil
+}
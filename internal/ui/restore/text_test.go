@@ -1,6 +1,7 @@
 package restore
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -9,33 +10,67 @@ import (
 
 type mockTerm struct {
 	output []string
+	errors []string
 }
 
 func (m *mockTerm) Print(line string) {
 	m.output = append(m.output, line)
 }
 
+func (m *mockTerm) Error(line string) {
+	m.errors = append(m.errors, line)
+}
+
 func (m *mockTerm) SetStatus(lines []string) {
 	m.output = append([]string{}, lines...)
 }
 
 func TestPrintUpdate(t *testing.T) {
 	term := &mockTerm{}
-	printer := NewTextProgress(term)
+	printer := NewTextProgress(term, 3)
 	printer.Update(3, 11, 29, 47, 5*time.Second)
 	test.Equals(t, []string{"[0:05] 61.70%  3 files/dirs 29 B, total 11 files/dirs 47 B"}, term.output)
 }
 
 func TestPrintSummaryOnSuccess(t *testing.T) {
 	term := &mockTerm{}
-	printer := NewTextProgress(term)
+	printer := NewTextProgress(term, 3)
 	printer.Finish(11, 11, 47, 47, 5*time.Second)
 	test.Equals(t, []string{"Summary: Restored 11 files/dirs (47 B) in 0:05"}, term.output)
 }
 
 func TestPrintSummaryOnErrors(t *testing.T) {
 	term := &mockTerm{}
-	printer := NewTextProgress(term)
+	printer := NewTextProgress(term, 3)
 	printer.Finish(3, 11, 29, 47, 5*time.Second)
 	test.Equals(t, []string{"Summary: Restored 3 / 11 files/dirs (29 B / 47 B) in 0:05"}, term.output)
 }
+
+func TestPrintCompleteItem(t *testing.T) {
+	for _, data := range []struct {
+		action   ItemAction
+		size     uint64
+		expected string
+	}{
+		{ActionRestored, 10, "restored  test with size 10 B"},
+		{ActionSkipped, 10, "skipped   test with size 10 B"},
+		{ActionDeleted, 0, "deleted   test"},
+	} {
+		term := &mockTerm{}
+		printer := NewTextProgress(term, 3)
+		printer.CompleteItem(data.action, "test", data.size)
+		test.Equals(t, []string{data.expected}, term.output)
+	}
+
+	// only printed with -vv
+	term := &mockTerm{}
+	NewTextProgress(term, 2).CompleteItem(ActionRestored, "test", 10)
+	test.Equals(t, []string(nil), term.output)
+}
+
+func TestPrintError(t *testing.T) {
+	term := &mockTerm{}
+	printer := NewTextProgress(term, 3)
+	test.OK(t, printer.Error("/path", errors.New("error \"message\"")))
+	test.Equals(t, []string{"ignoring error for /path: error \"message\""}, term.errors)
+}
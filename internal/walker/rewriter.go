@@ -20,6 +20,9 @@ type RewriteOpts struct {
 
 	AllowUnstableSerialization bool
 	DisableNodeCache           bool
+	// BlobHasher computes the tree IDs for checking the serialization, it
+	// must match the repository the trees are loaded from.
+	BlobHasher restic.BlobHasher
 }
 
 type idMap map[restic.ID]restic.ID
@@ -57,6 +60,18 @@ type BlobLoadSaver interface {
 	restic.BlobLoader
 }
 
+// hashOnlySaver computes the ID of a blob without storing it.
+type hashOnlySaver struct {
+	hasher restic.BlobHasher
+}
+
+func (s hashOnlySaver) SaveBlob(_ context.Context, _ restic.BlobType, buf []byte, id restic.ID, _ bool) (restic.ID, bool, int, error) {
+	if id.IsNull() {
+		id = s.hasher.Hash(buf)
+	}
+	return id, false, len(buf), nil
+}
+
 func (t *TreeRewriter) RewriteTree(ctx context.Context, repo BlobLoadSaver, nodepath string, nodeID restic.ID) (newNodeID restic.ID, err error) {
 	// check if tree was already changed
 	newID, ok := t.replaces[nodeID]
@@ -74,7 +89,7 @@ func (t *TreeRewriter) RewriteTree(ctx context.Context, repo BlobLoadSaver, node
 		// check that we can properly encode this tree without losing information
 		// The alternative of using json/Decoder.DisallowUnknownFields() doesn't work as we use
 		// a custom UnmarshalJSON to decode trees, see also https://github.com/golang/go/issues/41144
-		testID, err := restic.SaveTree(ctx, repo, curTree)
+		testID, err := restic.SaveTree(ctx, hashOnlySaver{hasher: t.opts.BlobHasher}, curTree)
 		if err != nil {
 			return restic.ID{}, err
 		}